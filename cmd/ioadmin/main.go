@@ -0,0 +1,204 @@
+// Command ioadmin runs maintenance tasks against a storage directory and its
+// metadata database while the service is stopped or running.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/zots0127/io/pkg/api/handler"
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/config"
+	"github.com/zots0127/io/pkg/metadata/repository"
+)
+
+// commands maps each subcommand to its implementation
+var commands = map[string]func(args []string) error{
+	"rotate-keys": rotateKeys,
+	"migrate":     migrateSchema,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: ioadmin <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  rotate-keys   re-wrap every blob's data key with the primary master key")
+	fmt.Fprintln(os.Stderr, "  migrate       show, apply or roll back metadata database schema migrations")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'ioadmin <command> -h' for the flags of a command.")
+}
+
+// rotateKeys re-wraps data keys with the primary key. Blob content is not
+// rewritten, so it is quick and safe to run while the service is serving.
+// The storage is opened as the service opens it, with every backend it
+// mounts, so blobs kept outside the local root are rotated too.
+func rotateKeys(args []string) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	configFile := flags.String("config", "", "Configuration file of the service")
+	storagePath := flags.String("storage", "", "Storage directory (default from the configuration)")
+	dbPath := flags.String("db", "", "Metadata database (default from the configuration)")
+	keyFile := flags.String("key-file", "", "Key file, primary key first (default from the configuration or $STORAGE_ENCRYPTION_KEY_FILE)")
+	flags.Parse(args)
+
+	appConfig, err := config.NewConfigManager().Load(*configFile)
+	if err != nil {
+		return err
+	}
+	if *storagePath != "" {
+		appConfig.Storage.Path = *storagePath
+	}
+	if *dbPath != "" {
+		appConfig.Database.Name = *dbPath
+	}
+	if *keyFile != "" {
+		appConfig.Storage.EncryptionKeyFile = *keyFile
+	}
+
+	storage, err := handler.OpenStorage(appConfig)
+	if err != nil {
+		return err
+	}
+	keyring := storage.Encryption()
+	if keyring == nil {
+		return fmt.Errorf("no encryption key configured: pass -key-file or set STORAGE_ENCRYPTION_KEY")
+	}
+	if err := handler.MountBackends(storage); err != nil {
+		return err
+	}
+
+	metadataRepo, err := repository.NewMetadataRepository(appConfig.Database.Name)
+	if err != nil {
+		return err
+	}
+	defer metadataRepo.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	chunks := chunkstore.NewStore(storage, metadataRepo, nil).Chunks()
+
+	fmt.Printf("Rotating data keys to primary key %s\n", keyring.Primary())
+
+	rotated, err := storage.RotateKeys(ctx, metadataRepo.SetBlobKeyID)
+	fmt.Printf("Blobs re-wrapped: %d\n", rotated)
+	if err != nil {
+		return err
+	}
+
+	rotated, err = chunks.RotateKeys(ctx, nil)
+	fmt.Printf("Chunks re-wrapped: %d\n", rotated)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Rotation complete. Keys no longer listed in encrypted_blobs_by_key can be removed from the key file.")
+	return nil
+}
+
+// migrateSchema shows the schema migrations of the metadata database, or
+// migrates it up or down. The database is backed up before it is changed.
+// Stop the service before migrating down: it expects the latest schema.
+func migrateSchema(args []string) error {
+	if len(args) < 1 || (args[0] != "status" && args[0] != "up" && args[0] != "down") {
+		return fmt.Errorf("usage: ioadmin migrate <status|up|down> [flags]")
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("migrate "+action, flag.ExitOnError)
+	dbPath := flags.String("db", "./storage.db", "Metadata database")
+	to := flags.Int("to", -1, "Schema version to migrate to (default: the latest for up, the previous one for down)")
+	flags.Parse(args[1:])
+
+	migrator, err := repository.NewSchemaMigrator(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	version, unversioned, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+
+	target := *to
+	switch action {
+	case "status":
+		return printSchemaStatus(migrator, version, unversioned)
+	case "up":
+		if target < 0 {
+			target = migrator.Latest()
+		}
+		if target < version {
+			return fmt.Errorf("database is at version %d, use down to go back to %d", version, target)
+		}
+	case "down":
+		if target < 0 {
+			target = version - 1
+		}
+		if target > version || target < 0 {
+			return fmt.Errorf("database is at version %d, cannot go down to %d", version, target)
+		}
+	}
+
+	ran, err := migrator.Migrate(target)
+	for _, migration := range ran {
+		verb := "Applied"
+		if migration.AppliedAt == nil {
+			verb = "Rolled back"
+		}
+		fmt.Printf("%s %04d_%s\n", verb, migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Database is at schema version %d\n", target)
+	return nil
+}
+
+// printSchemaStatus lists every schema migration and whether it was applied
+func printSchemaStatus(migrator *repository.SchemaMigrator, version int, unversioned bool) error {
+	status, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Schema version: %d (latest %d)\n", version, migrator.Latest())
+	if unversioned {
+		fmt.Println("The database predates schema versions and has the first schema; it is recorded at version 1 on the next migration.")
+	}
+	fmt.Println()
+
+	for _, migration := range status {
+		applied := "pending"
+		if migration.AppliedAt != nil {
+			applied = "applied " + migration.AppliedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("  %04d_%-24s %s\n", migration.Version, migration.Name, applied)
+	}
+	return nil
+}
@@ -13,9 +13,10 @@ import (
 	"time"
 
 	"github.com/zots0127/io/pkg/api"
+	"github.com/zots0127/io/pkg/api/handler"
 	"github.com/zots0127/io/pkg/config"
+	"github.com/zots0127/io/pkg/metadata/repository"
 	"github.com/zots0127/io/pkg/service"
-	storageservice "github.com/zots0127/io/pkg/storage/service"
 	"github.com/zots0127/io/pkg/web"
 )
 
@@ -47,13 +48,36 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Open the metadata database, upgrading its schema if it is behind
+	metadataRepo, err := repository.NewMetadataRepository(appConfig.GetConfig().Database.Name)
+	if err != nil {
+		log.Fatalf("Failed to open metadata database: %v", err)
+	}
+
 	// Create services
-	fileService, err := createFileService(appConfig)
+	storage, err := handler.OpenStorage(appConfig.GetConfig())
+	if err != nil {
+		log.Fatalf("Failed to create storage: %v", err)
+	}
+
+	// The native API owns the file service, so objects stored or deleted
+	// through the web interface get the same quotas, retention and trash.
+	// Requests are not authenticated here, so uploaders name themselves and
+	// only the global quota is enforced.
+	apiConfig := *appConfig.GetConfig()
+	apiConfig.Security.EnableAuth = false
+	nativeAPI, err := handler.NewAPIWithConfig(storage, metadataRepo, &apiConfig)
 	if err != nil {
-		log.Fatalf("Failed to create file service: %v", err)
+		log.Fatalf("Failed to create API: %v", err)
+	}
+	fileService := nativeAPI.FileService()
+
+	// Serve the S3 API next to the native one if configured
+	if err := nativeAPI.StartS3Gateway(appConfig.GetConfig()); err != nil {
+		log.Fatalf("Failed to start S3 gateway: %v", err)
 	}
 
-	searchService, err := createSearchService(appConfig)
+	searchService, err := createSearchService(appConfig, metadataRepo)
 	if err != nil {
 		log.Fatalf("Failed to create search service: %v", err)
 	}
@@ -62,8 +86,9 @@ func main() {
 	serviceConfig := service.DefaultServiceConfig()
 	batchService := service.NewBatchService(fileService, searchService, serviceConfig)
 
-	// Create batch API
+	// Create batch API, refusing batches over quota before they are queued
 	batchAPI := api.NewBatchAPI(batchService)
+	batchAPI.SetQuotas(nativeAPI.Quotas())
 
 	// Configure web server
 	webConfig := &web.Config{
@@ -78,22 +103,20 @@ func main() {
 		SSLKey:       *keyFile,
 	}
 
-	// Override with config file values if available
+	// Override with config file values if available, unless given on the command line
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
 	if appConfig != nil {
 		config := appConfig.GetConfig()
-		if config.Server.Host != "" {
+		if config.Server.Host != "" && !setFlags["host"] {
 			webConfig.Host = config.Server.Host
 		}
-		if config.Server.Port != "" {
+		if config.Server.Port != "" && !setFlags["port"] {
 			// Parse string port to int for web config
 			if port, err := strconv.Atoi(config.Server.Port); err == nil {
 				webConfig.Port = port
 			}
 		}
-		// Use storage path from config if available
-		if config.Storage.Path != "" {
-			// We could use this for file service initialization here
-		}
 	}
 
 	// Create web integration
@@ -101,9 +124,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create web integration: %v", err)
 	}
+	nativeAPI.RegisterRoutes(webIntegration.GetServer().GetEngine())
 
 	// Start services
 	fmt.Printf("📦 Services Initialized\n")
+	fmt.Printf("   Native API: ✅\n")
 	fmt.Printf("   File Service: ✅\n")
 	fmt.Printf("   Search Service: ✅\n")
 	fmt.Printf("   Batch Service: ✅\n")
@@ -146,6 +171,14 @@ func main() {
 	if err := webIntegration.Stop(ctx); err != nil {
 		log.Printf("Error during web interface shutdown: %v", err)
 	}
+	if err := nativeAPI.StopS3Gateway(ctx); err != nil {
+		log.Printf("Error during S3 gateway shutdown: %v", err)
+	}
+	nativeAPI.Stop()
+
+	if err := metadataRepo.Close(); err != nil {
+		log.Printf("Error closing metadata database: %v", err)
+	}
 
 	fmt.Println("✅ Web interface stopped successfully")
 	fmt.Println("👋 Goodbye!")
@@ -172,11 +205,12 @@ func loadConfiguration(configFile string) (*config.ConfigManager, error) {
 
 		if configFile == "" {
 			fmt.Println("⚠️  No configuration file found, using defaults")
-			return nil, nil
 		}
 	}
 
-	fmt.Printf("📄 Loading configuration from: %s\n", configFile)
+	if configFile != "" {
+		fmt.Printf("📄 Loading configuration from: %s\n", configFile)
+	}
 	configManager := config.NewConfigManager()
 	_, err := configManager.Load(configFile)
 	if err != nil {
@@ -185,25 +219,11 @@ func loadConfiguration(configFile string) (*config.ConfigManager, error) {
 	return configManager, nil
 }
 
-func createFileService(appConfig *config.ConfigManager) (service.FileService, error) {
-	// Create storage implementation
-	storage := storageservice.NewStorage("./data") // Default storage path
-
-	// Create service configuration
-	serviceConfig := service.DefaultServiceConfig()
-
-	// For now, create a basic file service without metadata repository
-	// In a real implementation, this would be configured based on the config
-	return service.NewFileService(storage, nil, serviceConfig), nil
-}
-
-func createSearchService(appConfig *config.ConfigManager) (service.SearchService, error) {
+func createSearchService(appConfig *config.ConfigManager, metadataRepo *repository.MetadataRepository) (service.SearchService, error) {
 	// Create service configuration
 	serviceConfig := service.DefaultServiceConfig()
 
-	// For now, create a basic search service without metadata repository
-	// In a real implementation, this would be configured based on the config
-	return service.NewSearchService(nil, serviceConfig), nil
+	return service.NewSearchService(metadataRepo, serviceConfig), nil
 }
 
 func showHelp() {
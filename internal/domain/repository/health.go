@@ -20,6 +20,9 @@ type HealthRepository interface {
 	// CheckDiskSpace checks available disk space
 	CheckDiskSpace(ctx context.Context) entities.CheckResult
 	
+	// CheckIntegrity reports corrupt content found by the integrity scrubber
+	CheckIntegrity(ctx context.Context) entities.CheckResult
+	
 	// GetSystemInfo retrieves system information
 	GetSystemInfo(ctx context.Context) (*entities.SystemInfo, error)
 	
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"syscall"
 	
 	"github.com/zots0127/io/internal/domain/entities"
@@ -39,6 +40,9 @@ func (h *HealthRepositoryImpl) CheckHealth(ctx context.Context) (*entities.Healt
 	// Check disk space
 	checks["disk_space"] = h.CheckDiskSpace(ctx)
 	
+	// Check stored content integrity
+	checks["integrity"] = h.CheckIntegrity(ctx)
+	
 	// Get system info
 	systemInfo, err := h.GetSystemInfo(ctx)
 	if err != nil {
@@ -191,6 +195,64 @@ func (h *HealthRepositoryImpl) CheckDiskSpace(ctx context.Context) entities.Chec
 	}
 }
 
+// CheckIntegrity reports what the background scrubber last found in stored content
+func (h *HealthRepositoryImpl) CheckIntegrity(ctx context.Context) entities.CheckResult {
+	if h.db == nil {
+		return entities.CheckResult{
+			Status:  entities.HealthStatusDown,
+			Message: "Database connection is nil",
+		}
+	}
+	
+	var checked, corrupt, repaired int64
+	var lastChecked sql.NullString
+	err := h.db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COUNT(CASE WHEN status = 'corrupt' THEN 1 END),
+			COUNT(CASE WHEN status = 'repaired' THEN 1 END),
+			MAX(checked_at)
+		FROM integrity_checks`).Scan(&checked, &corrupt, &repaired, &lastChecked)
+	if err != nil {
+		// The table is created with the metadata schema; without it nothing was scrubbed
+		if strings.Contains(err.Error(), "no such table") {
+			return entities.CheckResult{
+				Status:  entities.HealthStatusUp,
+				Message: "Integrity scrubber has not run yet",
+			}
+		}
+		return entities.CheckResult{
+			Status:  entities.HealthStatusPartial,
+			Message: fmt.Sprintf("Failed to read integrity checks: %v", err),
+		}
+	}
+	
+	details := map[string]interface{}{
+		"checked":  checked,
+		"corrupt":  corrupt,
+		"repaired": repaired,
+	}
+	if lastChecked.Valid {
+		details["last_checked_at"] = lastChecked.String
+	}
+	
+	status := entities.HealthStatusUp
+	message := "Stored content verified"
+	
+	// Corrupt content is quarantined, so the service still serves everything else
+	if corrupt > 0 {
+		status = entities.HealthStatusPartial
+		message = fmt.Sprintf("%d corrupt objects quarantined and not repaired", corrupt)
+	} else if checked == 0 {
+		message = "Integrity scrubber has not run yet"
+	}
+	
+	return entities.CheckResult{
+		Status:  status,
+		Message: message,
+		Details: details,
+	}
+}
+
 // GetSystemInfo retrieves system information
 func (h *HealthRepositoryImpl) GetSystemInfo(ctx context.Context) (*entities.SystemInfo, error) {
 	var stat syscall.Statfs_t
@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zots0127/io/internal/domain/entities"
+	"github.com/zots0127/io/internal/domain/repository"
+	metadata "github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/migrate"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// MultiStorageRepositoryImpl implements MultiStorageRepository over storage
+// volumes mounted as named backends, such as a fast SSD, a big HDD or an S3
+// bucket. Backends are addressed by the names they were mounted under.
+type MultiStorageRepositoryImpl struct {
+	storage      *service.Storage
+	migrator     *migrate.Migrator
+	metadataRepo *metadata.MetadataRepository
+}
+
+// NewMultiStorageRepository creates a new multi-backend storage repository.
+// metadataRepo supplies reference counts and may be nil.
+func NewMultiStorageRepository(storage *service.Storage, migrator *migrate.Migrator, metadataRepo *metadata.MetadataRepository) repository.MultiStorageRepository {
+	return &MultiStorageRepositoryImpl{
+		storage:      storage,
+		migrator:     migrator,
+		metadataRepo: metadataRepo,
+	}
+}
+
+// Store saves a file to the primary backend and returns its hash
+func (r *MultiStorageRepositoryImpl) Store(ctx context.Context, reader io.Reader) (string, error) {
+	hash, _, err := r.storage.StoreFromReader(reader)
+	return hash, err
+}
+
+// Retrieve gets a file by its hash from whichever backend holds it
+func (r *MultiStorageRepositoryImpl) Retrieve(ctx context.Context, hash string) (io.ReadCloser, error) {
+	return r.storage.Open(hash)
+}
+
+// Delete removes a file by its hash
+func (r *MultiStorageRepositoryImpl) Delete(ctx context.Context, hash string) error {
+	return r.storage.Delete(hash)
+}
+
+// Exists checks if a file exists on any backend
+func (r *MultiStorageRepositoryImpl) Exists(ctx context.Context, hash string) (bool, error) {
+	return r.storage.Exists(hash), nil
+}
+
+// GetMetadata retrieves file metadata
+func (r *MultiStorageRepositoryImpl) GetMetadata(ctx context.Context, hash string) (*entities.File, error) {
+	size, err := r.storage.Size(hash)
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := r.storage.ModTime(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.toFile(hash, size, modTime), nil
+}
+
+// ListFiles returns a page of the files stored across every backend
+func (r *MultiStorageRepositoryImpl) ListFiles(ctx context.Context, limit, offset int) ([]*entities.File, error) {
+	files := []*entities.File{}
+	skipped := 0
+	errDone := errors.New("page complete")
+
+	err := r.storage.Walk(func(hash string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+		if limit > 0 && len(files) >= limit {
+			return errDone
+		}
+
+		size, err := r.storage.Size(hash)
+		if err != nil {
+			return nil
+		}
+		files = append(files, r.toFile(hash, size, info.ModTime()))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDone) {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// GetStorageStats returns how many files and bytes each backend holds
+func (r *MultiStorageRepositoryImpl) GetStorageStats(ctx context.Context) (map[string]interface{}, error) {
+	backends := map[string]interface{}{}
+	var totalFiles, totalBytes int64
+
+	for _, backend := range r.storage.Backends() {
+		var files, bytes int64
+		err := r.storage.WalkBackend(backend.Name, func(hash string, info os.FileInfo) error {
+			files++
+			bytes += info.Size()
+			return ctx.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		backends[backend.Name] = map[string]interface{}{
+			"path":         backend.Path,
+			"primary":      backend.Primary,
+			"total_files":  files,
+			"stored_bytes": bytes,
+		}
+		totalFiles += files
+		totalBytes += bytes
+	}
+
+	stats := map[string]interface{}{
+		"backends":     backends,
+		"total_files":  totalFiles,
+		"stored_bytes": totalBytes,
+	}
+	if r.migrator != nil {
+		if migration := r.migrator.Progress(); migration != nil {
+			stats["migration"] = migration
+		}
+	}
+
+	return stats, nil
+}
+
+// SetPrimaryBackend sets the backend new files are written to
+func (r *MultiStorageRepositoryImpl) SetPrimaryBackend(backend repository.StorageBackend) error {
+	return r.storage.SetPrimaryBackend(string(backend))
+}
+
+// GetBackends returns all configured backends, in the order they were mounted
+func (r *MultiStorageRepositoryImpl) GetBackends() []repository.StorageBackend {
+	backends := r.storage.Backends()
+	names := make([]repository.StorageBackend, len(backends))
+	for i, backend := range backends {
+		names[i] = repository.StorageBackend(backend.Name)
+	}
+	return names
+}
+
+// MigrateData moves every file from one backend to another, returning once
+// the migration finishes. Files stay readable throughout. If ctx is done
+// first, the migration is left running in the background.
+func (r *MultiStorageRepositoryImpl) MigrateData(ctx context.Context, from, to repository.StorageBackend) error {
+	if r.migrator == nil {
+		return fmt.Errorf("storage migrations are not available")
+	}
+
+	started, err := r.migrator.Migrate(context.Background(), string(from), string(to))
+	if err != nil {
+		return err
+	}
+
+	migration, err := r.migrator.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if migration == nil || migration.ID != started.ID {
+		return fmt.Errorf("migration %s is no longer running", started.ID)
+	}
+	if migration.Error != "" {
+		return fmt.Errorf("migration %s %s: %s", migration.ID, migration.Status, migration.Error)
+	}
+	if migration.Status != types.MigrationCompleted {
+		return fmt.Errorf("migration %s %s", migration.ID, migration.Status)
+	}
+	return nil
+}
+
+// toFile describes a stored file
+func (r *MultiStorageRepositoryImpl) toFile(hash string, size int64, modTime time.Time) *entities.File {
+	file := &entities.File{
+		SHA1:         hash,
+		Size:         size,
+		CreatedAt:    modTime,
+		LastAccessed: modTime,
+	}
+	if r.metadataRepo != nil {
+		if refs, err := r.metadataRepo.BlobRefCount(hash); err == nil {
+			file.RefCount = int(refs)
+		}
+	}
+	return file
+}
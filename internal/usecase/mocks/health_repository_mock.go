@@ -39,6 +39,12 @@ func (m *MockHealthRepository) CheckDiskSpace(ctx context.Context) entities.Chec
 	return args.Get(0).(entities.CheckResult)
 }
 
+// CheckIntegrity mocks the CheckIntegrity method
+func (m *MockHealthRepository) CheckIntegrity(ctx context.Context) entities.CheckResult {
+	args := m.Called(ctx)
+	return args.Get(0).(entities.CheckResult)
+}
+
 // GetSystemInfo mocks the GetSystemInfo method
 func (m *MockHealthRepository) GetSystemInfo(ctx context.Context) (*entities.SystemInfo, error) {
 	args := m.Called(ctx)
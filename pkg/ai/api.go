@@ -507,7 +507,7 @@ func (api *API) searchByTags(c *gin.Context) {
 	// 目前返回模拟结果
 	files := []*types.FileMetadata{
 		{
-			SHA1:       "example_sha1_1",
+			Hash:       "example_sha1_1",
 			FileName:   "document1.pdf",
 			Size:       1024000,
 			UploadedAt: time.Now().Add(-24 * time.Hour),
@@ -566,7 +566,7 @@ func (api *API) getSimilarFiles(c *gin.Context) {
 	// 目前返回模拟结果
 	files := []*types.FileMetadata{
 		{
-			SHA1:       "similar_sha1_1",
+			Hash:       "similar_sha1_1",
 			FileName:   "similar_document.pdf",
 			Size:       800000,
 			UploadedAt: time.Now().Add(-12 * time.Hour),
@@ -317,20 +317,19 @@ func (s *AIServiceImpl) BatchAnalyze(ctx context.Context, files map[string]*mult
 }
 
 // UpdateClassification 更新分类信息到元数据
+// 分类结果来自文件内容，因此写入引用该内容的所有对象
 func (s *AIServiceImpl) UpdateClassification(ctx context.Context, sha1 string, result *ClassificationResult) error {
 	if s.metadataRepo == nil {
 		return fmt.Errorf("metadata repository not available")
 	}
 
-	// 获取现有元数据
-	metadata, err := s.metadataRepo.GetMetadata(sha1)
+	// 获取引用该内容的所有对象
+	objects, err := s.metadataRepo.ListFiles(&types.MetadataFilter{Hash: sha1})
 	if err != nil {
 		return fmt.Errorf("failed to get metadata: %w", err)
 	}
-
-	// 更新AI分类信息
-	if metadata.CustomFields == nil {
-		metadata.CustomFields = make(map[string]string)
+	if len(objects) == 0 {
+		return fmt.Errorf("failed to get metadata: metadata not found for SHA1: %s", sha1)
 	}
 
 	// 将AI分类信息存储为JSON字符串
@@ -345,16 +344,21 @@ func (s *AIServiceImpl) UpdateClassification(ctx context.Context, sha1 string, r
 	}
 
 	aiClassJSON, _ := json.Marshal(aiClass)
-	metadata.CustomFields["ai_classification"] = string(aiClassJSON)
 
-	// 合并标签
-	mergedTags := MergeTags(metadata.Tags, result.Tags)
-	metadata.Tags = mergedTags
+	for _, metadata := range objects {
+		// 更新AI分类信息
+		if metadata.CustomFields == nil {
+			metadata.CustomFields = make(map[string]string)
+		}
+		metadata.CustomFields["ai_classification"] = string(aiClassJSON)
 
-	// 保存更新后的元数据
-	err = s.metadataRepo.SaveMetadata(metadata)
-	if err != nil {
-		return fmt.Errorf("failed to save metadata: %w", err)
+		// 合并标签
+		metadata.Tags = MergeTags(metadata.Tags, result.Tags)
+
+		// 保存更新后的元数据
+		if err := s.metadataRepo.SaveMetadata(metadata); err != nil {
+			return fmt.Errorf("failed to save metadata: %w", err)
+		}
 	}
 
 	return nil
@@ -367,7 +371,7 @@ func (s *AIServiceImpl) GetSimilarFiles(ctx context.Context, sha1 string, limit
 	}
 
 	// 获取源文件的分类信息
-	metadata, err := s.metadataRepo.GetMetadata(sha1)
+	metadata, err := s.metadataRepo.GetMetadataByHash(sha1)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get source metadata: %w", err)
 	}
@@ -381,7 +385,7 @@ func (s *AIServiceImpl) GetSimilarFiles(ctx context.Context, sha1 string, limit
 			continue
 		}
 		for _, file := range files {
-			if file.SHA1 != sha1 { // 排除自己
+			if file.Hash != sha1 { // 排除自己
 				similarFiles = append(similarFiles, file)
 				if len(similarFiles) >= limit {
 					return similarFiles, nil
@@ -2,13 +2,16 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/quota"
 	"github.com/zots0127/io/pkg/service"
 )
 
@@ -17,6 +20,7 @@ type BatchAPI struct {
 	batchService   service.BatchService
 	progressTracker *ProgressTracker
 	taskManager    *TaskManager
+	quotas         *quota.Enforcer
 }
 
 // NewBatchAPI creates a new batch API instance
@@ -28,6 +32,12 @@ func NewBatchAPI(batchService service.BatchService) *BatchAPI {
 	}
 }
 
+// SetQuotas checks batch uploads against quotas before they are queued. Each
+// file is checked again by the file service as it is stored.
+func (api *BatchAPI) SetQuotas(quotas *quota.Enforcer) {
+	api.quotas = quotas
+}
+
 // BatchRequest represents a batch operation request
 type BatchRequest struct {
 	Operation string                 `json:"operation" binding:"required"` // upload, delete, update, metadata_update, copy, move
@@ -272,34 +282,69 @@ func (api *BatchAPI) BatchUpload(c *gin.Context) {
 		return
 	}
 
+	// The authenticated user and API key are charged; only unauthenticated
+	// requests name their uploader, and then only the global quota applies
+	uploadedBy := c.GetString("username")
+	if uploadedBy == "" {
+		uploadedBy = c.GetString("user_id")
+	}
+	if values := form.Value["uploaded_by"]; uploadedBy == "" && len(values) > 0 {
+		uploadedBy = values[0]
+	}
+	apiKeyID := quota.APIKeyID(c.GetString("api_key"))
+
+	// Refuse the whole batch up front if it cannot fit
+	if api.quotas != nil {
+		var totalSize int64
+		for _, fileHeader := range files {
+			totalSize += fileHeader.Size
+		}
+		owner := quota.Owner{User: uploadedBy, APIKeyID: apiKeyID}
+		if err := api.quotas.Check(owner, totalSize, int64(len(files))); err != nil {
+			var exceeded *quota.ExceededError
+			if !errors.As(err, &exceeded) {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "Failed to check quota",
+					"details": err.Error(),
+				})
+				return
+			}
+
+			status := http.StatusRequestEntityTooLarge
+			if errors.Is(err, quota.ErrStorageFull) {
+				status = http.StatusInsufficientStorage
+			}
+			c.JSON(status, gin.H{
+				"error":   "Batch upload exceeds quota",
+				"details": err.Error(),
+				"quota":   exceeded,
+			})
+			return
+		}
+	}
+
 	// Prepare batch request
 	items := make([]map[string]interface{}, len(files))
 	for i, fileHeader := range files {
+		// The open handle is handed to the batch worker, which streams it into
+		// storage and closes it. On disk-backed parts the handle keeps the spooled
+		// temp file readable after the request has completed.
 		file, err := fileHeader.Open()
 		if err != nil {
+			for _, item := range items[:i] {
+				item["reader"].(multipart.File).Close()
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error":   "Failed to open file",
 				"details": fmt.Sprintf("File %s: %v", fileHeader.Filename, err),
 			})
 			return
 		}
-		defer file.Close()
-
-		// Read file data
-		data := make([]byte, fileHeader.Size)
-		_, err = file.Read(data)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error":   "Failed to read file",
-				"details": fmt.Sprintf("File %s: %v", fileHeader.Filename, err),
-			})
-			return
-		}
 
 		// Extract metadata from form fields
 		metadata := make(map[string]interface{})
-		if uploadedBy := form.Value["uploaded_by"]; len(uploadedBy) > 0 {
-			metadata["uploaded_by"] = uploadedBy[0]
+		if uploadedBy != "" {
+			metadata["uploaded_by"] = uploadedBy
 		}
 		if description := form.Value["description"]; len(description) > 0 {
 			metadata["description"] = description[0]
@@ -309,12 +354,14 @@ func (api *BatchAPI) BatchUpload(c *gin.Context) {
 		}
 
 		items[i] = map[string]interface{}{
-			"data":       data,
-			"filename":   fileHeader.Filename,
+			"reader":       file,
+			"filename":     fileHeader.Filename,
 			"content_type": fileHeader.Header.Get("Content-Type"),
-			"uploaded_by": metadata["uploaded_by"],
-			"description": metadata["description"],
-			"is_public":   metadata["is_public"],
+			"uploaded_by":  metadata["uploaded_by"],
+			"api_key_id":   apiKeyID,
+			"size":         fileHeader.Size,
+			"description":  metadata["description"],
+			"is_public":    metadata["is_public"],
 		}
 	}
 
@@ -343,7 +390,7 @@ func (api *BatchAPI) BatchUpload(c *gin.Context) {
 // BatchDelete handles batch deletion of files
 func (api *BatchAPI) BatchDelete(c *gin.Context) {
 	var req struct {
-		SHA1s []string `json:"sha1s" binding:"required"`
+		IDs []string `json:"ids" binding:"required"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -354,18 +401,18 @@ func (api *BatchAPI) BatchDelete(c *gin.Context) {
 		return
 	}
 
-	if len(req.SHA1s) == 0 {
+	if len(req.IDs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "No SHA1s provided",
+			"error": "No IDs provided",
 		})
 		return
 	}
 
 	// Prepare batch request
-	items := make([]map[string]interface{}, len(req.SHA1s))
-	for i, sha1 := range req.SHA1s {
+	items := make([]map[string]interface{}, len(req.IDs))
+	for i, id := range req.IDs {
 		items[i] = map[string]interface{}{
-			"sha1": sha1,
+			"id": id,
 		}
 	}
 
@@ -384,7 +431,7 @@ func (api *BatchAPI) BatchDelete(c *gin.Context) {
 		"task_id":   task.ID,
 		"operation": "delete",
 		"status":    "queued",
-		"total":     len(req.SHA1s),
+		"total":     len(req.IDs),
 		"message":   "Files queued for deletion",
 	})
 }
@@ -414,7 +461,7 @@ func (api *BatchAPI) BatchUpdate(c *gin.Context) {
 	items := make([]map[string]interface{}, len(req.Updates))
 	for i, update := range req.Updates {
 		item := map[string]interface{}{
-			"sha1": update.SHA1,
+			"id": update.ID,
 		}
 
 		// Add optional fields
@@ -459,7 +506,7 @@ func (api *BatchAPI) BatchUpdate(c *gin.Context) {
 
 // BatchMetadataUpdate represents a metadata update request
 type BatchMetadataUpdate struct {
-	SHA1        string   `json:"sha1" binding:"required"`
+	ID          string   `json:"id" binding:"required"`
 	FileName    string   `json:"filename,omitempty"`
 	ContentType string   `json:"content_type,omitempty"`
 	Description string   `json:"description,omitempty"`
@@ -563,12 +610,12 @@ func (api *BatchAPI) validateBatchItem(operation string, item map[string]interfa
 			return fmt.Errorf("file data is required for upload")
 		}
 	case "delete":
-		if _, ok := item["sha1"]; !ok {
-			return fmt.Errorf("sha1 is required for delete")
+		if _, ok := item["id"]; !ok {
+			return fmt.Errorf("id is required for delete")
 		}
 	case "update", "metadata_update":
-		if _, ok := item["sha1"]; !ok {
-			return fmt.Errorf("sha1 is required for update")
+		if _, ok := item["id"]; !ok {
+			return fmt.Errorf("id is required for update")
 		}
 	}
 
@@ -3,14 +3,20 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/quota"
 	"github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/types"
 )
 
 func TestBatchRequest_Validation(t *testing.T) {
@@ -34,7 +40,7 @@ func TestBatchRequest_Validation(t *testing.T) {
 			request: BatchRequest{
 				Operation: "delete",
 				Items: []map[string]interface{}{
-					{"sha1": "abc123"},
+					{"id": "3f0c6a8e-5b1d-4c0e-9a57-2d1b8f4e7c90"},
 				},
 			},
 			expectError: false,
@@ -121,16 +127,16 @@ func TestBatchMetadataUpdate_Validation(t *testing.T) {
 		expectError bool
 	}{
 		{
-			name: "Valid update with SHA1 only",
+			name: "Valid update with ID only",
 			update: BatchMetadataUpdate{
-				SHA1: "abc123def456",
+				ID: "abc123def456",
 			},
 			expectError: false,
 		},
 		{
 			name: "Valid update with all fields",
 			update: BatchMetadataUpdate{
-				SHA1:        "abc123def456",
+				ID:          "abc123def456",
 				FileName:    "newname.txt",
 				ContentType: "text/plain",
 				Description: "Updated file description",
@@ -139,16 +145,16 @@ func TestBatchMetadataUpdate_Validation(t *testing.T) {
 			expectError: false,
 		},
 		{
-			name: "Missing SHA1",
+			name: "Missing ID",
 			update: BatchMetadataUpdate{
 				FileName: "newname.txt",
 			},
 			expectError: true,
 		},
 		{
-			name: "Empty SHA1",
+			name: "Empty ID",
 			update: BatchMetadataUpdate{
-				SHA1: "",
+				ID: "",
 			},
 			expectError: true,
 		},
@@ -164,7 +170,7 @@ func TestBatchMetadataUpdate_Validation(t *testing.T) {
 			err = json.Unmarshal(data, &unmarshaled)
 			assert.NoError(t, err)
 
-			assert.Equal(t, tt.update.SHA1, unmarshaled.SHA1)
+			assert.Equal(t, tt.update.ID, unmarshaled.ID)
 			assert.Equal(t, tt.update.FileName, unmarshaled.FileName)
 			assert.Equal(t, tt.update.ContentType, unmarshaled.ContentType)
 			assert.Equal(t, tt.update.Description, unmarshaled.Description)
@@ -453,4 +459,47 @@ func TestBatchAPI_ErrorHandling(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Contains(t, response, "error")
 	})
-}
\ No newline at end of file
+}
+
+func TestBatchUpload_Quotas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer metadataRepo.Close()
+	require.NoError(t, metadataRepo.SaveQuota(&types.Quota{Scope: types.QuotaScopeUser, Subject: "alice", MaxBytes: 100}))
+
+	api := NewBatchAPI(service.NewBatchService(nil, nil, service.DefaultServiceConfig()))
+	api.SetQuotas(quota.NewEnforcer(metadataRepo, &quota.Config{MaxBytes: 1000, Subjects: true}))
+
+	upload := func(username, uploadedBy string, sizes ...int) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		for _, size := range sizes {
+			part, err := form.CreateFormFile("files", "data.bin")
+			require.NoError(t, err)
+			part.Write(bytes.Repeat([]byte("x"), size))
+		}
+		require.NoError(t, form.WriteField("uploaded_by", uploadedBy))
+		require.NoError(t, form.Close())
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/batch/upload", body)
+		c.Request.Header.Set("Content-Type", form.FormDataContentType())
+		if username != "" {
+			c.Set("username", username)
+		}
+		api.BatchUpload(c)
+		return w
+	}
+
+	// The whole batch is refused when it does not fit the store
+	w := upload("", "bob", 600, 600)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	// An authenticated batch is charged to its user, not the uploader it names
+	w = upload("alice", "bob", 80, 80)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "user alice")
+}
@@ -1,54 +1,257 @@
 package handler
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/buckets"
+	"github.com/zots0127/io/pkg/chunker"
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/expiry"
+	"github.com/zots0127/io/pkg/gc"
+	"github.com/zots0127/io/pkg/lifecycle"
+	"github.com/zots0127/io/pkg/links"
 	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/migrate"
+	"github.com/zots0127/io/pkg/quota"
+	"github.com/zots0127/io/pkg/rehash"
+	"github.com/zots0127/io/pkg/retention"
+	"github.com/zots0127/io/pkg/s3api"
+	"github.com/zots0127/io/pkg/scrub"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
 	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/trash"
 	"github.com/zots0127/io/pkg/types"
+	"github.com/zots0127/io/pkg/upload"
 )
 
-var sha1Regex = regexp.MustCompile("^[a-f0-9]{40}$")
-
 // API handles HTTP requests
 type API struct {
-	storage       *service.Storage
+	content       *chunkstore.Store
+	basePath      string
 	metadataRepo  *repository.MetadataRepository
+	fileService   fileservice.FileService
+	collector     *gc.Collector
+	backfiller    *rehash.Backfiller
+	uploads       *upload.Manager
+	quotas        *quota.Enforcer
+	scrubber      *scrub.Scrubber
+	migrator      *migrate.Migrator
+	gateway       *s3api.Gateway
+	links         *links.Manager
+	buckets       *buckets.Store
+	reaper        *expiry.Reaper
+	lifecycle     *lifecycle.Evaluator
+	tiering       *tiering.Manager
+	retention     *retention.Enforcer
+	trash         *trash.Bin
+
+	// trustedProxies are the networks whose forwarding headers are believed
+	trustedProxies []*net.IPNet
+	// versioning keeps earlier versions of bucket keys, natively and over S3
+	versioning bool
 }
 
-// NewAPI creates a new API instance
+// NewAPI creates a new API instance configured from the environment
 func NewAPI(storage *service.Storage, metadataRepo *repository.MetadataRepository) *API {
-	return &API{
-		storage:      storage,
+	// Only declaring lifecycle rules can fail, and the environment declares none
+	api, _ := newAPI(storage, metadataRepo, getSettings())
+	return api
+}
+
+// newAPI creates a new API instance with settings
+func newAPI(storage *service.Storage, metadataRepo *repository.MetadataRepository, settings *settings) (*API, error) {
+	config := fileservice.DefaultServiceConfig()
+	config.MaxFileSize = settings.maxFileSize
+
+	// The chunk store shares the backends, compression policy and keyring, so they are set first
+	configureBackends(storage)
+	if storage.Compression() == nil {
+		storage.SetCompression(getCompressionPolicy())
+	}
+	if storage.Encryption() == nil {
+		storage.SetEncryption(getKeyring())
+	}
+
+	content := chunkstore.NewStore(storage, metadataRepo, &chunkstore.Config{
+		Enabled: os.Getenv("CHUNKING_ENABLED") == "true",
+		Chunker: chunker.DefaultConfig(),
+	})
+
+	fileService := fileservice.NewFileService(content, metadataRepo, config)
+	api := &API{
+		content:      content,
+		basePath:     storage.BasePath(),
 		metadataRepo: metadataRepo,
+		fileService:  fileService,
+
+		trustedProxies: settings.trustedProxies,
+		versioning:     settings.versioning,
+	}
+
+	if metadataRepo != nil {
+		// Declared lifecycle rules are in place before any background work starts
+		api.lifecycle = lifecycle.NewEvaluator(content, metadataRepo, settings.lifecycle)
+		if settings.lifecycleRules != nil {
+			if err := api.lifecycle.Declare(settings.lifecycleRules); err != nil {
+				return nil, fmt.Errorf("failed to declare lifecycle rules: %w", err)
+			}
+		}
+
+		api.quotas = quota.NewEnforcer(metadataRepo, &quota.Config{
+			MaxBytes: settings.maxStorageSize,
+			Subjects: settings.subjectQuotas,
+		})
+		fileService.SetQuotas(api.quotas)
+
+		api.retention = retention.NewEnforcer(metadataRepo, getRetentionConfig())
+		fileService.SetRetention(api.retention)
+
+		api.trash = trash.NewBin(metadataRepo, getTrashConfig())
+		fileService.SetTrash(api.trash)
+		api.trash.Start(context.Background())
+
+		api.collector = gc.NewCollector(storage, content.Chunks(), metadataRepo, &gc.Config{
+			GracePeriod: getGCGracePeriod(),
+		})
+
+		backfillConfig := &rehash.Config{
+			Algorithms: getBackfillAlgorithms(),
+			Interval:   getBackfillInterval(),
+		}
+		backfiller, err := rehash.NewBackfiller(content, metadataRepo, backfillConfig)
+		if err != nil {
+			backfiller, _ = rehash.NewBackfiller(content, metadataRepo, &rehash.Config{Interval: backfillConfig.Interval})
+		}
+		api.backfiller = backfiller
+		api.backfiller.Start(context.Background())
+
+		api.scrubber = scrub.NewScrubber(storage, content.Chunks(), metadataRepo, getScrubConfig())
+		api.scrubber.Start(context.Background())
+
+		api.migrator = migrate.NewMigrator(storage, content.Chunks(), metadataRepo, getMigrationConfig())
+		api.migrator.Start(context.Background())
+
+		api.uploads = upload.NewManager(api.fileService, metadataRepo, &upload.Config{
+			Dir:        filepath.Join(storage.BasePath(), ".uploads"),
+			Expiration: getUploadExpiration(),
+			MaxSize:    config.MaxFileSize,
+		})
+		api.uploads.Start()
+
+		api.links = links.NewManager(metadataRepo, getLinkConfig())
+
+		api.reaper = expiry.NewReaper(api.fileService, metadataRepo, settings.expiry)
+		api.reaper.Start(context.Background())
+
+		api.lifecycle.Start(context.Background())
+
+		api.tiering = tiering.NewManager(content, metadataRepo, getTieringConfig())
+		fileService.SetTiering(api.tiering)
+		api.tiering.Start(context.Background())
+
+		api.buckets = buckets.NewStore(api.fileService, metadataRepo, &buckets.Config{
+			Versioning: api.versioning,
+			Retention:  api.retention,
+		})
 	}
+
+	return api, nil
+}
+
+// FileService returns the file service requests are served by, so other
+// frontends store and delete objects under the same quotas, retention and trash
+func (a *API) FileService() fileservice.FileService {
+	return a.fileService
+}
+
+// Quotas returns the quota enforcer uploads are checked against, or nil
+// without a metadata repository
+func (a *API) Quotas() *quota.Enforcer {
+	return a.quotas
+}
+
+// Stop stops the background workers started by NewAPI
+func (a *API) Stop() {
+	if a.metadataRepo == nil {
+		return
+	}
+	a.uploads.Stop()
+	a.backfiller.Stop()
+	a.scrubber.Stop()
+	a.migrator.Stop()
+	a.reaper.Stop()
+	a.lifecycle.Stop()
+	a.tiering.Stop()
+	a.trash.Stop()
 }
 
 // RegisterRoutes registers API routes
 func (a *API) RegisterRoutes(router *gin.Engine) {
-	api := router.Group("/api")
+	api := router.Group("/api", a.retentionBypass)
 
-	// File operations
+	// Content operations, addressed by content hash
 	api.POST("/upload", a.uploadFile)
-	api.GET("/file/:sha1", a.getFile)
-	api.DELETE("/file/:sha1", a.deleteFile)
-	api.GET("/exists/:sha1", a.checkExists)
+	api.GET("/file/:hash", a.getFile)
+	api.HEAD("/file/:hash", a.getFile)
+	api.DELETE("/file/:hash", a.deleteFile)
+	api.GET("/exists/:hash", a.checkExists)
+	api.GET("/hash/:hash", a.listByHash)
+
+	// Resumable uploads
+	a.registerUploadRoutes(api)
+
+	// Signed download links
+	a.registerLinkRoutes(router, api)
+
+	// Objects addressed by bucket and path-like key
+	a.registerBucketRoutes(api)
+
+	// Object operations, addressed by object ID
+	api.GET("/object/:id", a.getObject)
+	api.HEAD("/object/:id", a.getObject)
+	api.DELETE("/object/:id", a.deleteObject)
 
 	// Metadata operations
-	api.GET("/metadata/:sha1", a.getMetadata)
-	api.PUT("/metadata/:sha1", a.updateMetadata)
-	api.DELETE("/metadata/:sha1", a.deleteMetadata)
+	api.GET("/metadata/:id", a.getMetadata)
+	api.PUT("/metadata/:id", a.updateMetadata)
+	api.DELETE("/metadata/:id", a.deleteMetadata)
 	api.GET("/files", a.listFiles)
 	api.POST("/search", a.searchFiles)
 	api.GET("/stats", a.getStats)
 
+	// Admin operations
+	admin := api.Group("/admin")
+	admin.GET("/gc", a.getGCReport)
+	admin.POST("/gc", a.runGC)
+	admin.GET("/digests", a.getBackfillReport)
+	admin.POST("/digests/backfill", a.runBackfill)
+	a.registerQuotaRoutes(admin)
+	a.registerScrubRoutes(admin)
+	a.registerExpiryRoutes(admin)
+	a.registerLifecycleRoutes(admin)
+	a.registerTieringRoutes(admin)
+	a.registerBackendRoutes(admin)
+	a.registerRetentionRoutes(api, admin)
+	a.registerTrashRoutes(api, admin)
+
 	// Health check
 	api.GET("/health", a.healthCheck)
 }
@@ -66,47 +269,57 @@ func (a *API) uploadFile(c *gin.Context) {
 	}
 	defer file.Close()
 
-	// Store file
-	sha1, size, err := a.storage.StoreFromReader(file)
+	metadata := &types.FileMetadata{
+		FileName:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		UploadedBy:  requestUser(c),
+		APIKeyID:    quota.APIKeyID(requestAPIKey(c)),
+		Size:        header.Size,
+		IsPublic:    c.DefaultPostForm("is_public", "false") == "true",
+		Description: c.PostForm("description"),
+	}
+
+	metadata.ExpiresAt, err = expiry.ExpiresAt(c.PostForm("ttl"), c.PostForm("expires_at"), time.Now())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, types.APIResponse{
+		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Failed to store file",
+			Message: "Invalid expiry",
 			Error:   err.Error(),
 		})
 		return
 	}
 
-	// Save metadata
-	if a.metadataRepo != nil {
-		metadata := &types.FileMetadata{
-			SHA1:        sha1,
-			FileName:    header.Filename,
-			Size:        size,
-			ContentType: header.Header.Get("Content-Type"),
-			UploadedBy:  c.GetHeader("X-Uploaded-By"),
-			IsPublic:    c.DefaultPostForm("is_public", "false") == "true",
-			Description: c.PostForm("description"),
+	// Parse tags
+	tagsStr := c.PostForm("tags")
+	if tagsStr != "" {
+		metadata.Tags = strings.Split(tagsStr, ",")
+		for i, tag := range metadata.Tags {
+			metadata.Tags[i] = strings.TrimSpace(tag)
 		}
+	}
 
-		// Parse tags
-		tagsStr := c.PostForm("tags")
-		if tagsStr != "" {
-			metadata.Tags = strings.Split(tagsStr, ",")
-			for i, tag := range metadata.Tags {
-				metadata.Tags[i] = strings.TrimSpace(tag)
-			}
+	// Stream file into storage
+	stored, err := a.fileService.StoreStream(c.Request.Context(), file, metadata)
+	if err != nil {
+		if quotaError(c, err) {
+			return
 		}
-
-		if err := a.metadataRepo.SaveMetadata(metadata); err != nil {
-			// Log error but don't fail the upload
-			fmt.Printf("Warning: Failed to save metadata: %v\n", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, fileservice.ErrFileTooLarge) {
+			status = http.StatusRequestEntityTooLarge
 		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Failed to store file",
+			Error:   err.Error(),
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, types.FileUploadResponse{
-		SHA1:    sha1,
-		Size:    size,
+		ID:      stored.ID,
+		Hash:    stored.Hash,
+		Size:    stored.Size,
 		Success: true,
 		Message: "File uploaded successfully",
 	})
@@ -114,24 +327,28 @@ func (a *API) uploadFile(c *gin.Context) {
 
 // getFile handles file download
 func (a *API) getFile(c *gin.Context) {
-	sha1 := c.Param("sha1")
-	if !isValidSHA1(sha1) {
+	hash, ok := a.resolveHash(c.Param("hash"))
+	if !ok {
 		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Invalid SHA1 hash format",
+			Message: "Invalid content hash format",
 		})
 		return
 	}
 
-	// Retrieve file
-	data, err := a.storage.Retrieve(sha1)
+	// Open file
+	reader, metadata, err := a.fileService.RetrieveStream(c.Request.Context(), hash)
 	if err != nil {
-		if err.Error() == "file not found: "+sha1 {
+		if errors.Is(err, service.ErrFileNotFound) {
 			c.JSON(http.StatusNotFound, types.APIResponse{
 				Success: false,
 				Message: "File not found",
 				Error:   err.Error(),
 			})
+		} else if errors.Is(err, fileservice.ErrExpired) {
+			expiredError(c, err)
+		} else if errors.Is(err, tiering.ErrRestoring) {
+			restoringError(c, err)
 		} else {
 			c.JSON(http.StatusInternalServerError, types.APIResponse{
 				Success: false,
@@ -141,40 +358,35 @@ func (a *API) getFile(c *gin.Context) {
 		}
 		return
 	}
+	defer reader.Close()
 
-	// Increment access count
-	if a.metadataRepo != nil {
-		a.metadataRepo.IncrementAccessCount(sha1)
-	}
-
-	// Try to get filename from metadata
-	filename := sha1
-	if a.metadataRepo != nil {
-		if metadata, err := a.metadataRepo.GetMetadata(sha1); err == nil {
-			filename = metadata.FileName
-		}
+	// Use filename from metadata if available
+	filename := hash
+	if metadata.FileName != "" {
+		filename = metadata.FileName
 	}
 
-	// Set headers for file download
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-	c.Header("Content-Type", "application/octet-stream")
-	c.Data(http.StatusOK, "application/octet-stream", data)
+	// Content addressed by hash never changes
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	serveContent(c, reader, metadata, filename)
 }
 
-// deleteFile handles file deletion
+// deleteFile removes content by hash along with every object that references it
 func (a *API) deleteFile(c *gin.Context) {
-	sha1 := c.Param("sha1")
-	if !isValidSHA1(sha1) {
+	hash, ok := a.resolveHash(c.Param("hash"))
+	if !ok {
 		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Invalid SHA1 hash format",
+			Message: "Invalid content hash format",
 		})
 		return
 	}
 
-	err := a.storage.Delete(sha1)
+	err := a.fileService.Purge(c.Request.Context(), hash)
 	if err != nil {
-		if err.Error() == "file not found: "+sha1 {
+		if errors.Is(err, retention.ErrLocked) {
+			lockedError(c, err)
+		} else if errors.Is(err, service.ErrFileNotFound) {
 			c.JSON(http.StatusNotFound, types.APIResponse{
 				Success: false,
 				Message: "File not found",
@@ -198,32 +410,152 @@ func (a *API) deleteFile(c *gin.Context) {
 
 // checkExists checks if a file exists
 func (a *API) checkExists(c *gin.Context) {
-	sha1 := c.Param("sha1")
-	if !isValidSHA1(sha1) {
+	hash, ok := a.resolveHash(c.Param("hash"))
+	if !ok {
 		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Invalid SHA1 hash format",
+			Message: "Invalid content hash format",
 		})
 		return
 	}
 
-	exists := a.storage.Exists(sha1)
+	exists := a.content.Exists(hash)
 	response := types.FileExistsResponse{
 		Exists: exists,
-		SHA1:   sha1,
+		Hash:   hash,
 	}
 
 	if exists {
 		// Try to get file size
-		data, err := a.storage.Retrieve(sha1)
-		if err == nil {
-			response.Size = int64(len(data))
+		if size, err := a.content.Size(hash); err == nil {
+			response.Size = size
 		}
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+// listByHash lists the objects that reference the content identified by hash
+func (a *API) listByHash(c *gin.Context) {
+	hash, ok := a.resolveHash(c.Param("hash"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid content hash format",
+		})
+		return
+	}
+
+	if a.metadataRepo == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	files, err := a.metadataRepo.ListFiles(&types.MetadataFilter{Hash: hash})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list files",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Files listed successfully",
+		Data:    files,
+	})
+}
+
+// getObject handles download of a single object by ID
+func (a *API) getObject(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	reader, metadata, err := a.fileService.RetrieveObject(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, fileservice.ErrExpired) {
+			expiredError(c, err)
+			return
+		}
+		if errors.Is(err, tiering.ErrRestoring) {
+			restoringError(c, err)
+			return
+		}
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "File not found",
+			Error:   err.Error(),
+		})
+		return
+	}
+	defer reader.Close()
+
+	filename := metadata.FileName
+	if filename == "" {
+		filename = metadata.Hash
+	}
+
+	serveContent(c, reader, metadata, filename)
+}
+
+// serveContent streams content from a file handle, answering Range, If-Range
+// and conditional requests. Content never changes once stored, so its hash is
+// a strong ETag; Last-Modified is the upload time.
+func serveContent(c *gin.Context, reader io.ReadSeeker, metadata *types.FileMetadata, filename string) {
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("ETag", `"`+metadata.Hash+`"`)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	http.ServeContent(c.Writer, c.Request, filename, metadata.UploadedAt, reader)
+}
+
+// deleteObject deletes a single object by ID. Its content is kept while other
+// objects still reference it.
+func (a *API) deleteObject(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	if err := a.fileService.Delete(c.Request.Context(), id); err != nil {
+		if errors.Is(err, retention.ErrLocked) {
+			lockedError(c, err)
+			return
+		}
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "Failed to delete file",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "File deleted successfully",
+	})
+}
+
 // healthCheck returns health status
 func (a *API) healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, types.APIResponse{
@@ -236,9 +568,29 @@ func (a *API) healthCheck(c *gin.Context) {
 	})
 }
 
-// isValidSHA1 validates SHA1 hash format
-func isValidSHA1(hash string) bool {
-	return sha1Regex.MatchString(hash)
+// resolveHash validates a content hash and maps it to the ID the content is
+// stored under. Any supported algorithm is accepted; a digest that differs
+// from the storage algorithm is looked up among recorded secondary digests.
+func (a *API) resolveHash(id string) (string, bool) {
+	algorithm, sum, err := digest.Parse(id)
+	if err != nil {
+		return "", false
+	}
+	hash := digest.Format(algorithm, sum)
+
+	if algorithm == a.content.Algorithm() || a.content.Exists(hash) || a.metadataRepo == nil {
+		return hash, true
+	}
+	if stored, err := a.metadataRepo.FindBlobByDigest(algorithm.Name, hex.EncodeToString(sum)); err == nil && stored != "" {
+		return stored, true
+	}
+	return hash, true
+}
+
+// isValidObjectID validates object ID format
+func isValidObjectID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
 }
 
 // getMaxFileSize gets maximum file size from configuration or uses default
@@ -256,6 +608,73 @@ func getMaxFileSize() int64 {
 	return maxSize
 }
 
+// getGCGracePeriod gets the garbage collection grace period from configuration or uses default
+func getGCGracePeriod() time.Duration {
+	gracePeriod := gc.DefaultGracePeriod
+
+	if periodStr := os.Getenv("GC_GRACE_PERIOD"); periodStr != "" {
+		if period, err := time.ParseDuration(periodStr); err == nil {
+			gracePeriod = period
+		}
+	}
+
+	return gracePeriod
+}
+
+// getBackfillAlgorithms gets the secondary digest algorithms from configuration or uses default
+func getBackfillAlgorithms() []string {
+	algorithms := rehash.DefaultConfig().Algorithms
+
+	if algorithmsStr := os.Getenv("DIGEST_BACKFILL_ALGORITHMS"); algorithmsStr != "" {
+		algorithms = strings.Split(algorithmsStr, ",")
+	}
+
+	return algorithms
+}
+
+// getBackfillInterval gets the interval between background digest backfills from configuration or uses default
+func getBackfillInterval() time.Duration {
+	interval := time.Hour
+
+	if intervalStr := os.Getenv("DIGEST_BACKFILL_INTERVAL"); intervalStr != "" {
+		if parsed, err := time.ParseDuration(intervalStr); err == nil {
+			interval = parsed
+		}
+	}
+
+	return interval
+}
+
+// getCompressionPolicy gets the at-rest compression policy from configuration or uses default
+func getCompressionPolicy() *codec.Policy {
+	policy := codec.DefaultPolicy()
+
+	if codecStr := os.Getenv("STORAGE_COMPRESSION"); codecStr != "" {
+		policy.Codec = codecStr
+	}
+	if sizeStr := os.Getenv("STORAGE_COMPRESSION_MIN_SIZE"); sizeStr != "" {
+		if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil {
+			policy.MinSize = size
+		}
+	}
+
+	if err := policy.Validate(); err != nil {
+		return codec.DefaultPolicy()
+	}
+	return policy
+}
+
+// getKeyring loads the encryption keyring from configuration. Without a key
+// new blobs are stored unencrypted. A key that is set but cannot be loaded is
+// fatal rather than silently storing plaintext.
+func getKeyring() *encryption.Keyring {
+	keyring, err := encryption.LoadKeyring(os.Getenv("STORAGE_ENCRYPTION_KEY_FILE"), os.Getenv("STORAGE_ENCRYPTION_KEY"))
+	if err != nil {
+		log.Fatalf("Failed to load storage encryption key: %v", err)
+	}
+	return keyring
+}
+
 // validateFileType validates file type (optional)
 func validateFileType(filename string) bool {
 	// For now, allow all file types
@@ -271,11 +690,11 @@ func getSafeFilename(filename string) string {
 
 // getMetadata handles metadata retrieval
 func (a *API) getMetadata(c *gin.Context) {
-	sha1 := c.Param("sha1")
-	if !isValidSHA1(sha1) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
 		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Invalid SHA1 hash format",
+			Message: "Invalid object ID format",
 		})
 		return
 	}
@@ -288,7 +707,7 @@ func (a *API) getMetadata(c *gin.Context) {
 		return
 	}
 
-	metadata, err := a.metadataRepo.GetMetadata(sha1)
+	metadata, err := a.metadataRepo.GetMetadata(id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, types.APIResponse{
 			Success: false,
@@ -307,11 +726,11 @@ func (a *API) getMetadata(c *gin.Context) {
 
 // updateMetadata handles metadata update
 func (a *API) updateMetadata(c *gin.Context) {
-	sha1 := c.Param("sha1")
-	if !isValidSHA1(sha1) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
 		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Invalid SHA1 hash format",
+			Message: "Invalid object ID format",
 		})
 		return
 	}
@@ -334,9 +753,19 @@ func (a *API) updateMetadata(c *gin.Context) {
 		return
 	}
 
-	metadata.SHA1 = sha1
-
-	if err := a.metadataRepo.UpdateMetadata(&metadata); err != nil {
+	if err := a.fileService.UpdateMetadata(c.Request.Context(), id, &metadata); err != nil {
+		if errors.Is(err, retention.ErrLocked) {
+			lockedError(c, err)
+			return
+		}
+		if errors.Is(err, service.ErrFileNotFound) {
+			c.JSON(http.StatusNotFound, types.APIResponse{
+				Success: false,
+				Message: "Object not found",
+				Error:   err.Error(),
+			})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, types.APIResponse{
 			Success: false,
 			Message: "Failed to update metadata",
@@ -354,11 +783,11 @@ func (a *API) updateMetadata(c *gin.Context) {
 
 // deleteMetadata handles metadata deletion
 func (a *API) deleteMetadata(c *gin.Context) {
-	sha1 := c.Param("sha1")
-	if !isValidSHA1(sha1) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
 		c.JSON(http.StatusBadRequest, types.APIResponse{
 			Success: false,
-			Message: "Invalid SHA1 hash format",
+			Message: "Invalid object ID format",
 		})
 		return
 	}
@@ -371,7 +800,11 @@ func (a *API) deleteMetadata(c *gin.Context) {
 		return
 	}
 
-	if err := a.metadataRepo.DeleteMetadata(sha1); err != nil {
+	if err := a.fileService.DeleteMetadata(c.Request.Context(), id); err != nil {
+		if errors.Is(err, retention.ErrLocked) {
+			lockedError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, types.APIResponse{
 			Success: false,
 			Message: "Failed to delete metadata",
@@ -503,4 +936,127 @@ func (a *API) getStats(c *gin.Context) {
 		Message: "Statistics retrieved successfully",
 		Data:    stats,
 	})
-}
\ No newline at end of file
+}
+
+// getGCReport returns the report of the last garbage collection
+func (a *API) getGCReport(c *gin.Context) {
+	if a.collector == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	report := a.collector.LastReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "Garbage collection has not run yet",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Garbage collection report retrieved successfully",
+		Data:    report,
+	})
+}
+
+// runGC runs a garbage collection. It defaults to a dry run; pass mode=sweep to reclaim.
+func (a *API) runGC(c *gin.Context) {
+	if a.collector == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	mode := gc.Mode(c.DefaultQuery("mode", string(gc.ModeDryRun)))
+	if mode != gc.ModeDryRun && mode != gc.ModeSweep {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid mode, expected dry-run or sweep",
+		})
+		return
+	}
+
+	report, err := a.collector.Run(c.Request.Context(), mode)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gc.ErrRunInProgress) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Garbage collection failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Garbage collection completed",
+		Data:    report,
+	})
+}
+
+// getBackfillReport returns the report of the last digest backfill
+func (a *API) getBackfillReport(c *gin.Context) {
+	if a.backfiller == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	report := a.backfiller.LastReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "Digest backfill has not run yet",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Digest backfill report retrieved successfully",
+		Data:    report,
+	})
+}
+
+// runBackfill records missing secondary digests for stored blobs
+func (a *API) runBackfill(c *gin.Context) {
+	if a.backfiller == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	report, err := a.backfiller.Run(c.Request.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, rehash.ErrRunInProgress) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Digest backfill failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Digest backfill completed",
+		Data:    report,
+	})
+}
@@ -0,0 +1,1306 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zots0127/io/pkg/config"
+	"github.com/zots0127/io/pkg/lifecycle"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/trash"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// newTestRouter returns a router serving a fresh API backed by a temp directory
+func newTestRouter(t *testing.T) (*gin.Engine, *API) {
+	gin.SetMode(gin.TestMode)
+
+	tempDir := t.TempDir()
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	api := NewAPI(service.NewStorage(filepath.Join(tempDir, "storage")), metadataRepo)
+	t.Cleanup(api.uploads.Stop)
+	t.Cleanup(api.backfiller.Stop)
+	t.Cleanup(api.scrubber.Stop)
+	t.Cleanup(api.migrator.Stop)
+	t.Cleanup(api.reaper.Stop)
+	t.Cleanup(api.lifecycle.Stop)
+	t.Cleanup(api.tiering.Stop)
+	t.Cleanup(api.trash.Stop)
+
+	router := gin.New()
+	api.RegisterRoutes(router)
+	return router, api
+}
+
+func TestDownloadRangeAndConditional(t *testing.T) {
+	router, api := newTestRouter(t)
+
+	data := []byte("0123456789abcdefghij")
+	stored, err := api.fileService.Store(context.Background(), data, &types.FileMetadata{
+		FileName:    "digits.txt",
+		ContentType: "text/plain",
+	})
+	require.NoError(t, err)
+
+	etag := `"` + stored.Hash + `"`
+	fileURL := "/api/file/" + stored.Hash
+
+	get := func(method, url string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Full", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, string(data), w.Body.String())
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+		assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+	})
+
+	t.Run("SingleRange", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, map[string]string{"Range": "bytes=2-5"})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "2345", w.Body.String())
+		assert.Equal(t, "bytes 2-5/20", w.Header().Get("Content-Range"))
+	})
+
+	t.Run("SuffixRange", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, map[string]string{"Range": "bytes=-3"})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "hij", w.Body.String())
+	})
+
+	t.Run("MultiRange", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, map[string]string{"Range": "bytes=0-1,10-11"})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges"))
+		assert.Contains(t, w.Body.String(), "01")
+		assert.Contains(t, w.Body.String(), "ab")
+	})
+
+	t.Run("UnsatisfiableRange", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, map[string]string{"Range": "bytes=100-200"})
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	})
+
+	t.Run("IfRange", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, map[string]string{"Range": "bytes=0-1", "If-Range": etag})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+
+		w = get(http.MethodGet, fileURL, map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, string(data), w.Body.String())
+	})
+
+	t.Run("IfNoneMatch", func(t *testing.T) {
+		w := get(http.MethodGet, fileURL, map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("IfModifiedSince", func(t *testing.T) {
+		future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		w := get(http.MethodGet, "/api/object/"+stored.ID, map[string]string{"If-Modified-Since": future})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		w = get(http.MethodGet, "/api/object/"+stored.ID, map[string]string{"If-Modified-Since": past})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		w := get(http.MethodHead, "/api/object/"+stored.ID, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "20", w.Header().Get("Content-Length"))
+		assert.Empty(t, w.Body.String())
+	})
+}
+
+func TestCompressedDownload(t *testing.T) {
+	router, api := newTestRouter(t)
+
+	data := []byte(strings.Repeat("compressible log line\n", 5000))
+	stored, err := api.fileService.Store(context.Background(), data, &types.FileMetadata{
+		FileName:    "app.log",
+		ContentType: "text/plain",
+	})
+	require.NoError(t, err)
+
+	info, err := api.metadataRepo.GetBlobInfo(stored.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", info.Codec)
+	assert.Less(t, info.StoredSize, info.Size)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/file/"+stored.Hash, nil)
+	req.Header.Set("Range", "bytes=50000-50021")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, string(data[50000:50022]), w.Body.String())
+	assert.Equal(t, fmt.Sprintf("bytes 50000-50021/%d", len(data)), w.Header().Get("Content-Range"))
+
+	stats, err := api.metadataRepo.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats["compressed_blobs"])
+	assert.Equal(t, info.Size-info.StoredSize, stats["compression_saved_bytes"])
+}
+
+func TestUploadQuotas(t *testing.T) {
+	t.Setenv("STORAGE_MAX_SIZE", "1000")
+	t.Setenv("SECURITY_AUTH_ENABLED", "true")
+	router, api := newTestRouter(t)
+
+	// Stands in for the authentication middleware, which names the user and key
+	authenticated := gin.New()
+	authenticated.Use(func(c *gin.Context) {
+		c.Set("username", c.GetHeader("X-Uploaded-By"))
+		c.Set("api_key", c.GetHeader("X-API-Key"))
+	})
+	api.RegisterRoutes(authenticated)
+
+	do := func(router http.Handler, req *http.Request) (*httptest.ResponseRecorder, types.APIResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response types.APIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w, response
+	}
+	upload := func(user string, size int) (*httptest.ResponseRecorder, types.APIResponse) {
+		return do(authenticated, newQuotaUpload(t, user, size))
+	}
+
+	quota := `{"scope":"user","subject":"alice","max_bytes":300}`
+	w, _ := do(router, httptest.NewRequest(http.MethodPut, "/api/admin/quotas", strings.NewReader(quota)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = upload("alice", 200)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// alice's quota is exceeded while the store still has room
+	w, response := upload("alice", 200)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "Quota exceeded", response.Message)
+	assert.Contains(t, response.Error, "user alice")
+
+	// An authenticated upload is charged to its user, whatever X-Uploaded-By names
+	asAlice := gin.New()
+	asAlice.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	api.RegisterRoutes(asAlice)
+	w, _ = do(asAlice, newQuotaUpload(t, "carol", 150))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "user alice")
+
+	// bob has no quota, but the store is capped at 1000 bytes
+	w, _ = upload("bob", 700)
+	require.Equal(t, http.StatusOK, w.Code)
+	w, response = upload("bob", 200)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	assert.Equal(t, "Storage capacity exceeded", response.Message)
+
+	w, response = do(router, httptest.NewRequest(http.MethodGet, "/api/admin/usage?scope=user&subject=alice", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	usages := response.Data.([]interface{})
+	require.Len(t, usages, 1)
+	usage := usages[0].(map[string]interface{})
+	assert.Equal(t, float64(200), usage["bytes"])
+	assert.Equal(t, float64(300), usage["quota"].(map[string]interface{})["max_bytes"])
+
+	// Objects are charged to the API key they were uploaded with
+	w, response = do(router, httptest.NewRequest(http.MethodGet, "/api/admin/usage?scope=api_key", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, response.Data, 2)
+}
+
+func TestUploadQuotas_Unauthenticated(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	// Uploaders name themselves, so their quotas cannot be enforced
+	quota := `{"scope":"user","subject":"alice","max_bytes":300}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/admin/quotas", strings.NewReader(quota)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "require authentication")
+
+	// Unchecked API keys are not charged
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newQuotaUpload(t, "alice", 200))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response types.APIResponse
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/usage?scope=api_key", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	usages := response.Data.([]interface{})
+	require.Len(t, usages, 1)
+	assert.Equal(t, "", usages[0].(map[string]interface{})["subject"])
+}
+
+// newQuotaUpload builds an upload of size bytes naming user as its uploader and API key
+func newQuotaUpload(t *testing.T, user string, size int) *http.Request {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", "data.bin")
+	require.NoError(t, err)
+	part.Write(bytes.Repeat([]byte(user), size/len(user)))
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/upload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Uploaded-By", user)
+	req.Header.Set("X-API-Key", "key-of-"+user)
+	return req
+}
+
+func TestScrub(t *testing.T) {
+	t.Setenv("SCRUB_INTERVAL", "0")
+	router, api := newTestRouter(t)
+
+	stored, err := api.fileService.Store(context.Background(), []byte("soon to rot"), &types.FileMetadata{FileName: "rot.txt"})
+	require.NoError(t, err)
+
+	// Flip a byte of the blob on disk
+	blobPath := api.content.Storage().GetFilePath(stored.Hash)
+	data, err := os.ReadFile(blobPath)
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, os.WriteFile(blobPath, data, 0644))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/admin/scrub", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/integrity?status=corrupt", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var response types.APIResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	checks := response.Data.([]interface{})
+	require.Len(t, checks, 1)
+	assert.Equal(t, stored.Hash, checks[0].(map[string]interface{})["hash"])
+
+	// The corrupt blob is quarantined rather than served
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/file/"+stored.Hash, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/scrub", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	summary := response.Data.(map[string]interface{})["summary"].(map[string]interface{})
+	assert.Equal(t, float64(1), summary["corrupt"])
+}
+
+func TestStorageBackendMigration(t *testing.T) {
+	hdd := t.TempDir()
+	t.Setenv("STORAGE_BACKENDS", "hdd="+hdd)
+	t.Setenv("MIGRATION_RATE_LIMIT", "0")
+	router, api := newTestRouter(t)
+
+	stored, err := api.fileService.Store(context.Background(), []byte("moving house"), &types.FileMetadata{FileName: "box.txt"})
+	require.NoError(t, err)
+
+	send := func(method, url, body string) (*httptest.ResponseRecorder, types.APIResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		var response types.APIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w, response
+	}
+
+	w, response := send(http.MethodGet, "/api/admin/backends", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, response.Data, 2)
+
+	w, _ = send(http.MethodPut, "/api/admin/backends/primary", `{"name":"tape"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = send(http.MethodPut, "/api/admin/backends/primary", `{"name":"hdd"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = send(http.MethodPost, "/api/admin/migrations", `{"from":"hdd","to":"hdd"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, response = send(http.MethodPost, "/api/admin/migrations", `{"from":"default","to":"hdd"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	id := response.Data.(map[string]interface{})["id"].(string)
+
+	migration, err := api.migrator.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, types.MigrationCompleted, migration.Status)
+
+	w, response = send(http.MethodGet, "/api/admin/migrations/"+id, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(1), response.Data.(map[string]interface{})["blobs_moved"])
+
+	backend, err := api.content.Storage().BackendOf(stored.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, "hdd", backend)
+
+	// The moved blob is still served
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/file/"+stored.Hash, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "moving house", w.Body.String())
+
+	w, _ = send(http.MethodDelete, "/api/admin/migrations/"+id, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDownloadLinks(t *testing.T) {
+	router, api := newTestRouter(t)
+
+	data := []byte("private report")
+	stored, err := api.fileService.Store(context.Background(), data, &types.FileMetadata{
+		FileName:    "report 2024.txt",
+		ContentType: "text/plain",
+	})
+	require.NoError(t, err)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.10:4321"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header = header
+		req.RemoteAddr = "192.0.2.10:4321"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// createLink returns the ID and path of a new link
+	createLink := func(body string) (string, string) {
+		w := do(http.MethodPost, "/api/links", body)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response struct {
+			Data struct {
+				ID  string `json:"id"`
+				URL string `json:"url"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.True(t, strings.HasPrefix(response.Data.URL, "http://example.com/d/"+response.Data.ID+"?"), response.Data.URL)
+		return response.Data.ID, strings.TrimPrefix(response.Data.URL, "http://example.com")
+	}
+
+	t.Run("SingleUse", func(t *testing.T) {
+		_, path := createLink(fmt.Sprintf(`{"object_id": %q, "expires_in": "10m", "single_use": true}`, stored.ID))
+
+		w := do(http.MethodHead, path, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, string(data), w.Body.String())
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="report 2024.txt"`, w.Header().Get("Content-Disposition"))
+
+		w = do(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusGone, w.Code)
+	})
+
+	t.Run("TamperedSignature", func(t *testing.T) {
+		_, path := createLink(fmt.Sprintf(`{"object_id": %q}`, stored.ID))
+
+		signed, err := url.Parse(path)
+		require.NoError(t, err)
+		query := signed.Query()
+		query.Set("signature", strings.Repeat("0", 64))
+		signed.RawQuery = query.Encode()
+
+		w := do(http.MethodGet, signed.String(), "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("BoundToAddress", func(t *testing.T) {
+		_, path := createLink(fmt.Sprintf(`{"object_id": %q, "allowed_ip": "198.51.100.7", "inline": true}`, stored.ID))
+
+		w := do(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		// Forwarding headers are only believed from trusted proxies
+		spoofed := http.Header{"X-Forwarded-For": {"198.51.100.7"}}
+		w = get(path, spoofed)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		api.trustedProxies = parseTrustedProxies([]string{"192.0.2.0/24"})
+		defer func() { api.trustedProxies = nil }()
+		w = get(path, spoofed)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = get(path, http.Header{"X-Forwarded-For": {"198.51.100.7, 203.0.113.5"}})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("PartialAndConditional", func(t *testing.T) {
+		_, path := createLink(fmt.Sprintf(`{"object_id": %q, "single_use": true}`, stored.ID))
+
+		// Revalidating a download does not use up the link
+		w := get(path, http.Header{"If-None-Match": {`"` + stored.Hash + `"`}})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		// Any range does, a suffix range covering the whole content included
+		w = get(path, http.Header{"Range": {"bytes=-100"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, string(data), w.Body.String())
+
+		w = get(path, http.Header{"Range": {"bytes=1-"}})
+		assert.Equal(t, http.StatusGone, w.Code)
+
+		_, path = createLink(fmt.Sprintf(`{"object_id": %q, "single_use": true}`, stored.ID))
+		w = get(path, http.Header{"Range": {"bytes=8-"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "report", w.Body.String())
+
+		w = get(path, nil)
+		assert.Equal(t, http.StatusGone, w.Code)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		id, path := createLink(fmt.Sprintf(`{"object_id": %q, "max_downloads": 5, "file_name": "shared.txt", "inline": true}`, stored.ID))
+
+		w := do(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `inline; filename=shared.txt`, w.Header().Get("Content-Disposition"))
+
+		w = do(http.MethodDelete, "/api/links/"+id, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusGone, w.Code)
+
+		w = do(http.MethodGet, "/api/links?object_id="+stored.ID, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), id)
+	})
+
+	t.Run("InvalidRequest", func(t *testing.T) {
+		w := do(http.MethodPost, "/api/links", `{"object_id": "missing"}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = do(http.MethodPost, "/api/links", fmt.Sprintf(`{"object_id": %q, "expires_in": "1000h"}`, stored.ID))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = do(http.MethodGet, "/d/missing?expires=1&signature=00", "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestBuckets(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	do := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// list returns the keys and common prefixes of a listing
+	list := func(url string) ([]string, []string) {
+		w := do(http.MethodGet, url, "", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response struct {
+			Data struct {
+				Entries []struct {
+					Key string `json:"key"`
+				} `json:"entries"`
+				Prefixes []string `json:"prefixes"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		keys := []string{}
+		for _, entry := range response.Data.Entries {
+			keys = append(keys, entry.Key)
+		}
+		return keys, response.Data.Prefixes
+	}
+
+	w := do(http.MethodPut, "/api/buckets/team-docs", "", "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = do(http.MethodPut, "/api/buckets/team-docs", "", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	for _, key := range []string{"project/reports/2024/q1.pdf", "project/reports/2024/q2.pdf", "project/readme.txt"} {
+		w = do(http.MethodPut, "/api/buckets/team-docs/"+key, "application/pdf", "content of "+key)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	t.Run("GetByPath", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/buckets/team-docs/project/reports/2024/q1.pdf", "", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "content of project/reports/2024/q1.pdf", w.Body.String())
+		assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename=q1.pdf`, w.Header().Get("Content-Disposition"))
+
+		w = do(http.MethodGet, "/api/buckets/team-docs/project/missing.pdf", "", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = do(http.MethodGet, "/api/buckets/no-such-bucket/a.txt", "", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("DirectoryListing", func(t *testing.T) {
+		keys, prefixes := list("/api/buckets/team-docs/project/")
+		assert.Equal(t, []string{"project/readme.txt"}, keys)
+		assert.Equal(t, []string{"project/reports/"}, prefixes)
+
+		keys, prefixes = list("/api/buckets/team-docs?prefix=project/reports/&delimiter=/")
+		assert.Empty(t, keys)
+		assert.Equal(t, []string{"project/reports/2024/"}, prefixes)
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		w := do(http.MethodPost, "/api/move", "application/json",
+			`{"from_bucket": "team-docs", "from_key": "project/reports/", "to_key": "archive/reports/"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		keys, _ := list("/api/buckets/team-docs?prefix=archive/")
+		assert.Equal(t, []string{"archive/reports/2024/q1.pdf", "archive/reports/2024/q2.pdf"}, keys)
+
+		w = do(http.MethodGet, "/api/buckets/team-docs/archive/reports/2024/q2.pdf", "", "")
+		assert.Equal(t, "content of project/reports/2024/q2.pdf", w.Body.String())
+
+		w = do(http.MethodPost, "/api/move", "application/json",
+			`{"from_bucket": "team-docs", "from_key": "archive/", "to_key": "archive/old/"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("RecursiveDelete", func(t *testing.T) {
+		w := do(http.MethodDelete, "/api/buckets/team-docs", "", "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = do(http.MethodDelete, "/api/buckets/team-docs/archive/", "", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		keys, prefixes := list("/api/buckets/team-docs/")
+		assert.Empty(t, keys)
+		assert.Equal(t, []string{"project/"}, prefixes)
+
+		w = do(http.MethodDelete, "/api/buckets/team-docs?recursive=true", "", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodGet, "/api/buckets/team-docs", "", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestBucketVersions(t *testing.T) {
+	t.Setenv("FEATURE_VERSIONING", "true")
+	router, _ := newTestRouter(t)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPut, "/api/buckets/versioned", "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	for _, content := range []string{"one", "two", "three"} {
+		w = do(http.MethodPut, "/api/buckets/versioned/notes/today.txt", content)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = do(http.MethodGet, "/api/buckets/versioned/notes/today.txt?versions", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Data []types.ObjectVersion `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Data, 3)
+	assert.Equal(t, 3, response.Data[0].Version)
+	assert.True(t, response.Data[0].IsCurrent)
+
+	w = do(http.MethodGet, "/api/buckets/versioned/notes/today.txt?version=1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "one", w.Body.String())
+	assert.Equal(t, "1", w.Header().Get("X-Version"))
+
+	w = do(http.MethodPost, "/api/buckets/versioned/notes/today.txt?restore=1", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = do(http.MethodGet, "/api/buckets/versioned/notes/today.txt", "")
+	assert.Equal(t, "one", w.Body.String())
+	assert.Equal(t, "4", w.Header().Get("X-Version"))
+
+	w = do(http.MethodDelete, "/api/buckets/versioned/notes/today.txt?version=2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(http.MethodGet, "/api/buckets/versioned/notes/today.txt?version=2", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = do(http.MethodGet, "/api/buckets/versioned/notes/today.txt?version=latest", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/buckets/versioned", strings.NewReader(`{"max_versions": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = do(http.MethodGet, "/api/buckets/versioned/notes/today.txt?versions", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Data, 1)
+	assert.Equal(t, 4, response.Data[0].Version)
+}
+
+func TestExpiry(t *testing.T) {
+	t.Setenv("STORAGE_CLEANUP_INTERVAL", "0")
+	router, api := newTestRouter(t)
+
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	upload := func(ttl string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, err := form.CreateFormFile("file", "short-lived.txt")
+		require.NoError(t, err)
+		part.Write([]byte("here today"))
+		require.NoError(t, form.WriteField("ttl", ttl))
+		require.NoError(t, form.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return do(req)
+	}
+
+	w := upload("forever")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = upload("1h")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var uploaded types.FileUploadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &uploaded))
+
+	metadata, err := api.metadataRepo.GetMetadata(uploaded.ID)
+	require.NoError(t, err)
+	require.NotNil(t, metadata.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *metadata.ExpiresAt, time.Minute)
+
+	w = do(httptest.NewRequest(http.MethodGet, "/api/object/"+uploaded.ID, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Bucket keys take a TTL in a header
+	w = do(httptest.NewRequest(http.MethodPut, "/api/buckets/scratch", nil))
+	require.Equal(t, http.StatusCreated, w.Code)
+	req := httptest.NewRequest(http.MethodPut, "/api/buckets/scratch/tmp/note.txt", strings.NewReader("scribble"))
+	req.Header.Set("X-TTL", "3600")
+	w = do(req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stored struct {
+		Data types.BucketEntry `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stored))
+
+	// Expired objects are gone at once, before the reaper deletes them
+	past := time.Now().Add(-time.Minute)
+	for _, id := range []string{uploaded.ID, stored.Data.ObjectID} {
+		metadata, err := api.metadataRepo.GetMetadata(id)
+		require.NoError(t, err)
+		metadata.ExpiresAt = &past
+		require.NoError(t, api.metadataRepo.UpdateMetadata(metadata))
+	}
+
+	w = do(httptest.NewRequest(http.MethodGet, "/api/object/"+uploaded.ID, nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+	w = do(httptest.NewRequest(http.MethodGet, "/api/file/"+uploaded.Hash, nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+	w = do(httptest.NewRequest(http.MethodGet, "/api/buckets/scratch/tmp/note.txt", nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	w = do(httptest.NewRequest(http.MethodPost, "/api/admin/expiry", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var run struct {
+		Data struct {
+			Deleted       int   `json:"deleted"`
+			BytesReleased int64 `json:"bytes_released"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, 2, run.Data.Deleted)
+	assert.Equal(t, int64(len("here today")+len("scribble")), run.Data.BytesReleased)
+
+	w = do(httptest.NewRequest(http.MethodGet, "/api/object/"+uploaded.ID, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = do(httptest.NewRequest(http.MethodGet, "/api/buckets/scratch/tmp/note.txt", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(httptest.NewRequest(http.MethodGet, "/api/admin/expiry", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var status struct {
+		Data struct {
+			LastReport *struct {
+				Deleted int `json:"deleted"`
+			} `json:"last_report"`
+			Deleted []types.ExpiryRecord `json:"deleted"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.NotNil(t, status.Data.LastReport)
+	assert.Equal(t, 2, status.Data.LastReport.Deleted)
+	require.Len(t, status.Data.Deleted, 2)
+	assert.ElementsMatch(t, []string{uploaded.ID, stored.Data.ObjectID},
+		[]string{status.Data.Deleted[0].ObjectID, status.Data.Deleted[1].ObjectID})
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Setenv("LIFECYCLE_INTERVAL", "0")
+	router, api := newTestRouter(t)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPut, "/api/buckets/archive", "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	for _, key := range []string{"old/report.txt", "new/report.txt"} {
+		w = do(http.MethodPut, "/api/buckets/archive/"+key, "contents of "+key)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = do(http.MethodPut, "/api/admin/lifecycle/rules/everything", `{"action":"expire"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(http.MethodPut, "/api/admin/lifecycle/rules/expire-old", `{"bucket":"archive","prefix":"old/","action":"expire"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = do(http.MethodGet, "/api/admin/lifecycle/rules/expire-old", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(http.MethodGet, "/api/admin/lifecycle/rules/missing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	type runResponse struct {
+		Data struct {
+			DryRun bool `json:"dry_run"`
+			Rules  []struct {
+				Rule    string `json:"rule"`
+				Matched int    `json:"matched"`
+				Applied int    `json:"applied"`
+			} `json:"rules"`
+		} `json:"data"`
+	}
+
+	// A dry run only reports what the rule would do
+	w = do(http.MethodPost, "/api/admin/lifecycle?mode=shred", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(http.MethodPost, "/api/admin/lifecycle", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var run runResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.True(t, run.Data.DryRun)
+	require.Len(t, run.Data.Rules, 1)
+	assert.Equal(t, 1, run.Data.Rules[0].Matched)
+	assert.Equal(t, 1, run.Data.Rules[0].Applied)
+
+	w = do(http.MethodGet, "/api/buckets/archive/old/report.txt", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = do(http.MethodPost, "/api/admin/lifecycle?mode=apply", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	run = runResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.False(t, run.Data.DryRun)
+
+	w = do(http.MethodGet, "/api/buckets/archive/old/report.txt", "")
+	assert.Equal(t, http.StatusGone, w.Code)
+	w = do(http.MethodGet, "/api/buckets/archive/new/report.txt", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Rules declared in configuration can only be changed there
+	require.NoError(t, api.Lifecycle().Declare([]types.LifecycleRule{
+		{ID: "declared", Tags: []string{"scratch"}, Action: types.LifecyclePrivate},
+	}))
+	w = do(http.MethodPut, "/api/admin/lifecycle/rules/declared", `{"age_days":1,"action":"expire"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = do(http.MethodDelete, "/api/admin/lifecycle/rules/declared", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = do(http.MethodGet, "/api/admin/lifecycle", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var status struct {
+		Data struct {
+			LastReport *struct {
+				DryRun bool `json:"dry_run"`
+			} `json:"last_report"`
+			Rules []types.LifecycleRule `json:"rules"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.NotNil(t, status.Data.LastReport)
+	assert.False(t, status.Data.LastReport.DryRun)
+	require.Len(t, status.Data.Rules, 2)
+	assert.Equal(t, types.LifecycleSourceConfig, status.Data.Rules[0].Source)
+	assert.Equal(t, types.LifecycleSourceAPI, status.Data.Rules[1].Source)
+
+	w = do(http.MethodDelete, "/api/admin/lifecycle/rules/expire-old", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(http.MethodDelete, "/api/admin/lifecycle/rules/expire-old", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestNewAPIWithConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tempDir := t.TempDir()
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	appConfig := &config.Config{
+		Storage: config.StorageConfig{MaxStorageSize: 1000},
+		Lifecycle: config.LifecycleConfig{Rules: []types.LifecycleRule{
+			{ID: "expire-tmp", Bucket: "scratch", Prefix: "tmp/", AgeDays: 7, Action: types.LifecycleExpire},
+		}},
+	}
+	newAPI := func() (*API, error) {
+		api, err := NewAPIWithConfig(service.NewStorage(filepath.Join(tempDir, "storage")), metadataRepo, appConfig)
+		if err == nil {
+			t.Cleanup(api.Stop)
+		}
+		return api, err
+	}
+
+	// The configured rules are declared as the API is created
+	api, err := newAPI()
+	require.NoError(t, err)
+	rules, err := api.Lifecycle().Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "expire-tmp", rules[0].ID)
+	assert.Equal(t, types.LifecycleSourceConfig, rules[0].Source)
+
+	limits, err := api.quotas.Limits(types.QuotaScopeGlobal, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), limits.MaxBytes)
+
+	// Schedules come from the config rather than the environment
+	t.Setenv("STORAGE_CLEANUP_INTERVAL", "5m")
+	appConfig.Storage.CleanupInterval = 2 * time.Hour
+	appConfig.Lifecycle.Interval = 12 * time.Hour
+	settings := getConfigSettings(appConfig)
+	assert.Equal(t, 2*time.Hour, settings.expiry.Interval)
+	assert.Equal(t, 12*time.Hour, settings.lifecycle.Interval)
+
+	// Rules no longer configured are removed, and so is versioning
+	appConfig.Lifecycle.Rules = nil
+	appConfig.Features.EnableVersioning = true
+	api, err = newAPI()
+	require.NoError(t, err)
+	rules, err = api.Lifecycle().Rules()
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	// Versioning comes from the config too, for buckets and the S3 gateway alike
+	assert.True(t, api.versioning)
+	ctx := context.Background()
+	_, err = api.buckets.CreateBucket("history")
+	require.NoError(t, err)
+	for _, content := range []string{"first", "second"} {
+		_, err = api.buckets.Put(ctx, "history", "doc.txt", strings.NewReader(content), &types.FileMetadata{})
+		require.NoError(t, err)
+	}
+	versions, err := api.buckets.Versions("history", "doc.txt")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	// An invalid rule keeps the API from being created
+	appConfig.Lifecycle.Rules = []types.LifecycleRule{{ID: "everything", Action: types.LifecycleExpire}}
+	_, err = newAPI()
+	assert.ErrorIs(t, err, lifecycle.ErrInvalidRule)
+}
+
+func TestTiering(t *testing.T) {
+	t.Setenv("STORAGE_BACKENDS", "cold="+t.TempDir())
+	t.Setenv("TIER_COLD_BACKEND", "cold")
+	t.Setenv("TIER_COLD_AFTER", "1ms")
+	t.Setenv("TIER_INTERVAL", "0")
+	router, api := newTestRouter(t)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	demote := func() {
+		t.Helper()
+		time.Sleep(10 * time.Millisecond)
+		w := do(http.MethodPost, "/api/admin/tiering")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var run struct {
+			Data struct {
+				Demoted int `json:"demoted"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+		require.Equal(t, 1, run.Data.Demoted)
+	}
+
+	stored, err := api.fileService.Store(context.Background(), []byte("rarely read"), &types.FileMetadata{
+		FileName:    "archive.txt",
+		ContentType: "text/plain",
+	})
+	require.NoError(t, err)
+
+	demote()
+	metadata, err := api.fileService.GetMetadata(context.Background(), stored.ID)
+	require.NoError(t, err)
+	assert.Equal(t, types.TierCold, metadata.Tier)
+
+	w := do(http.MethodGet, "/api/admin/tiering")
+	require.Equal(t, http.StatusOK, w.Code)
+	var status struct {
+		Data struct {
+			Enabled bool                        `json:"enabled"`
+			Tiers   map[string]*types.TierUsage `json:"tiers"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.True(t, status.Data.Enabled)
+	assert.Equal(t, 1, status.Data.Tiers[types.TierCold].Blobs)
+	assert.Equal(t, 0, status.Data.Tiers[types.TierHot].Blobs)
+
+	// Reading cold content promotes it first
+	w = do(http.MethodGet, "/api/file/"+stored.Hash)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "rarely read", w.Body.String())
+	metadata, err = api.fileService.GetMetadata(context.Background(), stored.ID)
+	require.NoError(t, err)
+	assert.Equal(t, types.TierHot, metadata.Tier)
+
+	// With asynchronous restores the read is turned away until it is done
+	demote()
+	api.Tiering().Config().AsyncRestore = true
+	w = do(http.MethodGet, "/api/object/"+stored.ID)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"status":"restoring"`)
+
+	api.Tiering().Stop()
+	w = do(http.MethodGet, "/api/object/"+stored.ID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "rarely read", w.Body.String())
+}
+
+func TestRetention(t *testing.T) {
+	_, api := newTestRouter(t)
+
+	// Roles come from the authentication middleware in production
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if roles := c.GetHeader("X-Test-Roles"); roles != "" {
+			c.Set("username", "auditor")
+			c.Set("user_roles", strings.Split(roles, ","))
+		}
+	})
+	api.RegisterRoutes(router)
+
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	bypass := map[string]string{"X-Bypass-Governance-Retention": "true", "X-Test-Roles": "admin"}
+	store := func(name string) *types.FileMetadata {
+		t.Helper()
+		stored, err := api.fileService.Store(context.Background(), []byte("record "+name), &types.FileMetadata{FileName: name})
+		require.NoError(t, err)
+		return stored
+	}
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	t.Run("Governance", func(t *testing.T) {
+		stored := store("governed.txt")
+		w := do(http.MethodPut, "/api/object/"+stored.ID+"/retention", `{"mode":"governance","retain_until":"`+until+`"}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = do(http.MethodPut, "/api/metadata/"+stored.ID, `{"file_name":"renamed.txt"}`, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodDelete, "/api/object/"+stored.ID, "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodDelete, "/api/file/"+stored.Hash, "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		// Only a privileged role may bypass governance retention
+		w = do(http.MethodDelete, "/api/object/"+stored.ID, "", map[string]string{
+			"X-Bypass-Governance-Retention": "true", "X-Test-Roles": "viewer"})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodDelete, "/api/object/"+stored.ID, "", bypass)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = do(http.MethodGet, "/api/admin/retention/audit?object_id="+stored.ID, "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var audit struct {
+			Data []*types.RetentionRecord `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &audit))
+		require.Len(t, audit.Data, 1)
+		assert.Equal(t, "delete", audit.Data[0].Action)
+		assert.Equal(t, "auditor", audit.Data[0].Actor)
+		assert.Equal(t, types.RetentionGovernance, audit.Data[0].RetentionMode)
+	})
+
+	t.Run("Compliance", func(t *testing.T) {
+		stored := store("complied.txt")
+		w := do(http.MethodPut, "/api/object/"+stored.ID+"/retention", `{"mode":"compliance","retain_until":"`+until+`"}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// Not even a privileged role may bypass or shorten compliance retention
+		w = do(http.MethodDelete, "/api/object/"+stored.ID, "", bypass)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodPut, "/api/object/"+stored.ID+"/retention", `{"mode":""}`, bypass)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		later := time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)
+		w = do(http.MethodPut, "/api/object/"+stored.ID+"/retention", `{"mode":"compliance","retain_until":"`+later+`"}`, nil)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("LegalHold", func(t *testing.T) {
+		stored := store("held.txt")
+		w := do(http.MethodPut, "/api/object/"+stored.ID+"/legal-hold", `{"legal_hold":true}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = do(http.MethodDelete, "/api/metadata/"+stored.ID, "", bypass)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodPut, "/api/object/"+stored.ID+"/legal-hold", `{"legal_hold":false}`, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodPut, "/api/object/"+stored.ID+"/legal-hold", `{"legal_hold":false}`, bypass)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodDelete, "/api/object/"+stored.ID, "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("BucketDefault", func(t *testing.T) {
+		w := do(http.MethodPut, "/api/buckets/records", "", nil)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		w = do(http.MethodPatch, "/api/buckets/records", `{"retention_mode":"archive","retention_days":30}`, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = do(http.MethodPatch, "/api/buckets/records", `{"retention_mode":"compliance","retention_days":30}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = do(http.MethodPut, "/api/buckets/records/2024/ledger.csv", "a,b", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var put struct {
+			Data types.BucketEntry `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &put))
+		metadata, err := api.fileService.GetMetadata(context.Background(), put.Data.ObjectID)
+		require.NoError(t, err)
+		assert.Equal(t, types.RetentionCompliance, metadata.RetentionMode)
+		require.NotNil(t, metadata.RetainUntil)
+		assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *metadata.RetainUntil, time.Minute)
+
+		w = do(http.MethodPut, "/api/buckets/records/2024/ledger.csv", "c,d", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodDelete, "/api/buckets/records/2024/ledger.csv", "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodDelete, "/api/buckets/records?recursive=true", "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodGet, "/api/buckets/records/2024/ledger.csv", "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "a,b", w.Body.String())
+	})
+}
+
+func TestS3Gateway(t *testing.T) {
+	_, api := newTestRouter(t)
+
+	appConfig := &config.Config{
+		API: config.APIConfig{Mode: "native"},
+		S3:  config.S3Config{Port: "0"},
+	}
+	require.NoError(t, api.StartS3Gateway(appConfig))
+	assert.Nil(t, api.gateway)
+
+	// Serving it takes credentials to verify requests with
+	appConfig.API.Mode = "hybrid"
+	assert.Error(t, api.StartS3Gateway(appConfig))
+	assert.Nil(t, api.gateway)
+
+	appConfig.S3.AccessKey, appConfig.S3.SecretKey = "access", "secret"
+	require.NoError(t, api.StartS3Gateway(appConfig))
+	require.NotNil(t, api.gateway)
+	assert.NoError(t, api.StopS3Gateway(context.Background()))
+}
+
+func TestTrash(t *testing.T) {
+	t.Setenv("TRASH_INTERVAL", "0")
+	router, api := newTestRouter(t)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	store := func(name string) *types.FileMetadata {
+		t.Helper()
+		stored, err := api.fileService.Store(context.Background(), []byte("draft of "+name), &types.FileMetadata{FileName: name})
+		require.NoError(t, err)
+		return stored
+	}
+	type listing struct {
+		Data struct {
+			Items []struct {
+				ID       string    `json:"id"`
+				FileName string    `json:"file_name"`
+				PurgeAt  time.Time `json:"purge_at"`
+			} `json:"items"`
+			Total int `json:"total"`
+		} `json:"data"`
+	}
+	list := func() listing {
+		t.Helper()
+		w := do(http.MethodGet, "/api/trash")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var trashed listing
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trashed))
+		return trashed
+	}
+
+	t.Run("DeleteAndRestore", func(t *testing.T) {
+		stored := store("chapter.txt")
+		w := do(http.MethodDelete, "/api/object/"+stored.ID)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// Trashed objects are neither served nor listed
+		w = do(http.MethodGet, "/api/object/"+stored.ID)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = do(http.MethodGet, "/api/files?file_name=chapter.txt")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), stored.ID)
+
+		// Nor is their metadata changed
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/metadata/"+stored.ID, strings.NewReader(`{"file_name": "renamed.txt"}`)))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		trashed := list()
+		require.Equal(t, 1, trashed.Data.Total)
+		assert.Equal(t, stored.ID, trashed.Data.Items[0].ID)
+		assert.Equal(t, "chapter.txt", trashed.Data.Items[0].FileName)
+		assert.WithinDuration(t, time.Now().Add(trash.DefaultWindow), trashed.Data.Items[0].PurgeAt, time.Minute)
+
+		w = do(http.MethodPost, "/api/trash/"+stored.ID+"/restore")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodGet, "/api/object/"+stored.ID)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "draft of chapter.txt", w.Body.String())
+
+		w = do(http.MethodPost, "/api/trash/"+stored.ID+"/restore")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, 0, list().Data.Total)
+	})
+
+	t.Run("BucketKeys", func(t *testing.T) {
+		w := do(http.MethodPut, "/api/buckets/drafts")
+		require.Equal(t, http.StatusCreated, w.Code)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/buckets/drafts/notes.txt", strings.NewReader("notes")))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = do(http.MethodDelete, "/api/buckets/drafts/notes.txt")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodGet, "/api/buckets/drafts/notes.txt")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		trashed := list()
+		require.Equal(t, 1, trashed.Data.Total)
+		assert.Equal(t, "notes.txt", trashed.Data.Items[0].FileName)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		kept, purged := store("kept.txt"), store("purged.txt")
+		for _, id := range []string{kept.ID, purged.ID} {
+			w := do(http.MethodDelete, "/api/object/"+id)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		w := do(http.MethodDelete, "/api/admin/trash/"+purged.ID)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodPost, "/api/trash/"+purged.ID+"/restore")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = do(http.MethodPost, "/api/admin/trash/purge")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var run struct {
+			Data trash.Report `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+		assert.Equal(t, 2, run.Data.Purged)
+		assert.Equal(t, 0, list().Data.Total)
+
+		w = do(http.MethodGet, "/api/admin/trash")
+		require.Equal(t, http.StatusOK, w.Code)
+		var status struct {
+			Data struct {
+				Enabled    bool          `json:"enabled"`
+				Objects    int64         `json:"objects"`
+				LastReport *trash.Report `json:"last_report"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		assert.True(t, status.Data.Enabled)
+		assert.Zero(t, status.Data.Objects)
+		require.NotNil(t, status.Data.LastReport)
+		assert.Equal(t, 2, status.Data.LastReport.Purged)
+	})
+
+	t.Run("ByHash", func(t *testing.T) {
+		first, second := store("copy.txt"), store("copy.txt")
+		require.Equal(t, first.Hash, second.Hash)
+
+		// Deleting content by hash moves every object referencing it to the trash
+		w := do(http.MethodDelete, "/api/file/"+first.Hash)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 2, list().Data.Total)
+		w = do(http.MethodDelete, "/api/file/"+first.Hash)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		// The content is kept, so a restored object is served again
+		w = do(http.MethodPost, "/api/trash/"+first.ID+"/restore")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodGet, "/api/object/"+first.ID)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "draft of copy.txt", w.Body.String())
+	})
+}
@@ -0,0 +1,383 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/config"
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/migrate"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
+	"github.com/zots0127/io/pkg/storage/s3store"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// primaryBackendRequest selects the backend new blobs are written to
+type primaryBackendRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// migrationRequest starts moving every blob from one backend to another
+type migrationRequest struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+}
+
+// registerBackendRoutes registers the admin routes for storage backends and migrations between them
+func (a *API) registerBackendRoutes(admin *gin.RouterGroup) {
+	admin.GET("/backends", a.listBackends)
+	admin.PUT("/backends/primary", a.setPrimaryBackend)
+	admin.GET("/migrations", a.listMigrations)
+	admin.POST("/migrations", a.startMigration)
+	admin.GET("/migrations/:id", a.getMigration)
+	admin.DELETE("/migrations/:id", a.cancelMigration)
+}
+
+// Migrator returns the storage migrator, or nil without a metadata repository
+func (a *API) Migrator() *migrate.Migrator {
+	return a.migrator
+}
+
+// listBackends lists the storage backends and which one is primary
+func (a *API) listBackends(c *gin.Context) {
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Storage backends listed successfully",
+		Data:    a.content.Storage().Backends(),
+	})
+}
+
+// setPrimaryBackend selects the backend new blobs are written to
+func (a *API) setPrimaryBackend(c *gin.Context) {
+	var request primaryBackendRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := a.content.Storage().SetPrimaryBackend(request.Name); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, service.ErrUnknownBackend) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Failed to set primary backend",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Primary backend set successfully",
+		Data:    a.content.Storage().Backends(),
+	})
+}
+
+// listMigrations lists the storage migrations, optionally with one status
+func (a *API) listMigrations(c *gin.Context) {
+	if a.migrator == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	migrations, err := a.metadataRepo.ListMigrations(c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list migrations",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// The running migration reports its live progress
+	if current := a.migrator.Progress(); current != nil {
+		for i, migration := range migrations {
+			if migration.ID == current.ID {
+				migrations[i] = current
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Migrations listed successfully",
+		Data:    migrations,
+	})
+}
+
+// startMigration starts moving every blob and chunk from one backend to
+// another in the background
+func (a *API) startMigration(c *gin.Context) {
+	if a.migrator == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	var request migrationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// The migration outlives the request
+	migration, err := a.migrator.Migrate(context.Background(), request.From, request.To)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, migrate.ErrMigrationInProgress):
+			status = http.StatusConflict
+		case errors.Is(err, service.ErrUnknownBackend), errors.Is(err, migrate.ErrSameBackend):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Failed to start migration",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, types.APIResponse{
+		Success: true,
+		Message: "Migration started",
+		Data:    migration,
+	})
+}
+
+// getMigration returns a storage migration and its progress
+func (a *API) getMigration(c *gin.Context) {
+	if a.migrator == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	migration, err := a.migrator.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to get migration",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if migration == nil {
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "Migration not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Migration retrieved successfully",
+		Data:    migration,
+	})
+}
+
+// cancelMigration stops a running migration. What was already moved stays moved.
+func (a *API) cancelMigration(c *gin.Context) {
+	if a.migrator == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	id := c.Param("id")
+	if err := a.migrator.Cancel(id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, migrate.ErrNotRunning) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Failed to cancel migration",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	migration, _ := a.migrator.Get(id)
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Migration cancelled",
+		Data:    migration,
+	})
+}
+
+// OpenStorage opens the storage a configuration describes: the local root
+// with its hash algorithm, compression policy and keyring, and the S3 bucket
+// blobs are kept in when the storage backend is s3.
+func OpenStorage(appConfig *config.Config) (*service.Storage, error) {
+	storageConfig := appConfig.Storage
+	storagePath := "./data" // Default storage path
+	if storageConfig.Path != "" {
+		storagePath = storageConfig.Path
+	}
+	algorithm := digest.Default
+	if storageConfig.HashAlgorithm != "" {
+		configured, err := digest.Lookup(storageConfig.HashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		algorithm = configured
+	}
+	storage := service.NewStorageWithAlgorithm(storagePath, algorithm)
+
+	compression := &codec.Policy{
+		Codec:   storageConfig.Compression,
+		MinSize: storageConfig.CompressionMinSize,
+	}
+	if err := compression.Validate(); err != nil {
+		return nil, err
+	}
+	storage.SetCompression(compression)
+
+	keyring, err := encryption.LoadKeyring(storageConfig.EncryptionKeyFile, storageConfig.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	storage.SetEncryption(keyring)
+
+	// Keep blobs in an S3-compatible bucket, staging them beside the local store
+	if storageConfig.Backend == "s3" {
+		volume, err := s3store.NewVolume(&s3store.Config{
+			Endpoint:       storageConfig.S3.Endpoint,
+			Region:         storageConfig.S3.Region,
+			Bucket:         storageConfig.S3.Bucket,
+			Prefix:         storageConfig.S3.Prefix,
+			AccessKey:      storageConfig.S3.AccessKey,
+			SecretKey:      storageConfig.S3.SecretKey,
+			ForcePathStyle: storageConfig.S3.ForcePathStyle,
+			PartSize:       storageConfig.S3.PartSize,
+			StagingDir:     filepath.Join(storagePath, ".tmp"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := storage.AddVolume("s3", volume); err != nil {
+			return nil, err
+		}
+		if err := storage.SetPrimaryBackend("s3"); err != nil {
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+// MountBackends mounts the backends listed in STORAGE_BACKENDS, as
+// comma-separated name=path pairs, and selects STORAGE_PRIMARY_BACKEND. A
+// path of the form s3://bucket/prefix mounts an S3 bucket (see getS3Volume).
+func MountBackends(storage *service.Storage) error {
+	if backendsStr := os.Getenv("STORAGE_BACKENDS"); backendsStr != "" {
+		for _, pair := range strings.Split(backendsStr, ",") {
+			name, path, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return fmt.Errorf("invalid storage backend %q: expected name=path", pair)
+			}
+			name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+
+			var err error
+			if strings.HasPrefix(path, "s3://") {
+				var volume *s3store.Volume
+				if volume, err = getS3Volume(storage, path); err == nil {
+					err = storage.AddVolume(name, volume)
+				}
+			} else {
+				err = storage.AddBackend(name, path)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to mount storage backend: %w", err)
+			}
+		}
+	}
+
+	if primary := os.Getenv("STORAGE_PRIMARY_BACKEND"); primary != "" {
+		if err := storage.SetPrimaryBackend(primary); err != nil {
+			return fmt.Errorf("failed to set primary storage backend: %w", err)
+		}
+	}
+	return nil
+}
+
+// configureBackends mounts the backends of the environment, exiting if one
+// cannot be mounted
+func configureBackends(storage *service.Storage) {
+	if err := MountBackends(storage); err != nil {
+		log.Fatalf("Failed to configure storage backends: %v", err)
+	}
+}
+
+// getS3Volume opens the bucket at an s3://bucket/prefix URL. The endpoint,
+// region and credentials come from the STORAGE_S3_* environment variables.
+func getS3Volume(storage *service.Storage, url string) (*s3store.Volume, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(url, "s3://"), "/")
+
+	config := &s3store.Config{
+		Endpoint:       os.Getenv("STORAGE_S3_ENDPOINT"),
+		Region:         os.Getenv("STORAGE_S3_REGION"),
+		Bucket:         bucket,
+		Prefix:         prefix,
+		AccessKey:      os.Getenv("STORAGE_S3_ACCESS_KEY"),
+		SecretKey:      os.Getenv("STORAGE_S3_SECRET_KEY"),
+		ForcePathStyle: os.Getenv("STORAGE_S3_FORCE_PATH_STYLE") == "true",
+		StagingDir:     filepath.Join(storage.BasePath(), ".tmp"),
+	}
+	if partSizeStr := os.Getenv("STORAGE_S3_PART_SIZE"); partSizeStr != "" {
+		if partSize, err := strconv.ParseInt(partSizeStr, 10, 64); err == nil {
+			config.PartSize = partSize
+		}
+	}
+
+	volume, err := s3store.NewVolume(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open S3 storage backend %s: %w", url, err)
+	}
+	return volume, nil
+}
+
+// getMigrationConfig gets the storage migrator configuration from the environment or uses defaults
+func getMigrationConfig() *migrate.Config {
+	config := migrate.DefaultConfig()
+
+	if rateStr := os.Getenv("MIGRATION_RATE_LIMIT"); rateStr != "" {
+		if rate, err := strconv.ParseInt(rateStr, 10, 64); err == nil && rate >= 0 {
+			config.RateLimit = rate
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,473 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/buckets"
+	"github.com/zots0127/io/pkg/expiry"
+	"github.com/zots0127/io/pkg/quota"
+	"github.com/zots0127/io/pkg/retention"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// moveRequest is the body of a request to move or rename keys. Keys ending
+// in "/" move every key under them.
+type moveRequest struct {
+	FromBucket string `json:"from_bucket" binding:"required"`
+	FromKey    string `json:"from_key" binding:"required"`
+	ToBucket   string `json:"to_bucket"` // defaults to from_bucket
+	ToKey      string `json:"to_key" binding:"required"`
+}
+
+// updateBucketRequest is the body of a request to change a bucket's
+// settings. Settings left out are not changed.
+type updateBucketRequest struct {
+	MaxVersions *int `json:"max_versions"` // zero keeps every version
+	// RetentionMode and RetentionDays set the default retention of objects
+	// written to the bucket; an empty mode removes it
+	RetentionMode *string `json:"retention_mode"`
+	RetentionDays int     `json:"retention_days"`
+}
+
+// registerBucketRoutes registers the routes addressing objects by bucket and key
+func (a *API) registerBucketRoutes(api *gin.RouterGroup) {
+	group := api.Group("/buckets", a.bucketsAvailable)
+	group.GET("", a.listBuckets)
+	group.PUT("/:bucket", a.createBucket)
+	group.GET("/:bucket", a.listKeys)
+	group.PATCH("/:bucket", a.updateBucket)
+	group.DELETE("/:bucket", a.deleteBucket)
+	group.PUT("/:bucket/*key", a.putKey)
+	group.GET("/:bucket/*key", a.getKey)
+	group.HEAD("/:bucket/*key", a.getKey)
+	group.POST("/:bucket/*key", a.restoreVersion)
+	group.DELETE("/:bucket/*key", a.deleteKey)
+
+	api.POST("/move", a.bucketsAvailable, a.moveKeys)
+}
+
+// bucketsAvailable rejects bucket requests when there is no metadata repository to keep keys in
+func (a *API) bucketsAvailable(c *gin.Context) {
+	if a.buckets == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+	c.Next()
+}
+
+// listBuckets lists every bucket
+func (a *API) listBuckets(c *gin.Context) {
+	list, err := a.buckets.ListBuckets()
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// createBucket creates a bucket
+func (a *API) createBucket(c *gin.Context) {
+	bucket, err := a.buckets.CreateBucket(c.Param("bucket"))
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, types.APIResponse{
+		Success: true,
+		Message: "Bucket created",
+		Data:    bucket,
+	})
+}
+
+// updateBucket changes how many versions of each key a bucket keeps and the
+// default retention of objects written to it
+func (a *API) updateBucket(c *gin.Context) {
+	var request updateBucketRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if request.MaxVersions == nil && request.RetentionMode == nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Nothing to update: set max_versions or retention_mode",
+		})
+		return
+	}
+
+	name := c.Param("bucket")
+	var bucket *types.Bucket
+	var err error
+	if request.MaxVersions != nil {
+		bucket, err = a.buckets.SetMaxVersions(c.Request.Context(), name, *request.MaxVersions)
+	}
+	if err == nil && request.RetentionMode != nil {
+		bucket, err = a.buckets.SetRetention(name, *request.RetentionMode, request.RetentionDays)
+	}
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Bucket updated",
+		Data:    bucket,
+	})
+}
+
+// deleteBucket deletes an empty bucket, or with recursive=true a bucket and
+// every key in it
+func (a *API) deleteBucket(c *gin.Context) {
+	err := a.buckets.DeleteBucket(c.Request.Context(), c.Param("bucket"), c.Query("recursive") == "true")
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Bucket deleted",
+	})
+}
+
+// listKeys lists the keys of a bucket starting with the prefix query
+// parameter, rolling keys up into common prefixes at the delimiter if one is
+// given. Pages continue after the key or prefix given as after.
+func (a *API) listKeys(c *gin.Context) {
+	a.listBucket(c, c.Query("prefix"), c.Query("delimiter"))
+}
+
+// listBucket responds with a page of the keys of the requested bucket
+func (a *API) listBucket(c *gin.Context, prefix, delimiter string) {
+	limit := buckets.MaxListKeys
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid limit",
+			})
+			return
+		}
+		if parsed < limit {
+			limit = parsed
+		}
+	}
+
+	bucket := c.Param("bucket")
+	if _, err := a.buckets.GetBucket(bucket); err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	listing, err := a.buckets.List(bucket, prefix, delimiter, c.Query("after"), limit)
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    listing,
+	})
+}
+
+// putKey stores the request body under a key, replacing what was stored there
+func (a *API) putKey(c *gin.Context) {
+	metadata := &types.FileMetadata{
+		ContentType: c.ContentType(),
+		UploadedBy:  requestUser(c),
+		APIKeyID:    quota.APIKeyID(requestAPIKey(c)),
+	}
+	var err error
+	metadata.ExpiresAt, err = expiry.ExpiresAt(c.GetHeader("X-TTL"), c.GetHeader("X-Expires-At"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid expiry",
+			Error:   err.Error(),
+		})
+		return
+	}
+	// The size is declared up front so quotas can turn the upload away early
+	if c.Request.ContentLength > 0 {
+		metadata.Size = c.Request.ContentLength
+	}
+
+	entry, err := a.buckets.Put(c.Request.Context(), c.Param("bucket"), requestKey(c), c.Request.Body, metadata)
+	if err != nil {
+		if quotaError(c, err) {
+			return
+		}
+		if errors.Is(err, fileservice.ErrFileTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, types.APIResponse{
+				Success: false,
+				Message: "Failed to store file",
+				Error:   err.Error(),
+			})
+			return
+		}
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "File stored successfully",
+		Data:    entry,
+	})
+}
+
+// getKey serves what is stored under a key, or with version=N that version
+// of it. A key ending in "/" names a directory, which is listed one level
+// deep, and ?versions lists the versions of a key.
+func (a *API) getKey(c *gin.Context) {
+	bucket, key := c.Param("bucket"), requestKey(c)
+	if key == "" || strings.HasSuffix(key, "/") {
+		a.listBucket(c, key, "/")
+		return
+	}
+	if _, ok := c.GetQuery("versions"); ok {
+		a.listVersions(c, bucket, key)
+		return
+	}
+
+	if c.Query("version") != "" {
+		version, ok := parseVersion(c, c.Query("version"))
+		if !ok {
+			return
+		}
+		reader, objectVersion, metadata, err := a.buckets.OpenVersion(c.Request.Context(), bucket, key, version)
+		if err != nil {
+			bucketError(c, err)
+			return
+		}
+		defer reader.Close()
+
+		serveKey(c, reader, metadata, key, objectVersion.ETag, objectVersion.Version, objectVersion.CreatedAt)
+		return
+	}
+
+	reader, entry, metadata, err := a.buckets.Open(c.Request.Context(), bucket, key)
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+	defer reader.Close()
+
+	serveKey(c, reader, metadata, key, entry.ETag, entry.Version, entry.ModifiedAt)
+}
+
+// serveKey streams a version of the object stored under key. Unlike content
+// addressed by hash, a key can be overwritten, so its entity tag is the MD5
+// of what is stored under it now.
+func serveKey(c *gin.Context, reader io.ReadSeeker, metadata *types.FileMetadata, key, etag string, version int, modifiedAt time.Time) {
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	filename := path.Base(key)
+
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Header("X-Object-ID", metadata.ID)
+	c.Header("X-Version", strconv.Itoa(version))
+
+	http.ServeContent(c.Writer, c.Request, filename, modifiedAt, reader)
+}
+
+// listVersions lists the versions of a key, newest first
+func (a *API) listVersions(c *gin.Context, bucket, key string) {
+	versions, err := a.buckets.Versions(bucket, key)
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    versions,
+	})
+}
+
+// restoreVersion makes the version of a key given as restore=N current again
+func (a *API) restoreVersion(c *gin.Context) {
+	version, ok := parseVersion(c, c.Query("restore"))
+	if !ok {
+		return
+	}
+
+	entry, err := a.buckets.RestoreVersion(c.Request.Context(), c.Param("bucket"), requestKey(c), version)
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Version restored",
+		Data:    entry,
+	})
+}
+
+// deleteKey deletes a key with all its versions, or with version=N only that
+// version. A key ending in "/", or any key with recursive=true, deletes every
+// key starting with it.
+func (a *API) deleteKey(c *gin.Context) {
+	bucket, key := c.Param("bucket"), requestKey(c)
+
+	if c.Query("version") != "" {
+		version, ok := parseVersion(c, c.Query("version"))
+		if !ok {
+			return
+		}
+		if err := a.buckets.DeleteVersion(c.Request.Context(), bucket, key, version); err != nil {
+			bucketError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, types.APIResponse{
+			Success: true,
+			Message: "Version deleted",
+		})
+		return
+	}
+
+	if strings.HasSuffix(key, "/") || c.Query("recursive") == "true" {
+		if _, err := a.buckets.GetBucket(bucket); err != nil {
+			bucketError(c, err)
+			return
+		}
+		deleted, err := a.buckets.DeletePrefix(c.Request.Context(), bucket, key)
+		if err != nil {
+			bucketError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, types.APIResponse{
+			Success: true,
+			Message: "Keys deleted",
+			Data:    gin.H{"deleted": deleted},
+		})
+		return
+	}
+
+	if err := a.buckets.Delete(c.Request.Context(), bucket, key); err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "File deleted successfully",
+	})
+}
+
+// moveKeys moves or renames a key or directory of keys without copying content
+func (a *API) moveKeys(c *gin.Context) {
+	var request moveRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if request.ToBucket == "" {
+		request.ToBucket = request.FromBucket
+	}
+
+	moved, err := a.buckets.Move(c.Request.Context(), request.FromBucket, request.FromKey, request.ToBucket, request.ToKey)
+	if err != nil {
+		bucketError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Keys moved",
+		Data:    gin.H{"moved": moved},
+	})
+}
+
+// requestKey returns the key a request addresses, without the slash that
+// separates it from the bucket
+func requestKey(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("key"), "/")
+}
+
+// parseVersion reads a version number, responding with an error if it is invalid
+func parseVersion(c *gin.Context, value string) (int, bool) {
+	version, err := strconv.Atoi(value)
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid version",
+		})
+		return 0, false
+	}
+	return version, true
+}
+
+// bucketError maps bucket errors to status codes
+func bucketError(c *gin.Context, err error) {
+	if errors.Is(err, tiering.ErrRestoring) {
+		restoringError(c, err)
+		return
+	}
+	if errors.Is(err, retention.ErrLocked) {
+		lockedError(c, err)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, buckets.ErrBucketNotFound), errors.Is(err, buckets.ErrKeyNotFound), errors.Is(err, buckets.ErrVersionNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, buckets.ErrInvalidBucketName), errors.Is(err, buckets.ErrInvalidKey), errors.Is(err, buckets.ErrInvalidMove),
+		errors.Is(err, buckets.ErrInvalidMaxVersions), errors.Is(err, retention.ErrInvalidRetention):
+		status = http.StatusBadRequest
+	case errors.Is(err, buckets.ErrBucketExists), errors.Is(err, buckets.ErrBucketNotEmpty):
+		status = http.StatusConflict
+	case errors.Is(err, fileservice.ErrExpired):
+		status = http.StatusGone
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: "Bucket request failed",
+		Error:   err.Error(),
+	})
+}
+
+// getVersioning reports whether earlier versions of keys are kept when they
+// are written, from FEATURE_VERSIONING
+func getVersioning() bool {
+	return os.Getenv("FEATURE_VERSIONING") == "true"
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net"
+	"os"
+
+	"github.com/zots0127/io/pkg/config"
+	"github.com/zots0127/io/pkg/expiry"
+	"github.com/zots0127/io/pkg/lifecycle"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// settings are the limits, schedules and rules an API is created with
+type settings struct {
+	maxFileSize    int64
+	maxStorageSize int64
+	expiry         *expiry.Config
+	lifecycle      *lifecycle.Config
+	trustedProxies []*net.IPNet
+	versioning     bool
+	subjectQuotas  bool // whether uploader and API key quotas are enforced
+
+	// lifecycleRules replace the rules declared in configuration, unless nil
+	lifecycleRules []types.LifecycleRule
+}
+
+// getSettings gets the settings from the environment or uses defaults
+func getSettings() *settings {
+	return &settings{
+		maxFileSize:    getMaxFileSize(),
+		maxStorageSize: getMaxStorageSize(),
+		expiry:         getExpiryConfig(),
+		lifecycle:      getLifecycleConfig(),
+		trustedProxies: getTrustedProxies(),
+		versioning:     getVersioning(),
+		subjectQuotas:  os.Getenv("SECURITY_AUTH_ENABLED") == "true",
+	}
+}
+
+// NewAPIWithConfig creates a new API instance with the settings in appConfig,
+// declaring its lifecycle rules. Settings appConfig has no field for are read
+// from the environment, as by NewAPI.
+func NewAPIWithConfig(storage *service.Storage, metadataRepo *repository.MetadataRepository, appConfig *config.Config) (*API, error) {
+	return newAPI(storage, metadataRepo, getConfigSettings(appConfig))
+}
+
+// getConfigSettings gets the settings from appConfig, and those it has no
+// field for from the environment or defaults
+func getConfigSettings(appConfig *config.Config) *settings {
+	settings := getSettings()
+	if appConfig.Storage.MaxFileSize > 0 {
+		settings.maxFileSize = appConfig.Storage.MaxFileSize
+	}
+	settings.maxStorageSize = appConfig.Storage.MaxStorageSize
+	settings.expiry.Interval = appConfig.Storage.CleanupInterval
+	settings.trustedProxies = parseTrustedProxies(appConfig.Security.TrustedProxies)
+	settings.versioning = appConfig.Features.EnableVersioning
+	settings.subjectQuotas = appConfig.Security.EnableAuth
+
+	settings.lifecycle.Interval = appConfig.Lifecycle.Interval
+	settings.lifecycleRules = appConfig.Lifecycle.Rules
+	if settings.lifecycleRules == nil {
+		settings.lifecycleRules = []types.LifecycleRule{}
+	}
+
+	return settings
+}
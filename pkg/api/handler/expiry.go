@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/expiry"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// defaultExpiryRecords is how many audit records the expiry status lists by default
+const defaultExpiryRecords = 100
+
+// expiryStatus is the last expiry report together with the most recent deletions
+type expiryStatus struct {
+	LastReport *expiry.Report        `json:"last_report,omitempty"`
+	Deleted    []*types.ExpiryRecord `json:"deleted"`
+}
+
+// registerExpiryRoutes registers the admin routes for the expiry reaper
+func (a *API) registerExpiryRoutes(admin *gin.RouterGroup) {
+	admin.GET("/expiry", a.getExpiryStatus)
+	admin.POST("/expiry", a.runExpiry)
+}
+
+// getExpiryStatus returns the report of the last expiry run and the audit
+// records of the most recent deletions, up to limit
+func (a *API) getExpiryStatus(c *gin.Context) {
+	if a.reaper == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	limit := defaultExpiryRecords
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid limit",
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	records, err := a.metadataRepo.ListExpiryRecords(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list expiry records",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Expiry status retrieved successfully",
+		Data:    expiryStatus{LastReport: a.reaper.LastReport(), Deleted: records},
+	})
+}
+
+// runExpiry deletes every object that has expired
+func (a *API) runExpiry(c *gin.Context) {
+	if a.reaper == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	report, err := a.reaper.Run(c.Request.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, expiry.ErrRunInProgress) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Expiry run failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Expiry run completed",
+		Data:    report,
+	})
+}
+
+// expiredError answers a request for an object that has expired. It is gone
+// for good, even if the reaper has not deleted it yet.
+func expiredError(c *gin.Context, err error) {
+	c.JSON(http.StatusGone, types.APIResponse{
+		Success: false,
+		Message: "File has expired",
+		Error:   err.Error(),
+	})
+}
+
+// getExpiryConfig gets the expiry reaper configuration from the environment or
+// uses defaults. STORAGE_CLEANUP_INTERVAL sets how often it runs; NewAPIWithConfig
+// takes it from storage.cleanup_interval instead.
+func getExpiryConfig() *expiry.Config {
+	config := expiry.DefaultConfig()
+
+	if intervalStr := os.Getenv("STORAGE_CLEANUP_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Interval = interval
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zots0127/io/pkg/config"
+	"github.com/zots0127/io/pkg/s3api"
+)
+
+// StartS3Gateway serves the S3 API alongside the native one when appConfig
+// enables it, with s3.enabled or an API mode of s3 or hybrid. Buckets and keys
+// map onto the same objects the native API serves. Parts of multipart uploads
+// are staged under .multipart in the storage directory.
+func (a *API) StartS3Gateway(appConfig *config.Config) error {
+	if !s3GatewayEnabled(appConfig) {
+		return nil
+	}
+	if a.metadataRepo == nil {
+		return fmt.Errorf("S3 gateway requires a metadata repository")
+	}
+
+	gateway := s3api.NewGateway(a.fileService, a.metadataRepo, &s3api.Config{
+		AccessKey:        appConfig.S3.AccessKey,
+		SecretKey:        appConfig.S3.SecretKey,
+		Region:           appConfig.S3.Region,
+		Dir:              filepath.Join(a.basePath, ".multipart"),
+		UploadExpiration: getS3UploadExpiration(),
+		Versioning:       a.versioning,
+		Retention:        a.retention,
+	})
+	if err := gateway.Start(":" + appConfig.S3.Port); err != nil {
+		return fmt.Errorf("failed to start S3 gateway: %w", err)
+	}
+	a.gateway = gateway
+	return nil
+}
+
+// StopS3Gateway stops serving the S3 API, waiting for requests in flight until ctx is done
+func (a *API) StopS3Gateway(ctx context.Context) error {
+	if a.gateway == nil {
+		return nil
+	}
+	return a.gateway.Stop(ctx)
+}
+
+// s3GatewayEnabled reports whether appConfig has the S3 API served
+func s3GatewayEnabled(appConfig *config.Config) bool {
+	mode := appConfig.API.Mode
+	return appConfig.S3.Enabled || mode == "s3" || mode == "hybrid"
+}
+
+// getS3UploadExpiration gets how long an idle multipart upload is kept from configuration or uses default
+func getS3UploadExpiration() time.Duration {
+	if expirationStr := os.Getenv("S3_MULTIPART_EXPIRATION"); expirationStr != "" {
+		if parsed, err := time.ParseDuration(expirationStr); err == nil {
+			return parsed
+		}
+	}
+	return s3api.DefaultUploadExpiration
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/lifecycle"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Lifecycle run modes
+const (
+	lifecycleDryRun = "dry-run"
+	lifecycleApply  = "apply"
+)
+
+// lifecycleStatus is the report of the last lifecycle run together with every rule
+type lifecycleStatus struct {
+	LastReport *lifecycle.Report      `json:"last_report,omitempty"`
+	Rules      []*types.LifecycleRule `json:"rules"`
+}
+
+// registerLifecycleRoutes registers the admin routes for lifecycle rules
+func (a *API) registerLifecycleRoutes(admin *gin.RouterGroup) {
+	group := admin.Group("/lifecycle", a.lifecycleAvailable)
+	group.GET("", a.getLifecycleStatus)
+	group.POST("", a.runLifecycle)
+	group.GET("/rules", a.listLifecycleRules)
+	group.GET("/rules/:id", a.getLifecycleRule)
+	group.PUT("/rules/:id", a.putLifecycleRule)
+	group.DELETE("/rules/:id", a.deleteLifecycleRule)
+}
+
+// Lifecycle returns the lifecycle evaluator, or nil without a metadata repository
+func (a *API) Lifecycle() *lifecycle.Evaluator {
+	return a.lifecycle
+}
+
+// lifecycleAvailable rejects lifecycle requests when there is no metadata repository to keep rules in
+func (a *API) lifecycleAvailable(c *gin.Context) {
+	if a.lifecycle == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+	c.Next()
+}
+
+// getLifecycleStatus returns the report of the last lifecycle run and every rule
+func (a *API) getLifecycleStatus(c *gin.Context) {
+	rules, err := a.lifecycle.Rules()
+	if err != nil {
+		lifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Lifecycle status retrieved successfully",
+		Data:    lifecycleStatus{LastReport: a.lifecycle.LastReport(), Rules: rules},
+	})
+}
+
+// runLifecycle applies every enabled rule. It defaults to a dry run that
+// only reports what each rule would do; pass mode=apply to apply them.
+func (a *API) runLifecycle(c *gin.Context) {
+	mode := c.DefaultQuery("mode", lifecycleDryRun)
+	if mode != lifecycleDryRun && mode != lifecycleApply {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid mode, expected dry-run or apply",
+		})
+		return
+	}
+
+	report, err := a.lifecycle.Run(c.Request.Context(), mode == lifecycleDryRun)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, lifecycle.ErrRunInProgress) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Lifecycle run failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Lifecycle run completed",
+		Data:    report,
+	})
+}
+
+// listLifecycleRules lists every lifecycle rule
+func (a *API) listLifecycleRules(c *gin.Context) {
+	rules, err := a.lifecycle.Rules()
+	if err != nil {
+		lifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    rules,
+	})
+}
+
+// getLifecycleRule returns one lifecycle rule
+func (a *API) getLifecycleRule(c *gin.Context) {
+	rule, err := a.lifecycle.Rule(c.Param("id"))
+	if err != nil {
+		lifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    rule,
+	})
+}
+
+// putLifecycleRule creates or replaces the lifecycle rule named in the path
+func (a *API) putLifecycleRule(c *gin.Context) {
+	var rule types.LifecycleRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+	rule.ID = c.Param("id")
+
+	if err := a.lifecycle.SaveRule(&rule); err != nil {
+		lifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Lifecycle rule saved",
+		Data:    rule,
+	})
+}
+
+// deleteLifecycleRule removes a lifecycle rule
+func (a *API) deleteLifecycleRule(c *gin.Context) {
+	if err := a.lifecycle.DeleteRule(c.Param("id")); err != nil {
+		lifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Lifecycle rule deleted",
+	})
+}
+
+// lifecycleError maps lifecycle errors to status codes
+func lifecycleError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, lifecycle.ErrRuleNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, lifecycle.ErrInvalidRule):
+		status = http.StatusBadRequest
+	case errors.Is(err, lifecycle.ErrRuleDeclared):
+		status = http.StatusConflict
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: "Lifecycle rule request failed",
+		Error:   err.Error(),
+	})
+}
+
+// getLifecycleConfig gets the lifecycle evaluator configuration from the
+// environment or uses defaults. LIFECYCLE_INTERVAL sets how often rules are applied.
+func getLifecycleConfig() *lifecycle.Config {
+	config := lifecycle.DefaultConfig()
+
+	if intervalStr := os.Getenv("LIFECYCLE_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Interval = interval
+		}
+	}
+
+	return config
+}
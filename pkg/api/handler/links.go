@@ -0,0 +1,381 @@
+package handler
+
+import (
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/links"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// downloadLinkPath is where download links are served. It lies outside /api
+// so that the links work for clients without an API key.
+const downloadLinkPath = "/d/"
+
+// createLinkRequest is the body of a request for a download link
+type createLinkRequest struct {
+	ObjectID     string `json:"object_id" binding:"required"`
+	ExpiresIn    string `json:"expires_in"` // a duration such as "30m"; defaults to DOWNLOAD_LINK_EXPIRY
+	MaxDownloads int    `json:"max_downloads"`
+	SingleUse    bool   `json:"single_use"` // shorthand for max_downloads 1
+	AllowedIP    string `json:"allowed_ip"`
+	FileName     string `json:"file_name"`
+	Inline       bool   `json:"inline"`
+}
+
+// linkResponse is a download link and the URL that serves it
+type linkResponse struct {
+	*types.DownloadLink
+	URL string `json:"url"`
+}
+
+// registerLinkRoutes registers the routes managing download links, and the
+// unauthenticated route serving them
+func (a *API) registerLinkRoutes(router *gin.Engine, api *gin.RouterGroup) {
+	group := api.Group("/links", a.linksAvailable)
+	group.POST("", a.createLink)
+	group.GET("", a.listLinks)
+	group.GET("/:id", a.getLink)
+	group.DELETE("/:id", a.revokeLink)
+
+	router.GET(downloadLinkPath+":id", a.linksAvailable, a.serveLink)
+	router.HEAD(downloadLinkPath+":id", a.linksAvailable, a.serveLink)
+}
+
+// linksAvailable rejects link requests when there is no metadata repository to keep links in
+func (a *API) linksAvailable(c *gin.Context) {
+	if a.links == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+	c.Next()
+}
+
+// createLink mints a signed download link to an object
+func (a *API) createLink(c *gin.Context) {
+	var request createLinkRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	options := &links.Options{
+		MaxDownloads: request.MaxDownloads,
+		AllowedIP:    request.AllowedIP,
+		FileName:     request.FileName,
+		Inline:       request.Inline,
+		CreatedBy:    requestUser(c),
+	}
+	if request.SingleUse {
+		options.MaxDownloads = 1
+	}
+	if request.ExpiresIn != "" {
+		expiry, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || expiry <= 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid expires_in duration",
+			})
+			return
+		}
+		options.Expiry = expiry
+	}
+
+	link, err := a.links.Create(request.ObjectID, options)
+	if err != nil {
+		linkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, types.APIResponse{
+		Success: true,
+		Message: "Download link created",
+		Data:    a.linkResponse(c, link),
+	})
+}
+
+// listLinks lists download links, optionally those of one object only
+func (a *API) listLinks(c *gin.Context) {
+	list, err := a.links.List(c.Query("object_id"))
+	if err != nil {
+		linkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// getLink returns a download link, its URL and how often it has been used
+func (a *API) getLink(c *gin.Context) {
+	link, err := a.links.Get(c.Param("id"))
+	if err != nil {
+		linkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Data:    a.linkResponse(c, link),
+	})
+}
+
+// revokeLink stops a download link from working before it expires
+func (a *API) revokeLink(c *gin.Context) {
+	link, err := a.links.Revoke(c.Param("id"))
+	if err != nil {
+		linkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Download link revoked",
+		Data:    link,
+	})
+}
+
+// serveLink streams the object a signed link names. Every request sending
+// content counts as a download; HEAD requests and conditional requests
+// answered with 304 Not Modified check the link without counting one.
+func (a *API) serveLink(c *gin.Context) {
+	link, err := a.links.Open(c.Param("id"), c.Query("expires"), c.Query("signature"), a.clientIP(c))
+	if err != nil {
+		linkError(c, err)
+		return
+	}
+
+	reader, metadata, err := a.fileService.RetrieveObject(c.Request.Context(), link.ObjectID)
+	if err != nil {
+		if errors.Is(err, fileservice.ErrExpired) {
+			expiredError(c, err)
+			return
+		}
+		if errors.Is(err, tiering.ErrRestoring) {
+			restoringError(c, err)
+			return
+		}
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "File not found",
+			Error:   err.Error(),
+		})
+		return
+	}
+	defer reader.Close()
+
+	etag := `"` + metadata.Hash + `"`
+	if countsAsDownload(c.Request, etag, metadata.UploadedAt) {
+		if err := a.links.Claim(link); err != nil {
+			linkError(c, err)
+			return
+		}
+	}
+
+	filename := link.FileName
+	if filename == "" {
+		filename = metadata.FileName
+	}
+	if filename == "" {
+		filename = metadata.Hash
+	}
+	disposition := "attachment"
+	if link.Inline {
+		disposition = "inline"
+	}
+
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(c.Writer, c.Request, filename, metadata.UploadedAt, reader)
+}
+
+// countsAsDownload reports whether serving r sends content, in whole or in
+// part. HEAD requests and conditional requests answered with 304 Not Modified
+// do not count.
+func countsAsDownload(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+
+	modified = modified.Truncate(time.Second)
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if etagMatches(match, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		return false
+	}
+	return true
+}
+
+// etagMatches reports whether an If-None-Match list names etag, using the
+// weak comparison
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a link is served to: the peer address, or the
+// one X-Forwarded-For names when the peer is a trusted proxy. Unlike
+// gin's ClientIP, it ignores forwarding headers from anyone else.
+func (a *API) clientIP(c *gin.Context) string {
+	ip := c.RemoteIP()
+	if !a.trustedProxy(ip) {
+		return ip
+	}
+
+	// Each proxy appends the address it received the request from
+	hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !a.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is in one of the trusted proxy networks
+func (a *API) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range a.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses trusted proxy addresses and CIDR ranges,
+// skipping those that are invalid
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// getTrustedProxies gets the proxies whose X-Forwarded-For headers are
+// believed from TRUSTED_PROXIES, a comma-separated list of addresses and CIDR
+// ranges. None are trusted by default.
+func getTrustedProxies() []*net.IPNet {
+	return parseTrustedProxies(strings.Split(os.Getenv("TRUSTED_PROXIES"), ","))
+}
+
+// linkResponse returns link with the absolute URL that serves it
+func (a *API) linkResponse(c *gin.Context, link *types.DownloadLink) *linkResponse {
+	return &linkResponse{
+		DownloadLink: link,
+		URL:          linkBaseURL(c) + downloadLinkPath + link.ID + "?" + a.links.Query(link).Encode(),
+	}
+}
+
+// linkError maps link errors to status codes
+func linkError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, links.ErrLinkNotFound), errors.Is(err, links.ErrObjectNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, links.ErrInvalidOptions):
+		status = http.StatusBadRequest
+	case errors.Is(err, links.ErrInvalidSignature), errors.Is(err, links.ErrAddressNotAllowed):
+		status = http.StatusForbidden
+	case errors.Is(err, links.ErrLinkExpired), errors.Is(err, links.ErrLinkRevoked), errors.Is(err, links.ErrLinkExhausted):
+		status = http.StatusGone
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: "Download link unavailable",
+		Error:   err.Error(),
+	})
+}
+
+// linkBaseURL returns the scheme and host download link URLs start with:
+// DOWNLOAD_LINK_BASE_URL if set, or the address the request was sent to
+func linkBaseURL(c *gin.Context) string {
+	if baseURL := os.Getenv("DOWNLOAD_LINK_BASE_URL"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// getLinkConfig gets the link signing secret and expiries from configuration or uses defaults
+func getLinkConfig() *links.Config {
+	config := &links.Config{
+		Secret: []byte(os.Getenv("DOWNLOAD_LINK_SECRET")),
+	}
+
+	if expiryStr := os.Getenv("DOWNLOAD_LINK_EXPIRY"); expiryStr != "" {
+		if parsed, err := time.ParseDuration(expiryStr); err == nil {
+			config.DefaultExpiry = parsed
+		}
+	}
+	if maxExpiryStr := os.Getenv("DOWNLOAD_LINK_MAX_EXPIRY"); maxExpiryStr != "" {
+		if parsed, err := time.ParseDuration(maxExpiryStr); err == nil {
+			config.MaxExpiry = parsed
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/quota"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// defaultMaxStorageSize matches the default of storage.max_storage_size
+const defaultMaxStorageSize = 10 * 1024 * 1024 * 1024
+
+// quotaUsage is the usage of a scope together with the quota in effect for it
+type quotaUsage struct {
+	*types.Usage
+	Quota *types.Quota `json:"quota,omitempty"`
+}
+
+// registerQuotaRoutes registers the admin routes for reading and setting quotas
+func (a *API) registerQuotaRoutes(admin *gin.RouterGroup) {
+	admin.GET("/quotas", a.listQuotas)
+	admin.PUT("/quotas", a.setQuota)
+	admin.DELETE("/quotas", a.deleteQuota)
+	admin.GET("/usage", a.getUsage)
+}
+
+// listQuotas lists the quotas set, optionally of one scope
+func (a *API) listQuotas(c *gin.Context) {
+	if a.quotas == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	quotas, err := a.metadataRepo.ListQuotas(c.Query("scope"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list quotas",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Quotas listed successfully",
+		Data:    quotas,
+	})
+}
+
+// setQuota creates or replaces a quota. Limits of zero are unlimited.
+func (a *API) setQuota(c *gin.Context) {
+	if a.quotas == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	var request types.Quota
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if request.MaxBytes < 0 || request.MaxObjects < 0 {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Quota limits cannot be negative",
+		})
+		return
+	}
+	if err := a.quotas.CheckScope(request.Scope); err != nil {
+		c.JSON(http.StatusConflict, types.APIResponse{
+			Success: false,
+			Message: "Failed to set quota",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := a.metadataRepo.SaveQuota(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Failed to set quota",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Quota set successfully",
+		Data:    request,
+	})
+}
+
+// deleteQuota removes a quota, leaving its scope unlimited or, for the global
+// quota, back at the configured maximum storage size
+func (a *API) deleteQuota(c *gin.Context) {
+	if a.quotas == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	removed, err := a.metadataRepo.DeleteQuota(c.Query("scope"), c.Query("subject"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to delete quota",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, types.APIResponse{
+			Success: false,
+			Message: "Quota not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Quota deleted successfully",
+	})
+}
+
+// getUsage reports usage with the quota in effect: of the whole store by
+// default, of one uploader or API key with scope and subject, or of every
+// uploader or API key with only scope
+func (a *API) getUsage(c *gin.Context) {
+	if a.quotas == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	scope := c.DefaultQuery("scope", types.QuotaScopeGlobal)
+	subject := c.Query("subject")
+
+	var usages []*types.Usage
+	var err error
+	if scope == types.QuotaScopeGlobal || subject != "" {
+		var usage *types.Usage
+		if usage, err = a.metadataRepo.GetUsage(scope, subject); err == nil {
+			usages = []*types.Usage{usage}
+		}
+	} else {
+		usages, err = a.metadataRepo.ListUsage(scope)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Failed to get usage",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	results := make([]quotaUsage, 0, len(usages))
+	for _, usage := range usages {
+		limits, err := a.quotas.Limits(usage.Scope, usage.Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, types.APIResponse{
+				Success: false,
+				Message: "Failed to get quota",
+				Error:   err.Error(),
+			})
+			return
+		}
+		results = append(results, quotaUsage{Usage: usage, Quota: limits})
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Usage retrieved successfully",
+		Data:    results,
+	})
+}
+
+// quotaError responds to an upload refused by a quota and reports whether err
+// was one: 507 when the store is full, 413 when an uploader or API key quota
+// is exceeded. The body names the quota, its limit and what is used.
+func quotaError(c *gin.Context, err error) bool {
+	var exceeded *quota.ExceededError
+	if !errors.As(err, &exceeded) {
+		return false
+	}
+
+	status, message := http.StatusRequestEntityTooLarge, "Quota exceeded"
+	if errors.Is(err, quota.ErrStorageFull) {
+		status, message = http.StatusInsufficientStorage, "Storage capacity exceeded"
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: message,
+		Data:    exceeded,
+		Error:   exceeded.Error(),
+	})
+	return true
+}
+
+// quotaOwner returns who an upload is charged to: the user making the
+// request and the API key it authenticated with. Their quotas are only
+// enforced while requests are authenticated.
+func quotaOwner(c *gin.Context) quota.Owner {
+	return quota.Owner{
+		User:     requestUser(c),
+		APIKeyID: quota.APIKeyID(requestAPIKey(c)),
+	}
+}
+
+// requestUser names who makes a request: the authenticated user, or only
+// when the request is not authenticated, the uploader named in X-Uploaded-By
+func requestUser(c *gin.Context) string {
+	if username := c.GetString("username"); username != "" {
+		return username
+	}
+	if userID := c.GetString("user_id"); userID != "" {
+		return userID
+	}
+	return c.GetHeader("X-Uploaded-By")
+}
+
+// requestAPIKey returns the API key a request authenticated with, as set by
+// the authentication middleware. Keys the middleware has not checked are ignored.
+func requestAPIKey(c *gin.Context) string {
+	return c.GetString("api_key")
+}
+
+// getMaxStorageSize gets the global storage cap from configuration or uses default. Zero means unlimited.
+func getMaxStorageSize() int64 {
+	maxSize := int64(defaultMaxStorageSize)
+
+	if sizeStr := os.Getenv("STORAGE_MAX_SIZE"); sizeStr != "" {
+		if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && size >= 0 {
+			maxSize = size
+		}
+	}
+
+	return maxSize
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/retention"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// bypassGovernanceHeader is the header privileged callers set to "true" to
+// bypass governance retention for a request
+const bypassGovernanceHeader = "X-Bypass-Governance-Retention"
+
+// defaultRetentionRecords is how many audit records are listed by default
+const defaultRetentionRecords = 100
+
+// retentionRequest is the body of a request to set an object's retention
+type retentionRequest struct {
+	Mode        string     `json:"mode"` // governance or compliance; empty removes retention
+	RetainUntil *time.Time `json:"retain_until"`
+}
+
+// legalHoldRequest is the body of a request to place or release a legal hold
+type legalHoldRequest struct {
+	LegalHold *bool `json:"legal_hold" binding:"required"`
+}
+
+// registerRetentionRoutes registers the routes setting retention and legal
+// holds on objects, and the admin route listing the retention audit trail
+func (a *API) registerRetentionRoutes(api, admin *gin.RouterGroup) {
+	api.PUT("/object/:id/retention", a.retentionAvailable, a.setObjectRetention)
+	api.PUT("/object/:id/legal-hold", a.retentionAvailable, a.setObjectLegalHold)
+	admin.GET("/retention/audit", a.retentionAvailable, a.getRetentionAudit)
+}
+
+// Retention returns the retention enforcer, or nil without a metadata repository
+func (a *API) Retention() *retention.Enforcer {
+	return a.retention
+}
+
+// retentionAvailable rejects retention requests when there is no metadata repository to keep it in
+func (a *API) retentionAvailable(c *gin.Context) {
+	if a.retention == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+	c.Next()
+}
+
+// retentionBypass lets a request bypass governance retention when it sets
+// the bypass header and its user holds a privileged role. The user is
+// recorded as the actor of every bypass the request makes.
+func (a *API) retentionBypass(c *gin.Context) {
+	if a.retention == nil || c.GetHeader(bypassGovernanceHeader) != "true" {
+		c.Next()
+		return
+	}
+
+	roles, _ := c.Get("user_roles")
+	userRoles, _ := roles.([]string)
+	if !a.retention.Privileged(userRoles) {
+		c.AbortWithStatusJSON(http.StatusForbidden, types.APIResponse{
+			Success: false,
+			Message: "Bypassing governance retention requires a privileged role",
+		})
+		return
+	}
+
+	c.Request = c.Request.WithContext(retention.WithBypass(c.Request.Context(), requestUser(c)))
+	c.Next()
+}
+
+// setObjectRetention retains an object in a mode until a time, or removes its retention
+func (a *API) setObjectRetention(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	var request retentionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	metadata, err := a.retention.SetRetention(c.Request.Context(), id, request.Mode, request.RetainUntil)
+	if err != nil {
+		retentionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Retention updated",
+		Data:    metadata,
+	})
+}
+
+// setObjectLegalHold places an object under legal hold or releases the hold
+func (a *API) setObjectLegalHold(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	var request legalHoldRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	metadata, err := a.retention.SetLegalHold(c.Request.Context(), id, *request.LegalHold)
+	if err != nil {
+		retentionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Legal hold updated",
+		Data:    metadata,
+	})
+}
+
+// getRetentionAudit lists the most recent retention bypasses and legal hold
+// releases, up to limit, only those of the object_id query parameter if given
+func (a *API) getRetentionAudit(c *gin.Context) {
+	limit := defaultRetentionRecords
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid limit",
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	records, err := a.retention.Records(c.Query("object_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list retention records",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Retention audit retrieved successfully",
+		Data:    records,
+	})
+}
+
+// retentionError maps a failed retention or legal hold change to a response
+func retentionError(c *gin.Context, err error) {
+	if errors.Is(err, retention.ErrLocked) {
+		lockedError(c, err)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, retention.ErrObjectNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, retention.ErrInvalidRetention):
+		status = http.StatusBadRequest
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: "Retention request failed",
+		Error:   err.Error(),
+	})
+}
+
+// lockedError answers a request to change an object that retention or a
+// legal hold protects
+func lockedError(c *gin.Context, err error) {
+	c.JSON(http.StatusForbidden, types.APIResponse{
+		Success: false,
+		Message: "Object is protected by retention or legal hold",
+		Error:   err.Error(),
+	})
+}
+
+// getRetentionConfig gets the retention configuration from the environment or
+// uses defaults. RETENTION_BYPASS_ROLES lists, separated by commas, the roles
+// allowed to bypass governance retention and release legal holds.
+func getRetentionConfig() *retention.Config {
+	config := retention.DefaultConfig()
+
+	if rolesStr := os.Getenv("RETENTION_BYPASS_ROLES"); rolesStr != "" {
+		roles := []string{}
+		for _, role := range strings.Split(rolesStr, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+		config.BypassRoles = roles
+	}
+
+	return config
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/scrub"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// integrityStatus is the last scrub report together with the integrity checks on record
+type integrityStatus struct {
+	Summary    *types.IntegritySummary `json:"summary"`
+	LastReport *scrub.Report           `json:"last_report,omitempty"`
+}
+
+// registerScrubRoutes registers the admin routes for the integrity scrubber
+func (a *API) registerScrubRoutes(admin *gin.RouterGroup) {
+	admin.GET("/scrub", a.getScrubStatus)
+	admin.POST("/scrub", a.runScrub)
+	admin.GET("/integrity", a.listIntegrityChecks)
+}
+
+// Scrubber returns the integrity scrubber, or nil without a metadata
+// repository, so its results can be reported to a metrics collector
+func (a *API) Scrubber() *scrub.Scrubber {
+	return a.scrubber
+}
+
+// getScrubStatus returns the integrity checks on record and the report of the last scrub
+func (a *API) getScrubStatus(c *gin.Context) {
+	if a.scrubber == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	summary, err := a.metadataRepo.GetIntegritySummary()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to get integrity summary",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Integrity status retrieved successfully",
+		Data:    integrityStatus{Summary: summary, LastReport: a.scrubber.LastReport()},
+	})
+}
+
+// runScrub re-verifies every blob and chunk that is due
+func (a *API) runScrub(c *gin.Context) {
+	if a.scrubber == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	report, err := a.scrubber.Run(c.Request.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, scrub.ErrRunInProgress) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Integrity scrub failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Integrity scrub completed",
+		Data:    report,
+	})
+}
+
+// listIntegrityChecks lists the integrity checks on record, optionally of one
+// store and with one status, such as status=corrupt
+func (a *API) listIntegrityChecks(c *gin.Context) {
+	if a.scrubber == nil {
+		c.JSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	checks, err := a.metadataRepo.ListIntegrityChecks(c.Query("store"), c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list integrity checks",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Integrity checks listed successfully",
+		Data:    checks,
+	})
+}
+
+// getScrubConfig gets the integrity scrubber configuration from the environment or uses defaults
+func getScrubConfig() *scrub.Config {
+	config := scrub.DefaultConfig()
+	config.Interval = 24 * time.Hour
+
+	if intervalStr := os.Getenv("SCRUB_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Interval = interval
+		}
+	}
+	if rateStr := os.Getenv("SCRUB_RATE_LIMIT"); rateStr != "" {
+		if rate, err := strconv.ParseInt(rateStr, 10, 64); err == nil && rate >= 0 {
+			config.RateLimit = rate
+		}
+	}
+	if ageStr := os.Getenv("SCRUB_MIN_AGE"); ageStr != "" {
+		if age, err := time.ParseDuration(ageStr); err == nil {
+			config.MinAge = age
+		}
+	}
+	if replicasStr := os.Getenv("SCRUB_REPLICAS"); replicasStr != "" {
+		for _, replica := range strings.Split(replicasStr, ",") {
+			if replica = strings.TrimSpace(replica); replica != "" {
+				config.Replicas = append(config.Replicas, replica)
+			}
+		}
+	}
+
+	return config
+}
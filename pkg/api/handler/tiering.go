@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// restoreRetryAfter is how many seconds clients are asked to wait before
+// reading content being restored from cold storage again
+const restoreRetryAfter = 30
+
+// tieringStatus is the tiering configuration, the report of the last run,
+// the content being restored and how much content each tier holds
+type tieringStatus struct {
+	Enabled      bool                        `json:"enabled"`
+	ColdBackend  string                      `json:"cold_backend,omitempty"`
+	ColdAfter    string                      `json:"cold_after"`
+	AsyncRestore bool                        `json:"async_restore"`
+	LastReport   *tiering.Report             `json:"last_report,omitempty"`
+	Restoring    []string                    `json:"restoring"`
+	Tiers        map[string]*types.TierUsage `json:"tiers"`
+}
+
+// registerTieringRoutes registers the admin routes for storage tiering
+func (a *API) registerTieringRoutes(admin *gin.RouterGroup) {
+	group := admin.Group("/tiering", a.tieringAvailable)
+	group.GET("", a.getTieringStatus)
+	group.POST("", a.runTiering)
+}
+
+// Tiering returns the tiering manager, or nil without a metadata repository
+func (a *API) Tiering() *tiering.Manager {
+	return a.tiering
+}
+
+// tieringAvailable rejects tiering requests when there is no metadata repository to track access in
+func (a *API) tieringAvailable(c *gin.Context) {
+	if a.tiering == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+	c.Next()
+}
+
+// getTieringStatus returns the tiering configuration, the last run and how much content each tier holds
+func (a *API) getTieringStatus(c *gin.Context) {
+	tiers, err := a.metadataRepo.CountBlobsByTier()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to get tier usage",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	config := a.tiering.Config()
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Tiering status retrieved successfully",
+		Data: tieringStatus{
+			Enabled:      a.tiering.Enabled(),
+			ColdBackend:  config.ColdBackend,
+			ColdAfter:    config.ColdAfter.String(),
+			AsyncRestore: config.AsyncRestore,
+			LastReport:   a.tiering.LastReport(),
+			Restoring:    a.tiering.Restoring(),
+			Tiers:        tiers,
+		},
+	})
+}
+
+// runTiering demotes idle content to cold storage now
+func (a *API) runTiering(c *gin.Context) {
+	report, err := a.tiering.Run(c.Request.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, tiering.ErrRunInProgress):
+			status = http.StatusConflict
+		case errors.Is(err, tiering.ErrDisabled):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Tiering run failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Tiering run completed",
+		Data:    report,
+	})
+}
+
+// restoringError responds that content is being restored from cold storage
+// and asks the client to try again later
+func restoringError(c *gin.Context, err error) {
+	c.Header("Retry-After", strconv.Itoa(restoreRetryAfter))
+	c.JSON(http.StatusAccepted, types.APIResponse{
+		Success: false,
+		Message: "File is being restored from cold storage, retry later",
+		Error:   err.Error(),
+		Data:    gin.H{"status": "restoring"},
+	})
+}
+
+// getTieringConfig gets the tiering configuration from the environment or
+// uses defaults. TIER_COLD_BACKEND names the mounted backend idle content is
+// demoted to and enables tiering. TIER_COLD_AFTER sets how long content goes
+// unread before it is demoted, TIER_INTERVAL how often that is checked and
+// TIER_RATE_LIMIT the bytes per second demotions copy. TIER_RESTORE=async
+// restores cold content in the background, answering reads with 202 meanwhile.
+func getTieringConfig() *tiering.Config {
+	config := tiering.DefaultConfig()
+	config.ColdBackend = os.Getenv("TIER_COLD_BACKEND")
+	config.AsyncRestore = os.Getenv("TIER_RESTORE") == "async"
+
+	if afterStr := os.Getenv("TIER_COLD_AFTER"); afterStr != "" {
+		if after, err := time.ParseDuration(afterStr); err == nil && after > 0 {
+			config.ColdAfter = after
+		}
+	}
+	if intervalStr := os.Getenv("TIER_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Interval = interval
+		}
+	}
+	if rateStr := os.Getenv("TIER_RATE_LIMIT"); rateStr != "" {
+		if rate, err := strconv.ParseInt(rateStr, 10, 64); err == nil && rate >= 0 {
+			config.RateLimit = rate
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/trash"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// defaultTrashItems is how many objects in the trash are listed by default
+const defaultTrashItems = 100
+
+// trashListing is a page of the objects in the trash, with how many objects
+// and bytes the whole trash holds
+type trashListing struct {
+	Items      []*trash.Item `json:"items"`
+	Total      int64         `json:"total"`
+	TotalBytes int64         `json:"total_bytes"`
+	Window     string        `json:"window"`
+}
+
+// trashStatus is the trash configuration, the report of the last purge and
+// how many objects and bytes the trash holds
+type trashStatus struct {
+	Enabled    bool          `json:"enabled"`
+	Window     string        `json:"window"`
+	Interval   string        `json:"interval"`
+	Objects    int64         `json:"objects"`
+	Bytes      int64         `json:"bytes"`
+	LastReport *trash.Report `json:"last_report,omitempty"`
+}
+
+// registerTrashRoutes registers the routes listing and restoring deleted
+// objects, and the admin routes purging them
+func (a *API) registerTrashRoutes(api, admin *gin.RouterGroup) {
+	group := api.Group("/trash", a.trashAvailable)
+	group.GET("", a.listTrash)
+	group.GET("/:id", a.getTrashedObject)
+	group.POST("/:id/restore", a.restoreObject)
+
+	adminGroup := admin.Group("/trash", a.trashAvailable)
+	adminGroup.GET("", a.getTrashStatus)
+	adminGroup.POST("/purge", a.purgeTrash)
+	adminGroup.DELETE("/:id", a.purgeTrashedObject)
+}
+
+// Trash returns the trash bin, or nil without a metadata repository
+func (a *API) Trash() *trash.Bin {
+	return a.trash
+}
+
+// trashAvailable rejects trash requests when there is no metadata repository to keep it in
+func (a *API) trashAvailable(c *gin.Context) {
+	if a.trash == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+	c.Next()
+}
+
+// listTrash lists the objects in the trash, those deleted last first, up to
+// limit from offset
+func (a *API) listTrash(c *gin.Context) {
+	limit, offset := defaultTrashItems, 0
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid limit",
+			})
+			return
+		}
+		limit = parsed
+	}
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		parsed, err := strconv.Atoi(offsetStr)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid offset",
+			})
+			return
+		}
+		offset = parsed
+	}
+
+	items, err := a.trash.List(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to list trash",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	total, totalBytes, err := a.metadataRepo.CountTrash()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to count trash",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Trash retrieved successfully",
+		Data: trashListing{
+			Items:      items,
+			Total:      total,
+			TotalBytes: totalBytes,
+			Window:     a.trash.Config().Window.String(),
+		},
+	})
+}
+
+// getTrashedObject returns an object in the trash and when it is due to be purged
+func (a *API) getTrashedObject(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	item, err := a.trash.Get(id)
+	if err != nil {
+		trashError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Trashed object retrieved successfully",
+		Data:    item,
+	})
+}
+
+// restoreObject takes an object out of the trash
+func (a *API) restoreObject(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	metadata, err := a.trash.Restore(id)
+	if err != nil {
+		trashError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Object restored successfully",
+		Data:    metadata,
+	})
+}
+
+// getTrashStatus returns the trash configuration, the last purge and how much the trash holds
+func (a *API) getTrashStatus(c *gin.Context) {
+	objects, bytes, err := a.metadataRepo.CountTrash()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, types.APIResponse{
+			Success: false,
+			Message: "Failed to count trash",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	config := a.trash.Config()
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Trash status retrieved successfully",
+		Data: trashStatus{
+			Enabled:    a.trash.Enabled(),
+			Window:     config.Window.String(),
+			Interval:   config.Interval.String(),
+			Objects:    objects,
+			Bytes:      bytes,
+			LastReport: a.trash.LastReport(),
+		},
+	})
+}
+
+// purgeTrash removes every object in the trash for good now, however
+// recently it was deleted
+func (a *API) purgeTrash(c *gin.Context) {
+	report, err := a.trash.Empty(c.Request.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, trash.ErrRunInProgress) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, types.APIResponse{
+			Success: false,
+			Message: "Trash purge failed",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Trash purged",
+		Data:    report,
+	})
+}
+
+// purgeTrashedObject removes an object in the trash for good
+func (a *API) purgeTrashedObject(c *gin.Context) {
+	id := c.Param("id")
+	if !isValidObjectID(id) {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid object ID format",
+		})
+		return
+	}
+
+	if err := a.trash.Purge(id); err != nil {
+		trashError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, types.APIResponse{
+		Success: true,
+		Message: "Object purged",
+	})
+}
+
+// trashError maps a failed trash request to a response
+func trashError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, trash.ErrNotInTrash) {
+		status = http.StatusNotFound
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: "Trash request failed",
+		Error:   err.Error(),
+	})
+}
+
+// getTrashConfig gets the trash configuration from the environment or uses
+// defaults. TRASH_WINDOW sets how long deleted objects stay restorable, where
+// 0 disables the trash and makes deletes permanent, and TRASH_INTERVAL how
+// often objects whose window has ended are purged.
+func getTrashConfig() *trash.Config {
+	config := trash.DefaultConfig()
+
+	if windowStr := os.Getenv("TRASH_WINDOW"); windowStr != "" {
+		if window, err := time.ParseDuration(windowStr); err == nil && window >= 0 {
+			config.Window = window
+		}
+	}
+	if intervalStr := os.Getenv("TRASH_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Interval = interval
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,325 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/expiry"
+	"github.com/zots0127/io/pkg/types"
+	"github.com/zots0127/io/pkg/upload"
+)
+
+// Resumable uploads follow the tus 1.0.0 core protocol with the creation,
+// creation-defer-length, expiration and termination extensions.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-defer-length,expiration,termination"
+	tusChunkType  = "application/offset+octet-stream"
+)
+
+// registerUploadRoutes registers the resumable upload routes
+func (a *API) registerUploadRoutes(api *gin.RouterGroup) {
+	uploads := api.Group("/uploads", a.tusHeaders)
+	uploads.OPTIONS("", a.uploadOptions)
+	uploads.POST("", a.createUpload)
+	uploads.HEAD("/:id", a.uploadStatus)
+	uploads.PATCH("/:id", a.patchUpload)
+	uploads.DELETE("/:id", a.terminateUpload)
+	uploads.POST("/:id/finalize", a.finalizeUpload)
+}
+
+// tusHeaders rejects requests for an unsupported protocol version and adds
+// the headers every tus response carries
+func (a *API) tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+
+	if a.uploads == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, types.APIResponse{
+			Success: false,
+			Message: "Metadata repository not available",
+		})
+		return
+	}
+
+	if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+
+	c.Next()
+}
+
+// uploadOptions describes the server's tus support
+func (a *API) uploadOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if maxSize := a.uploads.MaxSize(); maxSize > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// createUpload starts a resumable upload session
+func (a *API) createUpload(c *gin.Context) {
+	length := int64(-1)
+	if c.GetHeader("Upload-Defer-Length") != "1" {
+		parsed, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Upload-Length or Upload-Defer-Length header required",
+			})
+			return
+		}
+		length = parsed
+	}
+
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid Upload-Metadata header",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if _, err := expiry.ExpiresAt(metadata["ttl"], metadata["expires_at"], time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid Upload-Metadata header",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if uploadedBy := requestUser(c); uploadedBy != "" {
+		metadata["uploaded_by"] = uploadedBy
+	}
+
+	// The API key is taken from the request only, never from client metadata
+	delete(metadata, "api_key_id")
+	owner := quotaOwner(c)
+	owner.User = metadata["uploaded_by"]
+	if owner.APIKeyID != "" {
+		metadata["api_key_id"] = owner.APIKeyID
+	}
+
+	// Refuse an upload that cannot fit before any of it is sent. The quota is
+	// checked again when the upload is committed.
+	if a.quotas != nil {
+		if err := a.quotas.Check(owner, max(length, 0), 1); err != nil {
+			a.uploadError(c, err)
+			return
+		}
+	}
+
+	session, err := a.uploads.Create(length, metadata)
+	if err != nil {
+		a.uploadError(c, err)
+		return
+	}
+
+	c.Header("Location", c.Request.URL.Path+"/"+session.ID)
+	setUploadHeaders(c, session)
+	c.Status(http.StatusCreated)
+}
+
+// uploadStatus reports the current offset of an upload
+func (a *API) uploadStatus(c *gin.Context) {
+	session, err := a.uploads.Get(c.Param("id"))
+	if err != nil {
+		a.uploadError(c, err)
+		return
+	}
+
+	if len(session.Metadata) > 0 {
+		c.Header("Upload-Metadata", formatUploadMetadata(session.Metadata))
+	}
+	setUploadHeaders(c, session)
+	c.Status(http.StatusOK)
+}
+
+// patchUpload appends a chunk at the current offset
+func (a *API) patchUpload(c *gin.Context) {
+	if c.ContentType() != tusChunkType {
+		c.JSON(http.StatusUnsupportedMediaType, types.APIResponse{
+			Success: false,
+			Message: "Content-Type must be " + tusChunkType,
+		})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, types.APIResponse{
+			Success: false,
+			Message: "Invalid Upload-Offset header",
+		})
+		return
+	}
+
+	id := c.Param("id")
+	if lengthStr := c.GetHeader("Upload-Length"); lengthStr != "" {
+		length, err := strconv.ParseInt(lengthStr, 10, 64)
+		if err != nil || length < 0 {
+			c.JSON(http.StatusBadRequest, types.APIResponse{
+				Success: false,
+				Message: "Invalid Upload-Length header",
+			})
+			return
+		}
+		if _, err := a.uploads.DeclareLength(id, length); err != nil {
+			a.uploadError(c, err)
+			return
+		}
+	}
+
+	session, err := a.uploads.Write(c.Request.Context(), id, offset, c.Request.Body)
+	if err != nil {
+		a.uploadError(c, err)
+		return
+	}
+
+	setUploadHeaders(c, session)
+	c.Status(http.StatusNoContent)
+}
+
+// terminateUpload abandons an upload
+func (a *API) terminateUpload(c *gin.Context) {
+	if err := a.uploads.Terminate(c.Param("id")); err != nil {
+		a.uploadError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// finalizeUpload commits an upload whose content has been received in full.
+// Uploads with a declared length are finalized by their last chunk; this is
+// how an upload with a deferred length is completed.
+func (a *API) finalizeUpload(c *gin.Context) {
+	session, err := a.uploads.Finalize(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		a.uploadError(c, err)
+		return
+	}
+
+	setUploadHeaders(c, session)
+	c.JSON(http.StatusOK, types.FileUploadResponse{
+		ID:      session.ObjectID,
+		Hash:    session.Hash,
+		Size:    session.Length,
+		Success: true,
+		Message: "File uploaded successfully",
+	})
+}
+
+// uploadError maps upload errors to tus status codes
+func (a *API) uploadError(c *gin.Context, err error) {
+	if quotaError(c, err) {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, upload.ErrSessionNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, upload.ErrSessionExpired):
+		status = http.StatusGone
+	case errors.Is(err, upload.ErrSessionLocked):
+		status = http.StatusLocked
+	case errors.Is(err, upload.ErrOffsetMismatch), errors.Is(err, upload.ErrSessionCompleted),
+		errors.Is(err, upload.ErrLengthDeclared), errors.Is(err, upload.ErrIncomplete):
+		status = http.StatusConflict
+	case errors.Is(err, upload.ErrExceedsLength):
+		status = http.StatusBadRequest
+	case errors.Is(err, upload.ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	c.JSON(status, types.APIResponse{
+		Success: false,
+		Message: "Upload failed",
+		Error:   err.Error(),
+	})
+}
+
+// setUploadHeaders adds the offset, length and expiry of session to the
+// response, and the created object once the upload is complete
+func setUploadHeaders(c *gin.Context, session *types.UploadSession) {
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if session.Length >= 0 {
+		c.Header("Upload-Length", strconv.FormatInt(session.Length, 10))
+	} else {
+		c.Header("Upload-Defer-Length", "1")
+	}
+	c.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if session.Completed() {
+		c.Header("X-Object-Id", session.ObjectID)
+		c.Header("X-Content-Hash", session.Hash)
+	}
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma separated
+// pairs of a key and a base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New("malformed metadata pair: " + pair)
+		}
+
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errors.New("invalid base64 value for key: " + fields[0])
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+
+	return metadata, nil
+}
+
+// formatUploadMetadata encodes metadata as a tus Upload-Metadata header
+func formatUploadMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// getUploadExpiration gets the resumable upload session expiry from configuration or uses default
+func getUploadExpiration() time.Duration {
+	expiration := upload.DefaultExpiration
+
+	if expirationStr := os.Getenv("UPLOAD_SESSION_EXPIRY"); expirationStr != "" {
+		if parsed, err := time.ParseDuration(expirationStr); err == nil {
+			expiration = parsed
+		}
+	}
+
+	return expiration
+}
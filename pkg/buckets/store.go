@@ -0,0 +1,624 @@
+// Package buckets implements named buckets of path-like keys, each mapped to
+// an object. Keys are only names: content is still stored once per content
+// hash, so the same bytes under many keys take their space once, and moving
+// or renaming keys never copies any bytes. A "/" in a key is what listings
+// roll up into directories; buckets have no directories of their own.
+//
+// With versioning enabled, each write to a key adds a version instead of
+// replacing the object stored there. Earlier versions stay readable and can
+// be restored, again without copying bytes, until they are deleted or fall
+// beyond the bucket's version limit.
+//
+// Keys whose objects are locked by retention or a legal hold can be neither
+// deleted nor overwritten, and their locked versions are kept beyond the
+// version limit. Buckets may give every object written to them a default
+// retention.
+package buckets
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/retention"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// MaxKeyLength is the longest key in bytes, as in S3
+const MaxKeyLength = 1024
+
+// Listing limits
+const (
+	// MaxListKeys is the most keys and common prefixes a listing returns
+	MaxListKeys = 1000
+	// listBatchSize is how many keys are read from the repository at a time
+	listBatchSize = 1000
+)
+
+// Bucket errors
+var (
+	ErrInvalidBucketName  = errors.New("invalid bucket name")
+	ErrInvalidKey         = errors.New("invalid key")
+	ErrInvalidMove        = errors.New("invalid move")
+	ErrBucketExists       = errors.New("bucket already exists")
+	ErrBucketNotFound     = repository.ErrBucketNotFound
+	ErrBucketNotEmpty     = repository.ErrBucketNotEmpty
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrVersionNotFound    = errors.New("version not found")
+	ErrInvalidMaxVersions = errors.New("invalid max versions")
+)
+
+// Config configures the bucket store
+type Config struct {
+	// Versioning keeps earlier versions of a key when it is written. Without
+	// it, only the current version is kept.
+	Versioning bool `json:"versioning"`
+	// Retention protects locked objects and applies bucket default
+	// retention. Nil protects nothing.
+	Retention *retention.Enforcer `json:"-"`
+}
+
+// Listing is a page of the keys in a bucket, with the keys sharing a prefix
+// up to the delimiter rolled up into common prefixes
+type Listing struct {
+	Entries   []*types.BucketEntry `json:"entries"`
+	Prefixes  []string             `json:"prefixes"`
+	Truncated bool                 `json:"truncated"`
+	// Last is the last key or common prefix returned, which the next page starts after
+	Last string `json:"last,omitempty"`
+}
+
+// Store keeps objects under keys in buckets
+type Store struct {
+	fileService  fileservice.FileService
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+}
+
+// NewStore creates a new bucket store
+func NewStore(fileService fileservice.FileService, metadataRepo *repository.MetadataRepository, config *Config) *Store {
+	return &Store{
+		fileService:  fileService,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[BUCKETS] ", log.LstdFlags),
+	}
+}
+
+// CreateBucket creates the bucket called name
+func (s *Store) CreateBucket(name string) (*types.Bucket, error) {
+	if !ValidBucketName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidBucketName, name)
+	}
+
+	created, err := s.metadataRepo.CreateBucket(name, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket: %w", err)
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: %s", ErrBucketExists, name)
+	}
+	return s.GetBucket(name)
+}
+
+// GetBucket returns the bucket called name
+func (s *Store) GetBucket(name string) (*types.Bucket, error) {
+	bucket, err := s.metadataRepo.GetBucket(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket: %w", err)
+	}
+	if bucket == nil {
+		return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	return bucket, nil
+}
+
+// ListBuckets returns every bucket, by name
+func (s *Store) ListBuckets() ([]*types.Bucket, error) {
+	return s.metadataRepo.ListBuckets()
+}
+
+// DeleteBucket deletes the bucket called name. Unless recursive is set, only
+// an empty bucket is deleted; otherwise its keys are deleted first.
+func (s *Store) DeleteBucket(ctx context.Context, name string, recursive bool) error {
+	if recursive {
+		if _, err := s.GetBucket(name); err != nil {
+			return err
+		}
+		if _, err := s.DeletePrefix(ctx, name, ""); err != nil {
+			return err
+		}
+	}
+	return s.metadataRepo.DeleteBucket(name)
+}
+
+// Put stores the content read from reader under key in bucket as its new
+// current version. Content already stored under another key or through the
+// native API is not stored again.
+func (s *Store) Put(ctx context.Context, bucket, key string, reader io.Reader, metadata *types.FileMetadata) (*types.BucketEntry, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(key, "/") {
+		return nil, fmt.Errorf("%w: %q names a directory", ErrInvalidKey, key)
+	}
+	if _, err := s.GetBucket(bucket); err != nil {
+		return nil, err
+	}
+
+	if metadata.FileName == "" {
+		metadata.FileName = path.Base(key)
+	}
+
+	hasher := md5.New()
+	stored, err := s.fileService.StoreStream(ctx, io.TeeReader(reader, hasher), metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &types.BucketEntry{
+		Bucket:      bucket,
+		Key:         key,
+		ObjectID:    stored.ID,
+		ETag:        hex.EncodeToString(hasher.Sum(nil)),
+		Size:        stored.Size,
+		ContentType: stored.ContentType,
+		ModifiedAt:  time.Now().UTC(),
+	}
+	if err := s.Commit(ctx, entry); err != nil {
+		s.deleteObject(ctx, stored.ID)
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Commit makes entry's object, already stored, the current version of its
+// key, giving it the bucket's default retention. Without versioning, the
+// object previously stored there is deleted, so a locked one cannot be
+// overwritten; with it, the oldest versions beyond the bucket's limit are.
+func (s *Store) Commit(ctx context.Context, entry *types.BucketEntry) error {
+	if !s.config.Versioning {
+		if err := s.permitKeys(ctx, entry.Bucket, entry.Key, false); err != nil {
+			return err
+		}
+	}
+
+	dropped, err := s.metadataRepo.PutBucketEntry(entry, s.config.Versioning)
+	if err != nil {
+		return fmt.Errorf("failed to store key: %w", err)
+	}
+	for _, objectID := range dropped {
+		s.deleteObject(ctx, objectID)
+	}
+
+	if s.config.Retention != nil {
+		if bucket, err := s.GetBucket(entry.Bucket); err != nil {
+			s.logger.Printf("Failed to apply default retention to object %s: %v", entry.ObjectID, err)
+		} else if err := s.config.Retention.ApplyDefault(bucket, entry.ObjectID); err != nil {
+			s.logger.Printf("Failed to apply default retention to object %s: %v", entry.ObjectID, err)
+		}
+	}
+	return nil
+}
+
+// Get returns what is stored under key in bucket
+func (s *Store) Get(bucket, key string) (*types.BucketEntry, error) {
+	entry, err := s.metadataRepo.GetBucketEntry(bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key: %w", err)
+	}
+	if entry == nil {
+		if _, err := s.GetBucket(bucket); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s/%s", ErrKeyNotFound, bucket, key)
+	}
+	return entry, nil
+}
+
+// Open returns what is stored under key in bucket, with a reader of its content
+func (s *Store) Open(ctx context.Context, bucket, key string) (io.ReadSeekCloser, *types.BucketEntry, *types.FileMetadata, error) {
+	entry, err := s.Get(bucket, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	reader, metadata, err := s.fileService.RetrieveObject(ctx, entry.ObjectID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open %s/%s: %w", bucket, key, err)
+	}
+	return reader, entry, metadata, nil
+}
+
+// Delete removes key from bucket and deletes the objects stored there, every
+// version included. The content stays stored while other objects reference
+// it. A key any of whose objects is locked is left alone.
+func (s *Store) Delete(ctx context.Context, bucket, key string) error {
+	if err := s.permitKeys(ctx, bucket, key, false); err != nil {
+		return err
+	}
+
+	objectIDs, err := s.metadataRepo.DeleteBucketEntry(bucket, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete key: %w", err)
+	}
+	if len(objectIDs) == 0 {
+		if _, err := s.GetBucket(bucket); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s/%s", ErrKeyNotFound, bucket, key)
+	}
+
+	for _, objectID := range objectIDs {
+		s.deleteObject(ctx, objectID)
+	}
+	return nil
+}
+
+// DeletePrefix removes every key of bucket starting with prefix, deleting
+// the objects stored there, every version included, and returns how many
+// objects were deleted. Nothing is deleted if any of them is locked.
+func (s *Store) DeletePrefix(ctx context.Context, bucket, prefix string) (int, error) {
+	if err := s.permitKeys(ctx, bucket, prefix, true); err != nil {
+		return 0, err
+	}
+
+	objectIDs, err := s.metadataRepo.DeleteBucketEntries(bucket, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete keys: %w", err)
+	}
+	for _, objectID := range objectIDs {
+		s.deleteObject(ctx, objectID)
+	}
+
+	if len(objectIDs) > 0 {
+		s.logger.Printf("Deleted %d objects under %s/%s", len(objectIDs), bucket, prefix)
+	}
+	return len(objectIDs), nil
+}
+
+// Move moves srcKey of srcBucket to dstKey of dstBucket, replacing whatever
+// was stored there. Only keys change; no content is copied. A srcKey ending
+// in "/" moves the whole directory, every key under it, to the directory
+// dstKey, which must end in "/" too. It returns how many keys were moved.
+//
+// Moving renames the objects moved, so moving locked objects is a bypass of
+// their retention. A directory is only moved over one nothing locked is in.
+func (s *Store) Move(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) (int, error) {
+	if err := validKey(srcKey); err != nil {
+		return 0, err
+	}
+	if err := validKey(dstKey); err != nil {
+		return 0, err
+	}
+
+	directory := strings.HasSuffix(srcKey, "/")
+	if directory != strings.HasSuffix(dstKey, "/") {
+		return 0, fmt.Errorf("%w: a directory can only be moved to a directory", ErrInvalidMove)
+	}
+	if srcBucket == dstBucket {
+		if srcKey == dstKey {
+			return 0, fmt.Errorf("%w: source and destination are the same", ErrInvalidMove)
+		}
+		if directory && (strings.HasPrefix(dstKey, srcKey) || strings.HasPrefix(srcKey, dstKey)) {
+			return 0, fmt.Errorf("%w: %s and %s overlap", ErrInvalidMove, srcKey, dstKey)
+		}
+	}
+	if _, err := s.GetBucket(srcBucket); err != nil {
+		return 0, err
+	}
+	if err := s.permitKeys(ctx, dstBucket, dstKey, directory); err != nil {
+		return 0, err
+	}
+	if s.config.Retention != nil {
+		locked, err := s.lockedUnder(srcBucket, srcKey, directory)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.config.Retention.Check(ctx, retention.ActionMove, locked...); err != nil {
+			return 0, err
+		}
+	}
+
+	moved, replaced, err := s.metadataRepo.MoveBucketEntries(srcBucket, srcKey, dstBucket, dstKey, directory, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to move keys: %w", err)
+	}
+	if moved == 0 {
+		return 0, fmt.Errorf("%w: %s/%s", ErrKeyNotFound, srcBucket, srcKey)
+	}
+	for _, objectID := range replaced {
+		s.deleteObject(ctx, objectID)
+	}
+
+	return moved, nil
+}
+
+// List returns up to maxKeys keys and common prefixes of bucket starting
+// with prefix and sorting after after. A common prefix equal to after was
+// returned on the previous page, so the keys it rolls up are skipped.
+func (s *Store) List(bucket, prefix, delimiter, after string, maxKeys int) (*Listing, error) {
+	page := &Listing{Entries: []*types.BucketEntry{}, Prefixes: []string{}}
+	cursor := after
+
+	for {
+		entries, err := s.metadataRepo.ListBucketEntries(bucket, prefix, cursor, listBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		skipped := false
+		for _, entry := range entries {
+			cursor = entry.Key
+
+			if delimiter != "" {
+				if i := strings.Index(entry.Key[len(prefix):], delimiter); i >= 0 {
+					rolled := entry.Key[:len(prefix)+i+len(delimiter)]
+					if rolled != after {
+						if len(page.Entries)+len(page.Prefixes) == maxKeys {
+							page.Truncated = true
+							return page, nil
+						}
+						page.Prefixes = append(page.Prefixes, rolled)
+						page.Last = rolled
+					}
+
+					// Skip straight past every key the prefix rolls up. No
+					// UTF-8 key contains the byte 0xff.
+					cursor = rolled + "\xff"
+					skipped = true
+					break
+				}
+			}
+
+			if len(page.Entries)+len(page.Prefixes) == maxKeys {
+				page.Truncated = true
+				return page, nil
+			}
+			page.Entries = append(page.Entries, entry)
+			page.Last = entry.Key
+		}
+
+		if !skipped && len(entries) < listBatchSize {
+			return page, nil
+		}
+	}
+}
+
+// Versions returns the versions of key in bucket, newest first
+func (s *Store) Versions(bucket, key string) ([]*types.ObjectVersion, error) {
+	versions, err := s.metadataRepo.ListObjectVersions(bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	if len(versions) == 0 {
+		if _, err := s.GetBucket(bucket); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s/%s", ErrKeyNotFound, bucket, key)
+	}
+	return versions, nil
+}
+
+// GetVersion returns a version of key in bucket
+func (s *Store) GetVersion(bucket, key string, version int) (*types.ObjectVersion, error) {
+	objectVersion, err := s.metadataRepo.GetObjectVersion(bucket, key, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version: %w", err)
+	}
+	if objectVersion == nil {
+		if _, err := s.GetBucket(bucket); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s/%s version %d", ErrVersionNotFound, bucket, key, version)
+	}
+	return objectVersion, nil
+}
+
+// OpenVersion returns a version of key in bucket, with a reader of its content
+func (s *Store) OpenVersion(ctx context.Context, bucket, key string, version int) (io.ReadSeekCloser, *types.ObjectVersion, *types.FileMetadata, error) {
+	objectVersion, err := s.GetVersion(bucket, key, version)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	reader, metadata, err := s.fileService.RetrieveObject(ctx, objectVersion.ObjectID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open %s/%s version %d: %w", bucket, key, version, err)
+	}
+	return reader, objectVersion, metadata, nil
+}
+
+// RestoreVersion makes the content of a version of key in bucket current
+// again, as a new version. The new version's object shares the content of
+// the old one, so no bytes are copied.
+func (s *Store) RestoreVersion(ctx context.Context, bucket, key string, version int) (*types.BucketEntry, error) {
+	objectVersion, err := s.GetVersion(bucket, key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := s.metadataRepo.GetMetadata(objectVersion.ObjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version metadata: %w", err)
+	}
+	now := time.Now().UTC()
+	restored := *metadata
+	restored.ID = ""
+	restored.UploadedAt = now
+	restored.LastAccessed = now
+	// The restored copy is a new object, with the bucket's default retention only
+	restored.RetentionMode, restored.RetainUntil, restored.LegalHold = "", nil, false
+	if err := s.metadataRepo.SaveMetadata(&restored); err != nil {
+		return nil, fmt.Errorf("failed to restore version: %w", err)
+	}
+
+	entry := &types.BucketEntry{
+		Bucket:      bucket,
+		Key:         key,
+		ObjectID:    restored.ID,
+		ETag:        objectVersion.ETag,
+		Size:        restored.Size,
+		ContentType: restored.ContentType,
+		ModifiedAt:  now,
+	}
+	if err := s.Commit(ctx, entry); err != nil {
+		s.deleteObject(ctx, restored.ID)
+		return nil, err
+	}
+
+	s.logger.Printf("Restored %s/%s version %d as version %d", bucket, key, version, entry.Version)
+	return entry, nil
+}
+
+// DeleteVersion deletes a version of key in bucket. Deleting the current
+// version makes the newest remaining one current, or removes the key if none
+// remains. A locked version is left alone.
+func (s *Store) DeleteVersion(ctx context.Context, bucket, key string, version int) error {
+	if s.config.Retention != nil {
+		objectVersion, err := s.GetVersion(bucket, key, version)
+		if err != nil {
+			return err
+		}
+		if metadata, err := s.metadataRepo.GetMetadata(objectVersion.ObjectID); err == nil {
+			if err := s.config.Retention.Permit(ctx, metadata); err != nil {
+				return err
+			}
+		}
+	}
+
+	objectID, err := s.metadataRepo.DeleteObjectVersion(bucket, key, version)
+	if err != nil {
+		return fmt.Errorf("failed to delete version: %w", err)
+	}
+	if objectID == "" {
+		if _, err := s.GetBucket(bucket); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s/%s version %d", ErrVersionNotFound, bucket, key, version)
+	}
+
+	s.deleteObject(ctx, objectID)
+	return nil
+}
+
+// SetMaxVersions sets how many versions of each key the bucket keeps, the
+// current one included; zero keeps every version. Versions beyond a lowered
+// limit are deleted at once.
+func (s *Store) SetMaxVersions(ctx context.Context, bucket string, maxVersions int) (*types.Bucket, error) {
+	if maxVersions < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidMaxVersions, maxVersions)
+	}
+	if err := s.metadataRepo.SetBucketMaxVersions(bucket, maxVersions); err != nil {
+		return nil, fmt.Errorf("failed to set max versions: %w", err)
+	}
+
+	dropped, err := s.metadataRepo.PruneBucketVersions(bucket, maxVersions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune versions: %w", err)
+	}
+	for _, objectID := range dropped {
+		s.deleteObject(ctx, objectID)
+	}
+	if len(dropped) > 0 {
+		s.logger.Printf("Deleted %d versions beyond the limit of %d in %s", len(dropped), maxVersions, bucket)
+	}
+
+	return s.GetBucket(bucket)
+}
+
+// SetRetention sets the default retention given to objects written to
+// bucket from now on; an empty mode removes it. Objects already stored keep
+// the retention they have.
+func (s *Store) SetRetention(bucket, mode string, days int) (*types.Bucket, error) {
+	if err := retention.ValidateDefault(mode, days); err != nil {
+		return nil, err
+	}
+	if err := s.metadataRepo.SetBucketRetention(bucket, mode, days); err != nil {
+		return nil, fmt.Errorf("failed to set retention: %w", err)
+	}
+	return s.GetBucket(bucket)
+}
+
+// permitKeys returns retention.ErrLocked if an object stored under key in
+// bucket, or with prefix set under any key starting with key, may not be
+// deleted or replaced. The change itself checks again and audits bypasses.
+func (s *Store) permitKeys(ctx context.Context, bucket, key string, prefix bool) error {
+	if s.config.Retention == nil {
+		return nil
+	}
+	locked, err := s.lockedUnder(bucket, key, prefix)
+	if err != nil {
+		return err
+	}
+	return s.config.Retention.Permit(ctx, locked...)
+}
+
+// lockedUnder returns the locked objects stored under key in bucket, or with
+// prefix set under any key starting with key, every version included
+func (s *Store) lockedUnder(bucket, key string, prefix bool) ([]*types.FileMetadata, error) {
+	var locked []*types.FileMetadata
+	var err error
+	if prefix {
+		locked, err = s.metadataRepo.ListLockedObjectsUnder(bucket, key, time.Now())
+	} else {
+		locked, err = s.metadataRepo.ListLockedObjects(bucket, key, time.Now())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check retention: %w", err)
+	}
+	return locked, nil
+}
+
+// deleteObject deletes an object no key refers to any more. A failure only
+// leaves the object behind, so it is logged rather than reported.
+func (s *Store) deleteObject(ctx context.Context, id string) {
+	if err := s.fileService.Delete(ctx, id); err != nil {
+		s.logger.Printf("Failed to delete object %s: %v", id, err)
+	}
+}
+
+// ValidBucketName reports whether name follows the S3 bucket naming rules:
+// 3 to 63 lowercase letters, digits, dots and hyphens, beginning and ending
+// with a letter or digit, and not formatted as an IP address
+func ValidBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 || strings.Contains(name, "..") || net.ParseIP(name) != nil {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		alnum := ('a' <= c && c <= 'z') || ('0' <= c && c <= '9')
+		if !alnum && ((c != '.' && c != '-') || i == 0 || i == len(name)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// validKey checks that key is a non-empty UTF-8 string of at most
+// MaxKeyLength bytes without NUL characters
+func validKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	case len(key) > MaxKeyLength:
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidKey, MaxKeyLength)
+	case !utf8.ValidString(key), strings.ContainsRune(key, 0):
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
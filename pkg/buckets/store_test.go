@@ -0,0 +1,528 @@
+package buckets
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/retention"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// newTestStore returns a bucket store backed by a temp directory, with
+// helpers putting and reading keys
+func newTestStore(t *testing.T, config *Config) (*Store, *repository.MetadataRepository, func(bucket, key, content string) *types.BucketEntry, func(bucket, key string) string) {
+	tempDir, err := os.MkdirTemp("", "test_buckets")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	serviceConfig := fileservice.DefaultServiceConfig()
+	serviceConfig.EnableLogging = false
+	fileService := fileservice.NewFileService(service.NewStorage(filepath.Join(tempDir, "storage")), metadataRepo, serviceConfig)
+
+	store := NewStore(fileService, metadataRepo, config)
+	ctx := context.Background()
+
+	put := func(bucket, key, content string) *types.BucketEntry {
+		t.Helper()
+		entry, err := store.Put(ctx, bucket, key, strings.NewReader(content), &types.FileMetadata{})
+		if err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+		return entry
+	}
+	read := func(bucket, key string) string {
+		t.Helper()
+		reader, _, _, err := store.Open(ctx, bucket, key)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", key, err)
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", key, err)
+		}
+		return string(data)
+	}
+
+	return store, metadataRepo, put, read
+}
+
+func TestStore(t *testing.T) {
+	store, metadataRepo, put, read := newTestStore(t, &Config{})
+	ctx := context.Background()
+
+	keys := func(bucket, prefix string) []string {
+		t.Helper()
+		listing, err := store.List(bucket, prefix, "", "", MaxListKeys)
+		if err != nil {
+			t.Fatalf("Failed to list %s: %v", bucket, err)
+		}
+		var keys []string
+		for _, entry := range listing.Entries {
+			keys = append(keys, entry.Key)
+		}
+		return keys
+	}
+
+	if _, err := store.CreateBucket("projects"); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	if _, err := store.CreateBucket("projects"); !errors.Is(err, ErrBucketExists) {
+		t.Errorf("Expected ErrBucketExists, got %v", err)
+	}
+	if _, err := store.CreateBucket("Not_Valid"); !errors.Is(err, ErrInvalidBucketName) {
+		t.Errorf("Expected ErrInvalidBucketName, got %v", err)
+	}
+
+	t.Run("PutAndGet", func(t *testing.T) {
+		entry := put("projects", "reports/2024/q1.pdf", "first quarter")
+		if sum := md5.Sum([]byte("first quarter")); entry.ETag != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected the MD5 of the content as ETag, got %q", entry.ETag)
+		}
+		if got := read("projects", "reports/2024/q1.pdf"); got != "first quarter" {
+			t.Errorf("Expected stored content, got %q", got)
+		}
+
+		metadata, err := metadataRepo.GetMetadata(entry.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if metadata.FileName != "q1.pdf" {
+			t.Errorf("Expected object to be named after its key, got %q", metadata.FileName)
+		}
+
+		if _, err := store.Get("projects", "reports/2024/q2.pdf"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound, got %v", err)
+		}
+		if _, err := store.Get("missing", "q1.pdf"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("Expected ErrBucketNotFound, got %v", err)
+		}
+		if _, err := store.Put(ctx, "projects", "reports/", strings.NewReader("x"), &types.FileMetadata{}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for a directory key, got %v", err)
+		}
+	})
+
+	t.Run("Deduplication", func(t *testing.T) {
+		first := put("projects", "dedup/a.txt", "same bytes")
+		second := put("projects", "dedup/b.txt", "same bytes")
+
+		firstMeta, err := metadataRepo.GetMetadata(first.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		secondMeta, err := metadataRepo.GetMetadata(second.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if firstMeta.Hash != secondMeta.Hash {
+			t.Errorf("Expected both keys to share content, got %s and %s", firstMeta.Hash, secondMeta.Hash)
+		}
+
+		// Overwriting one key leaves the content of the other in place
+		put("projects", "dedup/a.txt", "new bytes")
+		if got := read("projects", "dedup/b.txt"); got != "same bytes" {
+			t.Errorf("Expected shared content to survive an overwrite, got %q", got)
+		}
+		if _, err := metadataRepo.GetMetadata(first.ObjectID); err == nil {
+			t.Error("Expected the replaced object to be deleted")
+		}
+	})
+
+	t.Run("ListWithDelimiter", func(t *testing.T) {
+		for _, key := range []string{"tree/a.txt", "tree/b/one.txt", "tree/b/two.txt", "tree/c/three.txt", "tree/d.txt"} {
+			put("projects", key, key)
+		}
+
+		listing, err := store.List("projects", "tree/", "/", "", MaxListKeys)
+		if err != nil {
+			t.Fatalf("Failed to list: %v", err)
+		}
+		var entries []string
+		for _, entry := range listing.Entries {
+			entries = append(entries, entry.Key)
+		}
+		if strings.Join(entries, ",") != "tree/a.txt,tree/d.txt" {
+			t.Errorf("Unexpected keys %v", entries)
+		}
+		if strings.Join(listing.Prefixes, ",") != "tree/b/,tree/c/" {
+			t.Errorf("Unexpected prefixes %v", listing.Prefixes)
+		}
+
+		// Pages continue after the last key or prefix returned
+		var pages []string
+		after := ""
+		for {
+			page, err := store.List("projects", "tree/", "/", after, 1)
+			if err != nil {
+				t.Fatalf("Failed to list: %v", err)
+			}
+			for _, entry := range page.Entries {
+				pages = append(pages, entry.Key)
+			}
+			pages = append(pages, page.Prefixes...)
+			if !page.Truncated {
+				break
+			}
+			after = page.Last
+		}
+		if strings.Join(pages, ",") != "tree/a.txt,tree/b/,tree/c/,tree/d.txt" {
+			t.Errorf("Unexpected pages %v", pages)
+		}
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		entry := put("projects", "drafts/plan.txt", "the plan")
+
+		if _, err := store.Move(ctx, "projects", "drafts/plan.txt", "projects", "final/plan-v1.txt"); err != nil {
+			t.Fatalf("Failed to move key: %v", err)
+		}
+		moved, err := store.Get("projects", "final/plan-v1.txt")
+		if err != nil {
+			t.Fatalf("Failed to get moved key: %v", err)
+		}
+		if moved.ObjectID != entry.ObjectID {
+			t.Errorf("Expected the key to keep its object, got %s instead of %s", moved.ObjectID, entry.ObjectID)
+		}
+		if _, err := store.Get("projects", "drafts/plan.txt"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the old key to be gone, got %v", err)
+		}
+		metadata, err := metadataRepo.GetMetadata(entry.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if metadata.FileName != "plan-v1.txt" {
+			t.Errorf("Expected the object to be renamed, got %q", metadata.FileName)
+		}
+
+		if _, err := store.Move(ctx, "projects", "drafts/plan.txt", "projects", "x.txt"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound moving a missing key, got %v", err)
+		}
+	})
+
+	t.Run("MoveDirectory", func(t *testing.T) {
+		put("projects", "src/main.go", "package main")
+		put("projects", "src/lib/util.go", "package lib")
+		put("projects", "dst/lib/util.go", "replaced")
+
+		if _, err := store.CreateBucket("archive"); err != nil {
+			t.Fatalf("Failed to create bucket: %v", err)
+		}
+
+		moved, err := store.Move(ctx, "projects", "src/", "projects", "dst/")
+		if err != nil {
+			t.Fatalf("Failed to move directory: %v", err)
+		}
+		if moved != 2 {
+			t.Errorf("Expected 2 keys moved, got %d", moved)
+		}
+		if got := strings.Join(keys("projects", "dst/"), ","); got != "dst/lib/util.go,dst/main.go" {
+			t.Errorf("Unexpected keys after move %s", got)
+		}
+		if got := read("projects", "dst/lib/util.go"); got != "package lib" {
+			t.Errorf("Expected moved key to replace the destination, got %q", got)
+		}
+		if len(keys("projects", "src/")) != 0 {
+			t.Error("Expected the source directory to be empty")
+		}
+
+		if _, err := store.Move(ctx, "projects", "dst/", "archive", "2024/dst/"); err != nil {
+			t.Fatalf("Failed to move directory across buckets: %v", err)
+		}
+		if got := strings.Join(keys("archive", ""), ","); got != "2024/dst/lib/util.go,2024/dst/main.go" {
+			t.Errorf("Unexpected keys after move across buckets %s", got)
+		}
+
+		if _, err := store.Move(ctx, "archive", "2024/", "archive", "2024/old/"); !errors.Is(err, ErrInvalidMove) {
+			t.Errorf("Expected ErrInvalidMove moving a directory into itself, got %v", err)
+		}
+		if _, err := store.Move(ctx, "archive", "2024/", "archive", "file.txt"); !errors.Is(err, ErrInvalidMove) {
+			t.Errorf("Expected ErrInvalidMove moving a directory onto a key, got %v", err)
+		}
+		if _, err := store.Move(ctx, "archive", "2024/", "missing", "2024/"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("Expected ErrBucketNotFound moving to a missing bucket, got %v", err)
+		}
+	})
+
+	t.Run("RecursiveDelete", func(t *testing.T) {
+		put("projects", "tmp/a.txt", "shared")
+		put("projects", "tmp/b/c.txt", "c")
+		kept := put("projects", "tmpfile.txt", "shared")
+
+		deleted, err := store.DeletePrefix(ctx, "projects", "tmp/")
+		if err != nil {
+			t.Fatalf("Failed to delete directory: %v", err)
+		}
+		if deleted != 2 {
+			t.Errorf("Expected 2 keys deleted, got %d", deleted)
+		}
+		if len(keys("projects", "tmp/")) != 0 {
+			t.Error("Expected the directory to be empty")
+		}
+		if got := read("projects", kept.Key); got != "shared" {
+			t.Errorf("Expected content shared with a deleted key to survive, got %q", got)
+		}
+
+		if err := store.DeleteBucket(ctx, "archive", false); !errors.Is(err, ErrBucketNotEmpty) {
+			t.Errorf("Expected ErrBucketNotEmpty, got %v", err)
+		}
+		if err := store.DeleteBucket(ctx, "archive", true); err != nil {
+			t.Fatalf("Failed to delete bucket recursively: %v", err)
+		}
+		if _, err := store.GetBucket("archive"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("Expected the bucket to be gone, got %v", err)
+		}
+	})
+}
+
+func TestVersions(t *testing.T) {
+	store, metadataRepo, put, read := newTestStore(t, &Config{Versioning: true})
+	ctx := context.Background()
+
+	if _, err := store.CreateBucket("history"); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	// versionNumbers lists the version numbers of key, newest first
+	versionNumbers := func(key string) []int {
+		t.Helper()
+		versions, err := store.Versions("history", key)
+		if err != nil {
+			t.Fatalf("Failed to list versions: %v", err)
+		}
+		var numbers []int
+		for _, version := range versions {
+			numbers = append(numbers, version.Version)
+		}
+		return numbers
+	}
+
+	first := put("history", "doc.txt", "draft")
+	put("history", "doc.txt", "review")
+	third := put("history", "doc.txt", "final")
+	if third.Version != 3 {
+		t.Errorf("Expected the third write to be version 3, got %d", third.Version)
+	}
+
+	t.Run("ListAndFetch", func(t *testing.T) {
+		versions, err := store.Versions("history", "doc.txt")
+		if err != nil {
+			t.Fatalf("Failed to list versions: %v", err)
+		}
+		if len(versions) != 3 || versions[0].Version != 3 || !versions[0].IsCurrent || versions[2].IsCurrent {
+			t.Fatalf("Unexpected versions %+v", versions)
+		}
+
+		reader, version, _, err := store.OpenVersion(ctx, "history", "doc.txt", 1)
+		if err != nil {
+			t.Fatalf("Failed to open version: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(data) != "draft" || version.ObjectID != first.ObjectID {
+			t.Errorf("Expected the first version, got %q", data)
+		}
+		if got := read("history", "doc.txt"); got != "final" {
+			t.Errorf("Expected the newest version to be current, got %q", got)
+		}
+
+		if _, err := store.GetVersion("history", "doc.txt", 9); !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("Expected ErrVersionNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		restored, err := store.RestoreVersion(ctx, "history", "doc.txt", 1)
+		if err != nil {
+			t.Fatalf("Failed to restore version: %v", err)
+		}
+		if restored.Version != 4 {
+			t.Errorf("Expected the restored content to be version 4, got %d", restored.Version)
+		}
+		if got := read("history", "doc.txt"); got != "draft" {
+			t.Errorf("Expected restored content, got %q", got)
+		}
+
+		original, err := metadataRepo.GetMetadata(first.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		copied, err := metadataRepo.GetMetadata(restored.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if copied.Hash != original.Hash {
+			t.Errorf("Expected the restored version to share content with the original")
+		}
+	})
+
+	t.Run("DeleteVersion", func(t *testing.T) {
+		if err := store.DeleteVersion(ctx, "history", "doc.txt", 2); err != nil {
+			t.Fatalf("Failed to delete version: %v", err)
+		}
+		if got := versionNumbers("doc.txt"); len(got) != 3 || got[0] != 4 || got[1] != 3 || got[2] != 1 {
+			t.Errorf("Unexpected versions after deleting one %v", got)
+		}
+
+		// Deleting the current version makes the previous one current
+		if err := store.DeleteVersion(ctx, "history", "doc.txt", 4); err != nil {
+			t.Fatalf("Failed to delete version: %v", err)
+		}
+		if got := read("history", "doc.txt"); got != "final" {
+			t.Errorf("Expected the previous version to become current, got %q", got)
+		}
+		if entry, _ := store.Get("history", "doc.txt"); entry == nil || entry.Version != 3 {
+			t.Errorf("Expected version 3 to be current, got %+v", entry)
+		}
+	})
+
+	t.Run("MaxVersions", func(t *testing.T) {
+		for _, content := range []string{"a", "b", "c", "d"} {
+			put("history", "log.txt", content)
+		}
+		if _, err := store.SetMaxVersions(ctx, "history", -1); !errors.Is(err, ErrInvalidMaxVersions) {
+			t.Errorf("Expected ErrInvalidMaxVersions, got %v", err)
+		}
+
+		// Lowering the limit drops the oldest versions at once
+		bucket, err := store.SetMaxVersions(ctx, "history", 2)
+		if err != nil {
+			t.Fatalf("Failed to set max versions: %v", err)
+		}
+		if bucket.MaxVersions != 2 {
+			t.Errorf("Expected max versions 2, got %d", bucket.MaxVersions)
+		}
+		if got := versionNumbers("log.txt"); len(got) != 2 || got[0] != 4 || got[1] != 3 {
+			t.Errorf("Unexpected versions after lowering the limit %v", got)
+		}
+
+		put("history", "log.txt", "e")
+		if got := versionNumbers("log.txt"); len(got) != 2 || got[0] != 5 || got[1] != 4 {
+			t.Errorf("Unexpected versions after a write past the limit %v", got)
+		}
+	})
+
+	t.Run("DeleteKey", func(t *testing.T) {
+		if err := store.Delete(ctx, "history", "log.txt"); err != nil {
+			t.Fatalf("Failed to delete key: %v", err)
+		}
+		if _, err := store.Versions("history", "log.txt"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected every version to be deleted with the key, got %v", err)
+		}
+	})
+
+	t.Run("Unversioned", func(t *testing.T) {
+		unversioned := NewStore(store.fileService, metadataRepo, &Config{})
+		if _, err := unversioned.Put(ctx, "history", "doc.txt", strings.NewReader("overwrite"), &types.FileMetadata{}); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		if got := versionNumbers("doc.txt"); len(got) != 1 {
+			t.Errorf("Expected only the current version to be kept without versioning, got %v", got)
+		}
+	})
+}
+
+func TestRetention(t *testing.T) {
+	store, metadataRepo, put, read := newTestStore(t, &Config{Versioning: true})
+	enforcer := retention.NewEnforcer(metadataRepo, nil)
+	store.config.Retention = enforcer
+	store.fileService.(*fileservice.FileServiceImpl).SetRetention(enforcer)
+	ctx := context.Background()
+
+	if _, err := store.CreateBucket("vault"); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	if _, err := store.SetRetention("vault", "archive", 1); !errors.Is(err, retention.ErrInvalidRetention) {
+		t.Errorf("Expected ErrInvalidRetention, got %v", err)
+	}
+	bucket, err := store.SetRetention("vault", types.RetentionGovernance, 1)
+	if err != nil {
+		t.Fatalf("Failed to set retention: %v", err)
+	}
+	if bucket.RetentionMode != types.RetentionGovernance || bucket.RetentionDays != 1 {
+		t.Errorf("Unexpected bucket retention %+v", bucket)
+	}
+	if _, err := store.SetMaxVersions(ctx, "vault", 1); err != nil {
+		t.Fatalf("Failed to set max versions: %v", err)
+	}
+
+	first := put("vault", "ledger.csv", "v1")
+	put("vault", "ledger.csv", "v2")
+
+	t.Run("DefaultRetention", func(t *testing.T) {
+		metadata, err := metadataRepo.GetMetadata(first.ObjectID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if metadata.RetentionMode != types.RetentionGovernance || metadata.RetainUntil == nil {
+			t.Errorf("Expected the bucket's default retention, got %+v", metadata)
+		}
+	})
+
+	t.Run("PruneSparesLocked", func(t *testing.T) {
+		versions, err := store.Versions("vault", "ledger.csv")
+		if err != nil {
+			t.Fatalf("Failed to list versions: %v", err)
+		}
+		if len(versions) != 2 {
+			t.Errorf("Expected the locked version to be kept beyond the limit, got %d versions", len(versions))
+		}
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		if err := store.Delete(ctx, "vault", "ledger.csv"); !errors.Is(err, retention.ErrLocked) {
+			t.Errorf("Expected deleting the key to be refused, got %v", err)
+		}
+		if _, err := store.DeletePrefix(ctx, "vault", ""); !errors.Is(err, retention.ErrLocked) {
+			t.Errorf("Expected deleting the prefix to be refused, got %v", err)
+		}
+		if err := store.DeleteVersion(ctx, "vault", "ledger.csv", 1); !errors.Is(err, retention.ErrLocked) {
+			t.Errorf("Expected deleting the version to be refused, got %v", err)
+		}
+		if _, err := store.Move(ctx, "vault", "ledger.csv", "vault", "moved.csv"); !errors.Is(err, retention.ErrLocked) {
+			t.Errorf("Expected moving the key to be refused, got %v", err)
+		}
+		if got := read("vault", "ledger.csv"); got != "v2" {
+			t.Errorf("Expected the key to be left alone, got %q", got)
+		}
+	})
+
+	t.Run("Bypass", func(t *testing.T) {
+		bypass := retention.WithBypass(ctx, "auditor")
+		if _, err := store.Move(bypass, "vault", "ledger.csv", "vault", "moved.csv"); err != nil {
+			t.Fatalf("Failed to move with a bypass: %v", err)
+		}
+		if err := store.Delete(bypass, "vault", "moved.csv"); err != nil {
+			t.Fatalf("Failed to delete with a bypass: %v", err)
+		}
+		if _, err := metadataRepo.GetMetadata(first.ObjectID); err == nil {
+			t.Error("Expected the locked version's object to be deleted")
+		}
+
+		records, err := enforcer.Records(first.ObjectID, 10)
+		if err != nil {
+			t.Fatalf("Failed to list records: %v", err)
+		}
+		if len(records) != 2 || records[0].Action != retention.ActionDelete || records[1].Action != retention.ActionMove ||
+			records[0].Actor != "auditor" {
+			t.Errorf("Expected the move and the delete to be audited, got %+v", records)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// Package chunker splits a stream into content-defined chunks using FastCDC.
+//
+// Chunk boundaries depend only on the bytes around them, so an insertion or
+// deletion changes the chunks near the edit while the rest of the stream
+// splits exactly as before. Near-identical files therefore share most of
+// their chunks.
+package chunker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes
+const (
+	DefaultMinSize = 16 * 1024
+	DefaultAvgSize = 64 * 1024
+	DefaultMaxSize = 256 * 1024
+)
+
+// Config configures chunk sizes. AvgSize is rounded down to a power of two.
+type Config struct {
+	MinSize int `json:"min_size"`
+	AvgSize int `json:"avg_size"`
+	MaxSize int `json:"max_size"`
+}
+
+// DefaultConfig returns the default chunk sizes
+func DefaultConfig() Config {
+	return Config{
+		MinSize: DefaultMinSize,
+		AvgSize: DefaultAvgSize,
+		MaxSize: DefaultMaxSize,
+	}
+}
+
+// Validate checks that the sizes are usable
+func (c Config) Validate() error {
+	if c.MinSize <= 0 || c.AvgSize < c.MinSize || c.MaxSize < c.AvgSize {
+		return fmt.Errorf("invalid chunk sizes: need 0 < min (%d) <= avg (%d) <= max (%d)", c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	if c.AvgSize < 64 {
+		return errors.New("average chunk size must be at least 64 bytes")
+	}
+	return nil
+}
+
+// Chunker reads a stream and returns it chunk by chunk
+type Chunker struct {
+	reader io.Reader
+	config Config
+	maskS  uint64
+	maskL  uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// New creates a chunker reading from reader
+func New(reader io.Reader, config Config) (*Chunker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Normalized chunking: below the average size a cut needs more matching
+	// bits, above it fewer, which narrows the chunk size distribution.
+	avgBits := bits.Len(uint(config.AvgSize)) - 1
+
+	return &Chunker{
+		reader: reader,
+		config: config,
+		maskS:  topBits(avgBits + 2),
+		maskL:  topBits(avgBits - 2),
+		buf:    make([]byte, 2*config.MaxSize),
+	}, nil
+}
+
+// Next returns the next chunk, or io.EOF once the stream is exhausted.
+// The returned slice is only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill tops the buffer up so that a full maximum-size chunk is available
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.config.MaxSize {
+		return nil
+	}
+
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buf) {
+		n, err := c.reader.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.config.MinSize {
+		return n
+	}
+	if n > c.config.MaxSize {
+		n = c.config.MaxSize
+	}
+	normal := c.config.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.config.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// topBits returns a mask of the n most significant bits. The gear hash mixes
+// each byte into the high bits last, so they cover the widest window.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// gear maps each byte to a random 64-bit value. The table is generated from a
+// fixed seed: changing it moves every chunk boundary and stops new content
+// from sharing chunks with content stored before.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,107 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// split chunks data and returns copies of the chunks
+func split(t *testing.T, data []byte, config Config) [][]byte {
+	t.Helper()
+
+	chunker, err := New(bytes.NewReader(data), config)
+	if err != nil {
+		t.Fatalf("Failed to create chunker: %v", err)
+	}
+
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	config := Config{MinSize: 2 * 1024, AvgSize: 8 * 1024, MaxSize: 32 * 1024}
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	t.Run("Reassembles", func(t *testing.T) {
+		chunks := split(t, data, config)
+		if !bytes.Equal(bytes.Join(chunks, nil), data) {
+			t.Fatal("Chunks do not reassemble into the input")
+		}
+
+		for i, chunk := range chunks {
+			if len(chunk) > config.MaxSize {
+				t.Errorf("Chunk %d exceeds max size: %d", i, len(chunk))
+			}
+			if i < len(chunks)-1 && len(chunk) < config.MinSize {
+				t.Errorf("Chunk %d is below min size: %d", i, len(chunk))
+			}
+		}
+
+		avg := len(data) / len(chunks)
+		if avg < config.MinSize || avg > config.MaxSize/2 {
+			t.Errorf("Unexpected average chunk size %d over %d chunks", avg, len(chunks))
+		}
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		first := split(t, data, config)
+		second := split(t, data, config)
+		if len(first) != len(second) {
+			t.Fatalf("Chunk counts differ: %d vs %d", len(first), len(second))
+		}
+		for i := range first {
+			if !bytes.Equal(first[i], second[i]) {
+				t.Fatalf("Chunk %d differs between runs", i)
+			}
+		}
+	})
+
+	t.Run("InsertionKeepsMostChunks", func(t *testing.T) {
+		edited := append([]byte("a few inserted bytes"), data...)
+
+		seen := make(map[[32]byte]bool)
+		original := split(t, data, config)
+		for _, chunk := range original {
+			seen[sha256.Sum256(chunk)] = true
+		}
+
+		shared := 0
+		for _, chunk := range split(t, edited, config) {
+			if seen[sha256.Sum256(chunk)] {
+				shared++
+			}
+		}
+		if shared < len(original)-2 {
+			t.Errorf("Expected all but the edited chunks to be shared, got %d of %d", shared, len(original))
+		}
+	})
+
+	t.Run("SmallInput", func(t *testing.T) {
+		chunks := split(t, data[:100], config)
+		if len(chunks) != 1 || len(chunks[0]) != 100 {
+			t.Errorf("Expected a single chunk, got %d", len(chunks))
+		}
+		if chunks := split(t, nil, config); len(chunks) != 0 {
+			t.Errorf("Expected no chunks for empty input, got %d", len(chunks))
+		}
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		if _, err := New(bytes.NewReader(data), Config{MinSize: 10, AvgSize: 5, MaxSize: 20}); err == nil {
+			t.Error("Expected error for invalid sizes")
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package chunkstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// manifestReader reads chunked content as one seekable stream, opening one
+// chunk at a time
+type manifestReader struct {
+	chunks   *service.Storage
+	manifest *types.Manifest
+	offset   int64
+
+	current      io.ReadSeekCloser
+	currentIndex int
+	// positioned is false when current must seek to offset before reading
+	positioned bool
+}
+
+// newManifestReader returns a reader over the chunks listed in manifest
+func newManifestReader(chunks *service.Storage, manifest *types.Manifest) *manifestReader {
+	return &manifestReader{
+		chunks:       chunks,
+		manifest:     manifest,
+		currentIndex: -1,
+	}
+}
+
+// Read implements io.Reader
+func (r *manifestReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.Size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	index := sort.Search(len(r.manifest.Chunks), func(i int) bool {
+		chunk := r.manifest.Chunks[i]
+		return chunk.Offset+chunk.Size > r.offset
+	})
+	if index == len(r.manifest.Chunks) {
+		return 0, fmt.Errorf("manifest for %s does not cover offset %d", r.manifest.Hash, r.offset)
+	}
+	chunk := r.manifest.Chunks[index]
+
+	if index != r.currentIndex {
+		if err := r.open(index); err != nil {
+			return 0, err
+		}
+	}
+	if !r.positioned {
+		if _, err := r.current.Seek(r.offset-chunk.Offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek chunk %s: %w", chunk.Hash, err)
+		}
+		r.positioned = true
+	}
+
+	if remaining := chunk.Offset + chunk.Size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil
+		}
+		return 0, fmt.Errorf("chunk %s is shorter than its manifest entry: %w", chunk.Hash, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *manifestReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = offset
+	r.positioned = false
+	return offset, nil
+}
+
+// Close implements io.Closer
+func (r *manifestReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	r.currentIndex = -1
+	return err
+}
+
+// open switches to the chunk at index
+func (r *manifestReader) open(index int) error {
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	chunk := r.manifest.Chunks[index]
+	current, err := r.chunks.Open(chunk.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to open chunk %s: %w", chunk.Hash, err)
+	}
+
+	r.current = current
+	r.currentIndex = index
+	r.positioned = false
+	return nil
+}
@@ -0,0 +1,338 @@
+// Package chunkstore stores content either as a single blob or, when chunking
+// is enabled, as content-defined chunks plus a manifest, so near-identical
+// content shares most of its storage.
+//
+// Content keeps its whole-content hash either way: chunking only changes how
+// it is laid out on disk, not how it is addressed.
+package chunkstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zots0127/io/pkg/chunker"
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// ChunkDirName is the directory under the storage root that holds chunks.
+// It is hidden so walks over whole blobs skip it.
+const ChunkDirName = ".chunks"
+
+// Config configures the chunk store
+type Config struct {
+	// Enabled splits new content into chunks. Content stored either way
+	// stays readable when this changes.
+	Enabled bool `json:"enabled"`
+	// Chunker configures chunk sizes
+	Chunker chunker.Config `json:"chunker"`
+}
+
+// DefaultConfig returns the default chunk store configuration, with chunking disabled
+func DefaultConfig() *Config {
+	return &Config{
+		Chunker: chunker.DefaultConfig(),
+	}
+}
+
+// Store reads and writes content as whole blobs or as chunks
+type Store struct {
+	storage      *service.Storage
+	chunks       *service.Storage
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+}
+
+// NewStore creates a chunk store over storage. Chunks are kept in their own
+// content-addressed storage under the same root, compressed and encrypted like
+// storage, and manifests in the metadata repository; without a repository
+// chunking is disabled. Chunks live in every backend of storage alongside its blobs.
+func NewStore(storage *service.Storage, metadataRepo *repository.MetadataRepository, config *Config) *Store {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.Chunker.Validate() != nil {
+		config.Chunker = chunker.DefaultConfig()
+	}
+	if metadataRepo == nil {
+		config.Enabled = false
+	}
+
+	return &Store{
+		storage:      storage,
+		chunks:       storage.Sub(ChunkDirName),
+		metadataRepo: metadataRepo,
+		config:       config,
+	}
+}
+
+// Storage returns the storage holding whole blobs
+func (s *Store) Storage() *service.Storage {
+	return s.storage
+}
+
+// Chunks returns the storage holding chunks
+func (s *Store) Chunks() *service.Storage {
+	return s.chunks
+}
+
+// Algorithm returns the algorithm used to address new content
+func (s *Store) Algorithm() *digest.Algorithm {
+	return s.storage.Algorithm()
+}
+
+// Store writes data and returns its content ID
+func (s *Store) Store(data []byte) (string, error) {
+	if !s.config.Enabled || len(data) <= s.config.Chunker.MinSize {
+		return s.storage.Store(data)
+	}
+
+	hash, _, err := s.StoreFromReader(bytes.NewReader(data))
+	return hash, err
+}
+
+// StoreFromReader streams reader into storage and returns its content ID and
+// size. With chunking enabled, content that spans more than one chunk is
+// stored as chunks; anything smaller is stored as a single blob.
+func (s *Store) StoreFromReader(reader io.Reader) (string, int64, error) {
+	if !s.config.Enabled {
+		return s.storage.StoreFromReader(reader)
+	}
+
+	hasher := s.Algorithm().New()
+	chunks, err := chunker.New(io.TeeReader(reader, hasher), s.config.Chunker)
+	if err != nil {
+		return "", 0, err
+	}
+
+	first, err := chunks.Next()
+	if err == io.EOF {
+		hash, err := s.storage.Store(nil)
+		return hash, 0, err
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read content: %w", err)
+	}
+	// The chunker reuses its buffer, so keep a copy while looking ahead
+	first = append([]byte(nil), first...)
+
+	next, err := chunks.Next()
+	if err == io.EOF {
+		hash, err := s.storage.Store(first)
+		return hash, int64(len(first)), err
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read content: %w", err)
+	}
+
+	manifest := &types.Manifest{}
+	if err := s.storeChunk(manifest, first); err != nil {
+		return "", 0, err
+	}
+	for {
+		if err := s.storeChunk(manifest, next); err != nil {
+			return "", 0, err
+		}
+
+		next, err = chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read content: %w", err)
+		}
+	}
+
+	manifest.Hash = digest.Format(s.Algorithm(), hasher.Sum(nil))
+	if err := s.metadataRepo.SaveManifest(manifest); err != nil {
+		return "", 0, fmt.Errorf("failed to save manifest: %w", err)
+	}
+
+	return manifest.Hash, manifest.Size, nil
+}
+
+// storeChunk stores one chunk and appends it to manifest
+func (s *Store) storeChunk(manifest *types.Manifest, chunk []byte) error {
+	hash, err := s.chunks.Store(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to store chunk: %w", err)
+	}
+
+	manifest.Chunks = append(manifest.Chunks, types.ChunkRef{
+		Hash:   hash,
+		Offset: manifest.Size,
+		Size:   int64(len(chunk)),
+	})
+	manifest.Size += int64(len(chunk))
+	return nil
+}
+
+// Retrieve reads the content identified by hash into memory
+func (s *Store) Retrieve(hash string) ([]byte, error) {
+	reader, err := s.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// Open opens the content identified by hash for streaming.
+// The caller must close the returned reader.
+func (s *Store) Open(hash string) (io.ReadSeekCloser, error) {
+	reader, err := s.storage.Open(hash)
+	if !errors.Is(err, service.ErrFileNotFound) {
+		return reader, err
+	}
+
+	manifest, err := s.manifest(hash)
+	if err != nil {
+		return nil, err
+	}
+	return newManifestReader(s.chunks, manifest), nil
+}
+
+// Exists reports whether the content identified by hash is stored
+func (s *Store) Exists(hash string) bool {
+	if s.storage.Exists(hash) {
+		return true
+	}
+	if s.metadataRepo == nil {
+		return false
+	}
+	exists, err := s.metadataRepo.HasManifest(hash)
+	return err == nil && exists
+}
+
+// Size returns the size of the content identified by hash
+func (s *Store) Size(hash string) (int64, error) {
+	size, err := s.storage.Size(hash)
+	if !errors.Is(err, service.ErrFileNotFound) {
+		return size, err
+	}
+
+	manifest, err := s.manifest(hash)
+	if err != nil {
+		return 0, err
+	}
+	return manifest.Size, nil
+}
+
+// Stat describes how the content identified by hash is stored. Chunked
+// content reports its total size; its chunks may be compressed individually.
+func (s *Store) Stat(hash string) (*types.BlobInfo, error) {
+	info, err := s.storage.Stat(hash)
+	if !errors.Is(err, service.ErrFileNotFound) {
+		return info, err
+	}
+
+	manifest, err := s.manifest(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &types.BlobInfo{Size: manifest.Size, StoredSize: manifest.Size, Codec: codec.None}, nil
+}
+
+// Delete removes the content identified by hash. Chunks are shared between
+// content, so only the manifest is removed; the garbage collector reclaims
+// chunks nothing lists any more.
+func (s *Store) Delete(hash string) error {
+	err := s.storage.Delete(hash)
+	if err != nil && !errors.Is(err, service.ErrFileNotFound) {
+		return err
+	}
+	if s.metadataRepo == nil {
+		return err
+	}
+
+	removed, manifestErr := s.metadataRepo.DeleteManifest(hash)
+	if manifestErr != nil {
+		return fmt.Errorf("failed to delete manifest: %w", manifestErr)
+	}
+	if removed {
+		return nil
+	}
+	return err
+}
+
+// Move moves the content identified by hash to the backend called to: its
+// blob, or every chunk of chunked content. Chunks shared with other content
+// move with it. Reads go through wrap if it is not nil. It reports whether
+// anything was moved, which nothing is if the content was already there.
+func (s *Store) Move(hash, to string, wrap func(io.Reader) io.Reader) (bool, error) {
+	moved, err := s.storage.Move(hash, to, wrap)
+	if !errors.Is(err, service.ErrFileNotFound) {
+		return moved, err
+	}
+
+	manifest, err := s.manifest(hash)
+	if err != nil {
+		return false, err
+	}
+	return eachChunk(manifest, func(chunk string) (bool, error) {
+		return s.chunks.Move(chunk, to, wrap)
+	})
+}
+
+// Recompress rewrites the content identified by hash stored with encoding:
+// its blob, or every chunk of chunked content. It reports whether anything
+// was rewritten, which nothing is if the content was already stored that way.
+func (s *Store) Recompress(hash, encoding string) (bool, error) {
+	changed, err := s.storage.Recompress(hash, encoding)
+	if !errors.Is(err, service.ErrFileNotFound) {
+		return changed, err
+	}
+
+	manifest, err := s.manifest(hash)
+	if err != nil {
+		return false, err
+	}
+	return eachChunk(manifest, func(chunk string) (bool, error) {
+		return s.chunks.Recompress(chunk, encoding)
+	})
+}
+
+// eachChunk calls fn once for every distinct chunk of manifest and reports
+// whether any call did
+func eachChunk(manifest *types.Manifest, fn func(chunk string) (bool, error)) (bool, error) {
+	seen := make(map[string]bool, len(manifest.Chunks))
+	changed := false
+	for _, chunk := range manifest.Chunks {
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+
+		done, err := fn(chunk.Hash)
+		if err != nil {
+			return changed, fmt.Errorf("failed on chunk %s of %s: %w", chunk.Hash, manifest.Hash, err)
+		}
+		changed = changed || done
+	}
+	return changed, nil
+}
+
+// manifest returns the manifest of chunked content, or ErrFileNotFound
+func (s *Store) manifest(hash string) (*types.Manifest, error) {
+	if s.metadataRepo == nil {
+		return nil, service.ErrFileNotFound
+	}
+	exists, err := s.metadataRepo.HasManifest(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up manifest: %w", err)
+	}
+	if !exists {
+		return nil, service.ErrFileNotFound
+	}
+	return s.metadataRepo.GetManifest(hash)
+}
@@ -0,0 +1,232 @@
+package chunkstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zots0127/io/pkg/chunker"
+	"github.com/zots0127/io/pkg/gc"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestStore(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_chunkstore")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := service.NewStorage(filepath.Join(tempDir, "storage"))
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	store := NewStore(storage, metadataRepo, &Config{
+		Enabled: true,
+		Chunker: chunker.Config{MinSize: 2 * 1024, AvgSize: 8 * 1024, MaxSize: 32 * 1024},
+	})
+
+	original := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(original)
+
+	hash, size, err := store.StoreFromReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+	if size != int64(len(original)) {
+		t.Errorf("Expected size %d, got %d", len(original), size)
+	}
+
+	t.Run("AddressedByWholeContent", func(t *testing.T) {
+		wholeHash, err := service.NewStorage(t.TempDir()).Store(original)
+		if err != nil {
+			t.Fatalf("Failed to store whole content: %v", err)
+		}
+		if hash != wholeHash {
+			t.Errorf("Expected hash %s, got %s", wholeHash, hash)
+		}
+		if storage.Exists(hash) {
+			t.Error("Expected chunked content not to be stored as a whole blob")
+		}
+		if !store.Exists(hash) {
+			t.Error("Expected chunked content to exist")
+		}
+		if size, err := store.Size(hash); err != nil || size != int64(len(original)) {
+			t.Errorf("Expected size %d, got %d (%v)", len(original), size, err)
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		data, err := store.Retrieve(hash)
+		if err != nil {
+			t.Fatalf("Failed to retrieve content: %v", err)
+		}
+		if !bytes.Equal(data, original) {
+			t.Error("Retrieved content does not match")
+		}
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		reader, err := store.Open(hash)
+		if err != nil {
+			t.Fatalf("Failed to open content: %v", err)
+		}
+		defer reader.Close()
+
+		for _, offset := range []int64{100000, 3, 400000, int64(len(original)) - 10} {
+			if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+				t.Fatalf("Failed to seek: %v", err)
+			}
+			buf := make([]byte, 50000)
+			n, err := io.ReadFull(reader, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatalf("Failed to read at %d: %v", offset, err)
+			}
+			if !bytes.Equal(buf[:n], original[offset:offset+int64(n)]) {
+				t.Errorf("Content at offset %d does not match", offset)
+			}
+		}
+
+		end, err := reader.Seek(0, io.SeekEnd)
+		if err != nil || end != int64(len(original)) {
+			t.Errorf("Expected end at %d, got %d (%v)", len(original), end, err)
+		}
+	})
+
+	t.Run("MoveAndRecompress", func(t *testing.T) {
+		if err := storage.AddBackend("cold", filepath.Join(tempDir, "cold")); err != nil {
+			t.Fatalf("Failed to add backend: %v", err)
+		}
+		manifest, err := metadataRepo.GetManifest(hash)
+		if err != nil {
+			t.Fatalf("Failed to get manifest: %v", err)
+		}
+
+		if moved, err := store.Move(hash, "cold", nil); err != nil || !moved {
+			t.Fatalf("Expected chunked content to move, got %v (%v)", moved, err)
+		}
+		if changed, err := store.Recompress(hash, codec.Gzip); err != nil || !changed {
+			t.Fatalf("Expected chunked content to be compressed, got %v (%v)", changed, err)
+		}
+		for _, chunk := range manifest.Chunks {
+			if backend, err := store.Chunks().BackendOf(chunk.Hash); err != nil || backend != "cold" {
+				t.Errorf("Expected chunk %s on cold, got %q (%v)", chunk.Hash, backend, err)
+			}
+			if info, err := store.Chunks().Stat(chunk.Hash); err != nil || info.Codec != codec.Gzip {
+				t.Errorf("Expected chunk %s to be compressed, got %+v (%v)", chunk.Hash, info, err)
+			}
+		}
+
+		if moved, err := store.Move(hash, "cold", nil); err != nil || moved {
+			t.Errorf("Expected content already on cold to stay, got %v (%v)", moved, err)
+		}
+		if changed, err := store.Recompress(hash, codec.Gzip); err != nil || changed {
+			t.Errorf("Expected compressed content to be left alone, got %v (%v)", changed, err)
+		}
+		if retrieved, err := store.Retrieve(hash); err != nil || !bytes.Equal(retrieved, original) {
+			t.Errorf("Expected moved content to read back, got %v", err)
+		}
+	})
+
+	t.Run("SmallContentStoredWhole", func(t *testing.T) {
+		small, err := store.Store([]byte("small content"))
+		if err != nil {
+			t.Fatalf("Failed to store content: %v", err)
+		}
+		if !storage.Exists(small) {
+			t.Error("Expected small content to be stored as a whole blob")
+		}
+		if exists, _ := metadataRepo.HasManifest(small); exists {
+			t.Error("Expected no manifest for small content")
+		}
+	})
+
+	t.Run("NearIdenticalContentSharesChunks", func(t *testing.T) {
+		edited := append([]byte(nil), original...)
+		copy(edited[200000:], "an edit in the middle")
+
+		editedHash, _, err := store.StoreFromReader(bytes.NewReader(edited))
+		if err != nil {
+			t.Fatalf("Failed to store content: %v", err)
+		}
+
+		for _, h := range []string{hash, editedHash} {
+			if err := metadataRepo.SaveMetadata(&types.FileMetadata{Hash: h, FileName: "version.bin", Size: int64(len(original))}); err != nil {
+				t.Fatalf("Failed to save metadata: %v", err)
+			}
+		}
+
+		stats, err := metadataRepo.GetStats()
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		logical := stats["logical_bytes"].(int64)
+		physical := stats["physical_bytes"].(int64)
+		if logical != 2*int64(len(original)) {
+			t.Errorf("Expected %d logical bytes, got %d", 2*len(original), logical)
+		}
+		if physical >= logical*3/4 {
+			t.Errorf("Expected shared chunks to save space: %d physical of %d logical bytes", physical, logical)
+		}
+		if ratio := stats["dedup_ratio"].(float64); ratio <= 1.3 {
+			t.Errorf("Expected a dedup ratio above 1.3, got %f", ratio)
+		}
+	})
+
+	t.Run("GarbageCollection", func(t *testing.T) {
+		objects, err := metadataRepo.ListFiles(&types.MetadataFilter{Limit: 10})
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		for _, object := range objects {
+			if object.Hash != hash {
+				continue
+			}
+			if _, _, err := metadataRepo.DeleteObject(object.ID); err != nil {
+				t.Fatalf("Failed to delete object: %v", err)
+			}
+		}
+
+		collector := gc.NewCollector(storage, store.Chunks(), metadataRepo, &gc.Config{})
+		report, err := collector.Run(context.Background(), gc.ModeSweep)
+		if err != nil {
+			t.Fatalf("Failed to collect: %v", err)
+		}
+		if report.RemovedManifests != 1 {
+			t.Errorf("Expected 1 removed manifest, got %d", report.RemovedManifests)
+		}
+		if report.ReclaimedChunks == 0 {
+			t.Error("Expected chunks only the deleted content used to be reclaimed")
+		}
+		if store.Exists(hash) {
+			t.Error("Expected deleted content to be gone")
+		}
+
+		// The edited version still reads back in full
+		stats, err := metadataRepo.GetStats()
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		if chunked := stats["chunked_blobs"].(int); chunked != 1 {
+			t.Errorf("Expected 1 chunked blob, got %d", chunked)
+		}
+		for _, object := range objects {
+			if object.Hash == hash {
+				continue
+			}
+			if _, err := store.Retrieve(object.Hash); err != nil {
+				t.Errorf("Failed to retrieve remaining content: %v", err)
+			}
+		}
+	})
+}
@@ -9,20 +9,26 @@ import (
 	"strings"
 	"time"
 
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/lifecycle"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
+	"github.com/zots0127/io/pkg/types"
 	"gopkg.in/yaml.v2"
 )
 
 // Config represents the complete application configuration
 type Config struct {
-	Server   ServerConfig   `yaml:"server" json:"server"`
-	Storage  StorageConfig  `yaml:"storage" json:"storage"`
-	API      APIConfig      `yaml:"api" json:"api"`
-	S3       S3Config       `yaml:"s3" json:"s3"`
-	Database DatabaseConfig `yaml:"database" json:"database"`
-	Security SecurityConfig `yaml:"security" json:"security"`
-	Logging  LoggingConfig  `yaml:"logging" json:"logging"`
-	Metrics  MetricsConfig  `yaml:"metrics" json:"metrics"`
-	Features FeatureConfig  `yaml:"features" json:"features"`
+	Server    ServerConfig    `yaml:"server" json:"server"`
+	Storage   StorageConfig   `yaml:"storage" json:"storage"`
+	API       APIConfig       `yaml:"api" json:"api"`
+	S3        S3Config        `yaml:"s3" json:"s3"`
+	Database  DatabaseConfig  `yaml:"database" json:"database"`
+	Security  SecurityConfig  `yaml:"security" json:"security"`
+	Logging   LoggingConfig   `yaml:"logging" json:"logging"`
+	Metrics   MetricsConfig   `yaml:"metrics" json:"metrics"`
+	Features  FeatureConfig   `yaml:"features" json:"features"`
+	Lifecycle LifecycleConfig `yaml:"lifecycle" json:"lifecycle"`
 }
 
 // ServerConfig holds HTTP server configuration
@@ -51,6 +57,26 @@ type StorageConfig struct {
 	TempDir         string `yaml:"temp_dir" json:"temp_dir" env:"STORAGE_TEMP_DIR" default:"./temp"`
 	CleanupInterval time.Duration `yaml:"cleanup_interval" json:"cleanup_interval" env:"STORAGE_CLEANUP_INTERVAL" default:"1h"`
 	MaxStorageSize  int64  `yaml:"max_storage_size" json:"max_storage_size" env:"STORAGE_MAX_SIZE" default:"10737418240"` // 10GB
+	HashAlgorithm   string `yaml:"hash_algorithm" json:"hash_algorithm" env:"STORAGE_HASH_ALGORITHM" default:"sha256"` // sha1, sha256, blake3
+	Compression     string `yaml:"compression" json:"compression" env:"STORAGE_COMPRESSION" default:"gzip"` // none, gzip
+	CompressionMinSize int64 `yaml:"compression_min_size" json:"compression_min_size" env:"STORAGE_COMPRESSION_MIN_SIZE" default:"4096"`
+	EncryptionKeyFile string `yaml:"encryption_key_file" json:"encryption_key_file" env:"STORAGE_ENCRYPTION_KEY_FILE"`
+	EncryptionKey   string `yaml:"encryption_key" json:"encryption_key" env:"STORAGE_ENCRYPTION_KEY" sensitive:"true"` // base64 or hex, 32 bytes
+	Backend         string `yaml:"backend" json:"backend" env:"STORAGE_BACKEND" default:"local"` // local, s3
+	S3              StorageS3Config `yaml:"s3" json:"s3"`
+}
+
+// StorageS3Config holds the S3-compatible object store blobs are kept in
+// when the storage backend is s3
+type StorageS3Config struct {
+	Endpoint       string `yaml:"endpoint" json:"endpoint" env:"STORAGE_S3_ENDPOINT"` // empty for AWS
+	Region         string `yaml:"region" json:"region" env:"STORAGE_S3_REGION" default:"us-east-1"`
+	Bucket         string `yaml:"bucket" json:"bucket" env:"STORAGE_S3_BUCKET"`
+	Prefix         string `yaml:"prefix" json:"prefix" env:"STORAGE_S3_PREFIX"`
+	AccessKey      string `yaml:"access_key" json:"access_key" env:"STORAGE_S3_ACCESS_KEY" sensitive:"true"`
+	SecretKey      string `yaml:"secret_key" json:"secret_key" env:"STORAGE_S3_SECRET_KEY" sensitive:"true"`
+	ForcePathStyle bool   `yaml:"force_path_style" json:"force_path_style" env:"STORAGE_S3_FORCE_PATH_STYLE" default:"false"`
+	PartSize       int64  `yaml:"part_size" json:"part_size" env:"STORAGE_S3_PART_SIZE" default:"16777216"` // 16MB, at least 5MB
 }
 
 // APIConfig holds API configuration
@@ -154,6 +180,13 @@ type FeatureConfig struct {
 	EnableCompression bool `yaml:"enable_compression" json:"enable_compression" env:"FEATURE_COMPRESSION" default:"true"`
 }
 
+// LifecycleConfig holds the lifecycle rules applied to stored objects and
+// how often they are applied. Rules declared here can only be changed here.
+type LifecycleConfig struct {
+	Interval time.Duration         `yaml:"interval" json:"interval" env:"LIFECYCLE_INTERVAL" default:"24h"`
+	Rules    []types.LifecycleRule `yaml:"rules" json:"rules"`
+}
+
 // ConfigManager manages configuration loading and validation
 type ConfigManager struct {
 	config     *Config
@@ -341,6 +374,29 @@ func (cm *ConfigManager) validate(config *Config) error {
 	if config.Storage.Path == "" {
 		return fmt.Errorf("storage path is required")
 	}
+	if config.Storage.HashAlgorithm != "" {
+		if _, err := digest.Lookup(config.Storage.HashAlgorithm); err != nil {
+			return fmt.Errorf("invalid storage hash algorithm: %w", err)
+		}
+	}
+	if _, err := codec.Lookup(config.Storage.Compression); err != nil {
+		return fmt.Errorf("invalid storage compression: %w", err)
+	}
+	if _, err := encryption.LoadKeyring(config.Storage.EncryptionKeyFile, config.Storage.EncryptionKey); err != nil {
+		return fmt.Errorf("invalid storage encryption key: %w", err)
+	}
+	switch config.Storage.Backend {
+	case "", "local":
+	case "s3":
+		if config.Storage.S3.Bucket == "" {
+			return fmt.Errorf("S3 bucket is required when the storage backend is s3")
+		}
+		if config.Storage.S3.PartSize != 0 && config.Storage.S3.PartSize < 5*1024*1024 {
+			return fmt.Errorf("S3 part size must be at least 5MB")
+		}
+	default:
+		return fmt.Errorf("invalid storage backend: %s", config.Storage.Backend)
+	}
 
 	// Validate S3 configuration
 	if config.S3.Enabled {
@@ -349,6 +405,19 @@ func (cm *ConfigManager) validate(config *Config) error {
 		}
 	}
 
+	// Validate lifecycle rules
+	declared := make(map[string]bool, len(config.Lifecycle.Rules))
+	for i := range config.Lifecycle.Rules {
+		rule := &config.Lifecycle.Rules[i]
+		if err := lifecycle.ValidateRule(rule); err != nil {
+			return err
+		}
+		if declared[rule.ID] {
+			return fmt.Errorf("lifecycle rule %s is declared twice", rule.ID)
+		}
+		declared[rule.ID] = true
+	}
+
 	return nil
 }
 
@@ -373,6 +442,14 @@ func (cm *ConfigManager) defaultConfig() *Config {
 			TempDir:         "./temp",
 			CleanupInterval: time.Hour,
 			MaxStorageSize:  10 * 1024 * 1024 * 1024, // 10GB
+			HashAlgorithm:   "sha256",
+			Compression:     codec.Gzip,
+			CompressionMinSize: codec.DefaultMinSize,
+			Backend:         "local",
+			S3: StorageS3Config{
+				Region:   "us-east-1",
+				PartSize: 16 * 1024 * 1024, // 16MB
+			},
 		},
 		API: APIConfig{
 			Mode:           "native",
@@ -444,6 +521,9 @@ func (cm *ConfigManager) defaultConfig() *Config {
 			EnableVersioning: false,
 			EnableCompression: true,
 		},
+		Lifecycle: LifecycleConfig{
+			Interval: 24 * time.Hour,
+		},
 	}
 }
 
@@ -478,6 +558,9 @@ func (cm *ConfigManager) logConfigSummary() {
 	fmt.Printf("Server: %s:%s\n", cm.config.Server.Host, cm.config.Server.Port)
 	fmt.Printf("API Mode: %s\n", cm.config.API.Mode)
 	fmt.Printf("Storage Path: %s\n", cm.config.Storage.Path)
+	if cm.config.Storage.Backend == "s3" {
+		fmt.Printf("Storage Backend: s3://%s/%s\n", cm.config.Storage.S3.Bucket, cm.config.Storage.S3.Prefix)
+	}
 	fmt.Printf("Database: %s\n", cm.config.Database.Type)
 	fmt.Printf("Features: WebUI=%v, BatchOps=%v, Monitoring=%v\n",
 		cm.config.Features.EnableWebUI,
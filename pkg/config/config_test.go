@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/zots0127/io/pkg/types"
 )
 
 func TestConfigManager_Load(t *testing.T) {
@@ -183,6 +184,73 @@ func TestConfigManager_Validation(t *testing.T) {
 			expectedError: true,
 			errorContains: "S3 access key and secret key are required",
 		},
+		{
+			name: "S3 storage backend without bucket",
+			config: &Config{
+				Server: ServerConfig{
+					Host: "localhost",
+					Port: "8080",
+				},
+				Storage: StorageConfig{
+					Path:    "./storage",
+					Backend: "s3",
+				},
+			},
+			expectedError: true,
+			errorContains: "S3 bucket is required",
+		},
+		{
+			name: "Unknown storage backend",
+			config: &Config{
+				Server: ServerConfig{
+					Host: "localhost",
+					Port: "8080",
+				},
+				Storage: StorageConfig{
+					Path:    "./storage",
+					Backend: "gcs",
+				},
+			},
+			expectedError: true,
+			errorContains: "invalid storage backend",
+		},
+		{
+			name: "Lifecycle rule without conditions",
+			config: &Config{
+				Server: ServerConfig{
+					Host: "localhost",
+					Port: "8080",
+				},
+				Storage: StorageConfig{
+					Path: "./storage",
+				},
+				Lifecycle: LifecycleConfig{
+					Rules: []types.LifecycleRule{{ID: "everything", Action: types.LifecycleExpire}},
+				},
+			},
+			expectedError: true,
+			errorContains: "has no conditions",
+		},
+		{
+			name: "Lifecycle rule declared twice",
+			config: &Config{
+				Server: ServerConfig{
+					Host: "localhost",
+					Port: "8080",
+				},
+				Storage: StorageConfig{
+					Path: "./storage",
+				},
+				Lifecycle: LifecycleConfig{
+					Rules: []types.LifecycleRule{
+						{ID: "old-logs", Tags: []string{"logs"}, AgeDays: 30, Action: types.LifecycleExpire},
+						{ID: "old-logs", Tags: []string{"logs"}, AgeDays: 7, Action: types.LifecycleCompress},
+					},
+				},
+			},
+			expectedError: true,
+			errorContains: "declared twice",
+		},
 	}
 
 	for _, tt := range tests {
@@ -441,6 +509,7 @@ func TestEnvironmentVariableLoading(t *testing.T) {
 		{"STORAGE_MAX_FILE_SIZE", "200", int64(200), "MaxFileSize"},
 		{"METRICS_ENABLED", "true", true, "Enabled"},
 		{"STORAGE_ALLOWED_TYPES", "jpg,png,pdf", []string{"jpg", "png", "pdf"}, "AllowedTypes"},
+		{"STORAGE_S3_PART_SIZE", "8388608", int64(8388608), "PartSize"},
 	}
 
 	for _, tt := range tests {
@@ -466,6 +535,8 @@ func TestEnvironmentVariableLoading(t *testing.T) {
 				assert.Equal(t, tt.expected, config.Metrics.Enabled)
 			case "AllowedTypes":
 				assert.Equal(t, tt.expected, config.Storage.AllowedTypes)
+			case "PartSize":
+				assert.Equal(t, tt.expected, config.Storage.S3.PartSize)
 			}
 		})
 	}
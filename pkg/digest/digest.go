@@ -0,0 +1,185 @@
+// Package digest defines the content hash algorithms used to address blobs
+// and the identifiers derived from them.
+//
+// A content ID is the hex encoding of a multihash: a varint algorithm code,
+// a varint digest length and the digest itself. For example a SHA-256 ID is
+// "1220" followed by 64 hex digits. SHA-1 IDs are the one exception: they stay
+// the bare 40-digit hex digest so content stored before other algorithms
+// existed keeps its identifiers and on-disk paths.
+package digest
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// Algorithm describes a content hash algorithm
+type Algorithm struct {
+	// Name is the identifier used in configuration and APIs
+	Name string
+	// Code is the multihash code of the algorithm
+	Code uint64
+	// Size is the digest length in bytes
+	Size int
+
+	newHash func() hash.Hash
+}
+
+// New returns a new hash.Hash computing this algorithm
+func (a *Algorithm) New() hash.Hash {
+	return a.newHash()
+}
+
+// String returns the algorithm name
+func (a *Algorithm) String() string {
+	return a.Name
+}
+
+// Supported algorithms
+var (
+	SHA1   = &Algorithm{Name: "sha1", Code: 0x11, Size: sha1.Size, newHash: sha1.New}
+	SHA256 = &Algorithm{Name: "sha256", Code: 0x12, Size: sha256.Size, newHash: sha256.New}
+	BLAKE3 = &Algorithm{Name: "blake3", Code: 0x1e, Size: 32, newHash: func() hash.Hash { return blake3.New() }}
+)
+
+// Default is the algorithm used for new content when none is configured
+var Default = SHA256
+
+var algorithms = []*Algorithm{SHA1, SHA256, BLAKE3}
+
+// Digest errors
+var (
+	ErrUnknownAlgorithm = errors.New("unknown hash algorithm")
+	ErrInvalidID        = errors.New("invalid content id")
+)
+
+// Algorithms returns all supported algorithms
+func Algorithms() []*Algorithm {
+	return append([]*Algorithm(nil), algorithms...)
+}
+
+// Lookup returns the algorithm with the given name.
+// Common spellings such as "SHA-256" and "sha2-256" are accepted.
+func Lookup(name string) (*Algorithm, error) {
+	normalized := strings.ToLower(strings.TrimSpace(name))
+	switch normalized {
+	case "sha-1":
+		normalized = "sha1"
+	case "sha-256", "sha2-256":
+		normalized = "sha256"
+	}
+
+	for _, algorithm := range algorithms {
+		if algorithm.Name == normalized {
+			return algorithm, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, name)
+}
+
+// byCode returns the algorithm with the given multihash code
+func byCode(code uint64) *Algorithm {
+	for _, algorithm := range algorithms {
+		if algorithm.Code == code {
+			return algorithm
+		}
+	}
+	return nil
+}
+
+// Format returns the content ID for a digest computed with algorithm
+func Format(algorithm *Algorithm, sum []byte) string {
+	if algorithm == SHA1 {
+		return hex.EncodeToString(sum)
+	}
+
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(sum))
+	buf = binary.AppendUvarint(buf, algorithm.Code)
+	buf = binary.AppendUvarint(buf, uint64(len(sum)))
+	buf = append(buf, sum...)
+	return hex.EncodeToString(buf)
+}
+
+// Sum hashes data with algorithm and returns its content ID
+func Sum(algorithm *Algorithm, data []byte) string {
+	h := algorithm.New()
+	h.Write(data)
+	return Format(algorithm, h.Sum(nil))
+}
+
+// Parse splits a content ID into its algorithm and raw digest
+func Parse(id string) (*Algorithm, []byte, error) {
+	if id != strings.ToLower(id) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidID, id)
+	}
+
+	raw, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidID, id)
+	}
+
+	// Bare SHA-1 digest
+	if len(raw) == SHA1.Size {
+		return SHA1, raw, nil
+	}
+
+	code, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidID, id)
+	}
+	raw = raw[n:]
+
+	algorithm := byCode(code)
+	if algorithm == nil {
+		return nil, nil, fmt.Errorf("%w: code 0x%x", ErrUnknownAlgorithm, code)
+	}
+
+	length, n := binary.Uvarint(raw)
+	if n <= 0 || length != uint64(algorithm.Size) || len(raw[n:]) != algorithm.Size {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidID, id)
+	}
+
+	return algorithm, raw[n:], nil
+}
+
+// Normalize returns the canonical form of id.
+// A SHA-1 multihash is reduced to the bare hex digest.
+func Normalize(id string) (string, error) {
+	algorithm, sum, err := Parse(id)
+	if err != nil {
+		return "", err
+	}
+	return Format(algorithm, sum), nil
+}
+
+// IsValid reports whether id is a well-formed content ID in canonical form
+func IsValid(id string) bool {
+	normalized, err := Normalize(id)
+	return err == nil && normalized == id
+}
+
+// Hex returns the hex encoded digest part of id, or "" if id is invalid
+func Hex(id string) string {
+	_, sum, err := Parse(id)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
+// Verify reports whether data hashes to id under id's algorithm
+func Verify(id string, data []byte) (bool, error) {
+	algorithm, sum, err := Parse(id)
+	if err != nil {
+		return false, err
+	}
+	return Sum(algorithm, data) == Format(algorithm, sum), nil
+}
@@ -0,0 +1,93 @@
+package digest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	data := []byte("abc")
+
+	t.Run("KnownVectors", func(t *testing.T) {
+		tests := []struct {
+			algorithm *Algorithm
+			expected  string
+		}{
+			{SHA1, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+			{SHA256, "1220ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+			{BLAKE3, "1e206437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		}
+
+		for _, tt := range tests {
+			if got := Sum(tt.algorithm, data); got != tt.expected {
+				t.Errorf("%s: expected %s, got %s", tt.algorithm, tt.expected, got)
+			}
+		}
+	})
+
+	t.Run("ParseRoundTrip", func(t *testing.T) {
+		for _, algorithm := range Algorithms() {
+			id := Sum(algorithm, data)
+			parsed, sum, err := Parse(id)
+			if err != nil {
+				t.Fatalf("%s: failed to parse %s: %v", algorithm, id, err)
+			}
+			if parsed != algorithm || len(sum) != algorithm.Size {
+				t.Errorf("%s: parsed as %s with %d bytes", algorithm, parsed, len(sum))
+			}
+			if !IsValid(id) {
+				t.Errorf("%s: expected %s to be valid", algorithm, id)
+			}
+		}
+	})
+
+	t.Run("SHA1MultihashNormalizes", func(t *testing.T) {
+		legacy := Sum(SHA1, data)
+		normalized, err := Normalize("1114" + legacy)
+		if err != nil {
+			t.Fatalf("Failed to normalize: %v", err)
+		}
+		if normalized != legacy {
+			t.Errorf("Expected %s, got %s", legacy, normalized)
+		}
+		if IsValid("1114" + legacy) {
+			t.Error("Non-canonical form should not be valid")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, id := range []string{
+			"",
+			"../../etc/passwd",
+			strings.ToUpper(Sum(SHA1, data)),
+			"1220abcd",
+			"9920" + strings.Repeat("00", 32),
+		} {
+			if IsValid(id) {
+				t.Errorf("Expected %q to be invalid", id)
+			}
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		for _, name := range []string{"sha256", "SHA-256", "sha2-256"} {
+			if algorithm, err := Lookup(name); err != nil || algorithm != SHA256 {
+				t.Errorf("Lookup(%q) = %v, %v", name, algorithm, err)
+			}
+		}
+		if _, err := Lookup("md5"); !errors.Is(err, ErrUnknownAlgorithm) {
+			t.Errorf("Expected ErrUnknownAlgorithm, got %v", err)
+		}
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		id := Sum(BLAKE3, data)
+		if ok, err := Verify(id, data); err != nil || !ok {
+			t.Errorf("Expected data to verify: %v", err)
+		}
+		if ok, _ := Verify(id, []byte("abd")); ok {
+			t.Error("Expected different data not to verify")
+		}
+	})
+}
@@ -0,0 +1,262 @@
+// Package expiry deletes objects once their expiry time has passed.
+//
+// An expired object stops being served as soon as it expires; the reaper
+// deletes it on its next run and leaves an audit record of the deletion.
+// Expired objects skip the trash. Deleting an object only releases its
+// reference on the content, which the garbage collector reclaims once nothing
+// else references it.
+package expiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultInterval is how often expired objects are deleted by default
+const DefaultInterval = time.Hour
+
+// DefaultBatchSize is how many expired objects are read from the repository at a time
+const DefaultBatchSize = 100
+
+// ErrRunInProgress is returned when a run is requested while one is already running
+var ErrRunInProgress = errors.New("expiry run already in progress")
+
+// ErrInvalidExpiry is returned for a TTL or expiry time that cannot be honoured
+var ErrInvalidExpiry = errors.New("invalid expiry")
+
+// Config configures the reaper
+type Config struct {
+	// Interval between background runs. Zero disables them.
+	Interval time.Duration `json:"interval"`
+	// BatchSize is how many expired objects are read from the repository at a time
+	BatchSize int `json:"batch_size"`
+}
+
+// DefaultConfig returns the default reaper configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Interval:  DefaultInterval,
+		BatchSize: DefaultBatchSize,
+	}
+}
+
+// Report is the outcome of a single run
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	Expired       int   `json:"expired"`
+	Deleted       int   `json:"deleted"`
+	BytesReleased int64 `json:"bytes_released"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ExpiresAt returns when an object stored at now expires, given either a
+// TTL, as a duration such as "24h" or a number of seconds, or an RFC 3339
+// expiry time. It returns nil if neither is set.
+func ExpiresAt(ttl, at string, now time.Time) (*time.Time, error) {
+	switch {
+	case ttl != "" && at != "":
+		return nil, fmt.Errorf("%w: set either a TTL or an expiry time, not both", ErrInvalidExpiry)
+	case ttl != "":
+		duration, err := time.ParseDuration(ttl)
+		if err != nil {
+			seconds, convErr := strconv.ParseInt(ttl, 10, 64)
+			if convErr != nil {
+				return nil, fmt.Errorf("%w: TTL %q is neither a duration nor a number of seconds", ErrInvalidExpiry, ttl)
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("%w: TTL must be positive", ErrInvalidExpiry)
+		}
+		expiresAt := now.Add(duration)
+		return &expiresAt, nil
+	case at != "":
+		expiresAt, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return nil, fmt.Errorf("%w: expiry time %q is not RFC 3339", ErrInvalidExpiry, at)
+		}
+		return &expiresAt, nil
+	}
+	return nil, nil
+}
+
+// Reaper deletes expired objects
+type Reaper struct {
+	fileService  fileservice.FileService
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewReaper creates a new expiry reaper
+func NewReaper(fileService fileservice.FileService, metadataRepo *repository.MetadataRepository, config *Config) *Reaper {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	return &Reaper{
+		fileService:  fileService,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[EXPIRY] ", log.LstdFlags),
+	}
+}
+
+// LastReport returns the report of the most recent run, or nil if none has run
+func (r *Reaper) LastReport() *Report {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastReport
+}
+
+// Run deletes every object that has expired. Only one run happens at a time.
+func (r *Reaper) Run(ctx context.Context) (*Report, error) {
+	if !r.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer r.running.Unlock()
+
+	report := &Report{StartedAt: time.Now()}
+	if err := r.reap(ctx, report); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	r.logger.Printf("expiry finished: %d expired, %d deleted (%d bytes released), %d errors",
+		report.Expired, report.Deleted, report.BytesReleased, len(report.Errors))
+
+	r.mu.Lock()
+	r.lastReport = report
+	r.mu.Unlock()
+
+	return report, nil
+}
+
+// reap deletes expired objects a batch at a time until none is left
+func (r *Reaper) reap(ctx context.Context, report *Report) error {
+	// Objects that failed to delete are still listed, so they are skipped for the rest of the run
+	failed := make(map[string]bool)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		objects, err := r.metadataRepo.ListExpiredObjects(report.StartedAt, r.config.BatchSize+len(failed))
+		if err != nil {
+			return fmt.Errorf("failed to list expired objects: %w", err)
+		}
+
+		deleted := 0
+		for _, metadata := range objects {
+			if failed[metadata.ID] {
+				continue
+			}
+			report.Expired++
+
+			if err := r.delete(ctx, metadata, report); err != nil {
+				failed[metadata.ID] = true
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			deleted++
+		}
+
+		if deleted == 0 {
+			return nil
+		}
+	}
+}
+
+// delete deletes one expired object for good and records the deletion
+func (r *Reaper) delete(ctx context.Context, metadata *types.FileMetadata, report *Report) error {
+	if err := r.fileService.Delete(ctx, metadata.ID); err != nil {
+		return fmt.Errorf("failed to delete expired object %s: %w", metadata.ID, err)
+	}
+	// While the trash is enabled the object was moved there, and is purged at once
+	if _, err := r.metadataRepo.PurgeObject(metadata.ID, time.Now()); err != nil {
+		return fmt.Errorf("failed to purge expired object %s from the trash: %w", metadata.ID, err)
+	}
+	report.Deleted++
+	report.BytesReleased += metadata.Size
+
+	record := &types.ExpiryRecord{
+		ObjectID:  metadata.ID,
+		Hash:      metadata.Hash,
+		FileName:  metadata.FileName,
+		Size:      metadata.Size,
+		ExpiresAt: *metadata.ExpiresAt,
+		DeletedAt: time.Now(),
+	}
+	if err := r.metadataRepo.SaveExpiryRecord(record); err != nil {
+		// The object is gone either way, so the rest of the run goes on
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to record expiry of %s: %v", metadata.ID, err))
+	}
+	return nil
+}
+
+// Start runs immediately and then every configured interval until Stop is
+// called. It does nothing if no interval is configured.
+func (r *Reaper) Start(ctx context.Context) {
+	if r.config.Interval <= 0 || r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := r.Run(ctx); err != nil && !errors.Is(err, ErrRunInProgress) {
+				r.logger.Printf("expiry failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background runs and waits for a running one to finish
+func (r *Reaper) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
@@ -0,0 +1,146 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/trash"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestReaper(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_expiry")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	serviceConfig := fileservice.DefaultServiceConfig()
+	serviceConfig.EnableLogging = false
+	fileService := fileservice.NewFileService(service.NewStorage(filepath.Join(tempDir, "storage")), metadataRepo, serviceConfig)
+	fileService.SetTrash(trash.NewBin(metadataRepo, nil))
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	store := func(name string, expiresAt *time.Time) *types.FileMetadata {
+		t.Helper()
+		stored, err := fileService.Store(ctx, []byte("shared content"), &types.FileMetadata{FileName: name, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatalf("Failed to store %s: %v", name, err)
+		}
+		return stored
+	}
+
+	// Two objects share content; only one of them has expired
+	expired := store("expired.txt", &past)
+	kept := store("kept.txt", nil)
+	later := store("later.txt", &future)
+
+	if _, _, err := fileService.RetrieveObject(ctx, expired.ID); !errors.Is(err, fileservice.ErrExpired) {
+		t.Errorf("Expected an expired object not to be served, got %v", err)
+	}
+
+	reaper := NewReaper(fileService, metadataRepo, &Config{BatchSize: 1})
+	report, err := reaper.Run(ctx)
+	if err != nil {
+		t.Fatalf("Expiry run failed: %v", err)
+	}
+	if report.Expired != 1 || report.Deleted != 1 {
+		t.Errorf("Expected 1 expired object deleted, got %d expired and %d deleted", report.Expired, report.Deleted)
+	}
+	if reaper.LastReport() != report {
+		t.Error("Expected the last report to be kept")
+	}
+
+	if metadata, err := metadataRepo.GetMetadata(expired.ID); err == nil && metadata != nil {
+		t.Error("Expected the expired object to be deleted")
+	}
+	if metadata, err := metadataRepo.GetTrashedObject(expired.ID); err != nil || metadata != nil {
+		t.Errorf("Expected the expired object to skip the trash, got %+v (%v)", metadata, err)
+	}
+	if refs, err := metadataRepo.BlobRefCount(expired.Hash); err != nil || refs != 2 {
+		t.Errorf("Expected the expired object to release its reference, got %d (%v)", refs, err)
+	}
+	for _, id := range []string{kept.ID, later.ID} {
+		reader, _, err := fileService.RetrieveObject(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected %s to stay served: %v", id, err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(data) != "shared content" {
+			t.Errorf("Expected shared content, got %q", data)
+		}
+	}
+
+	records, err := metadataRepo.ListExpiryRecords(10)
+	if err != nil {
+		t.Fatalf("Failed to list expiry records: %v", err)
+	}
+	if len(records) != 1 || records[0].ObjectID != expired.ID || records[0].FileName != "expired.txt" {
+		t.Errorf("Expected one expiry record of %s, got %+v", expired.ID, records)
+	}
+
+	// Nothing else has expired
+	report, err = reaper.Run(ctx)
+	if err != nil {
+		t.Fatalf("Expiry run failed: %v", err)
+	}
+	if report.Expired != 0 {
+		t.Errorf("Expected nothing to expire, got %d", report.Expired)
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		ttl, at string
+		want    time.Duration
+		none    bool
+		invalid bool
+	}{
+		{none: true},
+		{ttl: "90m", want: 90 * time.Minute},
+		{ttl: "60", want: time.Minute},
+		{at: "2024-01-02T12:00:00Z", want: 24 * time.Hour},
+		{ttl: "-1h", invalid: true},
+		{ttl: "0", invalid: true},
+		{ttl: "soon", invalid: true},
+		{at: "tomorrow", invalid: true},
+		{ttl: "1h", at: "2024-01-02T12:00:00Z", invalid: true},
+	}
+
+	for _, test := range tests {
+		expiresAt, err := ExpiresAt(test.ttl, test.at, now)
+		switch {
+		case test.invalid:
+			if !errors.Is(err, ErrInvalidExpiry) {
+				t.Errorf("ExpiresAt(%q, %q): expected ErrInvalidExpiry, got %v", test.ttl, test.at, err)
+			}
+		case err != nil:
+			t.Errorf("ExpiresAt(%q, %q) failed: %v", test.ttl, test.at, err)
+		case test.none:
+			if expiresAt != nil {
+				t.Errorf("ExpiresAt(%q, %q): expected no expiry, got %v", test.ttl, test.at, expiresAt)
+			}
+		case expiresAt == nil || expiresAt.Sub(now) != test.want:
+			t.Errorf("ExpiresAt(%q, %q): expected %v from now, got %v", test.ttl, test.at, test.want, expiresAt)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Package gc reclaims content that no file references any more and reports
+// file records whose content has gone missing. Content stored in chunks is
+// reclaimed in two steps: its manifest once no file references it, and each
+// chunk once no manifest lists it.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Mode selects whether a collection only reports or also reclaims
+type Mode string
+
+const (
+	// ModeDryRun reports what would be collected without changing anything
+	ModeDryRun Mode = "dry-run"
+	// ModeSweep deletes unreferenced blobs, manifests and chunks, and records whose blobs are missing
+	ModeSweep Mode = "sweep"
+)
+
+// DefaultGracePeriod is how long an unreferenced blob is kept after it was last written
+const DefaultGracePeriod = time.Hour
+
+// ErrRunInProgress is returned when a collection is requested while one is already running
+var ErrRunInProgress = errors.New("garbage collection already in progress")
+
+// Config configures the collector
+type Config struct {
+	// GracePeriod protects recently written blobs. An upload stores its blob
+	// before committing metadata, so a blob younger than this is never
+	// reclaimed even if nothing references it yet.
+	GracePeriod time.Duration `json:"grace_period"`
+}
+
+// DefaultConfig returns the default collector configuration
+func DefaultConfig() *Config {
+	return &Config{
+		GracePeriod: DefaultGracePeriod,
+	}
+}
+
+// MissingBlob describes a referenced blob that is not present in storage
+type MissingBlob struct {
+	Hash      string   `json:"hash"`
+	ObjectIDs []string `json:"object_ids"`
+}
+
+// Report is the outcome of a single collection
+type Report struct {
+	Mode        Mode      `json:"mode"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Duration    string    `json:"duration"`
+	GracePeriod string    `json:"grace_period"`
+
+	BlobsScanned   int      `json:"blobs_scanned"`
+	OrphanBlobs    []string `json:"orphan_blobs"`
+	OrphanBytes    int64    `json:"orphan_bytes"`
+	SkippedInGrace int      `json:"skipped_in_grace"`
+
+	OrphanManifests int `json:"orphan_manifests"`
+
+	ChunksScanned    int   `json:"chunks_scanned"`
+	OrphanChunks     int   `json:"orphan_chunks"`
+	OrphanChunkBytes int64 `json:"orphan_chunk_bytes"`
+
+	MissingBlobs []MissingBlob `json:"missing_blobs"`
+
+	ReclaimedBlobs     int   `json:"reclaimed_blobs"`
+	ReclaimedBytes     int64 `json:"reclaimed_bytes"`
+	RemovedManifests   int   `json:"removed_manifests"`
+	ReclaimedChunks    int   `json:"reclaimed_chunks"`
+	RemovedObjects     int64 `json:"removed_objects"`
+	RemovedBlobRecords int   `json:"removed_blob_records"`
+	RemovedTempFiles   int   `json:"removed_temp_files"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Collector finds and reclaims unreferenced blobs
+type Collector struct {
+	storage      *service.Storage
+	chunks       *service.Storage
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+}
+
+// NewCollector creates a new garbage collector. chunks is the storage holding
+// content chunks, or nil if content is never chunked.
+func NewCollector(storage, chunks *service.Storage, metadataRepo *repository.MetadataRepository, config *Config) *Collector {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.GracePeriod < 0 {
+		config.GracePeriod = DefaultGracePeriod
+	}
+
+	return &Collector{
+		storage:      storage,
+		chunks:       chunks,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[GC] ", log.LstdFlags),
+	}
+}
+
+// LastReport returns the report of the most recent collection, or nil if none has run
+func (c *Collector) LastReport() *Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastReport
+}
+
+// Run performs one collection. Only one collection runs at a time.
+func (c *Collector) Run(ctx context.Context, mode Mode) (*Report, error) {
+	if mode != ModeDryRun && mode != ModeSweep {
+		return nil, fmt.Errorf("invalid gc mode: %s", mode)
+	}
+	if !c.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer c.running.Unlock()
+
+	report := &Report{
+		Mode:         mode,
+		StartedAt:    time.Now(),
+		GracePeriod:  c.config.GracePeriod.String(),
+		OrphanBlobs:  []string{},
+		MissingBlobs: []MissingBlob{},
+	}
+	cutoff := report.StartedAt.Add(-c.config.GracePeriod)
+
+	if err := c.collectOrphans(ctx, mode, cutoff, report); err != nil {
+		return nil, err
+	}
+	if err := c.collectManifests(ctx, mode, cutoff, report); err != nil {
+		return nil, err
+	}
+	if err := c.collectChunks(ctx, mode, cutoff, report); err != nil {
+		return nil, err
+	}
+	if err := c.collectMissing(ctx, mode, report); err != nil {
+		return nil, err
+	}
+
+	if mode == ModeSweep {
+		for _, storage := range []*service.Storage{c.storage, c.chunks} {
+			if storage == nil {
+				continue
+			}
+			removed, err := storage.CleanTemp(cutoff)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			}
+			report.RemovedTempFiles += removed
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	c.logger.Printf("%s finished: scanned %d blobs and %d chunks, %d blobs orphaned (%d bytes), %d manifests orphaned, %d chunks orphaned (%d bytes), %d blobs and %d chunks reclaimed, %d missing",
+		mode, report.BlobsScanned, report.ChunksScanned, len(report.OrphanBlobs), report.OrphanBytes, report.OrphanManifests,
+		report.OrphanChunks, report.OrphanChunkBytes, report.ReclaimedBlobs, report.ReclaimedChunks, len(report.MissingBlobs))
+
+	c.mu.Lock()
+	c.lastReport = report
+	c.mu.Unlock()
+
+	return report, nil
+}
+
+// collectOrphans finds blobs on disk that nothing references
+func (c *Collector) collectOrphans(ctx context.Context, mode Mode, cutoff time.Time, report *Report) error {
+	err := c.storage.Walk(func(hash string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.BlobsScanned++
+
+		refs, err := c.metadataRepo.BlobRefCount(hash)
+		if err != nil {
+			return fmt.Errorf("failed to read ref count for %s: %w", hash, err)
+		}
+		if refs > 0 {
+			return nil
+		}
+		if !info.ModTime().Before(cutoff) {
+			report.SkippedInGrace++
+			return nil
+		}
+
+		report.OrphanBlobs = append(report.OrphanBlobs, hash)
+		report.OrphanBytes += info.Size()
+
+		if mode != ModeSweep {
+			return nil
+		}
+
+		// Re-checks the age under the blob lock in case an upload just reused it
+		removed, err := c.storage.DeleteIfOlderThan(hash, cutoff)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+		if !removed {
+			return nil
+		}
+		report.ReclaimedBlobs++
+		report.ReclaimedBytes += info.Size()
+
+		if dropped, err := c.metadataRepo.DeleteBlobIfUnreferenced(hash); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else if dropped {
+			report.RemovedBlobRecords++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan storage: %w", err)
+	}
+
+	if mode != ModeSweep {
+		return nil
+	}
+
+	// Drop unreferenced blob records whose content is already gone
+	return c.metadataRepo.ForEachUnreferencedBlob(func(hash string) error {
+		if c.storage.Exists(hash) {
+			return nil
+		}
+		if chunked, err := c.metadataRepo.HasManifest(hash); err != nil || chunked {
+			return err
+		}
+		dropped, err := c.metadataRepo.DeleteBlobIfUnreferenced(hash)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else if dropped {
+			report.RemovedBlobRecords++
+		}
+		return nil
+	})
+}
+
+// collectManifests finds manifests of chunked content that nothing references.
+// Removing a manifest releases its chunks, which collectChunks then reclaims.
+func (c *Collector) collectManifests(ctx context.Context, mode Mode, cutoff time.Time, report *Report) error {
+	return c.metadataRepo.ForEachUnreferencedManifest(cutoff, func(hash string, size int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.OrphanManifests++
+
+		if mode != ModeSweep {
+			return nil
+		}
+
+		// Re-checks the references in case an upload just reused the content
+		removed, err := c.metadataRepo.DeleteManifestIfUnreferenced(hash, cutoff)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+		if !removed {
+			return nil
+		}
+		report.RemovedManifests++
+
+		if c.storage.Exists(hash) {
+			return nil
+		}
+		if dropped, err := c.metadataRepo.DeleteBlobIfUnreferenced(hash); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else if dropped {
+			report.RemovedBlobRecords++
+		}
+		return nil
+	})
+}
+
+// collectChunks finds chunks that no manifest lists. In a dry run, chunks
+// only listed by orphaned manifests are still counted as referenced.
+func (c *Collector) collectChunks(ctx context.Context, mode Mode, cutoff time.Time, report *Report) error {
+	if c.chunks == nil {
+		return nil
+	}
+
+	err := c.chunks.Walk(func(hash string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.ChunksScanned++
+
+		referenced, err := c.metadataRepo.ChunkReferenced(hash)
+		if err != nil {
+			return fmt.Errorf("failed to check references to chunk %s: %w", hash, err)
+		}
+		if referenced {
+			return nil
+		}
+		if !info.ModTime().Before(cutoff) {
+			report.SkippedInGrace++
+			return nil
+		}
+
+		report.OrphanChunks++
+		report.OrphanChunkBytes += info.Size()
+
+		if mode != ModeSweep {
+			return nil
+		}
+
+		// Re-checks the age under the chunk lock in case an upload just reused it
+		removed, err := c.chunks.DeleteIfOlderThan(hash, cutoff)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+		if removed {
+			report.ReclaimedChunks++
+			report.ReclaimedBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan chunks: %w", err)
+	}
+	return nil
+}
+
+// collectMissing finds file records whose blob is not in storage
+func (c *Collector) collectMissing(ctx context.Context, mode Mode, report *Report) error {
+	return c.metadataRepo.ForEachReferencedBlob(func(hash string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if c.storage.Exists(hash) {
+			return nil
+		}
+		if chunked, err := c.metadataRepo.HasManifest(hash); err != nil || chunked {
+			return err
+		}
+
+		missing := MissingBlob{Hash: hash, ObjectIDs: []string{}}
+		objects, err := c.metadataRepo.ListFiles(&types.MetadataFilter{Hash: hash})
+		if err != nil {
+			return fmt.Errorf("failed to list objects for %s: %w", hash, err)
+		}
+		for _, object := range objects {
+			missing.ObjectIDs = append(missing.ObjectIDs, object.ID)
+		}
+		report.MissingBlobs = append(report.MissingBlobs, missing)
+
+		if mode != ModeSweep {
+			return nil
+		}
+
+		removed, err := c.metadataRepo.DeleteByHash(hash)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+		report.RemovedObjects += removed
+		report.RemovedBlobRecords++
+		return nil
+	})
+}
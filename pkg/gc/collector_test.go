@@ -0,0 +1,154 @@
+package gc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestCollector(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_gc")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := service.NewStorage(filepath.Join(tempDir, "storage"))
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	ctx := context.Background()
+	old := time.Now().Add(-2 * time.Hour)
+
+	age := func(hash string) {
+		if err := os.Chtimes(storage.GetFilePath(hash), old, old); err != nil {
+			t.Fatalf("Failed to age blob: %v", err)
+		}
+	}
+
+	// A referenced blob
+	referenced, err := storage.Store([]byte("referenced"))
+	if err != nil {
+		t.Fatalf("Failed to store blob: %v", err)
+	}
+	age(referenced)
+	if err := metadataRepo.SaveMetadata(&types.FileMetadata{Hash: referenced, FileName: "kept.txt", Size: 10}); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+
+	// An old blob whose only object was deleted
+	released, err := storage.Store([]byte("released"))
+	if err != nil {
+		t.Fatalf("Failed to store blob: %v", err)
+	}
+	age(released)
+	releasedObject := &types.FileMetadata{Hash: released, FileName: "gone.txt", Size: 8}
+	if err := metadataRepo.SaveMetadata(releasedObject); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	if _, _, err := metadataRepo.DeleteObject(releasedObject.ID); err != nil {
+		t.Fatalf("Failed to delete object: %v", err)
+	}
+
+	// A fresh blob with no metadata yet, as if an upload were in flight
+	inFlight, err := storage.Store([]byte("in flight"))
+	if err != nil {
+		t.Fatalf("Failed to store blob: %v", err)
+	}
+
+	// An object whose blob has gone missing
+	missing := "0123456789abcdef0123456789abcdef01234567"
+	dangling := &types.FileMetadata{Hash: missing, FileName: "missing.txt", Size: 4}
+	if err := metadataRepo.SaveMetadata(dangling); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+
+	collector := NewCollector(storage, nil, metadataRepo, &Config{GracePeriod: time.Hour})
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := collector.Run(ctx, ModeDryRun)
+		if err != nil {
+			t.Fatalf("Dry run failed: %v", err)
+		}
+
+		if report.BlobsScanned != 3 {
+			t.Errorf("Expected 3 blobs scanned, got %d", report.BlobsScanned)
+		}
+		if len(report.OrphanBlobs) != 1 || report.OrphanBlobs[0] != released {
+			t.Errorf("Expected only %s to be orphaned, got %v", released, report.OrphanBlobs)
+		}
+		if report.SkippedInGrace != 1 {
+			t.Errorf("Expected 1 blob skipped in grace period, got %d", report.SkippedInGrace)
+		}
+		if len(report.MissingBlobs) != 1 || report.MissingBlobs[0].ObjectIDs[0] != dangling.ID {
+			t.Errorf("Expected dangling object %s to be reported, got %+v", dangling.ID, report.MissingBlobs)
+		}
+		if report.ReclaimedBlobs != 0 || !storage.Exists(released) {
+			t.Error("Dry run must not reclaim anything")
+		}
+		if collector.LastReport() != report {
+			t.Error("Expected last report to be recorded")
+		}
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		report, err := collector.Run(ctx, ModeSweep)
+		if err != nil {
+			t.Fatalf("Sweep failed: %v", err)
+		}
+
+		if report.ReclaimedBlobs != 1 || storage.Exists(released) {
+			t.Errorf("Expected orphaned blob to be reclaimed, report: %+v", report)
+		}
+		if !storage.Exists(referenced) {
+			t.Error("Referenced blob must survive a sweep")
+		}
+		if !storage.Exists(inFlight) {
+			t.Error("Blob inside the grace period must survive a sweep")
+		}
+		if report.RemovedObjects != 1 {
+			t.Errorf("Expected dangling object to be removed, got %d", report.RemovedObjects)
+		}
+		if _, err := metadataRepo.GetMetadata(dangling.ID); err == nil {
+			t.Error("Dangling object should be gone after sweep")
+		}
+
+		stats, err := metadataRepo.GetStats()
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		if stats["unreferenced_blobs"] != 0 {
+			t.Errorf("Expected no unreferenced blob records, got %v", stats["unreferenced_blobs"])
+		}
+	})
+
+	t.Run("ReuseRefreshesBlob", func(t *testing.T) {
+		age(inFlight)
+		if _, err := storage.Store([]byte("in flight")); err != nil {
+			t.Fatalf("Failed to store blob: %v", err)
+		}
+
+		report, err := collector.Run(ctx, ModeSweep)
+		if err != nil {
+			t.Fatalf("Sweep failed: %v", err)
+		}
+		if report.ReclaimedBlobs != 0 || !storage.Exists(inFlight) {
+			t.Error("A blob reused by a new upload must not be reclaimed")
+		}
+	})
+
+	t.Run("InvalidMode", func(t *testing.T) {
+		if _, err := collector.Run(ctx, Mode("purge")); err == nil {
+			t.Error("Expected error for invalid mode")
+		}
+	})
+}
@@ -142,7 +142,7 @@ func (h *BatchHandlers) BatchUpload(c *gin.Context) {
 // BatchDelete handles batch file deletion
 func (h *BatchHandlers) BatchDelete(c *gin.Context) {
 	var req struct {
-		SHA1s []string `json:"sha1s" binding:"required"`
+		IDs   []string `json:"ids" binding:"required"`
 		Force bool     `json:"force,omitempty"`
 	}
 
@@ -152,12 +152,12 @@ func (h *BatchHandlers) BatchDelete(c *gin.Context) {
 	}
 
 	// Validate input
-	if len(req.SHA1s) == 0 {
-		h.respondWithError(c, http.StatusBadRequest, "No SHA1s provided", nil)
+	if len(req.IDs) == 0 {
+		h.respondWithError(c, http.StatusBadRequest, "No IDs provided", nil)
 		return
 	}
 
-	if len(req.SHA1s) > 1000 {
+	if len(req.IDs) > 1000 {
 		h.respondWithError(c, http.StatusBadRequest, "Batch size too large",
 			nil, "Maximum batch size is 1000 items")
 		return
@@ -192,9 +192,9 @@ func (h *BatchHandlers) BatchUpdate(c *gin.Context) {
 
 	// Validate each update
 	for i, update := range req.Updates {
-		if update.SHA1 == "" {
+		if update.ID == "" {
 			h.respondWithError(c, http.StatusBadRequest, "Invalid update",
-				nil, fmt.Sprintf("Update %d: SHA1 is required", i))
+				nil, fmt.Sprintf("Update %d: ID is required", i))
 			return
 		}
 	}
@@ -0,0 +1,514 @@
+// Package lifecycle applies lifecycle rules to stored objects.
+//
+// A rule picks objects by tag, content type, bucket and key prefix, size,
+// age since upload and time since last access, and applies one action to
+// them: expire them, move their content to a cold backend, compress it or
+// strip public access. Rules are declared in configuration or managed
+// through the API, and kept in the metadata repository. The evaluator runs
+// every enabled rule periodically; a dry run reports what each rule would do
+// without changing anything.
+//
+// Expiring an object only sets its expiry time, so it stops being served at
+// once and the expiry reaper deletes it with an audit record. Objects locked
+// by retention or a legal hold are neither expired nor made private.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/throttle"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultInterval is how often rules are applied by default
+const DefaultInterval = 24 * time.Hour
+
+// DefaultBatchSize is how many matching objects are read from the repository at a time
+const DefaultBatchSize = 100
+
+// DefaultRateLimit is how many bytes per second moves copy by default
+const DefaultRateLimit = 64 * 1024 * 1024
+
+// maxPreview is how many matching object IDs a rule report lists
+const maxPreview = 100
+
+// Lifecycle errors
+var (
+	ErrRunInProgress = errors.New("lifecycle run already in progress")
+	ErrInvalidRule   = errors.New("invalid lifecycle rule")
+	ErrRuleNotFound  = errors.New("lifecycle rule not found")
+	ErrRuleDeclared  = errors.New("lifecycle rule is declared in configuration")
+)
+
+// ruleIDPattern is what rule IDs look like
+var ruleIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Config configures the evaluator
+type Config struct {
+	// Interval between background runs. Zero disables them.
+	Interval time.Duration `json:"interval"`
+	// BatchSize is how many matching objects are read from the repository at a time
+	BatchSize int `json:"batch_size"`
+	// RateLimit caps the bytes moves copy per second. Zero copies as fast as the disks allow.
+	RateLimit int64 `json:"rate_limit"`
+}
+
+// DefaultConfig returns the default evaluator configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Interval:  DefaultInterval,
+		BatchSize: DefaultBatchSize,
+		RateLimit: DefaultRateLimit,
+	}
+}
+
+// RuleReport is what one rule did, or would do, in a run
+type RuleReport struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+
+	// Matched objects meet every condition of the rule
+	Matched int `json:"matched"`
+	// Applied counts the objects, or for move and compress the distinct
+	// content, the action changed
+	Applied int `json:"applied"`
+	// Skipped counts what needed no change, such as content shared with an
+	// object the rule already handled
+	Skipped int   `json:"skipped"`
+	Bytes   int64 `json:"bytes"`
+
+	// Objects lists the first matching object IDs
+	Objects []string `json:"objects"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Report is the outcome of a single run
+type Report struct {
+	DryRun     bool      `json:"dry_run"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	Rules []*RuleReport `json:"rules"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ValidateRule checks that rule can be applied and fills in its defaults:
+// compress rules use gzip unless they name a codec
+func ValidateRule(rule *types.LifecycleRule) error {
+	if !ruleIDPattern.MatchString(rule.ID) {
+		return fmt.Errorf("%w: ID %q must be 1 to 64 letters, digits, '.', '_' or '-'", ErrInvalidRule, rule.ID)
+	}
+
+	switch rule.Action {
+	case types.LifecycleExpire, types.LifecyclePrivate:
+	case types.LifecycleMove:
+		if rule.Backend == "" {
+			return fmt.Errorf("%w: %s moves content but names no backend", ErrInvalidRule, rule.ID)
+		}
+	case types.LifecycleCompress:
+		if rule.Codec == "" {
+			rule.Codec = codec.Gzip
+		}
+		encoding, err := codec.Lookup(rule.Codec)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidRule, rule.ID, err)
+		}
+		if encoding == codec.None {
+			return fmt.Errorf("%w: %s compresses content but names no codec", ErrInvalidRule, rule.ID)
+		}
+		rule.Codec = encoding
+	default:
+		return fmt.Errorf("%w: %s has unknown action %q", ErrInvalidRule, rule.ID, rule.Action)
+	}
+
+	if rule.MinSize < 0 || rule.MaxSize < 0 || rule.AgeDays < 0 || rule.IdleDays < 0 {
+		return fmt.Errorf("%w: %s has a negative size or age", ErrInvalidRule, rule.ID)
+	}
+	if rule.MaxSize > 0 && rule.MinSize > rule.MaxSize {
+		return fmt.Errorf("%w: %s has a minimum size above its maximum", ErrInvalidRule, rule.ID)
+	}
+	for _, tag := range rule.Tags {
+		if tag == "" {
+			return fmt.Errorf("%w: %s has an empty tag", ErrInvalidRule, rule.ID)
+		}
+	}
+
+	// A rule without conditions would apply to every object
+	if len(rule.Tags) == 0 && rule.ContentType == "" && rule.Bucket == "" && rule.Prefix == "" &&
+		rule.MinSize == 0 && rule.MaxSize == 0 && rule.AgeDays == 0 && rule.IdleDays == 0 {
+		return fmt.Errorf("%w: %s has no conditions", ErrInvalidRule, rule.ID)
+	}
+	return nil
+}
+
+// Evaluator applies lifecycle rules
+type Evaluator struct {
+	content      *chunkstore.Store
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewEvaluator creates a new lifecycle evaluator over the content store
+func NewEvaluator(content *chunkstore.Store, metadataRepo *repository.MetadataRepository, config *Config) *Evaluator {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	return &Evaluator{
+		content:      content,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[LIFECYCLE] ", log.LstdFlags),
+	}
+}
+
+// Declare makes rules the ones declared in configuration. They replace rules
+// with the same ID, and rules declared before that are no longer listed are removed.
+func (e *Evaluator) Declare(rules []types.LifecycleRule) error {
+	now := time.Now()
+	declared := make(map[string]bool, len(rules))
+
+	for i := range rules {
+		rule := rules[i]
+		if err := ValidateRule(&rule); err != nil {
+			return err
+		}
+		if declared[rule.ID] {
+			return fmt.Errorf("%w: %s is declared twice", ErrInvalidRule, rule.ID)
+		}
+		declared[rule.ID] = true
+
+		rule.Source = types.LifecycleSourceConfig
+		rule.CreatedAt = now
+		rule.UpdatedAt = now
+		if err := e.metadataRepo.SaveLifecycleRule(&rule); err != nil {
+			return fmt.Errorf("failed to save lifecycle rule %s: %w", rule.ID, err)
+		}
+	}
+
+	existing, err := e.metadataRepo.ListLifecycleRules()
+	if err != nil {
+		return fmt.Errorf("failed to list lifecycle rules: %w", err)
+	}
+	for _, rule := range existing {
+		if rule.Source == types.LifecycleSourceConfig && !declared[rule.ID] {
+			if _, err := e.metadataRepo.DeleteLifecycleRule(rule.ID); err != nil {
+				return fmt.Errorf("failed to remove lifecycle rule %s: %w", rule.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Rules returns every lifecycle rule, by ID
+func (e *Evaluator) Rules() ([]*types.LifecycleRule, error) {
+	return e.metadataRepo.ListLifecycleRules()
+}
+
+// Rule returns the lifecycle rule called id
+func (e *Evaluator) Rule(id string) (*types.LifecycleRule, error) {
+	rule, err := e.metadataRepo.GetLifecycleRule(id)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRuleNotFound, id)
+	}
+	return rule, nil
+}
+
+// SaveRule creates or replaces a rule managed through the API. Rules declared
+// in configuration can only be changed there.
+func (e *Evaluator) SaveRule(rule *types.LifecycleRule) error {
+	if err := ValidateRule(rule); err != nil {
+		return err
+	}
+	if rule.Action == types.LifecycleMove && !e.hasBackend(rule.Backend) {
+		return fmt.Errorf("%w: %s moves content to unknown backend %s", ErrInvalidRule, rule.ID, rule.Backend)
+	}
+
+	existing, err := e.metadataRepo.GetLifecycleRule(rule.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rule.CreatedAt = now
+	if existing != nil {
+		if existing.Source == types.LifecycleSourceConfig {
+			return fmt.Errorf("%w: %s", ErrRuleDeclared, rule.ID)
+		}
+		rule.CreatedAt = existing.CreatedAt
+	}
+	rule.Source = types.LifecycleSourceAPI
+	rule.UpdatedAt = now
+
+	return e.metadataRepo.SaveLifecycleRule(rule)
+}
+
+// DeleteRule removes a rule managed through the API
+func (e *Evaluator) DeleteRule(id string) error {
+	rule, err := e.Rule(id)
+	if err != nil {
+		return err
+	}
+	if rule.Source == types.LifecycleSourceConfig {
+		return fmt.Errorf("%w: %s", ErrRuleDeclared, id)
+	}
+
+	if _, err := e.metadataRepo.DeleteLifecycleRule(id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// hasBackend reports whether the content store has a backend called name
+func (e *Evaluator) hasBackend(name string) bool {
+	for _, backend := range e.content.Storage().Backends() {
+		if backend.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LastReport returns the report of the most recent run, or nil if none has run
+func (e *Evaluator) LastReport() *Report {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.lastReport
+}
+
+// Run applies every enabled rule, in order of ID. A dry run only reports
+// what each rule would do. Only one run happens at a time.
+func (e *Evaluator) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	if !e.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer e.running.Unlock()
+
+	rules, err := e.metadataRepo.ListLifecycleRules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list lifecycle rules: %w", err)
+	}
+
+	report := &Report{DryRun: dryRun, StartedAt: time.Now(), Rules: []*RuleReport{}}
+	limit := throttle.NewLimiter(ctx, e.config.RateLimit)
+
+	for _, rule := range rules {
+		if rule.Disabled {
+			continue
+		}
+
+		ruleReport, err := e.evaluate(ctx, rule, report.StartedAt, dryRun, limit)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			report.Errors = append(report.Errors, fmt.Sprintf("rule %s: %v", rule.ID, err))
+		}
+		report.Rules = append(report.Rules, ruleReport)
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	if !dryRun {
+		applied := 0
+		for _, ruleReport := range report.Rules {
+			applied += ruleReport.Applied
+		}
+		e.logger.Printf("lifecycle finished: %d rules applied to %d objects, %d errors",
+			len(report.Rules), applied, len(report.Errors))
+	}
+
+	e.mu.Lock()
+	e.lastReport = report
+	e.mu.Unlock()
+
+	return report, nil
+}
+
+// evaluate applies one rule to every object it matches at now, a batch at a time
+func (e *Evaluator) evaluate(ctx context.Context, rule *types.LifecycleRule, now time.Time, dryRun bool, limit *throttle.Limiter) (*RuleReport, error) {
+	report := &RuleReport{Rule: rule.ID, Action: rule.Action, Objects: []string{}}
+
+	// Content shared by several matching objects is moved or compressed once
+	handled := make(map[string]bool)
+
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		objects, err := e.metadataRepo.ListLifecycleMatches(rule, now, after, e.config.BatchSize)
+		if err != nil {
+			return report, fmt.Errorf("failed to list matching objects: %w", err)
+		}
+
+		for _, metadata := range objects {
+			after = metadata.ID
+			report.Matched++
+			if len(report.Objects) < maxPreview {
+				report.Objects = append(report.Objects, metadata.ID)
+			}
+
+			applied, err := e.apply(rule, metadata, now, dryRun, handled, limit)
+			if err != nil {
+				if ctx.Err() != nil {
+					return report, ctx.Err()
+				}
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			if !applied {
+				report.Skipped++
+				continue
+			}
+			report.Applied++
+			report.Bytes += metadata.Size
+		}
+
+		if len(objects) < e.config.BatchSize {
+			return report, nil
+		}
+	}
+}
+
+// apply applies the rule's action to one object and reports whether it
+// changed anything, or in a dry run whether it would
+func (e *Evaluator) apply(rule *types.LifecycleRule, metadata *types.FileMetadata, now time.Time, dryRun bool, handled map[string]bool, limit *throttle.Limiter) (bool, error) {
+	switch rule.Action {
+	case types.LifecycleExpire:
+		if metadata.Locked(now) {
+			return false, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+		expired, err := e.metadataRepo.ExpireObject(metadata.ID, now)
+		if err != nil {
+			return false, fmt.Errorf("failed to expire %s: %w", metadata.ID, err)
+		}
+		return expired, nil
+
+	case types.LifecyclePrivate:
+		if metadata.Locked(now) {
+			return false, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+		changed, err := e.metadataRepo.SetObjectPrivate(metadata.ID)
+		if err != nil {
+			return false, fmt.Errorf("failed to make %s private: %w", metadata.ID, err)
+		}
+		return changed, nil
+
+	case types.LifecycleMove:
+		if handled[metadata.Hash] {
+			return false, nil
+		}
+		handled[metadata.Hash] = true
+
+		if dryRun {
+			// Only whole blobs are known to be on one backend; chunks may be anywhere
+			backend, err := e.content.Storage().BackendOf(metadata.Hash)
+			return err != nil || backend != rule.Backend, nil
+		}
+		moved, err := e.content.Move(metadata.Hash, rule.Backend, limit.Reader)
+		if err != nil {
+			return false, fmt.Errorf("failed to move %s to %s: %w", metadata.Hash, rule.Backend, err)
+		}
+		return moved, nil
+
+	case types.LifecycleCompress:
+		if handled[metadata.Hash] {
+			return false, nil
+		}
+		handled[metadata.Hash] = true
+
+		if dryRun {
+			return true, nil
+		}
+		compressed, err := e.content.Recompress(metadata.Hash, rule.Codec)
+		if err != nil {
+			return false, fmt.Errorf("failed to compress %s: %w", metadata.Hash, err)
+		}
+		if compressed {
+			// Whole blobs are accounted for by their size on disk; chunked content is not
+			if info, err := e.content.Storage().Stat(metadata.Hash); err == nil {
+				if err := e.metadataRepo.SaveBlobInfo(metadata.Hash, info); err != nil {
+					e.logger.Printf("Warning: failed to record storage info for %s: %v", metadata.Hash, err)
+				}
+			}
+		}
+		return compressed, nil
+	}
+
+	return false, fmt.Errorf("%w: %s has unknown action %q", ErrInvalidRule, rule.ID, rule.Action)
+}
+
+// Start applies the rules immediately and then every configured interval
+// until Stop is called. It does nothing if no interval is configured.
+func (e *Evaluator) Start(ctx context.Context) {
+	if e.config.Interval <= 0 || e.stop != nil {
+		return
+	}
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := e.Run(ctx, false); err != nil && !errors.Is(err, ErrRunInProgress) {
+				e.logger.Printf("lifecycle failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background runs and waits for a running one to finish
+func (e *Evaluator) Stop() {
+	if e.stop == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+	e.stop = nil
+}
@@ -0,0 +1,224 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestEvaluator(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_lifecycle")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	storage := service.NewStorage(filepath.Join(tempDir, "storage"))
+	if err := storage.AddBackend("cold", filepath.Join(tempDir, "cold")); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	content := chunkstore.NewStore(storage, metadataRepo, nil)
+
+	serviceConfig := fileservice.DefaultServiceConfig()
+	serviceConfig.EnableLogging = false
+	fileService := fileservice.NewFileService(content, metadataRepo, serviceConfig)
+
+	ctx := context.Background()
+	store := func(data string, metadata *types.FileMetadata, age time.Duration) *types.FileMetadata {
+		t.Helper()
+		stored, err := fileService.Store(ctx, []byte(data), metadata)
+		if err != nil {
+			t.Fatalf("Failed to store %s: %v", metadata.FileName, err)
+		}
+		stored.UploadedAt = time.Now().Add(-age)
+		stored.LastAccessed = stored.UploadedAt
+		if err := metadataRepo.SaveMetadata(stored); err != nil {
+			t.Fatalf("Failed to back-date %s: %v", metadata.FileName, err)
+		}
+		return stored
+	}
+
+	day := 24 * time.Hour
+	oldLog := store(strings.Repeat("old log line\n", 1000),
+		&types.FileMetadata{FileName: "old.log", ContentType: "text/plain", Tags: []string{"logs"}, IsPublic: true}, 40*day)
+	newLog := store(strings.Repeat("new log line\n", 1000),
+		&types.FileMetadata{FileName: "new.log", ContentType: "text/plain", Tags: []string{"logs"}, IsPublic: true}, 0)
+	photo := store("pretend this is a photo",
+		&types.FileMetadata{FileName: "photo.png", ContentType: "image/png"}, 100*day)
+
+	evaluator := NewEvaluator(content, metadataRepo, &Config{})
+
+	t.Run("InvalidRules", func(t *testing.T) {
+		invalid := []*types.LifecycleRule{
+			{ID: "everything", Action: types.LifecycleExpire},
+			{ID: "bad id!", Action: types.LifecycleExpire, AgeDays: 1},
+			{ID: "shred", Action: "shred", AgeDays: 1},
+			{ID: "nowhere", Action: types.LifecycleMove, AgeDays: 1},
+			{ID: "unknown-backend", Action: types.LifecycleMove, Backend: "tape", AgeDays: 1},
+			{ID: "zstd", Action: types.LifecycleCompress, Codec: "zstd", AgeDays: 1},
+			{ID: "sizes", Action: types.LifecycleExpire, MinSize: 10, MaxSize: 5},
+		}
+		for _, rule := range invalid {
+			if err := evaluator.SaveRule(rule); !errors.Is(err, ErrInvalidRule) {
+				t.Errorf("Expected rule %s to be invalid, got %v", rule.ID, err)
+			}
+		}
+	})
+
+	rules := []*types.LifecycleRule{
+		{ID: "cold-images", ContentType: "image/", IdleDays: 90, Action: types.LifecycleMove, Backend: "cold"},
+		{ID: "compress-text", ContentType: "text/", Action: types.LifecycleCompress},
+		{ID: "expire-old-logs", Tags: []string{"logs"}, AgeDays: 30, Action: types.LifecycleExpire},
+		{ID: "private-logs", Tags: []string{"logs"}, Action: types.LifecyclePrivate},
+	}
+	for _, rule := range rules {
+		if err := evaluator.SaveRule(rule); err != nil {
+			t.Fatalf("Failed to save rule %s: %v", rule.ID, err)
+		}
+	}
+	if rules[1].Codec != codec.Gzip {
+		t.Errorf("Expected compress rules to default to gzip, got %q", rules[1].Codec)
+	}
+
+	counts := func(report *Report) map[string][3]int {
+		result := make(map[string][3]int)
+		for _, rule := range report.Rules {
+			result[rule.Rule] = [3]int{rule.Matched, rule.Applied, rule.Skipped}
+		}
+		return result
+	}
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := evaluator.Run(ctx, true)
+		if err != nil {
+			t.Fatalf("Dry run failed: %v", err)
+		}
+		expected := map[string][3]int{
+			"cold-images":     {1, 1, 0},
+			"compress-text":   {2, 2, 0},
+			"expire-old-logs": {1, 1, 0},
+			"private-logs":    {2, 2, 0},
+		}
+		if got := counts(report); len(got) != len(expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		} else {
+			for id, want := range expected {
+				if got[id] != want {
+					t.Errorf("Rule %s: expected matched, applied, skipped %v, got %v", id, want, got[id])
+				}
+			}
+		}
+		if !report.DryRun || len(report.Errors) != 0 {
+			t.Errorf("Unexpected report: %+v", report)
+		}
+
+		// Nothing changed
+		if _, _, err := fileService.RetrieveObject(ctx, oldLog.ID); err != nil {
+			t.Errorf("Expected old log to stay served: %v", err)
+		}
+		if backend, _ := storage.BackendOf(photo.Hash); backend != service.DefaultBackend {
+			t.Errorf("Expected photo to stay on the default backend, got %s", backend)
+		}
+		if info, _ := storage.Stat(newLog.Hash); info.Codec != codec.None {
+			t.Errorf("Expected new log to stay uncompressed, got %s", info.Codec)
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		report, err := evaluator.Run(ctx, false)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if len(report.Errors) != 0 {
+			t.Fatalf("Unexpected errors: %v", report.Errors)
+		}
+		if evaluator.LastReport() != report {
+			t.Error("Expected the last report to be kept")
+		}
+
+		if _, _, err := fileService.RetrieveObject(ctx, oldLog.ID); !errors.Is(err, fileservice.ErrExpired) {
+			t.Errorf("Expected old log to have expired, got %v", err)
+		}
+		if metadata, err := metadataRepo.GetMetadata(newLog.ID); err != nil || metadata.IsPublic || metadata.ExpiresAt != nil {
+			t.Errorf("Expected new log to be private and not to expire, got %+v (%v)", metadata, err)
+		}
+		if backend, err := storage.BackendOf(photo.Hash); err != nil || backend != "cold" {
+			t.Errorf("Expected photo on the cold backend, got %s (%v)", backend, err)
+		}
+
+		info, err := metadataRepo.GetBlobInfo(newLog.Hash)
+		if err != nil || info.Codec != codec.Gzip {
+			t.Errorf("Expected new log to be recorded as compressed, got %+v (%v)", info, err)
+		}
+		reader, _, err := fileService.RetrieveObject(ctx, newLog.ID)
+		if err != nil {
+			t.Fatalf("Failed to retrieve new log: %v", err)
+		}
+		reader.Close()
+	})
+
+	t.Run("NothingLeftToDo", func(t *testing.T) {
+		report, err := evaluator.Run(ctx, false)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		for _, rule := range report.Rules {
+			if rule.Applied != 0 {
+				t.Errorf("Expected rule %s to change nothing, applied %d", rule.Rule, rule.Applied)
+			}
+		}
+	})
+
+	t.Run("DeclaredRules", func(t *testing.T) {
+		declared := []types.LifecycleRule{{ID: "declared", AgeDays: 365, Action: types.LifecycleExpire}}
+		if err := evaluator.Declare(declared); err != nil {
+			t.Fatalf("Failed to declare rules: %v", err)
+		}
+
+		rule, err := evaluator.Rule("declared")
+		if err != nil || rule.Source != types.LifecycleSourceConfig {
+			t.Fatalf("Expected a rule from configuration, got %+v (%v)", rule, err)
+		}
+		if err := evaluator.SaveRule(&types.LifecycleRule{ID: "declared", AgeDays: 1, Action: types.LifecycleExpire}); !errors.Is(err, ErrRuleDeclared) {
+			t.Errorf("Expected ErrRuleDeclared on save, got %v", err)
+		}
+		if err := evaluator.DeleteRule("declared"); !errors.Is(err, ErrRuleDeclared) {
+			t.Errorf("Expected ErrRuleDeclared on delete, got %v", err)
+		}
+
+		if err := evaluator.Declare(nil); err != nil {
+			t.Fatalf("Failed to declare rules: %v", err)
+		}
+		if _, err := evaluator.Rule("declared"); !errors.Is(err, ErrRuleNotFound) {
+			t.Errorf("Expected a rule no longer declared to be removed, got %v", err)
+		}
+		remaining, err := evaluator.Rules()
+		if err != nil || len(remaining) != len(rules) {
+			t.Errorf("Expected the %d rules from the API to stay, got %d (%v)", len(rules), len(remaining), err)
+		}
+
+		if err := evaluator.DeleteRule("private-logs"); err != nil {
+			t.Errorf("Failed to delete rule: %v", err)
+		}
+		if err := evaluator.DeleteRule("private-logs"); !errors.Is(err, ErrRuleNotFound) {
+			t.Errorf("Expected ErrRuleNotFound, got %v", err)
+		}
+	})
+}
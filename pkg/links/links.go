@@ -0,0 +1,269 @@
+// Package links implements presigned download links. A link names one object
+// and carries its expiry and an HMAC-SHA256 signature over both, so forged or
+// altered links are turned away before the repository is consulted. Each link
+// is also recorded, which is what lets it be revoked early, limited to a
+// number of downloads and bound to one client address.
+package links
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultExpiry is how long a link is valid when no expiry is asked for
+const DefaultExpiry = 24 * time.Hour
+
+// DefaultMaxExpiry is the longest expiry a link may be given
+const DefaultMaxExpiry = 7 * 24 * time.Hour
+
+// Link errors
+var (
+	ErrObjectNotFound    = errors.New("object not found")
+	ErrInvalidOptions    = errors.New("invalid link options")
+	ErrLinkNotFound      = errors.New("download link not found")
+	ErrInvalidSignature  = errors.New("invalid download link signature")
+	ErrLinkExpired       = errors.New("download link expired")
+	ErrLinkRevoked       = errors.New("download link revoked")
+	ErrLinkExhausted     = errors.New("download link has no downloads left")
+	ErrAddressNotAllowed = errors.New("download link not valid from this address")
+)
+
+// Config configures the link manager
+type Config struct {
+	// Secret keys link signatures. Links signed with another secret are
+	// rejected, so it must stay the same across restarts for links to survive them.
+	Secret []byte `json:"-"`
+	// DefaultExpiry is how long a link is valid when no expiry is asked for
+	DefaultExpiry time.Duration `json:"default_expiry"`
+	// MaxExpiry is the longest expiry a link may be given
+	MaxExpiry time.Duration `json:"max_expiry"`
+}
+
+// Options describe a link to create
+type Options struct {
+	// Expiry is how long the link is valid. Zero means the default expiry.
+	Expiry time.Duration
+	// MaxDownloads limits how often the link may be used. Zero means unlimited.
+	MaxDownloads int
+	// AllowedIP, if set, is the only client address the link serves
+	AllowedIP string
+	// FileName overrides the object's file name in Content-Disposition
+	FileName string
+	// Inline serves the object for display rather than as an attachment
+	Inline bool
+	// CreatedBy records who asked for the link
+	CreatedBy string
+}
+
+// Manager creates, checks and revokes download links
+type Manager struct {
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+}
+
+// NewManager creates a new link manager. Without a configured secret a random
+// one is generated, and links stop working when the process restarts.
+func NewManager(metadataRepo *repository.MetadataRepository, config *Config) *Manager {
+	logger := log.New(os.Stdout, "[LINKS] ", log.LstdFlags)
+
+	if config.DefaultExpiry <= 0 {
+		config.DefaultExpiry = DefaultExpiry
+	}
+	if config.MaxExpiry <= 0 {
+		config.MaxExpiry = DefaultMaxExpiry
+	}
+	if config.DefaultExpiry > config.MaxExpiry {
+		config.DefaultExpiry = config.MaxExpiry
+	}
+	if len(config.Secret) == 0 {
+		config.Secret = make([]byte, 32)
+		if _, err := rand.Read(config.Secret); err != nil {
+			panic(fmt.Sprintf("failed to generate link secret: %v", err))
+		}
+		logger.Printf("No link secret configured; download links will not survive a restart")
+	}
+
+	return &Manager{
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       logger,
+	}
+}
+
+// Create records a new link to the object with objectID
+func (m *Manager) Create(objectID string, options *Options) (*types.DownloadLink, error) {
+	if _, err := m.metadataRepo.GetMetadata(objectID); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+	}
+
+	expiry := options.Expiry
+	if expiry == 0 {
+		expiry = m.config.DefaultExpiry
+	}
+	if expiry < 0 || expiry > m.config.MaxExpiry {
+		return nil, fmt.Errorf("%w: expiry must be positive and at most %s", ErrInvalidOptions, m.config.MaxExpiry)
+	}
+	if options.MaxDownloads < 0 {
+		return nil, fmt.Errorf("%w: max downloads must not be negative", ErrInvalidOptions)
+	}
+
+	allowedIP := ""
+	if options.AllowedIP != "" {
+		ip := net.ParseIP(options.AllowedIP)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: invalid IP address %q", ErrInvalidOptions, options.AllowedIP)
+		}
+		allowedIP = ip.String()
+	}
+
+	// Expiries are signed at second precision
+	now := time.Now().UTC().Truncate(time.Second)
+	link := &types.DownloadLink{
+		ID:           uuid.New().String(),
+		ObjectID:     objectID,
+		FileName:     options.FileName,
+		Inline:       options.Inline,
+		MaxDownloads: options.MaxDownloads,
+		AllowedIP:    allowedIP,
+		CreatedBy:    options.CreatedBy,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(expiry),
+	}
+	if err := m.metadataRepo.SaveDownloadLink(link); err != nil {
+		return nil, fmt.Errorf("failed to save download link: %w", err)
+	}
+
+	return link, nil
+}
+
+// Query returns the query parameters that authorize a request for link
+func (m *Manager) Query(link *types.DownloadLink) url.Values {
+	expires := strconv.FormatInt(link.ExpiresAt.Unix(), 10)
+	return url.Values{
+		"expires":   {expires},
+		"signature": {m.sign(link.ID, expires)},
+	}
+}
+
+// Open checks a request for the link with id, given the expires and signature
+// query parameters it carries and the address it came from, and returns the
+// link if it may be served. It does not count a download; see Claim.
+func (m *Manager) Open(id, expires, signature, clientIP string) (*types.DownloadLink, error) {
+	if !hmac.Equal([]byte(signature), []byte(m.sign(id, expires))) {
+		return nil, ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if !time.Now().Before(time.Unix(unix, 0)) {
+		return nil, fmt.Errorf("%w: %s", ErrLinkExpired, id)
+	}
+
+	link, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := usable(link, time.Now()); err != nil {
+		return nil, err
+	}
+	if link.AllowedIP != "" {
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !ip.Equal(net.ParseIP(link.AllowedIP)) {
+			return nil, fmt.Errorf("%w: %s", ErrAddressNotAllowed, clientIP)
+		}
+	}
+
+	return link, nil
+}
+
+// Claim counts a download through link. It fails if the link was revoked,
+// expired or used up since it was opened, so a limited link is never served
+// more often than allowed.
+func (m *Manager) Claim(link *types.DownloadLink) error {
+	now := time.Now()
+	claimed, err := m.metadataRepo.ClaimDownload(link.ID, now)
+	if err != nil {
+		return fmt.Errorf("failed to count download: %w", err)
+	}
+	if claimed {
+		link.Downloads++
+		return nil
+	}
+
+	current, err := m.Get(link.ID)
+	if err != nil {
+		return err
+	}
+	if err := usable(current, now); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrLinkExhausted, link.ID)
+}
+
+// Get returns the link with id
+func (m *Manager) Get(id string) (*types.DownloadLink, error) {
+	link, err := m.metadataRepo.GetDownloadLink(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get download link: %w", err)
+	}
+	if link == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLinkNotFound, id)
+	}
+	return link, nil
+}
+
+// List returns the links to an object, or every link if objectID is empty
+func (m *Manager) List(objectID string) ([]*types.DownloadLink, error) {
+	return m.metadataRepo.ListDownloadLinks(objectID)
+}
+
+// Revoke stops a link from being used before it expires. Revoking a link
+// twice is not an error.
+func (m *Manager) Revoke(id string) (*types.DownloadLink, error) {
+	if _, err := m.metadataRepo.RevokeDownloadLink(id, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to revoke download link: %w", err)
+	}
+
+	link, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Printf("Revoked download link %s to object %s", link.ID, link.ObjectID)
+	return link, nil
+}
+
+// sign returns the signature of a link's ID and expiry
+func (m *Manager) sign(id, expires string) string {
+	mac := hmac.New(sha256.New, m.config.Secret)
+	mac.Write([]byte(id + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// usable reports why link may not be served at now, if it may not
+func usable(link *types.DownloadLink, now time.Time) error {
+	switch {
+	case link.RevokedAt != nil:
+		return fmt.Errorf("%w: %s", ErrLinkRevoked, link.ID)
+	case !now.Before(link.ExpiresAt):
+		return fmt.Errorf("%w: %s", ErrLinkExpired, link.ID)
+	case link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads:
+		return fmt.Errorf("%w: %s", ErrLinkExhausted, link.ID)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package links
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestManager(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_links")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	config := fileservice.DefaultServiceConfig()
+	config.EnableLogging = false
+	fileService := fileservice.NewFileService(service.NewStorage(filepath.Join(tempDir, "storage")), metadataRepo, config)
+
+	stored, err := fileService.StoreStream(context.Background(), bytes.NewReader([]byte("shared file")), &types.FileMetadata{FileName: "shared.txt"})
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	manager := NewManager(metadataRepo, &Config{Secret: []byte("secret")})
+
+	open := func(link *types.DownloadLink, clientIP string) (*types.DownloadLink, error) {
+		query := manager.Query(link)
+		return manager.Open(link.ID, query.Get("expires"), query.Get("signature"), clientIP)
+	}
+
+	t.Run("OpenAndClaim", func(t *testing.T) {
+		link, err := manager.Create(stored.ID, &Options{Expiry: time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			opened, err := open(link, "192.0.2.1")
+			if err != nil {
+				t.Fatalf("Failed to open link: %v", err)
+			}
+			if err := manager.Claim(opened); err != nil {
+				t.Fatalf("Failed to claim download: %v", err)
+			}
+		}
+
+		link, err = manager.Get(link.ID)
+		if err != nil {
+			t.Fatalf("Failed to get link: %v", err)
+		}
+		if link.Downloads != 3 {
+			t.Errorf("Expected 3 downloads, got %d", link.Downloads)
+		}
+	})
+
+	t.Run("TamperedLink", func(t *testing.T) {
+		link, err := manager.Create(stored.ID, &Options{Expiry: time.Minute})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+		query := manager.Query(link)
+
+		// Pushing the expiry back invalidates the signature
+		later := strconv.FormatInt(link.ExpiresAt.Add(time.Hour).Unix(), 10)
+		if _, err := manager.Open(link.ID, later, query.Get("signature"), ""); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature for altered expiry, got %v", err)
+		}
+		if _, err := manager.Open("other", query.Get("expires"), query.Get("signature"), ""); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature for another ID, got %v", err)
+		}
+
+		other := NewManager(metadataRepo, &Config{Secret: []byte("other secret")})
+		if _, err := other.Open(link.ID, query.Get("expires"), query.Get("signature"), ""); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature under another secret, got %v", err)
+		}
+	})
+
+	t.Run("SingleUse", func(t *testing.T) {
+		link, err := manager.Create(stored.ID, &Options{MaxDownloads: 1})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+
+		first, err := open(link, "")
+		if err != nil {
+			t.Fatalf("Failed to open link: %v", err)
+		}
+		second, err := open(link, "")
+		if err != nil {
+			t.Fatalf("Failed to open link again before it is used: %v", err)
+		}
+
+		if err := manager.Claim(first); err != nil {
+			t.Fatalf("Failed to claim download: %v", err)
+		}
+		if err := manager.Claim(second); !errors.Is(err, ErrLinkExhausted) {
+			t.Errorf("Expected ErrLinkExhausted for a second download, got %v", err)
+		}
+		if _, err := open(link, ""); !errors.Is(err, ErrLinkExhausted) {
+			t.Errorf("Expected ErrLinkExhausted opening a used link, got %v", err)
+		}
+	})
+
+	t.Run("BoundToAddress", func(t *testing.T) {
+		link, err := manager.Create(stored.ID, &Options{AllowedIP: "2001:db8::1"})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+
+		if _, err := open(link, "2001:0db8:0:0:0:0:0:1"); err != nil {
+			t.Errorf("Expected link to open from its address, got %v", err)
+		}
+		if _, err := open(link, "192.0.2.1"); !errors.Is(err, ErrAddressNotAllowed) {
+			t.Errorf("Expected ErrAddressNotAllowed, got %v", err)
+		}
+
+		if _, err := manager.Create(stored.ID, &Options{AllowedIP: "not an address"}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Expected ErrInvalidOptions for an invalid address, got %v", err)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		if _, err := manager.Create(stored.ID, &Options{Expiry: DefaultMaxExpiry + time.Hour}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Expected ErrInvalidOptions for an expiry past the maximum, got %v", err)
+		}
+		if _, err := manager.Create("missing", &Options{}); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Expected ErrObjectNotFound, got %v", err)
+		}
+
+		link, err := manager.Create(stored.ID, &Options{Expiry: time.Second})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+		if link.ExpiresAt.Sub(link.CreatedAt) != time.Second {
+			t.Errorf("Expected link to expire a second after creation, got %s", link.ExpiresAt.Sub(link.CreatedAt))
+		}
+
+		link.ExpiresAt = time.Now().Add(-time.Second).Truncate(time.Second)
+		if _, err := open(link, ""); !errors.Is(err, ErrLinkExpired) {
+			t.Errorf("Expected ErrLinkExpired, got %v", err)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		link, err := manager.Create(stored.ID, &Options{})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+		opened, err := open(link, "")
+		if err != nil {
+			t.Fatalf("Failed to open link: %v", err)
+		}
+
+		revoked, err := manager.Revoke(link.ID)
+		if err != nil {
+			t.Fatalf("Failed to revoke link: %v", err)
+		}
+		if revoked.RevokedAt == nil {
+			t.Error("Expected revoked link to record when it was revoked")
+		}
+		if _, err := manager.Revoke(link.ID); err != nil {
+			t.Errorf("Expected revoking twice to succeed, got %v", err)
+		}
+
+		if _, err := open(link, ""); !errors.Is(err, ErrLinkRevoked) {
+			t.Errorf("Expected ErrLinkRevoked, got %v", err)
+		}
+		if err := manager.Claim(opened); !errors.Is(err, ErrLinkRevoked) {
+			t.Errorf("Expected ErrLinkRevoked claiming a link opened before it was revoked, got %v", err)
+		}
+		if _, err := manager.Revoke("missing"); !errors.Is(err, ErrLinkNotFound) {
+			t.Errorf("Expected ErrLinkNotFound, got %v", err)
+		}
+	})
+
+	t.Run("DeletedWithObject", func(t *testing.T) {
+		other, err := fileService.StoreStream(context.Background(), bytes.NewReader([]byte("short-lived")), &types.FileMetadata{FileName: "gone.txt"})
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		link, err := manager.Create(other.ID, &Options{})
+		if err != nil {
+			t.Fatalf("Failed to create link: %v", err)
+		}
+
+		if err := fileService.Delete(context.Background(), other.ID); err != nil {
+			t.Fatalf("Failed to delete object: %v", err)
+		}
+		if _, err := open(link, ""); !errors.Is(err, ErrLinkNotFound) {
+			t.Errorf("Expected ErrLinkNotFound once the object is deleted, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,362 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Bucket errors
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+)
+
+// bucketColumns lists the buckets columns in the order GetBucket and ListBuckets scan them
+const bucketColumns = `name, created_at, max_versions, retention_mode, retention_days`
+
+// bucketEntryColumns lists the bucket_keys and objects columns in the order scanBucketEntry expects
+const bucketEntryColumns = `k.bucket, k.object_key, k.object_id, k.etag, o.size, o.content_type, k.version, k.modified_at`
+
+// bucketEntryTables joins keys to the objects stored under them, hiding keys
+// whose object is gone
+const bucketEntryTables = `bucket_keys k JOIN objects o ON o.id = k.object_id`
+
+// CreateBucket creates the bucket called name. It reports false if the bucket
+// already exists.
+func (r *MetadataRepository) CreateBucket(name string, createdAt time.Time) (bool, error) {
+	result, err := r.db.Exec("INSERT INTO buckets (name, created_at) VALUES (?, ?) ON CONFLICT (name) DO NOTHING",
+		name, createdAt.UTC())
+	if err != nil {
+		return false, err
+	}
+
+	created, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return created > 0, nil
+}
+
+// GetBucket returns the bucket called name, or nil if there is none
+func (r *MetadataRepository) GetBucket(name string) (*types.Bucket, error) {
+	var bucket types.Bucket
+	err := r.db.QueryRow("SELECT "+bucketColumns+" FROM buckets WHERE name = ?", name).
+		Scan(&bucket.Name, &bucket.CreatedAt, &bucket.MaxVersions, &bucket.RetentionMode, &bucket.RetentionDays)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// ListBuckets returns every bucket, by name
+func (r *MetadataRepository) ListBuckets() ([]*types.Bucket, error) {
+	rows, err := r.db.Query("SELECT " + bucketColumns + " FROM buckets ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []*types.Bucket{}
+	for rows.Next() {
+		var bucket types.Bucket
+		if err := rows.Scan(&bucket.Name, &bucket.CreatedAt, &bucket.MaxVersions, &bucket.RetentionMode, &bucket.RetentionDays); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, &bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// DeleteBucket deletes the bucket called name, which must hold neither keys
+// nor versions
+func (r *MetadataRepository) DeleteBucket(name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var keys int64
+	err = tx.QueryRow("SELECT (SELECT COUNT(*) FROM bucket_keys WHERE bucket = ?) + (SELECT COUNT(*) FROM object_versions WHERE bucket = ?)",
+		name, name).Scan(&keys)
+	if err != nil {
+		return err
+	}
+	if keys > 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotEmpty, name)
+	}
+
+	result, err := tx.Exec("DELETE FROM buckets WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+
+	return tx.Commit()
+}
+
+// PutBucketEntry stores entry's object under its key as a new version,
+// numbering it in entry.Version. Unless versioned is set the versions before
+// it are dropped; otherwise as many are kept as the bucket's max_versions
+// allows, keeping locked versions beyond it too. It returns the IDs of the
+// objects whose versions were dropped, which the caller is left to delete.
+func (r *MetadataRepository) PutBucketEntry(entry *types.BucketEntry, versioned bool) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var maxVersions int
+	err = tx.QueryRow("SELECT max_versions FROM buckets WHERE name = ?", entry.Bucket).Scan(&maxVersions)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, entry.Bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var latest int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM object_versions WHERE bucket = ? AND object_key = ?",
+		entry.Bucket, entry.Key).Scan(&latest)
+	if err != nil {
+		return nil, err
+	}
+	entry.Version = latest + 1
+
+	_, err = tx.Exec("INSERT INTO object_versions (bucket, object_key, version, object_id, etag, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.Bucket, entry.Key, entry.Version, entry.ObjectID, entry.ETag, entry.ModifiedAt.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO bucket_keys (bucket, object_key, object_id, etag, version, modified_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (bucket, object_key) DO UPDATE SET
+			object_id = excluded.object_id,
+			etag = excluded.etag,
+			version = excluded.version,
+			modified_at = excluded.modified_at`,
+		entry.Bucket, entry.Key, entry.ObjectID, entry.ETag, entry.Version, entry.ModifiedAt.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	keep := 1
+	if versioned {
+		keep = maxVersions
+	}
+	dropped, err := pruneVersions(tx, entry.Bucket, entry.Key, keep, versioned)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return dropped, nil
+}
+
+// GetBucketEntry returns what is stored under key in bucket, or nil if nothing is
+func (r *MetadataRepository) GetBucketEntry(bucket, key string) (*types.BucketEntry, error) {
+	query := "SELECT " + bucketEntryColumns + " FROM " + bucketEntryTables + " WHERE k.bucket = ? AND k.object_key = ?"
+
+	entry, err := scanBucketEntry(r.db.QueryRow(query, bucket, key))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// DeleteBucketEntry removes key and every version of it from bucket. It
+// returns the IDs of the objects that were stored there, which the caller is
+// left to delete; none if there was no such key.
+func (r *MetadataRepository) DeleteBucketEntry(bucket, key string) ([]string, error) {
+	return r.deleteBucketEntries("object_key = ?", bucket, key)
+}
+
+// ListBucketEntries returns up to limit keys of bucket starting with prefix
+// and sorting after after, in byte order
+func (r *MetadataRepository) ListBucketEntries(bucket, prefix, after string, limit int) ([]*types.BucketEntry, error) {
+	query := "SELECT " + bucketEntryColumns + " FROM " + bucketEntryTables +
+		" WHERE k.bucket = ? AND k.object_key > ? AND substr(k.object_key, 1, length(?)) = ?" +
+		" ORDER BY k.object_key LIMIT ?"
+
+	rows, err := r.db.Query(query, bucket, after, prefix, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*types.BucketEntry{}
+	for rows.Next() {
+		entry, err := scanBucketEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// DeleteBucketEntries removes every key of bucket starting with prefix,
+// with every version of them. It returns the IDs of the objects that were
+// stored there, which the caller is left to delete.
+func (r *MetadataRepository) DeleteBucketEntries(bucket, prefix string) ([]string, error) {
+	return r.deleteBucketEntries("substr(object_key, 1, length(?)) = ?", bucket, prefix, prefix)
+}
+
+// deleteBucketEntries removes the keys of bucket matching condition, with
+// every version of them, and returns the IDs of their objects
+func (r *MetadataRepository) deleteBucketEntries(condition string, bucket string, args ...interface{}) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	args = append([]interface{}{bucket}, args...)
+	objectIDs := []string{}
+	seen := map[string]bool{}
+	for _, table := range []string{"bucket_keys", "object_versions"} {
+		rows, err := tx.Query("DELETE FROM "+table+" WHERE bucket = ? AND "+condition+" RETURNING object_id", args...)
+		if err != nil {
+			return nil, err
+		}
+		deleted, err := scanObjectIDs(rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, objectID := range deleted {
+			if !seen[objectID] {
+				seen[objectID] = true
+				objectIDs = append(objectIDs, objectID)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return objectIDs, nil
+}
+
+// MoveBucketEntries moves srcKey of srcBucket, with its versions, to dstKey
+// of dstBucket without touching the objects stored there. With prefix set,
+// every key starting with srcKey is moved, with srcKey replaced by dstKey;
+// the caller must make sure the two do not overlap. The objects are renamed
+// after their new keys. It returns how many keys were moved and the IDs of
+// the objects replaced at the destination, versions included, which the
+// caller is left to delete.
+func (r *MetadataRepository) MoveBucketEntries(srcBucket, srcKey, dstBucket, dstKey string, prefix bool, modifiedAt time.Time) (int, []string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM buckets WHERE name = ?", dstBucket).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return 0, nil, fmt.Errorf("%w: %s", ErrBucketNotFound, dstBucket)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	query := "SELECT object_key, object_id FROM bucket_keys WHERE bucket = ? AND object_key = ?"
+	args := []interface{}{srcBucket, srcKey}
+	if prefix {
+		query = "SELECT object_key, object_id FROM bucket_keys WHERE bucket = ? AND substr(object_key, 1, length(?)) = ? ORDER BY object_key"
+		args = []interface{}{srcBucket, srcKey, srcKey}
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	type move struct{ key, objectID string }
+	var moves []move
+	for rows.Next() {
+		var m move
+		if err := rows.Scan(&m.key, &m.objectID); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		moves = append(moves, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	replaced := []string{}
+	for _, m := range moves {
+		target := dstKey + m.key[len(srcKey):]
+
+		if _, err := tx.Exec("DELETE FROM bucket_keys WHERE bucket = ? AND object_key = ?", dstBucket, target); err != nil {
+			return 0, nil, err
+		}
+		rows, err := tx.Query("DELETE FROM object_versions WHERE bucket = ? AND object_key = ? RETURNING object_id", dstBucket, target)
+		if err != nil {
+			return 0, nil, err
+		}
+		dropped, err := scanObjectIDs(rows)
+		if err != nil {
+			return 0, nil, err
+		}
+		replaced = append(replaced, dropped...)
+
+		_, err = tx.Exec("UPDATE bucket_keys SET bucket = ?, object_key = ?, modified_at = ? WHERE bucket = ? AND object_key = ?",
+			dstBucket, target, modifiedAt.UTC(), srcBucket, m.key)
+		if err != nil {
+			return 0, nil, err
+		}
+		_, err = tx.Exec("UPDATE object_versions SET bucket = ?, object_key = ? WHERE bucket = ? AND object_key = ?",
+			dstBucket, target, srcBucket, m.key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("UPDATE objects SET file_name = ? WHERE id = ?", path.Base(target), m.objectID); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return len(moves), replaced, nil
+}
+
+// scanBucketEntry reads a row selected with bucketEntryColumns
+func scanBucketEntry(row rowScanner) (*types.BucketEntry, error) {
+	var entry types.BucketEntry
+	var contentType sql.NullString
+
+	err := row.Scan(&entry.Bucket, &entry.Key, &entry.ObjectID, &entry.ETag, &entry.Size, &contentType, &entry.Version, &entry.ModifiedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.ContentType = contentType.String
+	return &entry, nil
+}
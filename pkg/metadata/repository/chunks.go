@@ -0,0 +1,181 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// SaveManifest records the chunks of content stored in chunks. Saving the
+// manifest of content that is already chunked replaces it and resets its
+// creation time, which protects it from the garbage collector's grace period
+// like a freshly written blob.
+func (r *MetadataRepository) SaveManifest(manifest *types.Manifest) error {
+	if manifest.CreatedAt.IsZero() {
+		manifest.CreatedAt = time.Now()
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO manifests (blob_hash, size, chunk_count, created_at) VALUES (?, ?, ?, ?)",
+		manifest.Hash, manifest.Size, len(manifest.Chunks), manifest.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM manifest_chunks WHERE blob_hash = ?", manifest.Hash); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO manifest_chunks (blob_hash, seq, chunk_hash, chunk_offset, size) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for seq, chunk := range manifest.Chunks {
+		if _, err := stmt.Exec(manifest.Hash, seq, chunk.Hash, chunk.Offset, chunk.Size); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetManifest retrieves the manifest of chunked content
+func (r *MetadataRepository) GetManifest(hash string) (*types.Manifest, error) {
+	manifest := &types.Manifest{Hash: hash}
+	var chunkCount int
+
+	err := r.db.QueryRow("SELECT size, chunk_count, created_at FROM manifests WHERE blob_hash = ?", hash).
+		Scan(&manifest.Size, &chunkCount, &manifest.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("manifest not found for hash: %s", hash)
+		}
+		return nil, err
+	}
+
+	rows, err := r.db.Query("SELECT chunk_hash, chunk_offset, size FROM manifest_chunks WHERE blob_hash = ? ORDER BY seq", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	manifest.Chunks = make([]types.ChunkRef, 0, chunkCount)
+	for rows.Next() {
+		var chunk types.ChunkRef
+		if err := rows.Scan(&chunk.Hash, &chunk.Offset, &chunk.Size); err != nil {
+			return nil, err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Chunks) != chunkCount {
+		return nil, fmt.Errorf("manifest for %s lists %d of %d chunks", hash, len(manifest.Chunks), chunkCount)
+	}
+	return manifest, nil
+}
+
+// HasManifest reports whether content is stored in chunks
+func (r *MetadataRepository) HasManifest(hash string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM manifests WHERE blob_hash = ?)", hash).Scan(&exists)
+	return exists, err
+}
+
+// DeleteManifest removes the manifest of chunked content. The chunks
+// themselves are left for the garbage collector. It reports whether a
+// manifest was removed.
+func (r *MetadataRepository) DeleteManifest(hash string) (bool, error) {
+	return r.deleteManifest("DELETE FROM manifests WHERE blob_hash = ?", hash)
+}
+
+// DeleteManifestIfUnreferenced removes the manifest of chunked content that
+// no object references and that was saved before cutoff. It reports whether
+// a manifest was removed.
+func (r *MetadataRepository) DeleteManifestIfUnreferenced(hash string, cutoff time.Time) (bool, error) {
+	return r.deleteManifest(`
+		DELETE FROM manifests WHERE blob_hash = ? AND created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM blobs WHERE hash = manifests.blob_hash AND ref_count > 0)`,
+		hash, cutoff.UTC())
+}
+
+// deleteManifest runs a manifest delete and, if it removed a row, drops the
+// manifest's chunk list in the same transaction
+func (r *MetadataRepository) deleteManifest(query string, hash string, args ...interface{}) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, append([]interface{}{hash}, args...)...)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM manifest_chunks WHERE blob_hash = ?", hash); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ForEachUnreferencedManifest calls fn for every manifest saved before cutoff
+// whose content no object references
+func (r *MetadataRepository) ForEachUnreferencedManifest(cutoff time.Time, fn func(hash string, size int64) error) error {
+	rows, err := r.db.Query(`
+		SELECT blob_hash, size FROM manifests WHERE created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM blobs WHERE hash = manifests.blob_hash AND ref_count > 0)`,
+		cutoff.UTC())
+	if err != nil {
+		return err
+	}
+
+	// Collect first so fn may query the database without holding the cursor open
+	type entry struct {
+		hash string
+		size int64
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.hash, &e.size); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := fn(e.hash, e.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChunkReferenced reports whether any manifest lists the chunk
+func (r *MetadataRepository) ChunkReferenced(hash string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM manifest_chunks WHERE chunk_hash = ?)", hash).Scan(&exists)
+	return exists, err
+}
@@ -2,9 +2,13 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/digest"
 	"github.com/zots0127/io/pkg/types"
 	_ "modernc.org/sqlite"
 )
@@ -14,9 +18,10 @@ type MetadataRepository struct {
 	db *sql.DB
 }
 
-// NewMetadataRepository creates a new metadata repository
+// NewMetadataRepository creates a new metadata repository, migrating the
+// database to the latest schema first
 func NewMetadataRepository(dbPath string) (*MetadataRepository, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", withBusyTimeout(dbPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -25,67 +30,86 @@ func NewMetadataRepository(dbPath string) (*MetadataRepository, error) {
 		db: db,
 	}
 
-	if err := repo.initTables(); err != nil {
-		return nil, fmt.Errorf("failed to initialize tables: %w", err)
+	migrator, err := newSchemaMigrator(db, dbPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := migrator.Up(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
 	}
 
 	return repo, nil
 }
 
+// withBusyTimeout makes concurrent writers wait for the lock instead of failing with SQLITE_BUSY.
+// Transactions take the write lock when they begin, since SQLite cannot wait
+// for a reader to upgrade its lock and fails at once instead.
+func withBusyTimeout(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + "_pragma=busy_timeout(5000)&_txlock=immediate"
+}
+
 // Close closes the database connection
 func (r *MetadataRepository) Close() error {
 	return r.db.Close()
 }
 
-// initTables creates necessary database tables
-func (r *MetadataRepository) initTables() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS files (
-		sha1 TEXT PRIMARY KEY,
-		file_name TEXT NOT NULL,
-		content_type TEXT,
-		size INTEGER NOT NULL,
-		uploaded_by TEXT,
-		uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		last_accessed DATETIME DEFAULT CURRENT_TIMESTAMP,
-		access_count INTEGER DEFAULT 1,
-		tags TEXT, -- JSON array
-		custom_fields TEXT, -- JSON object
-		description TEXT,
-		is_public BOOLEAN DEFAULT FALSE,
-		expires_at DATETIME,
-		version INTEGER DEFAULT 1
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_files_uploaded_at ON files(uploaded_at);
-	CREATE INDEX IF NOT EXISTS idx_files_file_name ON files(file_name);
-	CREATE INDEX IF NOT EXISTS idx_files_content_type ON files(content_type);
-	CREATE INDEX IF NOT EXISTS idx_files_is_public ON files(is_public);
-	`
+// objectColumns lists the objects table columns in the order scanObject expects
+const objectColumns = `id, blob_hash, file_name, content_type, size, uploaded_by, api_key_id, uploaded_at,
+	last_accessed, access_count, tags, custom_fields, description,
+	is_public, expires_at, version, retention_mode, retain_until, legal_hold, deleted_at,
+	COALESCE((SELECT blobs.tier FROM blobs WHERE blobs.hash = blob_hash), 'hot')`
 
-	_, err := r.db.Exec(query)
-	return err
-}
-
-// SaveMetadata saves file metadata to database
+// SaveMetadata saves an object and registers its blob.
+// An object ID is assigned if metadata does not carry one yet. The blob's
+// reference count is adjusted in the same transaction: a new object adds a
+// reference, and re-pointing an existing object moves its reference.
 func (r *MetadataRepository) SaveMetadata(metadata *types.FileMetadata) error {
-	query := `
-	INSERT OR REPLACE INTO files (
-		sha1, file_name, content_type, size, uploaded_by, uploaded_at,
-		last_accessed, access_count, tags, custom_fields, description,
-		is_public, expires_at, version
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+	if metadata.ID == "" {
+		metadata.ID = uuid.New().String()
+	}
 
 	tagsJSON, _ := json.Marshal(metadata.Tags)
 	customFieldsJSON, _ := json.Marshal(metadata.CustomFields)
 
-	_, err := r.db.Exec(query,
-		metadata.SHA1,
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO blobs (hash, algorithm, size) VALUES (?, ?, ?)", metadata.Hash, algorithmOf(metadata.Hash), metadata.Size)
+	if err != nil {
+		return err
+	}
+
+	var previousHash string
+	err = tx.QueryRow("SELECT blob_hash FROM objects WHERE id = ?", metadata.ID).Scan(&previousHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	query := `
+	INSERT OR REPLACE INTO objects (
+		id, blob_hash, file_name, content_type, size, uploaded_by, api_key_id, uploaded_at,
+		last_accessed, access_count, tags, custom_fields, description,
+		is_public, expires_at, version, retention_mode, retain_until, legal_hold
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err = tx.Exec(query,
+		metadata.ID,
+		metadata.Hash,
 		metadata.FileName,
 		metadata.ContentType,
 		metadata.Size,
 		metadata.UploadedBy,
+		metadata.APIKeyID,
 		metadata.UploadedAt,
 		metadata.LastAccessed,
 		metadata.AccessCount,
@@ -93,65 +117,151 @@ func (r *MetadataRepository) SaveMetadata(metadata *types.FileMetadata) error {
 		string(customFieldsJSON),
 		metadata.Description,
 		metadata.IsPublic,
-		metadata.ExpiresAt,
+		utcTime(metadata.ExpiresAt),
 		metadata.Version,
+		metadata.RetentionMode,
+		utcTime(metadata.RetainUntil),
+		metadata.LegalHold,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if previousHash != metadata.Hash {
+		if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE hash = ?", metadata.Hash); err != nil {
+			return err
+		}
+		if previousHash != "" {
+			if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ?", previousHash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
 }
 
-// GetMetadata retrieves file metadata by SHA1
-func (r *MetadataRepository) GetMetadata(sha1 string) (*types.FileMetadata, error) {
-	query := `
-		SELECT sha1, file_name, content_type, size, uploaded_by, uploaded_at,
-			   last_accessed, access_count, tags, custom_fields, description,
-			   is_public, expires_at, version
-		FROM files WHERE sha1 = ?
-	`
+// GetMetadata retrieves object metadata by object ID, including every known
+// digest of its content. Objects in the trash are not found.
+func (r *MetadataRepository) GetMetadata(id string) (*types.FileMetadata, error) {
+	query := "SELECT " + objectColumns + " FROM objects WHERE id = ? AND " + liveObjects
 
-	var metadata types.FileMetadata
-	var tagsJSON, customFieldsJSON string
+	metadata, err := scanObject(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("metadata not found for object: %s", id)
+		}
+		return nil, err
+	}
 
-	err := r.db.QueryRow(query, sha1).Scan(
-		&metadata.SHA1,
-		&metadata.FileName,
-		&metadata.ContentType,
-		&metadata.Size,
-		&metadata.UploadedBy,
-		&metadata.UploadedAt,
-		&metadata.LastAccessed,
-		&metadata.AccessCount,
-		&tagsJSON,
-		&customFieldsJSON,
-		&metadata.Description,
-		&metadata.IsPublic,
-		&metadata.ExpiresAt,
-		&metadata.Version,
-	)
+	if metadata.Digests, err = r.GetDigests(metadata.Hash); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
 
+// GetMetadataByHash returns the most recently uploaded object referencing hash
+func (r *MetadataRepository) GetMetadataByHash(hash string) (*types.FileMetadata, error) {
+	files, err := r.ListFiles(&types.MetadataFilter{Hash: hash, Limit: 1})
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("metadata not found for SHA1: %s", sha1)
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("metadata not found for hash: %s", hash)
+	}
+
+	metadata := files[0]
+	if metadata.Digests, err = r.GetDigests(hash); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// SaveDigest records the digest of blob hash under another algorithm
+func (r *MetadataRepository) SaveDigest(hash, algorithm, value string) error {
+	_, err := r.db.Exec("INSERT OR REPLACE INTO blob_digests (blob_hash, algorithm, digest) VALUES (?, ?, ?)", hash, algorithm, value)
+	return err
+}
+
+// GetDigests returns every known hex digest of blob hash keyed by algorithm,
+// including the one that addresses it
+func (r *MetadataRepository) GetDigests(hash string) (map[string]string, error) {
+	digests := make(map[string]string)
+	if algorithm, sum, err := digest.Parse(hash); err == nil {
+		digests[algorithm.Name] = hex.EncodeToString(sum)
+	}
+
+	rows, err := r.db.Query("SELECT algorithm, digest FROM blob_digests WHERE blob_hash = ?", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var algorithm, value string
+		if err := rows.Scan(&algorithm, &value); err != nil {
+			return nil, err
 		}
+		digests[algorithm] = value
+	}
+
+	return digests, rows.Err()
+}
+
+// FindBlobByDigest returns the blob whose recorded digest under algorithm is value
+func (r *MetadataRepository) FindBlobByDigest(algorithm, value string) (string, error) {
+	var hash string
+	err := r.db.QueryRow("SELECT blob_hash FROM blob_digests WHERE algorithm = ? AND digest = ? LIMIT 1", algorithm, value).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no blob found for %s digest: %s", algorithm, value)
+	}
+	return hash, err
+}
+
+// BlobsMissingDigest returns up to limit blobs that have no recorded digest
+// under algorithm and are not addressed by it
+func (r *MetadataRepository) BlobsMissingDigest(algorithm string, limit int) ([]string, error) {
+	rows, err := r.db.Query(`
+		SELECT hash FROM blobs
+		WHERE algorithm != ?
+		AND NOT EXISTS (SELECT 1 FROM blob_digests WHERE blob_hash = blobs.hash AND algorithm = ?)
+		ORDER BY created_at
+		LIMIT ?`, algorithm, algorithm, limit)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	// Parse JSON fields
-	json.Unmarshal([]byte(tagsJSON), &metadata.Tags)
-	json.Unmarshal([]byte(customFieldsJSON), &metadata.CustomFields)
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
 
-	return &metadata, nil
+	return hashes, rows.Err()
 }
 
-// UpdateMetadata updates file metadata
+// algorithmOf returns the name of the algorithm addressing hash
+func algorithmOf(hash string) string {
+	algorithm, _, err := digest.Parse(hash)
+	if err != nil {
+		return "unknown"
+	}
+	return algorithm.Name
+}
+
+// UpdateMetadata updates object metadata. Objects in the trash are not updated.
 func (r *MetadataRepository) UpdateMetadata(metadata *types.FileMetadata) error {
 	query := `
-	UPDATE files SET
+	UPDATE objects SET
 		file_name = ?, content_type = ?, description = ?,
 		tags = ?, custom_fields = ?, is_public = ?, expires_at = ?,
 		version = version + 1
-	WHERE sha1 = ?
-	`
+	WHERE id = ? AND ` + liveObjects
 
 	tagsJSON, _ := json.Marshal(metadata.Tags)
 	customFieldsJSON, _ := json.Marshal(metadata.CustomFields)
@@ -163,8 +273,8 @@ func (r *MetadataRepository) UpdateMetadata(metadata *types.FileMetadata) error
 		string(tagsJSON),
 		string(customFieldsJSON),
 		metadata.IsPublic,
-		metadata.ExpiresAt,
-		metadata.SHA1,
+		utcTime(metadata.ExpiresAt),
+		metadata.ID,
 	)
 
 	if err != nil {
@@ -177,38 +287,241 @@ func (r *MetadataRepository) UpdateMetadata(metadata *types.FileMetadata) error
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("no metadata found for SHA1: %s", metadata.SHA1)
+		return fmt.Errorf("no metadata found for object: %s", metadata.ID)
 	}
 
 	return nil
 }
 
-// DeleteMetadata deletes file metadata by SHA1
-func (r *MetadataRepository) DeleteMetadata(sha1 string) error {
-	query := "DELETE FROM files WHERE sha1 = ?"
-	result, err := r.db.Exec(query, sha1)
+// DeleteMetadata deletes object metadata by object ID
+func (r *MetadataRepository) DeleteMetadata(id string) error {
+	_, _, err := r.DeleteObject(id)
+	return err
+}
+
+// DeleteObject deletes an object and releases its reference on the blob.
+// The blob row and its content are left for the garbage collector. It returns
+// the blob hash and whether the blob is now unreferenced.
+func (r *MetadataRepository) DeleteObject(id string) (string, bool, error) {
+	hash, unreferenced, err := r.deleteObject(id, "")
+	if err == sql.ErrNoRows {
+		return "", false, fmt.Errorf("no metadata found for object: %s", id)
+	}
+	return hash, unreferenced, err
+}
+
+// deleteObject deletes object id if it also matches condition, in the same
+// transaction, and returns sql.ErrNoRows if it does not
+func (r *MetadataRepository) deleteObject(id, condition string, args ...interface{}) (string, bool, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return "", false, err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	var hash string
+	err = tx.QueryRow("SELECT blob_hash FROM objects WHERE id = ?"+condition, append([]interface{}{id}, args...)...).Scan(&hash)
+	if err != nil {
+		return "", false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM objects WHERE id = ?", id); err != nil {
+		return "", false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM bucket_keys WHERE object_id = ?", id); err != nil {
+		return "", false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM object_versions WHERE object_id = ?", id); err != nil {
+		return "", false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM download_links WHERE object_id = ?", id); err != nil {
+		return "", false, err
+	}
+
+	if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ?", hash); err != nil {
+		return "", false, err
+	}
+
+	var refCount int64
+	if err := tx.QueryRow("SELECT ref_count FROM blobs WHERE hash = ?", hash).Scan(&refCount); err != nil && err != sql.ErrNoRows {
+		return "", false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+
+	return hash, refCount <= 0, nil
+}
+
+// SaveBlobInfo records how blob hash is stored: its codec, its size on disk
+// and the key encrypting it
+func (r *MetadataRepository) SaveBlobInfo(hash string, info *types.BlobInfo) error {
+	storedSize := sql.NullInt64{Int64: info.StoredSize, Valid: info.StoredSize != info.Size}
+	keyID := sql.NullString{String: info.KeyID, Valid: info.KeyID != ""}
+	_, err := r.db.Exec("UPDATE blobs SET codec = ?, stored_size = ?, key_id = ? WHERE hash = ?", info.Codec, storedSize, keyID, hash)
+	return err
+}
+
+// SetBlobKeyID records the key wrapping the data key of blob hash after a rotation
+func (r *MetadataRepository) SetBlobKeyID(hash, keyID string) error {
+	_, err := r.db.Exec("UPDATE blobs SET key_id = ? WHERE hash = ?", keyID, hash)
+	return err
+}
+
+// GetBlobInfo returns the size of blob hash and how it is stored
+func (r *MetadataRepository) GetBlobInfo(hash string) (*types.BlobInfo, error) {
+	info := &types.BlobInfo{}
+	var storedSize sql.NullInt64
+	var keyID sql.NullString
+	err := r.db.QueryRow("SELECT size, codec, stored_size, key_id FROM blobs WHERE hash = ?", hash).Scan(&info.Size, &info.Codec, &storedSize, &keyID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("blob not found: %s", hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.StoredSize = info.Size
+	if storedSize.Valid {
+		info.StoredSize = storedSize.Int64
+	}
+	info.KeyID = keyID.String
+	return info, nil
+}
+
+// BlobRefCount returns the number of objects referencing hash.
+// A blob without a row has no references.
+func (r *MetadataRepository) BlobRefCount(hash string) (int64, error) {
+	var refCount int64
+	err := r.db.QueryRow("SELECT ref_count FROM blobs WHERE hash = ?", hash).Scan(&refCount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return refCount, err
+}
+
+// ForEachReferencedBlob calls fn with the hash of every blob that has at least one reference
+func (r *MetadataRepository) ForEachReferencedBlob(fn func(hash string) error) error {
+	return r.forEachBlob("ref_count > 0", fn)
+}
+
+// ForEachUnreferencedBlob calls fn with the hash of every blob that nothing references
+func (r *MetadataRepository) ForEachUnreferencedBlob(fn func(hash string) error) error {
+	return r.forEachBlob("ref_count <= 0", fn)
+}
+
+// forEachBlob calls fn with the hash of every blob matching where
+func (r *MetadataRepository) forEachBlob(where string, fn func(hash string) error) error {
+	rows, err := r.db.Query("SELECT hash FROM blobs WHERE " + where)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("no metadata found for SHA1: %s", sha1)
+	// Collect first so fn may query the database without holding the cursor open
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
+	for _, hash := range hashes {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// ListFiles returns a list of files with optional filtering
+// DeleteBlobIfUnreferenced removes the blob row for hash if nothing references it.
+// It reports whether a row was removed.
+func (r *MetadataRepository) DeleteBlobIfUnreferenced(hash string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM blobs WHERE hash = ? AND ref_count <= 0", hash)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM blob_digests WHERE blob_hash = ?", hash); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// DeleteByHash deletes a blob together with every object that references it.
+// It returns the number of objects removed.
+func (r *MetadataRepository) DeleteByHash(hash string) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM bucket_keys WHERE object_id IN (SELECT id FROM objects WHERE blob_hash = ?)", hash); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM object_versions WHERE object_id IN (SELECT id FROM objects WHERE blob_hash = ?)", hash); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM download_links WHERE object_id IN (SELECT id FROM objects WHERE blob_hash = ?)", hash); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("DELETE FROM objects WHERE blob_hash = ?", hash)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM blobs WHERE hash = ?", hash); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM blob_digests WHERE blob_hash = ?", hash); err != nil {
+		return 0, err
+	}
+
+	return removed, tx.Commit()
+}
+
+// ListFiles returns a list of objects with optional filtering, leaving out
+// objects in the trash
 func (r *MetadataRepository) ListFiles(filter *types.MetadataFilter) ([]*types.FileMetadata, error) {
-	query := "SELECT sha1, file_name, content_type, size, uploaded_by, uploaded_at, last_accessed, access_count, tags, custom_fields, description, is_public, expires_at, version FROM files WHERE 1=1"
+	query := "SELECT " + objectColumns + " FROM objects WHERE " + liveObjects
 	args := []interface{}{}
 
 	// Add filters
+	if filter.Hash != "" {
+		query += " AND blob_hash = ?"
+		args = append(args, filter.Hash)
+	}
+
 	if filter.FileName != "" {
 		query += " AND file_name LIKE ?"
 		args = append(args, "%"+filter.FileName+"%")
@@ -278,54 +591,74 @@ func (r *MetadataRepository) ListFiles(filter *types.MetadataFilter) ([]*types.F
 
 	var files []*types.FileMetadata
 	for rows.Next() {
-		var metadata types.FileMetadata
-		var tagsJSON, customFieldsJSON string
-
-		err := rows.Scan(
-			&metadata.SHA1,
-			&metadata.FileName,
-			&metadata.ContentType,
-			&metadata.Size,
-			&metadata.UploadedBy,
-			&metadata.UploadedAt,
-			&metadata.LastAccessed,
-			&metadata.AccessCount,
-			&tagsJSON,
-			&customFieldsJSON,
-			&metadata.Description,
-			&metadata.IsPublic,
-			&metadata.ExpiresAt,
-			&metadata.Version,
-		)
-
+		metadata, err := scanObject(rows)
 		if err != nil {
 			return nil, err
 		}
-
-		// Parse JSON fields
-		json.Unmarshal([]byte(tagsJSON), &metadata.Tags)
-		json.Unmarshal([]byte(customFieldsJSON), &metadata.CustomFields)
-
-		files = append(files, &metadata)
+		files = append(files, metadata)
 	}
 
 	return files, rows.Err()
 }
 
-// IncrementAccessCount increments the access count for a file
-func (r *MetadataRepository) IncrementAccessCount(sha1 string) error {
-	query := "UPDATE files SET access_count = access_count + 1, last_accessed = CURRENT_TIMESTAMP WHERE sha1 = ?"
-	_, err := r.db.Exec(query, sha1)
+// IncrementAccessCount increments the access count for an object
+func (r *MetadataRepository) IncrementAccessCount(id string) error {
+	query := "UPDATE objects SET access_count = access_count + 1, last_accessed = CURRENT_TIMESTAMP WHERE id = ?"
+	_, err := r.db.Exec(query, id)
 	return err
 }
 
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanObject reads one row selected with objectColumns
+func scanObject(row rowScanner) (*types.FileMetadata, error) {
+	var metadata types.FileMetadata
+	var tagsJSON, customFieldsJSON string
+
+	err := row.Scan(
+		&metadata.ID,
+		&metadata.Hash,
+		&metadata.FileName,
+		&metadata.ContentType,
+		&metadata.Size,
+		&metadata.UploadedBy,
+		&metadata.APIKeyID,
+		&metadata.UploadedAt,
+		&metadata.LastAccessed,
+		&metadata.AccessCount,
+		&tagsJSON,
+		&customFieldsJSON,
+		&metadata.Description,
+		&metadata.IsPublic,
+		&metadata.ExpiresAt,
+		&metadata.Version,
+		&metadata.RetentionMode,
+		&metadata.RetainUntil,
+		&metadata.LegalHold,
+		&metadata.DeletedAt,
+		&metadata.Tier,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse JSON fields
+	json.Unmarshal([]byte(tagsJSON), &metadata.Tags)
+	json.Unmarshal([]byte(customFieldsJSON), &metadata.CustomFields)
+
+	return &metadata, nil
+}
+
 // GetStats returns database statistics
 func (r *MetadataRepository) GetStats() (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
 	// Total files count
 	var totalFiles int
-	err := r.db.QueryRow("SELECT COUNT(*) FROM files").Scan(&totalFiles)
+	err := r.db.QueryRow("SELECT COUNT(*) FROM objects").Scan(&totalFiles)
 	if err != nil {
 		return nil, err
 	}
@@ -333,7 +666,7 @@ func (r *MetadataRepository) GetStats() (map[string]interface{}, error) {
 
 	// Total storage size
 	var totalSize sql.NullInt64
-	err = r.db.QueryRow("SELECT SUM(size) FROM files").Scan(&totalSize)
+	err = r.db.QueryRow("SELECT SUM(size) FROM objects").Scan(&totalSize)
 	if err != nil {
 		return nil, err
 	}
@@ -343,8 +676,87 @@ func (r *MetadataRepository) GetStats() (map[string]interface{}, error) {
 		stats["total_size"] = 0
 	}
 
+	// Distinct content actually held in storage
+	var uniqueBlobs, unreferencedBlobs int
+	var storedSize sql.NullInt64
+	err = r.db.QueryRow("SELECT COUNT(*), SUM(size), COUNT(CASE WHEN ref_count <= 0 THEN 1 END) FROM blobs").Scan(&uniqueBlobs, &storedSize, &unreferencedBlobs)
+	if err != nil {
+		return nil, err
+	}
+	stats["unique_blobs"] = uniqueBlobs
+	stats["stored_size"] = storedSize.Int64
+	stats["unreferenced_blobs"] = unreferencedBlobs
+
+	// Bytes actually held: whole-file blobs plus each distinct chunk once
+	var chunkedBlobs, uniqueChunks int
+	err = r.db.QueryRow("SELECT COUNT(*) FROM manifests").Scan(&chunkedBlobs)
+	if err != nil {
+		return nil, err
+	}
+	err = r.db.QueryRow("SELECT COUNT(DISTINCT chunk_hash) FROM manifest_chunks").Scan(&uniqueChunks)
+	if err != nil {
+		return nil, err
+	}
+	physicalBytes, err := r.physicalBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	logicalBytes := totalSize.Int64
+	dedupRatio := 1.0
+	if physicalBytes > 0 {
+		dedupRatio = float64(logicalBytes) / float64(physicalBytes)
+	}
+	stats["chunked_blobs"] = chunkedBlobs
+	stats["unique_chunks"] = uniqueChunks
+	stats["logical_bytes"] = logicalBytes
+	stats["physical_bytes"] = physicalBytes
+	stats["dedup_ratio"] = dedupRatio
+
+	// Whole-file blobs stored compressed
+	var compressedBlobs int
+	var compressedSize, compressedStored sql.NullInt64
+	err = r.db.QueryRow("SELECT COUNT(*), SUM(size), SUM(stored_size) FROM blobs WHERE codec != 'none' AND stored_size IS NOT NULL").Scan(&compressedBlobs, &compressedSize, &compressedStored)
+	if err != nil {
+		return nil, err
+	}
+	stats["compressed_blobs"] = compressedBlobs
+	stats["compressed_bytes"] = compressedStored.Int64
+	stats["compression_saved_bytes"] = compressedSize.Int64 - compressedStored.Int64
+
+	// Blobs encrypted at rest, by the key wrapping their data key
+	keyRows, err := r.db.Query("SELECT key_id, COUNT(*) FROM blobs WHERE key_id IS NOT NULL GROUP BY key_id")
+	if err != nil {
+		return nil, err
+	}
+	defer keyRows.Close()
+
+	encryptedBlobs := 0
+	blobsByKey := make(map[string]int)
+	for keyRows.Next() {
+		var keyID string
+		var count int
+		if err := keyRows.Scan(&keyID, &count); err != nil {
+			return nil, err
+		}
+		blobsByKey[keyID] = count
+		encryptedBlobs += count
+	}
+	if err := keyRows.Err(); err != nil {
+		return nil, err
+	}
+	stats["encrypted_blobs"] = encryptedBlobs
+	stats["encrypted_blobs_by_key"] = blobsByKey
+
+	// Referenced content by the storage tier holding it
+	tiers, err := r.CountBlobsByTier()
+	if err != nil {
+		return nil, err
+	}
+	stats["tiers"] = tiers
+
 	// Files by content type
-	rows, err := r.db.Query("SELECT content_type, COUNT(*) FROM files GROUP BY content_type")
+	rows, err := r.db.Query("SELECT content_type, COUNT(*) FROM objects GROUP BY content_type")
 	if err != nil {
 		return nil, err
 	}
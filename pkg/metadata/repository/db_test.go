@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"database/sql"
 	"os"
 	"testing"
 
@@ -22,9 +23,11 @@ func TestMetadataRepository(t *testing.T) {
 	}
 	defer repo.Close()
 
+	var objectID string
+
 	t.Run("SaveAndGetMetadata", func(t *testing.T) {
 		metadata := &types.FileMetadata{
-			SHA1:        "test_sha1_1234567890123456789012345678901234567890",
+			Hash:        "test_sha1_1234567890123456789012345678901234567890",
 			FileName:    "test.txt",
 			ContentType: "text/plain",
 			Size:        10,
@@ -37,8 +40,12 @@ func TestMetadataRepository(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to save metadata: %v", err)
 		}
+		if metadata.ID == "" {
+			t.Fatal("Expected an object ID to be assigned")
+		}
+		objectID = metadata.ID
 
-		retrieved, err := repo.GetMetadata("test_sha1_1234567890123456789012345678901234567890")
+		retrieved, err := repo.GetMetadata(objectID)
 		if err != nil {
 			t.Fatalf("Failed to get metadata: %v", err)
 		}
@@ -50,7 +57,7 @@ func TestMetadataRepository(t *testing.T) {
 
 	t.Run("UpdateMetadata", func(t *testing.T) {
 		metadata := &types.FileMetadata{
-			SHA1:        "test_sha1_1234567890123456789012345678901234567890",
+			ID:          objectID,
 			FileName:    "updated.txt",
 			Description: "Updated description",
 		}
@@ -60,7 +67,7 @@ func TestMetadataRepository(t *testing.T) {
 			t.Fatalf("Failed to update metadata: %v", err)
 		}
 
-		retrieved, err := repo.GetMetadata("test_sha1_1234567890123456789012345678901234567890")
+		retrieved, err := repo.GetMetadata(objectID)
 		if err != nil {
 			t.Fatalf("Failed to get updated metadata: %v", err)
 		}
@@ -81,15 +88,119 @@ func TestMetadataRepository(t *testing.T) {
 		}
 	})
 
+	t.Run("SharedBlob", func(t *testing.T) {
+		hash := "test_sha1_1234567890123456789012345678901234567890"
+		other := &types.FileMetadata{
+			Hash:       hash,
+			FileName:   "copy.txt",
+			Size:       10,
+			UploadedBy: "other_user",
+		}
+		if err := repo.SaveMetadata(other); err != nil {
+			t.Fatalf("Failed to save second object: %v", err)
+		}
+
+		original, err := repo.GetMetadata(objectID)
+		if err != nil {
+			t.Fatalf("Failed to get original metadata: %v", err)
+		}
+		if original.FileName != "updated.txt" {
+			t.Errorf("Original object was overwritten, file name is %s", original.FileName)
+		}
+
+		objects, err := repo.ListFiles(&types.MetadataFilter{Hash: hash})
+		if err != nil {
+			t.Fatalf("Failed to list by hash: %v", err)
+		}
+		if len(objects) != 2 {
+			t.Fatalf("Expected 2 objects for hash, got %d", len(objects))
+		}
+
+		stats, err := repo.GetStats()
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		if stats["total_files"] != 2 || stats["unique_blobs"] != 1 {
+			t.Errorf("Unexpected stats: %v", stats)
+		}
+
+		hashOut, orphaned, err := repo.DeleteObject(other.ID)
+		if err != nil {
+			t.Fatalf("Failed to delete object: %v", err)
+		}
+		if hashOut != hash || orphaned {
+			t.Errorf("Blob should still be referenced, got hash=%s orphaned=%v", hashOut, orphaned)
+		}
+	})
+
 	t.Run("DeleteMetadata", func(t *testing.T) {
-		err := repo.DeleteMetadata("test_sha1_1234567890123456789012345678901234567890")
+		err := repo.DeleteMetadata(objectID)
 		if err != nil {
 			t.Fatalf("Failed to delete metadata: %v", err)
 		}
 
-		_, err = repo.GetMetadata("test_sha1_1234567890123456789012345678901234567890")
+		_, err = repo.GetMetadata(objectID)
 		if err == nil {
 			t.Error("Expected error when getting deleted metadata")
 		}
 	})
-}
\ No newline at end of file
+}
+func TestLegacyFilesMigration(t *testing.T) {
+	tempDB, err := os.CreateTemp("", "test_legacy.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp database: %v", err)
+	}
+	defer os.Remove(tempDB.Name())
+	defer tempDB.Close()
+
+	db, err := sql.Open("sqlite", tempDB.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+	CREATE TABLE files (
+		sha1 TEXT PRIMARY KEY,
+		file_name TEXT NOT NULL,
+		content_type TEXT,
+		size INTEGER NOT NULL,
+		uploaded_by TEXT,
+		uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_accessed DATETIME DEFAULT CURRENT_TIMESTAMP,
+		access_count INTEGER DEFAULT 1,
+		tags TEXT,
+		custom_fields TEXT,
+		description TEXT,
+		is_public BOOLEAN DEFAULT FALSE,
+		expires_at DATETIME,
+		version INTEGER DEFAULT 1
+	);
+	INSERT INTO files (sha1, file_name, content_type, size, uploaded_by, tags, custom_fields, description)
+	VALUES ('legacy_sha1', 'legacy.txt', 'text/plain', 5, 'someone', 'null', 'null', '');
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create legacy table: %v", err)
+	}
+
+	repo, err := NewMetadataRepository(tempDB.Name())
+	if err != nil {
+		t.Fatalf("Failed to open legacy database: %v", err)
+	}
+	defer repo.Close()
+
+	metadata, err := repo.GetMetadataByHash("legacy_sha1")
+	if err != nil {
+		t.Fatalf("Legacy row was not migrated: %v", err)
+	}
+	if metadata.ID == "" || metadata.FileName != "legacy.txt" {
+		t.Errorf("Unexpected migrated object: %+v", metadata)
+	}
+
+	refs, err := repo.BlobRefCount("legacy_sha1")
+	if err != nil {
+		t.Fatalf("Failed to get ref count: %v", err)
+	}
+	if refs != 1 {
+		t.Errorf("Expected migrated blob to have 1 reference, got %d", refs)
+	}
+}
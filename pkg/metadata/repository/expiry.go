@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// expiryRecordColumns lists the expiry_audit columns in the order scanExpiryRecord expects
+const expiryRecordColumns = `id, object_id, blob_hash, file_name, size, expires_at, deleted_at`
+
+// ListExpiredObjects returns up to limit objects whose expiry time is at or
+// before now, those that expired first first. Objects still locked by
+// retention or a legal hold are left out, as they may not be deleted yet, and
+// so are objects already in the trash.
+func (r *MetadataRepository) ListExpiredObjects(now time.Time, limit int) ([]*types.FileMetadata, error) {
+	query := "SELECT " + objectColumns + " FROM objects WHERE expires_at IS NOT NULL AND expires_at <= ?" +
+		" AND " + liveObjects + " AND NOT " + lockedObjects + " ORDER BY expires_at LIMIT ?"
+
+	rows, err := r.db.Query(query, now.UTC(), now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*types.FileMetadata{}
+	for rows.Next() {
+		metadata, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, metadata)
+	}
+
+	return files, rows.Err()
+}
+
+// CountObjectsByExpiry counts the objects referencing blob hash that are
+// live and those that have expired at now. Objects in the trash count as neither.
+func (r *MetadataRepository) CountObjectsByExpiry(hash string, now time.Time) (live, expired int, err error) {
+	err = r.db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE expires_at IS NULL OR expires_at > ?),
+			COUNT(*) FILTER (WHERE expires_at <= ?)
+		FROM objects WHERE blob_hash = ? AND `+liveObjects, now.UTC(), now.UTC(), hash).Scan(&live, &expired)
+	return live, expired, err
+}
+
+// SaveExpiryRecord records that an object was deleted because it expired,
+// setting the record's ID
+func (r *MetadataRepository) SaveExpiryRecord(record *types.ExpiryRecord) error {
+	result, err := r.db.Exec(`
+		INSERT INTO expiry_audit (object_id, blob_hash, file_name, size, expires_at, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		record.ObjectID, record.Hash, record.FileName, record.Size, record.ExpiresAt.UTC(), record.DeletedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	record.ID, err = result.LastInsertId()
+	return err
+}
+
+// ListExpiryRecords returns up to limit of the most recent expiry audit records, newest first
+func (r *MetadataRepository) ListExpiryRecords(limit int) ([]*types.ExpiryRecord, error) {
+	query := "SELECT " + expiryRecordColumns + " FROM expiry_audit ORDER BY id DESC LIMIT ?"
+
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*types.ExpiryRecord{}
+	for rows.Next() {
+		record, err := scanExpiryRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// scanExpiryRecord reads a row selected with expiryRecordColumns
+func scanExpiryRecord(row rowScanner) (*types.ExpiryRecord, error) {
+	var record types.ExpiryRecord
+
+	err := row.Scan(&record.ID, &record.ObjectID, &record.Hash, &record.FileName, &record.Size,
+		&record.ExpiresAt, &record.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// utcTime returns t in UTC for storing, or nil if t is not set
+func utcTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
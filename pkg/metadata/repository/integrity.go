@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// integrityCheckColumns lists the integrity_checks columns in the order scanIntegrityCheck expects
+const integrityCheckColumns = `store, hash, status, detail, checked_at, verified_at`
+
+// RecordIntegrityCheck saves the outcome of scrubbing a blob or chunk,
+// replacing the previous one. A check without VerifiedAt keeps the last time
+// the content was found intact.
+func (r *MetadataRepository) RecordIntegrityCheck(check *types.IntegrityCheck) error {
+	var verifiedAt interface{}
+	if check.VerifiedAt != nil {
+		verifiedAt = check.VerifiedAt.UTC()
+	}
+
+	_, err := r.db.Exec(`
+		INSERT INTO integrity_checks (`+integrityCheckColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (store, hash) DO UPDATE SET
+			status = excluded.status,
+			detail = excluded.detail,
+			checked_at = excluded.checked_at,
+			verified_at = COALESCE(excluded.verified_at, integrity_checks.verified_at)`,
+		check.Store, check.Hash, check.Status, check.Detail, check.CheckedAt.UTC(), verifiedAt)
+	return err
+}
+
+// GetIntegrityCheck returns the last integrity check of a blob or chunk, or
+// nil if it has not been scrubbed
+func (r *MetadataRepository) GetIntegrityCheck(store, hash string) (*types.IntegrityCheck, error) {
+	query := "SELECT " + integrityCheckColumns + " FROM integrity_checks WHERE store = ? AND hash = ?"
+
+	check, err := scanIntegrityCheck(r.db.QueryRow(query, store, hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// ListIntegrityChecks returns the last integrity checks, optionally only
+// those of one store and with one status
+func (r *MetadataRepository) ListIntegrityChecks(store, status string) ([]*types.IntegrityCheck, error) {
+	query := "SELECT " + integrityCheckColumns + " FROM integrity_checks WHERE 1=1"
+	args := []interface{}{}
+	if store != "" {
+		query += " AND store = ?"
+		args = append(args, store)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY checked_at DESC"
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := []*types.IntegrityCheck{}
+	for rows.Next() {
+		check, err := scanIntegrityCheck(rows)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, rows.Err()
+}
+
+// DeleteIntegrityCheck forgets the integrity check of a blob or chunk that is
+// no longer stored
+func (r *MetadataRepository) DeleteIntegrityCheck(store, hash string) error {
+	_, err := r.db.Exec("DELETE FROM integrity_checks WHERE store = ? AND hash = ?", store, hash)
+	return err
+}
+
+// GetIntegritySummary counts the last integrity checks by status
+func (r *MetadataRepository) GetIntegritySummary() (*types.IntegritySummary, error) {
+	summary := &types.IntegritySummary{}
+	err := r.db.QueryRow(`
+		SELECT COUNT(*),
+			COUNT(CASE WHEN status = ? THEN 1 END),
+			COUNT(CASE WHEN status = ? THEN 1 END),
+			COUNT(CASE WHEN status = ? THEN 1 END)
+		FROM integrity_checks`,
+		types.IntegrityOK, types.IntegrityCorrupt, types.IntegrityRepaired,
+	).Scan(&summary.Checked, &summary.OK, &summary.Corrupt, &summary.Repaired)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aggregates lose the column type, so the extremes are read as rows
+	var lastChecked, oldestVerified time.Time
+	err = r.db.QueryRow("SELECT checked_at FROM integrity_checks ORDER BY checked_at DESC LIMIT 1").Scan(&lastChecked)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		summary.LastCheckedAt = &lastChecked
+	}
+
+	err = r.db.QueryRow("SELECT verified_at FROM integrity_checks WHERE verified_at IS NOT NULL ORDER BY verified_at LIMIT 1").Scan(&oldestVerified)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		summary.OldestVerifiedAt = &oldestVerified
+	}
+
+	return summary, nil
+}
+
+// scanIntegrityCheck reads an integrity_checks row selected with integrityCheckColumns
+func scanIntegrityCheck(row rowScanner) (*types.IntegrityCheck, error) {
+	var check types.IntegrityCheck
+	var verifiedAt sql.NullTime
+
+	err := row.Scan(&check.Store, &check.Hash, &check.Status, &check.Detail, &check.CheckedAt, &verifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	if verifiedAt.Valid {
+		check.VerifiedAt = &verifiedAt.Time
+	}
+
+	return &check, nil
+}
@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// lifecycleRuleColumns lists the lifecycle_rules columns in the order scanLifecycleRule expects
+const lifecycleRuleColumns = `id, disabled, tags, content_type, bucket, prefix, min_size, max_size, age_days, idle_days,
+	action, backend, codec, source, created_at, updated_at`
+
+// SaveLifecycleRule creates or replaces a lifecycle rule. A replaced rule
+// keeps the time it was created.
+func (r *MetadataRepository) SaveLifecycleRule(rule *types.LifecycleRule) error {
+	tags := rule.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(`
+		INSERT INTO lifecycle_rules (`+lifecycleRuleColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			disabled = excluded.disabled, tags = excluded.tags, content_type = excluded.content_type,
+			bucket = excluded.bucket, prefix = excluded.prefix, min_size = excluded.min_size,
+			max_size = excluded.max_size, age_days = excluded.age_days, idle_days = excluded.idle_days,
+			action = excluded.action, backend = excluded.backend, codec = excluded.codec,
+			source = excluded.source, updated_at = excluded.updated_at`,
+		rule.ID, rule.Disabled, string(tagsJSON), rule.ContentType, rule.Bucket, rule.Prefix,
+		rule.MinSize, rule.MaxSize, rule.AgeDays, rule.IdleDays,
+		rule.Action, rule.Backend, rule.Codec, rule.Source, rule.CreatedAt.UTC(), rule.UpdatedAt.UTC())
+	return err
+}
+
+// GetLifecycleRule returns the lifecycle rule called id, or nil if there is none
+func (r *MetadataRepository) GetLifecycleRule(id string) (*types.LifecycleRule, error) {
+	query := "SELECT " + lifecycleRuleColumns + " FROM lifecycle_rules WHERE id = ?"
+
+	rule, err := scanLifecycleRule(r.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// ListLifecycleRules returns every lifecycle rule, by ID
+func (r *MetadataRepository) ListLifecycleRules() ([]*types.LifecycleRule, error) {
+	rows, err := r.db.Query("SELECT " + lifecycleRuleColumns + " FROM lifecycle_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*types.LifecycleRule{}
+	for rows.Next() {
+		rule, err := scanLifecycleRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// DeleteLifecycleRule removes the lifecycle rule called id and reports whether there was one
+func (r *MetadataRepository) DeleteLifecycleRule(id string) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM lifecycle_rules WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+// ListLifecycleMatches returns up to limit objects with an ID after the
+// given one that meet every condition of rule at now, by ID. Objects the
+// rule's action has already been applied to are left out where the database
+// can tell: expired objects for expire, private ones for private, and those
+// whose content is stored with the rule's codec for compress. Objects in the
+// trash are left out too.
+func (r *MetadataRepository) ListLifecycleMatches(rule *types.LifecycleRule, now time.Time, after string, limit int) ([]*types.FileMetadata, error) {
+	var conditions []string
+	args := []interface{}{}
+
+	conditions = append(conditions, "o.id > ?", "o."+liveObjects)
+	args = append(args, after)
+
+	for _, tag := range rule.Tags {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(o.tags) WHERE json_each.value = ?)")
+		args = append(args, tag)
+	}
+	if rule.ContentType != "" {
+		if strings.HasSuffix(rule.ContentType, "/") {
+			conditions = append(conditions, "substr(o.content_type, 1, length(?)) = ?")
+			args = append(args, rule.ContentType, rule.ContentType)
+		} else {
+			conditions = append(conditions, "o.content_type = ?")
+			args = append(args, rule.ContentType)
+		}
+	}
+	if rule.Bucket != "" || rule.Prefix != "" {
+		keyCondition := "k.object_id = o.id AND substr(k.object_key, 1, length(?)) = ?"
+		keyArgs := []interface{}{rule.Prefix, rule.Prefix}
+		if rule.Bucket != "" {
+			keyCondition += " AND k.bucket = ?"
+			keyArgs = append(keyArgs, rule.Bucket)
+		}
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM bucket_keys k WHERE "+keyCondition+")")
+		args = append(args, keyArgs...)
+	}
+	if rule.MinSize > 0 {
+		conditions = append(conditions, "o.size >= ?")
+		args = append(args, rule.MinSize)
+	}
+	if rule.MaxSize > 0 {
+		conditions = append(conditions, "o.size <= ?")
+		args = append(args, rule.MaxSize)
+	}
+	if rule.AgeDays > 0 {
+		conditions = append(conditions, "o.uploaded_at <= ?")
+		args = append(args, now.AddDate(0, 0, -rule.AgeDays).UTC())
+	}
+	if rule.IdleDays > 0 {
+		conditions = append(conditions, "o.last_accessed <= ?")
+		args = append(args, now.AddDate(0, 0, -rule.IdleDays).UTC())
+	}
+
+	switch rule.Action {
+	case types.LifecycleExpire:
+		conditions = append(conditions, "(o.expires_at IS NULL OR o.expires_at > ?)")
+		args = append(args, now.UTC())
+	case types.LifecyclePrivate:
+		conditions = append(conditions, "o.is_public")
+	case types.LifecycleCompress:
+		conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM blobs b WHERE b.hash = o.blob_hash AND b.codec = ?)")
+		args = append(args, rule.Codec)
+	}
+
+	query := "SELECT " + objectColumns + " FROM objects o WHERE " +
+		strings.Join(conditions, " AND ") + " ORDER BY o.id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*types.FileMetadata{}
+	for rows.Next() {
+		metadata, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, metadata)
+	}
+
+	return files, rows.Err()
+}
+
+// ExpireObject sets the expiry time of the object identified by id to at,
+// unless it already expires earlier, and reports whether it was changed
+func (r *MetadataRepository) ExpireObject(id string, at time.Time) (bool, error) {
+	result, err := r.db.Exec("UPDATE objects SET expires_at = ? WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)",
+		at.UTC(), id, at.UTC())
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// SetObjectPrivate strips public access from the object identified by id and
+// reports whether it was public
+func (r *MetadataRepository) SetObjectPrivate(id string) (bool, error) {
+	result, err := r.db.Exec("UPDATE objects SET is_public = FALSE WHERE id = ? AND is_public", id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// scanLifecycleRule reads a row selected with lifecycleRuleColumns
+func scanLifecycleRule(row rowScanner) (*types.LifecycleRule, error) {
+	var rule types.LifecycleRule
+	var tagsJSON string
+
+	err := row.Scan(&rule.ID, &rule.Disabled, &tagsJSON, &rule.ContentType, &rule.Bucket, &rule.Prefix,
+		&rule.MinSize, &rule.MaxSize, &rule.AgeDays, &rule.IdleDays,
+		&rule.Action, &rule.Backend, &rule.Codec, &rule.Source, &rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(tagsJSON), &rule.Tags); err != nil {
+		return nil, fmt.Errorf("invalid tags of lifecycle rule %s: %w", rule.ID, err)
+	}
+	return &rule, nil
+}
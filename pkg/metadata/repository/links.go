@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// downloadLinkColumns lists the download_links columns in the order scanDownloadLink expects
+const downloadLinkColumns = `id, object_id, file_name, inline, max_downloads, downloads, allowed_ip, created_by, created_at, expires_at, revoked_at`
+
+// SaveDownloadLink records a new download link
+func (r *MetadataRepository) SaveDownloadLink(link *types.DownloadLink) error {
+	var revokedAt interface{}
+	if link.RevokedAt != nil {
+		revokedAt = link.RevokedAt.UTC()
+	}
+
+	query := "INSERT INTO download_links (" + downloadLinkColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(query,
+		link.ID,
+		link.ObjectID,
+		link.FileName,
+		link.Inline,
+		link.MaxDownloads,
+		link.Downloads,
+		link.AllowedIP,
+		link.CreatedBy,
+		link.CreatedAt.UTC(),
+		link.ExpiresAt.UTC(),
+		revokedAt,
+	)
+	return err
+}
+
+// GetDownloadLink returns the download link with id, or nil if there is none
+func (r *MetadataRepository) GetDownloadLink(id string) (*types.DownloadLink, error) {
+	query := "SELECT " + downloadLinkColumns + " FROM download_links WHERE id = ?"
+
+	link, err := scanDownloadLink(r.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// ListDownloadLinks returns the download links of an object, or of every
+// object if objectID is empty, newest first
+func (r *MetadataRepository) ListDownloadLinks(objectID string) ([]*types.DownloadLink, error) {
+	query := "SELECT " + downloadLinkColumns + " FROM download_links"
+	args := []interface{}{}
+	if objectID != "" {
+		query += " WHERE object_id = ?"
+		args = append(args, objectID)
+	}
+	query += " ORDER BY created_at DESC, id"
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*types.DownloadLink{}
+	for rows.Next() {
+		link, err := scanDownloadLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// RevokeDownloadLink marks a download link revoked at the given time. It
+// reports false if there is no such link or it was already revoked.
+func (r *MetadataRepository) RevokeDownloadLink(id string, at time.Time) (bool, error) {
+	result, err := r.db.Exec("UPDATE download_links SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", at.UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return revoked > 0, nil
+}
+
+// ClaimDownload counts a download through a link, provided the link is not
+// revoked, has not expired by now and has downloads left. It reports whether
+// the download was counted, so concurrent requests cannot exceed the limit.
+func (r *MetadataRepository) ClaimDownload(id string, now time.Time) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE download_links SET downloads = downloads + 1
+		WHERE id = ? AND revoked_at IS NULL AND expires_at > ?
+			AND (max_downloads = 0 OR downloads < max_downloads)`,
+		id, now.UTC())
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return claimed > 0, nil
+}
+
+// scanDownloadLink reads a download_links row selected with downloadLinkColumns
+func scanDownloadLink(row rowScanner) (*types.DownloadLink, error) {
+	var link types.DownloadLink
+	var revokedAt sql.NullTime
+
+	err := row.Scan(&link.ID, &link.ObjectID, &link.FileName, &link.Inline, &link.MaxDownloads, &link.Downloads,
+		&link.AllowedIP, &link.CreatedBy, &link.CreatedAt, &link.ExpiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		link.RevokedAt = &revokedAt.Time
+	}
+
+	return &link, nil
+}
@@ -0,0 +1,22 @@
+-- The first schema: one row per stored file, keyed by the SHA1 of its content
+CREATE TABLE IF NOT EXISTS files (
+	sha1 TEXT PRIMARY KEY,
+	file_name TEXT NOT NULL,
+	content_type TEXT,
+	size INTEGER NOT NULL,
+	uploaded_by TEXT,
+	uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_accessed DATETIME DEFAULT CURRENT_TIMESTAMP,
+	access_count INTEGER DEFAULT 1,
+	tags TEXT, -- JSON array
+	custom_fields TEXT, -- JSON object
+	description TEXT,
+	is_public BOOLEAN DEFAULT FALSE,
+	expires_at DATETIME,
+	version INTEGER DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_uploaded_at ON files(uploaded_at);
+CREATE INDEX IF NOT EXISTS idx_files_file_name ON files(file_name);
+CREATE INDEX IF NOT EXISTS idx_files_content_type ON files(content_type);
+CREATE INDEX IF NOT EXISTS idx_files_is_public ON files(is_public);
@@ -0,0 +1,38 @@
+-- Back to one row per file: each blob keeps the live object uploaded to it
+-- last. Other objects are lost.
+CREATE TABLE IF NOT EXISTS files (
+	sha1 TEXT PRIMARY KEY,
+	file_name TEXT NOT NULL,
+	content_type TEXT,
+	size INTEGER NOT NULL,
+	uploaded_by TEXT,
+	uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_accessed DATETIME DEFAULT CURRENT_TIMESTAMP,
+	access_count INTEGER DEFAULT 1,
+	tags TEXT, -- JSON array
+	custom_fields TEXT, -- JSON object
+	description TEXT,
+	is_public BOOLEAN DEFAULT FALSE,
+	expires_at DATETIME,
+	version INTEGER DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_uploaded_at ON files(uploaded_at);
+CREATE INDEX IF NOT EXISTS idx_files_file_name ON files(file_name);
+CREATE INDEX IF NOT EXISTS idx_files_content_type ON files(content_type);
+CREATE INDEX IF NOT EXISTS idx_files_is_public ON files(is_public);
+
+INSERT OR IGNORE INTO files (
+	sha1, file_name, content_type, size, uploaded_by, uploaded_at,
+	last_accessed, access_count, tags, custom_fields, description,
+	is_public, expires_at, version
+)
+SELECT
+	blob_hash, file_name, content_type, size, uploaded_by, uploaded_at,
+	last_accessed, access_count, tags, custom_fields, description,
+	is_public, expires_at, version
+FROM objects WHERE deleted_at IS NULL
+ORDER BY uploaded_at DESC, id;
+
+DROP TABLE objects;
+DROP TABLE blobs;
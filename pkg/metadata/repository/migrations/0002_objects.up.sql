@@ -0,0 +1,73 @@
+-- Content and names are kept apart: a blob row exists once per distinct hash,
+-- while every upload gets its own object row pointing at a blob. Two uploads of
+-- identical bytes therefore share storage but keep their own names and owners.
+
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	algorithm TEXT NOT NULL DEFAULT 'sha1',
+	size INTEGER NOT NULL,
+	ref_count INTEGER NOT NULL DEFAULT 0,
+	codec TEXT NOT NULL DEFAULT 'none',
+	stored_size INTEGER, -- bytes on disk, NULL when stored as is
+	key_id TEXT, -- master key wrapping the data key, NULL when not encrypted
+	tier TEXT NOT NULL DEFAULT 'hot', -- storage tier: hot, demoting or cold
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_blobs_ref_count ON blobs(ref_count);
+CREATE INDEX IF NOT EXISTS idx_blobs_tier ON blobs(tier);
+
+CREATE TABLE IF NOT EXISTS objects (
+	id TEXT PRIMARY KEY,
+	blob_hash TEXT NOT NULL REFERENCES blobs(hash),
+	file_name TEXT NOT NULL,
+	content_type TEXT,
+	size INTEGER NOT NULL,
+	uploaded_by TEXT,
+	api_key_id TEXT NOT NULL DEFAULT '', -- fingerprint of the API key used to upload
+	uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_accessed DATETIME DEFAULT CURRENT_TIMESTAMP,
+	access_count INTEGER DEFAULT 1,
+	tags TEXT, -- JSON array
+	custom_fields TEXT, -- JSON object
+	description TEXT,
+	is_public BOOLEAN DEFAULT FALSE,
+	expires_at DATETIME,
+	version INTEGER DEFAULT 1,
+	retention_mode TEXT NOT NULL DEFAULT '', -- governance or compliance, empty without retention
+	retain_until DATETIME,
+	legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+	deleted_at DATETIME -- when the object was moved to the trash, NULL while live
+);
+
+CREATE INDEX IF NOT EXISTS idx_objects_blob_hash ON objects(blob_hash);
+CREATE INDEX IF NOT EXISTS idx_objects_uploaded_at ON objects(uploaded_at);
+CREATE INDEX IF NOT EXISTS idx_objects_file_name ON objects(file_name);
+CREATE INDEX IF NOT EXISTS idx_objects_content_type ON objects(content_type);
+CREATE INDEX IF NOT EXISTS idx_objects_is_public ON objects(is_public);
+CREATE INDEX IF NOT EXISTS idx_objects_uploaded_by ON objects(uploaded_by);
+CREATE INDEX IF NOT EXISTS idx_objects_expires_at ON objects(expires_at);
+CREATE INDEX IF NOT EXISTS idx_objects_api_key_id ON objects(api_key_id);
+CREATE INDEX IF NOT EXISTS idx_objects_deleted_at ON objects(deleted_at);
+
+-- Each file becomes one object with a random (version 4) UUID, and its content a blob
+INSERT OR IGNORE INTO blobs (hash, size, created_at) SELECT sha1, size, uploaded_at FROM files;
+
+INSERT INTO objects (
+	id, blob_hash, file_name, content_type, size, uploaded_by, uploaded_at,
+	last_accessed, access_count, tags, custom_fields, description,
+	is_public, expires_at, version
+)
+SELECT
+	lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' ||
+		substr(lower(hex(randomblob(2))), 2) || '-' ||
+		substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' ||
+		lower(hex(randomblob(6))),
+	sha1, file_name, content_type, size, uploaded_by, uploaded_at,
+	last_accessed, access_count, tags, custom_fields, description,
+	is_public, expires_at, version
+FROM files;
+
+UPDATE blobs SET ref_count = (SELECT COUNT(*) FROM objects WHERE blob_hash = blobs.hash);
+
+DROP TABLE files;
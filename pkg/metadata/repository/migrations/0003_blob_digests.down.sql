@@ -0,0 +1 @@
+DROP TABLE blob_digests;
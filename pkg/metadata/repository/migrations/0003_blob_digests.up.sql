@@ -0,0 +1,9 @@
+-- Digests of a blob under algorithms other than the one that addresses it
+CREATE TABLE IF NOT EXISTS blob_digests (
+	blob_hash TEXT NOT NULL REFERENCES blobs(hash),
+	algorithm TEXT NOT NULL,
+	digest TEXT NOT NULL,
+	PRIMARY KEY (blob_hash, algorithm)
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_digests_digest ON blob_digests(algorithm, digest);
@@ -0,0 +1,2 @@
+DROP TABLE manifest_chunks;
+DROP TABLE manifests;
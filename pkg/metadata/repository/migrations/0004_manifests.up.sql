@@ -0,0 +1,18 @@
+-- Content stored as content-defined chunks instead of a single file
+CREATE TABLE IF NOT EXISTS manifests (
+	blob_hash TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	chunk_count INTEGER NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS manifest_chunks (
+	blob_hash TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	chunk_hash TEXT NOT NULL,
+	chunk_offset INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	PRIMARY KEY (blob_hash, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_manifest_chunks_chunk_hash ON manifest_chunks(chunk_hash);
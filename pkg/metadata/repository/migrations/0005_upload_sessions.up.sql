@@ -0,0 +1,14 @@
+-- Resumable uploads in progress, and finalized ones until they expire
+CREATE TABLE IF NOT EXISTS upload_sessions (
+	id TEXT PRIMARY KEY,
+	upload_length INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	metadata TEXT, -- JSON object
+	object_id TEXT,
+	hash TEXT,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at);
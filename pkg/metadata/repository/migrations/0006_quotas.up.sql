@@ -0,0 +1,9 @@
+-- Limits on what is stored, globally, per uploader and per API key
+CREATE TABLE IF NOT EXISTS quotas (
+	scope TEXT NOT NULL,
+	subject TEXT NOT NULL DEFAULT '',
+	max_bytes INTEGER NOT NULL DEFAULT 0,
+	max_objects INTEGER NOT NULL DEFAULT 0,
+	updated_at DATETIME NOT NULL,
+	PRIMARY KEY (scope, subject)
+);
@@ -0,0 +1 @@
+DROP TABLE integrity_checks;
@@ -0,0 +1,12 @@
+-- Latest scrub of each stored blob and chunk
+CREATE TABLE IF NOT EXISTS integrity_checks (
+	store TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	status TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	checked_at DATETIME NOT NULL,
+	verified_at DATETIME,
+	PRIMARY KEY (store, hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_integrity_checks_status ON integrity_checks(status);
@@ -0,0 +1,17 @@
+-- Moves of stored content from one storage backend to another
+CREATE TABLE IF NOT EXISTS storage_migrations (
+	id TEXT PRIMARY KEY,
+	source TEXT NOT NULL,
+	target TEXT NOT NULL,
+	status TEXT NOT NULL,
+	blobs_total INTEGER NOT NULL DEFAULT 0,
+	bytes_total INTEGER NOT NULL DEFAULT 0,
+	blobs_moved INTEGER NOT NULL DEFAULT 0,
+	bytes_moved INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	started_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL,
+	finished_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_storage_migrations_status ON storage_migrations(status);
@@ -0,0 +1,3 @@
+DROP TABLE object_versions;
+DROP TABLE bucket_keys;
+DROP TABLE buckets;
@@ -0,0 +1,33 @@
+-- Buckets and the objects stored under keys in them
+CREATE TABLE IF NOT EXISTS buckets (
+	name TEXT PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	max_versions INTEGER NOT NULL DEFAULT 0,
+	retention_mode TEXT NOT NULL DEFAULT '', -- default retention of objects written to the bucket
+	retention_days INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS bucket_keys (
+	bucket TEXT NOT NULL REFERENCES buckets(name),
+	object_key TEXT NOT NULL,
+	object_id TEXT NOT NULL REFERENCES objects(id),
+	etag TEXT NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1, -- the current version in object_versions
+	modified_at DATETIME NOT NULL,
+	PRIMARY KEY (bucket, object_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bucket_keys_object_id ON bucket_keys(object_id);
+
+-- Every version of the object stored under a key, the current one included
+CREATE TABLE IF NOT EXISTS object_versions (
+	bucket TEXT NOT NULL REFERENCES buckets(name),
+	object_key TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	object_id TEXT NOT NULL REFERENCES objects(id),
+	etag TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (bucket, object_key, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_object_versions_object_id ON object_versions(object_id);
@@ -0,0 +1,23 @@
+-- S3 multipart uploads in progress and their parts, staged on disk until completed
+CREATE TABLE IF NOT EXISTS multipart_uploads (
+	id TEXT PRIMARY KEY,
+	bucket TEXT NOT NULL,
+	object_key TEXT NOT NULL,
+	content_type TEXT NOT NULL DEFAULT '',
+	metadata TEXT, -- JSON object
+	initiator TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_multipart_uploads_key ON multipart_uploads(bucket, object_key);
+CREATE INDEX IF NOT EXISTS idx_multipart_uploads_updated_at ON multipart_uploads(updated_at);
+
+CREATE TABLE IF NOT EXISTS multipart_parts (
+	upload_id TEXT NOT NULL,
+	part_number INTEGER NOT NULL,
+	etag TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	modified_at DATETIME NOT NULL,
+	PRIMARY KEY (upload_id, part_number)
+);
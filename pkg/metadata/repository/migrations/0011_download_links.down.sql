@@ -0,0 +1 @@
+DROP TABLE download_links;
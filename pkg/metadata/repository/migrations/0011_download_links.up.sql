@@ -0,0 +1,17 @@
+-- Signed links serving an object without an API key
+CREATE TABLE IF NOT EXISTS download_links (
+	id TEXT PRIMARY KEY,
+	object_id TEXT NOT NULL REFERENCES objects(id),
+	file_name TEXT NOT NULL DEFAULT '',
+	inline BOOLEAN NOT NULL DEFAULT FALSE,
+	max_downloads INTEGER NOT NULL DEFAULT 0,
+	downloads INTEGER NOT NULL DEFAULT 0,
+	allowed_ip TEXT NOT NULL DEFAULT '',
+	created_by TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	revoked_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_download_links_object_id ON download_links(object_id);
+CREATE INDEX IF NOT EXISTS idx_download_links_expires_at ON download_links(expires_at);
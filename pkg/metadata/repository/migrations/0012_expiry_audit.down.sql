@@ -0,0 +1 @@
+DROP TABLE expiry_audit;
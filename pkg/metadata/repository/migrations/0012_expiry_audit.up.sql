@@ -0,0 +1,12 @@
+-- Audit trail of objects deleted because they expired
+CREATE TABLE IF NOT EXISTS expiry_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	object_id TEXT NOT NULL,
+	blob_hash TEXT NOT NULL,
+	file_name TEXT NOT NULL DEFAULT '',
+	size INTEGER NOT NULL DEFAULT 0,
+	expires_at DATETIME NOT NULL,
+	deleted_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_expiry_audit_deleted_at ON expiry_audit(deleted_at);
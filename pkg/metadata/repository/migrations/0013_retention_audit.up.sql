@@ -0,0 +1,13 @@
+-- Audit trail of changes to objects made by bypassing retention or releasing a legal hold
+CREATE TABLE IF NOT EXISTS retention_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	object_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL DEFAULT '',
+	retention_mode TEXT NOT NULL DEFAULT '',
+	retain_until DATETIME,
+	legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_retention_audit_object_id ON retention_audit(object_id);
@@ -0,0 +1 @@
+DROP TABLE lifecycle_rules;
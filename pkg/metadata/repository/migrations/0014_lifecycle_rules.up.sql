@@ -0,0 +1,19 @@
+-- Lifecycle rules, declared in configuration or through the API
+CREATE TABLE IF NOT EXISTS lifecycle_rules (
+	id TEXT PRIMARY KEY,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	tags TEXT NOT NULL DEFAULT '[]', -- JSON array
+	content_type TEXT NOT NULL DEFAULT '',
+	bucket TEXT NOT NULL DEFAULT '',
+	prefix TEXT NOT NULL DEFAULT '',
+	min_size INTEGER NOT NULL DEFAULT 0,
+	max_size INTEGER NOT NULL DEFAULT 0,
+	age_days INTEGER NOT NULL DEFAULT 0,
+	idle_days INTEGER NOT NULL DEFAULT 0,
+	action TEXT NOT NULL,
+	backend TEXT NOT NULL DEFAULT '',
+	codec TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
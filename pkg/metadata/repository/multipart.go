@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// ErrMultipartUploadNotFound is returned for parts of an upload that does not exist
+var ErrMultipartUploadNotFound = errors.New("multipart upload not found")
+
+// multipartUploadColumns lists the multipart_uploads columns in the order scanMultipartUpload expects
+const multipartUploadColumns = `id, bucket, object_key, content_type, metadata, initiator, created_at, updated_at`
+
+// multipartPartColumns lists the multipart_parts columns in the order scanMultipartPart expects
+const multipartPartColumns = `upload_id, part_number, etag, size, modified_at`
+
+// SaveMultipartUpload records a new multipart upload
+func (r *MetadataRepository) SaveMultipartUpload(upload *types.MultipartUpload) error {
+	metadataJSON, _ := json.Marshal(upload.Metadata)
+
+	query := "INSERT INTO multipart_uploads (" + multipartUploadColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(query,
+		upload.ID,
+		upload.Bucket,
+		upload.Key,
+		upload.ContentType,
+		string(metadataJSON),
+		upload.Initiator,
+		upload.CreatedAt.UTC(),
+		upload.UpdatedAt.UTC(),
+	)
+	return err
+}
+
+// GetMultipartUpload returns the multipart upload with id, or nil if there is none
+func (r *MetadataRepository) GetMultipartUpload(id string) (*types.MultipartUpload, error) {
+	query := "SELECT " + multipartUploadColumns + " FROM multipart_uploads WHERE id = ?"
+
+	upload, err := scanMultipartUpload(r.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// ListMultipartUploads returns the multipart uploads into bucket whose key
+// starts with prefix, by key and then by when they were started
+func (r *MetadataRepository) ListMultipartUploads(bucket, prefix string) ([]*types.MultipartUpload, error) {
+	query := "SELECT " + multipartUploadColumns + " FROM multipart_uploads" +
+		" WHERE bucket = ? AND substr(object_key, 1, length(?)) = ?" +
+		" ORDER BY object_key, created_at, id"
+
+	return r.queryMultipartUploads(query, bucket, prefix, prefix)
+}
+
+// ListExpiredMultipartUploads returns the multipart uploads last active before cutoff.
+// Upload times are stored in UTC so they compare correctly as text.
+func (r *MetadataRepository) ListExpiredMultipartUploads(cutoff time.Time) ([]*types.MultipartUpload, error) {
+	query := "SELECT " + multipartUploadColumns + " FROM multipart_uploads WHERE updated_at < ? ORDER BY updated_at"
+
+	return r.queryMultipartUploads(query, cutoff.UTC())
+}
+
+// queryMultipartUploads runs a query selecting multipartUploadColumns
+func (r *MetadataRepository) queryMultipartUploads(query string, args ...interface{}) ([]*types.MultipartUpload, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []*types.MultipartUpload{}
+	for rows.Next() {
+		upload, err := scanMultipartUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
+
+// DeleteMultipartUpload removes a multipart upload and its parts. It reports
+// false if there was no such upload.
+func (r *MetadataRepository) DeleteMultipartUpload(id string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM multipart_parts WHERE upload_id = ?", id); err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec("DELETE FROM multipart_uploads WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return removed > 0, tx.Commit()
+}
+
+// SaveMultipartPart records an uploaded part, replacing an earlier upload of
+// the same part number, and marks its upload as active
+func (r *MetadataRepository) SaveMultipartPart(part *types.MultipartPart) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE multipart_uploads SET updated_at = ? WHERE id = ?", part.ModifiedAt.UTC(), part.UploadID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: %s", ErrMultipartUploadNotFound, part.UploadID)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO multipart_parts (`+multipartPartColumns+`) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (upload_id, part_number) DO UPDATE SET
+			etag = excluded.etag,
+			size = excluded.size,
+			modified_at = excluded.modified_at`,
+		part.UploadID, part.PartNumber, part.ETag, part.Size, part.ModifiedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListMultipartParts returns up to limit parts of an upload numbered above
+// after, in order. A limit of zero or less returns every part.
+func (r *MetadataRepository) ListMultipartParts(uploadID string, after, limit int) ([]*types.MultipartPart, error) {
+	query := "SELECT " + multipartPartColumns + " FROM multipart_parts WHERE upload_id = ? AND part_number > ? ORDER BY part_number"
+	args := []interface{}{uploadID, after}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []*types.MultipartPart{}
+	for rows.Next() {
+		part, err := scanMultipartPart(rows)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+
+	return parts, rows.Err()
+}
+
+// scanMultipartUpload reads a multipart_uploads row selected with multipartUploadColumns
+func scanMultipartUpload(row rowScanner) (*types.MultipartUpload, error) {
+	var upload types.MultipartUpload
+	var metadataJSON sql.NullString
+
+	err := row.Scan(&upload.ID, &upload.Bucket, &upload.Key, &upload.ContentType, &metadataJSON,
+		&upload.Initiator, &upload.CreatedAt, &upload.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		json.Unmarshal([]byte(metadataJSON.String), &upload.Metadata)
+	}
+	if upload.Metadata == nil {
+		upload.Metadata = make(map[string]string)
+	}
+
+	return &upload, nil
+}
+
+// scanMultipartPart reads a multipart_parts row selected with multipartPartColumns
+func scanMultipartPart(row rowScanner) (*types.MultipartPart, error) {
+	var part types.MultipartPart
+	err := row.Scan(&part.UploadID, &part.PartNumber, &part.ETag, &part.Size, &part.ModifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &part, nil
+}
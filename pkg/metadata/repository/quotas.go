@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// quotaSubjectColumns maps each per-subject quota scope to the objects column naming its subject
+var quotaSubjectColumns = map[string]string{
+	types.QuotaScopeUser:   "uploaded_by",
+	types.QuotaScopeAPIKey: "api_key_id",
+}
+
+// SaveQuota creates or replaces a quota
+func (r *MetadataRepository) SaveQuota(quota *types.Quota) error {
+	if err := checkQuotaScope(quota.Scope, quota.Subject); err != nil {
+		return err
+	}
+	quota.UpdatedAt = time.Now().UTC()
+
+	_, err := r.db.Exec("INSERT OR REPLACE INTO quotas (scope, subject, max_bytes, max_objects, updated_at) VALUES (?, ?, ?, ?, ?)",
+		quota.Scope, quota.Subject, quota.MaxBytes, quota.MaxObjects, quota.UpdatedAt)
+	return err
+}
+
+// GetQuota returns the quota of a scope and subject, or nil if none is set
+func (r *MetadataRepository) GetQuota(scope, subject string) (*types.Quota, error) {
+	quota := &types.Quota{Scope: scope, Subject: subject}
+	err := r.db.QueryRow("SELECT max_bytes, max_objects, updated_at FROM quotas WHERE scope = ? AND subject = ?", scope, subject).
+		Scan(&quota.MaxBytes, &quota.MaxObjects, &quota.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// ListQuotas returns every quota set, optionally only those of scope
+func (r *MetadataRepository) ListQuotas(scope string) ([]*types.Quota, error) {
+	query := "SELECT scope, subject, max_bytes, max_objects, updated_at FROM quotas"
+	args := []interface{}{}
+	if scope != "" {
+		query += " WHERE scope = ?"
+		args = append(args, scope)
+	}
+	query += " ORDER BY scope, subject"
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := []*types.Quota{}
+	for rows.Next() {
+		quota := &types.Quota{}
+		if err := rows.Scan(&quota.Scope, &quota.Subject, &quota.MaxBytes, &quota.MaxObjects, &quota.UpdatedAt); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+
+	return quotas, rows.Err()
+}
+
+// DeleteQuota removes a quota. It reports whether one was set.
+func (r *MetadataRepository) DeleteQuota(scope, subject string) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM quotas WHERE scope = ? AND subject = ?", scope, subject)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+// GetUsage returns what a scope and subject currently hold. Objects are
+// charged to the uploader and API key recorded when they were uploaded.
+func (r *MetadataRepository) GetUsage(scope, subject string) (*types.Usage, error) {
+	if scope == types.QuotaScopeGlobal {
+		return r.globalUsage()
+	}
+	if err := checkQuotaScope(scope, subject); err != nil {
+		return nil, err
+	}
+
+	usages, err := r.listUsage(scope, &subject)
+	if err != nil {
+		return nil, err
+	}
+	if len(usages) == 0 {
+		return &types.Usage{Scope: scope, Subject: subject}, nil
+	}
+	return usages[0], nil
+}
+
+// ListUsage returns the usage of every subject of a per-subject scope that holds objects
+func (r *MetadataRepository) ListUsage(scope string) ([]*types.Usage, error) {
+	if _, ok := quotaSubjectColumns[scope]; !ok {
+		return nil, fmt.Errorf("invalid quota scope for listing usage: %q", scope)
+	}
+	return r.listUsage(scope, nil)
+}
+
+// listUsage sums the objects of each subject of scope, or of subject alone if given.
+// Unique bytes count each distinct blob a subject references once.
+func (r *MetadataRepository) listUsage(scope string, subject *string) ([]*types.Usage, error) {
+	column := quotaSubjectColumns[scope]
+
+	where := ""
+	args := []interface{}{}
+	if subject != nil {
+		where = " WHERE " + column + " = ?"
+		args = append(args, *subject)
+	}
+
+	query := `
+	SELECT totals.subject, totals.objects, totals.bytes, COALESCE(distinct_blobs.bytes, 0)
+	FROM (
+		SELECT ` + column + ` AS subject, COUNT(*) AS objects, SUM(size) AS bytes
+		FROM objects` + where + ` GROUP BY ` + column + `
+	) AS totals
+	LEFT JOIN (
+		SELECT owned.subject AS subject, SUM(blobs.size) AS bytes
+		FROM (SELECT DISTINCT ` + column + ` AS subject, blob_hash FROM objects` + where + `) AS owned
+		JOIN blobs ON blobs.hash = owned.blob_hash
+		GROUP BY owned.subject
+	) AS distinct_blobs ON distinct_blobs.subject = totals.subject
+	ORDER BY totals.bytes DESC`
+	args = append(args, args...)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := []*types.Usage{}
+	for rows.Next() {
+		usage := &types.Usage{Scope: scope}
+		var name sql.NullString
+		if err := rows.Scan(&name, &usage.Objects, &usage.Bytes, &usage.UniqueBytes); err != nil {
+			return nil, err
+		}
+		usage.Subject = name.String
+		usages = append(usages, usage)
+	}
+
+	return usages, rows.Err()
+}
+
+// globalUsage returns what the whole store holds. Unique bytes are the bytes
+// actually held in storage, as for physical_bytes in the statistics.
+func (r *MetadataRepository) globalUsage() (*types.Usage, error) {
+	usage := &types.Usage{Scope: types.QuotaScopeGlobal}
+
+	var bytes sql.NullInt64
+	if err := r.db.QueryRow("SELECT COUNT(*), SUM(size) FROM objects").Scan(&usage.Objects, &bytes); err != nil {
+		return nil, err
+	}
+	usage.Bytes = bytes.Int64
+
+	physicalBytes, err := r.physicalBytes()
+	if err != nil {
+		return nil, err
+	}
+	usage.UniqueBytes = physicalBytes
+
+	return usage, nil
+}
+
+// physicalBytes returns the bytes held in storage: whole-file blobs plus each distinct chunk once
+func (r *MetadataRepository) physicalBytes() (int64, error) {
+	var wholeSize, chunkSize sql.NullInt64
+	err := r.db.QueryRow("SELECT SUM(size) FROM blobs WHERE NOT EXISTS (SELECT 1 FROM manifests WHERE blob_hash = blobs.hash)").Scan(&wholeSize)
+	if err != nil {
+		return 0, err
+	}
+	err = r.db.QueryRow("SELECT SUM(size) FROM (SELECT MAX(size) AS size FROM manifest_chunks GROUP BY chunk_hash)").Scan(&chunkSize)
+	if err != nil {
+		return 0, err
+	}
+	return wholeSize.Int64 + chunkSize.Int64, nil
+}
+
+// checkQuotaScope validates a quota's scope and subject: the global quota has
+// no subject, and the others need one
+func checkQuotaScope(scope, subject string) error {
+	if scope == types.QuotaScopeGlobal {
+		if subject != "" {
+			return fmt.Errorf("the global quota takes no subject, got %q", subject)
+		}
+		return nil
+	}
+	if _, ok := quotaSubjectColumns[scope]; !ok {
+		return fmt.Errorf("invalid quota scope: %q", scope)
+	}
+	if subject == "" {
+		return fmt.Errorf("a %s quota needs a subject", scope)
+	}
+	return nil
+}
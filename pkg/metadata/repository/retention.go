@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// retentionRecordColumns lists the retention_audit columns in the order ListRetentionRecords scans them
+const retentionRecordColumns = `id, object_id, action, actor, retention_mode, retain_until, legal_hold, created_at`
+
+// lockedObjects is the condition matching objects under legal hold or whose
+// retention period still runs at the time given as its argument
+const lockedObjects = `(legal_hold OR (retention_mode != '' AND retain_until > ?))`
+
+// SetObjectRetention sets the retention mode and retain-until time of object
+// id, or removes its retention when mode is empty. It reports false if there
+// is no such object.
+func (r *MetadataRepository) SetObjectRetention(id, mode string, retainUntil *time.Time) (bool, error) {
+	result, err := r.db.Exec("UPDATE objects SET retention_mode = ?, retain_until = ? WHERE id = ?",
+		mode, utcTime(retainUntil), id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// SetObjectLegalHold places object id under legal hold or releases it. It
+// reports false if there is no such object.
+func (r *MetadataRepository) SetObjectLegalHold(id string, hold bool) (bool, error) {
+	result, err := r.db.Exec("UPDATE objects SET legal_hold = ? WHERE id = ?", hold, id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// SetBucketRetention sets the default retention of objects written to the
+// bucket called name; an empty mode removes it
+func (r *MetadataRepository) SetBucketRetention(name, mode string, days int) error {
+	result, err := r.db.Exec("UPDATE buckets SET retention_mode = ?, retention_days = ? WHERE name = ?", mode, days, name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	return nil
+}
+
+// ListLockedObjects returns the objects stored under key in bucket, every
+// version included, that are locked at now
+func (r *MetadataRepository) ListLockedObjects(bucket, key string, now time.Time) ([]*types.FileMetadata, error) {
+	return r.listLockedBucketObjects("object_key = ?", now, bucket, key)
+}
+
+// ListLockedObjectsUnder returns the objects stored under every key of bucket
+// starting with prefix, every version included, that are locked at now
+func (r *MetadataRepository) ListLockedObjectsUnder(bucket, prefix string, now time.Time) ([]*types.FileMetadata, error) {
+	return r.listLockedBucketObjects("substr(object_key, 1, length(?)) = ?", now, bucket, prefix, prefix)
+}
+
+// listLockedBucketObjects returns the locked objects stored under the keys of
+// bucket matching condition, or under versions of them
+func (r *MetadataRepository) listLockedBucketObjects(condition string, now time.Time, bucket string, args ...interface{}) ([]*types.FileMetadata, error) {
+	query := "SELECT " + objectColumns + " FROM objects WHERE id IN (" +
+		"SELECT object_id FROM bucket_keys WHERE bucket = ? AND " + condition +
+		" UNION SELECT object_id FROM object_versions WHERE bucket = ? AND " + condition +
+		") AND " + lockedObjects + " ORDER BY id"
+
+	queryArgs := append([]interface{}{bucket}, args...)
+	queryArgs = append(queryArgs, bucket)
+	queryArgs = append(queryArgs, args...)
+	return r.listObjects(query, append(queryArgs, now.UTC())...)
+}
+
+// ListLockedObjectsByHash returns the objects referencing blob hash that are locked at now
+func (r *MetadataRepository) ListLockedObjectsByHash(hash string, now time.Time) ([]*types.FileMetadata, error) {
+	query := "SELECT " + objectColumns + " FROM objects WHERE blob_hash = ? AND " + lockedObjects + " ORDER BY id"
+	return r.listObjects(query, hash, now.UTC())
+}
+
+// listObjects returns the objects a query selecting objectColumns returns
+func (r *MetadataRepository) listObjects(query string, args ...interface{}) ([]*types.FileMetadata, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*types.FileMetadata{}
+	for rows.Next() {
+		metadata, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, metadata)
+	}
+
+	return files, rows.Err()
+}
+
+// SaveRetentionRecord records a change made to an object by bypassing its
+// retention or releasing its legal hold, setting the record's ID
+func (r *MetadataRepository) SaveRetentionRecord(record *types.RetentionRecord) error {
+	result, err := r.db.Exec(`
+		INSERT INTO retention_audit (object_id, action, actor, retention_mode, retain_until, legal_hold, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		record.ObjectID, record.Action, record.Actor, record.RetentionMode, utcTime(record.RetainUntil),
+		record.LegalHold, record.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	record.ID, err = result.LastInsertId()
+	return err
+}
+
+// ListRetentionRecords returns up to limit of the most recent retention audit
+// records, newest first, only those of object id if it is not empty
+func (r *MetadataRepository) ListRetentionRecords(id string, limit int) ([]*types.RetentionRecord, error) {
+	query := "SELECT " + retentionRecordColumns + " FROM retention_audit"
+	args := []interface{}{}
+	if id != "" {
+		query += " WHERE object_id = ?"
+		args = append(args, id)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+
+	rows, err := r.db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*types.RetentionRecord{}
+	for rows.Next() {
+		var record types.RetentionRecord
+		err := rows.Scan(&record.ID, &record.ObjectID, &record.Action, &record.Actor, &record.RetentionMode,
+			&record.RetainUntil, &record.LegalHold, &record.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+
+	return records, rows.Err()
+}
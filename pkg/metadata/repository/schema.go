@@ -0,0 +1,374 @@
+package repository
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// schemaFiles holds the schema migrations, NNNN_name.up.sql applying version
+// NNNN and NNNN_name.down.sql rolling it back
+//
+//go:embed migrations/*.sql
+var schemaFiles embed.FS
+
+// ErrSchemaTooNew is returned for a database migrated by a newer release
+var ErrSchemaTooNew = errors.New("database schema is newer than this release supports")
+
+// schemaMigration is one version of the schema and the SQL applying and
+// rolling it back
+type schemaMigration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadSchemaMigrations reads the migrations in dir of fsys, ordered by
+// version. Versions must run from 1 without gaps, each with both scripts.
+func loadSchemaMigrations(fsys fs.FS, dir string) ([]*schemaMigration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*schemaMigration)
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		base, direction := strings.TrimSuffix(base, path.Ext(base)), strings.TrimPrefix(path.Ext(base), ".")
+		number, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 || name == "" || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid schema migration file name: %s", entry.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &schemaMigration{version: version, name: name}
+			byVersion[version] = migration
+		}
+		if migration.name != name {
+			return nil, fmt.Errorf("schema migration %d is named both %s and %s", version, migration.name, name)
+		}
+		if direction == "up" {
+			migration.up = string(data)
+		} else {
+			migration.down = string(data)
+		}
+	}
+
+	migrations := make([]*schemaMigration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for i, migration := range migrations {
+		if migration.version != i+1 {
+			return nil, fmt.Errorf("schema migration %d is missing", i+1)
+		}
+		if migration.up == "" || migration.down == "" {
+			return nil, fmt.Errorf("schema migration %d needs both an up and a down script", migration.version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// SchemaMigrator moves the schema of a metadata database between versions.
+// Each migration is applied or rolled back in its own transaction and
+// recorded in the schema_migrations table, and the database is backed up
+// before it is changed.
+type SchemaMigrator struct {
+	db         *sql.DB
+	dbPath     string
+	migrations []*schemaMigration
+	logger     *log.Logger
+}
+
+// NewSchemaMigrator opens the database at dbPath without migrating it
+func NewSchemaMigrator(dbPath string) (*SchemaMigrator, error) {
+	db, err := sql.Open("sqlite", withBusyTimeout(dbPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	migrator, err := newSchemaMigrator(db, dbPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return migrator, nil
+}
+
+// newSchemaMigrator creates a schema migrator for db, opened from dbPath
+func newSchemaMigrator(db *sql.DB, dbPath string) (*SchemaMigrator, error) {
+	migrations, err := loadSchemaMigrations(schemaFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema migrations: %w", err)
+	}
+
+	return &SchemaMigrator{
+		db:         db,
+		dbPath:     dbPath,
+		migrations: migrations,
+		logger:     log.New(os.Stdout, "[SCHEMA] ", log.LstdFlags),
+	}, nil
+}
+
+// Close closes the database connection
+func (m *SchemaMigrator) Close() error {
+	return m.db.Close()
+}
+
+// Latest returns the schema version of this release
+func (m *SchemaMigrator) Latest() int {
+	return len(m.migrations)
+}
+
+// Version returns the schema version of the database, 0 for a database
+// without any, and whether it was created before the schema was versioned.
+// Such databases have the first schema, version 1.
+func (m *SchemaMigrator) Version() (int, bool, error) {
+	tables, err := m.tables()
+	if err != nil {
+		return 0, false, err
+	}
+	if !tables["schema_migrations"] {
+		if len(tables) > 0 {
+			return 1, true, nil
+		}
+		return 0, false, nil
+	}
+
+	var version int
+	err = m.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, false, err
+}
+
+// Status returns every migration this release knows, and those a newer
+// release applied, with when each was applied
+func (m *SchemaMigrator) Status() ([]*types.SchemaMigration, error) {
+	applied := make(map[int]*types.SchemaMigration)
+
+	tables, err := m.tables()
+	if err != nil {
+		return nil, err
+	}
+	if tables["schema_migrations"] {
+		rows, err := m.db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var migration types.SchemaMigration
+			var appliedAt time.Time
+			if err := rows.Scan(&migration.Version, &migration.Name, &appliedAt); err != nil {
+				return nil, err
+			}
+			migration.AppliedAt = &appliedAt
+			applied[migration.Version] = &migration
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	status := make([]*types.SchemaMigration, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		if record, ok := applied[migration.version]; ok {
+			status = append(status, record)
+			delete(applied, migration.version)
+			continue
+		}
+		status = append(status, &types.SchemaMigration{Version: migration.version, Name: migration.name})
+	}
+	for _, record := range applied {
+		status = append(status, record)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return status, nil
+}
+
+// Up migrates the database to the latest version
+func (m *SchemaMigrator) Up() ([]*types.SchemaMigration, error) {
+	return m.Migrate(m.Latest())
+}
+
+// Migrate applies or rolls back migrations until the database is at version
+// target, and returns them in the order they ran. A database created before
+// the schema was versioned is first recorded at version 1. The database is
+// backed up before it is changed, unless it is new or in memory.
+func (m *SchemaMigrator) Migrate(target int) ([]*types.SchemaMigration, error) {
+	if target < 0 || target > m.Latest() {
+		return nil, fmt.Errorf("unknown schema version %d, the latest is %d", target, m.Latest())
+	}
+
+	current, unversioned, err := m.Version()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current > m.Latest() {
+		return nil, fmt.Errorf("%w: version %d, this release knows up to %d", ErrSchemaTooNew, current, m.Latest())
+	}
+	if current == target && !unversioned {
+		return nil, nil
+	}
+
+	if current > 0 || unversioned {
+		if _, err := m.Backup(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := m.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`); err != nil {
+		return nil, err
+	}
+
+	var ran []*types.SchemaMigration
+	if unversioned {
+		// The first migration only creates what is missing, so it records the version
+		record, err := m.run(m.migrations[0], true)
+		if err != nil {
+			return nil, err
+		}
+		ran = append(ran, record)
+	}
+
+	for current < target {
+		record, err := m.run(m.migrations[current], true)
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, record)
+		current++
+	}
+	for current > target {
+		record, err := m.run(m.migrations[current-1], false)
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, record)
+		current--
+	}
+
+	return ran, nil
+}
+
+// run applies migration, or rolls it back, and records it
+func (m *SchemaMigrator) run(migration *schemaMigration, up bool) (*types.SchemaMigration, error) {
+	record := &types.SchemaMigration{Version: migration.version, Name: migration.name}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.Exec(migration.up); err != nil {
+			return nil, fmt.Errorf("failed to apply schema migration %d (%s): %w", migration.version, migration.name, err)
+		}
+		appliedAt := time.Now().UTC()
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			migration.version, migration.name, appliedAt); err != nil {
+			return nil, err
+		}
+		record.AppliedAt = &appliedAt
+	} else {
+		if _, err := tx.Exec(migration.down); err != nil {
+			return nil, fmt.Errorf("failed to roll back schema migration %d (%s): %w", migration.version, migration.name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.version); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if up {
+		m.logger.Printf("applied schema migration %d (%s)", migration.version, migration.name)
+	} else {
+		m.logger.Printf("rolled back schema migration %d (%s)", migration.version, migration.name)
+	}
+	return record, nil
+}
+
+// Backup copies the database next to itself, named after its schema version
+// and the time, and returns the copy's path. In-memory databases are not
+// backed up and return an empty path.
+func (m *SchemaMigrator) Backup() (string, error) {
+	dbFile := strings.TrimPrefix(m.dbPath, "file:")
+	dbFile, params, _ := strings.Cut(dbFile, "?")
+	if dbFile == "" || dbFile == ":memory:" || strings.Contains(params, "mode=memory") {
+		return "", nil
+	}
+
+	version, _, err := m.Version()
+	if err != nil {
+		return "", err
+	}
+
+	backup := fmt.Sprintf("%s.v%d-%s.bak", dbFile, version, time.Now().UTC().Format("20060102T150405Z"))
+	for n := 2; ; n++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.v%d-%s-%d.bak", dbFile, version, time.Now().UTC().Format("20060102T150405Z"), n)
+	}
+
+	if _, err := m.db.Exec("VACUUM INTO ?", backup); err != nil {
+		return "", fmt.Errorf("failed to back up database: %w", err)
+	}
+
+	m.logger.Printf("backed up database at version %d to %s", version, backup)
+	return backup, nil
+}
+
+// tables returns the names of the tables in the database
+func (m *SchemaMigrator) tables() (map[string]bool, error) {
+	rows, err := m.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables[name] = true
+	}
+	return tables, rows.Err()
+}
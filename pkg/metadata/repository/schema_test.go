@@ -0,0 +1,303 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// schemaOf returns the columns of every table in the database at dbPath,
+// schema_migrations aside, sorted by name
+func schemaOf(t *testing.T, dbPath string) map[string]string {
+	t.Helper()
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	migrator := &SchemaMigrator{db: db}
+	tables, err := migrator.tables()
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+
+	schema := make(map[string]string)
+	for table := range tables {
+		if table == "schema_migrations" {
+			continue
+		}
+		rows, err := db.Query("SELECT name, type, \"notnull\", COALESCE(dflt_value, '') FROM pragma_table_info(?)", table)
+		if err != nil {
+			t.Fatalf("Failed to read columns of %s: %v", table, err)
+		}
+		var columns []string
+		for rows.Next() {
+			var name, colType, defaultValue string
+			var notNull bool
+			if err := rows.Scan(&name, &colType, &notNull, &defaultValue); err != nil {
+				t.Fatalf("Failed to scan column: %v", err)
+			}
+			column := strings.Join([]string{name, colType, defaultValue}, " ")
+			if notNull {
+				column += " NOT NULL"
+			}
+			columns = append(columns, column)
+		}
+		rows.Close()
+		sort.Strings(columns)
+		schema[table] = strings.Join(columns, ", ")
+	}
+	return schema
+}
+
+// sameSchema fails the test unless got has the tables and columns of want
+func sameSchema(t *testing.T, want, got map[string]string) {
+	t.Helper()
+	for table, columns := range want {
+		if got[table] != columns {
+			t.Errorf("Expected %s to have columns %s, got %s", table, columns, got[table])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d tables, got %d", len(want), len(got))
+	}
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_schema")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	backups := func(dbPath string) []string {
+		t.Helper()
+		matches, err := filepath.Glob(dbPath + ".v*.bak")
+		if err != nil {
+			t.Fatalf("Failed to list backups: %v", err)
+		}
+		return matches
+	}
+
+	freshPath := filepath.Join(tempDir, "fresh.db")
+	fresh, err := NewMetadataRepository(freshPath)
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	fresh.Close()
+
+	t.Run("Fresh", func(t *testing.T) {
+		migrator, err := NewSchemaMigrator(freshPath)
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		defer migrator.Close()
+
+		version, unversioned, err := migrator.Version()
+		if err != nil || version != migrator.Latest() || unversioned {
+			t.Errorf("Expected version %d, got %d (unversioned %v, %v)", migrator.Latest(), version, unversioned, err)
+		}
+		status, err := migrator.Status()
+		if err != nil {
+			t.Fatalf("Failed to get status: %v", err)
+		}
+		for _, migration := range status {
+			if migration.AppliedAt == nil {
+				t.Errorf("Expected migration %d to be applied", migration.Version)
+			}
+		}
+		if len(backups(freshPath)) != 0 {
+			t.Error("Expected no backup of a new database")
+		}
+
+		if ran, err := migrator.Up(); err != nil || len(ran) != 0 {
+			t.Errorf("Expected nothing to migrate, got %d (%v)", len(ran), err)
+		}
+	})
+
+	t.Run("FromFirstSchema", func(t *testing.T) {
+		dbPath := filepath.Join(tempDir, "first.db")
+		migrator, err := NewSchemaMigrator(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		if _, err := migrator.Migrate(1); err != nil {
+			t.Fatalf("Failed to migrate to the first schema: %v", err)
+		}
+		_, err = migrator.db.Exec(`
+		INSERT INTO files (sha1, file_name, content_type, size, uploaded_by, tags, custom_fields, description, is_public)
+		VALUES ('first_sha1', 'first.txt', 'text/plain', 5, 'someone', '["a"]', '{"k":"v"}', 'first', TRUE),
+			('second_sha1', 'second.txt', 'text/plain', 7, 'someone', 'null', 'null', '', FALSE)`)
+		migrator.Close()
+		if err != nil {
+			t.Fatalf("Failed to insert files: %v", err)
+		}
+
+		repo, err := NewMetadataRepository(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to migrate from the first schema: %v", err)
+		}
+		defer repo.Close()
+
+		metadata, err := repo.GetMetadataByHash("first_sha1")
+		if err != nil {
+			t.Fatalf("File was not migrated: %v", err)
+		}
+		if _, err := uuid.Parse(metadata.ID); err != nil {
+			t.Errorf("Expected a UUID object ID, got %q", metadata.ID)
+		}
+		if metadata.FileName != "first.txt" || !metadata.IsPublic || metadata.Description != "first" ||
+			len(metadata.Tags) != 1 || metadata.CustomFields["k"] != "v" {
+			t.Errorf("Unexpected migrated object: %+v", metadata)
+		}
+		if refs, err := repo.BlobRefCount("first_sha1"); err != nil || refs != 1 {
+			t.Errorf("Expected the migrated blob to have 1 reference, got %d (%v)", refs, err)
+		}
+
+		if len(backups(dbPath)) != 1 {
+			t.Errorf("Expected one backup before migrating, got %v", backups(dbPath))
+		}
+		sameSchema(t, schemaOf(t, freshPath), schemaOf(t, dbPath))
+	})
+
+	t.Run("DownAndUp", func(t *testing.T) {
+		dbPath := filepath.Join(tempDir, "roundtrip.db")
+		repo, err := NewMetadataRepository(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create metadata repository: %v", err)
+		}
+		for _, name := range []string{"old.txt", "new.txt"} {
+			metadata := &types.FileMetadata{Hash: "shared_sha1", FileName: name, Size: 3, UploadedAt: time.Now()}
+			if err := repo.SaveMetadata(metadata); err != nil {
+				t.Fatalf("Failed to save metadata: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		repo.Close()
+
+		migrator, err := NewSchemaMigrator(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		defer migrator.Close()
+
+		ran, err := migrator.Migrate(1)
+		if err != nil {
+			t.Fatalf("Failed to roll back: %v", err)
+		}
+		if len(ran) != migrator.Latest()-1 || ran[0].AppliedAt != nil {
+			t.Errorf("Expected %d migrations rolled back, got %+v", migrator.Latest()-1, ran)
+		}
+
+		var name string
+		if err := migrator.db.QueryRow("SELECT file_name FROM files WHERE sha1 = 'shared_sha1'").Scan(&name); err != nil || name != "new.txt" {
+			t.Errorf("Expected the last upload to be kept, got %q (%v)", name, err)
+		}
+
+		if _, err := migrator.Up(); err != nil {
+			t.Fatalf("Failed to migrate up again: %v", err)
+		}
+		if version, _, _ := migrator.Version(); version != migrator.Latest() {
+			t.Errorf("Expected version %d, got %d", migrator.Latest(), version)
+		}
+		if len(backups(dbPath)) != 2 {
+			t.Errorf("Expected a backup before each migration, got %v", backups(dbPath))
+		}
+	})
+
+	t.Run("Unversioned", func(t *testing.T) {
+		// Databases created before the schema was versioned have the first schema
+		dbPath := filepath.Join(tempDir, "unversioned.db")
+		db, err := sql.Open("sqlite", dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		first, err := fs.ReadFile(schemaFiles, "migrations/0001_files.up.sql")
+		if err == nil {
+			_, err = db.Exec(string(first) + "INSERT INTO files (sha1, file_name, size) VALUES ('old_sha1', 'old.txt', 4);")
+		}
+		db.Close()
+		if err != nil {
+			t.Fatalf("Failed to create unversioned table: %v", err)
+		}
+
+		migrator, err := NewSchemaMigrator(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		defer migrator.Close()
+
+		if version, unversioned, err := migrator.Version(); err != nil || version != 1 || !unversioned {
+			t.Errorf("Expected an unversioned database at version 1, got %d (unversioned %v, %v)", version, unversioned, err)
+		}
+		if ran, err := migrator.Migrate(1); err != nil || len(ran) != 1 || ran[0].Version != 1 {
+			t.Fatalf("Expected version 1 to be recorded, got %+v (%v)", ran, err)
+		}
+		if version, unversioned, err := migrator.Version(); err != nil || version != 1 || unversioned {
+			t.Errorf("Expected version 1, got %d (unversioned %v, %v)", version, unversioned, err)
+		}
+
+		var name string
+		if err := migrator.db.QueryRow("SELECT file_name FROM files WHERE sha1 = 'old_sha1'").Scan(&name); err != nil || name != "old.txt" {
+			t.Errorf("Expected the file to be kept, got %q (%v)", name, err)
+		}
+	})
+
+	t.Run("TooNew", func(t *testing.T) {
+		dbPath := filepath.Join(tempDir, "newer.db")
+		migrator, err := NewSchemaMigrator(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		if _, err := migrator.Up(); err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		_, err = migrator.db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', ?)",
+			migrator.Latest()+1, time.Now().UTC())
+		migrator.Close()
+		if err != nil {
+			t.Fatalf("Failed to record a newer migration: %v", err)
+		}
+
+		if _, err := NewMetadataRepository(dbPath); !errors.Is(err, ErrSchemaTooNew) {
+			t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+		}
+	})
+}
+
+func TestLoadSchemaMigrations(t *testing.T) {
+	migrations, err := loadSchemaMigrations(schemaFiles, "migrations")
+	if err != nil {
+		t.Fatalf("Failed to load embedded migrations: %v", err)
+	}
+	if len(migrations) < 2 || migrations[0].name != "files" || migrations[1].name != "objects" {
+		t.Errorf("Expected the first schema and the move to objects first, got %d migrations", len(migrations))
+	}
+
+	script := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	invalid := map[string]fstest.MapFS{
+		"gap":        {"m/0001_a.up.sql": script, "m/0001_a.down.sql": script, "m/0003_c.up.sql": script, "m/0003_c.down.sql": script},
+		"no down":    {"m/0001_a.up.sql": script},
+		"bad name":   {"m/first.up.sql": script},
+		"two names":  {"m/0001_a.up.sql": script, "m/0001_b.down.sql": script},
+		"direction":  {"m/0001_a.sideways.sql": script},
+		"zero":       {"m/0000_a.up.sql": script, "m/0000_a.down.sql": script},
+		"empty name": {"m/0001_.up.sql": script, "m/0001_.down.sql": script},
+	}
+	for name, fsys := range invalid {
+		if _, err := loadSchemaMigrations(fsys, "m"); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"database/sql"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// migrationColumns lists the storage_migrations columns in the order scanMigration expects
+const migrationColumns = `id, source, target, status, blobs_total, bytes_total, blobs_moved, bytes_moved, error, started_at, updated_at, finished_at`
+
+// SaveMigration records a storage migration and its progress, replacing what
+// was recorded before
+func (r *MetadataRepository) SaveMigration(migration *types.Migration) error {
+	var finishedAt interface{}
+	if migration.FinishedAt != nil {
+		finishedAt = migration.FinishedAt.UTC()
+	}
+
+	_, err := r.db.Exec(`
+		INSERT INTO storage_migrations (`+migrationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = excluded.status,
+			blobs_total = excluded.blobs_total,
+			bytes_total = excluded.bytes_total,
+			blobs_moved = excluded.blobs_moved,
+			bytes_moved = excluded.bytes_moved,
+			error = excluded.error,
+			updated_at = excluded.updated_at,
+			finished_at = excluded.finished_at`,
+		migration.ID, migration.Source, migration.Target, migration.Status,
+		migration.BlobsTotal, migration.BytesTotal, migration.BlobsMoved, migration.BytesMoved,
+		migration.Error, migration.StartedAt.UTC(), migration.UpdatedAt.UTC(), finishedAt)
+	return err
+}
+
+// GetMigration returns the storage migration with id, or nil if there is none
+func (r *MetadataRepository) GetMigration(id string) (*types.Migration, error) {
+	query := "SELECT " + migrationColumns + " FROM storage_migrations WHERE id = ?"
+
+	migration, err := scanMigration(r.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return migration, nil
+}
+
+// ListMigrations returns the storage migrations, newest first, optionally
+// only those with one status
+func (r *MetadataRepository) ListMigrations(status string) ([]*types.Migration, error) {
+	query := "SELECT " + migrationColumns + " FROM storage_migrations"
+	args := []interface{}{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY started_at DESC"
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	migrations := []*types.Migration{}
+	for rows.Next() {
+		migration, err := scanMigration(rows)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, rows.Err()
+}
+
+// scanMigration reads a storage_migrations row selected with migrationColumns
+func scanMigration(row rowScanner) (*types.Migration, error) {
+	var migration types.Migration
+	var finishedAt sql.NullTime
+
+	err := row.Scan(&migration.ID, &migration.Source, &migration.Target, &migration.Status,
+		&migration.BlobsTotal, &migration.BytesTotal, &migration.BlobsMoved, &migration.BytesMoved,
+		&migration.Error, &migration.StartedAt, &migration.UpdatedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if finishedAt.Valid {
+		migration.FinishedAt = &finishedAt.Time
+	}
+
+	return &migration, nil
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// ListTierCandidates returns up to limit referenced blobs with a hash after
+// the given one that are due to move to cold storage, by hash: hot blobs no
+// object referencing them has been read since cutoff, and blobs left
+// demoting by an interrupted move
+func (r *MetadataRepository) ListTierCandidates(cutoff time.Time, after string, limit int) ([]*types.BlobTier, error) {
+	rows, err := r.db.Query(`
+		SELECT b.hash, b.size, b.tier FROM blobs b
+		WHERE b.hash > ? AND b.ref_count > 0 AND (b.tier = ? OR (b.tier = ? AND NOT EXISTS (
+			SELECT 1 FROM objects o WHERE o.blob_hash = b.hash AND COALESCE(o.last_accessed, o.uploaded_at) > ?)))
+		ORDER BY b.hash LIMIT ?`,
+		after, types.TierDemoting, types.TierHot, cutoff.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := []*types.BlobTier{}
+	for rows.Next() {
+		var blob types.BlobTier
+		if err := rows.Scan(&blob.Hash, &blob.Size, &blob.Tier); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, &blob)
+	}
+
+	return blobs, rows.Err()
+}
+
+// GetBlobTier returns the storage tier of blob hash, or "" if there is no such blob
+func (r *MetadataRepository) GetBlobTier(hash string) (string, error) {
+	var tier string
+	err := r.db.QueryRow("SELECT tier FROM blobs WHERE hash = ?", hash).Scan(&tier)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return tier, err
+}
+
+// SetBlobTier records that blob hash is kept in tier
+func (r *MetadataRepository) SetBlobTier(hash, tier string) error {
+	_, err := r.db.Exec("UPDATE blobs SET tier = ? WHERE hash = ?", tier, hash)
+	return err
+}
+
+// SwapBlobTier records that blob hash is kept in tier to, provided it is
+// recorded in tier from, and reports whether it was
+func (r *MetadataRepository) SwapBlobTier(hash, from, to string) (bool, error) {
+	result, err := r.db.Exec("UPDATE blobs SET tier = ? WHERE hash = ? AND tier = ?", to, hash, from)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// CountBlobsByTier returns the number and size of referenced blobs in each storage tier
+func (r *MetadataRepository) CountBlobsByTier() (map[string]*types.TierUsage, error) {
+	rows, err := r.db.Query("SELECT tier, COUNT(*), COALESCE(SUM(size), 0) FROM blobs WHERE ref_count > 0 GROUP BY tier")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiers := map[string]*types.TierUsage{
+		types.TierHot:  {},
+		types.TierCold: {},
+	}
+	for rows.Next() {
+		var tier string
+		usage := &types.TierUsage{}
+		if err := rows.Scan(&tier, &usage.Blobs, &usage.Bytes); err != nil {
+			return nil, err
+		}
+		tiers[tier] = usage
+	}
+
+	return tiers, rows.Err()
+}
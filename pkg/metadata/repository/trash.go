@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// liveObjects is the condition matching objects that are not in the trash
+const liveObjects = "deleted_at IS NULL"
+
+// TrashObject moves object id to the trash at, removing the bucket keys and
+// versions stored under it. The object keeps its reference on the blob until
+// it is purged. It reports false if there is no such live object.
+func (r *MetadataRepository) TrashObject(id string, at time.Time) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE objects SET deleted_at = ? WHERE id = ? AND "+liveObjects, at.UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	trashed, err := result.RowsAffected()
+	if err != nil || trashed == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM bucket_keys WHERE object_id = ?", id); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM object_versions WHERE object_id = ?", id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// RestoreObject takes object id out of the trash. It reports false if there
+// is no such object in the trash.
+func (r *MetadataRepository) RestoreObject(id string) (bool, error) {
+	result, err := r.db.Exec("UPDATE objects SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return false, err
+	}
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return restored > 0, nil
+}
+
+// PurgeObject deletes object id for good if it was moved to the trash at or
+// before cutoff, as DeleteObject does. It reports false if the object is not
+// in the trash or was moved there later, as when it was restored meanwhile.
+func (r *MetadataRepository) PurgeObject(id string, cutoff time.Time) (bool, error) {
+	_, _, err := r.deleteObject(id, " AND deleted_at IS NOT NULL AND deleted_at <= ?", cutoff.UTC())
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetTrashedObject returns object id if it is in the trash, or nil if it is not
+func (r *MetadataRepository) GetTrashedObject(id string) (*types.FileMetadata, error) {
+	objects, err := r.listObjects("SELECT "+objectColumns+" FROM objects WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+	return objects[0], nil
+}
+
+// ListTrash returns up to limit objects in the trash, skipping the first
+// offset, those moved there last first
+func (r *MetadataRepository) ListTrash(limit, offset int) ([]*types.FileMetadata, error) {
+	query := "SELECT " + objectColumns + " FROM objects WHERE deleted_at IS NOT NULL" +
+		" ORDER BY deleted_at DESC, id LIMIT ? OFFSET ?"
+	return r.listObjects(query, limit, offset)
+}
+
+// ListPurgeableObjects returns up to limit objects moved to the trash at or
+// before cutoff, those moved there first first
+func (r *MetadataRepository) ListPurgeableObjects(cutoff time.Time, limit int) ([]*types.FileMetadata, error) {
+	query := "SELECT " + objectColumns + " FROM objects WHERE deleted_at IS NOT NULL AND deleted_at <= ?" +
+		" ORDER BY deleted_at, id LIMIT ?"
+	return r.listObjects(query, cutoff.UTC(), limit)
+}
+
+// CountTrash returns how many objects are in the trash and their total size
+func (r *MetadataRepository) CountTrash() (int64, int64, error) {
+	var objects, bytes int64
+	err := r.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM objects WHERE deleted_at IS NOT NULL").Scan(&objects, &bytes)
+	return objects, bytes, err
+}
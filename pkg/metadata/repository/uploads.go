@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// uploadSessionColumns lists the upload_sessions columns in the order scanUploadSession expects
+const uploadSessionColumns = `id, upload_length, upload_offset, metadata, object_id, hash, created_at, updated_at, expires_at`
+
+// SaveUploadSession creates or replaces a resumable upload session
+func (r *MetadataRepository) SaveUploadSession(session *types.UploadSession) error {
+	metadataJSON, _ := json.Marshal(session.Metadata)
+
+	query := "INSERT OR REPLACE INTO upload_sessions (" + uploadSessionColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(query,
+		session.ID,
+		session.Length,
+		session.Offset,
+		string(metadataJSON),
+		session.ObjectID,
+		session.Hash,
+		session.CreatedAt.UTC(),
+		session.UpdatedAt.UTC(),
+		session.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// GetUploadSession retrieves a resumable upload session by ID
+func (r *MetadataRepository) GetUploadSession(id string) (*types.UploadSession, error) {
+	query := "SELECT " + uploadSessionColumns + " FROM upload_sessions WHERE id = ?"
+
+	session, err := scanUploadSession(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("upload session not found: %s", id)
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// DeleteUploadSession removes a resumable upload session
+func (r *MetadataRepository) DeleteUploadSession(id string) error {
+	_, err := r.db.Exec("DELETE FROM upload_sessions WHERE id = ?", id)
+	return err
+}
+
+// ListExpiredUploadSessions returns the upload sessions that expired before now.
+// Session times are stored in UTC so they compare correctly as text.
+func (r *MetadataRepository) ListExpiredUploadSessions(now time.Time) ([]*types.UploadSession, error) {
+	query := "SELECT " + uploadSessionColumns + " FROM upload_sessions WHERE expires_at < ? ORDER BY expires_at"
+
+	rows, err := r.db.Query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*types.UploadSession
+	for rows.Next() {
+		session, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// scanUploadSession reads an upload_sessions row selected with uploadSessionColumns
+func scanUploadSession(row rowScanner) (*types.UploadSession, error) {
+	var session types.UploadSession
+	var metadataJSON, objectID, hash sql.NullString
+
+	err := row.Scan(
+		&session.ID,
+		&session.Length,
+		&session.Offset,
+		&metadataJSON,
+		&objectID,
+		&hash,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+		&session.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	json.Unmarshal([]byte(metadataJSON.String), &session.Metadata)
+	session.ObjectID = objectID.String
+	session.Hash = hash.String
+
+	return &session, nil
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/types"
+)
+
+// objectVersionColumns lists the object_versions, objects and bucket_keys
+// columns in the order scanObjectVersion expects
+const objectVersionColumns = `v.bucket, v.object_key, v.version, v.object_id, v.etag, o.size, o.content_type,
+	COALESCE(k.version = v.version, 0), v.created_at`
+
+// objectVersionTables joins versions to their objects and to the key they
+// may be current for
+const objectVersionTables = `object_versions v JOIN objects o ON o.id = v.object_id
+	LEFT JOIN bucket_keys k ON k.bucket = v.bucket AND k.object_key = v.object_key`
+
+// ListObjectVersions returns the versions of key in bucket, newest first
+func (r *MetadataRepository) ListObjectVersions(bucket, key string) ([]*types.ObjectVersion, error) {
+	query := "SELECT " + objectVersionColumns + " FROM " + objectVersionTables +
+		" WHERE v.bucket = ? AND v.object_key = ? ORDER BY v.version DESC"
+
+	rows, err := r.db.Query(query, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*types.ObjectVersion{}
+	for rows.Next() {
+		version, err := scanObjectVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+// GetObjectVersion returns a version of key in bucket, or nil if there is no such version
+func (r *MetadataRepository) GetObjectVersion(bucket, key string, version int) (*types.ObjectVersion, error) {
+	query := "SELECT " + objectVersionColumns + " FROM " + objectVersionTables +
+		" WHERE v.bucket = ? AND v.object_key = ? AND v.version = ?"
+
+	objectVersion, err := scanObjectVersion(r.db.QueryRow(query, bucket, key, version))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return objectVersion, nil
+}
+
+// DeleteObjectVersion removes a version of key in bucket. Deleting the
+// current version makes the newest remaining one current, or removes the key
+// if none remains. It returns the ID of the version's object, which the
+// caller is left to delete, or an empty string if there was no such version.
+func (r *MetadataRepository) DeleteObjectVersion(bucket, key string, version int) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var objectID string
+	err = tx.QueryRow("DELETE FROM object_versions WHERE bucket = ? AND object_key = ? AND version = ? RETURNING object_id",
+		bucket, key, version).Scan(&objectID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var current int
+	err = tx.QueryRow("SELECT version FROM bucket_keys WHERE bucket = ? AND object_key = ?", bucket, key).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if current == version {
+		var previous types.ObjectVersion
+		err := tx.QueryRow(`
+			SELECT version, object_id, etag, created_at FROM object_versions
+			WHERE bucket = ? AND object_key = ? ORDER BY version DESC LIMIT 1`, bucket, key).
+			Scan(&previous.Version, &previous.ObjectID, &previous.ETag, &previous.CreatedAt)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = tx.Exec("DELETE FROM bucket_keys WHERE bucket = ? AND object_key = ?", bucket, key)
+		case err == nil:
+			_, err = tx.Exec("UPDATE bucket_keys SET object_id = ?, etag = ?, version = ?, modified_at = ? WHERE bucket = ? AND object_key = ?",
+				previous.ObjectID, previous.ETag, previous.Version, previous.CreatedAt.UTC(), bucket, key)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return objectID, nil
+}
+
+// SetBucketMaxVersions sets how many versions of each key in the bucket
+// called name are kept. Zero keeps every version.
+func (r *MetadataRepository) SetBucketMaxVersions(name string, maxVersions int) error {
+	result, err := r.db.Exec("UPDATE buckets SET max_versions = ? WHERE name = ?", maxVersions, name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	return nil
+}
+
+// unlockedVersion is the condition matching versions whose object is not
+// locked by retention or a legal hold at the time given as its argument
+const unlockedVersion = "object_id NOT IN (SELECT id FROM objects WHERE " + lockedObjects + ")"
+
+// PruneBucketVersions drops all but the newest keep versions of every key in
+// bucket. It returns the IDs of the objects whose versions were dropped,
+// which the caller is left to delete. Locked versions are kept beyond the
+// limit until they are no longer locked.
+func (r *MetadataRepository) PruneBucketVersions(bucket string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return []string{}, nil
+	}
+
+	rows, err := r.db.Query(`
+		DELETE FROM object_versions WHERE rowid IN (
+			SELECT rowid FROM (
+				SELECT rowid, ROW_NUMBER() OVER (PARTITION BY object_key ORDER BY version DESC) AS n
+				FROM object_versions WHERE bucket = ?
+			) WHERE n > ?
+		) AND `+unlockedVersion+` RETURNING object_id`, bucket, keep, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return scanObjectIDs(rows)
+}
+
+// pruneVersions drops all but the newest keep versions of key in bucket
+// within tx, returning the IDs of their objects. Zero keeps every version.
+// With spareLocked, locked versions are kept beyond the limit.
+func pruneVersions(tx *sql.Tx, bucket, key string, keep int, spareLocked bool) ([]string, error) {
+	if keep <= 0 {
+		return []string{}, nil
+	}
+
+	query := `
+		DELETE FROM object_versions WHERE bucket = ? AND object_key = ? AND version <= (
+			SELECT version FROM object_versions WHERE bucket = ? AND object_key = ?
+			ORDER BY version DESC LIMIT 1 OFFSET ?
+		)`
+	args := []interface{}{bucket, key, bucket, key, keep}
+	if spareLocked {
+		query += " AND " + unlockedVersion
+		args = append(args, time.Now().UTC())
+	}
+
+	rows, err := tx.Query(query+" RETURNING object_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanObjectIDs(rows)
+}
+
+// scanObjectIDs reads and closes rows of object IDs
+func scanObjectIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	objectIDs := []string{}
+	for rows.Next() {
+		var objectID string
+		if err := rows.Scan(&objectID); err != nil {
+			return nil, err
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	return objectIDs, rows.Err()
+}
+
+// scanObjectVersion reads a row selected with objectVersionColumns
+func scanObjectVersion(row rowScanner) (*types.ObjectVersion, error) {
+	var version types.ObjectVersion
+	var contentType sql.NullString
+
+	err := row.Scan(&version.Bucket, &version.Key, &version.Version, &version.ObjectID, &version.ETag,
+		&version.Size, &contentType, &version.IsCurrent, &version.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	version.ContentType = contentType.String
+	return &version, nil
+}
@@ -31,6 +31,15 @@ type MetricsCollector struct {
 	batchItemsProcessed int64
 	batchErrors     int64
 
+	// 完整性校验指标
+	scrubRuns         int64
+	scrubChecked      int64
+	scrubBytes        int64
+	scrubCorrupt      int64
+	scrubRepaired     int64
+	scrubUnrepaired   int64
+	lastScrubTime     int64 // UnixNano
+
 	// 系统指标
 	startTime       time.Time
 	lastUpdateTime  time.Time
@@ -231,6 +240,23 @@ func (mc *MetricsCollector) RecordBatchOperation(itemsCount int, hasError bool)
 	mc.recordDataPoint("batch_error_count", atomic.LoadInt64(&mc.batchErrors), now)
 }
 
+// 完整性校验指标记录方法
+
+// RecordScrub 记录一次完整性校验的结果
+func (mc *MetricsCollector) RecordScrub(checked int, bytes int64, corrupt, repaired int) {
+	atomic.AddInt64(&mc.scrubRuns, 1)
+	atomic.AddInt64(&mc.scrubChecked, int64(checked))
+	atomic.AddInt64(&mc.scrubBytes, bytes)
+	atomic.AddInt64(&mc.scrubCorrupt, int64(corrupt))
+	atomic.AddInt64(&mc.scrubRepaired, int64(repaired))
+	atomic.StoreInt64(&mc.scrubUnrepaired, int64(corrupt-repaired))
+
+	now := time.Now()
+	atomic.StoreInt64(&mc.lastScrubTime, now.UnixNano())
+	mc.recordDataPoint("scrub_checked", int64(checked), now)
+	mc.recordDataPoint("scrub_corrupt", int64(corrupt), now)
+}
+
 // 获取指标数据方法
 
 // GetHTTPMetrics 获取HTTP指标
@@ -297,6 +323,24 @@ func (mc *MetricsCollector) GetBatchMetrics() map[string]interface{} {
 	}
 }
 
+// GetIntegrityMetrics 获取完整性校验指标
+func (mc *MetricsCollector) GetIntegrityMetrics() map[string]interface{} {
+	var lastScrub interface{}
+	if nanos := atomic.LoadInt64(&mc.lastScrubTime); nanos > 0 {
+		lastScrub = time.Unix(0, nanos)
+	}
+
+	return map[string]interface{}{
+		"total_runs":        atomic.LoadInt64(&mc.scrubRuns),
+		"total_checked":     atomic.LoadInt64(&mc.scrubChecked),
+		"total_bytes_read":  atomic.LoadInt64(&mc.scrubBytes),
+		"total_corrupt":     atomic.LoadInt64(&mc.scrubCorrupt),
+		"total_repaired":    atomic.LoadInt64(&mc.scrubRepaired),
+		"unrepaired":        atomic.LoadInt64(&mc.scrubUnrepaired),
+		"last_scrub":        lastScrub,
+	}
+}
+
 // GetSystemMetrics 获取系统指标
 func (mc *MetricsCollector) GetSystemMetrics() map[string]interface{} {
 	uptime := time.Since(mc.startTime)
@@ -355,6 +399,7 @@ func (mc *MetricsCollector) GetAllMetrics() map[string]interface{} {
 		"files":  mc.GetFileMetrics(),
 		"batch":  mc.GetBatchMetrics(),
 		"system": mc.GetSystemMetrics(),
+		"integrity": mc.GetIntegrityMetrics(),
 		"timestamp": time.Now(),
 	}
 }
@@ -439,6 +439,22 @@ func (d *Dashboard) checkAlerts(metrics map[string]interface{}) []Alert {
 		}
 	}
 
+	// 检查完整性校验发现的损坏数据
+	if integrityMetrics, ok := metrics["integrity"].(map[string]interface{}); ok {
+		if unrepaired, ok := integrityMetrics["unrepaired"].(int64); ok {
+			if unrepaired > 0 {
+				alerts = append(alerts, Alert{
+					Level:     "error",
+					Title:     "发现无法修复的损坏数据",
+					Message:   fmt.Sprintf("最近一次校验有 %d 个对象损坏且未能修复，已隔离", unrepaired),
+					Timestamp: now,
+					Metric:    "integrity.unrepaired",
+					Value:     unrepaired,
+				})
+			}
+		}
+	}
+
 	return alerts
 }
 
@@ -278,6 +278,46 @@ func TestDashboard(t *testing.T) {
 	}
 }
 
+func TestIntegrityMetrics(t *testing.T) {
+	collector := NewMetricsCollector(&Config{Enabled: false})
+	dashboard := NewDashboard(collector)
+
+	// 没有校验记录时不应告警
+	for _, alert := range dashboard.checkAlerts(collector.GetAllMetrics()) {
+		if alert.Metric == "integrity.unrepaired" {
+			t.Error("Expected no integrity alert before any scrub")
+		}
+	}
+
+	collector.RecordScrub(10, 4096, 3, 1)
+
+	integrity := collector.GetIntegrityMetrics()
+	if integrity["total_checked"] != int64(10) || integrity["total_corrupt"] != int64(3) || integrity["unrepaired"] != int64(2) {
+		t.Errorf("Unexpected integrity metrics: %v", integrity)
+	}
+	if integrity["last_scrub"] == nil {
+		t.Error("Last scrub time should not be nil")
+	}
+
+	found := false
+	for _, alert := range dashboard.checkAlerts(collector.GetAllMetrics()) {
+		if alert.Metric == "integrity.unrepaired" {
+			found = alert.Level == "error" && alert.Value == int64(2)
+		}
+	}
+	if !found {
+		t.Error("Expected an error alert for unrepaired corruption")
+	}
+
+	// 全部修复后告警解除
+	collector.RecordScrub(10, 4096, 1, 1)
+	for _, alert := range dashboard.checkAlerts(collector.GetAllMetrics()) {
+		if alert.Metric == "integrity.unrepaired" {
+			t.Error("Expected the alert to clear once corruption is repaired")
+		}
+	}
+}
+
 func TestFormatBytes(t *testing.T) {
 	tests := []struct {
 		bytes     int64
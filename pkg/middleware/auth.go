@@ -227,6 +227,9 @@ func (a *Authentication) authenticateAPIKey(c *gin.Context) (*UserInfo, error) {
 	}
 	user.Metadata["auth_method"] = "api_key"
 
+	// Handlers charge quotas to the key by its fingerprint
+	c.Set("api_key", apiKey)
+
 	return user, nil
 }
 
@@ -298,7 +301,9 @@ func (a *Authentication) isPublicPath(path string) bool {
 			return true
 		}
 	}
-	return false
+
+	// Download links carry their own signature
+	return strings.HasPrefix(path, "/d/")
 }
 
 // RequireRole middleware to require specific roles
@@ -0,0 +1,357 @@
+// Package migrate moves stored content between storage backends while the
+// service keeps serving it, such as draining a full SSD onto a large HDD.
+//
+// A migration walks the source backend and moves every blob and chunk to the
+// target at a limited rate. Each one is copied before the original is
+// removed, so reads find it throughout. Progress is saved as the migration
+// goes, and a migration interrupted by a restart resumes where it stopped:
+// what was already moved has left the source.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/throttle"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultRateLimit is how many bytes per second a migration copies by default
+const DefaultRateLimit = 64 * 1024 * 1024
+
+// checkpointInterval is how often the progress of a migration is saved
+const checkpointInterval = time.Second
+
+// Migration errors
+var (
+	ErrMigrationInProgress = errors.New("storage migration already in progress")
+	ErrNotRunning          = errors.New("storage migration is not running")
+	ErrSameBackend         = errors.New("source and target backend are the same")
+)
+
+// Config configures the migrator
+type Config struct {
+	// RateLimit caps the bytes copied per second. Zero copies as fast as the disks allow.
+	RateLimit int64 `json:"rate_limit"`
+}
+
+// DefaultConfig returns the default migrator configuration
+func DefaultConfig() *Config {
+	return &Config{RateLimit: DefaultRateLimit}
+}
+
+// Migrator moves blobs and chunks between the backends of a storage, one
+// migration at a time
+type Migrator struct {
+	stores       []*service.Storage
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	mu      sync.Mutex
+	current *run
+}
+
+// run is a migration in progress
+type run struct {
+	migration types.Migration
+	cancel    context.CancelFunc
+	cancelled bool
+	done      chan struct{}
+}
+
+// NewMigrator creates a new migrator. chunks is the storage holding content
+// chunks, or nil if content is never chunked; it must share the backends of
+// storage (see service.Storage.Sub).
+func NewMigrator(storage, chunks *service.Storage, metadataRepo *repository.MetadataRepository, config *Config) *Migrator {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.RateLimit < 0 {
+		config.RateLimit = 0
+	}
+
+	stores := []*service.Storage{storage}
+	if chunks != nil {
+		stores = append(stores, chunks)
+	}
+
+	return &Migrator{
+		stores:       stores,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[MIGRATE] ", log.LstdFlags),
+	}
+}
+
+// Migrate starts moving every blob and chunk from the backend called from to
+// the one called to, in the background, until ctx is done. Blobs written to
+// from while it runs are not moved, so make to the primary backend first to
+// drain from.
+func (m *Migrator) Migrate(ctx context.Context, from, to string) (*types.Migration, error) {
+	if from == to {
+		return nil, ErrSameBackend
+	}
+	if err := m.checkBackends(from, to); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.current != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMigrationInProgress, m.current.migration.ID)
+	}
+
+	now := time.Now()
+	migration := &types.Migration{
+		ID:        uuid.New().String(),
+		Source:    from,
+		Target:    to,
+		Status:    types.MigrationRunning,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if err := m.metadataRepo.SaveMigration(migration); err != nil {
+		return nil, fmt.Errorf("failed to save migration: %w", err)
+	}
+
+	m.launch(ctx, migration)
+	return migration, nil
+}
+
+// Start resumes the migration that was running when the service last
+// stopped, if any
+func (m *Migrator) Start(ctx context.Context) {
+	migrations, err := m.metadataRepo.ListMigrations(types.MigrationRunning)
+	if err != nil {
+		m.logger.Printf("failed to list migrations: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, migration := range migrations {
+		// Only one migration runs at a time, so any older one was abandoned
+		if i > 0 || m.current != nil || m.checkBackends(migration.Source, migration.Target) != nil {
+			m.finish(migration, types.MigrationFailed, "backend no longer configured or migration superseded")
+			continue
+		}
+		m.logger.Printf("resuming migration %s from %s to %s", migration.ID, migration.Source, migration.Target)
+		m.launch(ctx, migration)
+	}
+}
+
+// Progress returns the migration in progress, or nil if none is running
+func (m *Migrator) Progress() *types.Migration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.current == nil {
+		return nil
+	}
+	migration := m.current.migration
+	return &migration
+}
+
+// Get returns the migration with id, with its live progress if it is running,
+// or nil if there is none
+func (m *Migrator) Get(id string) (*types.Migration, error) {
+	if current := m.Progress(); current != nil && current.ID == id {
+		return current, nil
+	}
+	return m.metadataRepo.GetMigration(id)
+}
+
+// Cancel stops the migration with id. Content already moved stays on the target.
+func (m *Migrator) Cancel(id string) error {
+	m.mu.Lock()
+	current := m.current
+	if current == nil || current.migration.ID != id {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotRunning, id)
+	}
+	current.cancelled = true
+	m.mu.Unlock()
+
+	current.cancel()
+	<-current.done
+	return nil
+}
+
+// Wait waits for the migration in progress to finish and returns it, or nil
+// if none is running
+func (m *Migrator) Wait(ctx context.Context) (*types.Migration, error) {
+	m.mu.Lock()
+	current := m.current
+	m.mu.Unlock()
+
+	if current == nil {
+		return nil, nil
+	}
+
+	select {
+	case <-current.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	migration := current.migration
+	return &migration, nil
+}
+
+// Stop interrupts the migration in progress and waits for it to return. Its
+// progress is saved and it stays running, so Start resumes it.
+func (m *Migrator) Stop() {
+	m.mu.Lock()
+	current := m.current
+	m.mu.Unlock()
+
+	if current == nil {
+		return
+	}
+	current.cancel()
+	<-current.done
+}
+
+// checkBackends checks that both backends exist
+func (m *Migrator) checkBackends(from, to string) error {
+	names := map[string]bool{}
+	for _, backend := range m.stores[0].Backends() {
+		names[backend.Name] = true
+	}
+	for _, name := range []string{from, to} {
+		if !names[name] {
+			return fmt.Errorf("%w: %s", service.ErrUnknownBackend, name)
+		}
+	}
+	return nil
+}
+
+// launch runs migration in the background. The caller holds m.mu.
+func (m *Migrator) launch(ctx context.Context, migration *types.Migration) {
+	ctx, cancel := context.WithCancel(ctx)
+	current := &run{migration: *migration, cancel: cancel, done: make(chan struct{})}
+	m.current = current
+
+	go func() {
+		defer close(current.done)
+		defer cancel()
+
+		err := m.run(ctx, current)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.current = nil
+
+		migration := &current.migration
+		switch {
+		case err == nil:
+			m.finish(migration, types.MigrationCompleted, "")
+			m.logger.Printf("migration %s finished: moved %d blobs (%d bytes) from %s to %s",
+				migration.ID, migration.BlobsMoved, migration.BytesMoved, migration.Source, migration.Target)
+		case current.cancelled:
+			m.finish(migration, types.MigrationCancelled, "")
+			m.logger.Printf("migration %s cancelled after moving %d blobs", migration.ID, migration.BlobsMoved)
+		case ctx.Err() != nil:
+			// Stopped with the service: leave it running so it resumes
+			m.save(migration)
+		default:
+			m.finish(migration, types.MigrationFailed, err.Error())
+			m.logger.Printf("migration %s failed: %v", migration.ID, err)
+		}
+	}()
+}
+
+// run moves everything on the source backend to the target
+func (m *Migrator) run(ctx context.Context, current *run) error {
+	m.mu.Lock()
+	from, to := current.migration.Source, current.migration.Target
+	m.mu.Unlock()
+
+	// Count what is left, so progress can be reported against it
+	var blobs, bytes int64
+	for _, storage := range m.stores {
+		err := storage.WalkBackend(from, func(hash string, info os.FileInfo) error {
+			blobs++
+			bytes += info.Size()
+			return ctx.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan backend %s: %w", from, err)
+		}
+	}
+
+	m.mu.Lock()
+	current.migration.BlobsTotal = current.migration.BlobsMoved + blobs
+	current.migration.BytesTotal = current.migration.BytesMoved + bytes
+	m.save(&current.migration)
+	m.mu.Unlock()
+
+	limit := throttle.NewLimiter(ctx, m.config.RateLimit)
+	checkpoint := time.Now()
+
+	for _, storage := range m.stores {
+		err := storage.WalkBackend(from, func(hash string, info os.FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// A blob already on the target was copied before an interruption
+			// but not yet counted, so it counts as moved either way
+			_, err := storage.Move(hash, to, limit.Reader)
+			if errors.Is(err, service.ErrFileNotFound) {
+				// Deleted while we walked
+				return nil
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("failed to move %s: %w", hash, err)
+			}
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			current.migration.BlobsMoved++
+			current.migration.BytesMoved += info.Size()
+			if time.Since(checkpoint) >= checkpointInterval {
+				m.save(&current.migration)
+				checkpoint = time.Now()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finish records the final status of migration. The caller holds m.mu if
+// the migration is in progress.
+func (m *Migrator) finish(migration *types.Migration, status, detail string) {
+	now := time.Now()
+	migration.Status = status
+	migration.Error = detail
+	migration.FinishedAt = &now
+	m.save(migration)
+}
+
+// save records the progress of migration
+func (m *Migrator) save(migration *types.Migration) {
+	migration.UpdatedAt = time.Now()
+	if err := m.metadataRepo.SaveMigration(migration); err != nil {
+		m.logger.Printf("failed to save migration %s: %v", migration.ID, err)
+	}
+}
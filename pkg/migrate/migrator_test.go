@@ -0,0 +1,189 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// newTestMigrator returns a migrator over fresh storage with an ssd and an hdd backend
+func newTestMigrator(t *testing.T, config *Config) (*Migrator, *service.Storage, *service.Storage, *repository.MetadataRepository) {
+	t.Helper()
+
+	tempDir := t.TempDir()
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	storage := service.NewStorage(filepath.Join(tempDir, "ssd"))
+	chunks := storage.Sub(".chunks")
+	if err := storage.AddBackend("hdd", filepath.Join(tempDir, "hdd")); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+
+	migrator := NewMigrator(storage, chunks, metadataRepo, config)
+	t.Cleanup(migrator.Stop)
+	return migrator, storage, chunks, metadataRepo
+}
+
+// fill stores n distinct blobs of size bytes and returns their hashes
+func fill(t *testing.T, storage *service.Storage, n, size int) []string {
+	t.Helper()
+
+	hashes := make([]string, n)
+	for i := range hashes {
+		data := append([]byte(fmt.Sprintf("%s %d ", storage.BasePath(), i)), bytes.Repeat([]byte{byte(i)}, size)...)
+		hash, err := storage.Store(data)
+		if err != nil {
+			t.Fatalf("Failed to store data: %v", err)
+		}
+		hashes[i] = hash
+	}
+	return hashes
+}
+
+// wait waits for the running migration to finish
+func wait(t *testing.T, migrator *Migrator) *types.Migration {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	migration, err := migrator.Wait(ctx)
+	if err != nil || migration == nil {
+		t.Fatalf("Failed to wait for migration: %v", err)
+	}
+	return migration
+}
+
+func TestMigrate(t *testing.T) {
+	migrator, storage, chunks, repo := newTestMigrator(t, &Config{})
+
+	blobs := fill(t, storage, 5, 1024)
+	chunkHashes := fill(t, chunks, 3, 512)
+
+	if _, err := migrator.Migrate(context.Background(), "ssd", "hdd"); !errors.Is(err, service.ErrUnknownBackend) {
+		t.Errorf("Expected ErrUnknownBackend, got %v", err)
+	}
+	if _, err := migrator.Migrate(context.Background(), "hdd", "hdd"); !errors.Is(err, ErrSameBackend) {
+		t.Errorf("Expected ErrSameBackend, got %v", err)
+	}
+
+	started, err := migrator.Migrate(context.Background(), service.DefaultBackend, "hdd")
+	if err != nil {
+		t.Fatalf("Failed to start migration: %v", err)
+	}
+	migration := wait(t, migrator)
+	if migration.Status != types.MigrationCompleted || migration.FinishedAt == nil {
+		t.Fatalf("Expected the migration to complete, got %+v", migration)
+	}
+	if migration.BlobsTotal != 8 || migration.BlobsMoved != 8 || migration.BytesMoved != migration.BytesTotal {
+		t.Errorf("Expected 8 blobs moved, got %+v", migration)
+	}
+
+	for _, hash := range blobs {
+		if backend, err := storage.BackendOf(hash); err != nil || backend != "hdd" {
+			t.Errorf("Expected %s on hdd, got %s (%v)", hash, backend, err)
+		}
+		if _, err := storage.Verify(hash, nil); err != nil {
+			t.Errorf("Expected %s to verify after the move: %v", hash, err)
+		}
+	}
+	for _, hash := range chunkHashes {
+		if backend, _ := chunks.BackendOf(hash); backend != "hdd" {
+			t.Errorf("Expected chunk %s on hdd, got %s", hash, backend)
+		}
+	}
+
+	saved, err := repo.GetMigration(started.ID)
+	if err != nil || saved == nil || saved.Status != types.MigrationCompleted || saved.BlobsMoved != 8 {
+		t.Errorf("Expected the completed migration on record, got %+v (%v)", saved, err)
+	}
+	if migrator.Progress() != nil {
+		t.Error("Expected no migration in progress")
+	}
+}
+
+func TestMigrateCancelAndResume(t *testing.T) {
+	// 8KiB per blob at 16KiB/s takes about two seconds for all four
+	migrator, storage, _, repo := newTestMigrator(t, &Config{RateLimit: 16 * 1024})
+	blobs := fill(t, storage, 4, 8*1024)
+
+	started, err := migrator.Migrate(context.Background(), service.DefaultBackend, "hdd")
+	if err != nil {
+		t.Fatalf("Failed to start migration: %v", err)
+	}
+	if _, err := migrator.Migrate(context.Background(), service.DefaultBackend, "hdd"); !errors.Is(err, ErrMigrationInProgress) {
+		t.Errorf("Expected ErrMigrationInProgress, got %v", err)
+	}
+
+	// Reads keep working while blobs move
+	deadline := time.Now().Add(700 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		for _, hash := range blobs {
+			if _, err := storage.Retrieve(hash); err != nil {
+				t.Fatalf("Expected %s readable during the migration: %v", hash, err)
+			}
+		}
+	}
+	progress := migrator.Progress()
+	if progress == nil || progress.BlobsTotal != 4 || progress.BlobsMoved == 4 {
+		t.Fatalf("Expected the migration part way, got %+v", progress)
+	}
+
+	// Stopping the service leaves it running on record
+	migrator.Stop()
+	saved, err := repo.GetMigration(started.ID)
+	if err != nil || saved.Status != types.MigrationRunning {
+		t.Fatalf("Expected the interrupted migration to stay running, got %+v (%v)", saved, err)
+	}
+	moved := saved.BlobsMoved
+
+	// A new migrator resumes it where it stopped
+	resumed := NewMigrator(storage, nil, repo, &Config{})
+	resumed.Start(context.Background())
+	migration := wait(t, resumed)
+	if migration.ID != started.ID || migration.Status != types.MigrationCompleted {
+		t.Fatalf("Expected the migration to resume and complete, got %+v", migration)
+	}
+	if migration.BlobsMoved != 4 || migration.BlobsMoved < moved {
+		t.Errorf("Expected all 4 blobs counted once, got %+v", migration)
+	}
+	for _, hash := range blobs {
+		if backend, _ := storage.BackendOf(hash); backend != "hdd" {
+			t.Errorf("Expected %s on hdd, got %s", hash, backend)
+		}
+	}
+
+	// Cancelling stops a migration for good
+	slow := NewMigrator(storage, nil, repo, &Config{RateLimit: 1024})
+	t.Cleanup(slow.Stop)
+	back, err := slow.Migrate(context.Background(), "hdd", service.DefaultBackend)
+	if err != nil {
+		t.Fatalf("Failed to start migration: %v", err)
+	}
+	if err := slow.Cancel("unknown"); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+	if err := slow.Cancel(back.ID); err != nil {
+		t.Fatalf("Failed to cancel migration: %v", err)
+	}
+	cancelled, err := slow.Get(back.ID)
+	if err != nil || cancelled.Status != types.MigrationCancelled {
+		t.Errorf("Expected the migration cancelled, got %+v (%v)", cancelled, err)
+	}
+
+	slow.Start(context.Background())
+	if slow.Progress() != nil {
+		t.Error("Expected a cancelled migration not to resume")
+	}
+}
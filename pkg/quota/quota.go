@@ -0,0 +1,303 @@
+// Package quota enforces limits on how much is stored: a global cap on the
+// whole store, and quotas per uploader and per API key on bytes and objects.
+//
+// Uploads reserve their size before content is written, so concurrent uploads
+// cannot together overshoot a quota, and settle once the actual size is known.
+// The global cap is charged by what storage actually holds, each distinct
+// content once, while uploaders and API keys are charged for every object in
+// full regardless of dedup. Those quotas are only enforced when uploaders and
+// API keys are authenticated, since clients could otherwise name any.
+package quota
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Quota errors. An ExceededError wraps ErrStorageFull when the global cap is
+// reached and ErrQuotaExceeded when an uploader or API key quota is.
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrStorageFull   = errors.New("storage capacity exceeded")
+)
+
+// Limited resources
+const (
+	ResourceBytes   = "bytes"
+	ResourceObjects = "objects"
+)
+
+// ErrSubjectsDisabled is returned for a quota on an uploader or API key while
+// they are not authenticated
+var ErrSubjectsDisabled = errors.New("uploader and API key quotas require authentication")
+
+// Config holds the global limits that apply while no global quota is set
+// through the repository. Zero means unlimited.
+type Config struct {
+	MaxBytes   int64 `json:"max_bytes"`
+	MaxObjects int64 `json:"max_objects"`
+	// Subjects enforces the quotas of uploaders and API keys. Enable it only
+	// when every request is authenticated.
+	Subjects bool `json:"subjects"`
+}
+
+// Owner identifies who an upload is charged to. Either may be empty, in which
+// case only the global quota applies to that side.
+type Owner struct {
+	User     string
+	APIKeyID string
+}
+
+// APIKeyID returns the fingerprint an API key is recorded and limited by, so
+// the key itself is never stored
+func APIKeyID(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ExceededError describes the quota an upload would exceed
+type ExceededError struct {
+	Scope     string `json:"scope"`
+	Subject   string `json:"subject,omitempty"`
+	Resource  string `json:"resource"`
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used"`
+	Requested int64  `json:"requested"`
+}
+
+// Error implements error
+func (e *ExceededError) Error() string {
+	name := e.Scope
+	if e.Subject != "" {
+		name += " " + e.Subject
+	}
+	return fmt.Sprintf("%s: %s quota of %s is %d, %d used, %d requested", e.Unwrap(), e.Resource, name, e.Limit, e.Used, e.Requested)
+}
+
+// Unwrap returns ErrStorageFull or ErrQuotaExceeded
+func (e *ExceededError) Unwrap() error {
+	if e.Scope == types.QuotaScopeGlobal {
+		return ErrStorageFull
+	}
+	return ErrQuotaExceeded
+}
+
+// scopeKey identifies one scope and subject
+type scopeKey struct {
+	scope   string
+	subject string
+}
+
+// pending is what reservations not yet settled hold in one scope
+type pending struct {
+	bytes   int64
+	objects int64
+}
+
+// Enforcer checks uploads against quotas
+type Enforcer struct {
+	repo   *repository.MetadataRepository
+	config *Config
+
+	mu      sync.Mutex
+	pending map[scopeKey]*pending
+}
+
+// NewEnforcer creates an enforcer over the quotas and usage in repo
+func NewEnforcer(repo *repository.MetadataRepository, config *Config) *Enforcer {
+	if config == nil {
+		config = &Config{}
+	}
+	return &Enforcer{
+		repo:    repo,
+		config:  config,
+		pending: make(map[scopeKey]*pending),
+	}
+}
+
+// SubjectsEnabled reports whether the quotas of uploaders and API keys are enforced
+func (e *Enforcer) SubjectsEnabled() bool {
+	return e.config.Subjects
+}
+
+// CheckScope returns ErrSubjectsDisabled for an uploader or API key scope
+// while their quotas are not enforced
+func (e *Enforcer) CheckScope(scope string) error {
+	if scope != types.QuotaScopeGlobal && !e.config.Subjects {
+		return fmt.Errorf("%w: %s", ErrSubjectsDisabled, scope)
+	}
+	return nil
+}
+
+// Limits returns the quota in effect for a scope and subject, or nil if it is
+// unlimited. The global quota falls back to the configured limits.
+func (e *Enforcer) Limits(scope, subject string) (*types.Quota, error) {
+	quota, err := e.repo.GetQuota(scope, subject)
+	if err != nil || quota != nil {
+		return quota, err
+	}
+	if scope == types.QuotaScopeGlobal && (e.config.MaxBytes > 0 || e.config.MaxObjects > 0) {
+		return &types.Quota{
+			Scope:      types.QuotaScopeGlobal,
+			MaxBytes:   e.config.MaxBytes,
+			MaxObjects: e.config.MaxObjects,
+		}, nil
+	}
+	return nil, nil
+}
+
+// Check reports whether owner may store objects more objects totalling bytes,
+// without reserving anything
+func (e *Enforcer) Check(owner Owner, bytes, objects int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, key := range e.scopesOf(owner) {
+		if err := e.check(key, bytes, objects); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reserve checks that owner may store one more object of size bytes and holds
+// that much against its quotas until the reservation is released. Pass zero
+// if the size is not known yet, and Extend once it is.
+func (e *Enforcer) Reserve(owner Owner, bytes int64) (*Reservation, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	keys := e.scopesOf(owner)
+	for _, key := range keys {
+		if err := e.check(key, bytes, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	e.hold(keys, bytes, 1)
+	return &Reservation{enforcer: e, keys: keys, bytes: bytes}, nil
+}
+
+// check compares usage and pending reservations of one scope with its quota
+func (e *Enforcer) check(key scopeKey, bytes, objects int64) error {
+	quota, err := e.Limits(key.scope, key.subject)
+	if err != nil {
+		return fmt.Errorf("failed to load %s quota: %w", key.scope, err)
+	}
+	if quota == nil || (quota.MaxBytes <= 0 && quota.MaxObjects <= 0) {
+		return nil
+	}
+
+	usage, err := e.repo.GetUsage(key.scope, key.subject)
+	if err != nil {
+		return fmt.Errorf("failed to load %s usage: %w", key.scope, err)
+	}
+	used := usage.Bytes
+	if key.scope == types.QuotaScopeGlobal {
+		used = usage.UniqueBytes
+	}
+	usedObjects := usage.Objects
+	if held := e.pending[key]; held != nil {
+		used += held.bytes
+		usedObjects += held.objects
+	}
+
+	if quota.MaxBytes > 0 && bytes > 0 && used+bytes > quota.MaxBytes {
+		return &ExceededError{Scope: key.scope, Subject: key.subject, Resource: ResourceBytes, Limit: quota.MaxBytes, Used: used, Requested: bytes}
+	}
+	if quota.MaxObjects > 0 && objects > 0 && usedObjects+objects > quota.MaxObjects {
+		return &ExceededError{Scope: key.scope, Subject: key.subject, Resource: ResourceObjects, Limit: quota.MaxObjects, Used: usedObjects, Requested: objects}
+	}
+	return nil
+}
+
+// hold adds bytes and objects to the pending reservations of keys
+func (e *Enforcer) hold(keys []scopeKey, bytes, objects int64) {
+	for _, key := range keys {
+		held := e.pending[key]
+		if held == nil {
+			held = &pending{}
+			e.pending[key] = held
+		}
+		held.bytes += bytes
+		held.objects += objects
+		if held.bytes == 0 && held.objects == 0 {
+			delete(e.pending, key)
+		}
+	}
+}
+
+// scopesOf returns the scopes an upload by owner is charged to
+func (e *Enforcer) scopesOf(owner Owner) []scopeKey {
+	keys := []scopeKey{{scope: types.QuotaScopeGlobal}}
+	if !e.config.Subjects {
+		return keys
+	}
+	if owner.User != "" {
+		keys = append(keys, scopeKey{scope: types.QuotaScopeUser, subject: owner.User})
+	}
+	if owner.APIKeyID != "" {
+		keys = append(keys, scopeKey{scope: types.QuotaScopeAPIKey, subject: owner.APIKeyID})
+	}
+	return keys
+}
+
+// Reservation holds room for one upload against its owner's quotas
+type Reservation struct {
+	enforcer *Enforcer
+	keys     []scopeKey
+	bytes    int64
+	released bool
+}
+
+// Extend grows the reservation to bytes once the upload's actual size is
+// known, failing if that no longer fits a quota
+func (r *Reservation) Extend(bytes int64) error {
+	if r == nil || bytes <= r.bytes {
+		return nil
+	}
+
+	e := r.enforcer
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if r.released {
+		return errors.New("quota reservation already released")
+	}
+	for _, key := range r.keys {
+		if err := e.check(key, bytes-r.bytes, 0); err != nil {
+			return err
+		}
+	}
+	e.hold(r.keys, bytes-r.bytes, 0)
+	r.bytes = bytes
+	return nil
+}
+
+// Release gives up the reservation. Call it once the upload is committed, when
+// its usage is counted from the repository, or has failed. A nil reservation
+// may be released.
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+
+	e := r.enforcer
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if r.released {
+		return
+	}
+	r.released = true
+	e.hold(r.keys, -r.bytes, -1)
+}
@@ -0,0 +1,226 @@
+package quota
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// newTestEnforcer returns an enforcer over a fresh repository
+func newTestEnforcer(t *testing.T, config *Config) (*Enforcer, *repository.MetadataRepository) {
+	t.Helper()
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	return NewEnforcer(metadataRepo, config), metadataRepo
+}
+
+// saveObject records an object of size bytes with content hash for owner
+func saveObject(t *testing.T, repo *repository.MetadataRepository, hash string, size int64, owner Owner) {
+	t.Helper()
+
+	err := repo.SaveMetadata(&types.FileMetadata{
+		Hash:       hash,
+		FileName:   "file",
+		Size:       size,
+		UploadedBy: owner.User,
+		APIKeyID:   owner.APIKeyID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+}
+
+// setQuota saves a quota
+func setQuota(t *testing.T, repo *repository.MetadataRepository, quota *types.Quota) {
+	t.Helper()
+
+	if err := repo.SaveQuota(quota); err != nil {
+		t.Fatalf("Failed to save quota: %v", err)
+	}
+}
+
+// exceeded returns the ExceededError err wraps, failing if there is none
+func exceeded(t *testing.T, err error) *ExceededError {
+	t.Helper()
+
+	var exceededErr *ExceededError
+	if !errors.As(err, &exceededErr) {
+		t.Fatalf("Expected an ExceededError, got %v", err)
+	}
+	return exceededErr
+}
+
+func TestUserQuota(t *testing.T) {
+	enforcer, repo := newTestEnforcer(t, &Config{Subjects: true})
+	alice := Owner{User: "alice"}
+
+	setQuota(t, repo, &types.Quota{Scope: types.QuotaScopeUser, Subject: "alice", MaxBytes: 100, MaxObjects: 3})
+	saveObject(t, repo, "sha1:aa", 60, alice)
+
+	if err := enforcer.Check(alice, 40, 1); err != nil {
+		t.Errorf("Expected an upload filling the quota to pass: %v", err)
+	}
+
+	err := enforcer.Check(alice, 41, 1)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if e := exceeded(t, err); e.Resource != ResourceBytes || e.Limit != 100 || e.Used != 60 || e.Requested != 41 {
+		t.Errorf("Unexpected error details: %+v", e)
+	}
+
+	// Another uploader is not limited by alice's quota
+	if err := enforcer.Check(Owner{User: "bob"}, 1000, 1); err != nil {
+		t.Errorf("Expected bob to be unlimited: %v", err)
+	}
+
+	// The object count is limited too
+	saveObject(t, repo, "sha1:bb", 1, alice)
+	saveObject(t, repo, "sha1:cc", 1, alice)
+	if e := exceeded(t, enforcer.Check(alice, 1, 1)); e.Resource != ResourceObjects {
+		t.Errorf("Expected the objects quota to be exceeded, got %s", e.Resource)
+	}
+}
+
+func TestAPIKeyQuota(t *testing.T) {
+	enforcer, repo := newTestEnforcer(t, &Config{Subjects: true})
+	keyID := APIKeyID("secret-key")
+	if keyID == "secret-key" || keyID != APIKeyID("secret-key") {
+		t.Fatalf("Expected a stable fingerprint, got %s", keyID)
+	}
+
+	setQuota(t, repo, &types.Quota{Scope: types.QuotaScopeAPIKey, Subject: keyID, MaxBytes: 50})
+	saveObject(t, repo, "sha1:aa", 30, Owner{User: "alice", APIKeyID: keyID})
+
+	// The key's quota applies whoever uploads with it
+	if e := exceeded(t, enforcer.Check(Owner{User: "bob", APIKeyID: keyID}, 30, 1)); e.Scope != types.QuotaScopeAPIKey {
+		t.Errorf("Expected the API key quota to be exceeded, got %s", e.Scope)
+	}
+	if err := enforcer.Check(Owner{User: "bob"}, 30, 1); err != nil {
+		t.Errorf("Expected an upload without the key to pass: %v", err)
+	}
+}
+
+func TestSubjectsDisabled(t *testing.T) {
+	enforcer, repo := newTestEnforcer(t, &Config{MaxBytes: 100})
+	alice := Owner{User: "alice", APIKeyID: APIKeyID("secret-key")}
+	setQuota(t, repo, &types.Quota{Scope: types.QuotaScopeUser, Subject: "alice", MaxBytes: 10})
+
+	// Unauthenticated uploaders name themselves, so only the global cap applies
+	if err := enforcer.Check(alice, 50, 1); err != nil {
+		t.Errorf("Expected only the global cap to apply: %v", err)
+	}
+	if err := enforcer.Check(alice, 101, 1); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("Expected ErrStorageFull, got %v", err)
+	}
+
+	if err := enforcer.CheckScope(types.QuotaScopeUser); !errors.Is(err, ErrSubjectsDisabled) {
+		t.Errorf("Expected ErrSubjectsDisabled, got %v", err)
+	}
+	if err := enforcer.CheckScope(types.QuotaScopeGlobal); err != nil {
+		t.Errorf("Expected the global scope to be allowed: %v", err)
+	}
+}
+
+func TestGlobalQuota(t *testing.T) {
+	enforcer, repo := newTestEnforcer(t, &Config{MaxBytes: 100})
+
+	// Identical content is held once, so it counts once against the global cap
+	saveObject(t, repo, "sha1:aa", 40, Owner{User: "alice"})
+	saveObject(t, repo, "sha1:aa", 40, Owner{User: "bob"})
+
+	usage, err := repo.GetUsage(types.QuotaScopeGlobal, "")
+	if err != nil {
+		t.Fatalf("Failed to get usage: %v", err)
+	}
+	if usage.Bytes != 80 || usage.UniqueBytes != 40 || usage.Objects != 2 {
+		t.Errorf("Expected 80 logical and 40 unique bytes in 2 objects, got %+v", usage)
+	}
+
+	if err := enforcer.Check(Owner{}, 60, 1); err != nil {
+		t.Errorf("Expected an upload within the cap to pass: %v", err)
+	}
+	if err := enforcer.Check(Owner{}, 61, 1); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("Expected ErrStorageFull, got %v", err)
+	}
+
+	// A global quota set through the repository replaces the configured cap
+	setQuota(t, repo, &types.Quota{Scope: types.QuotaScopeGlobal, MaxBytes: 1000})
+	if err := enforcer.Check(Owner{}, 61, 1); err != nil {
+		t.Errorf("Expected the stored global quota to apply: %v", err)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	enforcer, repo := newTestEnforcer(t, &Config{Subjects: true})
+	alice := Owner{User: "alice"}
+	setQuota(t, repo, &types.Quota{Scope: types.QuotaScopeUser, Subject: "alice", MaxBytes: 100})
+
+	first, err := enforcer.Reserve(alice, 70)
+	if err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+
+	// Concurrent uploads cannot together overshoot the quota
+	if _, err := enforcer.Reserve(alice, 40); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the second reservation to be refused, got %v", err)
+	}
+
+	// An upload of unknown size is checked again once its size is known
+	second, err := enforcer.Reserve(alice, 0)
+	if err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	if err := second.Extend(40); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected extending past the quota to fail, got %v", err)
+	}
+	if err := second.Extend(30); err != nil {
+		t.Errorf("Expected extending within the quota to pass: %v", err)
+	}
+	second.Release()
+
+	first.Release()
+	first.Release()
+	if err := enforcer.Check(alice, 100, 1); err != nil {
+		t.Errorf("Expected released reservations to free the quota: %v", err)
+	}
+	if len(enforcer.pending) != 0 {
+		t.Errorf("Expected no pending reservations, got %d", len(enforcer.pending))
+	}
+}
+
+func TestListUsage(t *testing.T) {
+	_, repo := newTestEnforcer(t, nil)
+
+	saveObject(t, repo, "sha1:aa", 10, Owner{User: "alice"})
+	saveObject(t, repo, "sha1:aa", 10, Owner{User: "alice"})
+	saveObject(t, repo, "sha1:bb", 5, Owner{User: "alice"})
+	saveObject(t, repo, "sha1:cc", 7, Owner{User: "bob"})
+
+	usages, err := repo.ListUsage(types.QuotaScopeUser)
+	if err != nil {
+		t.Fatalf("Failed to list usage: %v", err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("Expected usage of 2 uploaders, got %d", len(usages))
+	}
+	alice := usages[0]
+	if alice.Subject != "alice" || alice.Objects != 3 || alice.Bytes != 25 || alice.UniqueBytes != 15 {
+		t.Errorf("Unexpected usage of alice: %+v", alice)
+	}
+
+	if _, err := repo.GetUsage(types.QuotaScopeUser, ""); err == nil {
+		t.Error("Expected a user scope without a subject to be rejected")
+	}
+	if err := repo.SaveQuota(&types.Quota{Scope: "team", Subject: "x"}); err == nil {
+		t.Error("Expected an unknown scope to be rejected")
+	}
+}
@@ -0,0 +1,238 @@
+// Package rehash records secondary digests for stored blobs so that content
+// addressed by one hash algorithm can also be found by another.
+package rehash
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+)
+
+// DefaultBatchSize is how many blobs are read from the repository at a time
+const DefaultBatchSize = 100
+
+// ErrRunInProgress is returned when a backfill is requested while one is already running
+var ErrRunInProgress = errors.New("digest backfill already in progress")
+
+// Config configures the backfiller
+type Config struct {
+	// Algorithms are the digests recorded for every blob not already addressed by them
+	Algorithms []string `json:"algorithms"`
+	// BatchSize is how many blobs are read from the repository at a time
+	BatchSize int `json:"batch_size"`
+	// Interval between background runs. Zero disables them.
+	Interval time.Duration `json:"interval"`
+}
+
+// DefaultConfig returns the default backfiller configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Algorithms: []string{digest.SHA256.Name},
+		BatchSize:  DefaultBatchSize,
+	}
+}
+
+// Report is the outcome of a single backfill
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	Algorithms      []string `json:"algorithms"`
+	BlobsHashed     int      `json:"blobs_hashed"`
+	BytesHashed     int64    `json:"bytes_hashed"`
+	DigestsRecorded int      `json:"digests_recorded"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Backfiller computes missing secondary digests for stored blobs
+type Backfiller struct {
+	storage      fileservice.Storage
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	algorithms   []*digest.Algorithm
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewBackfiller creates a new digest backfiller
+func NewBackfiller(storage fileservice.Storage, metadataRepo *repository.MetadataRepository, config *Config) (*Backfiller, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = DefaultConfig().Algorithms
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	algorithms := make([]*digest.Algorithm, 0, len(config.Algorithms))
+	for _, name := range config.Algorithms {
+		algorithm, err := digest.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+
+	return &Backfiller{
+		storage:      storage,
+		metadataRepo: metadataRepo,
+		config:       config,
+		algorithms:   algorithms,
+		logger:       log.New(os.Stdout, "[REHASH] ", log.LstdFlags),
+	}, nil
+}
+
+// LastReport returns the report of the most recent backfill, or nil if none has run
+func (b *Backfiller) LastReport() *Report {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.lastReport
+}
+
+// Run records every missing digest. Only one backfill runs at a time.
+func (b *Backfiller) Run(ctx context.Context) (*Report, error) {
+	if !b.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer b.running.Unlock()
+
+	report := &Report{
+		StartedAt:  time.Now(),
+		Algorithms: make([]string, 0, len(b.algorithms)),
+	}
+
+	for _, algorithm := range b.algorithms {
+		report.Algorithms = append(report.Algorithms, algorithm.Name)
+		if err := b.backfill(ctx, algorithm, report); err != nil {
+			return nil, err
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	b.logger.Printf("backfill finished: hashed %d blobs (%d bytes), recorded %d digests, %d errors",
+		report.BlobsHashed, report.BytesHashed, report.DigestsRecorded, len(report.Errors))
+
+	b.mu.Lock()
+	b.lastReport = report
+	b.mu.Unlock()
+
+	return report, nil
+}
+
+// backfill records algorithm digests for every blob that lacks one
+func (b *Backfiller) backfill(ctx context.Context, algorithm *digest.Algorithm, report *Report) error {
+	// Blobs that failed stay missing, so they are skipped for the rest of the run
+	failed := make(map[string]bool)
+
+	for {
+		hashes, err := b.metadataRepo.BlobsMissingDigest(algorithm.Name, b.config.BatchSize+len(failed))
+		if err != nil {
+			return fmt.Errorf("failed to list blobs missing %s digest: %w", algorithm.Name, err)
+		}
+
+		progressed := false
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if failed[hash] {
+				continue
+			}
+			progressed = true
+
+			if err := b.record(algorithm, hash, report); err != nil {
+				failed[hash] = true
+				report.Errors = append(report.Errors, err.Error())
+			}
+		}
+
+		if !progressed {
+			return nil
+		}
+	}
+}
+
+// record hashes one blob with algorithm and saves the digest
+func (b *Backfiller) record(algorithm *digest.Algorithm, hash string, report *Report) error {
+	reader, err := b.storage.Open(hash)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", hash, err)
+	}
+	defer reader.Close()
+
+	h := algorithm.New()
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", hash, err)
+	}
+	report.BlobsHashed++
+	report.BytesHashed += n
+
+	if err := b.metadataRepo.SaveDigest(hash, algorithm.Name, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return fmt.Errorf("failed to save %s digest for %s: %w", algorithm.Name, hash, err)
+	}
+	report.DigestsRecorded++
+	return nil
+}
+
+// Start runs a backfill immediately and then every configured interval until
+// Stop is called. It does nothing if no interval is configured.
+func (b *Backfiller) Start(ctx context.Context) {
+	if b.config.Interval <= 0 || b.stop != nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+
+	go func() {
+		defer close(b.done)
+
+		ticker := time.NewTicker(b.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := b.Run(ctx); err != nil && !errors.Is(err, ErrRunInProgress) {
+				b.logger.Printf("backfill failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background runs and waits for a running backfill to finish
+func (b *Backfiller) Stop() {
+	if b.stop == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+	b.stop = nil
+}
@@ -0,0 +1,90 @@
+package rehash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestBackfiller(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_rehash")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Legacy content addressed by SHA-1
+	storage := service.NewStorageWithAlgorithm(filepath.Join(tempDir, "storage"), digest.SHA1)
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	data := []byte("legacy content")
+	hash, err := storage.Store(data)
+	if err != nil {
+		t.Fatalf("Failed to store blob: %v", err)
+	}
+	if err := metadataRepo.SaveMetadata(&types.FileMetadata{Hash: hash, FileName: "legacy.txt", Size: int64(len(data))}); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+
+	// A blob record whose content is gone must not stall the backfill
+	missing := "0123456789abcdef0123456789abcdef01234567"
+	if err := metadataRepo.SaveMetadata(&types.FileMetadata{Hash: missing, FileName: "missing.txt", Size: 4}); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+
+	backfiller, err := NewBackfiller(storage, metadataRepo, &Config{
+		Algorithms: []string{"sha256", "blake3"},
+		BatchSize:  1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create backfiller: %v", err)
+	}
+
+	report, err := backfiller.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if report.DigestsRecorded != 2 {
+		t.Errorf("Expected 2 digests recorded, got %d", report.DigestsRecorded)
+	}
+	if len(report.Errors) != 2 {
+		t.Errorf("Expected the missing blob to fail once per algorithm, got %v", report.Errors)
+	}
+
+	sha256ID := digest.Sum(digest.SHA256, data)
+	found, err := metadataRepo.FindBlobByDigest("sha256", digest.Hex(sha256ID))
+	if err != nil || found != hash {
+		t.Errorf("Expected SHA-256 digest to resolve to %s, got %q (%v)", hash, found, err)
+	}
+
+	digests, err := metadataRepo.GetDigests(hash)
+	if err != nil {
+		t.Fatalf("Failed to get digests: %v", err)
+	}
+	if digests["blake3"] != digest.Hex(digest.Sum(digest.BLAKE3, data)) {
+		t.Errorf("Unexpected BLAKE3 digest: %v", digests)
+	}
+
+	// A second run has nothing left to do
+	report, err = backfiller.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if report.DigestsRecorded != 0 {
+		t.Errorf("Expected nothing to backfill, got %d", report.DigestsRecorded)
+	}
+
+	if _, err := NewBackfiller(storage, metadataRepo, &Config{Algorithms: []string{"md5"}}); err == nil {
+		t.Error("Expected error for unknown algorithm")
+	}
+}
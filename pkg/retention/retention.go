@@ -0,0 +1,286 @@
+// Package retention keeps objects immutable for audit and compliance.
+//
+// An object retained until a time may not be deleted, overwritten or have
+// its metadata changed before then. In governance mode privileged roles may
+// bypass retention, and every bypass is audited; in compliance mode nobody
+// may, and the retention period can only be extended. An object under legal
+// hold is protected the same way, whatever its retention, until the hold is
+// released, which only privileged roles may do.
+//
+// Buckets may carry a default retention that every object written to them
+// without one of its own receives.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Retention errors
+var (
+	ErrLocked           = errors.New("object is locked by retention or a legal hold")
+	ErrInvalidRetention = errors.New("invalid retention")
+	ErrObjectNotFound   = errors.New("object not found")
+)
+
+// Changes retention guards against, as recorded in the audit trail
+const (
+	ActionDelete           = "delete"
+	ActionPurge            = "purge"
+	ActionUpdateMetadata   = "update_metadata"
+	ActionDeleteMetadata   = "delete_metadata"
+	ActionMove             = "move"
+	ActionShortenRetention = "shorten_retention"
+	ActionReleaseLegalHold = "release_legal_hold"
+)
+
+// DefaultBypassRole is the role allowed to bypass governance retention by default
+const DefaultBypassRole = "admin"
+
+// Config configures retention enforcement
+type Config struct {
+	// BypassRoles are the roles allowed to bypass governance retention and
+	// to release legal holds
+	BypassRoles []string `json:"bypass_roles"`
+}
+
+// DefaultConfig returns the default retention configuration
+func DefaultConfig() *Config {
+	return &Config{BypassRoles: []string{DefaultBypassRole}}
+}
+
+// bypassKey is the context key of the actor bypassing governance retention
+type bypassKey struct{}
+
+// WithBypass returns a context under which changes are made by actor
+// bypassing governance retention. Callers must make sure actor holds one of
+// the roles Privileged accepts.
+func WithBypass(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, bypassKey{}, actor)
+}
+
+// bypassOf returns the actor bypassing governance retention under ctx, if any
+func bypassOf(ctx context.Context) (string, bool) {
+	actor, ok := ctx.Value(bypassKey{}).(string)
+	return actor, ok
+}
+
+// Enforcer decides which changes retention and legal holds allow
+type Enforcer struct {
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+}
+
+// NewEnforcer creates a new retention enforcer
+func NewEnforcer(metadataRepo *repository.MetadataRepository, config *Config) *Enforcer {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Enforcer{
+		metadataRepo: metadataRepo,
+		config:       config,
+	}
+}
+
+// Privileged reports whether any of roles may bypass governance retention
+func (e *Enforcer) Privileged(roles []string) bool {
+	for _, role := range roles {
+		for _, allowed := range e.config.BypassRoles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check returns ErrLocked unless action may be applied to every one of
+// objects now. Objects in governance mode allow it under a context made with
+// WithBypass, and each such bypass is recorded in the audit trail.
+func (e *Enforcer) Check(ctx context.Context, action string, objects ...*types.FileMetadata) error {
+	now := time.Now()
+	if err := e.permit(ctx, now, objects); err != nil {
+		return err
+	}
+
+	for _, metadata := range objects {
+		if metadata.Locked(now) {
+			if err := e.record(ctx, metadata, action, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Permit returns ErrLocked unless every one of objects may be changed now,
+// as Check does, without recording anything. It suits checks made ahead of
+// changes that are checked again, and recorded, as they are made.
+func (e *Enforcer) Permit(ctx context.Context, objects ...*types.FileMetadata) error {
+	return e.permit(ctx, time.Now(), objects)
+}
+
+// permit returns ErrLocked for the first of objects that may not be changed at now
+func (e *Enforcer) permit(ctx context.Context, now time.Time, objects []*types.FileMetadata) error {
+	_, bypass := bypassOf(ctx)
+	for _, metadata := range objects {
+		switch {
+		case !metadata.Locked(now):
+		case metadata.LegalHold:
+			return fmt.Errorf("%w: %s is under legal hold", ErrLocked, metadata.ID)
+		case metadata.RetentionMode == types.RetentionGovernance && bypass:
+		default:
+			return fmt.Errorf("%w: %s is retained in %s mode until %s", ErrLocked,
+				metadata.ID, metadata.RetentionMode, metadata.RetainUntil.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// record adds a change made to a locked object to the audit trail
+func (e *Enforcer) record(ctx context.Context, metadata *types.FileMetadata, action string, now time.Time) error {
+	actor, _ := bypassOf(ctx)
+	record := &types.RetentionRecord{
+		ObjectID:      metadata.ID,
+		Action:        action,
+		Actor:         actor,
+		RetentionMode: metadata.RetentionMode,
+		RetainUntil:   metadata.RetainUntil,
+		LegalHold:     metadata.LegalHold,
+		CreatedAt:     now,
+	}
+	if err := e.metadataRepo.SaveRetentionRecord(record); err != nil {
+		return fmt.Errorf("failed to record retention bypass on %s: %w", metadata.ID, err)
+	}
+	return nil
+}
+
+// SetRetention retains object id in mode until retainUntil, or removes its
+// retention when mode is empty. Retention may always be extended or made
+// stricter. Shortening or removing governance retention that still runs is a
+// bypass, and compliance retention that still runs can only be extended.
+func (e *Enforcer) SetRetention(ctx context.Context, id, mode string, retainUntil *time.Time) (*types.FileMetadata, error) {
+	now := time.Now()
+	switch mode {
+	case "":
+		retainUntil = nil
+	case types.RetentionGovernance, types.RetentionCompliance:
+		if retainUntil == nil || !retainUntil.After(now) {
+			return nil, fmt.Errorf("%w: retain_until must be in the future", ErrInvalidRetention)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidRetention, mode)
+	}
+
+	metadata, err := e.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Retained(now) && weakens(metadata, mode, retainUntil) {
+		// A legal hold does not stop retention from being changed
+		current := *metadata
+		current.LegalHold = false
+		if err := e.Check(ctx, ActionShortenRetention, &current); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := e.metadataRepo.SetObjectRetention(id, mode, retainUntil); err != nil {
+		return nil, fmt.Errorf("failed to set retention: %w", err)
+	}
+	metadata.RetentionMode, metadata.RetainUntil = mode, retainUntil
+	return metadata, nil
+}
+
+// weakens reports whether retaining an object in mode until retainUntil
+// protects it less than its current retention does
+func weakens(metadata *types.FileMetadata, mode string, retainUntil *time.Time) bool {
+	if mode == "" {
+		return true
+	}
+	if metadata.RetentionMode == types.RetentionCompliance && mode != types.RetentionCompliance {
+		return true
+	}
+	return retainUntil.Before(*metadata.RetainUntil)
+}
+
+// SetLegalHold places object id under legal hold, or releases the hold.
+// Releasing a hold requires a context made with WithBypass and is recorded
+// in the audit trail.
+func (e *Enforcer) SetLegalHold(ctx context.Context, id string, hold bool) (*types.FileMetadata, error) {
+	metadata, err := e.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.LegalHold && !hold {
+		if _, ok := bypassOf(ctx); !ok {
+			return nil, fmt.Errorf("%w: only a privileged role may release the legal hold on %s", ErrLocked, id)
+		}
+		if err := e.record(ctx, metadata, ActionReleaseLegalHold, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := e.metadataRepo.SetObjectLegalHold(id, hold); err != nil {
+		return nil, fmt.Errorf("failed to set legal hold: %w", err)
+	}
+	metadata.LegalHold = hold
+	return metadata, nil
+}
+
+// ApplyDefault gives object id the default retention of bucket, counted from
+// now, unless the bucket has none or the object already has retention
+func (e *Enforcer) ApplyDefault(bucket *types.Bucket, id string) error {
+	if bucket.RetentionMode == "" || bucket.RetentionDays <= 0 {
+		return nil
+	}
+
+	metadata, err := e.lookup(id)
+	if err != nil {
+		return err
+	}
+	if metadata.RetentionMode != "" {
+		return nil
+	}
+
+	retainUntil := time.Now().AddDate(0, 0, bucket.RetentionDays)
+	if _, err := e.metadataRepo.SetObjectRetention(id, bucket.RetentionMode, &retainUntil); err != nil {
+		return fmt.Errorf("failed to apply default retention: %w", err)
+	}
+	return nil
+}
+
+// ValidateDefault checks a bucket's default retention
+func ValidateDefault(mode string, days int) error {
+	switch {
+	case mode == "" && days == 0:
+		return nil
+	case mode != types.RetentionGovernance && mode != types.RetentionCompliance:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidRetention, mode)
+	case days <= 0:
+		return fmt.Errorf("%w: retention_days must be positive", ErrInvalidRetention)
+	}
+	return nil
+}
+
+// Records returns up to limit of the most recent audit records, newest
+// first, only those of object id if it is not empty
+func (e *Enforcer) Records(id string, limit int) ([]*types.RetentionRecord, error) {
+	return e.metadataRepo.ListRetentionRecords(id, limit)
+}
+
+// lookup returns the metadata of object id
+func (e *Enforcer) lookup(id string) (*types.FileMetadata, error) {
+	metadata, err := e.metadataRepo.GetMetadata(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,183 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestEnforcer(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_retention")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	enforcer := NewEnforcer(metadataRepo, nil)
+	ctx := context.Background()
+	bypass := WithBypass(ctx, "auditor")
+
+	save := func() *types.FileMetadata {
+		t.Helper()
+		metadata := &types.FileMetadata{
+			Hash:       "0123456789abcdef",
+			FileName:   "record.txt",
+			UploadedAt: time.Now(),
+		}
+		if err := metadataRepo.SaveMetadata(metadata); err != nil {
+			t.Fatalf("Failed to save metadata: %v", err)
+		}
+		return metadata
+	}
+	hour := time.Now().Add(time.Hour)
+	twoHours := time.Now().Add(2 * time.Hour)
+
+	t.Run("Privileged", func(t *testing.T) {
+		if !enforcer.Privileged([]string{"user", DefaultBypassRole}) {
+			t.Error("Expected the default bypass role to be privileged")
+		}
+		if enforcer.Privileged([]string{"user"}) || enforcer.Privileged(nil) {
+			t.Error("Expected other roles not to be privileged")
+		}
+	})
+
+	t.Run("InvalidRetention", func(t *testing.T) {
+		metadata := save()
+		past := time.Now().Add(-time.Hour)
+		for _, until := range []*time.Time{nil, &past} {
+			if _, err := enforcer.SetRetention(ctx, metadata.ID, types.RetentionGovernance, until); !errors.Is(err, ErrInvalidRetention) {
+				t.Errorf("Expected ErrInvalidRetention for %v, got %v", until, err)
+			}
+		}
+		if _, err := enforcer.SetRetention(ctx, metadata.ID, "archive", &hour); !errors.Is(err, ErrInvalidRetention) {
+			t.Errorf("Expected ErrInvalidRetention for an unknown mode, got %v", err)
+		}
+		if _, err := enforcer.SetRetention(ctx, "missing", types.RetentionGovernance, &hour); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Expected ErrObjectNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Governance", func(t *testing.T) {
+		metadata, err := enforcer.SetRetention(ctx, save().ID, types.RetentionGovernance, &hour)
+		if err != nil {
+			t.Fatalf("Failed to set retention: %v", err)
+		}
+		if err := enforcer.Check(ctx, ActionDelete, metadata); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked, got %v", err)
+		}
+		if _, err := enforcer.SetRetention(ctx, metadata.ID, "", nil); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected removing retention to need a bypass, got %v", err)
+		}
+		if _, err := enforcer.SetRetention(ctx, metadata.ID, types.RetentionGovernance, &twoHours); err != nil {
+			t.Errorf("Expected extending retention to be allowed, got %v", err)
+		}
+
+		if err := enforcer.Check(bypass, ActionDelete, metadata); err != nil {
+			t.Fatalf("Expected a bypass to be allowed, got %v", err)
+		}
+		if _, err := enforcer.SetRetention(bypass, metadata.ID, "", nil); err != nil {
+			t.Fatalf("Expected removing retention with a bypass to be allowed, got %v", err)
+		}
+
+		records, err := enforcer.Records(metadata.ID, 10)
+		if err != nil {
+			t.Fatalf("Failed to list records: %v", err)
+		}
+		if len(records) != 2 || records[0].Action != ActionShortenRetention || records[1].Action != ActionDelete ||
+			records[1].Actor != "auditor" || records[1].RetentionMode != types.RetentionGovernance {
+			t.Errorf("Unexpected audit records %+v", records)
+		}
+	})
+
+	t.Run("Compliance", func(t *testing.T) {
+		metadata, err := enforcer.SetRetention(ctx, save().ID, types.RetentionCompliance, &twoHours)
+		if err != nil {
+			t.Fatalf("Failed to set retention: %v", err)
+		}
+		if err := enforcer.Check(bypass, ActionDelete, metadata); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected compliance retention not to be bypassed, got %v", err)
+		}
+		if _, err := enforcer.SetRetention(bypass, metadata.ID, types.RetentionCompliance, &hour); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected shortening compliance retention to be refused, got %v", err)
+		}
+		if _, err := enforcer.SetRetention(bypass, metadata.ID, types.RetentionGovernance, &twoHours); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected weakening compliance retention to be refused, got %v", err)
+		}
+	})
+
+	t.Run("LegalHold", func(t *testing.T) {
+		metadata, err := enforcer.SetLegalHold(ctx, save().ID, true)
+		if err != nil {
+			t.Fatalf("Failed to place legal hold: %v", err)
+		}
+		if err := enforcer.Check(bypass, ActionDelete, metadata); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected a legal hold not to be bypassed, got %v", err)
+		}
+		if _, err := enforcer.SetLegalHold(ctx, metadata.ID, false); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected releasing the hold to need a bypass, got %v", err)
+		}
+		metadata, err = enforcer.SetLegalHold(bypass, metadata.ID, false)
+		if err != nil {
+			t.Fatalf("Failed to release legal hold: %v", err)
+		}
+		if err := enforcer.Check(ctx, ActionDelete, metadata); err != nil {
+			t.Errorf("Expected a released object to be unlocked, got %v", err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		metadata := save()
+		past := time.Now().Add(-time.Minute)
+		metadata.RetentionMode, metadata.RetainUntil = types.RetentionCompliance, &past
+		if err := enforcer.Check(ctx, ActionDelete, metadata); err != nil {
+			t.Errorf("Expected retention that ended not to lock, got %v", err)
+		}
+	})
+
+	t.Run("ApplyDefault", func(t *testing.T) {
+		if err := ValidateDefault(types.RetentionGovernance, 0); !errors.Is(err, ErrInvalidRetention) {
+			t.Errorf("Expected ErrInvalidRetention, got %v", err)
+		}
+		if err := ValidateDefault("", 0); err != nil {
+			t.Errorf("Expected no default retention to be valid, got %v", err)
+		}
+
+		bucket := &types.Bucket{Name: "vault", RetentionMode: types.RetentionCompliance, RetentionDays: 7}
+		metadata := save()
+		if err := enforcer.ApplyDefault(bucket, metadata.ID); err != nil {
+			t.Fatalf("Failed to apply default retention: %v", err)
+		}
+		metadata, err := metadataRepo.GetMetadata(metadata.ID)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if metadata.RetentionMode != types.RetentionCompliance || metadata.RetainUntil == nil ||
+			metadata.RetainUntil.Before(time.Now().AddDate(0, 0, 6)) {
+			t.Errorf("Expected seven days of compliance retention, got %+v", metadata)
+		}
+
+		// Objects with retention of their own keep it
+		own, err := enforcer.SetRetention(ctx, save().ID, types.RetentionGovernance, &hour)
+		if err != nil {
+			t.Fatalf("Failed to set retention: %v", err)
+		}
+		if err := enforcer.ApplyDefault(bucket, own.ID); err != nil {
+			t.Fatalf("Failed to apply default retention: %v", err)
+		}
+		if own, _ = metadataRepo.GetMetadata(own.ID); own.RetentionMode != types.RetentionGovernance {
+			t.Errorf("Expected the object's own retention to be kept, got %s", own.RetentionMode)
+		}
+	})
+}
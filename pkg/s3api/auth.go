@@ -0,0 +1,300 @@
+package s3api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature Version 4 constants
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	scopeDateFormat = "20060102"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// emptySHA256 is the hex SHA-256 of no bytes
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxClockSkew is how far a request's date may be from the server's clock
+	maxClockSkew = 15 * time.Minute
+	// maxPresignExpiry is the longest a presigned URL may be valid for
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// signature is a verified Signature Version 4 request signature
+type signature struct {
+	accessKey string
+	date      time.Time
+	scope     string
+	key       []byte // signing key derived for the scope
+	value     string // hex signature, which seeds the chunk signatures of a streaming payload
+	payload   string // the x-amz-content-sha256 the request was signed with
+}
+
+// authenticate verifies the Signature Version 4 signature of r, carried
+// either in the Authorization header or, for presigned URLs, in the query
+func (g *Gateway) authenticate(r *http.Request, now time.Time) (*signature, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return g.authenticateHeader(r, auth, now)
+	}
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return g.authenticatePresigned(r, now)
+	}
+	return nil, errAccessDenied
+}
+
+// authenticateHeader verifies a signature carried in the Authorization header
+func (g *Gateway) authenticateHeader(r *http.Request, auth string, now time.Time) (*signature, error) {
+	if !strings.HasPrefix(auth, signV4Algorithm+" ") {
+		return nil, errUnsupportedAuthentication
+	}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, signV4Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, errAuthorizationMalformed
+		}
+		fields[name] = value
+	}
+	credential, signedHeaders, provided := fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+	if credential == "" || signedHeaders == "" || provided == "" {
+		return nil, errAuthorizationMalformed
+	}
+
+	dateStr := r.Header.Get("X-Amz-Date")
+	if dateStr == "" {
+		dateStr = r.Header.Get("Date")
+	}
+	date, err := time.Parse(amzDateFormat, dateStr)
+	if err != nil {
+		if date, err = http.ParseTime(dateStr); err != nil {
+			return nil, errAccessDenied
+		}
+	}
+	if date.Sub(now) > maxClockSkew || now.Sub(date) > maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		return nil, errMissingContentSHA256
+	}
+	if !validPayload(payload) {
+		return nil, errContentSHA256Mismatch
+	}
+
+	return g.verify(r, credential, strings.Split(signedHeaders, ";"), r.URL.Query(), date, payload, provided)
+}
+
+// authenticatePresigned verifies a signature carried in the query of a presigned URL
+func (g *Gateway) authenticatePresigned(r *http.Request, now time.Time) (*signature, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, errUnsupportedAuthentication
+	}
+
+	credential, signedHeaders, provided := query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature")
+	if credential == "" || signedHeaders == "" || provided == "" {
+		return nil, errAuthorizationMalformed
+	}
+
+	date, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationMalformed
+	}
+	seconds, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+		return nil, errAuthorizationMalformed
+	}
+	if date.Sub(now) > maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	if now.After(date.Add(time.Duration(seconds) * time.Second)) {
+		return nil, errExpiredRequest
+	}
+
+	payload := query.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = unsignedPayload
+	}
+
+	query.Del("X-Amz-Signature")
+	return g.verify(r, credential, strings.Split(signedHeaders, ";"), query, date, payload, provided)
+}
+
+// verify checks the signature provided for r against the one computed with
+// the configured secret key
+func (g *Gateway) verify(r *http.Request, credential string, signedHeaders []string, query url.Values, date time.Time, payload, provided string) (*signature, error) {
+	// Credential is <access key>/<date>/<region>/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return nil, errAuthorizationMalformed
+	}
+	accessKey, scopeDate, region := parts[0], parts[1], parts[2]
+	if scopeDate != date.Format(scopeDateFormat) {
+		return nil, errAuthorizationMalformed
+	}
+	if subtle.ConstantTimeCompare([]byte(accessKey), []byte(g.config.AccessKey)) != 1 {
+		return nil, errInvalidAccessKeyID
+	}
+
+	// Every x-amz- header changes how the request is handled, so must be signed
+	signed := map[string]bool{}
+	for _, name := range signedHeaders {
+		signed[name] = true
+	}
+	if !signed["host"] {
+		return nil, errAuthorizationMalformed
+	}
+	for name := range r.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") && lower != "x-amz-content-sha256" && !signed[lower] {
+			return nil, errAccessDenied
+		}
+	}
+
+	scope := strings.Join(parts[1:], "/")
+	canonical := canonicalRequest(r, signedHeaders, query, payload)
+	stringToSign := strings.Join([]string{
+		signV4Algorithm,
+		date.Format(amzDateFormat),
+		scope,
+		hashHex([]byte(canonical)),
+	}, "\n")
+
+	key := signingKey(g.config.SecretKey, scopeDate, region)
+	expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(provided)) {
+		return nil, errSignatureDoesNotMatch
+	}
+
+	return &signature{
+		accessKey: accessKey,
+		date:      date,
+		scope:     scope,
+		key:       key,
+		value:     expected,
+		payload:   payload,
+	}, nil
+}
+
+// canonicalRequest builds the canonical form of r that is signed
+func canonicalRequest(r *http.Request, signedHeaders []string, query url.Values, payload string) string {
+	headers := make([]string, len(signedHeaders))
+	for i, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+			if values := r.Header.Values("Content-Length"); len(values) > 0 {
+				value = values[0]
+			}
+		default:
+			var values []string
+			for _, v := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		headers[i] = name + ":" + value + "\n"
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL),
+		canonicalQuery(query),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+// canonicalURI returns the path of u URI-encoded the way S3 signs it. Each
+// segment is decoded and encoded again, so an encoded slash within a key
+// stays encoded.
+func canonicalURI(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segment = decoded
+		}
+		segments[i] = uriEncode(segment, true)
+	}
+
+	uri := strings.Join(segments, "/")
+	if uri == "" {
+		return "/"
+	}
+	return uri
+}
+
+// canonicalQuery returns query URI-encoded and sorted by name, then value
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters,
+// and slashes too if encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+// signingKey derives the key requests scoped to date and region are signed with
+func signingKey(secretKey, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte("s3"))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// hashHex returns the hex SHA-256 of data
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
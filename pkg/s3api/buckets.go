@@ -0,0 +1,320 @@
+package s3api
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/buckets"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// maxListKeys is the most keys and common prefixes a listing returns
+const maxListKeys = buckets.MaxListKeys
+
+// timeFormat is how S3 formats times in XML
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// owner is the owner of every bucket and object
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// listAllMyBucketsResult is the response to ListBuckets
+type listAllMyBucketsResult struct {
+	XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner         `xml:"Owner"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// locationConstraint is the response to GetBucketLocation
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+// listBucketResult is the response to ListObjects and ListObjectsV2
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []objectEntry  `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type objectEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+	Owner        *owner `xml:"Owner,omitempty"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listBuckets handles ListBuckets
+func (g *Gateway) listBuckets(c *gin.Context) {
+	buckets, err := g.metadataRepo.ListBuckets()
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	result := &listAllMyBucketsResult{Owner: g.owner(), Buckets: []bucketEntry{}}
+	for _, bucket := range buckets {
+		result.Buckets = append(result.Buckets, bucketEntry{
+			Name:         bucket.Name,
+			CreationDate: bucket.CreatedAt.UTC().Format(timeFormat),
+		})
+	}
+	writeXML(c, http.StatusOK, result)
+}
+
+// createBucket handles CreateBucket. The location constraint in the body, if
+// any, is ignored.
+func (g *Gateway) createBucket(c *gin.Context, bucket string) {
+	if !validBucketName(bucket) {
+		writeError(c, errInvalidBucketName)
+		return
+	}
+
+	created, err := g.metadataRepo.CreateBucket(bucket, time.Now())
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+	if !created {
+		writeError(c, errBucketAlreadyOwnedByYou)
+		return
+	}
+
+	c.Header("Location", "/"+bucket)
+	c.Status(http.StatusOK)
+}
+
+// headBucket handles HeadBucket
+func (g *Gateway) headBucket(c *gin.Context, bucket string) {
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+	c.Header("x-amz-bucket-region", g.config.Region)
+	c.Status(http.StatusOK)
+}
+
+// deleteBucket handles DeleteBucket, which only deletes empty buckets
+func (g *Gateway) deleteBucket(c *gin.Context, bucket string) {
+	if err := g.metadataRepo.DeleteBucket(bucket); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrBucketNotFound):
+			writeError(c, errNoSuchBucket)
+		case errors.Is(err, repository.ErrBucketNotEmpty):
+			writeError(c, errBucketNotEmpty)
+		default:
+			g.fail(c, err)
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getBucketLocation handles GetBucketLocation. Buckets in us-east-1 have an
+// empty location.
+func (g *Gateway) getBucketLocation(c *gin.Context, bucket string) {
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	location := g.config.Region
+	if location == DefaultRegion {
+		location = ""
+	}
+	writeXML(c, http.StatusOK, &locationConstraint{Location: location})
+}
+
+// listObjects handles ListObjects, which pages with a marker key
+func (g *Gateway) listObjects(c *gin.Context, bucket string) {
+	query := c.Request.URL.Query()
+	prefix, delimiter, marker := query.Get("prefix"), query.Get("delimiter"), query.Get("marker")
+
+	maxKeys, ok := parseMaxKeys(c)
+	if !ok {
+		return
+	}
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	page, err := g.buckets.List(bucket, prefix, delimiter, marker, maxKeys)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	encode := keyEncoder(query.Get("encoding-type"))
+	encodedMarker := encode(marker)
+	result := &listBucketResult{
+		Name:         bucket,
+		Prefix:       encode(prefix),
+		Marker:       &encodedMarker,
+		MaxKeys:      maxKeys,
+		Delimiter:    encode(delimiter),
+		EncodingType: query.Get("encoding-type"),
+		IsTruncated:  page.Truncated,
+	}
+	if page.Truncated {
+		result.NextMarker = encode(page.Last)
+	}
+	g.fillListing(result, page, encode, true)
+	writeXML(c, http.StatusOK, result)
+}
+
+// listObjectsV2 handles ListObjectsV2, which pages with an opaque continuation token
+func (g *Gateway) listObjectsV2(c *gin.Context, bucket string) {
+	query := c.Request.URL.Query()
+	prefix, delimiter, startAfter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("start-after"), query.Get("continuation-token")
+
+	maxKeys, ok := parseMaxKeys(c)
+	if !ok {
+		return
+	}
+
+	after := startAfter
+	if token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			writeError(c, &apiError{"InvalidArgument", "The continuation token provided is incorrect.", http.StatusBadRequest})
+			return
+		}
+		after = string(decoded)
+	}
+
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	page, err := g.buckets.List(bucket, prefix, delimiter, after, maxKeys)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	encode := keyEncoder(query.Get("encoding-type"))
+	keyCount := len(page.Entries) + len(page.Prefixes)
+	result := &listBucketResult{
+		Name:              bucket,
+		Prefix:            encode(prefix),
+		StartAfter:        encode(startAfter),
+		ContinuationToken: token,
+		KeyCount:          &keyCount,
+		MaxKeys:           maxKeys,
+		Delimiter:         encode(delimiter),
+		EncodingType:      query.Get("encoding-type"),
+		IsTruncated:       page.Truncated,
+	}
+	if page.Truncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(page.Last))
+	}
+	g.fillListing(result, page, encode, query.Get("fetch-owner") == "true")
+	writeXML(c, http.StatusOK, result)
+}
+
+// fillListing adds the keys and common prefixes of page to result
+func (g *Gateway) fillListing(result *listBucketResult, page *buckets.Listing, encode func(string) string, withOwner bool) {
+	for _, entry := range page.Entries {
+		object := objectEntry{
+			Key:          encode(entry.Key),
+			LastModified: entry.ModifiedAt.UTC().Format(timeFormat),
+			ETag:         `"` + entry.ETag + `"`,
+			Size:         entry.Size,
+			StorageClass: "STANDARD",
+		}
+		if withOwner {
+			o := g.owner()
+			object.Owner = &o
+		}
+		result.Contents = append(result.Contents, object)
+	}
+	for _, prefix := range page.Prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(prefix)})
+	}
+}
+
+// bucket returns the bucket called name, responding with NoSuchBucket if there is none
+func (g *Gateway) bucket(c *gin.Context, name string) (*types.Bucket, bool) {
+	bucket, err := g.metadataRepo.GetBucket(name)
+	if err != nil {
+		g.fail(c, err)
+		return nil, false
+	}
+	if bucket == nil {
+		writeError(c, errNoSuchBucket)
+		return nil, false
+	}
+	return bucket, true
+}
+
+// owner returns the owner of every bucket and object, which is the holder of
+// the configured access key
+func (g *Gateway) owner() owner {
+	return owner{ID: g.config.AccessKey, DisplayName: g.config.AccessKey}
+}
+
+// parseMaxKeys reads the max-keys query parameter, responding with an error if it is invalid
+func parseMaxKeys(c *gin.Context) (int, bool) {
+	value := c.Query("max-keys")
+	if value == "" {
+		return maxListKeys, true
+	}
+
+	maxKeys, err := strconv.Atoi(value)
+	if err != nil || maxKeys < 0 {
+		writeError(c, &apiError{"InvalidArgument", "Argument max-keys must be an integer between 0 and 2147483647.", http.StatusBadRequest})
+		return 0, false
+	}
+	if maxKeys > maxListKeys {
+		maxKeys = maxListKeys
+	}
+	return maxKeys, true
+}
+
+// keyEncoder returns how keys are encoded in a listing: URL-encoded if the
+// client asked for encoding-type=url, as is otherwise
+func keyEncoder(encodingType string) func(string) string {
+	if encodingType == "url" {
+		return func(s string) string {
+			return uriEncode(s, false)
+		}
+	}
+	return func(s string) string {
+		return s
+	}
+}
+
+// validBucketName reports whether name follows the S3 bucket naming rules
+func validBucketName(name string) bool {
+	return buckets.ValidBucketName(name)
+}
@@ -0,0 +1,99 @@
+package s3api
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiError is an S3 error response
+type apiError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+// Error implements error
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// S3 errors the gateway responds with
+var (
+	errAccessDenied              = &apiError{"AccessDenied", "Access Denied.", http.StatusForbidden}
+	errAuthorizationMalformed    = &apiError{"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	errBadDigest                 = &apiError{"BadDigest", "The Content-MD5 you specified did not match what we received.", http.StatusBadRequest}
+	errBucketAlreadyOwnedByYou   = &apiError{"BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.", http.StatusConflict}
+	errBucketNotEmpty            = &apiError{"BucketNotEmpty", "The bucket you tried to delete is not empty.", http.StatusConflict}
+	errContentSHA256Mismatch     = &apiError{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	errEntityTooLarge            = &apiError{"EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", http.StatusBadRequest}
+	errEntityTooSmall            = &apiError{"EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.", http.StatusBadRequest}
+	errExpiredRequest            = &apiError{"AccessDenied", "Request has expired.", http.StatusForbidden}
+	errIncompleteBody            = &apiError{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", http.StatusBadRequest}
+	errInternalError             = &apiError{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+	errInvalidAccessKeyID        = &apiError{"InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.", http.StatusForbidden}
+	errInvalidArgument           = &apiError{"InvalidArgument", "Invalid Argument.", http.StatusBadRequest}
+	errInvalidBucketName         = &apiError{"InvalidBucketName", "The specified bucket is not valid.", http.StatusBadRequest}
+	errInvalidDigest             = &apiError{"InvalidDigest", "The Content-MD5 you specified is not valid.", http.StatusBadRequest}
+	errInvalidObjectState        = &apiError{"InvalidObjectState", "The object is being restored from cold storage. Retry the request later.", http.StatusForbidden}
+	errInvalidPart               = &apiError{"InvalidPart", "One or more of the specified parts could not be found. The part might not have been uploaded, or the specified entity tag might not have matched the part's entity tag.", http.StatusBadRequest}
+	errInvalidPartNumber         = &apiError{"InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive.", http.StatusBadRequest}
+	errInvalidPartOrder          = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number.", http.StatusBadRequest}
+	errInvalidRange              = &apiError{"InvalidRange", "The requested range is not satisfiable.", http.StatusRequestedRangeNotSatisfiable}
+	errInvalidRequest            = &apiError{"InvalidRequest", "Invalid Request.", http.StatusBadRequest}
+	errKeyTooLong                = &apiError{"KeyTooLongError", "Your key is too long.", http.StatusBadRequest}
+	errMalformedXML              = &apiError{"MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.", http.StatusBadRequest}
+	errMethodNotAllowed          = &apiError{"MethodNotAllowed", "The specified method is not allowed against this resource.", http.StatusMethodNotAllowed}
+	errMissingContentSHA256      = &apiError{"InvalidRequest", "Missing required header for this request: x-amz-content-sha256.", http.StatusBadRequest}
+	errNoSuchBucket              = &apiError{"NoSuchBucket", "The specified bucket does not exist.", http.StatusNotFound}
+	errNoSuchKey                 = &apiError{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	errNoSuchUpload              = &apiError{"NoSuchUpload", "The specified multipart upload does not exist. The upload ID might be invalid, or the multipart upload might have been aborted or completed.", http.StatusNotFound}
+	errNotImplemented            = &apiError{"NotImplemented", "A header or query you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+	errObjectLocked              = &apiError{"AccessDenied", "Access Denied because object protected by object lock.", http.StatusForbidden}
+	errPreconditionFailed        = &apiError{"PreconditionFailed", "At least one of the preconditions you specified did not hold.", http.StatusPreconditionFailed}
+	errQuotaExceeded             = &apiError{"QuotaExceeded", "Storage quota exceeded.", http.StatusForbidden}
+	errRequestTimeTooSkewed      = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	errSignatureDoesNotMatch     = &apiError{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	errUnsupportedAuthentication = &apiError{"AccessDenied", "Only AWS Signature Version 4 is supported.", http.StatusForbidden}
+)
+
+// errorResponse is the body of an S3 error response
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// writeError responds with err, which is reported as an internal error unless
+// it is an *apiError. Responses to HEAD requests carry no body.
+func writeError(c *gin.Context, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = errInternalError
+	}
+
+	if c.Request.Method == http.MethodHead {
+		c.Status(e.Status)
+		return
+	}
+
+	writeXML(c, e.Status, &errorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  c.Request.URL.Path,
+		RequestID: c.Writer.Header().Get("x-amz-request-id"),
+	})
+}
+
+// writeXML responds with v encoded as XML
+func writeXML(c *gin.Context, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(status, "application/xml", append([]byte(xml.Header), body...))
+}
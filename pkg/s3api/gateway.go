@@ -0,0 +1,361 @@
+// Package s3api implements an S3-compatible HTTP front end. Requests are
+// authenticated with AWS Signature Version 4 against one configured key pair,
+// and buckets and keys map onto objects of the deduplicating file service, so
+// identical content put under many keys is stored once.
+//
+// Only path-style addressing is supported: the bucket is the first segment of
+// the path and the key the rest of it.
+package s3api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/buckets"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/retention"
+	fileservice "github.com/zots0127/io/pkg/service"
+)
+
+// DefaultRegion is the region buckets are reported in when none is configured
+const DefaultRegion = "us-east-1"
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// signatureKey is the gin context key holding the request's verified signature
+const signatureKey = "s3.signature"
+
+// DefaultUploadExpiration is how long a multipart upload is kept after its last activity
+const DefaultUploadExpiration = 24 * time.Hour
+
+// DefaultCleanupInterval is how often expired multipart uploads are removed
+const DefaultCleanupInterval = 10 * time.Minute
+
+// Config configures the gateway
+type Config struct {
+	// AccessKey and SecretKey are the credentials requests must be signed with
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"-"`
+	// Region is reported as the location of every bucket
+	Region string `json:"region"`
+	// Dir stages the parts of multipart uploads until they are completed
+	Dir string `json:"dir"`
+	// UploadExpiration is how long a multipart upload is kept after its last activity
+	UploadExpiration time.Duration `json:"upload_expiration"`
+	// CleanupInterval is how often expired multipart uploads are removed
+	CleanupInterval time.Duration `json:"cleanup_interval"`
+	// Versioning keeps earlier versions of a key when it is written
+	Versioning bool `json:"versioning"`
+	// Retention keeps objects locked by retention or a legal hold from being
+	// deleted or overwritten. Nil protects nothing.
+	Retention *retention.Enforcer `json:"-"`
+}
+
+// Gateway serves the S3 API
+type Gateway struct {
+	fileService  fileservice.FileService
+	metadataRepo *repository.MetadataRepository
+	buckets      *buckets.Store
+	config       *Config
+	router       *gin.Engine
+	server       *http.Server
+	logger       *log.Logger
+
+	uploadLocks sync.Map // multipart upload ID -> *sync.Mutex
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// NewGateway creates a gateway storing objects through fileService and
+// keeping buckets in metadataRepo
+func NewGateway(fileService fileservice.FileService, metadataRepo *repository.MetadataRepository, config *Config) *Gateway {
+	if config.Region == "" {
+		config.Region = DefaultRegion
+	}
+	if config.Dir == "" {
+		config.Dir = filepath.Join(os.TempDir(), "io-s3-multipart")
+	}
+	if config.UploadExpiration <= 0 {
+		config.UploadExpiration = DefaultUploadExpiration
+	}
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = DefaultCleanupInterval
+	}
+
+	g := &Gateway{
+		fileService:  fileService,
+		metadataRepo: metadataRepo,
+		buckets:      buckets.NewStore(fileService, metadataRepo, &buckets.Config{Versioning: config.Versioning, Retention: config.Retention}),
+		config:       config,
+		logger:       log.New(os.Stdout, "[S3] ", log.LstdFlags),
+	}
+	g.router = g.newRouter()
+	return g
+}
+
+// newRouter routes requests to the S3 operations they name
+func (g *Gateway) newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.RedirectTrailingSlash = false
+	router.RedirectFixedPath = false
+	router.Use(g.authenticated)
+
+	router.GET("/", g.listBuckets)
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete} {
+		router.Handle(method, "/:bucket", g.bucketOperation)
+		router.Handle(method, "/:bucket/*key", g.objectOperation)
+	}
+	router.NoRoute(func(c *gin.Context) {
+		writeError(c, errMethodNotAllowed)
+	})
+
+	return router
+}
+
+// ServeHTTP implements http.Handler
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.router.ServeHTTP(w, r)
+}
+
+// Start serves the gateway on addr in the background, removing expired
+// multipart uploads every cleanup interval, until Stop is called
+func (g *Gateway) Start(addr string) error {
+	if g.config.AccessKey == "" || g.config.SecretKey == "" {
+		return fmt.Errorf("S3 access key and secret key are required")
+	}
+	if g.server != nil {
+		return fmt.Errorf("S3 gateway already started")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	server := &http.Server{Handler: g, ReadHeaderTimeout: 30 * time.Second}
+	g.server = server
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			g.logger.Printf("Server stopped: %v", err)
+		}
+	}()
+	g.startCleanup()
+
+	g.logger.Printf("Serving S3 API on %s", listener.Addr())
+	return nil
+}
+
+// Stop stops serving, waiting for requests in flight until ctx is done, and
+// stops the background cleanup
+func (g *Gateway) Stop(ctx context.Context) error {
+	if g.server == nil {
+		return nil
+	}
+	err := g.server.Shutdown(ctx)
+	g.server = nil
+
+	close(g.stop)
+	<-g.done
+	g.stop = nil
+	return err
+}
+
+// startCleanup removes expired multipart uploads every cleanup interval until stop is closed
+func (g *Gateway) startCleanup() {
+	g.stop = make(chan struct{})
+	g.done = make(chan struct{})
+
+	go func() {
+		defer close(g.done)
+
+		ticker := time.NewTicker(g.config.CleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := g.CleanExpiredUploads(); err != nil {
+					g.logger.Printf("Cleanup failed: %v", err)
+				}
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// authenticated rejects requests without a valid signature
+func (g *Gateway) authenticated(c *gin.Context) {
+	c.Header("x-amz-request-id", strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:16]))
+	c.Header("Server", "io")
+
+	sig, err := g.authenticate(c.Request, time.Now())
+	if err != nil {
+		writeError(c, err)
+		c.Abort()
+		return
+	}
+
+	c.Set(signatureKey, sig)
+	c.Next()
+}
+
+// bucketOperation handles requests addressing a bucket
+func (g *Gateway) bucketOperation(c *gin.Context) {
+	bucket := c.Param("bucket")
+	query := c.Request.URL.Query()
+
+	for name := range query {
+		if unsupportedBucketSubresources[name] {
+			writeError(c, errNotImplemented)
+			return
+		}
+	}
+
+	switch c.Request.Method {
+	case http.MethodPut:
+		g.createBucket(c, bucket)
+	case http.MethodHead:
+		g.headBucket(c, bucket)
+	case http.MethodDelete:
+		g.deleteBucket(c, bucket)
+	case http.MethodPost:
+		if _, ok := query["delete"]; ok {
+			g.deleteObjects(c, bucket)
+			return
+		}
+		writeError(c, errNotImplemented)
+	case http.MethodGet:
+		if _, ok := query["location"]; ok {
+			g.getBucketLocation(c, bucket)
+			return
+		}
+		if _, ok := query["uploads"]; ok {
+			g.listMultipartUploads(c, bucket)
+			return
+		}
+		if query.Get("list-type") == "2" {
+			g.listObjectsV2(c, bucket)
+			return
+		}
+		g.listObjects(c, bucket)
+	}
+}
+
+// objectOperation handles requests addressing a key in a bucket
+func (g *Gateway) objectOperation(c *gin.Context) {
+	bucket := c.Param("bucket")
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		g.bucketOperation(c)
+		return
+	}
+
+	for name := range c.Request.URL.Query() {
+		if unsupportedObjectSubresources[name] {
+			writeError(c, errNotImplemented)
+			return
+		}
+	}
+	if len(key) > maxKeyLength {
+		writeError(c, errKeyTooLong)
+		return
+	}
+
+	query := c.Request.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch c.Request.Method {
+	case http.MethodPut:
+		switch {
+		case uploadID != "" && c.GetHeader("X-Amz-Copy-Source") != "":
+			g.uploadPartCopy(c, bucket, key, uploadID)
+		case uploadID != "":
+			g.uploadPart(c, bucket, key, uploadID)
+		case c.GetHeader("X-Amz-Copy-Source") != "":
+			writeError(c, errNotImplemented)
+		default:
+			g.putObject(c, bucket, key)
+		}
+	case http.MethodPost:
+		switch {
+		case uploads:
+			g.createMultipartUpload(c, bucket, key)
+		case uploadID != "":
+			g.completeMultipartUpload(c, bucket, key, uploadID)
+		default:
+			writeError(c, errNotImplemented)
+		}
+	case http.MethodGet, http.MethodHead:
+		switch {
+		case uploadID != "" && c.Request.Method == http.MethodGet:
+			g.listParts(c, bucket, key, uploadID)
+		case query.Get("partNumber") != "":
+			writeError(c, errNotImplemented)
+		default:
+			g.getObject(c, bucket, key)
+		}
+	case http.MethodDelete:
+		if uploadID != "" {
+			g.abortMultipartUpload(c, bucket, key, uploadID)
+			return
+		}
+		g.deleteObject(c, bucket, key)
+	default:
+		writeError(c, errNotImplemented)
+	}
+}
+
+// Subresources of buckets and objects the gateway does not implement
+var (
+	unsupportedBucketSubresources = subresources("accelerate", "acl", "analytics", "cors", "encryption",
+		"intelligent-tiering", "inventory", "lifecycle", "logging", "metrics", "notification", "object-lock",
+		"ownershipControls", "policy", "policyStatus", "publicAccessBlock", "replication", "requestPayment",
+		"tagging", "versioning", "versions", "website")
+	unsupportedObjectSubresources = subresources("acl", "attributes", "legal-hold", "restore",
+		"retention", "select", "tagging", "torrent")
+)
+
+// subresources returns a set of query parameter names
+func subresources(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// signatureOf returns the verified signature of the request
+func signatureOf(c *gin.Context) *signature {
+	sig, _ := c.MustGet(signatureKey).(*signature)
+	return sig
+}
+
+// fail responds with err, logging it if it is not an S3 error
+func (g *Gateway) fail(c *gin.Context, err error) {
+	var e *apiError
+	if errors.As(err, &e) {
+		writeError(c, e)
+		return
+	}
+	if errors.Is(err, retention.ErrLocked) {
+		writeError(c, errObjectLocked)
+		return
+	}
+	g.logger.Printf("%s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+	writeError(c, errInternalError)
+}
@@ -0,0 +1,420 @@
+package s3api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/service"
+)
+
+const (
+	testAccessKey = "minioadmin"
+	testSecretKey = "minioadmin"
+)
+
+// newTestGateway serves a gateway over a fresh store and returns it with a
+// client configured like the examples in examples/s3
+func newTestGateway(t *testing.T) (*Gateway, *s3.S3, *httptest.Server) {
+	gin.SetMode(gin.TestMode)
+
+	tempDir := t.TempDir()
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	config := fileservice.DefaultServiceConfig()
+	config.EnableLogging = false
+	fileService := fileservice.NewFileService(service.NewStorage(filepath.Join(tempDir, "storage")), metadataRepo, config)
+
+	gateway := NewGateway(fileService, metadataRepo, &Config{
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		Dir:       filepath.Join(tempDir, "multipart"),
+	})
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	client := newTestClient(t, server.URL, testSecretKey)
+	return gateway, client, server
+}
+
+// newTestClient returns an SDK client for the gateway at endpoint
+func newTestClient(t *testing.T, endpoint, secretKey string) *s3.S3 {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials(testAccessKey, secretKey, ""),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	require.NoError(t, err)
+	return s3.New(sess)
+}
+
+// errorCode returns the S3 error code of err
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestGateway(t *testing.T) {
+	gateway, client, _ := newTestGateway(t)
+	bucket := aws.String("test-bucket")
+	content := []byte("Hello, S3!\n")
+	sum := md5.Sum(content)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	t.Run("CreateAndListBuckets", func(t *testing.T) {
+		_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: bucket})
+		require.NoError(t, err)
+
+		_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: bucket})
+		require.Equal(t, "BucketAlreadyOwnedByYou", errorCode(err))
+
+		_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("Invalid_Name")})
+		require.Equal(t, "InvalidBucketName", errorCode(err))
+
+		result, err := client.ListBuckets(&s3.ListBucketsInput{})
+		require.NoError(t, err)
+		require.Len(t, result.Buckets, 1)
+		require.Equal(t, "test-bucket", *result.Buckets[0].Name)
+
+		_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: bucket})
+		require.NoError(t, err)
+	})
+
+	t.Run("PutGetHeadObject", func(t *testing.T) {
+		put, err := client.PutObject(&s3.PutObjectInput{
+			Bucket:      bucket,
+			Key:         aws.String("test.txt"),
+			Body:        bytes.NewReader(content),
+			ContentType: aws.String("text/plain"),
+			Metadata:    map[string]*string{"Author": aws.String("gateway")},
+		})
+		require.NoError(t, err)
+		require.Equal(t, etag, *put.ETag)
+
+		head, err := client.HeadObject(&s3.HeadObjectInput{Bucket: bucket, Key: aws.String("test.txt")})
+		require.NoError(t, err)
+		require.Equal(t, etag, *head.ETag)
+		require.Equal(t, "text/plain", *head.ContentType)
+		require.Equal(t, int64(len(content)), *head.ContentLength)
+		require.Equal(t, "gateway", *head.Metadata["Author"])
+
+		get, err := client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("test.txt")})
+		require.NoError(t, err)
+		body, err := io.ReadAll(get.Body)
+		get.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, content, body)
+
+		ranged, err := client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("test.txt"), Range: aws.String("bytes=7-9")})
+		require.NoError(t, err)
+		body, err = io.ReadAll(ranged.Body)
+		ranged.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, "S3!", string(body))
+		require.Equal(t, "bytes 7-9/11", *ranged.ContentRange)
+
+		_, err = client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("missing.txt")})
+		require.Equal(t, "NoSuchKey", errorCode(err))
+
+		_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("no-such-bucket"), Key: aws.String("test.txt")})
+		require.Equal(t, "NoSuchBucket", errorCode(err))
+	})
+
+	t.Run("ContentIsDeduplicated", func(t *testing.T) {
+		_, err := client.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String("copy/of/test.txt"), Body: bytes.NewReader(content)})
+		require.NoError(t, err)
+
+		first, err := gateway.metadataRepo.GetBucketEntry("test-bucket", "test.txt")
+		require.NoError(t, err)
+		second, err := gateway.metadataRepo.GetBucketEntry("test-bucket", "copy/of/test.txt")
+		require.NoError(t, err)
+		require.NotEqual(t, first.ObjectID, second.ObjectID)
+
+		firstMeta, err := gateway.metadataRepo.GetMetadata(first.ObjectID)
+		require.NoError(t, err)
+		secondMeta, err := gateway.metadataRepo.GetMetadata(second.ObjectID)
+		require.NoError(t, err)
+		require.Equal(t, firstMeta.Hash, secondMeta.Hash)
+
+		refs, err := gateway.metadataRepo.BlobRefCount(firstMeta.Hash)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), refs)
+	})
+
+	t.Run("OverwriteReplacesObject", func(t *testing.T) {
+		before, err := gateway.metadataRepo.GetBucketEntry("test-bucket", "copy/of/test.txt")
+		require.NoError(t, err)
+
+		_, err = client.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String("copy/of/test.txt"), Body: strings.NewReader("replaced")})
+		require.NoError(t, err)
+
+		_, err = gateway.metadataRepo.GetMetadata(before.ObjectID)
+		require.Error(t, err)
+
+		get, err := client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("copy/of/test.txt")})
+		require.NoError(t, err)
+		body, _ := io.ReadAll(get.Body)
+		get.Body.Close()
+		require.Equal(t, "replaced", string(body))
+	})
+
+	t.Run("ListObjectsV2", func(t *testing.T) {
+		for _, key := range []string{"a/1.txt", "a/2.txt", "a/b/3.txt", "b/4.txt", "c.txt"} {
+			_, err := client.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String(key), Body: strings.NewReader(key)})
+			require.NoError(t, err)
+		}
+
+		result, err := client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("a/")})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a/1.txt", "a/2.txt", "a/b/3.txt"}, keysOf(result.Contents))
+		require.Equal(t, int64(3), *result.KeyCount)
+
+		result, err = client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: bucket, Delimiter: aws.String("/")})
+		require.NoError(t, err)
+		require.Equal(t, []string{"c.txt", "test.txt"}, keysOf(result.Contents))
+		require.Equal(t, []string{"a/", "b/", "copy/"}, prefixesOf(result.CommonPrefixes))
+
+		// Page through keys and common prefixes two at a time
+		var keys, prefixes []string
+		var pages int
+		err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: bucket, Delimiter: aws.String("/"), MaxKeys: aws.Int64(2)},
+			func(page *s3.ListObjectsV2Output, last bool) bool {
+				pages++
+				keys = append(keys, keysOf(page.Contents)...)
+				prefixes = append(prefixes, prefixesOf(page.CommonPrefixes)...)
+				return true
+			})
+		require.NoError(t, err)
+		require.Equal(t, 3, pages)
+		require.Equal(t, []string{"c.txt", "test.txt"}, keys)
+		require.Equal(t, []string{"a/", "b/", "copy/"}, prefixes)
+
+		v1, err := client.ListObjects(&s3.ListObjectsInput{Bucket: bucket, Prefix: aws.String("a/"), Delimiter: aws.String("/")})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a/1.txt", "a/2.txt"}, keysOf(v1.Contents))
+		require.Equal(t, []string{"a/b/"}, prefixesOf(v1.CommonPrefixes))
+	})
+
+	t.Run("DeleteObjects", func(t *testing.T) {
+		_, err := client.DeleteBucket(&s3.DeleteBucketInput{Bucket: bucket})
+		require.Equal(t, "BucketNotEmpty", errorCode(err))
+
+		_, err = client.DeleteObject(&s3.DeleteObjectInput{Bucket: bucket, Key: aws.String("test.txt")})
+		require.NoError(t, err)
+		_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: bucket, Key: aws.String("test.txt")})
+		require.Error(t, err)
+
+		// Deleting a missing key succeeds
+		_, err = client.DeleteObject(&s3.DeleteObjectInput{Bucket: bucket, Key: aws.String("test.txt")})
+		require.NoError(t, err)
+
+		var objects []*s3.ObjectIdentifier
+		for _, key := range []string{"a/1.txt", "a/2.txt", "a/b/3.txt", "b/4.txt", "c.txt", "copy/of/test.txt", "missing"} {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		result, err := client.DeleteObjects(&s3.DeleteObjectsInput{Bucket: bucket, Delete: &s3.Delete{Objects: objects}})
+		require.NoError(t, err)
+		require.Len(t, result.Deleted, 7)
+		require.Empty(t, result.Errors)
+
+		_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: bucket})
+		require.NoError(t, err)
+		_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: bucket})
+		require.Error(t, err)
+	})
+}
+
+func TestGatewayAuthentication(t *testing.T) {
+	_, client, server := newTestGateway(t)
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		_, err := newTestClient(t, server.URL, "wrong").ListBuckets(&s3.ListBucketsInput{})
+		require.Equal(t, "SignatureDoesNotMatch", errorCode(err))
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("TamperedBody", func(t *testing.T) {
+		_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("signed")})
+		require.NoError(t, err)
+
+		req, _ := client.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String("signed"),
+			Key:    aws.String("tampered.txt"),
+			Body:   strings.NewReader("original"),
+		})
+		require.NoError(t, req.Sign())
+		req.HTTPRequest.Body = io.NopCloser(strings.NewReader("tampered"))
+		resp, err := http.DefaultClient.Do(req.HTTPRequest)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("signed"), Key: aws.String("tampered.txt")})
+		require.Error(t, err)
+	})
+
+	t.Run("Presigned", func(t *testing.T) {
+		_, err := client.PutObject(&s3.PutObjectInput{Bucket: aws.String("signed"), Key: aws.String("shared file.txt"), Body: strings.NewReader("shared")})
+		require.NoError(t, err)
+
+		req, _ := client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("signed"), Key: aws.String("shared file.txt")})
+		url, err := req.Presign(time.Minute)
+		require.NoError(t, err)
+
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "shared", string(body))
+	})
+}
+
+func TestGatewayStreamingPayload(t *testing.T) {
+	_, client, server := newTestGateway(t)
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("stream")})
+	require.NoError(t, err)
+
+	chunks := [][]byte{bytes.Repeat([]byte("a"), 64*1024), []byte("tail")}
+	var content []byte
+	for _, chunk := range chunks {
+		content = append(content, chunk...)
+	}
+
+	// put sends content in aws-chunked encoding, signing each chunk unless
+	// the payload is unsigned, and reports the response status
+	put := func(key, payload string, corrupt bool) int {
+		now := time.Now().UTC()
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/stream/"+key, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+		req.Header.Set("X-Amz-Decoded-Content-Length", fmt.Sprint(len(content)))
+		req.Header.Set("Content-Encoding", "aws-chunked")
+
+		signer := v4.NewSigner(credentials.NewStaticCredentials(testAccessKey, testSecretKey, ""))
+		_, err = signer.Sign(req, nil, "s3", "us-east-1", now)
+		require.NoError(t, err)
+		auth := req.Header.Get("Authorization")
+		previous := auth[strings.Index(auth, "Signature=")+len("Signature="):]
+
+		key256 := signingKey(testSecretKey, now.Format(scopeDateFormat), "us-east-1")
+		scope := now.Format(scopeDateFormat) + "/us-east-1/s3/aws4_request"
+		var body bytes.Buffer
+		for _, chunk := range append(chunks, nil) {
+			if payload == streamingUnsignedTrailer {
+				fmt.Fprintf(&body, "%x\r\n", len(chunk))
+			} else {
+				stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256-PAYLOAD", now.Format(amzDateFormat), scope, previous, emptySHA256, hashHex(chunk)}, "\n")
+				previous = hex.EncodeToString(hmacSHA256(key256, []byte(stringToSign)))
+				fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n", len(chunk), previous)
+			}
+			if corrupt && len(chunk) > 0 {
+				chunk = bytes.ToUpper(chunk)
+			}
+			body.Write(chunk)
+			if len(chunk) > 0 {
+				body.WriteString("\r\n")
+			}
+		}
+		if payload == streamingUnsignedTrailer {
+			body.WriteString("x-amz-checksum-crc32:AAAAAA==\r\n")
+		}
+		body.WriteString("\r\n")
+
+		req.Body = io.NopCloser(&body)
+		req.ContentLength = int64(body.Len())
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, payload := range []string{streamingPayload, streamingUnsignedTrailer} {
+		t.Run(payload, func(t *testing.T) {
+			require.Equal(t, http.StatusOK, put("object", payload, false))
+
+			get, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("stream"), Key: aws.String("object")})
+			require.NoError(t, err)
+			body, _ := io.ReadAll(get.Body)
+			get.Body.Close()
+			require.Equal(t, content, body)
+		})
+	}
+
+	t.Run("CorruptChunk", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, put("corrupt", streamingPayload, true))
+
+		_, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("stream"), Key: aws.String("corrupt")})
+		require.Error(t, err)
+	})
+}
+
+func TestValidBucketName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"test-bucket", true},
+		{"my.bucket.1", true},
+		{"ab", false},
+		{strings.Repeat("a", 64), false},
+		{"Upper", false},
+		{"-leading", false},
+		{"trailing-", false},
+		{"double..dot", false},
+		{"192.168.1.1", false},
+		{"under_score", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.valid, validBucketName(tt.name))
+		})
+	}
+}
+
+func keysOf(objects []*s3.Object) []string {
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, *object.Key)
+	}
+	return keys
+}
+
+func prefixesOf(prefixes []*s3.CommonPrefix) []string {
+	values := []string{}
+	for _, prefix := range prefixes {
+		values = append(values, *prefix.Prefix)
+	}
+	return values
+}
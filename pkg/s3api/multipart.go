@@ -0,0 +1,820 @@
+package s3api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Multipart upload limits
+const (
+	// maxPartNumber is the highest part number
+	maxPartNumber = 10000
+	// minPartSize is the smallest size of every part but the last
+	minPartSize = 5 << 20
+	// maxPartSize is the largest size of a part
+	maxPartSize = 5 << 30
+	// maxListParts is the most parts ListParts returns
+	maxListParts = 1000
+	// maxListUploads is the most uploads and common prefixes ListMultipartUploads returns
+	maxListUploads = 1000
+	// maxCompleteBody bounds the body of a CompleteMultipartUpload request
+	maxCompleteBody = 4 << 20
+)
+
+// initiateMultipartUploadResult is the response to CreateMultipartUpload
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// copyPartResult is the response to UploadPartCopy
+type copyPartResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyPartResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// completeMultipartUpload is the body of a CompleteMultipartUpload request
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+// completeMultipartUploadResult is the response to CompleteMultipartUpload
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// listPartsResult is the response to ListParts
+type listPartsResult struct {
+	XMLName              xml.Name    `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string      `xml:"Bucket"`
+	Key                  string      `xml:"Key"`
+	UploadID             string      `xml:"UploadId"`
+	Initiator            owner       `xml:"Initiator"`
+	Owner                owner       `xml:"Owner"`
+	StorageClass         string      `xml:"StorageClass"`
+	PartNumberMarker     int         `xml:"PartNumberMarker"`
+	NextPartNumberMarker int         `xml:"NextPartNumberMarker"`
+	MaxParts             int         `xml:"MaxParts"`
+	IsTruncated          bool        `xml:"IsTruncated"`
+	Parts                []partEntry `xml:"Part"`
+}
+
+type partEntry struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// listMultipartUploadsResult is the response to ListMultipartUploads
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string         `xml:"Bucket"`
+	KeyMarker          string         `xml:"KeyMarker"`
+	UploadIDMarker     string         `xml:"UploadIdMarker"`
+	NextKeyMarker      string         `xml:"NextKeyMarker"`
+	NextUploadIDMarker string         `xml:"NextUploadIdMarker"`
+	Prefix             string         `xml:"Prefix"`
+	Delimiter          string         `xml:"Delimiter,omitempty"`
+	MaxUploads         int            `xml:"MaxUploads"`
+	EncodingType       string         `xml:"EncodingType,omitempty"`
+	IsTruncated        bool           `xml:"IsTruncated"`
+	Uploads            []uploadEntry  `xml:"Upload"`
+	CommonPrefixes     []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type uploadEntry struct {
+	Key          string `xml:"Key"`
+	UploadID     string `xml:"UploadId"`
+	Initiator    owner  `xml:"Initiator"`
+	Owner        owner  `xml:"Owner"`
+	StorageClass string `xml:"StorageClass"`
+	Initiated    string `xml:"Initiated"`
+}
+
+// createMultipartUpload handles CreateMultipartUpload. The content type and
+// user metadata given now are those of the object the upload completes.
+func (g *Gateway) createMultipartUpload(c *gin.Context, bucket, key string) {
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	now := time.Now()
+	upload := &types.MultipartUpload{
+		ID:          uuid.New().String(),
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: c.GetHeader("Content-Type"),
+		Metadata:    userMetadata(c.Request.Header),
+		Initiator:   signatureOf(c).accessKey,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := g.metadataRepo.SaveMultipartUpload(upload); err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	writeXML(c, http.StatusOK, &initiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: upload.ID,
+	})
+}
+
+// uploadPart handles UploadPart, staging the part on disk
+func (g *Gateway) uploadPart(c *gin.Context, bucket, key, uploadID string) {
+	partNumber, ok := parsePartNumber(c)
+	if !ok {
+		return
+	}
+
+	var contentMD5 []byte
+	if header := c.GetHeader("Content-MD5"); header != "" {
+		decoded, err := base64.StdEncoding.DecodeString(header)
+		if err != nil || len(decoded) != md5.Size {
+			writeError(c, errInvalidDigest)
+			return
+		}
+		contentMD5 = decoded
+	}
+
+	upload, ok := g.multipartUpload(c, bucket, key, uploadID)
+	if !ok {
+		return
+	}
+
+	part, err := g.stagePart(upload, partNumber, payloadReader(c.Request.Body, signatureOf(c)), contentMD5)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	c.Header("ETag", `"`+part.ETag+`"`)
+	c.Status(http.StatusOK)
+}
+
+// uploadPartCopy handles UploadPartCopy, staging all or a range of an
+// existing object as a part
+func (g *Gateway) uploadPartCopy(c *gin.Context, bucket, key, uploadID string) {
+	partNumber, ok := parsePartNumber(c)
+	if !ok {
+		return
+	}
+
+	sourceBucket, sourceKey, err := parseCopySource(c.GetHeader("X-Amz-Copy-Source"))
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	upload, ok := g.multipartUpload(c, bucket, key, uploadID)
+	if !ok {
+		return
+	}
+
+	source, err := g.metadataRepo.GetBucketEntry(sourceBucket, sourceKey)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+	if source == nil {
+		if _, ok := g.bucket(c, sourceBucket); ok {
+			writeError(c, errNoSuchKey)
+		}
+		return
+	}
+	if err := checkCopyConditions(c.Request.Header, source); err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	reader, metadata, err := g.fileService.RetrieveObject(ctx, source.ObjectID)
+	if err != nil {
+		if errors.Is(err, tiering.ErrRestoring) {
+			err = errInvalidObjectState
+		}
+		g.fail(c, err)
+		return
+	}
+	defer reader.Close()
+
+	var body io.Reader = reader
+	if header := c.GetHeader("X-Amz-Copy-Source-Range"); header != "" {
+		start, end, err := parseCopyRange(header, metadata.Size)
+		if err != nil {
+			g.fail(c, err)
+			return
+		}
+		if _, err := reader.Seek(start, io.SeekStart); err != nil {
+			g.fail(c, err)
+			return
+		}
+		body = io.LimitReader(reader, end-start+1)
+	}
+
+	part, err := g.stagePart(upload, partNumber, body, nil)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	writeXML(c, http.StatusOK, &copyPartResult{
+		ETag:         `"` + part.ETag + `"`,
+		LastModified: part.ModifiedAt.UTC().Format(timeFormat),
+	})
+}
+
+// listParts handles ListParts
+func (g *Gateway) listParts(c *gin.Context, bucket, key, uploadID string) {
+	marker := 0
+	if value := c.Query("part-number-marker"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(c, errInvalidArgument)
+			return
+		}
+		marker = n
+	}
+
+	maxParts := maxListParts
+	if value := c.Query("max-parts"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(c, errInvalidArgument)
+			return
+		}
+		if n < maxParts {
+			maxParts = n
+		}
+	}
+
+	upload, ok := g.multipartUpload(c, bucket, key, uploadID)
+	if !ok {
+		return
+	}
+
+	parts, err := g.metadataRepo.ListMultipartParts(uploadID, marker, maxParts+1)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	result := &listPartsResult{
+		Bucket:           bucket,
+		Key:              key,
+		UploadID:         uploadID,
+		Initiator:        owner{ID: upload.Initiator, DisplayName: upload.Initiator},
+		Owner:            g.owner(),
+		StorageClass:     "STANDARD",
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	if len(parts) > maxParts {
+		parts = parts[:maxParts]
+		result.IsTruncated = true
+	}
+	for _, part := range parts {
+		result.Parts = append(result.Parts, partEntry{
+			PartNumber:   part.PartNumber,
+			LastModified: part.ModifiedAt.UTC().Format(timeFormat),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+		result.NextPartNumberMarker = part.PartNumber
+	}
+
+	writeXML(c, http.StatusOK, result)
+}
+
+// completeMultipartUpload handles CompleteMultipartUpload. The listed parts
+// are streamed in order through the file service as one object, which is
+// deduplicated like any other, and the staged parts are removed.
+func (g *Gateway) completeMultipartUpload(c *gin.Context, bucket, key, uploadID string) {
+	body, err := io.ReadAll(io.LimitReader(payloadReader(c.Request.Body, signatureOf(c)), maxCompleteBody))
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	var request completeMultipartUpload
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 || len(request.Parts) > maxPartNumber {
+		writeError(c, errMalformedXML)
+		return
+	}
+
+	lock := g.uploadLock(uploadID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, ok := g.multipartUpload(c, bucket, key, uploadID)
+	if !ok {
+		return
+	}
+
+	staged, err := g.metadataRepo.ListMultipartParts(uploadID, 0, 0)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+	partsByNumber := make(map[int]*types.MultipartPart, len(staged))
+	for _, part := range staged {
+		partsByNumber[part.PartNumber] = part
+	}
+
+	parts := make([]*types.MultipartPart, 0, len(request.Parts))
+	for i, requested := range request.Parts {
+		if i > 0 && requested.PartNumber <= request.Parts[i-1].PartNumber {
+			writeError(c, errInvalidPartOrder)
+			return
+		}
+		part := partsByNumber[requested.PartNumber]
+		if part == nil || strings.Trim(requested.ETag, `"`) != part.ETag {
+			writeError(c, errInvalidPart)
+			return
+		}
+		if i < len(request.Parts)-1 && part.Size < minPartSize {
+			writeError(c, errEntityTooSmall)
+			return
+		}
+		parts = append(parts, part)
+	}
+
+	etag, err := multipartETag(parts)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	files := make([]io.Reader, 0, len(parts))
+	var size int64
+	for _, part := range parts {
+		file, err := os.Open(g.partPath(uploadID, part.PartNumber))
+		if err != nil {
+			g.fail(c, fmt.Errorf("failed to open part %d: %w", part.PartNumber, err))
+			return
+		}
+		defer file.Close()
+		files = append(files, file)
+		size += part.Size
+	}
+
+	metadata := &types.FileMetadata{
+		FileName:     path.Base(key),
+		ContentType:  upload.ContentType,
+		Size:         size,
+		UploadedBy:   upload.Initiator,
+		CustomFields: upload.Metadata,
+	}
+
+	ctx := c.Request.Context()
+	stored, err := g.fileService.StoreStream(ctx, io.MultiReader(files...), metadata)
+	if err != nil {
+		g.storeFailed(c, err)
+		return
+	}
+
+	err = g.buckets.Commit(ctx, &types.BucketEntry{
+		Bucket:     bucket,
+		Key:        key,
+		ObjectID:   stored.ID,
+		ETag:       etag,
+		ModifiedAt: time.Now(),
+	})
+	if err != nil {
+		g.deleteObjectID(ctx, stored.ID)
+		if errors.Is(err, repository.ErrBucketNotFound) {
+			writeError(c, errNoSuchBucket)
+			return
+		}
+		g.fail(c, err)
+		return
+	}
+
+	if err := g.removeUpload(uploadID); err != nil {
+		g.logger.Printf("Failed to remove completed upload %s: %v", uploadID, err)
+	}
+
+	writeXML(c, http.StatusOK, &completeMultipartUploadResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     `"` + etag + `"`,
+	})
+}
+
+// abortMultipartUpload handles AbortMultipartUpload, removing the staged parts
+func (g *Gateway) abortMultipartUpload(c *gin.Context, bucket, key, uploadID string) {
+	lock := g.uploadLock(uploadID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := g.multipartUpload(c, bucket, key, uploadID); !ok {
+		return
+	}
+
+	if err := g.removeUpload(uploadID); err != nil {
+		g.fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listMultipartUploads handles ListMultipartUploads, listing the uploads in
+// progress by key and then by when they were started
+func (g *Gateway) listMultipartUploads(c *gin.Context, bucket string) {
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+	keyMarker := c.Query("key-marker")
+	uploadIDMarker := c.Query("upload-id-marker")
+	encodingType := c.Query("encoding-type")
+
+	maxUploads := maxListUploads
+	if value := c.Query("max-uploads"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(c, errInvalidArgument)
+			return
+		}
+		if n < maxUploads {
+			maxUploads = n
+		}
+	}
+
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	uploads, err := g.metadataRepo.ListMultipartUploads(bucket, prefix)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	encode := keyEncoder(encodingType)
+	result := &listMultipartUploadsResult{
+		Bucket:         bucket,
+		KeyMarker:      encode(keyMarker),
+		UploadIDMarker: uploadIDMarker,
+		Prefix:         encode(prefix),
+		Delimiter:      encode(delimiter),
+		MaxUploads:     maxUploads,
+		EncodingType:   encodingType,
+	}
+
+	// Uploads are skipped up to the markers: the whole marker key unless an
+	// upload ID marker names where in its uploads the previous page stopped
+	skipping := uploadIDMarker != ""
+	lastPrefix := ""
+	count := 0
+	for _, upload := range uploads {
+		if upload.Key < keyMarker {
+			continue
+		}
+		if upload.Key == keyMarker {
+			if skipping {
+				skipping = upload.ID != uploadIDMarker
+				continue
+			}
+			if uploadIDMarker == "" {
+				continue
+			}
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(upload.Key[len(prefix):], delimiter); i >= 0 {
+				rolled := upload.Key[:len(prefix)+i+len(delimiter)]
+				if rolled == lastPrefix || rolled <= keyMarker {
+					continue
+				}
+				if count == maxUploads {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(rolled)})
+				result.NextKeyMarker = encode(rolled)
+				result.NextUploadIDMarker = ""
+				lastPrefix = rolled
+				count++
+				continue
+			}
+		}
+
+		if count == maxUploads {
+			result.IsTruncated = true
+			break
+		}
+		result.Uploads = append(result.Uploads, uploadEntry{
+			Key:          encode(upload.Key),
+			UploadID:     upload.ID,
+			Initiator:    owner{ID: upload.Initiator, DisplayName: upload.Initiator},
+			Owner:        g.owner(),
+			StorageClass: "STANDARD",
+			Initiated:    upload.CreatedAt.UTC().Format(timeFormat),
+		})
+		result.NextKeyMarker = encode(upload.Key)
+		result.NextUploadIDMarker = upload.ID
+		count++
+	}
+
+	writeXML(c, http.StatusOK, result)
+}
+
+// CleanExpiredUploads aborts the multipart uploads without activity for the
+// upload expiration, and removes staged parts no upload refers to. It returns
+// how many uploads were aborted.
+func (g *Gateway) CleanExpiredUploads() (int, error) {
+	cutoff := time.Now().Add(-g.config.UploadExpiration)
+
+	uploads, err := g.metadataRepo.ListExpiredMultipartUploads(cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expired uploads: %w", err)
+	}
+
+	removed := 0
+	for _, upload := range uploads {
+		lock := g.uploadLock(upload.ID)
+		lock.Lock()
+		err := g.removeUpload(upload.ID)
+		lock.Unlock()
+		if err != nil {
+			g.logger.Printf("Failed to remove expired upload %s: %v", upload.ID, err)
+			continue
+		}
+		removed++
+	}
+
+	entries, err := os.ReadDir(g.config.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, fmt.Errorf("failed to read upload directory: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		upload, err := g.metadataRepo.GetMultipartUpload(entry.Name())
+		if err != nil || upload != nil {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(g.config.Dir, entry.Name())); err != nil {
+			g.logger.Printf("Failed to remove stale parts %s: %v", entry.Name(), err)
+		}
+	}
+
+	if removed > 0 {
+		g.logger.Printf("Aborted %d expired multipart uploads", removed)
+	}
+	return removed, nil
+}
+
+// stagePart writes a part of upload to disk and records it, replacing an
+// earlier upload of the same part number. If contentMD5 is set the part must
+// match it.
+func (g *Gateway) stagePart(upload *types.MultipartUpload, partNumber int, body io.Reader, contentMD5 []byte) (*types.MultipartPart, error) {
+	dir := g.uploadDir(upload.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	file, err := os.CreateTemp(dir, "part-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create part: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	hasher := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), io.LimitReader(body, maxPartSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > maxPartSize {
+		return nil, errEntityTooLarge
+	}
+
+	sum := hasher.Sum(nil)
+	if contentMD5 != nil && !bytes.Equal(sum, contentMD5) {
+		return nil, errBadDigest
+	}
+
+	part := &types.MultipartPart{
+		UploadID:   upload.ID,
+		PartNumber: partNumber,
+		ETag:       hex.EncodeToString(sum),
+		Size:       size,
+		ModifiedAt: time.Now(),
+	}
+
+	// Completing or aborting the upload holds its lock, so the part is either
+	// in place before they start or finds the upload gone
+	lock := g.uploadLock(upload.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.Rename(file.Name(), g.partPath(upload.ID, partNumber)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoSuchUpload
+		}
+		return nil, fmt.Errorf("failed to stage part: %w", err)
+	}
+	if err := g.metadataRepo.SaveMultipartPart(part); err != nil {
+		if errors.Is(err, repository.ErrMultipartUploadNotFound) {
+			os.RemoveAll(dir)
+			return nil, errNoSuchUpload
+		}
+		return nil, err
+	}
+
+	return part, nil
+}
+
+// removeUpload deletes a multipart upload and its staged parts
+func (g *Gateway) removeUpload(id string) error {
+	if _, err := g.metadataRepo.DeleteMultipartUpload(id); err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	g.uploadLocks.Delete(id)
+
+	if err := os.RemoveAll(g.uploadDir(id)); err != nil {
+		return fmt.Errorf("failed to remove parts: %w", err)
+	}
+	return nil
+}
+
+// multipartUpload returns the upload called id into bucket and key,
+// responding with NoSuchUpload if there is none
+func (g *Gateway) multipartUpload(c *gin.Context, bucket, key, id string) (*types.MultipartUpload, bool) {
+	upload, err := g.metadataRepo.GetMultipartUpload(id)
+	if err != nil {
+		g.fail(c, err)
+		return nil, false
+	}
+	if upload == nil || upload.Bucket != bucket || upload.Key != key {
+		writeError(c, errNoSuchUpload)
+		return nil, false
+	}
+	return upload, true
+}
+
+// uploadLock returns the lock serializing changes to a multipart upload
+func (g *Gateway) uploadLock(id string) *sync.Mutex {
+	lock, _ := g.uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// uploadDir returns the directory staging the parts of an upload. Upload IDs
+// are only used in paths once they have been found in the repository.
+func (g *Gateway) uploadDir(id string) string {
+	return filepath.Join(g.config.Dir, id)
+}
+
+// partPath returns where a part of an upload is staged
+func (g *Gateway) partPath(id string, partNumber int) string {
+	return filepath.Join(g.uploadDir(id), fmt.Sprintf("%05d", partNumber))
+}
+
+// multipartETag returns the entity tag S3 gives multipart objects: the MD5 of
+// the concatenated MD5s of the parts, followed by the number of parts
+func multipartETag(parts []*types.MultipartPart) (string, error) {
+	hasher := md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return "", fmt.Errorf("invalid entity tag of part %d: %w", part.PartNumber, err)
+		}
+		hasher.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hasher.Sum(nil)), len(parts)), nil
+}
+
+// parsePartNumber reads the partNumber query parameter, responding with an error if it is invalid
+func parsePartNumber(c *gin.Context) (int, bool) {
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		writeError(c, errInvalidPartNumber)
+		return 0, false
+	}
+	return partNumber, true
+}
+
+// parseCopySource splits an x-amz-copy-source header into its bucket and key.
+// Only the current version of an object can be copied.
+func parseCopySource(header string) (string, string, error) {
+	source, query, _ := strings.Cut(header, "?")
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return "", "", errInvalidArgument
+		}
+		if version := values.Get("versionId"); version != "" && version != "null" {
+			return "", "", errNotImplemented
+		}
+	}
+
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return "", "", errInvalidArgument
+	}
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", errInvalidArgument
+	}
+	return bucket, key, nil
+}
+
+// parseCopyRange parses an x-amz-copy-source-range header of the form
+// bytes=first-last into the first and last byte it selects from an object of size
+func parseCopyRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, errInvalidArgument
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errInvalidArgument
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, errInvalidArgument
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, 0, errInvalidArgument
+	}
+	if start < 0 || end < start || end >= size {
+		return 0, 0, errInvalidRange
+	}
+	return start, end, nil
+}
+
+// checkCopyConditions checks the x-amz-copy-source-if-* headers against the source object
+func checkCopyConditions(header http.Header, source *types.BucketEntry) error {
+	etag := `"` + source.ETag + `"`
+
+	if match := header.Get("X-Amz-Copy-Source-If-Match"); match != "" && !etagMatches(match, etag) {
+		return errPreconditionFailed
+	}
+	if match := header.Get("X-Amz-Copy-Source-If-None-Match"); match != "" && etagMatches(match, etag) {
+		return errPreconditionFailed
+	}
+
+	modified := source.ModifiedAt.Truncate(time.Second)
+	if value := header.Get("X-Amz-Copy-Source-If-Modified-Since"); value != "" {
+		if since, err := http.ParseTime(value); err == nil && !modified.After(since) {
+			return errPreconditionFailed
+		}
+	}
+	if value := header.Get("X-Amz-Copy-Source-If-Unmodified-Since"); value != "" {
+		if since, err := http.ParseTime(value); err == nil && modified.After(since) {
+			return errPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// etagMatches reports whether an If-Match style list of entity tags includes etag
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.Trim(candidate, `"`) == strings.Trim(etag, `"`) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package s3api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	gateway, client, _ := newTestGateway(t)
+	bucket := aws.String("multipart")
+	key := aws.String("dir/large.bin")
+
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: bucket})
+	require.NoError(t, err)
+
+	source := []byte("0123456789abcdefghij")
+	_, err = client.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String("source.txt"), Body: bytes.NewReader(source)})
+	require.NoError(t, err)
+
+	part1 := bytes.Repeat([]byte("a"), minPartSize)
+	part2 := bytes.Repeat([]byte("b"), minPartSize)
+	part3 := source[10:15]
+
+	t.Run("CompleteUpload", func(t *testing.T) {
+		created, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:      bucket,
+			Key:         key,
+			ContentType: aws.String("application/octet-stream"),
+			Metadata:    map[string]*string{"Origin": aws.String("multipart")},
+		})
+		require.NoError(t, err)
+		uploadID := created.UploadId
+
+		var completed []*s3.CompletedPart
+		for i, data := range [][]byte{part1, part2} {
+			result, err := client.UploadPart(&s3.UploadPartInput{
+				Bucket:     bucket,
+				Key:        key,
+				UploadId:   uploadID,
+				PartNumber: aws.Int64(int64(i + 1)),
+				Body:       bytes.NewReader(data),
+			})
+			require.NoError(t, err)
+			sum := md5.Sum(data)
+			require.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, *result.ETag)
+			completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: result.ETag})
+		}
+
+		copied, err := client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          bucket,
+			Key:             key,
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(3),
+			CopySource:      aws.String("multipart/source.txt"),
+			CopySourceRange: aws.String("bytes=10-14"),
+		})
+		require.NoError(t, err)
+		completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(3), ETag: copied.CopyPartResult.ETag})
+
+		parts, err := client.ListParts(&s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: uploadID, MaxParts: aws.Int64(2)})
+		require.NoError(t, err)
+		require.Len(t, parts.Parts, 2)
+		require.True(t, *parts.IsTruncated)
+		require.Equal(t, int64(2), *parts.NextPartNumberMarker)
+
+		parts, err = client.ListParts(&s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: uploadID, PartNumberMarker: aws.Int64(2)})
+		require.NoError(t, err)
+		require.Len(t, parts.Parts, 1)
+		require.Equal(t, int64(len(part3)), *parts.Parts[0].Size)
+
+		uploads, err := client.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: bucket})
+		require.NoError(t, err)
+		require.Len(t, uploads.Uploads, 1)
+		require.Equal(t, *uploadID, *uploads.Uploads[0].UploadId)
+
+		_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             key,
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{completed[1], completed[0]}},
+		})
+		require.Equal(t, "InvalidPartOrder", errorCode(err))
+
+		_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:   bucket,
+			Key:      key,
+			UploadId: uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{
+				{PartNumber: aws.Int64(1), ETag: completed[1].ETag},
+			}},
+		})
+		require.Equal(t, "InvalidPart", errorCode(err))
+
+		result, err := client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             key,
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		require.NoError(t, err)
+
+		var sums []byte
+		for _, data := range [][]byte{part1, part2, part3} {
+			sum := md5.Sum(data)
+			sums = append(sums, sum[:]...)
+		}
+		sum := md5.Sum(sums)
+		etag := fmt.Sprintf(`"%s-3"`, hex.EncodeToString(sum[:]))
+		require.Equal(t, etag, *result.ETag)
+
+		get, err := client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: key})
+		require.NoError(t, err)
+		body, err := io.ReadAll(get.Body)
+		get.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, bytes.Join([][]byte{part1, part2, part3}, nil), body)
+		require.Equal(t, etag, *get.ETag)
+		require.Equal(t, "application/octet-stream", *get.ContentType)
+		require.Equal(t, "multipart", *get.Metadata["Origin"])
+
+		uploads, err = client.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: bucket})
+		require.NoError(t, err)
+		require.Empty(t, uploads.Uploads)
+		require.NoDirExists(t, gateway.uploadDir(*uploadID))
+
+		_, err = client.ListParts(&s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: uploadID})
+		require.Equal(t, "NoSuchUpload", errorCode(err))
+	})
+
+	t.Run("EntityTooSmall", func(t *testing.T) {
+		created, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: bucket, Key: aws.String("small.bin")})
+		require.NoError(t, err)
+
+		var completed []*s3.CompletedPart
+		for i := 1; i <= 2; i++ {
+			result, err := client.UploadPart(&s3.UploadPartInput{
+				Bucket:     bucket,
+				Key:        aws.String("small.bin"),
+				UploadId:   created.UploadId,
+				PartNumber: aws.Int64(int64(i)),
+				Body:       bytes.NewReader([]byte("small")),
+			})
+			require.NoError(t, err)
+			completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(int64(i)), ETag: result.ETag})
+		}
+
+		_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             aws.String("small.bin"),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		require.Equal(t, "EntityTooSmall", errorCode(err))
+
+		_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: bucket, Key: aws.String("small.bin"), UploadId: created.UploadId})
+		require.NoError(t, err)
+		require.NoDirExists(t, gateway.uploadDir(*created.UploadId))
+
+		_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: bucket, Key: aws.String("small.bin"), UploadId: created.UploadId})
+		require.Equal(t, "NoSuchUpload", errorCode(err))
+	})
+
+	t.Run("InvalidPartNumber", func(t *testing.T) {
+		created, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+		require.NoError(t, err)
+
+		_, err = client.UploadPart(&s3.UploadPartInput{
+			Bucket:     bucket,
+			Key:        key,
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int64(maxPartNumber + 1),
+			Body:       bytes.NewReader([]byte("part")),
+		})
+		require.Equal(t, "InvalidArgument", errorCode(err))
+
+		_, err = client.UploadPart(&s3.UploadPartInput{
+			Bucket:     bucket,
+			Key:        aws.String("other.bin"),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int64(1),
+			Body:       bytes.NewReader([]byte("part")),
+		})
+		require.Equal(t, "NoSuchUpload", errorCode(err))
+	})
+
+	t.Run("UploadManager", func(t *testing.T) {
+		content := bytes.Repeat([]byte("0123456789"), (2*minPartSize+1024)/10)
+		uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			u.PartSize = minPartSize
+			u.Concurrency = 2
+		})
+
+		result, err := uploader.Upload(&s3manager.UploadInput{Bucket: bucket, Key: aws.String("managed.bin"), Body: bytes.NewReader(content)})
+		require.NoError(t, err)
+		require.Regexp(t, `^"[0-9a-f]{32}-3"$`, *result.ETag)
+
+		get, err := client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("managed.bin")})
+		require.NoError(t, err)
+		body, err := io.ReadAll(get.Body)
+		get.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, content, body)
+	})
+}
+
+func TestListMultipartUploads(t *testing.T) {
+	_, client, _ := newTestGateway(t)
+	bucket := aws.String("uploads")
+
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: bucket})
+	require.NoError(t, err)
+
+	var ids []string
+	for _, key := range []string{"a.bin", "a.bin", "dir/b.bin", "dir/c.bin", "z.bin"} {
+		created, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: bucket, Key: aws.String(key)})
+		require.NoError(t, err)
+		ids = append(ids, *created.UploadId)
+	}
+
+	page, err := client.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: bucket, Delimiter: aws.String("/"), MaxUploads: aws.Int64(2)})
+	require.NoError(t, err)
+	require.True(t, *page.IsTruncated)
+	require.Len(t, page.Uploads, 2)
+	require.ElementsMatch(t, ids[:2], []string{*page.Uploads[0].UploadId, *page.Uploads[1].UploadId})
+
+	page, err = client.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+		Bucket:         bucket,
+		Delimiter:      aws.String("/"),
+		KeyMarker:      page.NextKeyMarker,
+		UploadIdMarker: page.NextUploadIdMarker,
+	})
+	require.NoError(t, err)
+	require.False(t, *page.IsTruncated)
+	require.Len(t, page.CommonPrefixes, 1)
+	require.Equal(t, "dir/", *page.CommonPrefixes[0].Prefix)
+	require.Len(t, page.Uploads, 1)
+	require.Equal(t, "z.bin", *page.Uploads[0].Key)
+
+	page, err = client.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: bucket, Prefix: aws.String("dir/")})
+	require.NoError(t, err)
+	require.Len(t, page.Uploads, 2)
+	require.Equal(t, "dir/b.bin", *page.Uploads[0].Key)
+	require.Equal(t, "dir/c.bin", *page.Uploads[1].Key)
+}
+
+func TestCleanExpiredUploads(t *testing.T) {
+	gateway, client, _ := newTestGateway(t)
+	bucket := aws.String("expiring")
+
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: bucket})
+	require.NoError(t, err)
+
+	created, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: bucket, Key: aws.String("stale.bin")})
+	require.NoError(t, err)
+	_, err = client.UploadPart(&s3.UploadPartInput{
+		Bucket:     bucket,
+		Key:        aws.String("stale.bin"),
+		UploadId:   created.UploadId,
+		PartNumber: aws.Int64(1),
+		Body:       bytes.NewReader([]byte("part")),
+	})
+	require.NoError(t, err)
+	require.DirExists(t, gateway.uploadDir(*created.UploadId))
+
+	// Parts left behind by an upload the repository no longer knows
+	orphan := filepath.Join(gateway.config.Dir, "orphan")
+	require.NoError(t, os.MkdirAll(orphan, 0755))
+	old := time.Now().Add(-2 * DefaultUploadExpiration)
+	require.NoError(t, os.Chtimes(orphan, old, old))
+
+	removed, err := gateway.CleanExpiredUploads()
+	require.NoError(t, err)
+	require.Zero(t, removed)
+	require.DirExists(t, gateway.uploadDir(*created.UploadId))
+	require.NoDirExists(t, orphan)
+
+	gateway.config.UploadExpiration = time.Nanosecond
+	removed, err = gateway.CleanExpiredUploads()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.NoDirExists(t, gateway.uploadDir(*created.UploadId))
+
+	_, err = client.ListParts(&s3.ListPartsInput{Bucket: bucket, Key: aws.String("stale.bin"), UploadId: created.UploadId})
+	require.Equal(t, "NoSuchUpload", errorCode(err))
+}
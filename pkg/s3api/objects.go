@@ -0,0 +1,292 @@
+package s3api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zots0127/io/pkg/buckets"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/quota"
+	"github.com/zots0127/io/pkg/retention"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// Object limits
+const (
+	// maxKeyLength is the longest key in bytes
+	maxKeyLength = 1024
+	// maxDeleteObjects is the most keys a DeleteObjects request may name
+	maxDeleteObjects = 1000
+	// maxDeleteBody bounds the body of a DeleteObjects request
+	maxDeleteBody = 2 << 20
+)
+
+// userMetadataPrefix introduces user metadata headers, which are kept in the
+// object's custom fields
+const userMetadataPrefix = "X-Amz-Meta-"
+
+// responseOverrides maps query parameters of GetObject to the response
+// headers they override
+var responseOverrides = map[string]string{
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+	"response-content-language":    "Content-Language",
+	"response-content-type":        "Content-Type",
+	"response-expires":             "Expires",
+}
+
+// deleteRequest is the body of a DeleteObjects request
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+// deleteResult is the response to DeleteObjects
+type deleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// putObject handles PutObject. The content is stored through the file
+// service, so content already stored under another key or uploaded through
+// the native API is not stored again. The object previously under the key,
+// if any, is deleted.
+func (g *Gateway) putObject(c *gin.Context, bucket, key string) {
+	var contentMD5 []byte
+	if header := c.GetHeader("Content-MD5"); header != "" {
+		decoded, err := base64.StdEncoding.DecodeString(header)
+		if err != nil || len(decoded) != md5.Size {
+			writeError(c, errInvalidDigest)
+			return
+		}
+		contentMD5 = decoded
+	}
+
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	sig := signatureOf(c)
+	metadata := &types.FileMetadata{
+		FileName:     path.Base(key),
+		ContentType:  c.GetHeader("Content-Type"),
+		UploadedBy:   sig.accessKey,
+		CustomFields: userMetadata(c.Request.Header),
+	}
+	// The size is declared up front so quotas can turn the upload away early
+	if c.Request.ContentLength > 0 {
+		metadata.Size = c.Request.ContentLength
+	}
+	if decoded := c.GetHeader("X-Amz-Decoded-Content-Length"); decoded != "" {
+		metadata.Size, _ = strconv.ParseInt(decoded, 10, 64)
+	}
+
+	hasher := md5.New()
+	body := io.TeeReader(payloadReader(c.Request.Body, sig), hasher)
+
+	ctx := c.Request.Context()
+	stored, err := g.fileService.StoreStream(ctx, body, metadata)
+	if err != nil {
+		g.storeFailed(c, err)
+		return
+	}
+
+	sum := hasher.Sum(nil)
+	if contentMD5 != nil && !bytes.Equal(sum, contentMD5) {
+		g.deleteObjectID(ctx, stored.ID)
+		writeError(c, errBadDigest)
+		return
+	}
+
+	etag := hex.EncodeToString(sum)
+	err = g.buckets.Commit(ctx, &types.BucketEntry{
+		Bucket:     bucket,
+		Key:        key,
+		ObjectID:   stored.ID,
+		ETag:       etag,
+		ModifiedAt: time.Now(),
+	})
+	if err != nil {
+		g.deleteObjectID(ctx, stored.ID)
+		if errors.Is(err, repository.ErrBucketNotFound) {
+			writeError(c, errNoSuchBucket)
+			return
+		}
+		g.fail(c, err)
+		return
+	}
+
+	c.Header("ETag", `"`+etag+`"`)
+	c.Status(http.StatusOK)
+}
+
+// getObject handles GetObject and HeadObject, including range and
+// conditional requests
+func (g *Gateway) getObject(c *gin.Context, bucket, key string) {
+	entry, err := g.metadataRepo.GetBucketEntry(bucket, key)
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+	if entry == nil {
+		if _, ok := g.bucket(c, bucket); ok {
+			writeError(c, errNoSuchKey)
+		}
+		return
+	}
+
+	reader, metadata, err := g.fileService.RetrieveObject(c.Request.Context(), entry.ObjectID)
+	if err != nil {
+		// S3 clients expect an expired object to be gone, as lifecycle expiry leaves it
+		if errors.Is(err, fileservice.ErrExpired) {
+			err = errNoSuchKey
+		}
+		if errors.Is(err, tiering.ErrRestoring) {
+			err = errInvalidObjectState
+		}
+		g.fail(c, err)
+		return
+	}
+	defer reader.Close()
+
+	header := c.Writer.Header()
+	header.Set("ETag", `"`+entry.ETag+`"`)
+	header.Set("Content-Type", metadata.ContentType)
+	for name, value := range metadata.CustomFields {
+		header.Set(userMetadataPrefix+name, value)
+	}
+	for param, name := range responseOverrides {
+		if value := c.Query(param); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	http.ServeContent(c.Writer, c.Request, "", entry.ModifiedAt, reader)
+}
+
+// deleteObject handles DeleteObject, which succeeds whether or not the key exists
+func (g *Gateway) deleteObject(c *gin.Context, bucket, key string) {
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	if err := g.deleteKey(c.Request.Context(), bucket, key); err != nil {
+		g.fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deleteObjects handles DeleteObjects, deleting up to maxDeleteObjects keys.
+// Keys that are not there count as deleted.
+func (g *Gateway) deleteObjects(c *gin.Context, bucket string) {
+	body, err := io.ReadAll(io.LimitReader(payloadReader(c.Request.Body, signatureOf(c)), maxDeleteBody))
+	if err != nil {
+		g.fail(c, err)
+		return
+	}
+
+	var request deleteRequest
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Objects) == 0 || len(request.Objects) > maxDeleteObjects {
+		writeError(c, errMalformedXML)
+		return
+	}
+
+	if _, ok := g.bucket(c, bucket); !ok {
+		return
+	}
+
+	result := &deleteResult{}
+	for _, object := range request.Objects {
+		if err := g.deleteKey(c.Request.Context(), bucket, object.Key); err != nil {
+			failure := errInternalError
+			if errors.Is(err, retention.ErrLocked) {
+				failure = errObjectLocked
+			} else {
+				g.logger.Printf("Failed to delete %s/%s: %v", bucket, object.Key, err)
+			}
+			result.Errors = append(result.Errors, deleteError{
+				Key:     object.Key,
+				Code:    failure.Code,
+				Message: failure.Message,
+			})
+			continue
+		}
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: object.Key})
+		}
+	}
+	writeXML(c, http.StatusOK, result)
+}
+
+// deleteKey removes key from bucket and deletes the objects stored there,
+// every version included, unless any of them is locked. The content stays
+// stored while other objects reference it. A key that is not there counts as
+// deleted.
+func (g *Gateway) deleteKey(ctx context.Context, bucket, key string) error {
+	if err := g.buckets.Delete(ctx, bucket, key); err != nil && !errors.Is(err, buckets.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+// deleteObjectID deletes an object no key refers to any more. A failure only
+// leaves the object behind, so it is logged rather than reported.
+func (g *Gateway) deleteObjectID(ctx context.Context, id string) {
+	if err := g.fileService.Delete(ctx, id); err != nil {
+		g.logger.Printf("Failed to delete object %s: %v", id, err)
+	}
+}
+
+// storeFailed responds to a failed upload
+func (g *Gateway) storeFailed(c *gin.Context, err error) {
+	var exceeded *quota.ExceededError
+	switch {
+	case errors.Is(err, fileservice.ErrFileTooLarge):
+		writeError(c, errEntityTooLarge)
+	case errors.As(err, &exceeded):
+		writeError(c, errQuotaExceeded)
+	default:
+		g.fail(c, err)
+	}
+}
+
+// userMetadata returns the x-amz-meta- headers of a request, by lowercase
+// name without the prefix
+func userMetadata(header http.Header) map[string]string {
+	fields := map[string]string{}
+	for name, values := range header {
+		if strings.HasPrefix(name, userMetadataPrefix) && len(values) > 0 {
+			fields[strings.ToLower(strings.TrimPrefix(name, userMetadataPrefix))] = values[0]
+		}
+	}
+	return fields
+}
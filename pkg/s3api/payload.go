@@ -0,0 +1,153 @@
+package s3api
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkSize bounds a chunk of an aws-chunked body, which is held in memory
+// until its signature is checked
+const maxChunkSize = 16 << 20
+
+// validPayload reports whether payload is an x-amz-content-sha256 value the
+// gateway understands
+func validPayload(payload string) bool {
+	switch payload {
+	case unsignedPayload, streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		return true
+	}
+	decoded, err := hex.DecodeString(payload)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// payloadReader returns the body of a request signed with sig, decoded from
+// aws-chunked if it was sent that way. Reads fail once what was read turns
+// out not to match what was signed, at the latest when the body is exhausted.
+func payloadReader(body io.Reader, sig *signature) io.Reader {
+	switch sig.payload {
+	case unsignedPayload:
+		return body
+	case streamingPayload, streamingPayloadTrailer:
+		return &chunkedReader{reader: bufio.NewReader(body), sig: sig, previous: sig.value}
+	case streamingUnsignedTrailer:
+		return &chunkedReader{reader: bufio.NewReader(body)}
+	default:
+		return &hashedReader{reader: body, hash: sha256.New(), expected: sig.payload}
+	}
+}
+
+// hashedReader checks that what it reads hashes to the signed SHA-256
+type hashedReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+// Read implements io.Reader
+func (h *hashedReader) Read(p []byte) (int, error) {
+	n, err := h.reader.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body. Each chunk is prefixed with its
+// size in hex and, unless the body is unsigned, a signature chaining it to
+// the one before. Trailing headers after the last chunk are skipped.
+type chunkedReader struct {
+	reader   *bufio.Reader
+	sig      *signature // nil if the chunks are unsigned
+	previous string     // signature of the previous chunk
+	chunk    []byte     // unread part of the current chunk
+	buf      []byte
+	err      error
+}
+
+// Read implements io.Reader
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.err = c.next()
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads the next chunk, returning io.EOF after the last one
+func (c *chunkedReader) next() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeStr, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errIncompleteBody
+	}
+
+	if int64(cap(c.buf)) < size {
+		c.buf = make([]byte, size)
+	}
+	data := c.buf[:size]
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return errIncompleteBody
+	}
+
+	if c.sig != nil {
+		provided := strings.TrimPrefix(strings.TrimSpace(extension), "chunk-signature=")
+		stringToSign := strings.Join([]string{
+			signV4Algorithm + "-PAYLOAD",
+			c.sig.date.Format(amzDateFormat),
+			c.sig.scope,
+			c.previous,
+			emptySHA256,
+			hashHex(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.sig.key, []byte(stringToSign)))
+		if !hmac.Equal([]byte(expected), []byte(provided)) {
+			return errSignatureDoesNotMatch
+		}
+		c.previous = expected
+	}
+
+	if size == 0 {
+		// Skip trailing headers up to the blank line ending the body
+		for {
+			line, err := c.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "" {
+				return io.EOF
+			}
+		}
+	}
+
+	if line, err := c.readLine(); err != nil || line != "" {
+		return errIncompleteBody
+	}
+	c.chunk = data
+	return nil
+}
+
+// readLine reads a CRLF-terminated line without its terminator
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return "", errIncompleteBody
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
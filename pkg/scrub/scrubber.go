@@ -0,0 +1,403 @@
+// Package scrub re-verifies stored content against its address so silent
+// corruption on disk is found before a download trips over it.
+//
+// A scrub walks every blob and chunk at a limited read rate, re-hashes its
+// original bytes and records the outcome and the last time it verified.
+// Corrupt content is moved to the store's quarantine directory and, if a
+// replica or backup copy of the storage tree holds an intact copy, restored
+// from it.
+package scrub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/throttle"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultRateLimit is how many bytes per second a scrub reads by default
+const DefaultRateLimit = 32 * 1024 * 1024
+
+// DefaultMinAge is how long content that verified is left alone by default
+const DefaultMinAge = 7 * 24 * time.Hour
+
+// ErrRunInProgress is returned when a scrub is requested while one is already running
+var ErrRunInProgress = errors.New("integrity scrub already in progress")
+
+// Config configures the scrubber
+type Config struct {
+	// Interval between background runs. Zero disables them.
+	Interval time.Duration `json:"interval"`
+	// RateLimit caps the bytes read per second. Zero reads as fast as the disk allows.
+	RateLimit int64 `json:"rate_limit"`
+	// MinAge skips content that verified more recently than this, so each run
+	// only re-reads what is due
+	MinAge time.Duration `json:"min_age"`
+	// Replicas are the roots of replica or backup copies of the storage tree,
+	// laid out and encrypted the same way, that corrupt content is restored from
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// DefaultConfig returns the default scrubber configuration
+func DefaultConfig() *Config {
+	return &Config{
+		RateLimit: DefaultRateLimit,
+		MinAge:    DefaultMinAge,
+	}
+}
+
+// Finding describes content found corrupt
+type Finding struct {
+	Store        string `json:"store"`
+	Hash         string `json:"hash"`
+	Detail       string `json:"detail"`
+	Quarantined  string `json:"quarantined,omitempty"`
+	RepairedFrom string `json:"repaired_from,omitempty"`
+}
+
+// Report is the outcome of a single scrub
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	BlobsChecked  int   `json:"blobs_checked"`
+	ChunksChecked int   `json:"chunks_checked"`
+	BytesRead     int64 `json:"bytes_read"`
+	Skipped       int   `json:"skipped"`
+
+	Corrupt  []Finding `json:"corrupt"`
+	Repaired int       `json:"repaired"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Recorder receives the outcome of every scrub, such as the metrics collector
+type Recorder interface {
+	RecordScrub(checked int, bytes int64, corrupt, repaired int)
+}
+
+// Scrubber re-verifies stored blobs and chunks
+type Scrubber struct {
+	stores       map[string]*service.Storage
+	replicas     []map[string]*service.Storage
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	recorder     Recorder
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewScrubber creates a new scrubber. chunks is the storage holding content
+// chunks, or nil if content is never chunked. Replicas are opened with the
+// storage's algorithm and keyring.
+func NewScrubber(storage, chunks *service.Storage, metadataRepo *repository.MetadataRepository, config *Config) *Scrubber {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.RateLimit < 0 {
+		config.RateLimit = 0
+	}
+
+	stores := map[string]*service.Storage{types.IntegrityStoreBlobs: storage}
+	if chunks != nil {
+		stores[types.IntegrityStoreChunks] = chunks
+	}
+
+	replicas := make([]map[string]*service.Storage, 0, len(config.Replicas))
+	for _, root := range config.Replicas {
+		replica := map[string]*service.Storage{
+			types.IntegrityStoreBlobs:  openReplica(root, storage),
+			types.IntegrityStoreChunks: openReplica(filepath.Join(root, chunkstore.ChunkDirName), storage),
+		}
+		replicas = append(replicas, replica)
+	}
+
+	return &Scrubber{
+		stores:       stores,
+		replicas:     replicas,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[SCRUB] ", log.LstdFlags),
+	}
+}
+
+// openReplica opens the storage tree under root for reading the way storage reads
+func openReplica(root string, storage *service.Storage) *service.Storage {
+	replica := service.NewStorageWithAlgorithm(root, storage.Algorithm())
+	replica.SetEncryption(storage.Encryption())
+	return replica
+}
+
+// SetRecorder sets where the outcome of every scrub is reported
+func (s *Scrubber) SetRecorder(recorder Recorder) {
+	s.recorder = recorder
+}
+
+// LastReport returns the report of the most recent scrub, or nil if none has run
+func (s *Scrubber) LastReport() *Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastReport
+}
+
+// Run scrubs every blob and chunk that is due. Only one scrub runs at a time.
+func (s *Scrubber) Run(ctx context.Context) (*Report, error) {
+	if !s.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer s.running.Unlock()
+
+	report := &Report{
+		StartedAt: time.Now(),
+		Corrupt:   []Finding{},
+	}
+	limit := throttle.NewLimiter(ctx, s.config.RateLimit)
+
+	for _, store := range []string{types.IntegrityStoreBlobs, types.IntegrityStoreChunks} {
+		if s.stores[store] == nil {
+			continue
+		}
+		if err := s.scrub(ctx, store, limit, report); err != nil {
+			return nil, err
+		}
+		if err := s.forgetRemoved(store); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	s.logger.Printf("scrub finished: checked %d blobs and %d chunks (%d bytes), %d corrupt, %d repaired, %d errors",
+		report.BlobsChecked, report.ChunksChecked, report.BytesRead, len(report.Corrupt), report.Repaired, len(report.Errors))
+
+	if s.recorder != nil {
+		s.recorder.RecordScrub(report.BlobsChecked+report.ChunksChecked, report.BytesRead, len(report.Corrupt), report.Repaired)
+	}
+
+	s.mu.Lock()
+	s.lastReport = report
+	s.mu.Unlock()
+
+	return report, nil
+}
+
+// scrub verifies every blob of one store that is due
+func (s *Scrubber) scrub(ctx context.Context, store string, limit *throttle.Limiter, report *Report) error {
+	storage := s.stores[store]
+	cutoff := time.Now().Add(-s.config.MinAge)
+
+	err := storage.Walk(func(hash string, _ os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		last, err := s.metadataRepo.GetIntegrityCheck(store, hash)
+		if err != nil {
+			return fmt.Errorf("failed to load integrity check of %s: %w", hash, err)
+		}
+		// Content on record as corrupt is checked every run until it verifies
+		if s.config.MinAge > 0 && last != nil && last.Status != types.IntegrityCorrupt &&
+			last.VerifiedAt != nil && last.VerifiedAt.After(cutoff) {
+			report.Skipped++
+			return nil
+		}
+
+		n, err := storage.Verify(hash, limit.Reader)
+		report.BytesRead += n
+		if store == types.IntegrityStoreChunks {
+			report.ChunksChecked++
+		} else {
+			report.BlobsChecked++
+		}
+
+		now := time.Now()
+		switch {
+		case err == nil:
+			return s.record(store, hash, types.IntegrityOK, "", now, true, report)
+		case errors.Is(err, service.ErrCorrupt):
+			return s.handleCorrupt(ctx, store, hash, err, limit, report)
+		case errors.Is(err, service.ErrFileNotFound):
+			// Removed while we walked
+			return nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scrub %s: %w", store, err)
+	}
+	return nil
+}
+
+// handleCorrupt quarantines corrupt content and tries to restore it from a replica
+func (s *Scrubber) handleCorrupt(ctx context.Context, store, hash string, cause error, limit *throttle.Limiter, report *Report) error {
+	storage := s.stores[store]
+	finding := Finding{Store: store, Hash: hash, Detail: cause.Error()}
+	s.logger.Printf("%s", cause)
+
+	dir, err := storage.Quarantine(hash)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to quarantine %s: %v", hash, err))
+		return s.record(store, hash, types.IntegrityCorrupt, finding.Detail, time.Now(), false, report)
+	}
+	if dir == "" {
+		// Rewritten intact since it was read
+		return s.record(store, hash, types.IntegrityOK, "", time.Now(), true, report)
+	}
+	finding.Quarantined = dir
+
+	for i, replica := range s.replicas {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		root := s.config.Replicas[i]
+		if err := s.restore(storage, replica[store], hash, limit); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to restore %s from %s: %v", hash, root, err))
+			continue
+		}
+
+		finding.RepairedFrom = root
+		report.Corrupt = append(report.Corrupt, finding)
+		report.Repaired++
+		s.logger.Printf("restored %s from %s", hash, root)
+
+		detail := fmt.Sprintf("%s; restored from %s, corrupt copy in %s", finding.Detail, root, dir)
+		return s.record(store, hash, types.IntegrityRepaired, detail, time.Now(), true, report)
+	}
+
+	report.Corrupt = append(report.Corrupt, finding)
+	detail := fmt.Sprintf("%s; quarantined in %s", finding.Detail, dir)
+	return s.record(store, hash, types.IntegrityCorrupt, detail, time.Now(), false, report)
+}
+
+// restore copies hash from replica into storage, checking it as it is written
+func (s *Scrubber) restore(storage, replica *service.Storage, hash string, limit *throttle.Limiter) error {
+	reader, err := replica.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if _, err := storage.Restore(hash, limit.Reader(reader)); err != nil {
+		return err
+	}
+
+	// The copy is stored under the current policy, which may differ from the lost one
+	if storage == s.stores[types.IntegrityStoreBlobs] {
+		info, err := storage.Stat(hash)
+		if err != nil {
+			return err
+		}
+		if err := s.metadataRepo.SaveBlobInfo(hash, info); err != nil {
+			return fmt.Errorf("failed to record blob info of %s: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// record saves the outcome of checking one blob or chunk
+func (s *Scrubber) record(store, hash, status, detail string, now time.Time, verified bool, report *Report) error {
+	check := &types.IntegrityCheck{
+		Store:     store,
+		Hash:      hash,
+		Status:    status,
+		Detail:    detail,
+		CheckedAt: now,
+	}
+	if verified {
+		check.VerifiedAt = &now
+	}
+	if err := s.metadataRepo.RecordIntegrityCheck(check); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to record integrity check of %s: %v", hash, err))
+	}
+	return nil
+}
+
+// forgetRemoved drops the checks of content that is no longer stored. Corrupt
+// content stays on record until it is stored again intact.
+func (s *Scrubber) forgetRemoved(store string) error {
+	checks, err := s.metadataRepo.ListIntegrityChecks(store, "")
+	if err != nil {
+		return fmt.Errorf("failed to list integrity checks: %w", err)
+	}
+	for _, check := range checks {
+		if check.Status == types.IntegrityCorrupt || s.stores[store].Exists(check.Hash) {
+			continue
+		}
+		if err := s.metadataRepo.DeleteIntegrityCheck(store, check.Hash); err != nil {
+			return fmt.Errorf("failed to delete integrity check of %s: %w", check.Hash, err)
+		}
+	}
+	return nil
+}
+
+// Start runs a scrub immediately and then every configured interval until
+// Stop is called. It does nothing if no interval is configured.
+func (s *Scrubber) Start(ctx context.Context) {
+	if s.config.Interval <= 0 || s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	// A scrub may take hours, so Stop cancels it rather than waiting
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer close(s.done)
+		defer cancel()
+
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+
+		go func() {
+			select {
+			case <-s.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			if _, err := s.Run(ctx); err != nil && !errors.Is(err, ErrRunInProgress) && ctx.Err() == nil {
+				s.logger.Printf("scrub failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background runs, cancelling a running scrub, and waits for it to return
+func (s *Scrubber) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
@@ -0,0 +1,248 @@
+package scrub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// newTestScrubber returns a scrubber over fresh blob and chunk storage
+func newTestScrubber(t *testing.T, config *Config) (*Scrubber, *service.Storage, *service.Storage, *repository.MetadataRepository) {
+	t.Helper()
+
+	tempDir := t.TempDir()
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	t.Cleanup(func() { metadataRepo.Close() })
+
+	storage := service.NewStorage(filepath.Join(tempDir, "storage"))
+	chunks := service.NewStorage(filepath.Join(tempDir, "storage", ".chunks"))
+
+	return NewScrubber(storage, chunks, metadataRepo, config), storage, chunks, metadataRepo
+}
+
+// store writes data to storage and returns its hash
+func store(t *testing.T, storage *service.Storage, data string) string {
+	t.Helper()
+
+	hash, err := storage.Store([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to store data: %v", err)
+	}
+	return hash
+}
+
+// corrupt flips a byte of the stored file of hash
+func corrupt(t *testing.T, storage *service.Storage, hash string) {
+	t.Helper()
+
+	info, err := storage.Stat(hash)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", hash, err)
+	}
+	path := storage.GetFilePath(hash) + codec.Extension(info.Codec)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to corrupt %s: %v", path, err)
+	}
+}
+
+// run performs a scrub
+func run(t *testing.T, scrubber *Scrubber) *Report {
+	t.Helper()
+
+	report, err := scrubber.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to scrub: %v", err)
+	}
+	return report
+}
+
+// status returns the recorded status of hash in store
+func status(t *testing.T, repo *repository.MetadataRepository, store, hash string) *types.IntegrityCheck {
+	t.Helper()
+
+	check, err := repo.GetIntegrityCheck(store, hash)
+	if err != nil || check == nil {
+		t.Fatalf("Expected an integrity check of %s (%v)", hash, err)
+	}
+	return check
+}
+
+// recorder keeps what a scrub reports
+type recorder struct {
+	checked, corrupt, repaired int
+	bytes                      int64
+}
+
+func (r *recorder) RecordScrub(checked int, bytes int64, corrupt, repaired int) {
+	r.checked, r.bytes, r.corrupt, r.repaired = checked, bytes, corrupt, repaired
+}
+
+func TestScrubDetectsCorruption(t *testing.T) {
+	scrubber, storage, chunks, repo := newTestScrubber(t, &Config{})
+	metrics := &recorder{}
+	scrubber.SetRecorder(metrics)
+
+	good := store(t, storage, "intact content")
+	bad := store(t, storage, "content that will rot")
+	badChunk := store(t, chunks, "a chunk that will rot")
+	corrupt(t, storage, bad)
+	corrupt(t, chunks, badChunk)
+
+	report := run(t, scrubber)
+	if report.BlobsChecked != 2 || report.ChunksChecked != 1 {
+		t.Errorf("Expected 2 blobs and 1 chunk checked, got %d and %d", report.BlobsChecked, report.ChunksChecked)
+	}
+	if len(report.Corrupt) != 2 || report.Repaired != 0 {
+		t.Fatalf("Expected 2 corrupt and none repaired, got %+v", report.Corrupt)
+	}
+	if metrics.checked != 3 || metrics.corrupt != 2 {
+		t.Errorf("Expected the outcome to be recorded, got %+v", metrics)
+	}
+
+	if check := status(t, repo, types.IntegrityStoreBlobs, good); check.Status != types.IntegrityOK || check.VerifiedAt == nil {
+		t.Errorf("Expected %s verified, got %+v", good, check)
+	}
+	check := status(t, repo, types.IntegrityStoreBlobs, bad)
+	if check.Status != types.IntegrityCorrupt || check.VerifiedAt != nil {
+		t.Errorf("Expected %s corrupt and never verified, got %+v", bad, check)
+	}
+	if status(t, repo, types.IntegrityStoreChunks, badChunk).Status != types.IntegrityCorrupt {
+		t.Error("Expected the chunk to be recorded as corrupt")
+	}
+
+	// Corrupt content is moved out of the store
+	if storage.Exists(bad) || chunks.Exists(badChunk) {
+		t.Error("Expected corrupt content to be quarantined")
+	}
+	if _, err := os.Stat(report.Corrupt[0].Quarantined); err != nil {
+		t.Errorf("Expected the quarantine directory to exist: %v", err)
+	}
+
+	summary, err := repo.GetIntegritySummary()
+	if err != nil {
+		t.Fatalf("Failed to get summary: %v", err)
+	}
+	if summary.Checked != 3 || summary.OK != 1 || summary.Corrupt != 2 || summary.LastCheckedAt == nil {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+
+	// Quarantined content stays on record as corrupt until stored again intact
+	run(t, scrubber)
+	if status(t, repo, types.IntegrityStoreBlobs, bad).Status != types.IntegrityCorrupt {
+		t.Error("Expected the quarantined blob to stay on record")
+	}
+	store(t, storage, "content that will rot")
+	run(t, scrubber)
+	if check := status(t, repo, types.IntegrityStoreBlobs, bad); check.Status != types.IntegrityOK {
+		t.Errorf("Expected the re-stored blob to verify, got %+v", check)
+	}
+
+	// Content removed from storage is forgotten
+	if err := storage.Delete(good); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+	run(t, scrubber)
+	if check, _ := repo.GetIntegrityCheck(types.IntegrityStoreBlobs, good); check != nil {
+		t.Errorf("Expected the check of a removed blob to be dropped, got %+v", check)
+	}
+}
+
+func TestScrubRepairsFromReplica(t *testing.T) {
+	replicaRoot := t.TempDir()
+	scrubber, storage, chunks, repo := newTestScrubber(t, &Config{Replicas: []string{t.TempDir(), replicaRoot}})
+
+	// The first replica lacks the content; the second holds it, chunks included
+	replica := service.NewStorage(replicaRoot)
+	replicaChunks := service.NewStorage(filepath.Join(replicaRoot, ".chunks"))
+
+	hash := store(t, storage, "precious content")
+	chunk := store(t, chunks, "precious chunk")
+	store(t, replica, "precious content")
+	store(t, replicaChunks, "precious chunk")
+	corrupt(t, storage, hash)
+	corrupt(t, chunks, chunk)
+
+	report := run(t, scrubber)
+	if report.Repaired != 2 || len(report.Corrupt) != 2 {
+		t.Fatalf("Expected 2 repaired, got %d of %d (%v)", report.Repaired, len(report.Corrupt), report.Errors)
+	}
+	if report.Corrupt[0].RepairedFrom != replicaRoot {
+		t.Errorf("Expected the repair to come from %s, got %s", replicaRoot, report.Corrupt[0].RepairedFrom)
+	}
+
+	data, err := storage.Retrieve(hash)
+	if err != nil || string(data) != "precious content" {
+		t.Errorf("Expected the repaired content back (%v)", err)
+	}
+	if _, err := chunks.Verify(chunk, nil); err != nil {
+		t.Errorf("Expected the repaired chunk to verify: %v", err)
+	}
+	if check := status(t, repo, types.IntegrityStoreBlobs, hash); check.Status != types.IntegrityRepaired || check.VerifiedAt == nil {
+		t.Errorf("Expected %s recorded as repaired, got %+v", hash, check)
+	}
+
+	// A replica that is itself corrupt is not trusted
+	other := store(t, storage, "rotten everywhere")
+	store(t, replica, "rotten everywhere")
+	corrupt(t, storage, other)
+	corrupt(t, replica, other)
+
+	report = run(t, scrubber)
+	if report.Repaired != 0 || len(report.Corrupt) != 1 {
+		t.Errorf("Expected 1 corrupt and none repaired, got %d of %d", report.Repaired, len(report.Corrupt))
+	}
+	if storage.Exists(other) {
+		t.Error("Expected the corrupt blob to stay quarantined")
+	}
+}
+
+func TestScrubMinAge(t *testing.T) {
+	scrubber, storage, _, _ := newTestScrubber(t, &Config{MinAge: time.Hour})
+
+	store(t, storage, "checked once")
+	if report := run(t, scrubber); report.BlobsChecked != 1 {
+		t.Fatalf("Expected 1 blob checked, got %d", report.BlobsChecked)
+	}
+
+	// Verified within the hour, so the next run leaves it alone
+	report := run(t, scrubber)
+	if report.BlobsChecked != 0 || report.Skipped != 1 {
+		t.Errorf("Expected the blob to be skipped, got %d checked and %d skipped", report.BlobsChecked, report.Skipped)
+	}
+}
+
+func TestScrubRateLimit(t *testing.T) {
+	scrubber, storage, _, _ := newTestScrubber(t, &Config{RateLimit: 20 * 1024})
+
+	store(t, storage, string(bytes.Repeat([]byte("x"), 10*1024)))
+
+	started := time.Now()
+	run(t, scrubber)
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected 10KiB at 20KiB/s to take about half a second, took %s", elapsed)
+	}
+
+	// A cancelled scrub stops reading
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := scrubber.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled scrub to fail with context.Canceled, got %v", err)
+	}
+}
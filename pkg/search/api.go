@@ -571,7 +571,7 @@ func (e *SearchEngine) GetSimilarFiles(ctx context.Context, sha1 string, limit i
 	}
 
 	// 使用AI服务获取相似文件
-	metadata, err := e.metadataRepo.GetMetadata(sha1)
+	metadata, err := e.metadataRepo.GetMetadataByHash(sha1)
 	if err != nil {
 		return nil, err
 	}
@@ -592,9 +592,9 @@ func (e *SearchEngine) GetSimilarFiles(ctx context.Context, sha1 string, limit i
 		}
 
 		for _, file := range result.Files {
-			if file.SHA1 != sha1 { // 排除自己
+			if file.Hash != sha1 { // 排除自己
 				similarFiles = append(similarFiles, &SimilarFile{
-					SHA1:     file.SHA1,
+					SHA1:     file.Hash,
 					Filename: file.FileName,
 					Score:    file.Score,
 					Reason:   fmt.Sprintf("Similar tag: %s", tag),
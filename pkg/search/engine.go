@@ -139,13 +139,13 @@ type InvertedIndex struct {
 
 // TermInfo 词汇信息
 type TermInfo struct {
-	Postings map[string]*PostingInfo // SHA1 -> PostingInfo
+	Postings map[string]*PostingInfo // object ID -> PostingInfo
 	DF       int                     // Document Frequency
 }
 
 // PostingInfo 倒排列表项
 type PostingInfo struct {
-	SHA1       string
+	ID         string
 	Positions  []int
 	Frequency  int
 	Boost      float64
@@ -418,7 +418,7 @@ func (e *SearchEngine) searchFullText(ctx context.Context, query *SearchQuery) (
 	// 转换为搜索结果
 	var results []*SearchResultFile
 	for _, posting := range postings {
-		file, err := e.metadataRepo.GetMetadata(posting.SHA1)
+		file, err := e.metadataRepo.GetMetadata(posting.ID)
 		if err != nil {
 			continue
 		}
@@ -456,7 +456,7 @@ func (e *SearchEngine) searchFuzzy(ctx context.Context, query *SearchQuery) ([]*
 			termInfo := e.index.GetTerm(similarTerm)
 			if termInfo != nil {
 				for _, posting := range termInfo.Postings {
-					file, err := e.metadataRepo.GetMetadata(posting.SHA1)
+					file, err := e.metadataRepo.GetMetadata(posting.ID)
 					if err != nil {
 						continue
 					}
@@ -567,14 +567,14 @@ func (e *SearchEngine) indexFile(file *types.FileMetadata) {
 	// 为文件名建立索引
 	terms := e.tokenize(file.FileName)
 	for _, term := range terms {
-		e.index.AddPosting(term, file.SHA1, 1.0)
+		e.index.AddPosting(term, file.ID, 1.0)
 	}
 
 	// 为描述建立索引
 	if file.Description != "" {
 		terms = e.tokenize(file.Description)
 		for _, term := range terms {
-			e.index.AddPosting(term, file.SHA1, 0.8)
+			e.index.AddPosting(term, file.ID, 0.8)
 		}
 	}
 
@@ -582,7 +582,7 @@ func (e *SearchEngine) indexFile(file *types.FileMetadata) {
 	for _, tag := range file.Tags {
 		terms = e.tokenize(tag)
 		for _, term := range terms {
-			e.index.AddPosting(term, file.SHA1, 0.9)
+			e.index.AddPosting(term, file.ID, 0.9)
 		}
 	}
 }
@@ -628,16 +628,16 @@ func (e *SearchEngine) mergeResults(a, b []*SearchResultFile) []*SearchResultFil
 	var merged []*SearchResultFile
 
 	for _, result := range a {
-		if !seen[result.SHA1] {
+		if !seen[result.ID] {
 			merged = append(merged, result)
-			seen[result.SHA1] = true
+			seen[result.ID] = true
 		}
 	}
 
 	for _, result := range b {
-		if !seen[result.SHA1] {
+		if !seen[result.ID] {
 			merged = append(merged, result)
-			seen[result.SHA1] = true
+			seen[result.ID] = true
 		}
 	}
 
@@ -682,14 +682,14 @@ func (e *SearchEngine) addSimilarFiles(ctx context.Context, results []*SearchRes
 			break
 		}
 
-		similar, err := e.aiService.GetSimilarFiles(ctx, result.SHA1, 3)
+		similar, err := e.aiService.GetSimilarFiles(ctx, result.Hash, 3)
 		if err != nil {
 			continue
 		}
 
 		for _, simFile := range similar {
 			result.Similar = append(result.Similar, &SimilarFile{
-				SHA1:     simFile.SHA1,
+				SHA1:     simFile.Hash,
 				Filename: simFile.FileName,
 				Score:    0.8, // 占位符分数
 				Reason:   "Similar content",
@@ -806,7 +806,7 @@ func NewInvertedIndex() *InvertedIndex {
 	}
 }
 
-func (idx *InvertedIndex) AddPosting(term, sha1 string, boost float64) {
+func (idx *InvertedIndex) AddPosting(term, id string, boost float64) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
@@ -817,15 +817,15 @@ func (idx *InvertedIndex) AddPosting(term, sha1 string, boost float64) {
 	}
 
 	termInfo := idx.terms[term]
-	if termInfo.Postings[sha1] == nil {
-		termInfo.Postings[sha1] = &PostingInfo{
-			SHA1:       sha1,
+	if termInfo.Postings[id] == nil {
+		termInfo.Postings[id] = &PostingInfo{
+			ID:         id,
 			Boost:      boost,
 			LastAccess: time.Now(),
 		}
 		termInfo.DF++
 	} else {
-		posting := termInfo.Postings[sha1]
+		posting := termInfo.Postings[id]
 		posting.Frequency++
 		posting.LastAccess = time.Now()
 	}
@@ -90,7 +90,7 @@ func TestSearchEngine_MatchesQuery(t *testing.T) {
 
 	// 创建测试文件
 	file := &types.FileMetadata{
-		SHA1:        "test123",
+		Hash:        "test123",
 		FileName:    "test_document.pdf",
 		Size:        1024,
 		Tags:        []string{"document", "important"},
@@ -180,7 +180,7 @@ func TestSearchEngine_CalculateScore(t *testing.T) {
 
 	// 创建测试文件
 	file := &types.FileMetadata{
-		SHA1:        "test123",
+		Hash:        "test123",
 		FileName:    "test_document.pdf",
 		Size:        1024,
 		Tags:        []string{"document", "important"},
@@ -359,7 +359,7 @@ func TestSearchEngine_Integration(t *testing.T) {
 	// 添加测试数据
 	testFiles := []*types.FileMetadata{
 		{
-			SHA1:        "file1",
+			Hash:        "file1",
 			FileName:    "document1.pdf",
 			Size:        1024,
 			Tags:        []string{"document", "important"},
@@ -367,7 +367,7 @@ func TestSearchEngine_Integration(t *testing.T) {
 			UploadedAt:  time.Now().Add(-1 * time.Hour),
 		},
 		{
-			SHA1:        "file2",
+			Hash:        "file2",
 			FileName:    "image1.jpg",
 			Size:        2048,
 			Tags:        []string{"image", "photo"},
@@ -375,7 +375,7 @@ func TestSearchEngine_Integration(t *testing.T) {
 			UploadedAt:  time.Now().Add(-2 * time.Hour),
 		},
 		{
-			SHA1:        "file3",
+			Hash:        "file3",
 			FileName:    "document2.pdf",
 			Size:        512,
 			Tags:        []string{"document", "draft"},
@@ -486,7 +486,7 @@ func BenchmarkSearchEngine_Search(b *testing.B) {
 	// 添加大量测试数据
 	for i := 0; i < 1000; i++ {
 		file := &types.FileMetadata{
-			SHA1:        fmt.Sprintf("file%d", i),
+			Hash:        fmt.Sprintf("file%d", i),
 			FileName:    fmt.Sprintf("document%d.pdf", i),
 			Size:        int64(1024 + i*100),
 			Tags:        []string{"document", fmt.Sprintf("tag%d", i%10)},
@@ -487,15 +487,15 @@ func (s *SearchServiceImpl) IndexFile(ctx context.Context, metadata *types.FileM
 }
 
 // RemoveFromIndex 从索引中移除文件
-func (s *SearchServiceImpl) RemoveFromIndex(ctx context.Context, sha1 string) error {
+func (s *SearchServiceImpl) RemoveFromIndex(ctx context.Context, id string) error {
 	// 实现从索引中移除文件
 	s.searchEngine.index.mu.Lock()
 	defer s.searchEngine.index.mu.Unlock()
 
 	// 从倒排索引中移除文件
 	for term, termInfo := range s.searchEngine.index.terms {
-		if posting, exists := termInfo.Postings[sha1]; exists {
-			delete(termInfo.Postings, sha1)
+		if posting, exists := termInfo.Postings[id]; exists {
+			delete(termInfo.Postings, id)
 			termInfo.DF--
 			if termInfo.DF == 0 {
 				delete(s.searchEngine.index.terms, term)
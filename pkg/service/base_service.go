@@ -2,8 +2,10 @@ package service
 
 import (
 	"context"
+	"io"
 	"time"
 
+	"github.com/zots0127/io/pkg/digest"
 	"github.com/zots0127/io/pkg/types"
 )
 
@@ -83,6 +85,7 @@ type ServiceConfig struct {
 	EnableCompression  bool          `json:"enable_compression"`
 	CacheEnabled       bool          `json:"cache_enabled"`
 	CacheTTL           time.Duration `json:"cache_ttl"`
+	MaxFileSize        int64         `json:"max_file_size"`
 }
 
 // DefaultServiceConfig returns default service configuration
@@ -97,6 +100,7 @@ func DefaultServiceConfig() *ServiceConfig {
 		EnableCompression: false,
 		CacheEnabled:      false,
 		CacheTTL:          5 * time.Minute,
+		MaxFileSize:       100 * 1024 * 1024, // 100MB
 	}
 }
 
@@ -120,6 +124,9 @@ func (c *ServiceConfig) Validate() error {
 	if c.CacheTTL <= 0 {
 		c.CacheTTL = 5 * time.Minute
 	}
+	if c.MaxFileSize <= 0 {
+		c.MaxFileSize = 100 * 1024 * 1024
+	}
 	return nil
 }
 
@@ -133,21 +140,30 @@ type Service interface {
 // Storage interface defines storage operations
 type Storage interface {
 	Store(data []byte) (string, error)
-	Retrieve(sha1Hash string) ([]byte, error)
-	Delete(sha1Hash string) error
-	Exists(sha1Hash string) bool
+	StoreFromReader(reader io.Reader) (string, int64, error)
+	Retrieve(hash string) ([]byte, error)
+	Open(hash string) (io.ReadSeekCloser, error)
+	Delete(hash string) error
+	Exists(hash string) bool
+	Stat(hash string) (*types.BlobInfo, error)
+	Algorithm() *digest.Algorithm
 }
 
-// FileService interface defines file operations
+// FileService interface defines file operations.
+// Content is addressed by its content hash; named files (objects) are addressed by their ID.
 type FileService interface {
 	Service
 	Store(ctx context.Context, data []byte, metadata *types.FileMetadata) (*types.FileMetadata, error)
-	Retrieve(ctx context.Context, sha1 string) ([]byte, *types.FileMetadata, error)
-	Delete(ctx context.Context, sha1 string) error
-	Exists(ctx context.Context, sha1 string) (bool, error)
-	GetMetadata(ctx context.Context, sha1 string) (*types.FileMetadata, error)
-	UpdateMetadata(ctx context.Context, sha1 string, metadata *types.FileMetadata) error
-	DeleteMetadata(ctx context.Context, sha1 string) error
+	StoreStream(ctx context.Context, reader io.Reader, metadata *types.FileMetadata) (*types.FileMetadata, error)
+	Retrieve(ctx context.Context, hash string) ([]byte, *types.FileMetadata, error)
+	RetrieveStream(ctx context.Context, hash string) (io.ReadSeekCloser, *types.FileMetadata, error)
+	RetrieveObject(ctx context.Context, id string) (io.ReadSeekCloser, *types.FileMetadata, error)
+	Delete(ctx context.Context, id string) error
+	Purge(ctx context.Context, hash string) error
+	Exists(ctx context.Context, hash string) (bool, error)
+	GetMetadata(ctx context.Context, id string) (*types.FileMetadata, error)
+	UpdateMetadata(ctx context.Context, id string, metadata *types.FileMetadata) error
+	DeleteMetadata(ctx context.Context, id string) error
 	List(ctx context.Context, filter *types.MetadataFilter) ([]*types.FileMetadata, error)
 }
 
@@ -173,6 +189,6 @@ type BatchService interface {
 	Service
 	ProcessBatch(ctx context.Context, req *BatchRequest) (*BatchResult, error)
 	BatchUpload(ctx context.Context, files []map[string]interface{}) (*BatchResult, error)
-	BatchDelete(ctx context.Context, sha1s []string) (*BatchResult, error)
+	BatchDelete(ctx context.Context, ids []string) (*BatchResult, error)
 	BatchUpdate(ctx context.Context, updates []map[string]interface{}) (*BatchResult, error)
 }
\ No newline at end of file
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -122,12 +123,12 @@ func (s *BatchServiceImpl) BatchUpload(ctx context.Context, files []map[string]i
 	return s.batchUpload(ctx, req)
 }
 
-// BatchDelete performs batch deletion of files
-func (s *BatchServiceImpl) BatchDelete(ctx context.Context, sha1s []string) (*BatchResult, error) {
-	items := make([]map[string]interface{}, len(sha1s))
-	for i, sha1 := range sha1s {
+// BatchDelete performs batch deletion of files by object ID
+func (s *BatchServiceImpl) BatchDelete(ctx context.Context, ids []string) (*BatchResult, error) {
+	items := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
 		items[i] = map[string]interface{}{
-			"sha1": sha1,
+			"id": id,
 		}
 	}
 
@@ -224,21 +225,21 @@ func (s *BatchServiceImpl) batchDelete(ctx context.Context, req *BatchRequest) (
 
 	// Process items
 	for i, item := range req.Items {
-		sha1, ok := item["sha1"].(string)
+		id, ok := item["id"].(string)
 		if !ok {
 			result.Results[i] = ServiceResponse{
 				Success: false,
-				Error:   "invalid or missing SHA1",
+				Error:   "invalid or missing ID",
 			}
 			result.Failed++
 			result.Errors = append(result.Errors, map[string]interface{}{
 				"index": i,
-				"error": "invalid or missing SHA1",
+				"error": "invalid or missing ID",
 			})
 			continue
 		}
 
-		err := s.fileService.Delete(ctx, sha1)
+		err := s.fileService.Delete(ctx, id)
 		if err != nil {
 			result.Results[i] = ServiceResponse{
 				Success: false,
@@ -252,7 +253,7 @@ func (s *BatchServiceImpl) batchDelete(ctx context.Context, req *BatchRequest) (
 		} else {
 			result.Results[i] = ServiceResponse{
 				Success: true,
-				Data:    map[string]interface{}{"sha1": sha1},
+				Data:    map[string]interface{}{"id": id},
 			}
 			result.Success++
 		}
@@ -281,22 +282,22 @@ func (s *BatchServiceImpl) batchUpdate(ctx context.Context, req *BatchRequest) (
 
 	// Process items
 	for i, item := range req.Items {
-		sha1, ok := item["sha1"].(string)
+		id, ok := item["id"].(string)
 		if !ok {
 			result.Results[i] = ServiceResponse{
 				Success: false,
-				Error:   "invalid or missing SHA1",
+				Error:   "invalid or missing ID",
 			}
 			result.Failed++
 			result.Errors = append(result.Errors, map[string]interface{}{
 				"index": i,
-				"error": "invalid or missing SHA1",
+				"error": "invalid or missing ID",
 			})
 			continue
 		}
 
 		// Extract metadata update
-		metadata := &types.FileMetadata{SHA1: sha1}
+		metadata := &types.FileMetadata{ID: id}
 		if filename, ok := item["filename"].(string); ok {
 			metadata.FileName = filename
 		}
@@ -310,7 +311,7 @@ func (s *BatchServiceImpl) batchUpdate(ctx context.Context, req *BatchRequest) (
 			metadata.IsPublic = isPublic
 		}
 
-		err := s.fileService.UpdateMetadata(ctx, sha1, metadata)
+		err := s.fileService.UpdateMetadata(ctx, id, metadata)
 		if err != nil {
 			result.Results[i] = ServiceResponse{
 				Success: false,
@@ -324,7 +325,7 @@ func (s *BatchServiceImpl) batchUpdate(ctx context.Context, req *BatchRequest) (
 		} else {
 			result.Results[i] = ServiceResponse{
 				Success: true,
-				Data:    map[string]interface{}{"sha1": sha1},
+				Data:    map[string]interface{}{"id": id},
 			}
 			result.Success++
 		}
@@ -359,9 +360,13 @@ func (s *BatchServiceImpl) batchUploadWorker(ctx context.Context, wg *sync.WaitG
 }
 
 func (s *BatchServiceImpl) processBatchUploadItem(ctx context.Context, item map[string]interface{}) ServiceResponse {
-	// Extract file data
-	data, ok := item["data"].([]byte)
-	if !ok {
+	// Extract file data, either buffered or as a stream
+	if closer, ok := item["reader"].(io.Closer); ok {
+		defer closer.Close()
+	}
+	reader, isStream := item["reader"].(io.Reader)
+	data, isBuffered := item["data"].([]byte)
+	if !isStream && !isBuffered {
 		return ServiceResponse{
 			Success: false,
 			Error:   "invalid or missing file data",
@@ -379,6 +384,12 @@ func (s *BatchServiceImpl) processBatchUploadItem(ctx context.Context, item map[
 	if uploadedBy, ok := item["uploaded_by"].(string); ok {
 		metadata.UploadedBy = uploadedBy
 	}
+	if apiKeyID, ok := item["api_key_id"].(string); ok {
+		metadata.APIKeyID = apiKeyID
+	}
+	if size, ok := item["size"].(int64); ok {
+		metadata.Size = size
+	}
 	if description, ok := item["description"].(string); ok {
 		metadata.Description = description
 	}
@@ -387,7 +398,13 @@ func (s *BatchServiceImpl) processBatchUploadItem(ctx context.Context, item map[
 	}
 
 	// Store file
-	storedMetadata, err := s.fileService.Store(ctx, data, metadata)
+	var storedMetadata *types.FileMetadata
+	var err error
+	if isStream {
+		storedMetadata, err = s.fileService.StoreStream(ctx, reader, metadata)
+	} else {
+		storedMetadata, err = s.fileService.Store(ctx, data, metadata)
+	}
 	if err != nil {
 		return ServiceResponse{
 			Success: false,
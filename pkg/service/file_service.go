@@ -2,8 +2,10 @@ package service
 
 import (
 	"context"
-	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"mime"
@@ -12,10 +14,23 @@ import (
 	"strings"
 	"time"
 
+	"github.com/zots0127/io/pkg/digest"
 	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/quota"
+	"github.com/zots0127/io/pkg/retention"
+	storageservice "github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/tiering"
+	"github.com/zots0127/io/pkg/trash"
 	"github.com/zots0127/io/pkg/types"
 )
 
+// ErrFileTooLarge is returned when a file exceeds the configured maximum size
+var ErrFileTooLarge = errors.New("file exceeds maximum allowed size")
+
+// ErrExpired is returned when an object is requested after its expiry time.
+// It is no longer served, though it may not have been deleted yet.
+var ErrExpired = errors.New("object has expired")
+
 // FileServiceImpl implements FileService interface
 type FileServiceImpl struct {
 	*BaseService
@@ -23,6 +38,10 @@ type FileServiceImpl struct {
 	metadataRepo  *repository.MetadataRepository
 	config        *ServiceConfig
 	logger        *log.Logger
+	quotas        *quota.Enforcer
+	tiering       *tiering.Manager
+	retention     *retention.Enforcer
+	trash         *trash.Bin
 }
 
 // NewFileService creates a new file service instance
@@ -45,26 +64,26 @@ func NewFileService(storage Storage, metadataRepo *repository.MetadataRepository
 func (s *FileServiceImpl) Health(ctx context.Context) error {
 	// Check storage availability
 	tempData := []byte("health_check")
-	tempSHA1 := fmt.Sprintf("%x", sha1.Sum(tempData))
+	tempHash := digest.Sum(s.storage.Algorithm(), tempData)
 
 	// Try to store and retrieve a small test file
-	sha1Hash, err := s.storage.Store(tempData)
+	hash, err := s.storage.Store(tempData)
 	if err != nil {
 		return fmt.Errorf("storage health check failed: %w", err)
 	}
 
-	// Verify the returned SHA1 matches our expected SHA1
-	if sha1Hash != tempSHA1 {
-		return fmt.Errorf("SHA1 hash mismatch in health check: expected %s, got %s", tempSHA1, sha1Hash)
+	// Verify the returned hash matches our expected hash
+	if hash != tempHash {
+		return fmt.Errorf("hash mismatch in health check: expected %s, got %s", tempHash, hash)
 	}
 
-	_, err = s.storage.Retrieve(tempSHA1)
+	_, err = s.storage.Retrieve(tempHash)
 	if err != nil {
 		return fmt.Errorf("storage retrieval health check failed: %w", err)
 	}
 
 	// Clean up test file
-	_ = s.storage.Delete(sha1Hash)
+	_ = s.storage.Delete(hash)
 
 	// Check metadata repository if available
 	if s.metadataRepo != nil {
@@ -77,6 +96,48 @@ func (s *FileServiceImpl) Health(ctx context.Context) error {
 	return nil
 }
 
+// SetQuotas enforces quotas on every upload. Uploads are charged to
+// metadata.UploadedBy and metadata.APIKeyID. A nil enforcer disables quotas.
+func (s *FileServiceImpl) SetQuotas(quotas *quota.Enforcer) {
+	s.quotas = quotas
+}
+
+// SetRetention refuses to delete objects, or change their metadata, while
+// retention or a legal hold protects them. A nil enforcer protects nothing.
+func (s *FileServiceImpl) SetRetention(enforcer *retention.Enforcer) {
+	s.retention = enforcer
+}
+
+// checkRetention returns retention.ErrLocked unless action may be applied to
+// object id. A missing object is left for the change itself to report.
+func (s *FileServiceImpl) checkRetention(ctx context.Context, action, id string) error {
+	if s.retention == nil || s.metadataRepo == nil {
+		return nil
+	}
+	metadata, err := s.metadataRepo.GetMetadata(id)
+	if err != nil {
+		return nil
+	}
+	return s.retention.Check(ctx, action, metadata)
+}
+
+// SetTrash moves deleted objects to the trash while it is enabled, so they
+// can be restored until it is purged. A nil bin deletes objects for good.
+func (s *FileServiceImpl) SetTrash(bin *trash.Bin) {
+	s.trash = bin
+}
+
+// trashEnabled reports whether deleted objects are moved to the trash
+func (s *FileServiceImpl) trashEnabled() bool {
+	return s.trash != nil && s.trash.Enabled()
+}
+
+// SetTiering promotes cold content back to hot storage whenever it is read.
+// A nil manager leaves content wherever it is.
+func (s *FileServiceImpl) SetTiering(manager *tiering.Manager) {
+	s.tiering = manager
+}
+
 // GetConfig returns the current service configuration
 func (s *FileServiceImpl) GetConfig() *ServiceConfig {
 	return s.config
@@ -99,12 +160,136 @@ func (s *FileServiceImpl) Store(ctx context.Context, data []byte, metadata *type
 		s.logger.Printf("Storing file: %s (size: %d bytes)", metadata.FileName, len(data))
 	}
 
-	// Calculate SHA1 if not provided
-	if metadata.SHA1 == "" {
-		sha1Hash := sha1.Sum(data)
-		metadata.SHA1 = fmt.Sprintf("%x", sha1Hash)
+	if int64(len(data)) > s.config.MaxFileSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d", ErrFileTooLarge, len(data), s.config.MaxFileSize)
+	}
+
+	reservation, err := s.reserveQuota(metadata, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	defer reservation.Release()
+
+	// Verify a client-provided hash, which may use any supported algorithm
+	claimed := metadata.Hash
+	if claimed != "" {
+		ok, err := digest.Verify(claimed, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash: %w", err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("hash mismatch: expected %s", claimed)
+		}
+	}
+
+	// Store the file
+	hash, err := s.storage.Store(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+	metadata.Hash = hash
+
+	if err := s.commitMetadata(metadata, int64(len(data))); err != nil {
+		return nil, err
+	}
+	s.recordDigest(hash, claimed)
+	s.recordBlobInfo(hash)
+
+	duration := time.Since(startTime)
+	if s.config.EnableLogging {
+		s.logger.Printf("File stored successfully: %s (duration: %v)", metadata.Hash, duration)
 	}
 
+	return metadata, nil
+}
+
+// StoreStream stores a file read from reader, hashing it while it is written to storage.
+// The content is never held in memory as a whole. A positive metadata.Size is
+// taken as the expected size, so an upload over quota is refused before it is read.
+func (s *FileServiceImpl) StoreStream(ctx context.Context, reader io.Reader, metadata *types.FileMetadata) (*types.FileMetadata, error) {
+	startTime := time.Now()
+
+	if s.config.EnableLogging {
+		s.logger.Printf("Storing file stream: %s", metadata.FileName)
+	}
+
+	reservation, err := s.reserveQuota(metadata, metadata.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer reservation.Release()
+
+	// A client-provided hash may use a different algorithm than storage,
+	// in which case it is computed alongside while the content streams in
+	claimed := metadata.Hash
+	var claimedAlgorithm *digest.Algorithm
+	var claimedHasher hash.Hash
+	if claimed != "" {
+		algorithm, _, err := digest.Parse(claimed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash: %w", err)
+		}
+		if algorithm != s.storage.Algorithm() {
+			claimedAlgorithm = algorithm
+			claimedHasher = algorithm.New()
+			reader = io.TeeReader(reader, claimedHasher)
+		}
+	}
+
+	limited := &maxSizeReader{reader: reader, remaining: s.config.MaxFileSize}
+	hash, size, err := s.storage.StoreFromReader(limited)
+	if err != nil {
+		if errors.Is(err, ErrFileTooLarge) {
+			return nil, ErrFileTooLarge
+		}
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+
+	// Verify the computed hash matches the expected hash if one was provided
+	if claimed != "" {
+		computed := hash
+		if claimedHasher != nil {
+			computed = digest.Format(claimedAlgorithm, claimedHasher.Sum(nil))
+		}
+		if expected, _ := digest.Normalize(claimed); computed != expected {
+			return nil, fmt.Errorf("hash mismatch: expected %s, got %s", claimed, computed)
+		}
+	}
+	metadata.Hash = hash
+
+	// The stored blob is left for the garbage collector if it does not fit
+	if err := reservation.Extend(size); err != nil {
+		return nil, err
+	}
+
+	if err := s.commitMetadata(metadata, size); err != nil {
+		return nil, err
+	}
+	s.recordDigest(hash, claimed)
+	s.recordBlobInfo(hash)
+
+	duration := time.Since(startTime)
+	if s.config.EnableLogging {
+		s.logger.Printf("File stored successfully: %s (size: %d bytes, duration: %v)", metadata.Hash, size, duration)
+	}
+
+	return metadata, nil
+}
+
+// reserveQuota holds size bytes and one object against the quotas of the
+// uploader. It returns a nil reservation when quotas are not enforced.
+func (s *FileServiceImpl) reserveQuota(metadata *types.FileMetadata, size int64) (*quota.Reservation, error) {
+	if s.quotas == nil {
+		return nil, nil
+	}
+	if size < 0 {
+		size = 0
+	}
+	return s.quotas.Reserve(quota.Owner{User: metadata.UploadedBy, APIKeyID: metadata.APIKeyID}, size)
+}
+
+// commitMetadata fills in derived metadata fields and persists them for a stored blob
+func (s *FileServiceImpl) commitMetadata(metadata *types.FileMetadata, size int64) error {
 	// Auto-detect content type if not provided
 	if metadata.ContentType == "" {
 		metadata.ContentType = mime.TypeByExtension(filepath.Ext(metadata.FileName))
@@ -114,7 +299,7 @@ func (s *FileServiceImpl) Store(ctx context.Context, data []byte, metadata *type
 	}
 
 	// Set file size
-	metadata.Size = int64(len(data))
+	metadata.Size = size
 
 	// Set timestamps
 	now := time.Now()
@@ -122,170 +307,372 @@ func (s *FileServiceImpl) Store(ctx context.Context, data []byte, metadata *type
 	metadata.LastAccessed = now
 	metadata.AccessCount = 1
 
-	// Store the file
-	sha1Hash, err := s.storage.Store(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to store file: %w", err)
-	}
-
-	// Verify the returned SHA1 matches our expected SHA1
-	if sha1Hash != metadata.SHA1 {
-		return nil, fmt.Errorf("SHA1 hash mismatch: expected %s, got %s", metadata.SHA1, sha1Hash)
-	}
+	// Every upload is a new object, even when its content is already stored
+	metadata.ID = ""
 
 	// Store metadata if repository is available
 	if s.metadataRepo != nil {
 		if err := s.metadataRepo.SaveMetadata(metadata); err != nil {
-			// Try to clean up the stored file if metadata save fails
-			_ = s.storage.Delete(metadata.SHA1)
-			return nil, fmt.Errorf("failed to save metadata: %w", err)
+			return fmt.Errorf("failed to save metadata: %w", err)
 		}
 	}
 
-	duration := time.Since(startTime)
-	if s.config.EnableLogging {
-		s.logger.Printf("File stored successfully: %s (duration: %v)", metadata.SHA1, duration)
+	return nil
+}
+
+// recordBlobInfo records the codec blob hash is stored with, so compressed
+// blobs are accounted for by their size on disk
+func (s *FileServiceImpl) recordBlobInfo(hash string) {
+	if s.metadataRepo == nil {
+		return
 	}
+	info, err := s.storage.Stat(hash)
+	if err != nil {
+		s.logger.Printf("Warning: failed to stat %s: %v", hash, err)
+		return
+	}
+	if err := s.metadataRepo.SaveBlobInfo(hash, info); err != nil {
+		s.logger.Printf("Warning: failed to record storage info for %s: %v", hash, err)
+	}
+}
 
-	return metadata, nil
+// recordDigest stores a verified client-provided digest of blob hash when it
+// uses a different algorithm, so the content can also be found by it
+func (s *FileServiceImpl) recordDigest(hash, claimed string) {
+	if s.metadataRepo == nil || claimed == "" {
+		return
+	}
+	algorithm, sum, err := digest.Parse(claimed)
+	if err != nil || digest.Format(algorithm, sum) == hash {
+		return
+	}
+	if err := s.metadataRepo.SaveDigest(hash, algorithm.Name, hex.EncodeToString(sum)); err != nil {
+		s.logger.Printf("Warning: failed to record %s digest for %s: %v", algorithm.Name, hash, err)
+	}
 }
 
 // Retrieve retrieves a file and its metadata
-func (s *FileServiceImpl) Retrieve(ctx context.Context, sha1 string) ([]byte, *types.FileMetadata, error) {
+func (s *FileServiceImpl) Retrieve(ctx context.Context, hash string) ([]byte, *types.FileMetadata, error) {
 	startTime := time.Now()
 
 	if s.config.EnableLogging {
-		s.logger.Printf("Retrieving file: %s", sha1)
+		s.logger.Printf("Retrieving file: %s", hash)
+	}
+
+	if err := s.checkExpired(hash); err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.promote(ctx, hash); err != nil {
+		return nil, nil, err
 	}
 
 	// Retrieve file data
-	data, err := s.storage.Retrieve(sha1)
+	data, err := s.storage.Retrieve(hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve file: %w", err)
+	}
+
+	metadata := s.lookupMetadata(hash, int64(len(data)))
+
+	duration := time.Since(startTime)
+	if s.config.EnableLogging {
+		s.logger.Printf("File retrieved successfully: %s (duration: %v)", hash, duration)
+	}
+
+	return data, metadata, nil
+}
+
+// RetrieveStream opens a file for streaming and returns it with its metadata.
+// The caller must close the returned reader.
+func (s *FileServiceImpl) RetrieveStream(ctx context.Context, hash string) (io.ReadSeekCloser, *types.FileMetadata, error) {
+	if s.config.EnableLogging {
+		s.logger.Printf("Opening file stream: %s", hash)
+	}
+
+	if err := s.checkExpired(hash); err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.promote(ctx, hash); err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := s.storage.Open(hash)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to retrieve file: %w", err)
 	}
 
-	// Retrieve metadata if repository is available
-	var metadata *types.FileMetadata
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = reader.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, nil, fmt.Errorf("failed to determine file size: %w", err)
+	}
+
+	// The stream length is authoritative for what will actually be served
+	metadata := s.lookupMetadata(hash, size)
+	metadata.Size = size
+
+	return reader, metadata, nil
+}
+
+// checkExpired returns ErrExpired once every object referencing hash has
+// expired, since the content is no longer served
+func (s *FileServiceImpl) checkExpired(hash string) error {
+	if s.metadataRepo == nil {
+		return nil
+	}
+	live, expired, err := s.metadataRepo.CountObjectsByExpiry(hash, time.Now())
+	if err == nil && live == 0 && expired > 0 {
+		return fmt.Errorf("%w: %s", ErrExpired, hash)
+	}
+	return nil
+}
+
+// promote brings cold content back to hot storage before it is read. It
+// returns tiering.ErrRestoring when the content is restored in the background.
+func (s *FileServiceImpl) promote(ctx context.Context, hash string) error {
+	if s.tiering == nil {
+		return nil
+	}
+	return s.tiering.Promote(ctx, hash)
+}
+
+// lookupMetadata returns the most recent object stored for hash, or basic metadata if none is available
+func (s *FileServiceImpl) lookupMetadata(hash string, size int64) *types.FileMetadata {
 	if s.metadataRepo != nil {
-		metadata, err = s.metadataRepo.GetMetadata(sha1)
-		if err != nil {
-			s.logger.Printf("Warning: failed to retrieve metadata for %s: %v", sha1, err)
-			// Create basic metadata if not found in repository
-			metadata = &types.FileMetadata{
-				SHA1:        sha1,
-				Size:        int64(len(data)),
-				ContentType: "application/octet-stream",
-				AccessCount: 1,
-			}
-		} else {
+		metadata, err := s.metadataRepo.GetMetadataByHash(hash)
+		if err == nil {
 			// Increment access count asynchronously
 			go func() {
-				_ = s.metadataRepo.IncrementAccessCount(sha1)
+				_ = s.metadataRepo.IncrementAccessCount(metadata.ID)
 			}()
+			return metadata
 		}
-	} else {
-		// Create basic metadata if no repository
-		metadata = &types.FileMetadata{
-			SHA1:        sha1,
-			Size:        int64(len(data)),
-			ContentType: "application/octet-stream",
-			AccessCount: 1,
+		s.logger.Printf("Warning: failed to retrieve metadata for %s: %v", hash, err)
+	}
+
+	// Create basic metadata if not found in repository
+	return &types.FileMetadata{
+		Hash:        hash,
+		Size:        size,
+		ContentType: "application/octet-stream",
+		AccessCount: 1,
+	}
+}
+
+// RetrieveObject opens the content of the object identified by id for streaming.
+// The caller must close the returned reader.
+func (s *FileServiceImpl) RetrieveObject(ctx context.Context, id string) (io.ReadSeekCloser, *types.FileMetadata, error) {
+	metadata, err := s.GetMetadata(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if metadata.Expired(time.Now()) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrExpired, id)
+	}
+
+	if err := s.promote(ctx, metadata.Hash); err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := s.storage.Open(metadata.Hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve file: %w", err)
+	}
+
+	return reader, metadata, nil
+}
+
+// Delete deletes the object identified by id and releases its reference on the
+// underlying content. Unreferenced content is reclaimed later by the garbage
+// collector, never here, so a concurrent upload of the same bytes is safe.
+// While the trash is enabled the object is moved there instead, keeping its
+// reference until it is purged.
+func (s *FileServiceImpl) Delete(ctx context.Context, id string) error {
+	startTime := time.Now()
+
+	if s.config.EnableLogging {
+		s.logger.Printf("Deleting file: %s", id)
+	}
+
+	if s.metadataRepo == nil {
+		return fmt.Errorf("metadata repository not available")
+	}
+
+	if err := s.checkRetention(ctx, retention.ActionDelete, id); err != nil {
+		return err
+	}
+
+	if s.trashEnabled() {
+		if err := s.trash.Move(id); err != nil {
+			return fmt.Errorf("failed to move to trash: %w", err)
+		}
+		if s.config.EnableLogging {
+			s.logger.Printf("File moved to trash: %s (duration: %v)", id, time.Since(startTime))
 		}
+		return nil
+	}
+
+	hash, orphaned, err := s.metadataRepo.DeleteObject(id)
+	if err != nil {
+		return fmt.Errorf("failed to delete metadata: %w", err)
 	}
 
 	duration := time.Since(startTime)
 	if s.config.EnableLogging {
-		s.logger.Printf("File retrieved successfully: %s (duration: %v)", sha1, duration)
+		s.logger.Printf("File deleted successfully: %s (blob %s unreferenced: %v, duration: %v)", id, hash, orphaned, duration)
 	}
 
-	return data, metadata, nil
+	return nil
 }
 
-// Delete deletes a file and its metadata
-func (s *FileServiceImpl) Delete(ctx context.Context, sha1 string) error {
-	startTime := time.Now()
+// Purge deletes the content identified by hash together with every object
+// referencing it. While the trash is enabled the live objects are moved there
+// instead, and the content is kept until they are purged from the trash.
+func (s *FileServiceImpl) Purge(ctx context.Context, hash string) error {
+	trashing := s.metadataRepo != nil && s.trashEnabled()
 
-	if s.config.EnableLogging {
-		s.logger.Printf("Deleting file: %s", sha1)
+	if s.metadataRepo != nil && s.retention != nil {
+		locked, err := s.metadataRepo.ListLockedObjectsByHash(hash, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to check retention: %w", err)
+		}
+		action := retention.ActionPurge
+		if trashing {
+			action = retention.ActionDelete
+		}
+		if err := s.retention.Check(ctx, action, locked...); err != nil {
+			return err
+		}
+	}
+
+	if trashing {
+		return s.trashByHash(hash)
 	}
 
-	// Delete metadata first if repository is available
 	if s.metadataRepo != nil {
-		if err := s.metadataRepo.DeleteMetadata(sha1); err != nil {
-			s.logger.Printf("Warning: failed to delete metadata for %s: %v", sha1, err)
+		removed, err := s.metadataRepo.DeleteByHash(hash)
+		if err != nil {
+			return fmt.Errorf("failed to delete metadata: %w", err)
+		}
+		if s.config.EnableLogging {
+			s.logger.Printf("Purged %d objects referencing %s", removed, hash)
 		}
 	}
 
-	// Delete the file
-	if err := s.storage.Delete(sha1); err != nil {
+	if err := s.storage.Delete(hash); err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
 
-	duration := time.Since(startTime)
+	return nil
+}
+
+// trashByHash moves every live object referencing hash to the trash
+func (s *FileServiceImpl) trashByHash(hash string) error {
+	objects, err := s.metadataRepo.ListFiles(&types.MetadataFilter{Hash: hash})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("%w: %s", storageservice.ErrFileNotFound, hash)
+	}
+
+	for _, object := range objects {
+		if err := s.trash.Move(object.ID); err != nil {
+			return fmt.Errorf("failed to move to trash: %w", err)
+		}
+	}
 	if s.config.EnableLogging {
-		s.logger.Printf("File deleted successfully: %s (duration: %v)", sha1, duration)
+		s.logger.Printf("Moved %d objects referencing %s to trash", len(objects), hash)
 	}
 
 	return nil
 }
 
 // Exists checks if a file exists
-func (s *FileServiceImpl) Exists(ctx context.Context, sha1 string) (bool, error) {
-	exists := s.storage.Exists(sha1)
+func (s *FileServiceImpl) Exists(ctx context.Context, hash string) (bool, error) {
+	exists := s.storage.Exists(hash)
 	return exists, nil
 }
 
-// GetMetadata retrieves file metadata only
-func (s *FileServiceImpl) GetMetadata(ctx context.Context, sha1 string) (*types.FileMetadata, error) {
+// GetMetadata retrieves object metadata only
+func (s *FileServiceImpl) GetMetadata(ctx context.Context, id string) (*types.FileMetadata, error) {
 	if s.metadataRepo == nil {
 		return nil, fmt.Errorf("metadata repository not available")
 	}
 
-	metadata, err := s.metadataRepo.GetMetadata(sha1)
+	metadata, err := s.metadataRepo.GetMetadata(id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metadata: %w", err)
 	}
 
 	// Increment access count asynchronously
 	go func() {
-		_ = s.metadataRepo.IncrementAccessCount(sha1)
+		_ = s.metadataRepo.IncrementAccessCount(id)
 	}()
 
 	return metadata, nil
 }
 
-// UpdateMetadata updates file metadata
-func (s *FileServiceImpl) UpdateMetadata(ctx context.Context, sha1 string, metadata *types.FileMetadata) error {
+// UpdateMetadata updates object metadata
+func (s *FileServiceImpl) UpdateMetadata(ctx context.Context, id string, metadata *types.FileMetadata) error {
 	if s.metadataRepo == nil {
 		return fmt.Errorf("metadata repository not available")
 	}
 
-	// Ensure SHA1 matches
-	metadata.SHA1 = sha1
+	// Objects in the trash are not found, so their metadata cannot change
+	current, err := s.metadataRepo.GetMetadata(id)
+	if err != nil {
+		return fmt.Errorf("%w: %s", storageservice.ErrFileNotFound, id)
+	}
+	if s.retention != nil {
+		if err := s.retention.Check(ctx, retention.ActionUpdateMetadata, current); err != nil {
+			return err
+		}
+	}
+
+	// Ensure ID matches
+	metadata.ID = id
 
 	if err := s.metadataRepo.UpdateMetadata(metadata); err != nil {
 		return fmt.Errorf("failed to update metadata: %w", err)
 	}
 
 	if s.config.EnableLogging {
-		s.logger.Printf("Metadata updated successfully: %s", sha1)
+		s.logger.Printf("Metadata updated successfully: %s", id)
 	}
 
 	return nil
 }
 
-// DeleteMetadata deletes file metadata only
-func (s *FileServiceImpl) DeleteMetadata(ctx context.Context, sha1 string) error {
+// DeleteMetadata deletes object metadata only, leaving the content in storage.
+// While the trash is enabled the object is moved there instead.
+func (s *FileServiceImpl) DeleteMetadata(ctx context.Context, id string) error {
 	if s.metadataRepo == nil {
 		return fmt.Errorf("metadata repository not available")
 	}
 
-	if err := s.metadataRepo.DeleteMetadata(sha1); err != nil {
+	if err := s.checkRetention(ctx, retention.ActionDeleteMetadata, id); err != nil {
+		return err
+	}
+
+	if s.trashEnabled() {
+		if err := s.trash.Move(id); err != nil {
+			return fmt.Errorf("failed to move to trash: %w", err)
+		}
+		return nil
+	}
+
+	if err := s.metadataRepo.DeleteMetadata(id); err != nil {
 		return fmt.Errorf("failed to delete metadata: %w", err)
 	}
 
 	if s.config.EnableLogging {
-		s.logger.Printf("Metadata deleted successfully: %s", sha1)
+		s.logger.Printf("Metadata deleted successfully: %s", id)
 	}
 
 	return nil
@@ -319,19 +706,13 @@ func (s *FileServiceImpl) List(ctx context.Context, filter *types.MetadataFilter
 
 // StoreFromReader stores a file from an io.Reader
 func (s *FileServiceImpl) StoreFromReader(ctx context.Context, reader io.Reader, filename string, contentType string) (*types.FileMetadata, error) {
-	// Read all data
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
-	}
-
 	// Create metadata
 	metadata := &types.FileMetadata{
 		FileName:    filepath.Base(filename),
 		ContentType: contentType,
 	}
 
-	return s.Store(ctx, data, metadata)
+	return s.StoreStream(ctx, reader, metadata)
 }
 
 // StoreFromFile stores a file from a file path
@@ -391,19 +772,43 @@ func (s *FileServiceImpl) ValidateFile(data []byte, metadata *types.FileMetadata
 		return fmt.Errorf("filename cannot be empty")
 	}
 
-	// Validate file size (example: 100MB limit)
-	maxSize := int64(100 * 1024 * 1024) // 100MB
-	if metadata.Size > maxSize {
-		return fmt.Errorf("file size %d exceeds maximum allowed size %d", metadata.Size, maxSize)
+	// Validate file size
+	if metadata.Size > s.config.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrFileTooLarge, metadata.Size, s.config.MaxFileSize)
 	}
 
-	// Validate SHA1 if provided
-	if metadata.SHA1 != "" {
-		calculatedSHA1 := fmt.Sprintf("%x", sha1.Sum(data))
-		if metadata.SHA1 != calculatedSHA1 {
-			return fmt.Errorf("SHA1 mismatch: expected %s, got %s", metadata.SHA1, calculatedSHA1)
+	// Validate hash if provided
+	if metadata.Hash != "" {
+		ok, err := digest.Verify(metadata.Hash, data)
+		if err != nil {
+			return fmt.Errorf("invalid hash: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("hash mismatch: expected %s", metadata.Hash)
 		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// maxSizeReader fails with ErrFileTooLarge once more than limit bytes have been read
+type maxSizeReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, ErrFileTooLarge
+	}
+	// Allow one byte past the limit so an oversized stream is detected
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, ErrFileTooLarge
+	}
+	return n, err
+}
@@ -1,9 +1,14 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -104,7 +109,7 @@ func TestFileService(t *testing.T) {
 			t.Fatalf("Failed to store file: %v", err)
 		}
 
-		if storedMetadata.SHA1 == "" {
+		if storedMetadata.Hash == "" {
 			t.Error("SHA1 should not be empty after storage")
 		}
 		if storedMetadata.Size != int64(len(data)) {
@@ -112,7 +117,7 @@ func TestFileService(t *testing.T) {
 		}
 
 		// Retrieve file
-		retrievedData, retrievedMetadata, err := fileService.Retrieve(ctx, storedMetadata.SHA1)
+		retrievedData, retrievedMetadata, err := fileService.Retrieve(ctx, storedMetadata.Hash)
 		if err != nil {
 			t.Fatalf("Failed to retrieve file: %v", err)
 		}
@@ -125,6 +130,70 @@ func TestFileService(t *testing.T) {
 		}
 	})
 
+	t.Run("StoreAndRetrieveStream", func(t *testing.T) {
+		data := []byte(strings.Repeat("streamed content ", 4096))
+		metadata := &types.FileMetadata{
+			FileName: "stream.txt",
+		}
+
+		storedMetadata, err := fileService.StoreStream(ctx, bytes.NewReader(data), metadata)
+		if err != nil {
+			t.Fatalf("Failed to store stream: %v", err)
+		}
+
+		expectedSHA1 := fmt.Sprintf("%x", sha1.Sum(data))
+		if storedMetadata.Hash != expectedSHA1 {
+			t.Errorf("Expected SHA1 %s, got %s", expectedSHA1, storedMetadata.Hash)
+		}
+		if storedMetadata.Size != int64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), storedMetadata.Size)
+		}
+
+		reader, retrievedMetadata, err := fileService.RetrieveStream(ctx, storedMetadata.Hash)
+		if err != nil {
+			t.Fatalf("Failed to retrieve stream: %v", err)
+		}
+		defer reader.Close()
+
+		if retrievedMetadata.Size != int64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), retrievedMetadata.Size)
+		}
+
+		if _, err := reader.Seek(int64(len(data)-17), io.SeekStart); err != nil {
+			t.Fatalf("Failed to seek: %v", err)
+		}
+		tail, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Failed to read stream: %v", err)
+		}
+		if string(tail) != "streamed content " {
+			t.Errorf("Unexpected tail %q", tail)
+		}
+	})
+
+	t.Run("StoreStreamTooLarge", func(t *testing.T) {
+		limitedConfig := DefaultServiceConfig()
+		limitedConfig.MaxFileSize = 16
+		limitedService := NewFileService(storage, metadataRepo, limitedConfig)
+
+		data := []byte("this payload is longer than sixteen bytes")
+		_, err := limitedService.StoreStream(ctx, bytes.NewReader(data), &types.FileMetadata{FileName: "big.txt"})
+		if !errors.Is(err, ErrFileTooLarge) {
+			t.Fatalf("Expected ErrFileTooLarge, got %v", err)
+		}
+
+		exists, _ := fileService.Exists(ctx, fmt.Sprintf("%x", sha1.Sum(data)))
+		if exists {
+			t.Error("Oversized upload should not be stored")
+		}
+
+		// Exactly at the limit is allowed
+		_, err = limitedService.StoreStream(ctx, bytes.NewReader(data[:16]), &types.FileMetadata{FileName: "fits.txt"})
+		if err != nil {
+			t.Errorf("Upload at the size limit should succeed: %v", err)
+		}
+	})
+
 	t.Run("Exists", func(t *testing.T) {
 		data := []byte("exists test")
 		metadata := &types.FileMetadata{
@@ -137,7 +206,7 @@ func TestFileService(t *testing.T) {
 		}
 
 		// Check existing file
-		exists, err := fileService.Exists(ctx, storedMetadata.SHA1)
+		exists, err := fileService.Exists(ctx, storedMetadata.Hash)
 		if err != nil {
 			t.Errorf("Exists check failed: %v", err)
 		}
@@ -173,13 +242,13 @@ func TestFileService(t *testing.T) {
 			Description: "Updated description",
 		}
 
-		err = fileService.UpdateMetadata(ctx, storedMetadata.SHA1, updatedMetadata)
+		err = fileService.UpdateMetadata(ctx, storedMetadata.ID, updatedMetadata)
 		if err != nil {
 			t.Fatalf("Failed to update metadata: %v", err)
 		}
 
 		// Retrieve updated metadata
-		retrievedMetadata, err := fileService.GetMetadata(ctx, storedMetadata.SHA1)
+		retrievedMetadata, err := fileService.GetMetadata(ctx, storedMetadata.ID)
 		if err != nil {
 			t.Fatalf("Failed to retrieve metadata: %v", err)
 		}
@@ -201,18 +270,87 @@ func TestFileService(t *testing.T) {
 		}
 
 		// Delete file
-		err = fileService.Delete(ctx, storedMetadata.SHA1)
+		err = fileService.Delete(ctx, storedMetadata.ID)
 		if err != nil {
 			t.Errorf("Failed to delete file: %v", err)
 		}
 
-		// Check file is deleted
-		exists, err := fileService.Exists(ctx, storedMetadata.SHA1)
+		// The object is gone and its content is left unreferenced for GC
+		if _, err := fileService.GetMetadata(ctx, storedMetadata.ID); err == nil {
+			t.Error("Metadata should not exist after deletion")
+		}
+		refs, err := metadataRepo.BlobRefCount(storedMetadata.Hash)
 		if err != nil {
-			t.Errorf("Exists check failed: %v", err)
+			t.Fatalf("Failed to get ref count: %v", err)
 		}
-		if exists {
-			t.Error("File should not exist after deletion")
+		if refs != 0 {
+			t.Errorf("Expected 0 references after deletion, got %d", refs)
+		}
+	})
+
+	t.Run("DuplicateContentKeepsSeparateObjects", func(t *testing.T) {
+		data := []byte("identical bytes")
+
+		first, err := fileService.Store(ctx, data, &types.FileMetadata{FileName: "a.pdf", UploadedBy: "alice"})
+		if err != nil {
+			t.Fatalf("Failed to store first file: %v", err)
+		}
+		second, err := fileService.Store(ctx, data, &types.FileMetadata{FileName: "b.pdf", UploadedBy: "bob"})
+		if err != nil {
+			t.Fatalf("Failed to store second file: %v", err)
+		}
+
+		if first.Hash != second.Hash {
+			t.Fatal("Identical content should share a SHA1")
+		}
+		if first.ID == second.ID {
+			t.Fatal("Each upload should get its own object ID")
+		}
+
+		retrieved, err := fileService.GetMetadata(ctx, first.ID)
+		if err != nil {
+			t.Fatalf("Failed to retrieve metadata: %v", err)
+		}
+		if retrieved.FileName != "a.pdf" || retrieved.UploadedBy != "alice" {
+			t.Errorf("First object was overwritten: %+v", retrieved)
+		}
+
+		if refs, _ := metadataRepo.BlobRefCount(first.Hash); refs != 2 {
+			t.Errorf("Expected 2 references, got %d", refs)
+		}
+
+		// Deleting one object must keep the shared content for the other
+		if err := fileService.Delete(ctx, first.ID); err != nil {
+			t.Fatalf("Failed to delete first object: %v", err)
+		}
+		if exists, _ := fileService.Exists(ctx, second.Hash); !exists {
+			t.Fatal("Content should survive while still referenced")
+		}
+		if refs, _ := metadataRepo.BlobRefCount(first.Hash); refs != 1 {
+			t.Errorf("Expected 1 reference, got %d", refs)
+		}
+	})
+
+	t.Run("ExpiredContent", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute)
+		stored, err := fileService.Store(ctx, []byte("short-lived bytes"), &types.FileMetadata{FileName: "old.txt", ExpiresAt: &past})
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+
+		// Content is not served once every object referencing it has expired
+		if _, _, err := fileService.Retrieve(ctx, stored.Hash); !errors.Is(err, ErrExpired) {
+			t.Errorf("Expected expired content not to be retrieved, got %v", err)
+		}
+		if _, _, err := fileService.RetrieveStream(ctx, stored.Hash); !errors.Is(err, ErrExpired) {
+			t.Errorf("Expected expired content not to be streamed, got %v", err)
+		}
+
+		if _, err := fileService.Store(ctx, []byte("short-lived bytes"), &types.FileMetadata{FileName: "new.txt"}); err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		if _, _, err := fileService.Retrieve(ctx, stored.Hash); err != nil {
+			t.Errorf("Expected content with a live object to be retrieved, got %v", err)
 		}
 	})
 }
@@ -346,6 +484,7 @@ func TestBatchService(t *testing.T) {
 
 	t.Run("BatchDelete", func(t *testing.T) {
 		// First store some files
+		ids := []string{}
 		sha1s := []string{}
 		for i := 0; i < 3; i++ {
 			data := []byte(fmt.Sprintf("batch test file %d", i))
@@ -356,11 +495,12 @@ func TestBatchService(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Failed to store file %d: %v", i, err)
 			}
-			sha1s = append(sha1s, storedMetadata.SHA1)
+			ids = append(ids, storedMetadata.ID)
+			sha1s = append(sha1s, storedMetadata.Hash)
 		}
 
 		// Batch delete
-		result, err := batchService.BatchDelete(ctx, sha1s)
+		result, err := batchService.BatchDelete(ctx, ids)
 		if err != nil {
 			t.Fatalf("Batch delete failed: %v", err)
 		}
@@ -372,14 +512,14 @@ func TestBatchService(t *testing.T) {
 			t.Errorf("Expected 0 failed deletions, got %d", result.Failed)
 		}
 
-		// Verify files are deleted
+		// Verify references are released; content is left for GC
 		for _, sha1 := range sha1s {
-			exists, err := fileService.Exists(ctx, sha1)
+			refs, err := metadataRepo.BlobRefCount(sha1)
 			if err != nil {
-				t.Errorf("Exists check failed: %v", err)
+				t.Errorf("Ref count check failed: %v", err)
 			}
-			if exists {
-				t.Error("File should not exist after batch deletion")
+			if refs != 0 {
+				t.Errorf("Expected 0 references after batch deletion, got %d", refs)
 			}
 		}
 	})
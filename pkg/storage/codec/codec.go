@@ -0,0 +1,134 @@
+// Package codec compresses blobs at rest.
+//
+// Compressed blobs are written as a sequence of independently compressed
+// frames, each holding FrameSize bytes of the original content, followed by an
+// index of where every frame starts. A reader can therefore seek to any offset
+// by decompressing a single frame rather than everything before it.
+package codec
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Codec names
+const (
+	// None stores content as is
+	None = "none"
+	// Gzip stores content as gzip frames
+	Gzip = "gzip"
+)
+
+// Codecs lists every codec content can be compressed with
+var Codecs = []string{Gzip}
+
+// Default policy values
+const (
+	// DefaultMinSize is the smallest content worth compressing
+	DefaultMinSize = 4 * 1024
+	// FrameSize is how much original content each frame holds
+	FrameSize = 256 * 1024
+)
+
+// Codec errors
+var (
+	ErrUnknownCodec = errors.New("unknown codec")
+	ErrCorrupt      = errors.New("corrupt compressed blob")
+)
+
+// Lookup validates a codec name. An empty name is None.
+func Lookup(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", None:
+		return None, nil
+	case Gzip:
+		return Gzip, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+}
+
+// Extension returns the file name suffix of blobs stored with codec
+func Extension(codec string) string {
+	switch codec {
+	case Gzip:
+		return ".gz"
+	}
+	return ""
+}
+
+// Policy decides which content is compressed
+type Policy struct {
+	// Codec compresses content chosen for compression. None disables compression.
+	Codec string `json:"codec"`
+	// MinSize is the smallest content compressed
+	MinSize int64 `json:"min_size"`
+	// Level is the compression level. Zero uses the codec's default.
+	Level int `json:"level"`
+}
+
+// DefaultPolicy returns the default compression policy
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Codec:   Gzip,
+		MinSize: DefaultMinSize,
+	}
+}
+
+// Validate checks the policy
+func (p *Policy) Validate() error {
+	codec, err := Lookup(p.Codec)
+	if err != nil {
+		return err
+	}
+	p.Codec = codec
+	if p.MinSize < 0 {
+		return fmt.Errorf("invalid compression min size: %d", p.MinSize)
+	}
+	if p.Level != 0 && (p.Level < gzip.HuffmanOnly || p.Level > gzip.BestCompression) {
+		return fmt.Errorf("invalid compression level: %d", p.Level)
+	}
+	return nil
+}
+
+// SniffLen returns how much of the content Select needs to see
+func (p *Policy) SniffLen() int {
+	if p.MinSize > 512 {
+		return int(p.MinSize)
+	}
+	return 512
+}
+
+// Select returns the codec to store content with, given its first SniffLen
+// bytes (or all of it, if shorter). Content below the minimum size or of a
+// type that is already compressed is stored as is.
+func (p *Policy) Select(head []byte) string {
+	if p == nil || p.Codec == "" || p.Codec == None || int64(len(head)) < p.MinSize {
+		return None
+	}
+	if !Compressible(http.DetectContentType(head)) {
+		return None
+	}
+	return p.Codec
+}
+
+// Compressible reports whether content of contentType usually compresses well
+func Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/postscript", "application/wasm", "image/svg+xml", "image/bmp", "image/x-icon",
+		"audio/wave", "font/ttf", "font/otf", "application/vnd.ms-fontobject":
+		return true
+	}
+	return false
+}
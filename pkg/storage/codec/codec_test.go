@@ -0,0 +1,146 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// compress frames data with gzip
+func compress(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Gzip, 0)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFrames(t *testing.T) {
+	// Compressible but not trivially so, spanning several frames
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon\n"}
+	random := rand.New(rand.NewSource(1))
+	var builder strings.Builder
+	for builder.Len() < 3*FrameSize+1234 {
+		builder.WriteString(words[random.Intn(len(words))])
+	}
+	data := []byte(builder.String())
+	compressed := compress(t, data)
+
+	if len(compressed) >= len(data)/2 {
+		t.Errorf("Expected text to compress well, got %d of %d bytes", len(compressed), len(data))
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		reader, err := NewReader(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if reader.Size() != int64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), reader.Size())
+		}
+
+		got, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("Decompressed content does not match")
+		}
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		reader, err := NewReader(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+
+		// Within a frame, across a frame boundary, backwards and at the tail
+		for _, offset := range []int64{10, FrameSize - 100, 2*FrameSize + 7, 5, int64(len(data)) - 50} {
+			if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+				t.Fatalf("Failed to seek: %v", err)
+			}
+			buf := make([]byte, 1000)
+			n, err := io.ReadFull(reader, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatalf("Failed to read at %d: %v", offset, err)
+			}
+			if !bytes.Equal(buf[:n], data[offset:offset+int64(n)]) {
+				t.Errorf("Content at offset %d does not match", offset)
+			}
+		}
+
+		if end, err := reader.Seek(0, io.SeekEnd); err != nil || end != int64(len(data)) {
+			t.Errorf("Expected end at %d, got %d (%v)", len(data), end, err)
+		}
+		if n, err := reader.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Errorf("Expected EOF at end, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		empty := compress(t, nil)
+		reader, err := NewReader(bytes.NewReader(empty), int64(len(empty)))
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if got, err := io.ReadAll(reader); err != nil || len(got) != 0 {
+			t.Errorf("Expected no content, got %d bytes (%v)", len(got), err)
+		}
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		if _, err := NewReader(bytes.NewReader(data[:100]), 100); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt for a blob without index, got %v", err)
+		}
+
+		damaged := append([]byte(nil), compressed...)
+		for i := 20; i < 60; i++ {
+			damaged[i] ^= 0xff
+		}
+		reader, err := NewReader(bytes.NewReader(damaged), int64(len(damaged)))
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if _, err := io.ReadAll(reader); err == nil {
+			t.Error("Expected an error reading a damaged frame")
+		}
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	text := bytes.Repeat([]byte("plain text compresses well. "), 500)
+
+	if got := policy.Select(text); got != Gzip {
+		t.Errorf("Expected text to be compressed, got %s", got)
+	}
+	if got := policy.Select(text[:100]); got != None {
+		t.Errorf("Expected content below the minimum size to be stored as is, got %s", got)
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 8192)...)
+	if got := policy.Select(png); got != None {
+		t.Errorf("Expected an image to be stored as is, got %s", got)
+	}
+
+	var nilPolicy *Policy
+	if got := nilPolicy.Select(text); got != None {
+		t.Errorf("Expected no compression without a policy, got %s", got)
+	}
+
+	if err := (&Policy{Codec: "lz4"}).Validate(); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Expected ErrUnknownCodec, got %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package codec
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// trailerMagic ends every compressed blob
+var trailerMagic = [8]byte{'I', 'O', 'F', 'R', 'A', 'M', 'E', '1'}
+
+// trailerSize is the fixed part of the index: the original size, the frame
+// size, the frame count and the magic. The frame offsets precede it.
+const trailerSize = 8 + 4 + 4 + 8
+
+// Writer compresses content into frames. Close must be called to write the index.
+type Writer struct {
+	w       *countingWriter
+	gz      *gzip.Writer
+	frame   []byte
+	offsets []uint64
+	size    int64
+	closed  bool
+}
+
+// NewWriter returns a writer compressing to w with codec at level (zero for
+// the codec's default)
+func NewWriter(w io.Writer, codec string, level int) (*Writer, error) {
+	if codec != Gzip {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, codec)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	counting := &countingWriter{w: w}
+	gz, err := gzip.NewWriterLevel(counting, level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:     counting,
+		gz:    gz,
+		frame: make([]byte, 0, FrameSize),
+	}, nil
+}
+
+// Write implements io.Writer
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed codec writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.frame[len(w.frame):cap(w.frame)], p)
+		w.frame = w.frame[:len(w.frame)+n]
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+
+		if len(w.frame) == cap(w.frame) {
+			if err := w.flushFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last frame and the index
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if len(w.frame) > 0 {
+		if err := w.flushFrame(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 0, 8*len(w.offsets)+trailerSize)
+	for _, offset := range w.offsets {
+		trailer = binary.LittleEndian.AppendUint64(trailer, offset)
+	}
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(w.size))
+	trailer = binary.LittleEndian.AppendUint32(trailer, FrameSize)
+	trailer = binary.LittleEndian.AppendUint32(trailer, uint32(len(w.offsets)))
+	trailer = append(trailer, trailerMagic[:]...)
+
+	_, err := w.w.Write(trailer)
+	return err
+}
+
+// flushFrame compresses the buffered content as one frame
+func (w *Writer) flushFrame() error {
+	w.offsets = append(w.offsets, uint64(w.w.n))
+	w.gz.Reset(w.w)
+	if _, err := w.gz.Write(w.frame); err != nil {
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	w.frame = w.frame[:0]
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Reader decompresses a framed blob and supports seeking to any offset
+type Reader struct {
+	r         io.ReaderAt
+	offsets   []int64
+	frameSize int64
+	size      int64
+	offset    int64
+
+	gz    *gzip.Reader
+	frame int
+	// pos is the offset the open frame reader is at, or -1 if none is open
+	pos int64
+}
+
+// NewReader returns a reader over the compressed blob r of length size
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < trailerSize {
+		return nil, fmt.Errorf("%w: too short", ErrCorrupt)
+	}
+
+	tail := make([]byte, trailerSize)
+	if _, err := r.ReadAt(tail, size-trailerSize); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if [8]byte(tail[16:]) != trailerMagic {
+		return nil, fmt.Errorf("%w: missing index", ErrCorrupt)
+	}
+	original := int64(binary.LittleEndian.Uint64(tail[0:8]))
+	frameSize := int64(binary.LittleEndian.Uint32(tail[8:12]))
+	count := int64(binary.LittleEndian.Uint32(tail[12:16]))
+
+	indexStart := size - trailerSize - 8*count
+	if frameSize == 0 || indexStart < 0 || original > count*frameSize || original <= (count-1)*frameSize {
+		return nil, fmt.Errorf("%w: invalid index", ErrCorrupt)
+	}
+
+	index := make([]byte, 8*count)
+	if _, err := r.ReadAt(index, indexStart); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	offsets := make([]int64, count+1)
+	for i := range offsets[:count] {
+		offsets[i] = int64(binary.LittleEndian.Uint64(index[8*i:]))
+		if offsets[i] > indexStart || (i > 0 && offsets[i] < offsets[i-1]) {
+			return nil, fmt.Errorf("%w: invalid frame offset", ErrCorrupt)
+		}
+	}
+	offsets[count] = indexStart
+
+	return &Reader{
+		r:         r,
+		offsets:   offsets,
+		frameSize: frameSize,
+		size:      original,
+		frame:     -1,
+		pos:       -1,
+	}, nil
+}
+
+// Size returns the size of the original content
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	frame := int(r.offset / r.frameSize)
+	if frame != r.frame || r.pos != r.offset {
+		if err := r.open(frame); err != nil {
+			return 0, err
+		}
+	}
+
+	frameEnd := int64(frame+1) * r.frameSize
+	if frameEnd > r.size {
+		frameEnd = r.size
+	}
+	if remaining := frameEnd - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.gz.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil
+		}
+		return 0, fmt.Errorf("%w: frame %d is short", ErrCorrupt, frame)
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+// open starts decompressing frame and skips ahead to the current offset
+func (r *Reader) open(frame int) error {
+	section := io.NewSectionReader(r.r, r.offsets[frame], r.offsets[frame+1]-r.offsets[frame])
+
+	var err error
+	if r.gz == nil {
+		r.gz, err = gzip.NewReader(section)
+	} else {
+		err = r.gz.Reset(section)
+	}
+	if err != nil {
+		r.frame, r.pos = -1, -1
+		return fmt.Errorf("%w: frame %d: %v", ErrCorrupt, frame, err)
+	}
+	r.gz.Multistream(false)
+	r.frame = frame
+
+	start := int64(frame) * r.frameSize
+	if skip := r.offset - start; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r.gz, skip); err != nil {
+			r.frame, r.pos = -1, -1
+			return fmt.Errorf("%w: frame %d: %v", ErrCorrupt, frame, err)
+		}
+	}
+	r.pos = r.offset
+	return nil
+}
@@ -0,0 +1,213 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey returns a deterministic key for seed
+func testKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, KeySize)
+}
+
+// encrypt seals data with dataKey
+func encrypt(t *testing.T, data, dataKey []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, dataKey)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	dataKey := testKey(7)
+	data := make([]byte, 3*SegmentSize+999)
+	rand.New(rand.NewSource(1)).Read(data)
+	sealed := encrypt(t, data, dataKey)
+
+	if bytes.Contains(sealed, data[:64]) {
+		t.Fatal("Expected no plaintext in the encrypted stream")
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		reader, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), dataKey)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if reader.Size() != int64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), reader.Size())
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Decrypted content does not match (%v)", err)
+		}
+	})
+
+	t.Run("ReadAt", func(t *testing.T) {
+		reader, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), dataKey)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		for _, offset := range []int64{SegmentSize - 10, 5, 2*SegmentSize + 100, int64(len(data)) - 20} {
+			buf := make([]byte, 500)
+			n, err := reader.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				t.Fatalf("Failed to read at %d: %v", offset, err)
+			}
+			if !bytes.Equal(buf[:n], data[offset:offset+int64(n)]) {
+				t.Errorf("Content at offset %d does not match", offset)
+			}
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		empty := encrypt(t, nil, dataKey)
+		reader, err := NewReader(bytes.NewReader(empty), int64(len(empty)), dataKey)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if got, err := io.ReadAll(reader); err != nil || len(got) != 0 {
+			t.Errorf("Expected no content, got %d bytes (%v)", len(got), err)
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		reader, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), testKey(8))
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if _, err := io.ReadAll(reader); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Expected ErrDecrypt, got %v", err)
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		tampered := append([]byte(nil), sealed...)
+		tampered[headerSize+SegmentSize+tagSize+10] ^= 1
+		reader, err := NewReader(bytes.NewReader(tampered), int64(len(tampered)), dataKey)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if _, err := io.ReadAll(reader); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Expected ErrDecrypt, got %v", err)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		// Dropping whole segments leaves a stream whose last segment was not sealed as final
+		truncated := sealed[:headerSize+2*(SegmentSize+tagSize)]
+		reader, err := NewReader(bytes.NewReader(truncated), int64(len(truncated)), dataKey)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if _, err := io.ReadAll(reader); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Expected ErrDecrypt, got %v", err)
+		}
+	})
+}
+
+func TestKeyring(t *testing.T) {
+	keyring := NewKeyring()
+	oldID, err := keyring.Add("old", testKey(1), false)
+	if err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("Failed to generate data key: %v", err)
+	}
+	wrapped, err := keyring.Wrap(dataKey, "blob-a")
+	if err != nil {
+		t.Fatalf("Failed to wrap: %v", err)
+	}
+	if wrapped.KeyID != oldID {
+		t.Errorf("Expected key %s, got %s", oldID, wrapped.KeyID)
+	}
+
+	t.Run("Unwrap", func(t *testing.T) {
+		got, err := keyring.Unwrap(wrapped, "blob-a")
+		if err != nil || !bytes.Equal(got, dataKey) {
+			t.Errorf("Expected the data key back (%v)", err)
+		}
+		if _, err := keyring.Unwrap(wrapped, "blob-b"); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Expected a key wrapped for another blob to fail, got %v", err)
+		}
+	})
+
+	t.Run("NewPrimary", func(t *testing.T) {
+		newID, err := keyring.Add("", testKey(2), true)
+		if err != nil {
+			t.Fatalf("Failed to add key: %v", err)
+		}
+		if keyring.Primary() != newID || newID != KeyID(testKey(2)) {
+			t.Errorf("Expected fingerprint %s to be primary, got %s", KeyID(testKey(2)), keyring.Primary())
+		}
+		if _, err := keyring.Unwrap(wrapped, "blob-a"); err != nil {
+			t.Errorf("Expected keys wrapped by an older key to unwrap: %v", err)
+		}
+	})
+
+	t.Run("MissingKey", func(t *testing.T) {
+		if _, err := NewKeyring().Unwrap(wrapped, "blob-a"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound, got %v", err)
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		if _, err := keyring.Add("short", []byte("short"), false); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey, got %v", err)
+		}
+	})
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	content := "# rotation in progress\n" +
+		"2024 " + base64.StdEncoding.EncodeToString(testKey(2)) + "\n" +
+		"\n" +
+		"2023 " + base64.StdEncoding.EncodeToString(testKey(1)) + "\n"
+	if err := os.WriteFile(keyFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	keyring, err := LoadKeyring(keyFile, "")
+	if err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	if keyring.Primary() != "2024" || !keyring.Has("2023") {
+		t.Errorf("Expected primary 2024 and 2023 loaded, got primary %s", keyring.Primary())
+	}
+
+	// A key given directly takes over as primary
+	hexKey := "0303030303030303030303030303030303030303030303030303030303030303"
+	keyring, err = LoadKeyring(keyFile, hexKey)
+	if err != nil {
+		t.Fatalf("Failed to load keyring: %v", err)
+	}
+	if keyring.Primary() != KeyID(testKey(3)) {
+		t.Errorf("Expected the direct key to be primary, got %s", keyring.Primary())
+	}
+
+	if keyring, err := LoadKeyring("", ""); keyring != nil || err != nil {
+		t.Errorf("Expected no keyring without keys, got %v, %v", keyring, err)
+	}
+	if _, err := LoadKeyring("", "not a key"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+}
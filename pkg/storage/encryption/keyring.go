@@ -0,0 +1,240 @@
+// Package encryption encrypts blobs at rest with envelope encryption.
+//
+// Every blob is encrypted with its own random data key using AES-256-GCM in
+// fixed-size segments, so it can be streamed and read at any offset. The data
+// key is kept next to the blob, wrapped by a master key from the keyring.
+// Rotating master keys only re-wraps data keys; blob content is never rewritten.
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of master and data keys in bytes (AES-256)
+const KeySize = 32
+
+// Encryption errors
+var (
+	ErrKeyNotFound = errors.New("encryption key not found")
+	ErrInvalidKey  = errors.New("invalid encryption key")
+	ErrDecrypt     = errors.New("failed to decrypt")
+)
+
+// Keyring holds master keys by ID. New data keys are wrapped with the
+// primary key; the others only unwrap data keys wrapped before a rotation.
+type Keyring struct {
+	keys    map[string][]byte
+	primary string
+}
+
+// NewKeyring creates an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// Add adds a master key. The first key added becomes primary unless a later
+// one is added as primary. An empty id uses the key's fingerprint.
+func (k *Keyring) Add(id string, key []byte, primary bool) (string, error) {
+	if len(key) != KeySize {
+		return "", fmt.Errorf("%w: need %d bytes, got %d", ErrInvalidKey, KeySize, len(key))
+	}
+	if id == "" {
+		id = KeyID(key)
+	}
+	if existing, ok := k.keys[id]; ok && string(existing) != string(key) {
+		return "", fmt.Errorf("%w: duplicate key ID %s", ErrInvalidKey, id)
+	}
+
+	k.keys[id] = append([]byte(nil), key...)
+	if primary || k.primary == "" {
+		k.primary = id
+	}
+	return id, nil
+}
+
+// Primary returns the ID of the key new data keys are wrapped with
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Has reports whether the keyring holds the key id
+func (k *Keyring) Has(id string) bool {
+	_, ok := k.keys[id]
+	return ok
+}
+
+// KeyID returns the fingerprint of a master key, used as its ID when none is given
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseKey decodes a master key given as base64 or hex
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: expected %d bytes as base64 or hex", ErrInvalidKey, KeySize)
+}
+
+// LoadKeyFile reads a keyring from path. Each non-empty line that does not
+// start with # holds a key, optionally preceded by its ID:
+//
+//	# new primary key first, older keys below until rotation finishes
+//	2024-06 q8Xk...base64...=
+//	2023-01 7fS1...base64...=
+//
+// The first key is primary.
+func LoadKeyFile(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer file.Close()
+
+	keyring := NewKeyring()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		id, encoded := "", text
+		if fields := strings.Fields(text); len(fields) == 2 {
+			id, encoded = fields[0], fields[1]
+		} else if len(fields) > 2 {
+			return nil, fmt.Errorf("%w: key file line %d", ErrInvalidKey, line)
+		}
+
+		key, err := ParseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", line, err)
+		}
+		if _, err := keyring.Add(id, key, false); err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if keyring.primary == "" {
+		return nil, fmt.Errorf("%w: key file %s holds no keys", ErrInvalidKey, path)
+	}
+
+	return keyring, nil
+}
+
+// LoadKeyring builds a keyring from a key file and/or a single key given
+// directly, such as from an environment variable. A direct key is primary.
+// It returns nil if neither is set, meaning encryption is disabled.
+func LoadKeyring(keyFile, key string) (*Keyring, error) {
+	if keyFile == "" && key == "" {
+		return nil, nil
+	}
+
+	keyring := NewKeyring()
+	if keyFile != "" {
+		loaded, err := LoadKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keyring = loaded
+	}
+	if key != "" {
+		parsed, err := ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := keyring.Add("", parsed, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return keyring, nil
+}
+
+// NewDataKey generates a random data key
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return key, nil
+}
+
+// WrappedKey is a data key encrypted by a master key
+type WrappedKey struct {
+	KeyID string `json:"key_id"`
+	// Key is the nonce followed by the sealed data key
+	Key []byte `json:"key"`
+}
+
+// Wrap encrypts dataKey with the primary key. The wrapped key only unwraps
+// with the same context, which binds it to the blob it belongs to.
+func (k *Keyring) Wrap(dataKey []byte, context string) (*WrappedKey, error) {
+	if k.primary == "" {
+		return nil, ErrKeyNotFound
+	}
+	aead, err := newGCM(k.keys[k.primary])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return &WrappedKey{
+		KeyID: k.primary,
+		Key:   aead.Seal(nonce, nonce, dataKey, []byte(context)),
+	}, nil
+}
+
+// Unwrap decrypts a wrapped data key
+func (k *Keyring) Unwrap(wrapped *WrappedKey, context string) ([]byte, error) {
+	key, ok := k.keys[wrapped.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, wrapped.KeyID)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped.Key) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: wrapped key too short", ErrDecrypt)
+	}
+
+	nonce, sealed := wrapped.Key[:aead.NonceSize()], wrapped.Key[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(context))
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key wrapped by %s", ErrDecrypt, wrapped.KeyID)
+	}
+	return dataKey, nil
+}
+
+// newGCM returns AES-256-GCM keyed with key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return cipher.NewGCM(block)
+}
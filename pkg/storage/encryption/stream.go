@@ -0,0 +1,279 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SegmentSize is how much plaintext each sealed segment holds
+const SegmentSize = 64 * 1024
+
+// streamMagic starts every encrypted blob
+var streamMagic = [8]byte{'I', 'O', 'E', 'N', 'C', 'G', 'C', '1'}
+
+// Encrypted blob layout: the magic, the segment size and a random nonce
+// prefix, followed by the sealed segments. Each segment's nonce is the prefix,
+// its index and a flag marking the final segment, so segments cannot be
+// reordered, and truncating the blob is detected.
+const (
+	prefixSize = 7
+	headerSize = 8 + 4 + prefixSize
+	tagSize    = 16
+)
+
+// segmentNonce returns the nonce of segment index
+func segmentNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts a stream into sealed segments. Close must be called to seal
+// the final segment.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	segment []byte
+	index   uint32
+	started bool
+	closed  bool
+}
+
+// NewWriter returns a writer encrypting to w with dataKey
+func NewWriter(w io.Writer, dataKey []byte) (*Writer, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce prefix: %w", err)
+	}
+
+	return &Writer{
+		w:       w,
+		aead:    aead,
+		prefix:  prefix,
+		segment: make([]byte, 0, SegmentSize),
+	}, nil
+}
+
+// Write implements io.Writer
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, since the
+		// final segment is sealed differently
+		if len(w.segment) == cap(w.segment) {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.segment[len(w.segment):cap(w.segment)], p)
+		w.segment = w.segment[:len(w.segment)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final segment
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.seal(true)
+}
+
+// writeHeader writes the header before the first segment
+func (w *Writer) writeHeader() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, streamMagic[:]...)
+	header = binary.BigEndian.AppendUint32(header, SegmentSize)
+	header = append(header, w.prefix...)
+	_, err := w.w.Write(header)
+	return err
+}
+
+// seal encrypts and writes the buffered segment
+func (w *Writer) seal(final bool) error {
+	sealed := w.aead.Seal(nil, segmentNonce(w.prefix, w.index, final), w.segment, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.index++
+	w.segment = w.segment[:0]
+	return nil
+}
+
+// Reader decrypts an encrypted blob. It supports reading at any offset, and
+// decrypts one segment at a time. It is not safe for concurrent use.
+type Reader struct {
+	r           io.ReaderAt
+	aead        cipher.AEAD
+	prefix      []byte
+	segmentSize int64
+	segments    int64
+	size        int64
+	offset      int64
+
+	// The most recently decrypted segment
+	cached      []byte
+	cachedIndex int64
+}
+
+// NewReader returns a reader over the encrypted blob r of length size
+func NewReader(r io.ReaderAt, size int64, dataKey []byte) (*Reader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < headerSize+tagSize {
+		return nil, fmt.Errorf("%w: blob too short", ErrDecrypt)
+	}
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if [8]byte(header[:8]) != streamMagic {
+		return nil, fmt.Errorf("%w: not an encrypted blob", ErrDecrypt)
+	}
+	segmentSize := int64(binary.BigEndian.Uint32(header[8:12]))
+	if segmentSize == 0 {
+		return nil, fmt.Errorf("%w: invalid segment size", ErrDecrypt)
+	}
+
+	body := size - headerSize
+	sealedSize := segmentSize + tagSize
+	segments := (body + sealedSize - 1) / sealedSize
+	if last := body - (segments-1)*sealedSize; last < tagSize {
+		return nil, fmt.Errorf("%w: truncated segment", ErrDecrypt)
+	}
+
+	return &Reader{
+		r:           r,
+		aead:        aead,
+		prefix:      append([]byte(nil), header[12:]...),
+		segmentSize: segmentSize,
+		segments:    segments,
+		size:        body - segments*tagSize,
+		cachedIndex: -1,
+	}, nil
+}
+
+// Size returns the size of the plaintext
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+
+		index := off / r.segmentSize
+		segment, err := r.segment(index)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], segment[off-index*r.segmentSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+// segment returns the decrypted segment at index
+func (r *Reader) segment(index int64) ([]byte, error) {
+	if index == r.cachedIndex {
+		return r.cached, nil
+	}
+
+	sealedSize := r.segmentSize + tagSize
+	start := headerSize + index*sealedSize
+	length := sealedSize
+	final := index == r.segments-1
+	if final {
+		length = r.size + r.segments*tagSize - index*sealedSize
+	}
+
+	sealed := make([]byte, length)
+	if _, err := r.r.ReadAt(sealed, start); err != nil && !(err == io.EOF && final) {
+		return nil, fmt.Errorf("failed to read segment %d: %w", index, err)
+	}
+
+	plain, err := r.aead.Open(sealed[:0], segmentNonce(r.prefix, uint32(index), final), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: segment %d", ErrDecrypt, index)
+	}
+
+	r.cached = plain
+	r.cachedIndex = index
+	return plain, nil
+}
@@ -0,0 +1,499 @@
+// Package s3store keeps storage backends in an S3-compatible object store.
+//
+// A Volume holds the files of a storage backend as objects in a bucket,
+// under the same content-addressed layout used on disk:
+//
+//	<prefix>/2f/d4/2fd4e1c67a2d28fced849ee1bb76e7391b93eb12
+//	<prefix>/2f/d4/2fd4e1c67a2d28fced849ee1bb76e7391b93eb12.key
+//
+// New files are staged on local disk and uploaded whole once complete, in
+// parts for large ones, so readers never see a partial object. Reads stream
+// ranges of the object rather than downloading it first, and existence
+// checks are HEAD requests.
+package s3store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/zots0127/io/pkg/storage/service"
+)
+
+// DefaultPartSize is the size of the parts large objects are uploaded in
+const DefaultPartSize = 16 * 1024 * 1024
+
+// mtimeKey is the user metadata holding an object's modification time, in
+// Unix nanoseconds. S3 sets LastModified itself, so it cannot be backdated
+// when an object is copied in from another backend.
+const mtimeKey = "Mtime"
+
+// Config configures a volume
+type Config struct {
+	// Endpoint is the URL of an S3-compatible service. Empty uses AWS.
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// Prefix is prepended to every object key
+	Prefix string `json:"prefix"`
+	// AccessKey and SecretKey are static credentials. Empty uses the
+	// default AWS credential chain.
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"-"`
+	// ForcePathStyle addresses the bucket in the URL path rather than the
+	// host name, as most S3-compatible services need
+	ForcePathStyle bool `json:"force_path_style"`
+	// PartSize is the size of the parts objects larger than it are uploaded
+	// in. Zero uses DefaultPartSize.
+	PartSize int64 `json:"part_size"`
+	// StagingDir is the local directory new files are staged in before they
+	// are uploaded. Empty uses the system temp directory.
+	StagingDir string `json:"staging_dir"`
+}
+
+// Volume is a storage volume kept in an S3 bucket. It implements service.Volume.
+type Volume struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+	staging  string
+}
+
+var _ service.Volume = (*Volume)(nil)
+
+// NewVolume creates a new volume in the bucket described by config. The
+// bucket must already exist.
+func NewVolume(config *Config) (*Volume, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+
+	awsConfig := &aws.Config{
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	awsConfig.Region = aws.String(region)
+	if config.AccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, "")
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 session: %w", err)
+	}
+
+	partSize := config.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("S3 part size must be at least %d bytes", s3manager.MinUploadPartSize)
+	}
+
+	staging := config.StagingDir
+	if staging == "" {
+		staging = filepath.Join(os.TempDir(), "io-s3-staging")
+	}
+
+	client := s3.New(sess)
+	return &Volume{
+		client: client,
+		uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			u.PartSize = partSize
+		}),
+		bucket:  config.Bucket,
+		prefix:  strings.Trim(config.Prefix, "/"),
+		staging: staging,
+	}, nil
+}
+
+// Location implements service.Volume
+func (v *Volume) Location() string {
+	return v.Path(".")
+}
+
+// Path implements service.Volume. It returns the object's s3:// URL.
+func (v *Volume) Path(name string) string {
+	return "s3://" + path.Join(v.bucket, v.key(name))
+}
+
+// Stat implements service.Volume with a HEAD request
+func (v *Volume) Stat(name string) (os.FileInfo, error) {
+	head, err := v.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(v.bucket),
+		Key:    aws.String(v.key(name)),
+	})
+	if err != nil {
+		return nil, v.error("stat", name, err)
+	}
+
+	return &fileInfo{
+		name:  path.Base(name),
+		size:  aws.Int64Value(head.ContentLength),
+		mtime: modTime(head.Metadata, head.LastModified),
+	}, nil
+}
+
+// Open implements service.Volume. The object is streamed as it is read.
+func (v *Volume) Open(name string) (service.VolumeFile, error) {
+	info, err := v.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{volume: v, name: name, info: info}, nil
+}
+
+// CreateTemp implements service.Volume. Temp files are staged on local disk.
+func (v *Volume) CreateTemp() (*os.File, error) {
+	if err := os.MkdirAll(v.staging, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(v.staging, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	return tmp, nil
+}
+
+// Commit implements service.Volume. The temp file is uploaded in parts if it
+// is larger than the part size; the object only appears once the upload is
+// complete.
+func (v *Volume) Commit(tmpPath, name string) error {
+	defer os.Remove(tmpPath)
+
+	file, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = v.uploader.Upload(&s3manager.UploadInput{
+		Bucket:   aws.String(v.bucket),
+		Key:      aws.String(v.key(name)),
+		Body:     file,
+		Metadata: mtimeMetadata(info.ModTime()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	return nil
+}
+
+// Remove implements service.Volume. Removing a missing object succeeds.
+func (v *Volume) Remove(name string) error {
+	_, err := v.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(v.bucket),
+		Key:    aws.String(v.key(name)),
+	})
+	if err != nil {
+		return v.error("remove", name, err)
+	}
+	return nil
+}
+
+// Rename implements service.Volume by copying the object and removing the original
+func (v *Volume) Rename(name, newName string) error {
+	_, err := v.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(v.bucket),
+		Key:        aws.String(v.key(newName)),
+		CopySource: aws.String(v.copySource(name)),
+	})
+	if err != nil {
+		return v.error("rename", name, err)
+	}
+	return v.Remove(name)
+}
+
+// Chtimes implements service.Volume by copying the object onto itself with
+// new metadata
+func (v *Volume) Chtimes(name string, mtime time.Time) error {
+	_, err := v.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(v.bucket),
+		Key:               aws.String(v.key(name)),
+		CopySource:        aws.String(v.copySource(name)),
+		Metadata:          mtimeMetadata(mtime),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		return v.error("chtimes", name, err)
+	}
+	return nil
+}
+
+// Walk implements service.Volume. Listings do not carry user metadata, so
+// the files are reported with the time they were uploaded.
+func (v *Volume) Walk(dir string, fn func(name string, info os.FileInfo) error) error {
+	prefix := v.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var fnErr error
+	err := v.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(v.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			rel := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if hidden(rel) {
+				continue
+			}
+
+			name := path.Join(dir, rel)
+			info := &fileInfo{
+				name:  path.Base(rel),
+				size:  aws.Int64Value(object.Size),
+				mtime: aws.TimeValue(object.LastModified),
+			}
+			if fnErr = fn(name, info); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", v.Path(dir), err)
+	}
+	return nil
+}
+
+// CleanTemp implements service.Volume
+func (v *Volume) CleanTemp(cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(v.staging)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read staging directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "upload-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if os.Remove(filepath.Join(v.staging, entry.Name())) == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// key returns the object key of the named file
+func (v *Volume) key(name string) string {
+	key := path.Join(v.prefix, name)
+	if key == "." {
+		return ""
+	}
+	return key
+}
+
+// copySource returns the escaped source of a copy of the named file
+func (v *Volume) copySource(name string) string {
+	return (&url.URL{Path: v.bucket + "/" + v.key(name)}).EscapedPath()
+}
+
+// error converts an S3 error about the named file, reporting a missing
+// object as fs.ErrNotExist
+func (v *Volume) error(op, name string, err error) error {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound && failure.Code() != "NoSuchBucket" {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: v.Path(name), Err: err}
+}
+
+// hidden reports whether a relative object key is inside a hidden directory
+func hidden(rel string) bool {
+	dirs := strings.Split(rel, "/")
+	for _, dir := range dirs[:len(dirs)-1] {
+		if strings.HasPrefix(dir, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// mtimeMetadata returns the user metadata recording mtime
+func mtimeMetadata(mtime time.Time) map[string]*string {
+	return map[string]*string{mtimeKey: aws.String(strconv.FormatInt(mtime.UnixNano(), 10))}
+}
+
+// modTime returns the modification time recorded in metadata, or
+// lastModified if there is none
+func modTime(metadata map[string]*string, lastModified *time.Time) time.Time {
+	for key, value := range metadata {
+		if !strings.EqualFold(key, mtimeKey) {
+			continue
+		}
+		if ns, err := strconv.ParseInt(aws.StringValue(value), 10, 64); err == nil {
+			return time.Unix(0, ns)
+		}
+	}
+	return aws.TimeValue(lastModified)
+}
+
+// fileInfo describes an object
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() os.FileMode  { return 0644 }
+func (i *fileInfo) ModTime() time.Time { return i.mtime }
+func (i *fileInfo) IsDir() bool        { return false }
+func (i *fileInfo) Sys() interface{}   { return nil }
+
+// objectFile reads an object. Sequential reads stream a single GET from the
+// current offset; seeking starts a new one on the next read.
+type objectFile struct {
+	volume *Volume
+	name   string
+	info   os.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read implements io.Reader
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.get(f.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.info.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt with a ranged GET
+func (f *objectFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	length := int64(len(p))
+	if remaining := f.info.Size() - off; length > remaining {
+		length = remaining
+	}
+	body, err := f.get(off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Stat returns the object's description
+func (f *objectFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Close implements io.Closer
+func (f *objectFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+// get requests length bytes of the object from offset, or the rest of it if
+// length is negative
+func (f *objectFile) get(offset, length int64) (io.ReadCloser, error) {
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	object, err := f.volume.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.volume.bucket),
+		Key:    aws.String(f.volume.key(f.name)),
+		Range:  aws.String(rangeHeader),
+	})
+	if err != nil {
+		return nil, f.volume.error("read", f.name, err)
+	}
+	return object.Body, nil
+}
@@ -0,0 +1,569 @@
+package s3store
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
+	"github.com/zots0127/io/pkg/storage/service"
+)
+
+// fakeObject is an object held by fakeS3
+type fakeObject struct {
+	data     []byte
+	metadata http.Header
+	modified time.Time
+}
+
+// fakeS3 is an in-memory stand-in for an S3-compatible service. It serves
+// one bucket with path-style addressing and ignores authentication.
+type fakeS3 struct {
+	bucket   string
+	pageSize int
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	uploads  map[string]map[int][]byte
+	nextID   int
+	requests map[string]int
+}
+
+// newFakeS3 starts a fake S3 service holding bucket
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, string) {
+	t.Helper()
+
+	fake := &fakeS3{
+		bucket:   bucket,
+		pageSize: 3,
+		objects:  map[string]*fakeObject{},
+		uploads:  map[string]map[int][]byte{},
+		requests: map[string]int{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+// count returns how many requests of kind were served
+func (f *fakeS3) count(kind string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[kind]
+}
+
+// keys returns the keys of every object, sorted
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.requests["list"]++
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.requests["initiate"]++
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.requests["part"]++
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		parts[number] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.requests["complete"]++
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, parts[number]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = &fakeObject{data: data, metadata: metadata(r.Header), modified: time.Now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.requests["abort"]++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.requests["copy"]++
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		src, ok := f.objects[sourceKey]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		copied := &fakeObject{data: src.data, metadata: src.metadata, modified: time.Now()}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			copied.metadata = metadata(r.Header)
+		}
+		f.objects[key] = copied
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(copied.data), LastModified: copied.modified.UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPut:
+		f.requests["put"]++
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = &fakeObject{data: data, metadata: metadata(r.Header), modified: time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		if r.Method == http.MethodHead {
+			f.requests["head"]++
+		} else {
+			f.requests["get"]++
+		}
+		object, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(object.data))
+
+		data, status := object.data, http.StatusOK
+		if spec := r.Header.Get("Range"); spec != "" && r.Method == http.MethodGet {
+			var start, end int
+			if n, _ := fmt.Sscanf(spec, "bytes=%d-%d", &start, &end); n < 2 {
+				end = len(data) - 1
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		f.requests["delete"]++
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list serves a page of ListObjectsV2
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: f.bucket, Prefix: query.Get("prefix")}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, result.Prefix) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+
+	for _, key := range keys {
+		object := f.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: object.modified.UTC().Format(time.RFC3339),
+			ETag:         etag(object.data),
+			Size:         len(object.data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+// fail writes an S3 error response
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// metadata returns the user metadata headers of a request
+func metadata(header http.Header) http.Header {
+	meta := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+// etag returns the quoted MD5 of data
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// writeXML writes v as an XML response
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+// newTestVolume returns a volume in a fresh fake S3 bucket
+func newTestVolume(t *testing.T, prefix string) (*Volume, *fakeS3) {
+	t.Helper()
+
+	fake, endpoint := newFakeS3(t, "blobs")
+	volume, err := NewVolume(&Config{
+		Endpoint:       endpoint,
+		Bucket:         "blobs",
+		Prefix:         prefix,
+		AccessKey:      "test",
+		SecretKey:      "test",
+		ForcePathStyle: true,
+		PartSize:       5 * 1024 * 1024,
+		StagingDir:     t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create volume: %v", err)
+	}
+	return volume, fake
+}
+
+// commit stages data and commits it to volume as name
+func commit(t *testing.T, volume *Volume, name string, data []byte) {
+	t.Helper()
+
+	tmp, err := volume.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		t.Fatalf("Failed to write temp file: %v", err)
+	}
+	tmp.Close()
+	if err := volume.Commit(tmp.Name(), name); err != nil {
+		t.Fatalf("Failed to commit %s: %v", name, err)
+	}
+	if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp file removed, got %v", err)
+	}
+}
+
+func TestVolume(t *testing.T) {
+	volume, fake := newTestVolume(t, "store/")
+
+	t.Run("StatMissing", func(t *testing.T) {
+		if _, err := volume.Stat("ab/cd/missing"); !os.IsNotExist(err) {
+			t.Errorf("Expected a not-exist error, got %v", err)
+		}
+		if _, err := volume.Open("ab/cd/missing"); !os.IsNotExist(err) {
+			t.Errorf("Expected a not-exist error, got %v", err)
+		}
+	})
+
+	t.Run("CommitAndRead", func(t *testing.T) {
+		data := []byte("hello, object store")
+		commit(t, volume, "ab/cd/small", data)
+
+		if keys := fake.keys(); len(keys) != 1 || keys[0] != "store/ab/cd/small" {
+			t.Fatalf("Expected the object under the prefix, got %v", keys)
+		}
+		if got := volume.Path("ab/cd/small"); got != "s3://blobs/store/ab/cd/small" {
+			t.Errorf("Unexpected path %s", got)
+		}
+
+		file, err := volume.Open("ab/cd/small")
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		defer file.Close()
+
+		got, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("Expected %q, got %q (%v)", data, got, err)
+		}
+
+		if _, err := file.Seek(7, io.SeekStart); err != nil {
+			t.Fatalf("Failed to seek: %v", err)
+		}
+		tail, _ := io.ReadAll(file)
+		if string(tail) != "object store" {
+			t.Errorf("Expected the tail after seeking, got %q", tail)
+		}
+
+		buf := make([]byte, 6)
+		if n, err := file.ReadAt(buf, 13); n != 6 || err != nil || string(buf) != " store" {
+			t.Errorf("Unexpected ReadAt result %q (%d, %v)", buf[:n], n, err)
+		}
+		if n, err := file.ReadAt(buf, int64(len(data))-3); n != 3 || err != io.EOF {
+			t.Errorf("Expected a short read at the end, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		data := bytes.Repeat([]byte("0123456789abcdef"), 11*1024*1024/16)
+		parts := fake.count("part")
+		commit(t, volume, "ef/01/large", data)
+
+		if uploaded := fake.count("part") - parts; uploaded != 3 {
+			t.Errorf("Expected 3 parts uploaded, got %d", uploaded)
+		}
+
+		file, err := volume.Open("ef/01/large")
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		defer file.Close()
+		got, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("Expected the large object read back, got %d bytes (%v)", len(got), err)
+		}
+	})
+
+	t.Run("ModTime", func(t *testing.T) {
+		old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+		tmp, _ := volume.CreateTemp()
+		tmp.Write([]byte("aged"))
+		tmp.Close()
+		os.Chtimes(tmp.Name(), old, old)
+		if err := volume.Commit(tmp.Name(), "12/34/aged"); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+
+		info, err := volume.Stat("12/34/aged")
+		if err != nil || !info.ModTime().Equal(old) || info.Size() != 4 {
+			t.Fatalf("Expected the staged mtime kept, got %v (%v)", info, err)
+		}
+
+		now := time.Now()
+		if err := volume.Chtimes("12/34/aged", now); err != nil {
+			t.Fatalf("Failed to chtimes: %v", err)
+		}
+		if info, _ := volume.Stat("12/34/aged"); !info.ModTime().Equal(time.Unix(0, now.UnixNano())) {
+			t.Errorf("Expected the new mtime, got %v", info.ModTime())
+		}
+	})
+
+	t.Run("RenameAndRemove", func(t *testing.T) {
+		commit(t, volume, "56/78/moving", []byte("moving"))
+		if err := volume.Rename("56/78/moving", ".quarantine/moving-1/moving"); err != nil {
+			t.Fatalf("Failed to rename: %v", err)
+		}
+		if _, err := volume.Stat("56/78/moving"); !os.IsNotExist(err) {
+			t.Errorf("Expected the original gone, got %v", err)
+		}
+		if err := volume.Rename("56/78/moving", "elsewhere"); !os.IsNotExist(err) {
+			t.Errorf("Expected a not-exist error renaming a missing object, got %v", err)
+		}
+
+		if err := volume.Remove(".quarantine/moving-1/moving"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if _, err := volume.Stat(".quarantine/moving-1/moving"); !os.IsNotExist(err) {
+			t.Errorf("Expected the object removed, got %v", err)
+		}
+	})
+
+	t.Run("Walk", func(t *testing.T) {
+		commit(t, volume, ".quarantine/hidden/file", []byte("hidden"))
+		commit(t, volume, "sub/ab/cd/nested", []byte("nested"))
+
+		var names []string
+		err := volume.Walk(".", func(name string, info os.FileInfo) error {
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk: %v", err)
+		}
+		expected := []string{"12/34/aged", "ab/cd/small", "ef/01/large", "sub/ab/cd/nested"}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %v across pages, got %v", expected, names)
+		}
+
+		names = nil
+		volume.Walk("sub", func(name string, info os.FileInfo) error {
+			names = append(names, name)
+			return nil
+		})
+		if len(names) != 1 || names[0] != "sub/ab/cd/nested" {
+			t.Errorf("Expected only the nested object, got %v", names)
+		}
+	})
+
+	t.Run("CleanTemp", func(t *testing.T) {
+		tmp, _ := volume.CreateTemp()
+		tmp.Close()
+		old := time.Now().Add(-2 * time.Hour)
+		os.Chtimes(tmp.Name(), old, old)
+
+		if removed, err := volume.CleanTemp(time.Now().Add(-time.Hour)); removed != 1 || err != nil {
+			t.Errorf("Expected 1 temp file removed, got %d (%v)", removed, err)
+		}
+	})
+}
+
+func TestStorageOnVolume(t *testing.T) {
+	volume, fake := newTestVolume(t, "")
+
+	keyring := encryption.NewKeyring()
+	if _, err := keyring.Add("k1", bytes.Repeat([]byte{1}, 32), true); err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+
+	storage := service.NewStorage(filepath.Join(t.TempDir(), "local"))
+	storage.SetCompression(&codec.Policy{Codec: codec.Gzip, MinSize: 16})
+	if err := storage.AddVolume("s3", volume); err != nil {
+		t.Fatalf("Failed to add volume: %v", err)
+	}
+	if err := storage.SetPrimaryBackend("s3"); err != nil {
+		t.Fatalf("Failed to set primary backend: %v", err)
+	}
+
+	text := []byte(strings.Repeat("compressible text ", 100))
+	hash, err := storage.Store(text)
+	if err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if backend, _ := storage.BackendOf(hash); backend != "s3" {
+		t.Errorf("Expected the blob on s3, got %s", backend)
+	}
+	if path := storage.GetFilePath(hash); !strings.HasPrefix(path, "s3://blobs/") {
+		t.Errorf("Expected an s3 path, got %s", path)
+	}
+
+	got, err := storage.Retrieve(hash)
+	if err != nil || !bytes.Equal(got, text) {
+		t.Fatalf("Expected the blob read back, got %d bytes (%v)", len(got), err)
+	}
+	info, err := storage.Stat(hash)
+	if err != nil || info.Codec != codec.Gzip {
+		t.Errorf("Expected a gzip blob, got %+v (%v)", info, err)
+	}
+
+	// Encrypted blobs keep their wrapped key beside them in the bucket
+	storage.SetEncryption(keyring)
+	secret := []byte("a secret kept in the bucket")
+	secretHash, _, err := storage.StoreFromReader(bytes.NewReader(secret))
+	if err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	keys := strings.Join(fake.keys(), ",")
+	if !strings.Contains(keys, secretHash+".key") {
+		t.Errorf("Expected the wrapped key in the bucket, got %s", keys)
+	}
+	if got, err := storage.Retrieve(secretHash); err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("Expected the encrypted blob read back, got %q (%v)", got, err)
+	}
+	if _, err := storage.Verify(secretHash, nil); err != nil {
+		t.Errorf("Expected the blob to verify: %v", err)
+	}
+
+	// Blobs move between the bucket and local disk intact
+	if moved, err := storage.Move(secretHash, service.DefaultBackend, nil); !moved || err != nil {
+		t.Fatalf("Failed to move to local disk: %v", err)
+	}
+	if strings.Contains(strings.Join(fake.keys(), ","), secretHash) {
+		t.Error("Expected the blob and key gone from the bucket")
+	}
+	if moved, err := storage.Move(secretHash, "s3", nil); !moved || err != nil {
+		t.Fatalf("Failed to move back: %v", err)
+	}
+	if got, err := storage.Retrieve(secretHash); err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("Expected the moved blob read back, got %q (%v)", got, err)
+	}
+
+	var walked []string
+	storage.WalkBackend("s3", func(hash string, info os.FileInfo) error {
+		walked = append(walked, hash)
+		return nil
+	})
+	if len(walked) != 2 {
+		t.Errorf("Expected 2 blobs on s3, got %v", walked)
+	}
+
+	if err := storage.Delete(hash); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if storage.Exists(hash) {
+		t.Error("Expected the blob deleted")
+	}
+}
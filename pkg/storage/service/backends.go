@@ -0,0 +1,387 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/storage/codec"
+)
+
+// DefaultBackend names the root a storage is created with
+const DefaultBackend = "default"
+
+// Backend errors
+var (
+	ErrUnknownBackend = errors.New("unknown storage backend")
+	ErrBackendExists  = errors.New("storage backend already exists")
+)
+
+// Backend is a named volume blobs are stored in, such as a fast SSD, a large
+// HDD or an object store bucket
+type Backend struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Primary bool   `json:"primary"`
+}
+
+// mount is a volume mounted as a backend
+type mount struct {
+	name   string
+	volume Volume
+}
+
+// backendSet holds the backends of a storage and of the storages derived
+// from it with Sub, so they always agree on where blobs are written
+type backendSet struct {
+	mu      sync.RWMutex
+	mounts  []mount
+	primary int
+}
+
+// newBackendSet returns a set holding only the default backend at path
+func newBackendSet(path string) *backendSet {
+	return &backendSet{mounts: []mount{{name: DefaultBackend, volume: NewLocalVolume(path)}}}
+}
+
+// location is where a blob is stored
+type location struct {
+	backend  string
+	volume   Volume
+	base     string
+	name     string
+	encoding string
+	info     os.FileInfo
+}
+
+// keyName returns the name of the blob's wrapped data key in its volume
+func (l *location) keyName() string {
+	return l.base + keyExtension
+}
+
+// AddBackend mounts the local directory path as another backend called name.
+// Blobs stored there are read like any other, and new blobs go there once it
+// is made primary.
+func (s *Storage) AddBackend(name, path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create backend %s: %w", name, err)
+	}
+	return s.AddVolume(name, NewLocalVolume(path))
+}
+
+// AddVolume mounts volume as another backend called name, like AddBackend
+func (s *Storage) AddVolume(name string, volume Volume) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid backend name: %q", name)
+	}
+
+	set := s.backends
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for _, m := range set.mounts {
+		if m.name == name {
+			return fmt.Errorf("%w: %s", ErrBackendExists, name)
+		}
+	}
+
+	set.mounts = append(set.mounts, mount{name: name, volume: volume})
+	return nil
+}
+
+// SetPrimaryBackend makes the backend called name the one new blobs are
+// written to. Blobs already stored stay where they are until migrated.
+func (s *Storage) SetPrimaryBackend(name string) error {
+	set := s.backends
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for i, m := range set.mounts {
+		if m.name == name {
+			set.primary = i
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownBackend, name)
+}
+
+// PrimaryBackend returns the name of the backend new blobs are written to
+func (s *Storage) PrimaryBackend() string {
+	s.backends.mu.RLock()
+	defer s.backends.mu.RUnlock()
+	return s.backends.mounts[s.backends.primary].name
+}
+
+// Backends returns every backend, in the order they were added
+func (s *Storage) Backends() []Backend {
+	mounts, primary := s.mounts()
+
+	backends := make([]Backend, len(mounts))
+	for i, m := range mounts {
+		backends[i] = Backend{
+			Name:    m.name,
+			Path:    m.volume.Path(s.sub),
+			Primary: i == primary,
+		}
+	}
+	return backends
+}
+
+// BackendOf returns the name of the backend holding the blob identified by hash
+func (s *Storage) BackendOf(hash string) (string, error) {
+	if !isValidHash(hash) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	loc, err := s.locate(hash)
+	if err != nil {
+		return "", err
+	}
+	return loc.backend, nil
+}
+
+// Sub returns a storage rooted at dir inside every backend of s, sharing its
+// backends, algorithm, compression policy and keyring. Backends added to
+// either and primary changes apply to both.
+func (s *Storage) Sub(dir string) *Storage {
+	return &Storage{
+		basePath:    filepath.Join(s.basePath, dir),
+		sub:         path.Join(s.sub, dir),
+		algorithm:   s.algorithm,
+		compression: s.compression,
+		keyring:     s.keyring,
+		backends:    s.backends,
+	}
+}
+
+// WalkBackend calls fn for every blob stored in the backend called name
+func (s *Storage) WalkBackend(name string, fn func(hash string, info os.FileInfo) error) error {
+	mounts, _ := s.mounts()
+	for _, m := range mounts {
+		if m.name == name {
+			return s.walkVolume(m.volume, fn)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownBackend, name)
+}
+
+// Move moves the blob identified by hash, and its wrapped data key, to the
+// backend called to, keeping its stored form and modification time. The copy
+// is in place before the original is removed, so readers find the blob
+// throughout. Reads of the stored files go through wrap if it is not nil,
+// which lets the caller throttle them. It reports whether the blob was moved,
+// which it is not if it was already there.
+func (s *Storage) Move(hash, to string, wrap func(io.Reader) io.Reader) (bool, error) {
+	if !isValidHash(hash) {
+		return false, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	var target Volume
+	mounts, _ := s.mounts()
+	for _, m := range mounts {
+		if m.name == to {
+			target = m.volume
+			break
+		}
+	}
+	if target == nil {
+		return false, fmt.Errorf("%w: %s", ErrUnknownBackend, to)
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	locations, err := s.locateAll(hash)
+	if err != nil {
+		return false, err
+	}
+
+	// An interrupted move leaves a complete copy on the target, since the
+	// copy is committed before anything is removed
+	moved := true
+	for _, loc := range locations {
+		if loc.backend == to {
+			moved = false
+		}
+	}
+	if moved {
+		src := locations[0]
+
+		// The key goes first so the blob is never visible without it
+		if err := copyFile(src.volume, src.keyName(), target, wrap); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to copy data key of %s: %w", hash, err)
+		}
+		if err := copyFile(src.volume, src.name, target, wrap); err != nil {
+			_ = target.Remove(src.keyName())
+			return false, fmt.Errorf("failed to copy %s: %w", hash, err)
+		}
+	}
+
+	for _, loc := range locations {
+		if loc.backend != to {
+			removeBlob(loc)
+		}
+	}
+	return moved, nil
+}
+
+// copyFile copies the named file from src to dst through a temp file,
+// keeping its modification time. It is read through wrap if it is not nil.
+func copyFile(src Volume, name string, dst Volume, wrap func(io.Reader) io.Reader) error {
+	in, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := dst.CreateTemp()
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	var reader io.Reader = in
+	if wrap != nil {
+		reader = wrap(in)
+	}
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return dst.Commit(tmpPath, name)
+}
+
+// removeBlob removes a stored blob and its data key
+func removeBlob(loc *location) error {
+	if err := loc.volume.Remove(loc.name); err != nil {
+		return err
+	}
+	_ = loc.volume.Remove(loc.keyName())
+	return nil
+}
+
+// locate finds the file holding the blob identified by hash, looking in the
+// primary backend first
+func (s *Storage) locate(hash string) (*location, error) {
+	locations, err := s.find(hash, true)
+	if err != nil {
+		return nil, err
+	}
+	return locations[0], nil
+}
+
+// locateAll finds every copy of the blob identified by hash. A blob is only
+// held twice while it is moved between backends.
+func (s *Storage) locateAll(hash string) ([]*location, error) {
+	return s.find(hash, false)
+}
+
+// find looks for the blob identified by hash in every backend, primary
+// first, stopping at the first copy if first is set
+func (s *Storage) find(hash string, first bool) ([]*location, error) {
+	mounts, primary := s.mounts()
+	mounts[0], mounts[primary] = mounts[primary], mounts[0]
+
+	locations, err := s.scan(hash, mounts, first)
+	if err == nil && len(locations) == 0 && len(mounts) > 1 {
+		// A move copies the blob before removing it, so a blob missed in
+		// every backend was moved from one not yet looked at to one already
+		// looked at. Looking again finds it.
+		locations, err = s.scan(hash, mounts, first)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, hash)
+	}
+	return locations, nil
+}
+
+// scan looks for the blob identified by hash in mounts, in order
+func (s *Storage) scan(hash string, mounts []mount, first bool) ([]*location, error) {
+	base := s.blobName(hash)
+
+	var locations []*location
+	for _, m := range mounts {
+		for _, encoding := range encodings {
+			name := base + codec.Extension(encoding)
+			info, err := m.volume.Stat(name)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+
+			locations = append(locations, &location{
+				backend:  m.name,
+				volume:   m.volume,
+				base:     base,
+				name:     name,
+				encoding: encoding,
+				info:     info,
+			})
+			if first {
+				return locations, nil
+			}
+			break
+		}
+	}
+	return locations, nil
+}
+
+// mounts returns the mounted volumes and the index of the primary one
+func (s *Storage) mounts() ([]mount, int) {
+	set := s.backends
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	mounts := make([]mount, len(set.mounts))
+	copy(mounts, set.mounts)
+	return mounts, set.primary
+}
+
+// primaryVolume returns the volume new blobs are written to
+func (s *Storage) primaryVolume() Volume {
+	mounts, primary := s.mounts()
+	return mounts[primary].volume
+}
+
+// blobName returns the name of the blob identified by hash in its volume,
+// without any codec extension. Blobs are sharded by their digest rather than
+// the ID prefix, which is the same for every blob of an algorithm.
+func (s *Storage) blobName(hash string) string {
+	shard := digest.Hex(hash)
+	if len(shard) < 4 {
+		shard = hash
+	}
+	return path.Join(s.sub, shard[0:2], shard[2:4], hash)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/zots0127/io/pkg/storage/encryption"
+)
+
+// keyExtension is the suffix of the file holding a blob's wrapped data key
+const keyExtension = ".key"
+
+// keyPath returns the path of the wrapped data key of the blob identified by hash
+func (s *Storage) keyPath(hash string) string {
+	return s.GetFilePath(hash) + keyExtension
+}
+
+// readKey returns the wrapped data key of the blob identified by hash from
+// the file name in volume, or nil if the blob is not encrypted
+func (s *Storage) readKey(hash string, volume Volume, name string) (*encryption.WrappedKey, error) {
+	file, err := volume.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read data key of %s: %w", hash, err)
+	}
+	defer file.Close()
+
+	wrapped := &encryption.WrappedKey{}
+	if err := json.NewDecoder(file).Decode(wrapped); err != nil {
+		return nil, fmt.Errorf("failed to parse data key of %s: %w", hash, err)
+	}
+	return wrapped, nil
+}
+
+// writeKey atomically replaces the wrapped data key stored as name in volume
+func (s *Storage) writeKey(volume Volume, name string, wrapped *encryption.WrappedKey) error {
+	data, err := json.Marshal(wrapped)
+	if err != nil {
+		return fmt.Errorf("failed to encode data key: %w", err)
+	}
+
+	tmp, err := volume.CreateTemp()
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write data key: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync data key: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close data key: %w", err)
+	}
+
+	if err := volume.Commit(tmpPath, name); err != nil {
+		return fmt.Errorf("failed to move data key into place: %w", err)
+	}
+	return nil
+}
+
+// RotateKey re-wraps the data key of the blob identified by hash with the
+// keyring's primary key, leaving the blob's content untouched. It returns the
+// ID of the key the data key is now wrapped with, or "" for an unencrypted
+// blob, and reports whether the data key was re-wrapped.
+func (s *Storage) RotateKey(hash string) (string, bool, error) {
+	if !isValidHash(hash) {
+		return "", false, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+	if s.keyring == nil {
+		return "", false, fmt.Errorf("%w: no keyring is configured", encryption.ErrKeyNotFound)
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	loc, err := s.locate(hash)
+	if err != nil {
+		return "", false, err
+	}
+	wrapped, err := s.readKey(hash, loc.volume, loc.keyName())
+	if err != nil || wrapped == nil {
+		return "", false, err
+	}
+	if wrapped.KeyID == s.keyring.Primary() {
+		return wrapped.KeyID, false, nil
+	}
+
+	dataKey, err := s.keyring.Unwrap(wrapped, hash)
+	if err != nil {
+		return wrapped.KeyID, false, fmt.Errorf("failed to unwrap data key of %s: %w", hash, err)
+	}
+	rewrapped, err := s.keyring.Wrap(dataKey, hash)
+	if err != nil {
+		return wrapped.KeyID, false, fmt.Errorf("failed to wrap data key of %s: %w", hash, err)
+	}
+	if err := s.writeKey(loc.volume, loc.keyName(), rewrapped); err != nil {
+		return wrapped.KeyID, false, err
+	}
+
+	return rewrapped.KeyID, true, nil
+}
+
+// RotateKeys re-wraps the data key of every encrypted blob not yet wrapped
+// with the primary key, calling fn after each one. It returns how many were
+// re-wrapped. A blob that fails does not stop the rotation; the first error
+// is returned once every blob has been tried.
+func (s *Storage) RotateKeys(ctx context.Context, fn func(hash, keyID string) error) (int, error) {
+	rotated := 0
+	var firstErr error
+
+	err := s.Walk(func(hash string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		keyID, changed, err := s.RotateKey(hash)
+		if err == nil && changed {
+			rotated++
+			if fn != nil {
+				err = fn(hash, keyID)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return nil
+	})
+	if err != nil {
+		return rotated, err
+	}
+
+	return rotated, firstErr
+}
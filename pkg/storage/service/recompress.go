@@ -0,0 +1,90 @@
+package service
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
+)
+
+// Recompress rewrites the blob identified by hash stored with encoding, or
+// uncompressed for codec.None. The blob stays in the backend holding it and
+// keeps its data key and modification time. The rewritten file is committed
+// before the old one is removed, so readers find the blob throughout. It
+// reports whether the blob was rewritten, which it is not if it is already
+// stored with encoding.
+func (s *Storage) Recompress(hash, encoding string) (bool, error) {
+	if !isValidHash(hash) {
+		return false, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+	encoding, err := codec.Lookup(encoding)
+	if err != nil {
+		return false, err
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	loc, err := s.locate(hash)
+	if err != nil {
+		return false, err
+	}
+	if loc.encoding == encoding {
+		return false, nil
+	}
+
+	wrapped, err := s.readKey(hash, loc.volume, loc.keyName())
+	if err != nil {
+		return false, err
+	}
+	var dataKey []byte
+	if wrapped != nil {
+		if s.keyring == nil {
+			return false, fmt.Errorf("%w: %s is encrypted but no keyring is configured", encryption.ErrKeyNotFound, hash)
+		}
+		if dataKey, err = s.keyring.Unwrap(wrapped, hash); err != nil {
+			return false, fmt.Errorf("failed to unwrap data key of %s: %w", hash, err)
+		}
+	}
+
+	blob, err := s.openBlob(hash)
+	if err != nil {
+		return false, err
+	}
+	defer blob.Close()
+
+	tmp, err := loc.volume.CreateTemp()
+	if err != nil {
+		return false, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := s.write(tmp, blob, encoding, dataKey); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to rewrite %s: %w", hash, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chtimes(tmpPath, loc.info.ModTime(), loc.info.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to keep modification time of %s: %w", hash, err)
+	}
+
+	if err := loc.volume.Commit(tmpPath, loc.base+codec.Extension(encoding)); err != nil {
+		return false, fmt.Errorf("failed to commit %s: %w", hash, err)
+	}
+	if err := loc.volume.Remove(loc.name); err != nil && !os.IsNotExist(err) {
+		return true, fmt.Errorf("failed to remove old copy of %s: %w", hash, err)
+	}
+	return true, nil
+}
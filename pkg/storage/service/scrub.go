@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/storage/encryption"
+)
+
+// QuarantineDirName is the directory in each backend that corrupt
+// blobs are moved to. Being hidden, it is skipped when walking the blobs.
+const QuarantineDirName = ".quarantine"
+
+// ErrCorrupt is returned when a stored blob no longer matches its content ID
+var ErrCorrupt = errors.New("blob is corrupt")
+
+// Verify re-reads the blob identified by hash and checks that its original
+// bytes still hash to hash, returning how many bytes were read. Reads go
+// through wrap if it is not nil, which lets the caller throttle them.
+//
+// A blob that does not match, or whose stored form can no longer be
+// decrypted or decompressed, fails with an error wrapping ErrCorrupt. A
+// missing blob, a missing master key and errors from wrap are returned as is,
+// since they say nothing about the blob's content.
+func (s *Storage) Verify(hash string, wrap func(io.Reader) io.Reader) (int64, error) {
+	algorithm, sum, err := digest.Parse(hash)
+	if err != nil || !isValidHash(hash) {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	reader, err := s.Open(hash)
+	if err != nil {
+		return 0, corruption(hash, err)
+	}
+	defer reader.Close()
+
+	var src io.Reader = reader
+	if wrap != nil {
+		src = wrap(reader)
+	}
+
+	h := algorithm.New()
+	n, err := io.Copy(h, src)
+	if err != nil {
+		return n, corruption(hash, err)
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return n, fmt.Errorf("%w: %s hashes to %s", ErrCorrupt, hash, digest.Format(algorithm, h.Sum(nil)))
+	}
+
+	return n, nil
+}
+
+// corruption classifies an error reading blob hash. Errors that are not about
+// the blob's stored bytes are returned as is; anything else wraps ErrCorrupt.
+func corruption(hash string, err error) error {
+	switch {
+	case errors.Is(err, ErrFileNotFound),
+		errors.Is(err, encryption.ErrKeyNotFound),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	return fmt.Errorf("%w: %s: %v", ErrCorrupt, hash, err)
+}
+
+// Quarantine moves the blob identified by hash, and its wrapped data key, out
+// of the store into its own directory under QuarantineDirName. The blob is
+// verified again under its lock first, so a copy rewritten since it was found
+// corrupt is left alone. It returns the directory the blob was moved to, or ""
+// if the blob now verifies.
+func (s *Storage) Quarantine(hash string) (string, error) {
+	if !isValidHash(hash) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := s.Verify(hash, nil); !errors.Is(err, ErrCorrupt) {
+		return "", err
+	}
+
+	loc, err := s.locate(hash)
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(s.sub, QuarantineDirName, hash+"-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	// The key goes first: a blob left in place without its key reads as
+	// corrupt, which it already is
+	if err := loc.volume.Rename(loc.keyName(), path.Join(dir, path.Base(loc.keyName()))); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to quarantine data key: %w", err)
+	}
+	if err := loc.volume.Rename(loc.name, path.Join(dir, path.Base(loc.name))); err != nil {
+		return "", fmt.Errorf("failed to quarantine blob: %w", err)
+	}
+
+	return loc.volume.Path(dir), nil
+}
+
+// Restore stores the blob identified by hash from a known good copy in
+// reader, such as a replica. The content is checked against hash as it is
+// written, with hash's own algorithm, and discarded with an error wrapping
+// ErrCorrupt if it does not match. It returns the number of bytes restored.
+func (s *Storage) Restore(hash string, reader io.Reader) (int64, error) {
+	algorithm, sum, err := digest.Parse(hash)
+	if err != nil || !isValidHash(hash) {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	hasher := algorithm.New()
+	staged, err := s.stage(reader, hasher)
+	if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), sum) {
+		staged.tmp.Close()
+		os.Remove(staged.tmp.Name())
+		return 0, fmt.Errorf("%w: copy of %s hashes to %s", ErrCorrupt, hash, digest.Format(algorithm, hasher.Sum(nil)))
+	}
+
+	if err := s.commit(staged.tmp, staged.volume, hash, staged.encoding, staged.dataKey); err != nil {
+		return 0, err
+	}
+	return staged.size, nil
+}
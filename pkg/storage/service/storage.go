@@ -0,0 +1,688 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// lockStripes is the number of mutexes used to serialize operations on the same hash
+const lockStripes = 256
+
+// tempDirName is the directory under a local volume's root that holds in-flight
+// writes. It lives on the same filesystem as the blobs so the final rename is atomic.
+const tempDirName = ".tmp"
+
+// Storage errors
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrInvalidHash  = errors.New("invalid hash")
+)
+
+// Storage is a content-addressed blob store.
+//
+// Blobs are named by their content ID (see package digest) and stored under a
+// 2-level directory hierarchy derived from the digest:
+//
+//	<base>/2f/d4/2fd4e1c67a2d28fced849ee1bb76e7391b93eb12
+//	<base>/ba/78/1220ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad
+//
+// New blobs are hashed with the storage's algorithm; blobs stored under any
+// other supported algorithm remain readable.
+//
+// Writes go to a temp file that is fsynced and renamed into place, so readers
+// never observe a partially written blob.
+//
+// A storage may span several backends, named volumes such as a fast SSD, a
+// large HDD or an object store bucket (see AddBackend and AddVolume). New
+// blobs are written to the primary backend and blobs are read from whichever
+// backend holds them.
+//
+// With a compression policy set, compressible blobs are stored compressed
+// under their content ID plus the codec's extension. With a keyring set, new
+// blobs are encrypted and their wrapped data key is kept beside them in
+// <content ID>.key. Blobs are always addressed and read as their original bytes.
+type Storage struct {
+	basePath    string
+	sub         string
+	backends    *backendSet
+	algorithm   *digest.Algorithm
+	compression *codec.Policy
+	keyring     *encryption.Keyring
+	locks       [lockStripes]sync.Mutex
+}
+
+// NewStorage creates a new SHA-1 addressed storage rooted at basePath
+func NewStorage(basePath string) *Storage {
+	return NewStorageWithAlgorithm(basePath, digest.SHA1)
+}
+
+// NewStorageWithAlgorithm creates a new storage rooted at basePath that
+// addresses new blobs with algorithm
+func NewStorageWithAlgorithm(basePath string, algorithm *digest.Algorithm) *Storage {
+	s := &Storage{
+		basePath:  basePath,
+		backends:  newBackendSet(basePath),
+		algorithm: algorithm,
+	}
+
+	// Directories are created lazily on write as well, so a failure here is not fatal
+	_ = os.MkdirAll(filepath.Join(basePath, tempDirName), 0755)
+
+	return s
+}
+
+// BasePath returns the root directory of the default backend
+func (s *Storage) BasePath() string {
+	return s.basePath
+}
+
+// Algorithm returns the algorithm used to address new blobs
+func (s *Storage) Algorithm() *digest.Algorithm {
+	return s.algorithm
+}
+
+// SetCompression sets the policy deciding which new blobs are compressed.
+// Nil stores every blob as is. Blobs already stored are read either way.
+func (s *Storage) SetCompression(policy *codec.Policy) {
+	s.compression = policy
+}
+
+// Compression returns the compression policy, or nil if none is set
+func (s *Storage) Compression() *codec.Policy {
+	return s.compression
+}
+
+// SetEncryption sets the keyring new blobs are encrypted with. Nil stores new
+// blobs unencrypted. Encrypted blobs can only be read while their key is in
+// the keyring.
+func (s *Storage) SetEncryption(keyring *encryption.Keyring) {
+	s.keyring = keyring
+}
+
+// Encryption returns the keyring, or nil if encryption is disabled
+func (s *Storage) Encryption() *encryption.Keyring {
+	return s.keyring
+}
+
+// Store writes data to storage and returns its content ID
+func (s *Storage) Store(data []byte) (string, error) {
+	hash := digest.Sum(s.algorithm, data)
+
+	if s.refresh(hash) {
+		return hash, nil
+	}
+
+	volume := s.primaryVolume()
+	tmp, err := volume.CreateTemp()
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+
+	encoding := s.compression.Select(data)
+	dataKey, err := s.newDataKey()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if _, err := s.write(tmp, bytes.NewReader(data), encoding, dataKey); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	if err := s.commit(tmp, volume, hash, encoding, dataKey); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// StoreFromReader streams reader into storage, hashing it as it is written.
+// It returns the content ID and the number of bytes read.
+func (s *Storage) StoreFromReader(reader io.Reader) (string, int64, error) {
+	hasher := s.algorithm.New()
+	staged, err := s.stage(reader, hasher)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := digest.Format(s.algorithm, hasher.Sum(nil))
+	if err := s.commit(staged.tmp, staged.volume, hash, staged.encoding, staged.dataKey); err != nil {
+		return "", 0, err
+	}
+
+	return hash, staged.size, nil
+}
+
+// stagedBlob is content written to a temp file but not yet committed
+type stagedBlob struct {
+	tmp      *os.File
+	volume   Volume
+	encoding string
+	dataKey  []byte
+	size     int64
+}
+
+// stage writes reader to a temp file as it will be stored, feeding the
+// original bytes to hasher. The caller commits the temp file or removes it.
+func (s *Storage) stage(reader io.Reader, hasher hash.Hash) (*stagedBlob, error) {
+	volume := s.primaryVolume()
+	tmp, err := volume.CreateTemp()
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+
+	// The start of the content decides whether it is compressed
+	encoding := codec.None
+	if s.compression != nil {
+		buffered := bufio.NewReaderSize(reader, s.compression.SniffLen())
+		head, err := buffered.Peek(s.compression.SniffLen())
+		if err != nil && err != io.EOF {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to read content: %w", err)
+		}
+		encoding = s.compression.Select(head)
+		reader = buffered
+	}
+
+	dataKey, err := s.newDataKey()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	size, err := s.write(tmp, io.TeeReader(reader, hasher), encoding, dataKey)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	return &stagedBlob{tmp: tmp, volume: volume, encoding: encoding, dataKey: dataKey, size: size}, nil
+}
+
+// Retrieve reads the blob identified by hash
+func (s *Storage) Retrieve(hash string) ([]byte, error) {
+	if !isValidHash(hash) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	reader, err := s.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return data, nil
+}
+
+// Open returns a seekable handle to the blob identified by hash, reading its
+// original bytes. The caller must close it.
+func (s *Storage) Open(hash string) (io.ReadSeekCloser, error) {
+	if !isValidHash(hash) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	blob, err := s.openBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	if blob.info.Codec == codec.None && blob.info.KeyID == "" {
+		return blob.file, nil
+	}
+	return blob, nil
+}
+
+// blobFile reads a blob's original bytes from the file holding it
+type blobFile struct {
+	io.ReadSeeker
+	file VolumeFile
+	info types.BlobInfo
+}
+
+// Close implements io.Closer
+func (f *blobFile) Close() error {
+	return f.file.Close()
+}
+
+// openBlob opens the file holding the blob identified by hash, decrypting
+// and decompressing it as it is stored
+func (s *Storage) openBlob(hash string) (*blobFile, error) {
+	loc, wrapped, file, err := s.openFile(hash)
+	if err != nil && os.IsNotExist(err) {
+		// The blob was moved to another backend since it was located
+		loc, wrapped, file, err = s.openFile(hash)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrFileNotFound, hash)
+		}
+		if errors.Is(err, ErrFileNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	encoding, fileInfo := loc.encoding, loc.info
+
+	blob := &blobFile{
+		ReadSeeker: file,
+		file:       file,
+		info:       types.BlobInfo{Size: fileInfo.Size(), StoredSize: fileInfo.Size(), Codec: encoding},
+	}
+	var content io.ReaderAt = file
+
+	if wrapped != nil {
+		decrypted, err := s.decrypt(hash, file, fileInfo.Size(), wrapped)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		content = decrypted
+		blob.ReadSeeker = decrypted
+		blob.info.Size = decrypted.Size()
+		blob.info.KeyID = wrapped.KeyID
+	}
+
+	if encoding != codec.None {
+		decompressed, err := codec.NewReader(content, blob.info.Size)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open %s: %w", hash, err)
+		}
+		blob.ReadSeeker = decompressed
+		blob.info.Size = decompressed.Size()
+	}
+
+	return blob, nil
+}
+
+// openFile locates the blob identified by hash and opens the file holding it.
+// The key is read before the file is opened: a move removes the key after
+// the file, so a file still there has its key read with it.
+func (s *Storage) openFile(hash string) (*location, *encryption.WrappedKey, VolumeFile, error) {
+	loc, err := s.locate(hash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wrapped, err := s.readKey(hash, loc.volume, loc.keyName())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	file, err := loc.volume.Open(loc.name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return loc, wrapped, file, nil
+}
+
+// decrypt unwraps the data key of blob hash and returns a reader of its plaintext
+func (s *Storage) decrypt(hash string, file io.ReaderAt, size int64, wrapped *encryption.WrappedKey) (*encryption.Reader, error) {
+	if s.keyring == nil {
+		return nil, fmt.Errorf("%w: %s is encrypted but no keyring is configured", encryption.ErrKeyNotFound, hash)
+	}
+	dataKey, err := s.keyring.Unwrap(wrapped, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of %s: %w", hash, err)
+	}
+	reader, err := encryption.NewReader(file, size, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", hash, err)
+	}
+	return reader, nil
+}
+
+// Delete removes the blob identified by hash
+func (s *Storage) Delete(hash string) error {
+	if !isValidHash(hash) {
+		return fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	locations, err := s.locateAll(hash)
+	if err != nil {
+		return err
+	}
+	for _, loc := range locations {
+		if err := removeBlob(loc); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%w: %s", ErrFileNotFound, hash)
+			}
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Exists reports whether the blob identified by hash is stored
+func (s *Storage) Exists(hash string) bool {
+	if !isValidHash(hash) {
+		return false
+	}
+
+	_, err := s.locate(hash)
+	return err == nil
+}
+
+// Size returns the original size in bytes of the blob identified by hash
+func (s *Storage) Size(hash string) (int64, error) {
+	info, err := s.Stat(hash)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// ModTime returns when the blob identified by hash was last written or
+// refreshed by a store of the same content
+func (s *Storage) ModTime(hash string) (time.Time, error) {
+	if !isValidHash(hash) {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	loc, err := s.locate(hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return loc.info.ModTime(), nil
+}
+
+// Stat returns the original size of the blob identified by hash, the size it
+// takes on disk, the codec it is stored with and the key encrypting it
+func (s *Storage) Stat(hash string) (*types.BlobInfo, error) {
+	if !isValidHash(hash) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	blob, err := s.openBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	info := blob.info
+	return &info, nil
+}
+
+// DeleteIfOlderThan removes the blob identified by hash only if it was last
+// written before cutoff. The check and the removal happen under the blob's lock,
+// so a concurrent upload of the same content either refreshes the blob first
+// or recreates it afterwards. It reports whether the blob was removed.
+func (s *Storage) DeleteIfOlderThan(hash string, cutoff time.Time) (bool, error) {
+	if !isValidHash(hash) {
+		return false, fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	locations, err := s.locateAll(hash)
+	if err != nil {
+		return false, err
+	}
+	for _, loc := range locations {
+		if !loc.info.ModTime().Before(cutoff) {
+			return false, nil
+		}
+	}
+
+	for _, loc := range locations {
+		if err := removeBlob(loc); err != nil {
+			return false, fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Walk calls fn for every blob in storage, in every backend. Hidden
+// directories, such as the one holding in-flight temp files, are skipped. A
+// blob moved between backends during the walk may be seen twice or not at all.
+func (s *Storage) Walk(fn func(hash string, info os.FileInfo) error) error {
+	mounts, primary := s.mounts()
+	mounts[0], mounts[primary] = mounts[primary], mounts[0]
+
+	for _, m := range mounts {
+		if err := s.walkVolume(m.volume, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkVolume calls fn for every blob of s in volume
+func (s *Storage) walkVolume(volume Volume, fn func(hash string, info os.FileInfo) error) error {
+	dir := s.sub
+	if dir == "" {
+		dir = "."
+	}
+	return volume.Walk(dir, func(name string, info os.FileInfo) error {
+		hash := trimExtension(path.Base(name))
+		if !isValidHash(hash) {
+			return nil
+		}
+		return fn(hash, info)
+	})
+}
+
+// CleanTemp removes in-flight temp files last modified before cutoff, which
+// are left behind by writers that crashed. It returns the number removed.
+func (s *Storage) CleanTemp(cutoff time.Time) (int, error) {
+	mounts, _ := s.mounts()
+
+	removed := 0
+	for _, m := range mounts {
+		n, err := m.volume.CleanTemp(cutoff)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// GetFilePath returns the path of the blob identified by hash when it is
+// stored uncompressed. Compressed blobs add their codec's extension. The path
+// is in the backend holding the blob, or in the primary backend if it is not
+// stored. It is on disk for local backends only.
+func (s *Storage) GetFilePath(hash string) string {
+	if loc, err := s.locate(hash); err == nil {
+		return loc.volume.Path(loc.base)
+	}
+	return s.primaryVolume().Path(s.blobName(hash))
+}
+
+// encodings lists every way a blob may be stored, uncompressed first
+var encodings = append([]string{codec.None}, codec.Codecs...)
+
+// trimExtension strips a codec extension from a blob file name
+func trimExtension(name string) string {
+	for _, encoding := range codec.Codecs {
+		if ext := codec.Extension(encoding); strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// write copies src to dst, compressed with encoding and then encrypted with
+// dataKey if one is given, and returns the number of original bytes copied
+func (s *Storage) write(dst io.Writer, src io.Reader, encoding string, dataKey []byte) (int64, error) {
+	var encrypted *encryption.Writer
+	if dataKey != nil {
+		w, err := encryption.NewWriter(dst, dataKey)
+		if err != nil {
+			return 0, err
+		}
+		encrypted = w
+		dst = w
+	}
+
+	var n int64
+	var err error
+	if encoding == codec.None {
+		n, err = io.Copy(dst, src)
+	} else {
+		n, err = s.compress(dst, src, encoding)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if encrypted != nil {
+		return n, encrypted.Close()
+	}
+	return n, nil
+}
+
+// compress copies src to dst compressed with encoding
+func (s *Storage) compress(dst io.Writer, src io.Reader, encoding string) (int64, error) {
+	level := 0
+	if s.compression != nil {
+		level = s.compression.Level
+	}
+	w, err := codec.NewWriter(dst, encoding, level)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// newDataKey returns a fresh data key if new blobs are encrypted, or nil
+func (s *Storage) newDataKey() ([]byte, error) {
+	if s.keyring == nil {
+		return nil, nil
+	}
+	return encryption.NewDataKey()
+}
+
+// commit fsyncs tmp and commits it to volume, the backend it was created
+// for, as the blob for hash and encoding. If the blob is encrypted with
+// dataKey, the wrapped key is put in place first so the blob is never visible
+// without it. tmp is always closed and, unless it was moved into place, removed.
+func (s *Storage) commit(tmp *os.File, volume Volume, hash, encoding string, dataKey []byte) error {
+	tmpPath := tmp.Name()
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Another writer already stored the same content, possibly with another
+	// codec. Refresh its mtime so the garbage collector treats it as freshly written.
+	if existing, err := s.locate(hash); err == nil {
+		os.Remove(tmpPath)
+		_ = existing.volume.Chtimes(existing.name, time.Now())
+		return nil
+	}
+
+	base := s.blobName(hash)
+
+	// A key left behind by a crashed writer must not apply to a plaintext blob
+	if dataKey == nil {
+		if err := volume.Remove(base + keyExtension); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to remove stale key: %w", err)
+		}
+	} else {
+		wrapped, err := s.keyring.Wrap(dataKey, hash)
+		if err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		if err := s.writeKey(volume, base+keyExtension, wrapped); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := volume.Commit(tmpPath, base+codec.Extension(encoding)); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", hash, err)
+	}
+	return nil
+}
+
+// refresh bumps the mtime of an existing blob and reports whether it exists.
+// Stores that dedup against an existing blob call it so the blob is not
+// reclaimed by the garbage collector before its metadata is committed.
+func (s *Storage) refresh(hash string) bool {
+	mu := s.lockFor(hash)
+	mu.Lock()
+	defer mu.Unlock()
+
+	loc, err := s.locate(hash)
+	if err != nil {
+		return false
+	}
+	return loc.volume.Chtimes(loc.name, time.Now()) == nil
+}
+
+// lockFor returns the mutex guarding hash
+func (s *Storage) lockFor(hash string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	return &s.locks[h.Sum32()%lockStripes]
+}
+
+// syncDir fsyncs a directory so a rename into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// isValidHash validates the content ID format
+func isValidHash(hash string) bool {
+	return digest.IsValid(hash)
+}
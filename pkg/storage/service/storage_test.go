@@ -0,0 +1,821 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/storage/codec"
+	"github.com/zots0127/io/pkg/storage/encryption"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestStorage(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_storage")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := NewStorage(tempDir)
+	data := []byte("hello content-addressed world")
+	sum := sha1.Sum(data)
+	expected := hex.EncodeToString(sum[:])
+
+	t.Run("StoreAndRetrieve", func(t *testing.T) {
+		hash, err := storage.Store(data)
+		if err != nil {
+			t.Fatalf("Failed to store data: %v", err)
+		}
+		if hash != expected {
+			t.Errorf("Expected hash %s, got %s", expected, hash)
+		}
+
+		expectedPath := filepath.Join(tempDir, expected[0:2], expected[2:4], expected)
+		if _, err := os.Stat(expectedPath); err != nil {
+			t.Errorf("Expected blob at %s: %v", expectedPath, err)
+		}
+
+		retrieved, err := storage.Retrieve(hash)
+		if err != nil {
+			t.Fatalf("Failed to retrieve data: %v", err)
+		}
+		if !bytes.Equal(retrieved, data) {
+			t.Error("Retrieved data doesn't match original data")
+		}
+	})
+
+	t.Run("StoreFromReader", func(t *testing.T) {
+		hash, size, err := storage.StoreFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to store from reader: %v", err)
+		}
+		if hash != expected {
+			t.Errorf("Expected hash %s, got %s", expected, hash)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), size)
+		}
+	})
+
+	t.Run("NoTempFilesLeft", func(t *testing.T) {
+		entries, err := os.ReadDir(filepath.Join(tempDir, tempDirName))
+		if err != nil {
+			t.Fatalf("Failed to read temp directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("Expected empty temp directory, found %d entries", len(entries))
+		}
+	})
+
+	t.Run("ConcurrentWritersSameHash", func(t *testing.T) {
+		payload := []byte("concurrent payload")
+		var wg sync.WaitGroup
+		errs := make(chan error, 32)
+
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				if i%2 == 0 {
+					_, err = storage.Store(payload)
+				} else {
+					_, _, err = storage.StoreFromReader(bytes.NewReader(payload))
+				}
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Concurrent store failed: %v", err)
+			}
+		}
+
+		sum := sha1.Sum(payload)
+		retrieved, err := storage.Retrieve(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatalf("Failed to retrieve data: %v", err)
+		}
+		if !bytes.Equal(retrieved, payload) {
+			t.Error("Retrieved data doesn't match original data")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if !storage.Exists(expected) {
+			t.Fatal("Blob should exist before deletion")
+		}
+		if err := storage.Delete(expected); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+		if storage.Exists(expected) {
+			t.Error("Blob should not exist after deletion")
+		}
+
+		err := storage.Delete(expected)
+		if !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("Expected ErrFileNotFound, got %v", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		missing := fmt.Sprintf("%040x", 0)
+		_, err := storage.Retrieve(missing)
+		if !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("Expected ErrFileNotFound, got %v", err)
+		}
+		if err.Error() != "file not found: "+missing {
+			t.Errorf("Unexpected error message: %s", err.Error())
+		}
+	})
+
+	t.Run("InvalidHash", func(t *testing.T) {
+		if storage.Exists("../../etc/passwd") {
+			t.Error("Invalid hash should not exist")
+		}
+		if _, err := storage.Retrieve("../../etc/passwd"); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Expected ErrInvalidHash, got %v", err)
+		}
+	})
+}
+
+func TestStorageWithAlgorithm(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_storage_sha256")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := []byte("hello content-addressed world")
+
+	// Content written by a SHA-1 store stays readable after switching algorithms
+	legacy, err := NewStorage(tempDir).Store(data)
+	if err != nil {
+		t.Fatalf("Failed to store data: %v", err)
+	}
+
+	storage := NewStorageWithAlgorithm(tempDir, digest.SHA256)
+	sum := sha256.Sum256(data)
+	expected := "1220" + hex.EncodeToString(sum[:])
+
+	hash, size, err := storage.StoreFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to store from reader: %v", err)
+	}
+	if hash != expected {
+		t.Errorf("Expected hash %s, got %s", expected, hash)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), size)
+	}
+
+	digestHex := expected[4:]
+	expectedPath := filepath.Join(tempDir, digestHex[0:2], digestHex[2:4], expected)
+	if _, err := os.Stat(expectedPath); err != nil {
+		t.Errorf("Expected blob at %s: %v", expectedPath, err)
+	}
+
+	if retrieved, err := storage.Retrieve(legacy); err != nil || !bytes.Equal(retrieved, data) {
+		t.Errorf("Expected legacy SHA-1 content to stay readable, got %v", err)
+	}
+}
+
+func TestStorageCompression(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_storage_compression")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := bytes.Repeat([]byte("a line of very compressible text\n"), 20000)
+	sum := sha1.Sum(data)
+	expected := hex.EncodeToString(sum[:])
+
+	// Content stored uncompressed before compression was enabled
+	raw := []byte(strings.Repeat("stored before compression was enabled\n", 200))
+	legacy, err := NewStorage(tempDir).Store(raw)
+	if err != nil {
+		t.Fatalf("Failed to store data: %v", err)
+	}
+
+	storage := NewStorage(tempDir)
+	storage.SetCompression(codec.DefaultPolicy())
+
+	t.Run("HashOfOriginalBytes", func(t *testing.T) {
+		hash, size, err := storage.StoreFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to store from reader: %v", err)
+		}
+		if hash != expected {
+			t.Errorf("Expected hash %s, got %s", expected, hash)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), size)
+		}
+
+		if stored, err := storage.Store(data); err != nil || stored != expected {
+			t.Errorf("Expected Store to dedup to %s, got %s (%v)", expected, stored, err)
+		}
+	})
+
+	t.Run("StoredCompressed", func(t *testing.T) {
+		compressedPath := storage.GetFilePath(expected) + ".gz"
+		if _, err := os.Stat(compressedPath); err != nil {
+			t.Fatalf("Expected compressed blob at %s: %v", compressedPath, err)
+		}
+		if _, err := os.Stat(storage.GetFilePath(expected)); !os.IsNotExist(err) {
+			t.Error("Expected no uncompressed copy")
+		}
+
+		info, err := storage.Stat(expected)
+		if err != nil {
+			t.Fatalf("Failed to stat blob: %v", err)
+		}
+		if info.Codec != codec.Gzip || info.Size != int64(len(data)) || info.StoredSize >= info.Size/10 {
+			t.Errorf("Unexpected blob info: %+v", info)
+		}
+		if size, err := storage.Size(expected); err != nil || size != int64(len(data)) {
+			t.Errorf("Expected original size %d, got %d (%v)", len(data), size, err)
+		}
+	})
+
+	t.Run("ReadsOriginalBytes", func(t *testing.T) {
+		retrieved, err := storage.Retrieve(expected)
+		if err != nil || !bytes.Equal(retrieved, data) {
+			t.Fatalf("Expected original content, got %v", err)
+		}
+
+		reader, err := storage.Open(expected)
+		if err != nil {
+			t.Fatalf("Failed to open blob: %v", err)
+		}
+		defer reader.Close()
+
+		offset := int64(len(data)) - 5000
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Failed to seek: %v", err)
+		}
+		tail, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(tail, data[offset:]) {
+			t.Errorf("Expected range read to match, got %v", err)
+		}
+	})
+
+	t.Run("IncompressibleStoredAsIs", func(t *testing.T) {
+		png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1}, 8192)...)
+		hash, err := storage.Store(png)
+		if err != nil {
+			t.Fatalf("Failed to store data: %v", err)
+		}
+		if info, err := storage.Stat(hash); err != nil || info.Codec != codec.None {
+			t.Errorf("Expected image to be stored as is, got %+v (%v)", info, err)
+		}
+	})
+
+	t.Run("LegacyBlobsStayReadable", func(t *testing.T) {
+		if retrieved, err := storage.Retrieve(legacy); err != nil || !bytes.Equal(retrieved, raw) {
+			t.Errorf("Expected uncompressed content to stay readable, got %v", err)
+		}
+		if stored, err := storage.Store(raw); err != nil || stored != legacy {
+			t.Fatalf("Expected Store to dedup to %s, got %s (%v)", legacy, stored, err)
+		}
+		if info, err := storage.Stat(legacy); err != nil || info.Codec != codec.None {
+			t.Errorf("Expected the existing uncompressed blob to be kept, got %+v (%v)", info, err)
+		}
+	})
+
+	t.Run("Recompress", func(t *testing.T) {
+		before, err := storage.ModTime(legacy)
+		if err != nil {
+			t.Fatalf("Failed to get modification time: %v", err)
+		}
+
+		for _, encoding := range []string{codec.Gzip, codec.None} {
+			if changed, err := storage.Recompress(legacy, encoding); err != nil || !changed {
+				t.Fatalf("Expected %s to be rewritten with %s, got %v (%v)", legacy, encoding, changed, err)
+			}
+			if info, err := storage.Stat(legacy); err != nil || info.Codec != encoding || info.Size != int64(len(raw)) {
+				t.Errorf("Expected %s to be stored with %s, got %+v (%v)", legacy, encoding, info, err)
+			}
+			if retrieved, err := storage.Retrieve(legacy); err != nil || !bytes.Equal(retrieved, raw) {
+				t.Errorf("Expected original content after rewriting with %s, got %v", encoding, err)
+			}
+			if after, err := storage.ModTime(legacy); err != nil || !after.Equal(before) {
+				t.Errorf("Expected modification time %v to be kept, got %v (%v)", before, after, err)
+			}
+		}
+
+		if changed, err := storage.Recompress(legacy, codec.None); err != nil || changed {
+			t.Errorf("Expected a blob already stored as is to be left alone, got %v (%v)", changed, err)
+		}
+		if _, err := storage.Recompress(legacy, "zstd"); !errors.Is(err, codec.ErrUnknownCodec) {
+			t.Errorf("Expected ErrUnknownCodec, got %v", err)
+		}
+	})
+
+	t.Run("WalkAndDelete", func(t *testing.T) {
+		found := false
+		err := storage.Walk(func(hash string, info os.FileInfo) error {
+			if hash == expected {
+				found = true
+			}
+			return nil
+		})
+		if err != nil || !found {
+			t.Errorf("Expected Walk to report compressed blob by its hash (%v)", err)
+		}
+
+		if err := storage.Delete(expected); err != nil {
+			t.Fatalf("Failed to delete blob: %v", err)
+		}
+		if storage.Exists(expected) {
+			t.Error("Expected compressed blob to be deleted")
+		}
+	})
+}
+
+func TestStorageEncryption(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_storage_encryption")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	oldKey := bytes.Repeat([]byte{1}, encryption.KeySize)
+	keyring := encryption.NewKeyring()
+	if _, err := keyring.Add("old", oldKey, true); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	storage := NewStorage(tempDir)
+	storage.SetCompression(codec.DefaultPolicy())
+	storage.SetEncryption(keyring)
+
+	text := bytes.Repeat([]byte("secret but compressible text\n"), 10000)
+	binary := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte("secret pixels "), 100)...)
+
+	hashes := make(map[string][]byte)
+	for _, data := range [][]byte{text, binary} {
+		hash, _, err := storage.StoreFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to store data: %v", err)
+		}
+		sum := sha1.Sum(data)
+		if hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected the hash of the plaintext, got %s", hash)
+		}
+		hashes[hash] = data
+	}
+
+	t.Run("NoPlaintextOnDisk", func(t *testing.T) {
+		err := filepath.Walk(tempDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(content, []byte("secret")) {
+				t.Errorf("Found plaintext in %s", path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk storage: %v", err)
+		}
+	})
+
+	t.Run("ReadsPlaintext", func(t *testing.T) {
+		for hash, data := range hashes {
+			if !storage.Exists(hash) {
+				t.Errorf("Expected %s to exist", hash)
+			}
+			retrieved, err := storage.Retrieve(hash)
+			if err != nil || !bytes.Equal(retrieved, data) {
+				t.Errorf("Expected plaintext of %s back (%v)", hash, err)
+			}
+
+			reader, err := storage.Open(hash)
+			if err != nil {
+				t.Fatalf("Failed to open blob: %v", err)
+			}
+			offset := int64(len(data)) / 2
+			if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+				t.Fatalf("Failed to seek: %v", err)
+			}
+			tail, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil || !bytes.Equal(tail, data[offset:]) {
+				t.Errorf("Expected range read of %s to match (%v)", hash, err)
+			}
+
+			info, err := storage.Stat(hash)
+			if err != nil || info.KeyID != "old" || info.Size != int64(len(data)) {
+				t.Errorf("Unexpected blob info for %s: %+v (%v)", hash, info, err)
+			}
+		}
+	})
+
+	t.Run("Dedup", func(t *testing.T) {
+		hash, err := storage.Store(text)
+		if err != nil {
+			t.Fatalf("Failed to store data: %v", err)
+		}
+		if _, ok := hashes[hash]; !ok {
+			t.Errorf("Expected identical plaintext to dedup, got new hash %s", hash)
+		}
+	})
+
+	t.Run("Recompress", func(t *testing.T) {
+		binarySum := sha1.Sum(binary)
+		binaryHash := hex.EncodeToString(binarySum[:])
+
+		if changed, err := storage.Recompress(binaryHash, codec.Gzip); err != nil || !changed {
+			t.Fatalf("Expected %s to be compressed, got %v (%v)", binaryHash, changed, err)
+		}
+		info, err := storage.Stat(binaryHash)
+		if err != nil || info.Codec != codec.Gzip || info.KeyID != "old" {
+			t.Errorf("Expected %s to stay encrypted with its key, got %+v (%v)", binaryHash, info, err)
+		}
+		if retrieved, err := storage.Retrieve(binaryHash); err != nil || !bytes.Equal(retrieved, binary) {
+			t.Errorf("Expected plaintext of %s back (%v)", binaryHash, err)
+		}
+		compressed, err := os.ReadFile(storage.GetFilePath(binaryHash) + codec.Extension(codec.Gzip))
+		if err != nil || bytes.Contains(compressed, []byte("secret")) {
+			t.Errorf("Expected the compressed blob to be encrypted (%v)", err)
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		textSum := sha1.Sum(text)
+		textHash := hex.EncodeToString(textSum[:])
+		blobPath := storage.GetFilePath(textHash) + codec.Extension(mustStat(t, storage, textHash).Codec)
+		blobBefore, err := os.ReadFile(blobPath)
+		if err != nil {
+			t.Fatalf("Failed to read blob: %v", err)
+		}
+
+		if _, err := keyring.Add("new", bytes.Repeat([]byte{2}, encryption.KeySize), true); err != nil {
+			t.Fatalf("Failed to add key: %v", err)
+		}
+
+		var rotated []string
+		count, err := storage.RotateKeys(context.Background(), func(hash, keyID string) error {
+			if keyID != "new" {
+				t.Errorf("Expected rotation to the new key, got %s", keyID)
+			}
+			rotated = append(rotated, hash)
+			return nil
+		})
+		if err != nil || count != len(hashes) || len(rotated) != len(hashes) {
+			t.Fatalf("Expected %d blobs re-wrapped, got %d (%v)", len(hashes), count, err)
+		}
+
+		blobAfter, err := os.ReadFile(blobPath)
+		if err != nil || !bytes.Equal(blobBefore, blobAfter) {
+			t.Error("Expected rotation to leave blob content untouched")
+		}
+
+		// The old key is no longer needed
+		rotatedKeyring := encryption.NewKeyring()
+		if _, err := rotatedKeyring.Add("new", bytes.Repeat([]byte{2}, encryption.KeySize), true); err != nil {
+			t.Fatalf("Failed to add key: %v", err)
+		}
+		reopened := NewStorage(tempDir)
+		reopened.SetEncryption(rotatedKeyring)
+		for hash, data := range hashes {
+			if retrieved, err := reopened.Retrieve(hash); err != nil || !bytes.Equal(retrieved, data) {
+				t.Errorf("Expected %s to read with only the new key (%v)", hash, err)
+			}
+		}
+
+		if count, err := storage.RotateKeys(context.Background(), nil); err != nil || count != 0 {
+			t.Errorf("Expected nothing left to rotate, got %d (%v)", count, err)
+		}
+	})
+
+	t.Run("MissingKey", func(t *testing.T) {
+		withoutKeys := NewStorage(tempDir)
+		for hash := range hashes {
+			if !withoutKeys.Exists(hash) {
+				t.Errorf("Expected %s to exist without keys", hash)
+			}
+			if _, err := withoutKeys.Retrieve(hash); !errors.Is(err, encryption.ErrKeyNotFound) {
+				t.Errorf("Expected ErrKeyNotFound, got %v", err)
+			}
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		for hash := range hashes {
+			if err := storage.Delete(hash); err != nil {
+				t.Fatalf("Failed to delete blob: %v", err)
+			}
+			if _, err := os.Stat(storage.keyPath(hash)); !os.IsNotExist(err) {
+				t.Errorf("Expected the data key of %s to be removed", hash)
+			}
+		}
+	})
+}
+
+func TestStorageScrub(t *testing.T) {
+	tempDir := t.TempDir()
+
+	keyring := encryption.NewKeyring()
+	if _, err := keyring.Add("k", bytes.Repeat([]byte{1}, encryption.KeySize), true); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	plain := NewStorage(filepath.Join(tempDir, "plain"))
+	sealed := NewStorage(filepath.Join(tempDir, "sealed"))
+	sealed.SetCompression(codec.DefaultPolicy())
+	sealed.SetEncryption(keyring)
+
+	data := bytes.Repeat([]byte("scrub me please\n"), 1000)
+
+	for name, storage := range map[string]*Storage{"Plain": plain, "Sealed": sealed} {
+		t.Run(name, func(t *testing.T) {
+			hash, err := storage.Store(data)
+			if err != nil {
+				t.Fatalf("Failed to store data: %v", err)
+			}
+
+			n, err := storage.Verify(hash, nil)
+			if err != nil || n != int64(len(data)) {
+				t.Fatalf("Expected an intact blob to verify, got %d bytes (%v)", n, err)
+			}
+			if dir, err := storage.Quarantine(hash); dir != "" || err != nil {
+				t.Errorf("Expected an intact blob to stay in place, got %q (%v)", dir, err)
+			}
+
+			// Flip one bit of the stored file
+			blobPath := storage.GetFilePath(hash) + codec.Extension(mustStat(t, storage, hash).Codec)
+			stored, err := os.ReadFile(blobPath)
+			if err != nil {
+				t.Fatalf("Failed to read blob: %v", err)
+			}
+			stored[len(stored)/2] ^= 0x10
+			if err := os.WriteFile(blobPath, stored, 0644); err != nil {
+				t.Fatalf("Failed to corrupt blob: %v", err)
+			}
+
+			if _, err := storage.Verify(hash, nil); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Expected ErrCorrupt, got %v", err)
+			}
+
+			dir, err := storage.Quarantine(hash)
+			if err != nil || dir == "" {
+				t.Fatalf("Failed to quarantine blob: %v", err)
+			}
+			if storage.Exists(hash) {
+				t.Error("Expected the corrupt blob to leave the store")
+			}
+			if _, err := os.Stat(filepath.Join(dir, filepath.Base(blobPath))); err != nil {
+				t.Errorf("Expected the blob in quarantine: %v", err)
+			}
+			storage.Walk(func(walked string, info os.FileInfo) error {
+				t.Errorf("Expected quarantined blobs to be skipped, walked %s", walked)
+				return nil
+			})
+
+			if _, err := storage.Restore(hash, bytes.NewReader(data[1:])); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Expected a bad copy to be refused, got %v", err)
+			}
+			if _, err := storage.Restore(hash, bytes.NewReader(data)); err != nil {
+				t.Fatalf("Failed to restore blob: %v", err)
+			}
+			if _, err := storage.Verify(hash, nil); err != nil {
+				t.Errorf("Expected the restored blob to verify: %v", err)
+			}
+		})
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		missing := digest.Sum(digest.SHA1, []byte("never stored"))
+		if _, err := plain.Verify(missing, nil); !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("Expected ErrFileNotFound, got %v", err)
+		}
+	})
+}
+
+func TestStorageBackends(t *testing.T) {
+	tempDir := t.TempDir()
+	ssd := filepath.Join(tempDir, "ssd")
+	hdd := filepath.Join(tempDir, "hdd")
+
+	keyring := encryption.NewKeyring()
+	if _, err := keyring.Add("k1", bytes.Repeat([]byte{1}, encryption.KeySize), true); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	storage := NewStorage(ssd)
+	storage.SetCompression(codec.DefaultPolicy())
+	storage.SetEncryption(keyring)
+	chunks := storage.Sub(".chunks")
+
+	if err := storage.AddBackend("hdd", hdd); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	if err := storage.AddBackend("hdd", hdd); !errors.Is(err, ErrBackendExists) {
+		t.Errorf("Expected ErrBackendExists, got %v", err)
+	}
+	if err := storage.SetPrimaryBackend("tape"); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("Expected ErrUnknownBackend, got %v", err)
+	}
+
+	text := bytes.Repeat([]byte("compressible text on the fast disk\n"), 1000)
+	onSSD, err := storage.Store(text)
+	if err != nil {
+		t.Fatalf("Failed to store data: %v", err)
+	}
+
+	// New blobs, chunks included, go to the primary backend
+	if err := storage.SetPrimaryBackend("hdd"); err != nil {
+		t.Fatalf("Failed to set primary backend: %v", err)
+	}
+	if chunks.PrimaryBackend() != "hdd" {
+		t.Errorf("Expected the chunk storage to share the primary, got %s", chunks.PrimaryBackend())
+	}
+	onHDD, err := storage.Store([]byte("bulk data"))
+	if err != nil {
+		t.Fatalf("Failed to store data: %v", err)
+	}
+	chunk, err := chunks.Store([]byte("a chunk"))
+	if err != nil {
+		t.Fatalf("Failed to store chunk: %v", err)
+	}
+
+	for hash, want := range map[string]string{onSSD: DefaultBackend, onHDD: "hdd"} {
+		if backend, err := storage.BackendOf(hash); err != nil || backend != want {
+			t.Errorf("Expected %s on %s, got %s (%v)", hash, want, backend, err)
+		}
+	}
+	if !strings.HasPrefix(chunks.GetFilePath(chunk), filepath.Join(hdd, ".chunks")) {
+		t.Errorf("Expected the chunk under the hdd backend, got %s", chunks.GetFilePath(chunk))
+	}
+
+	walked := map[string]bool{}
+	storage.Walk(func(hash string, info os.FileInfo) error {
+		walked[hash] = true
+		return nil
+	})
+	if len(walked) != 2 || !walked[onSSD] || !walked[onHDD] {
+		t.Errorf("Expected both blobs walked and no chunks, got %v", walked)
+	}
+
+	t.Run("Move", func(t *testing.T) {
+		before := mustStat(t, storage, onSSD)
+		oldPath := storage.GetFilePath(onSSD)
+
+		moved, err := storage.Move(onSSD, "hdd", nil)
+		if err != nil || !moved {
+			t.Fatalf("Failed to move blob: %v", err)
+		}
+		if backend, _ := storage.BackendOf(onSSD); backend != "hdd" {
+			t.Errorf("Expected the blob on hdd, got %s", backend)
+		}
+		if _, err := os.Stat(oldPath + codec.Extension(before.Codec)); !os.IsNotExist(err) {
+			t.Error("Expected the blob to leave its old backend")
+		}
+		if _, err := os.Stat(oldPath + keyExtension); !os.IsNotExist(err) {
+			t.Error("Expected the data key to leave its old backend")
+		}
+
+		data, err := storage.Retrieve(onSSD)
+		if err != nil || !bytes.Equal(data, text) {
+			t.Errorf("Expected the moved blob to read back (%v)", err)
+		}
+		if after := mustStat(t, storage, onSSD); *after != *before {
+			t.Errorf("Expected the stored form to be kept, got %+v want %+v", after, before)
+		}
+
+		if moved, err := storage.Move(onSSD, "hdd", nil); err != nil || moved {
+			t.Errorf("Expected a second move to do nothing, got %v (%v)", moved, err)
+		}
+		if _, err := storage.Move(onSSD, "tape", nil); !errors.Is(err, ErrUnknownBackend) {
+			t.Errorf("Expected ErrUnknownBackend, got %v", err)
+		}
+	})
+
+	t.Run("ResumeInterruptedMove", func(t *testing.T) {
+		// A crash between copying and removing leaves the blob on both
+		hash, err := storage.Store([]byte("copied but not removed"))
+		if err != nil {
+			t.Fatalf("Failed to store data: %v", err)
+		}
+		src := storage.GetFilePath(hash)
+		dst := strings.Replace(src, hdd, ssd, 1)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		for _, ext := range []string{"", keyExtension} {
+			data, err := os.ReadFile(src + ext)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", src+ext, err)
+			}
+			if err := os.WriteFile(dst+ext, data, 0644); err != nil {
+				t.Fatalf("Failed to copy %s: %v", src+ext, err)
+			}
+		}
+
+		if moved, err := storage.Move(hash, DefaultBackend, nil); err != nil || moved {
+			t.Fatalf("Expected the move to finish without copying, got %v (%v)", moved, err)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Error("Expected the copy on the old backend to be removed")
+		}
+		if data, err := storage.Retrieve(hash); err != nil || string(data) != "copied but not removed" {
+			t.Errorf("Expected the blob to read back (%v)", err)
+		}
+
+		// Deleting removes every copy
+		if _, err := storage.Move(hash, "hdd", nil); err != nil {
+			t.Fatalf("Failed to move blob: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(dst, []byte("stale"), 0644); err != nil {
+			t.Fatalf("Failed to leave a stale copy: %v", err)
+		}
+		if err := storage.Delete(hash); err != nil {
+			t.Fatalf("Failed to delete blob: %v", err)
+		}
+		if storage.Exists(hash) {
+			t.Error("Expected every copy to be deleted")
+		}
+	})
+
+	t.Run("ReadsDuringMove", func(t *testing.T) {
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		failures := make(chan error, 1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				data, err := storage.Retrieve(onSSD)
+				if err == nil && !bytes.Equal(data, text) {
+					err = fmt.Errorf("read back %d bytes", len(data))
+				}
+				if err != nil {
+					select {
+					case failures <- err:
+					default:
+					}
+					return
+				}
+			}
+		}()
+
+		for i := 0; i < 10; i++ {
+			to := DefaultBackend
+			if i%2 == 1 {
+				to = "hdd"
+			}
+			if _, err := storage.Move(onSSD, to, nil); err != nil {
+				t.Fatalf("Failed to move blob: %v", err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+
+		select {
+		case err := <-failures:
+			t.Errorf("Expected reads to succeed during moves: %v", err)
+		default:
+		}
+	})
+}
+
+// mustStat returns the blob info of hash
+func mustStat(t *testing.T, storage *Storage, hash string) *types.BlobInfo {
+	t.Helper()
+	info, err := storage.Stat(hash)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", hash, err)
+	}
+	return info
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Volume is where a backend keeps its files, such as a local directory or an
+// object store bucket. Names are slash-separated and relative to the volume.
+// Missing files fail with an error for which os.IsNotExist reports true,
+// except that removing one may succeed.
+type Volume interface {
+	// Location describes the volume, such as its directory or bucket URL
+	Location() string
+	// Path returns where the named file is kept
+	Path(name string) string
+	// Stat describes the named file
+	Stat(name string) (os.FileInfo, error)
+	// Open opens the named file for reading
+	Open(name string) (VolumeFile, error)
+	// CreateTemp creates a local temp file to stage a new file in
+	CreateTemp() (*os.File, error)
+	// Commit durably moves the closed temp file at tmpPath into place as
+	// name, keeping its modification time. Readers see either the old file
+	// or the whole new one. The temp file is removed either way.
+	Commit(tmpPath, name string) error
+	// Remove removes the named file
+	Remove(name string) error
+	// Rename moves the named file to newName
+	Rename(name, newName string) error
+	// Chtimes sets the modification time of the named file
+	Chtimes(name string, mtime time.Time) error
+	// Walk calls fn for every file under dir, skipping hidden directories below it
+	Walk(dir string, fn func(name string, info os.FileInfo) error) error
+	// CleanTemp removes temp files last modified before cutoff and returns how many
+	CleanTemp(cutoff time.Time) (int, error)
+}
+
+// VolumeFile is a file opened from a volume. *os.File is one.
+type VolumeFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// localVolume keeps files in a directory on the local filesystem. Temp files
+// live in the same directory tree, so committing them is an atomic rename.
+type localVolume struct {
+	root string
+}
+
+// NewLocalVolume returns a volume keeping files under the directory root
+func NewLocalVolume(root string) Volume {
+	return &localVolume{root: root}
+}
+
+// Location implements Volume
+func (v *localVolume) Location() string {
+	return v.root
+}
+
+// Path implements Volume
+func (v *localVolume) Path(name string) string {
+	return filepath.Join(v.root, filepath.FromSlash(name))
+}
+
+// Stat implements Volume
+func (v *localVolume) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(v.Path(name))
+}
+
+// Open implements Volume
+func (v *localVolume) Open(name string) (VolumeFile, error) {
+	return os.Open(v.Path(name))
+}
+
+// CreateTemp implements Volume
+func (v *localVolume) CreateTemp() (*os.File, error) {
+	if err := os.MkdirAll(v.tempDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(v.tempDir(), "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	return tmp, nil
+}
+
+// Commit implements Volume
+func (v *localVolume) Commit(tmpPath, name string) error {
+	filePath := v.Path(name)
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// Remove implements Volume. Shard directories left empty are dropped too.
+func (v *localVolume) Remove(name string) error {
+	if err := os.Remove(v.Path(name)); err != nil {
+		return err
+	}
+
+	// Best effort: drop now-empty shard directories
+	dir := path.Dir(name)
+	for i := 0; i < 2 && dir != "." && dir != "/"; i++ {
+		if os.Remove(v.Path(dir)) != nil {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	return nil
+}
+
+// Rename implements Volume
+func (v *localVolume) Rename(name, newName string) error {
+	newPath := v.Path(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(v.Path(name), newPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(v.Path(name)))
+}
+
+// Chtimes implements Volume
+func (v *localVolume) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(v.Path(name), mtime, mtime)
+}
+
+// Walk implements Volume
+func (v *localVolume) Walk(dir string, fn func(name string, info os.FileInfo) error) error {
+	start := v.Path(dir)
+	return filepath.Walk(start, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may be removed while we walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if filePath != start && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(v.root, filePath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// CleanTemp implements Volume
+func (v *localVolume) CleanTemp(cutoff time.Time) (int, error) {
+	return cleanTempDir(v.tempDir(), cutoff)
+}
+
+// tempDir returns the directory used for in-flight writes
+func (v *localVolume) tempDir() string {
+	return filepath.Join(v.root, tempDirName)
+}
+
+// cleanTempDir removes the temp files in dir last modified before cutoff
+func cleanTempDir(dir string, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read temp directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "upload-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if os.Remove(filepath.Join(dir, entry.Name())) == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
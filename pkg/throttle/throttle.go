@@ -0,0 +1,76 @@
+// Package throttle paces background jobs that read or copy stored content,
+// such as scrubs and migrations, so they leave disk bandwidth to clients.
+package throttle
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// maxRead bounds a single paced read so slow rates are paced smoothly
+const maxRead = 64 * 1024
+
+// Limiter paces reads across a whole job to a number of bytes per second.
+// It is not safe for concurrent use.
+type Limiter struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+// NewLimiter creates a limiter of rate bytes per second. Zero does not limit,
+// but reads still stop once ctx is done.
+func NewLimiter(ctx context.Context, rate int64) *Limiter {
+	return &Limiter{ctx: ctx, rate: rate, start: time.Now()}
+}
+
+// Reader wraps r so reads from it are paced by the limiter
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{reader: r, limiter: l}
+}
+
+// Wait accounts for n bytes read and sleeps until reading them fits the rate
+func (l *Limiter) Wait(n int) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.read += int64(n)
+	due := l.start.Add(time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-l.ctx.Done():
+		return l.ctx.Err()
+	}
+}
+
+// limitedReader reads through a limiter
+type limitedReader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+// Read implements io.Reader
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxRead {
+		p = p[:maxRead]
+	}
+	n, err := r.reader.Read(p)
+	if waitErr := r.limiter.Wait(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
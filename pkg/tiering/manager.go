@@ -0,0 +1,384 @@
+// Package tiering keeps rarely read content on cheaper, slower storage.
+//
+// Content no object has read for a while is demoted from the hot backends
+// to a cold one at a limited rate, and promoted back to the primary backend
+// when it is read. A promotion either happens while the read waits or, with
+// asynchronous restores, in the background while the read is turned away
+// with ErrRestoring until it is done.
+//
+// Moves never lose content: each copy is complete before the original is
+// removed (see service.Storage.Move), and the tier of content being demoted
+// is recorded as demoting until the move is done, so a move interrupted by
+// a restart is finished by the next run.
+package tiering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/throttle"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultColdAfter is how long content goes unread before it is demoted by default
+const DefaultColdAfter = 30 * 24 * time.Hour
+
+// DefaultInterval is how often idle content is demoted by default
+const DefaultInterval = time.Hour
+
+// DefaultRateLimit is how many bytes per second demotions copy by default
+const DefaultRateLimit = 32 * 1024 * 1024
+
+// DefaultBatchSize is how many idle blobs are read from the repository at a time
+const DefaultBatchSize = 100
+
+// Tiering errors
+var (
+	ErrRunInProgress = errors.New("tiering run already in progress")
+	ErrDisabled      = errors.New("no cold storage backend is configured")
+	ErrRestoring     = errors.New("content is being restored from cold storage")
+)
+
+// Config configures tiering
+type Config struct {
+	// ColdBackend is the backend idle content is demoted to. Empty disables tiering.
+	ColdBackend string `json:"cold_backend"`
+	// ColdAfter is how long content goes unread before it is demoted
+	ColdAfter time.Duration `json:"cold_after"`
+	// Interval between background runs. Zero disables them.
+	Interval time.Duration `json:"interval"`
+	// RateLimit caps the bytes demotions copy per second. Zero copies as fast
+	// as the disks allow. Promotions are not limited, since a read waits for them.
+	RateLimit int64 `json:"rate_limit"`
+	// BatchSize is how many idle blobs are read from the repository at a time
+	BatchSize int `json:"batch_size"`
+	// AsyncRestore promotes cold content in the background when it is read,
+	// turning reads away with ErrRestoring until it is done
+	AsyncRestore bool `json:"async_restore"`
+}
+
+// DefaultConfig returns the default tiering configuration, with tiering disabled
+func DefaultConfig() *Config {
+	return &Config{
+		ColdAfter: DefaultColdAfter,
+		Interval:  DefaultInterval,
+		RateLimit: DefaultRateLimit,
+		BatchSize: DefaultBatchSize,
+	}
+}
+
+// Report is the outcome of a single run
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	Demoted      int   `json:"demoted"`
+	BytesDemoted int64 `json:"bytes_demoted"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Manager demotes idle content to cold storage and promotes it back when read
+type Manager struct {
+	content      *chunkstore.Store
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+
+	restoreMu sync.Mutex
+	restoring map[string]bool
+	restores  sync.WaitGroup
+}
+
+// NewManager creates a new tiering manager over the content store
+func NewManager(content *chunkstore.Store, metadataRepo *repository.MetadataRepository, config *Config) *Manager {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.ColdAfter <= 0 {
+		config.ColdAfter = DefaultColdAfter
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	return &Manager{
+		content:      content,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[TIERING] ", log.LstdFlags),
+		restoring:    make(map[string]bool),
+	}
+}
+
+// Enabled reports whether a cold backend is configured
+func (m *Manager) Enabled() bool {
+	return m.config.ColdBackend != ""
+}
+
+// Config returns the tiering configuration
+func (m *Manager) Config() *Config {
+	return m.config
+}
+
+// LastReport returns the report of the most recent run, or nil if none has run
+func (m *Manager) LastReport() *Report {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastReport
+}
+
+// Restoring returns the content being restored in the background, by hash
+func (m *Manager) Restoring() []string {
+	m.restoreMu.Lock()
+	defer m.restoreMu.Unlock()
+
+	hashes := make([]string, 0, len(m.restoring))
+	for hash := range m.restoring {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// Run demotes every blob nothing has read for the configured time. Only one
+// run happens at a time.
+func (m *Manager) Run(ctx context.Context) (*Report, error) {
+	if !m.Enabled() {
+		return nil, ErrDisabled
+	}
+	if !m.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer m.running.Unlock()
+
+	if err := m.checkColdBackend(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{StartedAt: time.Now()}
+	if err := m.demoteIdle(ctx, report); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	m.logger.Printf("tiering finished: demoted %d blobs (%d bytes) to %s, %d errors",
+		report.Demoted, report.BytesDemoted, m.config.ColdBackend, len(report.Errors))
+
+	m.mu.Lock()
+	m.lastReport = report
+	m.mu.Unlock()
+
+	return report, nil
+}
+
+// checkColdBackend makes sure the cold backend is mounted and is not where
+// new content is written
+func (m *Manager) checkColdBackend() error {
+	for _, backend := range m.content.Storage().Backends() {
+		if backend.Name != m.config.ColdBackend {
+			continue
+		}
+		if backend.Primary {
+			return fmt.Errorf("cold backend %s is the primary backend", backend.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("cold backend %s is not mounted", m.config.ColdBackend)
+}
+
+// demoteIdle demotes idle blobs a batch at a time until none is left
+func (m *Manager) demoteIdle(ctx context.Context, report *Report) error {
+	cutoff := report.StartedAt.Add(-m.config.ColdAfter)
+	limit := throttle.NewLimiter(ctx, m.config.RateLimit)
+
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		blobs, err := m.metadataRepo.ListTierCandidates(cutoff, after, m.config.BatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to list idle blobs: %w", err)
+		}
+
+		for _, blob := range blobs {
+			after = blob.Hash
+
+			demoted, err := m.demote(blob, limit)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			if demoted {
+				report.Demoted++
+				report.BytesDemoted += blob.Size
+			}
+		}
+
+		if len(blobs) < m.config.BatchSize {
+			return nil
+		}
+	}
+}
+
+// demote moves one blob to the cold backend and reports whether it is there.
+// A blob read while it moves is promoted by the read, so it is moved back.
+func (m *Manager) demote(blob *types.BlobTier, limit *throttle.Limiter) (bool, error) {
+	if blob.Tier == types.TierHot {
+		marked, err := m.metadataRepo.SwapBlobTier(blob.Hash, types.TierHot, types.TierDemoting)
+		if err != nil {
+			return false, fmt.Errorf("failed to mark %s as demoting: %w", blob.Hash, err)
+		}
+		if !marked {
+			return false, nil
+		}
+	}
+
+	if _, err := m.content.Move(blob.Hash, m.config.ColdBackend, limit.Reader); err != nil {
+		_, _ = m.metadataRepo.SwapBlobTier(blob.Hash, types.TierDemoting, types.TierHot)
+		return false, fmt.Errorf("failed to demote %s: %w", blob.Hash, err)
+	}
+
+	demoted, err := m.metadataRepo.SwapBlobTier(blob.Hash, types.TierDemoting, types.TierCold)
+	if err != nil {
+		return false, fmt.Errorf("failed to record demotion of %s: %w", blob.Hash, err)
+	}
+	if !demoted {
+		// Promoted by a read before the move was recorded
+		if _, err := m.content.Move(blob.Hash, m.content.Storage().PrimaryBackend(), nil); err != nil {
+			return false, fmt.Errorf("failed to move %s back after it was read: %w", blob.Hash, err)
+		}
+	}
+	return demoted, nil
+}
+
+// Promote readies the content identified by hash to be read from hot
+// storage. Content that is not cold is left alone. With asynchronous restores
+// it starts restoring cold content and returns ErrRestoring; otherwise it
+// waits for the promotion. Cold content that fails to promote is still read
+// from the cold backend.
+func (m *Manager) Promote(ctx context.Context, hash string) error {
+	if !m.Enabled() {
+		return nil
+	}
+
+	tier, err := m.metadataRepo.GetBlobTier(hash)
+	if err != nil {
+		m.logger.Printf("Warning: failed to look up tier of %s: %v", hash, err)
+		return nil
+	}
+	if tier == "" || tier == types.TierHot {
+		return nil
+	}
+
+	if m.config.AsyncRestore {
+		m.restore(hash)
+		return fmt.Errorf("%w: %s", ErrRestoring, hash)
+	}
+
+	if err := m.promote(hash); err != nil {
+		m.logger.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// restore promotes the content identified by hash in the background, unless
+// it is already being restored
+func (m *Manager) restore(hash string) {
+	m.restoreMu.Lock()
+	defer m.restoreMu.Unlock()
+
+	if m.restoring[hash] {
+		return
+	}
+	m.restoring[hash] = true
+	m.restores.Add(1)
+
+	go func() {
+		defer m.restores.Done()
+
+		if err := m.promote(hash); err != nil {
+			m.logger.Printf("restore failed: %v", err)
+		}
+
+		m.restoreMu.Lock()
+		delete(m.restoring, hash)
+		m.restoreMu.Unlock()
+	}()
+}
+
+// promote moves the content identified by hash to the primary backend
+func (m *Manager) promote(hash string) error {
+	if _, err := m.content.Move(hash, m.content.Storage().PrimaryBackend(), nil); err != nil {
+		return fmt.Errorf("failed to promote %s: %w", hash, err)
+	}
+	if err := m.metadataRepo.SetBlobTier(hash, types.TierHot); err != nil {
+		return fmt.Errorf("failed to record promotion of %s: %w", hash, err)
+	}
+	return nil
+}
+
+// Start demotes idle content immediately and then every configured interval
+// until Stop is called. It does nothing if tiering is disabled or no interval
+// is configured.
+func (m *Manager) Start(ctx context.Context) {
+	if !m.Enabled() || m.config.Interval <= 0 || m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(m.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := m.Run(ctx); err != nil && !errors.Is(err, ErrRunInProgress) {
+				m.logger.Printf("tiering failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background runs and waits for a running one, and for restores
+// in progress, to finish
+func (m *Manager) Stop() {
+	if m.stop != nil {
+		close(m.stop)
+		<-m.done
+		m.stop = nil
+	}
+	m.restores.Wait()
+}
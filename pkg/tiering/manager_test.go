@@ -0,0 +1,191 @@
+package tiering
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/chunkstore"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/storage/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestManager(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_tiering")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	storage := service.NewStorage(filepath.Join(tempDir, "storage"))
+	if err := storage.AddBackend("cold", filepath.Join(tempDir, "cold")); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	content := chunkstore.NewStore(storage, metadataRepo, nil)
+
+	store := func(data string, idle time.Duration) *types.FileMetadata {
+		t.Helper()
+		hash, err := content.Store([]byte(data))
+		if err != nil {
+			t.Fatalf("Failed to store content: %v", err)
+		}
+		accessed := time.Now().Add(-idle)
+		metadata := &types.FileMetadata{
+			Hash:         hash,
+			FileName:     "file.txt",
+			Size:         int64(len(data)),
+			UploadedAt:   accessed,
+			LastAccessed: accessed,
+		}
+		if err := metadataRepo.SaveMetadata(metadata); err != nil {
+			t.Fatalf("Failed to save metadata: %v", err)
+		}
+		return metadata
+	}
+	tierOf := func(hash string) string {
+		t.Helper()
+		tier, err := metadataRepo.GetBlobTier(hash)
+		if err != nil {
+			t.Fatalf("Failed to get tier: %v", err)
+		}
+		return tier
+	}
+	backendOf := func(hash string) string {
+		t.Helper()
+		backend, err := storage.BackendOf(hash)
+		if err != nil {
+			t.Fatalf("Failed to locate %s: %v", hash, err)
+		}
+		return backend
+	}
+
+	day := 24 * time.Hour
+	idle := store(strings.Repeat("idle ", 1000), 60*day)
+	busy := store(strings.Repeat("busy ", 1000), day)
+	ctx := context.Background()
+
+	t.Run("Disabled", func(t *testing.T) {
+		manager := NewManager(content, metadataRepo, DefaultConfig())
+		if _, err := manager.Run(ctx); !errors.Is(err, ErrDisabled) {
+			t.Errorf("Expected ErrDisabled, got %v", err)
+		}
+		if err := manager.Promote(ctx, idle.Hash); err != nil {
+			t.Errorf("Expected promotion to do nothing, got %v", err)
+		}
+	})
+
+	t.Run("ColdPrimary", func(t *testing.T) {
+		manager := NewManager(content, metadataRepo, &Config{ColdBackend: service.DefaultBackend})
+		if _, err := manager.Run(ctx); err == nil {
+			t.Error("Expected demoting to the primary backend to fail")
+		}
+	})
+
+	t.Run("UnknownBackend", func(t *testing.T) {
+		manager := NewManager(content, metadataRepo, &Config{ColdBackend: "tape"})
+		if _, err := manager.Run(ctx); err == nil {
+			t.Error("Expected demoting to a backend that is not mounted to fail")
+		}
+	})
+
+	manager := NewManager(content, metadataRepo, &Config{ColdBackend: "cold"})
+
+	t.Run("Demote", func(t *testing.T) {
+		report, err := manager.Run(ctx)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if report.Demoted != 1 || report.BytesDemoted != idle.Size || len(report.Errors) != 0 {
+			t.Errorf("Expected one blob demoted, got %+v", report)
+		}
+		if manager.LastReport() != report {
+			t.Error("Expected the last report to be kept")
+		}
+
+		if tier := tierOf(idle.Hash); tier != types.TierCold {
+			t.Errorf("Expected idle content to be cold, got %s", tier)
+		}
+		if backend := backendOf(idle.Hash); backend != "cold" {
+			t.Errorf("Expected idle content on the cold backend, got %s", backend)
+		}
+		if tier := tierOf(busy.Hash); tier != types.TierHot {
+			t.Errorf("Expected busy content to stay hot, got %s", tier)
+		}
+
+		metadata, err := metadataRepo.GetMetadata(idle.ID)
+		if err != nil || metadata.Tier != types.TierCold {
+			t.Errorf("Expected metadata to show the cold tier, got %+v (%v)", metadata, err)
+		}
+
+		usage, err := metadataRepo.CountBlobsByTier()
+		if err != nil {
+			t.Fatalf("Failed to count blobs by tier: %v", err)
+		}
+		if usage[types.TierCold].Blobs != 1 || usage[types.TierHot].Blobs != 1 {
+			t.Errorf("Unexpected tier usage: cold %+v, hot %+v", usage[types.TierCold], usage[types.TierHot])
+		}
+	})
+
+	t.Run("InterruptedDemotion", func(t *testing.T) {
+		// A move interrupted after the copy leaves the blob demoting
+		if err := metadataRepo.SetBlobTier(busy.Hash, types.TierDemoting); err != nil {
+			t.Fatalf("Failed to set tier: %v", err)
+		}
+		report, err := manager.Run(ctx)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if report.Demoted != 1 {
+			t.Errorf("Expected the interrupted demotion to finish, got %+v", report)
+		}
+		if tier := tierOf(busy.Hash); tier != types.TierCold {
+			t.Errorf("Expected busy content to be cold, got %s", tier)
+		}
+		data, err := content.Retrieve(busy.Hash)
+		if err != nil || !bytes.Equal(data, []byte(strings.Repeat("busy ", 1000))) {
+			t.Errorf("Expected content to survive the move, got %d bytes (%v)", len(data), err)
+		}
+	})
+
+	t.Run("Promote", func(t *testing.T) {
+		if err := manager.Promote(ctx, idle.Hash); err != nil {
+			t.Fatalf("Promote failed: %v", err)
+		}
+		if tier := tierOf(idle.Hash); tier != types.TierHot {
+			t.Errorf("Expected promoted content to be hot, got %s", tier)
+		}
+		if backend := backendOf(idle.Hash); backend != service.DefaultBackend {
+			t.Errorf("Expected promoted content on the primary backend, got %s", backend)
+		}
+	})
+
+	t.Run("AsyncRestore", func(t *testing.T) {
+		async := NewManager(content, metadataRepo, &Config{ColdBackend: "cold", AsyncRestore: true})
+		if err := async.Promote(ctx, busy.Hash); !errors.Is(err, ErrRestoring) {
+			t.Fatalf("Expected ErrRestoring, got %v", err)
+		}
+		async.Stop()
+
+		if restoring := async.Restoring(); len(restoring) != 0 {
+			t.Errorf("Expected no restores left, got %v", restoring)
+		}
+		if tier := tierOf(busy.Hash); tier != types.TierHot {
+			t.Errorf("Expected restored content to be hot, got %s", tier)
+		}
+		if err := async.Promote(ctx, busy.Hash); err != nil {
+			t.Errorf("Expected hot content to be read right away, got %v", err)
+		}
+	})
+}
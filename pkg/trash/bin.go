@@ -0,0 +1,313 @@
+// Package trash keeps deleted objects restorable for a while.
+//
+// A deleted object is moved to the trash instead of being removed: it is no
+// longer listed, searched or served, and the bucket keys it was stored under
+// are removed, but it keeps its reference on its content. Until the trash
+// window ends it can be restored by ID, live again as it was before. Each run
+// of the purger then removes the objects whose window has ended for good,
+// releasing their content to the garbage collector, and admins can empty the
+// trash at once.
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultWindow is how long deleted objects stay restorable by default
+const DefaultWindow = 7 * 24 * time.Hour
+
+// DefaultInterval is how often the trash is purged by default
+const DefaultInterval = time.Hour
+
+// DefaultBatchSize is how many trashed objects are read from the repository at a time
+const DefaultBatchSize = 100
+
+// Trash errors
+var (
+	ErrRunInProgress = errors.New("trash purge already in progress")
+	ErrNotInTrash    = errors.New("object is not in the trash")
+)
+
+// Config configures the trash
+type Config struct {
+	// Window is how long deleted objects stay restorable. Zero disables the
+	// trash: deletes are permanent, and runs purge whatever is left in it.
+	Window time.Duration `json:"window"`
+	// Interval between background purges. Zero disables them.
+	Interval time.Duration `json:"interval"`
+	// BatchSize is how many trashed objects are read from the repository at a time
+	BatchSize int `json:"batch_size"`
+}
+
+// DefaultConfig returns the default trash configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Window:    DefaultWindow,
+		Interval:  DefaultInterval,
+		BatchSize: DefaultBatchSize,
+	}
+}
+
+// Item is an object in the trash and when it is due to be purged
+type Item struct {
+	*types.FileMetadata
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// Report is the outcome of a single purge
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	Purged      int   `json:"purged"`
+	BytesPurged int64 `json:"bytes_purged"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Bin moves deleted objects to the trash, restores them and purges them
+type Bin struct {
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	running    sync.Mutex
+	mu         sync.RWMutex
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewBin creates a new trash bin
+func NewBin(metadataRepo *repository.MetadataRepository, config *Config) *Bin {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.Window < 0 {
+		config.Window = 0
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	return &Bin{
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[TRASH] ", log.LstdFlags),
+	}
+}
+
+// Enabled reports whether deleted objects are moved to the trash
+func (b *Bin) Enabled() bool {
+	return b.config.Window > 0
+}
+
+// Config returns the trash configuration
+func (b *Bin) Config() *Config {
+	return b.config
+}
+
+// LastReport returns the report of the most recent purge, or nil if none has run
+func (b *Bin) LastReport() *Report {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.lastReport
+}
+
+// Move moves object id to the trash
+func (b *Bin) Move(id string) error {
+	trashed, err := b.metadataRepo.TrashObject(id, time.Now())
+	if err != nil {
+		return err
+	}
+	if !trashed {
+		return fmt.Errorf("no metadata found for object: %s", id)
+	}
+	return nil
+}
+
+// List returns up to limit objects in the trash, skipping the first offset,
+// those deleted last first
+func (b *Bin) List(limit, offset int) ([]*Item, error) {
+	objects, err := b.metadataRepo.ListTrash(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*Item, 0, len(objects))
+	for _, metadata := range objects {
+		items = append(items, b.item(metadata))
+	}
+	return items, nil
+}
+
+// Get returns object id if it is in the trash
+func (b *Bin) Get(id string) (*Item, error) {
+	metadata, err := b.metadataRepo.GetTrashedObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotInTrash, id)
+	}
+	return b.item(metadata), nil
+}
+
+// item returns metadata with the time it is due to be purged
+func (b *Bin) item(metadata *types.FileMetadata) *Item {
+	return &Item{FileMetadata: metadata, PurgeAt: metadata.DeletedAt.Add(b.config.Window)}
+}
+
+// Restore takes object id out of the trash and returns it. The bucket keys
+// it was stored under are not restored.
+func (b *Bin) Restore(id string) (*types.FileMetadata, error) {
+	restored, err := b.metadataRepo.RestoreObject(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %w", id, err)
+	}
+	if !restored {
+		return nil, fmt.Errorf("%w: %s", ErrNotInTrash, id)
+	}
+	return b.metadataRepo.GetMetadata(id)
+}
+
+// Purge removes object id from the trash for good
+func (b *Bin) Purge(id string) error {
+	purged, err := b.metadataRepo.PurgeObject(id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to purge %s: %w", id, err)
+	}
+	if !purged {
+		return fmt.Errorf("%w: %s", ErrNotInTrash, id)
+	}
+	return nil
+}
+
+// Run purges every object whose trash window has ended. Only one purge
+// happens at a time.
+func (b *Bin) Run(ctx context.Context) (*Report, error) {
+	return b.run(ctx, b.config.Window)
+}
+
+// Empty purges every object in the trash, however recently it was deleted
+func (b *Bin) Empty(ctx context.Context) (*Report, error) {
+	return b.run(ctx, 0)
+}
+
+// run purges the objects deleted at least window ago
+func (b *Bin) run(ctx context.Context, window time.Duration) (*Report, error) {
+	if !b.running.TryLock() {
+		return nil, ErrRunInProgress
+	}
+	defer b.running.Unlock()
+
+	report := &Report{StartedAt: time.Now()}
+	if err := b.purge(ctx, report.StartedAt.Add(-window), report); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	b.logger.Printf("trash purge finished: %d purged (%d bytes), %d errors",
+		report.Purged, report.BytesPurged, len(report.Errors))
+
+	b.mu.Lock()
+	b.lastReport = report
+	b.mu.Unlock()
+
+	return report, nil
+}
+
+// purge removes the objects deleted at or before cutoff a batch at a time
+// until none is left
+func (b *Bin) purge(ctx context.Context, cutoff time.Time, report *Report) error {
+	// Objects that failed to purge are still listed, so they are skipped for the rest of the run
+	failed := make(map[string]bool)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		objects, err := b.metadataRepo.ListPurgeableObjects(cutoff, b.config.BatchSize+len(failed))
+		if err != nil {
+			return fmt.Errorf("failed to list trashed objects: %w", err)
+		}
+
+		purged := 0
+		for _, metadata := range objects {
+			if failed[metadata.ID] {
+				continue
+			}
+			// Objects restored since they were listed are left alone
+			deleted, err := b.metadataRepo.PurgeObject(metadata.ID, cutoff)
+			if err != nil {
+				failed[metadata.ID] = true
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to purge %s: %v", metadata.ID, err))
+				continue
+			}
+			if !deleted {
+				continue
+			}
+			report.Purged++
+			report.BytesPurged += metadata.Size
+			purged++
+		}
+
+		if purged == 0 {
+			return nil
+		}
+	}
+}
+
+// Start purges immediately and then every configured interval until Stop is
+// called. It does nothing if no interval is configured.
+func (b *Bin) Start(ctx context.Context) {
+	if b.config.Interval <= 0 || b.stop != nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+
+	go func() {
+		defer close(b.done)
+
+		ticker := time.NewTicker(b.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := b.Run(ctx); err != nil && !errors.Is(err, ErrRunInProgress) {
+				b.logger.Printf("trash purge failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background purges and waits for a running one to finish
+func (b *Bin) Stop() {
+	if b.stop == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+	b.stop = nil
+}
@@ -0,0 +1,207 @@
+package trash
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/metadata/repository"
+	"github.com/zots0127/io/pkg/types"
+)
+
+func TestBin(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_trash")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	bin := NewBin(metadataRepo, &Config{Window: time.Hour})
+
+	ctx := context.Background()
+	store := func(name string) *types.FileMetadata {
+		t.Helper()
+		metadata := &types.FileMetadata{
+			Hash:       "0123456789abcdef",
+			FileName:   name,
+			Size:       16,
+			UploadedAt: time.Now(),
+		}
+		if err := metadataRepo.SaveMetadata(metadata); err != nil {
+			t.Fatalf("Failed to save metadata: %v", err)
+		}
+		return metadata
+	}
+	discard := func(metadata *types.FileMetadata) {
+		t.Helper()
+		if err := bin.Move(metadata.ID); err != nil {
+			t.Fatalf("Failed to move %s to the trash: %v", metadata.ID, err)
+		}
+	}
+	refs := func(hash string) int64 {
+		t.Helper()
+		count, err := metadataRepo.BlobRefCount(hash)
+		if err != nil {
+			t.Fatalf("Failed to count references: %v", err)
+		}
+		return count
+	}
+
+	t.Run("Delete", func(t *testing.T) {
+		metadata := store("report.txt")
+		discard(metadata)
+
+		if _, err := metadataRepo.GetMetadata(metadata.ID); err == nil {
+			t.Error("Expected a trashed object not to be found")
+		}
+		files, err := metadataRepo.ListFiles(&types.MetadataFilter{FileName: "report.txt"})
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if len(files) != 0 {
+			t.Errorf("Expected a trashed object not to be listed, got %d", len(files))
+		}
+		if count := refs(metadata.Hash); count != 1 {
+			t.Errorf("Expected the trashed object to keep its reference, got %d", count)
+		}
+		if err := bin.Move(metadata.ID); err == nil {
+			t.Error("Expected moving a trashed object again to fail")
+		}
+
+		item, err := bin.Get(metadata.ID)
+		if err != nil {
+			t.Fatalf("Failed to get trashed object: %v", err)
+		}
+		if item.DeletedAt == nil || !item.PurgeAt.Equal(item.DeletedAt.Add(time.Hour)) {
+			t.Errorf("Expected the object to be purged an hour after it was deleted, got %+v", item)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		metadata := store("restored.txt")
+		discard(metadata)
+
+		restored, err := bin.Restore(metadata.ID)
+		if err != nil {
+			t.Fatalf("Failed to restore: %v", err)
+		}
+		if restored.DeletedAt != nil || restored.FileName != "restored.txt" {
+			t.Errorf("Expected the object to be live again, got %+v", restored)
+		}
+
+		files, err := metadataRepo.ListFiles(&types.MetadataFilter{FileName: "restored.txt"})
+		if err != nil || len(files) != 1 {
+			t.Errorf("Expected a restored object to be listed, got %d (%v)", len(files), err)
+		}
+
+		if _, err := bin.Restore(metadata.ID); !errors.Is(err, ErrNotInTrash) {
+			t.Errorf("Expected ErrNotInTrash for a live object, got %v", err)
+		}
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		if _, err := bin.Empty(ctx); err != nil {
+			t.Fatalf("Failed to empty the trash: %v", err)
+		}
+		metadata := store("recent.txt")
+		discard(metadata)
+
+		report, err := bin.Run(ctx)
+		if err != nil {
+			t.Fatalf("Purge failed: %v", err)
+		}
+		if report.Purged != 0 {
+			t.Errorf("Expected nothing purged within the window, got %+v", report)
+		}
+		if bin.LastReport() != report {
+			t.Error("Expected the last report to be kept")
+		}
+
+		// A window that has already ended purges what the trash holds
+		ended := NewBin(metadataRepo, &Config{Window: time.Nanosecond, BatchSize: 1})
+		report, err = ended.Run(ctx)
+		if err != nil {
+			t.Fatalf("Purge failed: %v", err)
+		}
+		if report.Purged != 1 || report.BytesPurged != metadata.Size {
+			t.Errorf("Expected one object purged, got %+v", report)
+		}
+		if _, err := bin.Get(metadata.ID); !errors.Is(err, ErrNotInTrash) {
+			t.Errorf("Expected the purged object to be gone, got %v", err)
+		}
+	})
+
+	t.Run("RestoredBeforePurge", func(t *testing.T) {
+		metadata := store("changed-mind.txt")
+		discard(metadata)
+
+		// A purge that listed the object before it was restored leaves it live
+		listed, err := metadataRepo.ListPurgeableObjects(time.Now(), 10)
+		if err != nil || len(listed) == 0 {
+			t.Fatalf("Expected the object to be purgeable, got %d (%v)", len(listed), err)
+		}
+		if _, err := bin.Restore(metadata.ID); err != nil {
+			t.Fatalf("Failed to restore: %v", err)
+		}
+		if purged, err := metadataRepo.PurgeObject(metadata.ID, time.Now()); err != nil || purged {
+			t.Errorf("Expected a restored object not to be purged, got %v (%v)", purged, err)
+		}
+		if err := bin.Purge(metadata.ID); !errors.Is(err, ErrNotInTrash) {
+			t.Errorf("Expected ErrNotInTrash, got %v", err)
+		}
+		if _, err := metadataRepo.GetMetadata(metadata.ID); err != nil {
+			t.Errorf("Expected the restored object to be kept: %v", err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		first, second := store("first.txt"), store("second.txt")
+		discard(first)
+		discard(second)
+		before := refs(first.Hash)
+
+		if err := bin.Purge(first.ID); err != nil {
+			t.Fatalf("Failed to purge: %v", err)
+		}
+		if err := bin.Purge(first.ID); !errors.Is(err, ErrNotInTrash) {
+			t.Errorf("Expected ErrNotInTrash, got %v", err)
+		}
+
+		report, err := bin.Empty(ctx)
+		if err != nil {
+			t.Fatalf("Failed to empty the trash: %v", err)
+		}
+		if report.Purged != 1 {
+			t.Errorf("Expected one object purged, got %+v", report)
+		}
+		if count := refs(first.Hash); count != before-2 {
+			t.Errorf("Expected purging to release both references, got %d of %d", count, before)
+		}
+
+		items, err := bin.List(10, 0)
+		if err != nil {
+			t.Fatalf("Failed to list trash: %v", err)
+		}
+		if len(items) != 0 {
+			t.Errorf("Expected an empty trash, got %d objects", len(items))
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		if !bin.Enabled() {
+			t.Error("Expected a window to enable the trash")
+		}
+		if NewBin(metadataRepo, &Config{}).Enabled() {
+			t.Error("Expected no window to disable the trash")
+		}
+	})
+}
@@ -11,13 +11,17 @@ type File struct {
 	LastAccessed time.Time
 }
 
-// FileMetadata represents metadata associated with a stored file
+// FileMetadata represents metadata associated with a stored file.
+// ID identifies this logical file; Hash is the content ID of its content,
+// which may be shared with other files.
 type FileMetadata struct {
-	SHA1         string            `json:"sha1" db:"sha1"`
+	ID           string            `json:"id" db:"id"`
+	Hash         string            `json:"hash" db:"hash"`
 	FileName     string            `json:"file_name" db:"file_name"`
 	ContentType  string            `json:"content_type" db:"content_type"`
 	Size         int64             `json:"size" db:"size"`
 	UploadedBy   string            `json:"uploaded_by" db:"uploaded_by"`
+	APIKeyID     string            `json:"api_key_id,omitempty" db:"api_key_id"` // fingerprint of the API key used to upload
 	UploadedAt   time.Time         `json:"uploaded_at" db:"uploaded_at"`
 	LastAccessed time.Time         `json:"last_accessed" db:"last_accessed"`
 	AccessCount  int64             `json:"access_count" db:"access_count"`
@@ -27,10 +31,38 @@ type FileMetadata struct {
 	IsPublic     bool              `json:"is_public" db:"is_public"`
 	ExpiresAt    *time.Time        `json:"expires_at" db:"expires_at"`
 	Version      int               `json:"version" db:"version"`
+	Digests      map[string]string `json:"digests,omitempty" db:"-"` // algorithm -> hex digest
+	Tier         string            `json:"tier,omitempty" db:"-"`    // storage tier holding its content
+
+	// Retention protects the object from being changed or deleted until
+	// RetainUntil; a legal hold protects it until the hold is released
+	RetentionMode string     `json:"retention_mode,omitempty" db:"retention_mode"`
+	RetainUntil   *time.Time `json:"retain_until,omitempty" db:"retain_until"`
+	LegalHold     bool       `json:"legal_hold,omitempty" db:"legal_hold"`
+
+	// DeletedAt is when the object was moved to the trash, nil while it is live
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+// Expired reports whether the object has passed its expiry time at now
+func (m *FileMetadata) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// Retained reports whether the object's retention period still runs at now
+func (m *FileMetadata) Retained(now time.Time) bool {
+	return m.RetentionMode != "" && m.RetainUntil != nil && now.Before(*m.RetainUntil)
+}
+
+// Locked reports whether the object may not be changed or deleted at now,
+// because its retention period still runs or it is under legal hold
+func (m *FileMetadata) Locked(now time.Time) bool {
+	return m.LegalHold || m.Retained(now)
 }
 
 // MetadataFilter represents filtering criteria for metadata queries
 type MetadataFilter struct {
+	Hash          string     `json:"hash"`
 	FileName      string     `json:"file_name"`
 	ContentType   string     `json:"content_type"`
 	UploadedBy    string     `json:"uploaded_by"`
@@ -56,7 +88,8 @@ type APIResponse struct {
 
 // FileUploadResponse represents response for file upload
 type FileUploadResponse struct {
-	SHA1    string `json:"sha1"`
+	ID      string `json:"id"`
+	Hash    string `json:"hash"`
 	Size    int64  `json:"size"`
 	Success bool   `json:"success"`
 	Message string `json:"message"`
@@ -65,6 +98,330 @@ type FileUploadResponse struct {
 // FileExistsResponse represents response for file existence check
 type FileExistsResponse struct {
 	Exists bool   `json:"exists"`
-	SHA1   string `json:"sha1,omitempty"`
+	Hash   string `json:"hash,omitempty"`
 	Size   int64  `json:"size,omitempty"`
-}
\ No newline at end of file
+}
+
+// UploadSession tracks a resumable upload. Length is -1 while the client has
+// deferred declaring it. Once finalized, ObjectID and Hash identify the
+// stored object.
+type UploadSession struct {
+	ID        string            `json:"id" db:"id"`
+	Length    int64             `json:"length" db:"length"`
+	Offset    int64             `json:"offset" db:"offset"`
+	Metadata  map[string]string `json:"metadata" db:"metadata"`
+	ObjectID  string            `json:"object_id,omitempty" db:"object_id"`
+	Hash      string            `json:"hash,omitempty" db:"hash"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at" db:"updated_at"`
+	ExpiresAt time.Time         `json:"expires_at" db:"expires_at"`
+}
+
+// Completed reports whether the upload has been finalized into an object
+func (s *UploadSession) Completed() bool {
+	return s.ObjectID != ""
+}
+
+// ChunkRef locates one chunk of chunked content
+type ChunkRef struct {
+	Hash   string `json:"hash" db:"chunk_hash"`
+	Offset int64  `json:"offset" db:"chunk_offset"`
+	Size   int64  `json:"size" db:"size"`
+}
+
+// Manifest lists the chunks that make up content stored in chunks, in order
+type Manifest struct {
+	Hash      string     `json:"hash" db:"blob_hash"`
+	Size      int64      `json:"size" db:"size"`
+	Chunks    []ChunkRef `json:"chunks" db:"-"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// BlobInfo describes how a blob is held in storage
+type BlobInfo struct {
+	Size       int64  `json:"size" db:"size"`
+	StoredSize int64  `json:"stored_size" db:"stored_size"`
+	Codec      string `json:"codec" db:"codec"`
+	// KeyID is the master key wrapping the blob's data key, or empty if it is not encrypted
+	KeyID string `json:"key_id,omitempty" db:"key_id"`
+}
+
+// Quota scopes: one global quota, and quotas per uploader and per API key
+const (
+	QuotaScopeGlobal = "global"
+	QuotaScopeUser   = "user"
+	QuotaScopeAPIKey = "api_key"
+)
+
+// Quota limits what a scope may hold. Subject names the user or API key
+// fingerprint it applies to, and is empty for the global quota. A zero limit
+// means unlimited.
+type Quota struct {
+	Scope      string    `json:"scope" db:"scope"`
+	Subject    string    `json:"subject" db:"subject"`
+	MaxBytes   int64     `json:"max_bytes" db:"max_bytes"`
+	MaxObjects int64     `json:"max_objects" db:"max_objects"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Usage is what a quota scope currently holds. Bytes counts every object in
+// full; UniqueBytes counts each distinct content once, and for the global
+// scope each distinct chunk once, which is what storage actually holds.
+type Usage struct {
+	Scope       string `json:"scope"`
+	Subject     string `json:"subject"`
+	Objects     int64  `json:"objects"`
+	Bytes       int64  `json:"bytes"`
+	UniqueBytes int64  `json:"unique_bytes"`
+}
+
+// Stores the integrity scrubber checks
+const (
+	IntegrityStoreBlobs  = "blobs"
+	IntegrityStoreChunks = "chunks"
+)
+
+// Integrity check statuses
+const (
+	// IntegrityOK means the content matched its hash
+	IntegrityOK = "ok"
+	// IntegrityCorrupt means the content did not match and could not be repaired
+	IntegrityCorrupt = "corrupt"
+	// IntegrityRepaired means the content did not match and was restored from a replica
+	IntegrityRepaired = "repaired"
+)
+
+// IntegrityCheck is the outcome of the last scrub of a blob or chunk.
+// VerifiedAt is the last time its content was found intact, if ever.
+type IntegrityCheck struct {
+	Store      string     `json:"store" db:"store"`
+	Hash       string     `json:"hash" db:"hash"`
+	Status     string     `json:"status" db:"status"`
+	Detail     string     `json:"detail,omitempty" db:"detail"`
+	CheckedAt  time.Time  `json:"checked_at" db:"checked_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty" db:"verified_at"`
+}
+
+// IntegritySummary counts the latest integrity checks by status
+type IntegritySummary struct {
+	Checked          int64      `json:"checked"`
+	OK               int64      `json:"ok"`
+	Corrupt          int64      `json:"corrupt"`
+	Repaired         int64      `json:"repaired"`
+	LastCheckedAt    *time.Time `json:"last_checked_at,omitempty"`
+	OldestVerifiedAt *time.Time `json:"oldest_verified_at,omitempty"`
+}
+
+// Migration statuses
+const (
+	// MigrationRunning means blobs are being moved, or will be once the service restarts
+	MigrationRunning = "running"
+	// MigrationCompleted means every blob was moved off the source backend
+	MigrationCompleted = "completed"
+	// MigrationFailed means the migration stopped on an error
+	MigrationFailed = "failed"
+	// MigrationCancelled means the migration was stopped before it completed
+	MigrationCancelled = "cancelled"
+)
+
+// Migration moves every blob and chunk from one storage backend to another.
+// The totals are what the source held when the migration started or resumed.
+type Migration struct {
+	ID         string     `json:"id" db:"id"`
+	Source     string     `json:"source" db:"source"`
+	Target     string     `json:"target" db:"target"`
+	Status     string     `json:"status" db:"status"`
+	BlobsTotal int64      `json:"blobs_total" db:"blobs_total"`
+	BytesTotal int64      `json:"bytes_total" db:"bytes_total"`
+	BlobsMoved int64      `json:"blobs_moved" db:"blobs_moved"`
+	BytesMoved int64      `json:"bytes_moved" db:"bytes_moved"`
+	Error      string     `json:"error,omitempty" db:"error"`
+	StartedAt  time.Time  `json:"started_at" db:"started_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+}
+
+// Bucket is a namespace of keys, each naming an object, as an S3 bucket is
+type Bucket struct {
+	Name      string    `json:"name" db:"name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	// MaxVersions is how many versions of each key are kept when versioning
+	// is enabled, the current one included. Zero keeps every version.
+	MaxVersions int `json:"max_versions" db:"max_versions"`
+	// RetentionMode and RetentionDays are the retention placed on every
+	// object written to the bucket that has none of its own
+	RetentionMode string `json:"retention_mode,omitempty" db:"retention_mode"`
+	RetentionDays int    `json:"retention_days,omitempty" db:"retention_days"`
+}
+
+// BucketEntry is a key in a bucket and the object stored under it. ETag is
+// the hex MD5 of the content S3 clients expect, which the content hash is not.
+type BucketEntry struct {
+	Bucket      string    `json:"bucket" db:"bucket"`
+	Key         string    `json:"key" db:"object_key"`
+	ObjectID    string    `json:"object_id" db:"object_id"`
+	ETag        string    `json:"etag" db:"etag"`
+	Size        int64     `json:"size" db:"size"`
+	ContentType string    `json:"content_type" db:"content_type"`
+	Version     int       `json:"version" db:"version"`
+	ModifiedAt  time.Time `json:"modified_at" db:"modified_at"`
+}
+
+// ObjectVersion is one version of the object stored under a key. Versions
+// are numbered from 1 per key, and the newest is the current one.
+type ObjectVersion struct {
+	Bucket      string    `json:"bucket" db:"bucket"`
+	Key         string    `json:"key" db:"object_key"`
+	Version     int       `json:"version" db:"version"`
+	ObjectID    string    `json:"object_id" db:"object_id"`
+	ETag        string    `json:"etag" db:"etag"`
+	Size        int64     `json:"size" db:"size"`
+	ContentType string    `json:"content_type" db:"content_type"`
+	IsCurrent   bool      `json:"is_current"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// MultipartUpload is an S3 multipart upload in progress. Its parts are staged
+// on disk until it is completed into one object stored under Key.
+type MultipartUpload struct {
+	ID          string            `json:"id" db:"id"`
+	Bucket      string            `json:"bucket" db:"bucket"`
+	Key         string            `json:"key" db:"object_key"`
+	ContentType string            `json:"content_type" db:"content_type"`
+	Metadata    map[string]string `json:"metadata" db:"metadata"`
+	Initiator   string            `json:"initiator" db:"initiator"`
+	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// MultipartPart is an uploaded part of a multipart upload. ETag is the hex
+// MD5 of the part.
+type MultipartPart struct {
+	UploadID   string    `json:"upload_id" db:"upload_id"`
+	PartNumber int       `json:"part_number" db:"part_number"`
+	ETag       string    `json:"etag" db:"etag"`
+	Size       int64     `json:"size" db:"size"`
+	ModifiedAt time.Time `json:"modified_at" db:"modified_at"`
+}
+
+// DownloadLink is a signed link serving one object without an API key until
+// it expires, is revoked or has been downloaded MaxDownloads times
+type DownloadLink struct {
+	ID           string     `json:"id" db:"id"`
+	ObjectID     string     `json:"object_id" db:"object_id"`
+	FileName     string     `json:"file_name,omitempty" db:"file_name"` // overrides the object's file name
+	Inline       bool       `json:"inline" db:"inline"`                 // served for display rather than as an attachment
+	MaxDownloads int        `json:"max_downloads" db:"max_downloads"`   // zero means unlimited
+	Downloads    int        `json:"downloads" db:"downloads"`
+	AllowedIP    string     `json:"allowed_ip,omitempty" db:"allowed_ip"` // the only client address served, if set
+	CreatedBy    string     `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+// ExpiryRecord is the audit record of an object deleted because it expired
+type ExpiryRecord struct {
+	ID        int64     `json:"id" db:"id"`
+	ObjectID  string    `json:"object_id" db:"object_id"`
+	Hash      string    `json:"hash" db:"blob_hash"`
+	FileName  string    `json:"file_name" db:"file_name"`
+	Size      int64     `json:"size" db:"size"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	DeletedAt time.Time `json:"deleted_at" db:"deleted_at"`
+}
+
+// Lifecycle rule actions
+const (
+	// LifecycleExpire expires matching objects, which stops serving them and
+	// leaves them to the expiry reaper
+	LifecycleExpire = "expire"
+	// LifecycleMove moves the content of matching objects to another storage backend
+	LifecycleMove = "move"
+	// LifecycleCompress rewrites the content of matching objects compressed
+	LifecycleCompress = "compress"
+	// LifecyclePrivate strips public access from matching objects
+	LifecyclePrivate = "private"
+)
+
+// Where lifecycle rules are declared
+const (
+	LifecycleSourceConfig = "config"
+	LifecycleSourceAPI    = "api"
+)
+
+// LifecycleRule acts on every stored object that meets all of its conditions.
+// Conditions left unset match every object.
+type LifecycleRule struct {
+	ID       string `yaml:"id" json:"id" db:"id"`
+	Disabled bool   `yaml:"disabled" json:"disabled" db:"disabled"`
+
+	Tags        []string `yaml:"tags" json:"tags,omitempty" db:"tags"`                         // every tag must be set
+	ContentType string   `yaml:"content_type" json:"content_type,omitempty" db:"content_type"` // exact, or a prefix ending in "/" such as "image/"
+	Bucket      string   `yaml:"bucket" json:"bucket,omitempty" db:"bucket"`                   // objects stored under a key in this bucket
+	Prefix      string   `yaml:"prefix" json:"prefix,omitempty" db:"prefix"`                   // objects stored under a key starting with this
+	MinSize     int64    `yaml:"min_size" json:"min_size,omitempty" db:"min_size"`
+	MaxSize     int64    `yaml:"max_size" json:"max_size,omitempty" db:"max_size"`    // zero means unbounded
+	AgeDays     int      `yaml:"age_days" json:"age_days,omitempty" db:"age_days"`    // days since upload
+	IdleDays    int      `yaml:"idle_days" json:"idle_days,omitempty" db:"idle_days"` // days since last access
+
+	Action  string `yaml:"action" json:"action" db:"action"`
+	Backend string `yaml:"backend" json:"backend,omitempty" db:"backend"` // where move puts content
+	Codec   string `yaml:"codec" json:"codec,omitempty" db:"codec"`       // what compress uses, gzip by default
+
+	Source    string    `yaml:"-" json:"source" db:"source"`
+	CreatedAt time.Time `yaml:"-" json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `yaml:"-" json:"updated_at" db:"updated_at"`
+}
+
+// Storage tiers content is kept in
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+	// TierDemoting marks content being moved to cold storage
+	TierDemoting = "demoting"
+)
+
+// BlobTier is the storage tier a blob is kept in
+type BlobTier struct {
+	Hash string `json:"hash" db:"hash"`
+	Size int64  `json:"size" db:"size"`
+	Tier string `json:"tier" db:"tier"`
+}
+
+// TierUsage counts the blobs kept in a storage tier and their size
+type TierUsage struct {
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Retention modes
+const (
+	// RetentionGovernance protects objects from everyone but privileged
+	// roles, who may bypass it
+	RetentionGovernance = "governance"
+	// RetentionCompliance protects objects from everyone, and its period can
+	// only be extended
+	RetentionCompliance = "compliance"
+)
+
+// RetentionRecord is the audit record of a change retention or a legal hold
+// would have prevented, made by a privileged role bypassing it
+type RetentionRecord struct {
+	ID            int64      `json:"id" db:"id"`
+	ObjectID      string     `json:"object_id" db:"object_id"`
+	Action        string     `json:"action" db:"action"`
+	Actor         string     `json:"actor" db:"actor"`
+	RetentionMode string     `json:"retention_mode,omitempty" db:"retention_mode"`
+	RetainUntil   *time.Time `json:"retain_until,omitempty" db:"retain_until"`
+	LegalHold     bool       `json:"legal_hold,omitempty" db:"legal_hold"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+}
+
+// SchemaMigration is a versioned change to the metadata database schema, and
+// when it was applied. AppliedAt is nil while it is pending.
+type SchemaMigration struct {
+	Version   int        `json:"version" db:"version"`
+	Name      string     `json:"name" db:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty" db:"applied_at"`
+}
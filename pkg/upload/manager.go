@@ -0,0 +1,470 @@
+// Package upload implements resumable uploads. A client creates a session,
+// appends chunks at the current offset for as long as it takes, and the
+// assembled content is committed through the file service once complete.
+//
+// Session state lives in the metadata repository and partial content in a
+// directory on disk, so uploads survive a server restart.
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zots0127/io/pkg/expiry"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/types"
+)
+
+// DefaultExpiration is how long a session is kept after its last activity
+const DefaultExpiration = 24 * time.Hour
+
+// DefaultCleanupInterval is how often expired sessions are removed
+const DefaultCleanupInterval = 10 * time.Minute
+
+// Upload errors
+var (
+	ErrSessionNotFound  = errors.New("upload session not found")
+	ErrSessionExpired   = errors.New("upload session expired")
+	ErrSessionLocked    = errors.New("upload session is in use")
+	ErrSessionCompleted = errors.New("upload session already completed")
+	ErrOffsetMismatch   = errors.New("upload offset mismatch")
+	ErrExceedsLength    = errors.New("upload exceeds declared length")
+	ErrLengthDeclared   = errors.New("upload length already declared")
+	ErrIncomplete       = errors.New("upload incomplete")
+	ErrTooLarge         = errors.New("upload too large")
+)
+
+// Config configures the upload manager
+type Config struct {
+	// Dir holds the partial content of sessions
+	Dir string `json:"dir"`
+	// Expiration is how long a session is kept after its last activity
+	Expiration time.Duration `json:"expiration"`
+	// CleanupInterval is how often expired sessions are removed
+	CleanupInterval time.Duration `json:"cleanup_interval"`
+	// MaxSize is the largest upload accepted. Zero means unlimited.
+	MaxSize int64 `json:"max_size"`
+}
+
+// Manager manages resumable upload sessions
+type Manager struct {
+	fileService  fileservice.FileService
+	metadataRepo *repository.MetadataRepository
+	config       *Config
+	logger       *log.Logger
+
+	locks sync.Map // session ID -> *sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewManager creates a new upload manager
+func NewManager(fileService fileservice.FileService, metadataRepo *repository.MetadataRepository, config *Config) *Manager {
+	if config.Expiration <= 0 {
+		config.Expiration = DefaultExpiration
+	}
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = DefaultCleanupInterval
+	}
+
+	// Directories are created lazily on write as well, so a failure here is not fatal
+	_ = os.MkdirAll(config.Dir, 0755)
+
+	return &Manager{
+		fileService:  fileService,
+		metadataRepo: metadataRepo,
+		config:       config,
+		logger:       log.New(os.Stdout, "[UPLOAD] ", log.LstdFlags),
+	}
+}
+
+// MaxSize returns the largest upload accepted, or zero if unlimited
+func (m *Manager) MaxSize() int64 {
+	return m.config.MaxSize
+}
+
+// Create starts a new session. length is the total upload size, or -1 to
+// declare it later. metadata describes the file that will be created.
+func (m *Manager) Create(length int64, metadata map[string]string) (*types.UploadSession, error) {
+	if length < -1 {
+		return nil, fmt.Errorf("invalid upload length: %d", length)
+	}
+	if m.config.MaxSize > 0 && length > m.config.MaxSize {
+		return nil, ErrTooLarge
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	now := time.Now().UTC()
+	session := &types.UploadSession{
+		ID:        uuid.New().String(),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(m.config.Expiration),
+	}
+
+	if err := os.MkdirAll(m.config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	file, err := os.OpenFile(m.partPath(session.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	file.Close()
+
+	if err := m.metadataRepo.SaveUploadSession(session); err != nil {
+		os.Remove(m.partPath(session.ID))
+		return nil, fmt.Errorf("failed to save upload session: %w", err)
+	}
+
+	// An upload of nothing is complete as soon as it exists
+	if length == 0 {
+		return m.withLock(session.ID, func() (*types.UploadSession, error) {
+			return m.finalize(context.Background(), session)
+		})
+	}
+
+	return session, nil
+}
+
+// Get returns the session identified by id
+func (m *Manager) Get(id string) (*types.UploadSession, error) {
+	session, err := m.metadataRepo.GetUploadSession(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("%w: %s", ErrSessionExpired, id)
+	}
+	return session, nil
+}
+
+// DeclareLength sets the total size of a session created with a deferred length
+func (m *Manager) DeclareLength(id string, length int64) (*types.UploadSession, error) {
+	return m.withLock(id, func() (*types.UploadSession, error) {
+		session, err := m.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if session.Length == length {
+			return session, nil
+		}
+		if session.Length >= 0 {
+			return nil, ErrLengthDeclared
+		}
+		if length < session.Offset {
+			return nil, ErrExceedsLength
+		}
+		if m.config.MaxSize > 0 && length > m.config.MaxSize {
+			return nil, ErrTooLarge
+		}
+
+		session.Length = length
+		if err := m.touch(session); err != nil {
+			return nil, err
+		}
+		return session, nil
+	})
+}
+
+// Write appends the content of reader to the session at offset, which must be
+// the session's current offset. Whatever was received before a read error is
+// kept, so the client can resume from the new offset. The session is
+// finalized once its declared length has been received.
+func (m *Manager) Write(ctx context.Context, id string, offset int64, reader io.Reader) (*types.UploadSession, error) {
+	return m.withLock(id, func() (*types.UploadSession, error) {
+		session, err := m.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if session.Completed() {
+			return nil, ErrSessionCompleted
+		}
+
+		file, err := os.OpenFile(m.partPath(id), os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open upload file: %w", err)
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat upload file: %w", err)
+		}
+		// Content past the recorded offset was never acknowledged and is
+		// dropped below. Content missing before it cannot be recovered, so
+		// the offset is rolled back and the client resumes from there.
+		if info.Size() < session.Offset {
+			session.Offset = info.Size()
+			if err := m.touch(session); err != nil {
+				return nil, err
+			}
+		}
+		if offset != session.Offset {
+			return nil, fmt.Errorf("%w: expected %d, got %d", ErrOffsetMismatch, session.Offset, offset)
+		}
+
+		if err := file.Truncate(offset); err != nil {
+			return nil, fmt.Errorf("failed to truncate upload file: %w", err)
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek upload file: %w", err)
+		}
+
+		limit, limitErr := session.Length, ErrExceedsLength
+		if limit < 0 || (m.config.MaxSize > 0 && limit > m.config.MaxSize) {
+			limit, limitErr = m.config.MaxSize, ErrTooLarge
+		}
+
+		var written int64
+		var writeErr error
+		if limit > 0 {
+			written, writeErr = io.Copy(file, io.LimitReader(reader, limit-offset))
+		} else {
+			written, writeErr = io.Copy(file, reader)
+		}
+
+		// Reject a chunk that runs past the limit as a whole
+		if writeErr == nil && limit > 0 && offset+written == limit {
+			var probe [1]byte
+			if n, _ := reader.Read(probe[:]); n > 0 {
+				if err := file.Truncate(offset); err != nil {
+					return nil, fmt.Errorf("failed to truncate upload file: %w", err)
+				}
+				return nil, limitErr
+			}
+		}
+
+		if err := file.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync upload file: %w", err)
+		}
+
+		session.Offset += written
+		if err := m.touch(session); err != nil {
+			return nil, err
+		}
+		if writeErr != nil {
+			return session, fmt.Errorf("failed to receive upload content: %w", writeErr)
+		}
+
+		if session.Length >= 0 && session.Offset == session.Length {
+			return m.finalize(ctx, session)
+		}
+		return session, nil
+	})
+}
+
+// Finalize commits a session whose content has been received in full. A
+// session with a deferred length takes its current offset as its length.
+// Finalizing a completed session returns it unchanged.
+func (m *Manager) Finalize(ctx context.Context, id string) (*types.UploadSession, error) {
+	return m.withLock(id, func() (*types.UploadSession, error) {
+		session, err := m.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if session.Completed() {
+			return session, nil
+		}
+		if session.Length < 0 {
+			session.Length = session.Offset
+		}
+		if session.Offset != session.Length {
+			return nil, fmt.Errorf("%w: received %d of %d bytes", ErrIncomplete, session.Offset, session.Length)
+		}
+		return m.finalize(ctx, session)
+	})
+}
+
+// Terminate abandons a session and removes its partial content
+func (m *Manager) Terminate(id string) error {
+	_, err := m.withLock(id, func() (*types.UploadSession, error) {
+		if _, err := m.metadataRepo.GetUploadSession(id); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+		}
+		return nil, m.remove(id)
+	})
+	return err
+}
+
+// CleanExpired removes sessions past their expiry together with their
+// partial content. Sessions in use are left for the next run. It returns
+// the number of sessions removed.
+func (m *Manager) CleanExpired() (int, error) {
+	sessions, err := m.metadataRepo.ListExpiredUploadSessions(time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expired upload sessions: %w", err)
+	}
+
+	removed := 0
+	for _, session := range sessions {
+		_, err := m.withLock(session.ID, func() (*types.UploadSession, error) {
+			return nil, m.remove(session.ID)
+		})
+		if err != nil {
+			if !errors.Is(err, ErrSessionLocked) {
+				m.logger.Printf("Failed to remove expired session %s: %v", session.ID, err)
+			}
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		m.logger.Printf("Removed %d expired upload sessions", removed)
+	}
+	return removed, nil
+}
+
+// Start removes expired sessions every cleanup interval until Stop is called
+func (m *Manager) Start() {
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(m.config.CleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.CleanExpired(); err != nil {
+					m.logger.Printf("Cleanup failed: %v", err)
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background cleanup
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// finalize streams the received content through the file service and records
+// the resulting object. The session is kept until it expires so a client that
+// missed the response can still look the object up.
+func (m *Manager) finalize(ctx context.Context, session *types.UploadSession) (*types.UploadSession, error) {
+	file, err := os.Open(m.partPath(session.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer file.Close()
+
+	metadata := fileMetadata(session.Metadata)
+	metadata.Size = session.Length
+	stored, err := m.fileService.StoreStream(ctx, io.LimitReader(file, session.Length), metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store upload: %w", err)
+	}
+
+	session.ObjectID = stored.ID
+	session.Hash = stored.Hash
+	if err := m.touch(session); err != nil {
+		return nil, err
+	}
+
+	file.Close()
+	if err := os.Remove(m.partPath(session.ID)); err != nil && !os.IsNotExist(err) {
+		m.logger.Printf("Warning: failed to remove upload file for %s: %v", session.ID, err)
+	}
+	return session, nil
+}
+
+// touch records session activity and extends its expiry
+func (m *Manager) touch(session *types.UploadSession) error {
+	session.UpdatedAt = time.Now().UTC()
+	session.ExpiresAt = session.UpdatedAt.Add(m.config.Expiration)
+	if err := m.metadataRepo.SaveUploadSession(session); err != nil {
+		return fmt.Errorf("failed to save upload session: %w", err)
+	}
+	return nil
+}
+
+// remove deletes a session and its partial content
+func (m *Manager) remove(id string) error {
+	if err := os.Remove(m.partPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload file: %w", err)
+	}
+	if err := m.metadataRepo.DeleteUploadSession(id); err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	m.locks.Delete(id)
+	return nil
+}
+
+// withLock runs fn while holding the session's lock. A session handles one
+// request at a time; concurrent requests fail with ErrSessionLocked.
+func (m *Manager) withLock(id string, fn func() (*types.UploadSession, error)) (*types.UploadSession, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+
+	value, _ := m.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, ErrSessionLocked
+	}
+	defer mu.Unlock()
+
+	return fn()
+}
+
+// partPath returns the path of a session's partial content
+func (m *Manager) partPath(id string) string {
+	return filepath.Join(m.config.Dir, id)
+}
+
+// fileMetadata builds the metadata of the file created by a session
+func fileMetadata(metadata map[string]string) *types.FileMetadata {
+	fileMetadata := &types.FileMetadata{
+		FileName:    metadata["filename"],
+		ContentType: metadata["filetype"],
+		UploadedBy:  metadata["uploaded_by"],
+		APIKeyID:    metadata["api_key_id"],
+		Description: metadata["description"],
+		IsPublic:    metadata["is_public"] == "true",
+		Hash:        metadata["hash"],
+	}
+
+	if tags := metadata["tags"]; tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				fileMetadata.Tags = append(fileMetadata.Tags, tag)
+			}
+		}
+	}
+
+	// A TTL counts from when the upload completes. Both were validated when
+	// the session was created.
+	if expiresAt, err := expiry.ExpiresAt(metadata["ttl"], metadata["expires_at"], time.Now()); err == nil {
+		fileMetadata.ExpiresAt = expiresAt
+	}
+
+	return fileMetadata
+}
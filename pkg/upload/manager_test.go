@@ -0,0 +1,187 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zots0127/io/pkg/digest"
+	"github.com/zots0127/io/pkg/metadata/repository"
+	fileservice "github.com/zots0127/io/pkg/service"
+	"github.com/zots0127/io/pkg/storage/service"
+)
+
+func TestManager(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_upload")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := service.NewStorageWithAlgorithm(filepath.Join(tempDir, "storage"), digest.SHA256)
+	metadataRepo, err := repository.NewMetadataRepository(filepath.Join(tempDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("Failed to create metadata repository: %v", err)
+	}
+	defer metadataRepo.Close()
+
+	config := fileservice.DefaultServiceConfig()
+	config.EnableLogging = false
+	fileService := fileservice.NewFileService(storage, metadataRepo, config)
+
+	newManager := func() *Manager {
+		return NewManager(fileService, metadataRepo, &Config{
+			Dir:     filepath.Join(tempDir, "uploads"),
+			MaxSize: 1024,
+		})
+	}
+	manager := newManager()
+	ctx := context.Background()
+	data := []byte(strings.Repeat("resumable ", 20))
+
+	t.Run("ChunkedUploadSurvivesRestart", func(t *testing.T) {
+		session, err := manager.Create(int64(len(data)), map[string]string{"filename": "chunked.txt", "tags": "a, b"})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+
+		session, err = manager.Write(ctx, session.ID, 0, bytes.NewReader(data[:50]))
+		if err != nil {
+			t.Fatalf("Failed to write chunk: %v", err)
+		}
+		if session.Offset != 50 {
+			t.Errorf("Expected offset 50, got %d", session.Offset)
+		}
+
+		// A new manager sees the same session, as after a restart
+		manager = newManager()
+		session, err = manager.Get(session.ID)
+		if err != nil {
+			t.Fatalf("Session lost across restart: %v", err)
+		}
+		if session.Offset != 50 {
+			t.Errorf("Expected offset 50 after restart, got %d", session.Offset)
+		}
+
+		if _, err := manager.Write(ctx, session.ID, 10, bytes.NewReader(data[10:])); !errors.Is(err, ErrOffsetMismatch) {
+			t.Errorf("Expected ErrOffsetMismatch, got %v", err)
+		}
+
+		session, err = manager.Write(ctx, session.ID, 50, bytes.NewReader(data[50:]))
+		if err != nil {
+			t.Fatalf("Failed to write final chunk: %v", err)
+		}
+		if !session.Completed() {
+			t.Fatal("Expected the last chunk to finalize the upload")
+		}
+		if session.Hash != digest.Sum(digest.SHA256, data) {
+			t.Errorf("Unexpected hash %s", session.Hash)
+		}
+
+		metadata, err := metadataRepo.GetMetadata(session.ObjectID)
+		if err != nil {
+			t.Fatalf("Finalized object not found: %v", err)
+		}
+		if metadata.FileName != "chunked.txt" || metadata.Size != int64(len(data)) || len(metadata.Tags) != 2 {
+			t.Errorf("Unexpected object metadata: %+v", metadata)
+		}
+		if _, err := os.Stat(manager.partPath(session.ID)); !os.IsNotExist(err) {
+			t.Error("Partial content should be removed once finalized")
+		}
+
+		if _, err := manager.Write(ctx, session.ID, session.Offset, bytes.NewReader(data)); !errors.Is(err, ErrSessionCompleted) {
+			t.Errorf("Expected ErrSessionCompleted, got %v", err)
+		}
+	})
+
+	t.Run("ChunkPastLength", func(t *testing.T) {
+		session, err := manager.Create(10, nil)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+
+		if _, err := manager.Write(ctx, session.ID, 0, bytes.NewReader(data[:11])); !errors.Is(err, ErrExceedsLength) {
+			t.Errorf("Expected ErrExceedsLength, got %v", err)
+		}
+		if session, _ = manager.Get(session.ID); session.Offset != 0 {
+			t.Errorf("Rejected chunk should not advance the offset, got %d", session.Offset)
+		}
+	})
+
+	t.Run("DeferredLength", func(t *testing.T) {
+		session, err := manager.Create(-1, map[string]string{"filename": "deferred.txt"})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+
+		if _, err := manager.Write(ctx, session.ID, 0, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to write chunk: %v", err)
+		}
+		session, err = manager.Finalize(ctx, session.ID)
+		if err != nil {
+			t.Fatalf("Failed to finalize: %v", err)
+		}
+		if !session.Completed() || session.Length != int64(len(data)) {
+			t.Errorf("Unexpected finalized session: %+v", session)
+		}
+
+		if _, err := manager.Create(2048, nil); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("Expected ErrTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("FinalizeIncomplete", func(t *testing.T) {
+		session, err := manager.Create(int64(len(data)), nil)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		if _, err := manager.Finalize(ctx, session.ID); !errors.Is(err, ErrIncomplete) {
+			t.Errorf("Expected ErrIncomplete, got %v", err)
+		}
+	})
+
+	t.Run("Terminate", func(t *testing.T) {
+		session, err := manager.Create(int64(len(data)), nil)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		if err := manager.Terminate(session.ID); err != nil {
+			t.Fatalf("Failed to terminate: %v", err)
+		}
+		if _, err := manager.Get(session.ID); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("Expected ErrSessionNotFound, got %v", err)
+		}
+	})
+
+	t.Run("CleanExpired", func(t *testing.T) {
+		short := NewManager(fileService, metadataRepo, &Config{
+			Dir:        filepath.Join(tempDir, "uploads"),
+			Expiration: time.Millisecond,
+		})
+		session, err := short.Create(int64(len(data)), nil)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if _, err := short.Get(session.ID); !errors.Is(err, ErrSessionExpired) {
+			t.Errorf("Expected ErrSessionExpired, got %v", err)
+		}
+
+		removed, err := short.CleanExpired()
+		if err != nil {
+			t.Fatalf("Failed to clean expired sessions: %v", err)
+		}
+		if removed == 0 {
+			t.Error("Expected the expired session to be removed")
+		}
+		if _, err := os.Stat(short.partPath(session.ID)); !os.IsNotExist(err) {
+			t.Error("Expired partial content should be removed")
+		}
+	})
+}
@@ -35,6 +35,7 @@ func (h *WebHandlers) RegisterWebRoutes(r *gin.Engine) {
 		web.GET("/dashboard", h.dashboardHandler)
 		web.GET("/files", h.filesHandler)
 		web.GET("/files/upload", h.uploadHandler)
+		web.GET("/trash", h.trashHandler)
 		web.GET("/batch", h.batchHandler)
 		web.GET("/batch/upload", h.batchUploadHandler)
 		web.GET("/monitoring", h.monitoringHandler)
@@ -110,6 +111,16 @@ func (h *WebHandlers) uploadHandler(c *gin.Context) {
 	})
 }
 
+// trashHandler shows deleted files, which can be restored or purged
+func (h *WebHandlers) trashHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "trash.html", gin.H{
+		"title":      "Trash - IO Storage System",
+		"page":       "trash",
+		"limitParam": h.getLimitParam(c, 50),
+		"basePath":   h.getBasePath(c),
+	})
+}
+
 func (h *WebHandlers) batchHandler(c *gin.Context) {
 	c.HTML(http.StatusOK, "batch.html", gin.H{
 		"title":     "Batch Operations - IO Storage System",
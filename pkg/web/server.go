@@ -77,6 +77,7 @@ func NewServer(batchAPI *api.BatchAPI, config *Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize template manager: %w", err)
 	}
+	engine.HTMLRender = templateMgr
 
 	// Create router
 	router := NewRouter(batchAPI, config.StaticPath, config.TemplatePath)
@@ -173,12 +174,9 @@ func (s *Server) setupAPIRoutes() {
 	v1 := s.engine.Group("/api/v1")
 	{
 		// Files API
+		// Upload, get, delete and metadata routes are registered by the web handlers
 		files := v1.Group("/files")
 		{
-			files.POST("/upload", s.handlers.fileUploadHandler)
-			files.GET("/:sha1", s.handlers.fileGetHandler)
-			files.DELETE("/:sha1", s.handlers.fileDeleteHandler)
-			files.PUT("/:sha1/metadata", s.handlers.fileMetadataHandler)
 			files.GET("/:sha1/download", s.fileDownloadHandler)
 			files.GET("/:sha1/thumbnail", s.fileThumbnailHandler)
 		}
@@ -187,14 +185,12 @@ func (s *Server) setupAPIRoutes() {
 		search := v1.Group("/search")
 		{
 			search.GET("/", s.handlers.searchHandler)
-			search.POST("/advanced", s.handlers.advancedSearchHandler)
 		}
 
 		// Statistics API
 		stats := v1.Group("/stats")
 		{
 			stats.GET("/", s.handlers.statsHandler)
-			stats.GET("/storage", s.handlers.storageStatsAPIHandler)
 		}
 
 		// Batch API
@@ -213,15 +209,6 @@ func (s *Server) setupAPIRoutes() {
 			batch.GET("/ready", s.batchReadyHandler)
 		}
 	}
-
-	// Legacy API routes for backward compatibility
-	legacy := s.engine.Group("/api")
-	{
-		legacy.GET("/stats", s.handlers.statsHandler)
-		legacy.GET("/storage/stats", s.handlers.storageStatsHandler)
-		legacy.GET("/files/list", s.handlers.filesListHandler)
-		legacy.GET("/batch/active", s.handlers.activeBatchesHandler)
-	}
 }
 
 // Handler methods
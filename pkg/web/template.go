@@ -4,15 +4,19 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
 )
 
 // TemplateManager manages HTML templates
 type TemplateManager struct {
 	templates map[string]*template.Template
+	pages     map[string]*template.Template
+	layout    *template.Template
 	funcMap   template.FuncMap
 }
 
@@ -20,6 +24,7 @@ type TemplateManager struct {
 func NewTemplateManager(templatePath string) (*TemplateManager, error) {
 	tm := &TemplateManager{
 		templates: make(map[string]*template.Template),
+		pages:     make(map[string]*template.Template),
 		funcMap:   createFuncMap(),
 	}
 
@@ -29,6 +34,11 @@ func NewTemplateManager(templatePath string) (*TemplateManager, error) {
 		return nil, err
 	}
 
+	// Load pages
+	if err := tm.loadPages(templatePath); err != nil {
+		return nil, err
+	}
+
 	return tm, nil
 }
 
@@ -87,6 +97,7 @@ func (tm *TemplateManager) loadTemplates(templatePath string) error {
 		"dashboard.html",
 		"files.html",
 		"upload.html",
+		"trash.html",
 		"batch.html",
 		"batch-upload.html",
 		"monitoring.html",
@@ -118,6 +129,47 @@ func (tm *TemplateManager) loadTemplates(templatePath string) error {
 	return nil
 }
 
+// loadPages parses each page in the template directory together with the
+// base layout, which renders the page's "content" block
+func (tm *TemplateManager) loadPages(templatePath string) error {
+	layoutPath := filepath.Join(templatePath, "layouts", "base.html")
+	if _, err := os.Stat(layoutPath); err != nil {
+		tm.layout = template.Must(template.New("base.html").Parse(`{{block "content" .}}{{end}}`))
+		return nil
+	}
+
+	layout, err := template.New("base.html").Funcs(tm.funcMap).ParseFiles(layoutPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse layout: %w", err)
+	}
+	tm.layout = layout
+
+	files, err := filepath.Glob(filepath.Join(templatePath, "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		page, err := template.New("base.html").Funcs(tm.funcMap).ParseFiles(layoutPath, file)
+		if err != nil {
+			return fmt.Errorf("failed to parse page %s: %w", filepath.Base(file), err)
+		}
+		tm.pages[filepath.Base(file)] = page
+	}
+
+	return nil
+}
+
+// Instance returns page name rendered inside the base layout, so the manager
+// serves as the engine's HTML renderer. A page without a template file
+// renders the layout alone.
+func (tm *TemplateManager) Instance(name string, data interface{}) render.Render {
+	page, ok := tm.pages[name]
+	if !ok {
+		page = tm.layout
+	}
+	return render.HTML{Template: page, Name: "base.html", Data: data}
+}
+
 // Render renders a template with the given data
 func (tm *TemplateManager) Render(c *gin.Context, templateName string, data gin.H) {
 	tmpl, exists := tm.templates[templateName]